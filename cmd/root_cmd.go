@@ -6,6 +6,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/crypto"
+	"github.com/supabase/gotrue/internal/models"
 	"github.com/supabase/gotrue/internal/observability"
 )
 
@@ -52,6 +54,13 @@ func loadGlobalConfig(ctx context.Context) *conf.GlobalConfiguration {
 	if err := observability.ConfigureProfiler(ctx, &config.Profiler); err != nil {
 		logrus.WithError(err).Error("unable to configure profiler")
 	}
+
+	crypto.ConfigurePasswordHashing(&config.Security)
+	if err := crypto.ConfigureEncryption(&config.Security); err != nil {
+		logrus.WithError(err).Fatal("unable to configure encryption")
+	}
+	models.EncryptedIdentityDataFields = config.Security.EncryptedIdentityDataFields
+
 	return config
 }
 
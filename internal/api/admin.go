@@ -117,8 +117,9 @@ func (a *API) adminUsers(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	filter := r.URL.Query().Get("filter")
+	includeDeleted := r.URL.Query().Get("include_deleted") == "true"
 
-	users, err := models.FindUsersInAudience(db, aud, pageParams, sortParams, filter)
+	users, err := models.FindUsersInAudience(db, aud, pageParams, sortParams, filter, includeDeleted)
 	if err != nil {
 		return internalServerError("Database error finding users").WithInternalError(err)
 	}
@@ -157,7 +158,7 @@ func (a *API) adminUserUpdate(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if params.Phone != "" {
-		params.Phone, err = validatePhone(params.Phone)
+		params.Phone, err = validatePhone(params.Phone, config.Sms.DefaultRegion)
 		if err != nil {
 			return err
 		}
@@ -200,6 +201,10 @@ func (a *API) adminUserUpdate(w http.ResponseWriter, r *http.Request) error {
 				return invalidPasswordLengthError(config.PasswordMinLength)
 			}
 
+			if terr := a.recordPasswordHistory(tx, user); terr != nil {
+				return terr
+			}
+
 			if terr := user.UpdatePassword(tx, *params.Password, nil); terr != nil {
 				return terr
 			}
@@ -329,7 +334,7 @@ func (a *API) adminUserCreate(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if params.Phone != "" {
-		params.Phone, err = validatePhone(params.Phone)
+		params.Phone, err = validatePhone(params.Phone, config.Sms.DefaultRegion)
 		if err != nil {
 			return err
 		}
@@ -507,10 +512,10 @@ func (a *API) adminUserDelete(w http.ResponseWriter, r *http.Request) error {
 			if terr := models.LogoutAllRefreshTokens(tx, user.ID); terr != nil {
 				return internalServerError("Error deleting user's refresh tokens").WithInternalError(terr)
 			}
-		} else {
-			if terr := tx.Destroy(user); terr != nil {
-				return internalServerError("Database error deleting user").WithInternalError(terr)
-			}
+		} else if a.config.Security.SoftDeleteUsers && user.IsDeleted() {
+			return nil
+		} else if terr := a.deleteUser(tx, user); terr != nil {
+			return terr
 		}
 
 		return nil
@@ -522,6 +527,79 @@ func (a *API) adminUserDelete(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, map[string]interface{}{})
 }
 
+// deleteUser deletes the user, only marking it as deleted and revoking its
+// sessions if SECURITY_SOFT_DELETE_USERS is enabled.
+func (a *API) deleteUser(tx *storage.Connection, user *models.User) error {
+	if !a.config.Security.SoftDeleteUsers {
+		if terr := tx.Destroy(user); terr != nil {
+			return internalServerError("Database error deleting user").WithInternalError(terr)
+		}
+		return nil
+	}
+
+	if terr := user.MarkDeleted(tx); terr != nil {
+		return internalServerError("Error soft deleting user").WithInternalError(terr)
+	}
+	if terr := models.Logout(tx, user.ID); terr != nil {
+		return internalServerError("Error deleting user's sessions").WithInternalError(terr)
+	}
+	if terr := models.LogoutAllRefreshTokens(tx, user.ID); terr != nil {
+		return internalServerError("Error deleting user's refresh tokens").WithInternalError(terr)
+	}
+	return nil
+}
+
+// adminUserRestore restores a soft deleted user.
+func (a *API) adminUserRestore(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	adminUser := getAdminUser(ctx)
+
+	if !user.IsDeleted() {
+		return badRequestError("User is not deleted")
+	}
+
+	err := a.db.WithContext(ctx).Transaction(func(tx *storage.Connection) error {
+		if terr := user.Restore(tx); terr != nil {
+			return internalServerError("Database error updating user").WithInternalError(terr)
+		}
+
+		return models.NewAuditLogEntry(r, tx, adminUser, models.UserRestoredAction, "", map[string]interface{}{
+			"user_id":    user.ID,
+			"user_email": user.Email,
+			"user_phone": user.Phone,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, user)
+}
+
+// adminUserUnlock unlocks password logins of a user that were locked after
+// too many failed attempts.
+func (a *API) adminUserUnlock(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	adminUser := getAdminUser(ctx)
+
+	err := a.db.WithContext(ctx).Transaction(func(tx *storage.Connection) error {
+		if terr := user.ResetFailedLoginAttempts(tx); terr != nil {
+			return internalServerError("Database error updating user").WithInternalError(terr)
+		}
+
+		return models.NewAuditLogEntry(r, tx, adminUser, models.UserUnlockedAction, "", map[string]interface{}{
+			"user_id": user.ID,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, user)
+}
+
 func (a *API) adminUserDeleteFactor(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	user := getUser(ctx)
@@ -555,6 +633,48 @@ func (a *API) adminUserGetFactors(w http.ResponseWriter, r *http.Request) error
 	return sendJSON(w, http.StatusOK, factors)
 }
 
+// adminUserRegenerateRecoveryCodes replaces the recovery codes of a TOTP
+// factor, invalidating the previous ones
+func (a *API) adminUserRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	factor := getFactor(ctx)
+	user := getUser(ctx)
+	adminUser := getAdminUser(ctx)
+	config := a.config
+
+	if !factor.IsOwnedBy(user) {
+		return notFoundError("Factor not found")
+	}
+	if factor.FactorType != models.TOTP {
+		return badRequestError("Recovery codes are only supported for totp factors")
+	}
+	if config.MFA.RecoveryCodesCount <= 0 {
+		return badRequestError(RecoveryCodesDisabledMessage)
+	}
+
+	var recoveryCodes []string
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if recoveryCodes, terr = models.RegenerateRecoveryCodes(tx, factor, config.MFA.RecoveryCodesCount); terr != nil {
+			return terr
+		}
+		if terr = models.NewAuditLogEntry(r, tx, adminUser, models.GenerateRecoveryCodesAction, "", map[string]interface{}{
+			"user_id":   user.ID,
+			"factor_id": factor.ID,
+		}); terr != nil {
+			return terr
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, &RecoveryCodesResponse{
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
 // adminUserUpdate updates a single factor object
 func (a *API) adminUserUpdateFactor(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
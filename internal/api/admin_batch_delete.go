@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+const (
+	// adminBatchDeleteBatchSize is the number of users loaded and deleted
+	// at a time.
+	adminBatchDeleteBatchSize = 100
+
+	// adminBatchDeleteConfirmationExpiry is how long the confirmation token
+	// of a dry run can be used to delete the users it counted.
+	adminBatchDeleteConfirmationExpiry = 10 * time.Minute
+
+	// adminBatchDeleteAudience is the audience of confirmation tokens, so
+	// that other tokens signed with the JWT secret are never accepted.
+	adminBatchDeleteAudience = "admin:users:delete"
+)
+
+// emailDomainRegexp matches domain names of one or more labels, never
+// wildcards.
+var emailDomainRegexp = regexp.MustCompile(`^[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)*$`)
+
+// AdminBatchDeleteParams deletes the users selected by the filter. Deleting
+// them requires the confirmation token of a dry run with the same filter,
+// which is the default.
+type AdminBatchDeleteParams struct {
+	models.UserFilter
+	DryRun            *bool  `json:"dry_run"`
+	ConfirmationToken string `json:"confirmation_token"`
+}
+
+type AdminBatchDeleteResponse struct {
+	Count             int    `json:"count"`
+	DryRun            bool   `json:"dry_run"`
+	ConfirmationToken string `json:"confirmation_token,omitempty"`
+}
+
+// batchDeleteClaims are the claims of confirmation tokens, which bind the
+// deletion to the filter and the number of users of the dry run.
+type batchDeleteClaims struct {
+	jwt.StandardClaims
+	Filter string `json:"filter"`
+	Count  int    `json:"count"`
+}
+
+// adminUsersBatchDelete counts, or deletes, the users of the audience
+// selected by a filter, such as test or bot accounts. The users are deleted
+// in batches in a single transaction.
+func (a *API) adminUsersBatchDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.db.WithContext(ctx)
+	config := a.config
+	adminUser := getAdminUser(ctx)
+	aud := a.requestAud(ctx, r)
+
+	body, err := getBodyBytes(r)
+	if err != nil {
+		return badRequestError("Could not read body").WithInternalError(err)
+	}
+
+	params := &AdminBatchDeleteParams{}
+	if err := json.Unmarshal(body, params); err != nil {
+		return badRequestError("Could not decode batch delete params: %v", err)
+	}
+
+	// an empty email_domain is rejected rather than ignored
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return badRequestError("Could not decode batch delete params: %v", err)
+	}
+
+	filter := &params.UserFilter
+	if _, ok := fields["email_domain"]; ok && !emailDomainRegexp.MatchString(filter.EmailDomain) {
+		return badRequestError("Invalid email_domain")
+	}
+
+	if filter.IsEmpty() {
+		return badRequestError("At least one of email_domain, created_before or never_confirmed is required")
+	}
+
+	encodedFilter, err := json.Marshal(filter)
+	if err != nil {
+		return internalServerError("Error encoding filter").WithInternalError(err)
+	}
+
+	if params.DryRun == nil || *params.DryRun {
+		count, err := models.CountFilteredUsers(db, aud, filter)
+		if err != nil {
+			return internalServerError("Database error counting users").WithInternalError(err)
+		}
+
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &batchDeleteClaims{
+			StandardClaims: jwt.StandardClaims{
+				Audience:  adminBatchDeleteAudience,
+				Subject:   aud,
+				ExpiresAt: a.now().Add(adminBatchDeleteConfirmationExpiry).Unix(),
+			},
+			Filter: string(encodedFilter),
+			Count:  count,
+		}).SignedString([]byte(config.JWT.Secret))
+		if err != nil {
+			return internalServerError("Error generating confirmation token").WithInternalError(err)
+		}
+
+		return sendJSON(w, http.StatusOK, &AdminBatchDeleteResponse{
+			Count:             count,
+			DryRun:            true,
+			ConfirmationToken: token,
+		})
+	}
+
+	claims := &batchDeleteClaims{}
+	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
+	if _, err := p.ParseWithClaims(params.ConfirmationToken, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(config.JWT.Secret), nil
+	}); err != nil {
+		return badRequestError("A valid confirmation_token of a dry run is required").WithInternalError(err)
+	}
+
+	if !claims.VerifyAudience(adminBatchDeleteAudience, true) || claims.Subject != aud || claims.Filter != string(encodedFilter) {
+		return badRequestError("The confirmation_token is for a different filter")
+	}
+
+	deleted := 0
+	err = db.Transaction(func(tx *storage.Connection) error {
+		count, terr := models.CountFilteredUsers(tx, aud, filter)
+		if terr != nil {
+			return internalServerError("Database error counting users").WithInternalError(terr)
+		}
+
+		if count != claims.Count {
+			return conflictError("The matching users changed since the dry run, run it again")
+		}
+
+		for deleted < count {
+			users, terr := models.FindFilteredUsers(tx, aud, filter, adminBatchDeleteBatchSize)
+			if terr != nil {
+				return internalServerError("Database error finding users").WithInternalError(terr)
+			}
+
+			if len(users) == 0 {
+				break
+			}
+
+			for _, user := range users {
+				if terr := a.deleteUser(tx, user); terr != nil {
+					return terr
+				}
+				deleted++
+			}
+		}
+
+		return models.NewAuditLogEntry(r, tx, adminUser, models.UsersBatchDeletedAction, "", map[string]interface{}{
+			"filter": filter,
+			"count":  deleted,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, &AdminBatchDeleteResponse{
+		Count:  deleted,
+		DryRun: false,
+	})
+}
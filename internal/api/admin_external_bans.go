@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// adminExternalBanParams bans a subject of an external provider. The ban is
+// permanent unless BanDuration is set.
+type adminExternalBanParams struct {
+	Provider    string `json:"provider"`
+	Subject     string `json:"subject"`
+	BanDuration string `json:"ban_duration"`
+}
+
+type AdminExternalBansResponse struct {
+	Bans []*models.ExternalSubjectBan `json:"bans"`
+}
+
+// adminExternalBans lists the bans of external subjects, including expired
+// ones.
+func (a *API) adminExternalBans(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	bans, err := models.FindExternalSubjectBans(a.db.WithContext(ctx))
+	if err != nil {
+		return internalServerError("Database error finding external subject bans").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, AdminExternalBansResponse{Bans: bans})
+}
+
+// adminExternalBanCreate bans a subject of an external provider from signing
+// in, replacing any existing ban of it.
+func (a *API) adminExternalBanCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.config
+
+	body, err := getBodyBytes(r)
+	if err != nil {
+		return badRequestError("Could not read body").WithInternalError(err)
+	}
+
+	params := &adminExternalBanParams{}
+	if err := json.Unmarshal(body, params); err != nil {
+		return badRequestError("Could not decode external ban params: %v", err)
+	}
+
+	if params.Provider == "" || params.Subject == "" {
+		return badRequestError("provider and subject are required")
+	}
+
+	if config.External.OAuthProvider(params.Provider) == nil {
+		return badRequestError("Unsupported provider: %v", params.Provider)
+	}
+
+	duration := time.Duration(0)
+	if params.BanDuration != "" {
+		duration, err = time.ParseDuration(params.BanDuration)
+		if err != nil {
+			return badRequestError("invalid format for ban duration: %v", err)
+		}
+		if duration <= 0 {
+			return badRequestError("ban duration must be positive")
+		}
+	}
+
+	var ban *models.ExternalSubjectBan
+	err = a.db.WithContext(ctx).Transaction(func(tx *storage.Connection) error {
+		var terr error
+		ban, terr = models.BanExternalSubject(tx, params.Provider, params.Subject, duration)
+		return terr
+	})
+	if err != nil {
+		return internalServerError("Database error banning external subject").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, ban)
+}
+
+// adminExternalBanDelete lifts the ban of a subject of an external provider,
+// allowing it to sign in again.
+func (a *API) adminExternalBanDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	provider := chi.URLParam(r, "provider")
+	subject := chi.URLParam(r, "subject")
+
+	err := a.db.WithContext(ctx).Transaction(func(tx *storage.Connection) error {
+		return models.DeleteExternalSubjectBan(tx, provider, subject)
+	})
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError("External subject ban not found")
+		}
+		return internalServerError("Database error deleting external subject ban").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
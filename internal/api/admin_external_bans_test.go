@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/models"
+)
+
+func (ts *AdminTestSuite) externalBansRequest(method, path string, body map[string]interface{}) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	if body != nil {
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+	}
+
+	req := httptest.NewRequest(method, "/admin/external_bans"+path, &buffer)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func (ts *AdminTestSuite) TestAdminExternalBans() {
+	w := ts.externalBansRequest(http.MethodPost, "/", map[string]interface{}{
+		"provider": "gitlab",
+		"subject":  "123",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	ban := models.ExternalSubjectBan{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&ban))
+	require.Equal(ts.T(), "gitlab", ban.Provider)
+	require.Equal(ts.T(), "123", ban.Subject)
+	require.Nil(ts.T(), ban.BannedUntil)
+
+	// banning again replaces the ban
+	w = ts.externalBansRequest(http.MethodPost, "/", map[string]interface{}{
+		"provider":     "gitlab",
+		"subject":      "123",
+		"ban_duration": "24h",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w = ts.externalBansRequest(http.MethodGet, "/", nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	data := AdminExternalBansResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Len(ts.T(), data.Bans, 1)
+	require.NotNil(ts.T(), data.Bans[0].BannedUntil)
+	require.WithinDuration(ts.T(), time.Now().Add(24*time.Hour), *data.Bans[0].BannedUntil, time.Minute)
+
+	banned, err := models.IsExternalSubjectBanned(ts.API.db, "gitlab", "123")
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), banned)
+
+	w = ts.externalBansRequest(http.MethodDelete, "/gitlab/123", nil)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	banned, err = models.IsExternalSubjectBanned(ts.API.db, "gitlab", "123")
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), banned)
+
+	w = ts.externalBansRequest(http.MethodDelete, "/gitlab/123", nil)
+	require.Equal(ts.T(), http.StatusNotFound, w.Code)
+}
+
+func (ts *AdminTestSuite) TestAdminExternalBansInvalid() {
+	cases := map[string]map[string]interface{}{
+		"missing subject":      {"provider": "gitlab"},
+		"unsupported provider": {"provider": "unknown", "subject": "123"},
+		"invalid duration":     {"provider": "gitlab", "subject": "123", "ban_duration": "forever"},
+		"negative duration":    {"provider": "gitlab", "subject": "123", "ban_duration": "-1h"},
+	}
+
+	for desc, body := range cases {
+		ts.Run(desc, func() {
+			w := ts.externalBansRequest(http.MethodPost, "/", body)
+			require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+		})
+	}
+}
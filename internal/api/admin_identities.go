@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/fatih/structs"
+	"github.com/gofrs/uuid"
+	"github.com/supabase/gotrue/internal/api/provider"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// adminIdentityParams pre-provisions an identity of an external provider,
+// e.g. when migrating users whose ID tokens aren't available. The identity
+// is linked to the user with UserID, or else the user with Email, who is
+// created if there is none.
+type adminIdentityParams struct {
+	Provider      string    `json:"provider"`
+	Subject       string    `json:"subject"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	UserID        uuid.UUID `json:"user_id"`
+}
+
+// adminIdentityCreate creates an identity of an external provider without
+// verifying a token from the provider. Later sign ins with the provider's
+// tokens for the subject resolve to the identity's user.
+func (a *API) adminIdentityCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.db.WithContext(ctx)
+	config := a.config
+
+	adminUser := getAdminUser(ctx)
+
+	body, err := getBodyBytes(r)
+	if err != nil {
+		return badRequestError("Could not read body").WithInternalError(err)
+	}
+
+	params := &adminIdentityParams{}
+	if err := json.Unmarshal(body, params); err != nil {
+		return badRequestError("Could not decode admin identity params: %v", err)
+	}
+
+	if params.Provider == "" || params.Subject == "" {
+		return badRequestError("provider and subject are required")
+	}
+
+	if config.External.OAuthProvider(params.Provider) == nil {
+		return badRequestError("Unsupported provider: %v", params.Provider)
+	}
+
+	if params.UserID == uuid.Nil && params.Email == "" {
+		return badRequestError("Either user_id or email is required")
+	}
+
+	if params.Email != "" {
+		params.Email, err = validateEmail(params.Email)
+		if err != nil {
+			return err
+		}
+	}
+
+	aud := a.requestAud(ctx, r)
+
+	var user *models.User
+	err = db.Transaction(func(tx *storage.Connection) error {
+		if _, terr := models.FindIdentityByIdAndProvider(tx, params.Subject, params.Provider); terr == nil {
+			return unprocessableEntityError("Identity is already linked to a user")
+		} else if !models.IsNotFoundError(terr) {
+			return internalServerError("Database error finding identity").WithInternalError(terr)
+		}
+
+		var terr error
+		created := false
+
+		if params.UserID != uuid.Nil {
+			user, terr = models.FindUserByID(tx, params.UserID)
+		} else {
+			user, terr = models.FindUserByEmailAndAudience(tx, params.Email, aud)
+		}
+
+		if terr != nil {
+			if !models.IsNotFoundError(terr) {
+				return internalServerError("Database error finding user").WithInternalError(terr)
+			}
+
+			if params.UserID != uuid.Nil {
+				return notFoundError("User not found")
+			}
+
+			user, terr = a.signupNewUser(ctx, tx, &SignupParams{
+				Provider: params.Provider,
+				Email:    params.Email,
+				Aud:      aud,
+			}, false)
+			if terr != nil {
+				return terr
+			}
+
+			created = true
+		}
+
+		if !created {
+			if exceeded, terr := a.identityLimitExceeded(tx, user); terr != nil {
+				return terr
+			} else if exceeded {
+				return identityLimitExceededError(config.External.MaxIdentitiesPerUser)
+			}
+		}
+
+		if _, terr := a.createNewIdentity(tx, user, params.Provider, structs.Map(provider.Claims{
+			Subject:       params.Subject,
+			Email:         params.Email,
+			EmailVerified: params.EmailVerified,
+		})); terr != nil {
+			return terr
+		}
+
+		if terr := user.UpdateAppMetaDataProviders(tx); terr != nil {
+			return internalServerError("Error updating user").WithInternalError(terr)
+		}
+
+		if created && params.EmailVerified {
+			if terr := user.Confirm(tx); terr != nil {
+				return internalServerError("Error updating user").WithInternalError(terr)
+			}
+		}
+
+		if terr := models.NewAuditLogEntry(r, tx, adminUser, models.IdentityLinkedAction, "", map[string]interface{}{
+			"user_id":      user.ID,
+			"provider":     params.Provider,
+			"subject":      params.Subject,
+			"provisioned":  true,
+			"user_created": created,
+		}); terr != nil {
+			return terr
+		}
+
+		user, terr = models.FindUserByID(tx, user.ID)
+		if terr != nil {
+			return internalServerError("Database error loading user").WithInternalError(terr)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, user)
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/api/provider"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+func (ts *AdminTestSuite) adminIdentityRequest(body map[string]interface{}) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/identities", &buffer)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func (ts *AdminTestSuite) TestAdminIdentityCreate() {
+	w := ts.adminIdentityRequest(map[string]interface{}{
+		"provider":       "google",
+		"subject":        "migrated-subject",
+		"email":          "migrated@example.com",
+		"email_verified": true,
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	provisioned := models.User{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&provisioned))
+	require.Equal(ts.T(), "migrated@example.com", provisioned.GetEmail())
+	require.True(ts.T(), provisioned.IsConfirmed())
+	require.Len(ts.T(), provisioned.Identities, 1)
+	require.Equal(ts.T(), "google", provisioned.Identities[0].Provider)
+	require.Equal(ts.T(), "migrated-subject", provisioned.Identities[0].ID)
+
+	entries, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.IdentityLinkedAction), nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), entries, 1)
+
+	// provisioning the same identity again fails
+	w = ts.adminIdentityRequest(map[string]interface{}{
+		"provider": "google",
+		"subject":  "migrated-subject",
+		"email":    "other@example.com",
+	})
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	// a sign in with a real ID token for the subject resolves to the
+	// provisioned user, even if the email address changed since
+	userData := &provider.UserProvidedData{
+		Emails: []provider.Email{
+			{
+				Email:    "changed@example.com",
+				Verified: true,
+				Primary:  true,
+			},
+		},
+		Metadata: &provider.Claims{
+			Issuer:        "https://accounts.google.com",
+			Subject:       "migrated-subject",
+			Email:         "changed@example.com",
+			EmailVerified: true,
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+
+	var user *models.User
+	require.NoError(ts.T(), ts.API.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		user, _, terr = ts.API.createAccountFromExternalIdentity(tx, req, userData, "google", nil)
+		return terr
+	}))
+	require.Equal(ts.T(), provisioned.ID, user.ID)
+
+	identities, err := models.FindIdentitiesByUserID(ts.API.db, user.ID)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), identities, 1)
+	require.Equal(ts.T(), "changed@example.com", identities[0].IdentityData["email"])
+}
+
+func (ts *AdminTestSuite) TestAdminIdentityCreateLinksExistingUser() {
+	u, err := models.NewUser("", "existing@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(u))
+
+	cases := []struct {
+		desc string
+		body map[string]interface{}
+	}{
+		{
+			desc: "by user ID",
+			body: map[string]interface{}{
+				"provider": "google",
+				"subject":  "google-subject",
+				"user_id":  u.ID,
+			},
+		},
+		{
+			desc: "by email",
+			body: map[string]interface{}{
+				"provider": "github",
+				"subject":  "github-subject",
+				"email":    "EXISTING@example.com",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			w := ts.adminIdentityRequest(c.body)
+			require.Equal(ts.T(), http.StatusOK, w.Code)
+
+			data := models.User{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+			require.Equal(ts.T(), u.ID, data.ID)
+		})
+	}
+
+	u, err = models.FindUserByID(ts.API.db, u.ID)
+	require.NoError(ts.T(), err)
+	require.ElementsMatch(ts.T(), []interface{}{"google", "github"}, u.AppMetaData["providers"])
+}
+
+func (ts *AdminTestSuite) TestAdminIdentityCreateInvalid() {
+	cases := map[string]struct {
+		body map[string]interface{}
+		code int
+	}{
+		"missing subject": {
+			body: map[string]interface{}{"provider": "google", "email": "test@example.com"},
+			code: http.StatusBadRequest,
+		},
+		"unsupported provider": {
+			body: map[string]interface{}{"provider": "unknown", "subject": "123", "email": "test@example.com"},
+			code: http.StatusBadRequest,
+		},
+		"missing user": {
+			body: map[string]interface{}{"provider": "google", "subject": "123"},
+			code: http.StatusBadRequest,
+		},
+		"unknown user ID": {
+			body: map[string]interface{}{"provider": "google", "subject": "123", "user_id": "4a1b6c8e-3f1d-4b6a-9f8e-2c3d4e5f6a7b"},
+			code: http.StatusNotFound,
+		},
+	}
+
+	for desc, c := range cases {
+		ts.Run(desc, func() {
+			w := ts.adminIdentityRequest(c.body)
+			require.Equal(ts.T(), c.code, w.Code)
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// ImpersonationResponse is returned when an admin impersonates a user. It
+// deliberately has no refresh token, so that the impersonation ends when the
+// access token expires.
+type ImpersonationResponse struct {
+	Token     string       `json:"access_token"`
+	TokenType string       `json:"token_type"`
+	ExpiresIn int          `json:"expires_in"`
+	ExpiresAt int64        `json:"expires_at"`
+	User      *models.User `json:"user"`
+}
+
+// adminUserImpersonate issues a short-lived access token for the user,
+// flagged as impersonated, to admins with one of the impersonation roles.
+func (a *API) adminUserImpersonate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.config
+	user := getUser(ctx)
+	adminUser := getAdminUser(ctx)
+	claims := getClaims(ctx)
+
+	if !config.Impersonation.Enabled {
+		return notFoundError("Impersonation is disabled")
+	}
+
+	if !isStringInSlice(claims.Role, config.Impersonation.Roles) {
+		return forbiddenError("Role %v is not allowed to impersonate users", claims.Role)
+	}
+
+	if user.IsBanned() {
+		return unprocessableEntityError("User is banned")
+	}
+
+	if user.DeletedAt != nil {
+		return unprocessableEntityError("User is deleted")
+	}
+
+	issuedAt := a.now().UTC()
+	expiresAt := issuedAt.Add(config.Impersonation.Exp)
+
+	var token string
+	err := a.db.WithContext(ctx).Transaction(func(tx *storage.Connection) error {
+		var terr error
+		token, terr = signAccessToken(&GoTrueClaims{
+			StandardClaims: jwt.StandardClaims{
+				Subject:   user.ID.String(),
+				Audience:  user.Aud,
+				IssuedAt:  issuedAt.Unix(),
+				ExpiresAt: expiresAt.Unix(),
+				Issuer:    config.JWT.IssuerForAudience(user.Aud),
+			},
+			Email:                         user.GetEmail(),
+			Phone:                         user.GetPhone(),
+			AppMetaData:                   user.AppMetaData,
+			UserMetaData:                  user.UserMetaData,
+			Role:                          config.JWT.RoleForUser(user.Role, user.AppMetaData),
+			AuthenticatorAssuranceLevel:   models.AAL1.String(),
+			AuthenticationMethodReference: []models.AMREntry{},
+			IsAnonymous:                   user.IsAnonymous,
+			Impersonated:                  true,
+		}, &config.JWT)
+		if terr != nil {
+			return internalServerError("Error generating access token").WithInternalError(terr)
+		}
+
+		// the admin token's subject identifies the acting admin, as the
+		// admin user only carries the role
+		return models.NewAuditLogEntry(r, tx, adminUser, models.UserImpersonatedAction, "", map[string]interface{}{
+			"user_id":    user.ID,
+			"admin_id":   claims.Subject,
+			"admin_role": claims.Role,
+			"expires_at": expiresAt.Unix(),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, &ImpersonationResponse{
+		Token:     token,
+		TokenType: "bearer",
+		ExpiresIn: int(config.Impersonation.Exp / time.Second),
+		ExpiresAt: expiresAt.Unix(),
+		User:      user,
+	})
+}
@@ -0,0 +1,347 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/fatih/structs"
+	"github.com/gofrs/uuid"
+	"github.com/supabase/gotrue/internal/api/provider"
+	"github.com/supabase/gotrue/internal/crypto"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+const (
+	// adminImportBatchSize is the number of users imported in a single
+	// database transaction.
+	adminImportBatchSize = 100
+
+	// adminImportMaxUsers is the maximum number of users in a single
+	// import request.
+	adminImportMaxUsers = 10000
+)
+
+// Import statuses reported for each user in AdminImportUsersResponse.
+const (
+	adminImportCreated = "created"
+	adminImportUpdated = "updated"
+	adminImportSkipped = "skipped"
+	adminImportFailed  = "failed"
+)
+
+// AdminImportUserParams describes a single user to import. PasswordHash is
+// an optional bcrypt or Argon2 (PHC string format) hash of the password.
+type AdminImportUserParams struct {
+	Email        string                 `json:"email"`
+	Phone        string                 `json:"phone"`
+	PasswordHash string                 `json:"password_hash"`
+	EmailConfirm bool                   `json:"email_confirm"`
+	PhoneConfirm bool                   `json:"phone_confirm"`
+	Role         string                 `json:"role"`
+	UserMetaData map[string]interface{} `json:"user_metadata"`
+	AppMetaData  map[string]interface{} `json:"app_metadata"`
+}
+
+type AdminImportUsersParams struct {
+	Aud       string                  `json:"aud"`
+	Overwrite bool                    `json:"overwrite"`
+	Users     []AdminImportUserParams `json:"users"`
+}
+
+// AdminImportUserResult reports the outcome of importing the user at Index
+// of the request.
+type AdminImportUserResult struct {
+	Index  int        `json:"index"`
+	Status string     `json:"status"`
+	UserID *uuid.UUID `json:"user_id,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+type AdminImportUsersResponse struct {
+	Users []AdminImportUserResult `json:"users"`
+}
+
+func importFailure(index int, err error) AdminImportUserResult {
+	message := err.Error()
+	if httpErr, ok := err.(*HTTPError); ok {
+		message = httpErr.Message
+	}
+
+	return AdminImportUserResult{
+		Index:  index,
+		Status: adminImportFailed,
+		Error:  message,
+	}
+}
+
+// adminUsersImport creates users in bulk, e.g. when migrating from another
+// auth system. Users are imported in batched transactions and the outcome is
+// reported for each user, so that a single invalid user does not fail the
+// whole import.
+func (a *API) adminUsersImport(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.db.WithContext(ctx)
+
+	adminUser := getAdminUser(ctx)
+
+	body, err := getBodyBytes(r)
+	if err != nil {
+		return badRequestError("Could not read body").WithInternalError(err)
+	}
+
+	params := &AdminImportUsersParams{}
+	if err := json.Unmarshal(body, params); err != nil {
+		return badRequestError("Could not decode admin user import params: %v", err)
+	}
+
+	if len(params.Users) == 0 {
+		return badRequestError("At least one user is required")
+	} else if len(params.Users) > adminImportMaxUsers {
+		return badRequestError("At most %d users can be imported at once", adminImportMaxUsers)
+	}
+
+	aud := a.requestAud(ctx, r)
+	if params.Aud != "" {
+		aud = params.Aud
+	}
+
+	results := make([]AdminImportUserResult, len(params.Users))
+
+	for start := 0; start < len(params.Users); start += adminImportBatchSize {
+		end := start + adminImportBatchSize
+		if end > len(params.Users) {
+			end = len(params.Users)
+		}
+
+		err := db.Transaction(func(tx *storage.Connection) error {
+			for i := start; i < end; i++ {
+				result, terr := a.importUser(tx, r, adminUser, aud, params.Overwrite, &params.Users[i])
+				if terr != nil {
+					return terr
+				}
+
+				result.Index = i
+				results[i] = *result
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			// the whole batch has been rolled back
+			for i := start; i < end; i++ {
+				if results[i].Status != adminImportFailed {
+					results[i] = importFailure(i, internalServerError("Database error importing user"))
+				}
+			}
+		}
+	}
+
+	return sendJSON(w, http.StatusOK, &AdminImportUsersResponse{
+		Users: results,
+	})
+}
+
+// importUser creates or, if overwrite is set, updates a single user. Invalid
+// users are reported in the returned result; only database errors are
+// returned as errors.
+func (a *API) importUser(tx *storage.Connection, r *http.Request, adminUser *models.User, aud string, overwrite bool, params *AdminImportUserParams) (*AdminImportUserResult, error) {
+	var err error
+
+	if params.Email == "" && params.Phone == "" {
+		result := importFailure(0, unprocessableEntityError("Cannot import a user without either an email or phone"))
+		return &result, nil
+	}
+
+	if params.PasswordHash != "" {
+		if err := crypto.ValidatePasswordHash(params.PasswordHash); err != nil {
+			result := importFailure(0, unprocessableEntityError("Password hash is not a supported bcrypt or Argon2 hash"))
+			return &result, nil
+		}
+	}
+
+	var existingUser *models.User
+	var providers []string
+
+	if params.Email != "" {
+		params.Email, err = validateEmail(params.Email)
+		if err != nil {
+			result := importFailure(0, err)
+			return &result, nil
+		}
+
+		existingUser, err = models.IsDuplicatedEmail(tx, params.Email, aud, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if existingUser != nil && !overwrite {
+			return &AdminImportUserResult{
+				Status: adminImportSkipped,
+				UserID: &existingUser.ID,
+			}, nil
+		}
+
+		providers = append(providers, "email")
+	}
+
+	if params.Phone != "" {
+		params.Phone, err = validatePhone(params.Phone, a.config.Sms.DefaultRegion)
+		if err != nil {
+			result := importFailure(0, err)
+			return &result, nil
+		}
+
+		// only the user being overwritten may already have this phone number
+		phoneUser, err := models.FindUserByPhoneAndAudience(tx, params.Phone, aud)
+		if err != nil && !models.IsNotFoundError(err) {
+			return nil, err
+		}
+
+		if phoneUser != nil && (existingUser == nil || phoneUser.ID != existingUser.ID) {
+			result := importFailure(0, unprocessableEntityError("Phone number already registered by another user"))
+			return &result, nil
+		}
+
+		providers = append(providers, "phone")
+	}
+
+	if existingUser != nil {
+		if err := a.overwriteImportedUser(tx, r, adminUser, existingUser, params); err != nil {
+			return nil, err
+		}
+
+		return &AdminImportUserResult{
+			Status: adminImportUpdated,
+			UserID: &existingUser.ID,
+		}, nil
+	}
+
+	user, err := models.NewUserWithPasswordHash(params.Phone, params.Email, params.PasswordHash, aud, params.UserMetaData)
+	if err != nil {
+		return nil, err
+	}
+
+	user.AppMetaData = map[string]interface{}{
+		// default to the first provider in the providers slice
+		"provider":  providers[0],
+		"providers": providers,
+	}
+
+	if err := tx.Create(user); err != nil {
+		return nil, err
+	}
+
+	if user.GetEmail() != "" {
+		if _, err := a.createNewIdentity(tx, user, "email", structs.Map(provider.Claims{
+			Subject: user.ID.String(),
+			Email:   user.GetEmail(),
+		})); err != nil {
+			return nil, err
+		}
+	}
+
+	if user.GetPhone() != "" {
+		if _, err := a.createNewIdentity(tx, user, "phone", structs.Map(provider.Claims{
+			Subject: user.ID.String(),
+			Phone:   user.GetPhone(),
+		})); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := models.NewAuditLogEntry(r, tx, adminUser, models.UserSignedUpAction, "", map[string]interface{}{
+		"user_id":    user.ID,
+		"user_email": user.Email,
+		"user_phone": user.Phone,
+		"imported":   true,
+	}); err != nil {
+		return nil, err
+	}
+
+	role := a.config.JWT.DefaultGroupName
+	if params.Role != "" {
+		role = params.Role
+	}
+	if err := user.SetRole(tx, role); err != nil {
+		return nil, err
+	}
+
+	if params.AppMetaData != nil {
+		if err := user.UpdateAppMetaData(tx, params.AppMetaData); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.confirmImportedUser(tx, user, params); err != nil {
+		return nil, err
+	}
+
+	return &AdminImportUserResult{
+		Status: adminImportCreated,
+		UserID: &user.ID,
+	}, nil
+}
+
+// overwriteImportedUser replaces the password hash and merges the metadata
+// of an existing user with the imported one.
+func (a *API) overwriteImportedUser(tx *storage.Connection, r *http.Request, adminUser, user *models.User, params *AdminImportUserParams) error {
+	if params.PasswordHash != "" {
+		user.EncryptedPassword = params.PasswordHash
+		if err := tx.UpdateOnly(user, "encrypted_password"); err != nil {
+			return err
+		}
+	}
+
+	if params.Phone != "" && user.GetPhone() != params.Phone {
+		if err := user.UpdatePhone(tx, params.Phone); err != nil {
+			return err
+		}
+	}
+
+	if params.UserMetaData != nil {
+		if err := user.UpdateUserMetaData(tx, params.UserMetaData); err != nil {
+			return err
+		}
+	}
+
+	if params.AppMetaData != nil {
+		if err := user.UpdateAppMetaData(tx, params.AppMetaData); err != nil {
+			return err
+		}
+	}
+
+	if params.Role != "" {
+		if err := user.SetRole(tx, params.Role); err != nil {
+			return err
+		}
+	}
+
+	if err := a.confirmImportedUser(tx, user, params); err != nil {
+		return err
+	}
+
+	return models.NewAuditLogEntry(r, tx, adminUser, models.UserModifiedAction, "", map[string]interface{}{
+		"user_id":    user.ID,
+		"user_email": user.Email,
+		"user_phone": user.Phone,
+		"imported":   true,
+	})
+}
+
+func (a *API) confirmImportedUser(tx *storage.Connection, user *models.User, params *AdminImportUserParams) error {
+	if params.EmailConfirm && user.GetEmail() != "" && !user.IsConfirmed() {
+		if err := user.Confirm(tx); err != nil {
+			return err
+		}
+	}
+
+	if params.PhoneConfirm && user.GetPhone() != "" && !user.IsPhoneConfirmed() {
+		if err := user.ConfirmPhone(tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/gofrs/uuid"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// AdminSession is a session of a user as listed to admins.
+type AdminSession struct {
+	ID uuid.UUID `json:"id"`
+	*models.Session
+}
+
+type AdminSessionsResponse struct {
+	Sessions []AdminSession `json:"sessions"`
+}
+
+// adminUserGetSessions lists the active sessions of a user.
+func (a *API) adminUserGetSessions(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	config := a.config
+
+	sessions, err := models.FindSessionsByUserID(a.db.WithContext(ctx), user.ID)
+	if err != nil {
+		return internalServerError("Database error finding sessions").WithInternalError(err)
+	}
+
+	now := a.now()
+	response := AdminSessionsResponse{
+		Sessions: []AdminSession{},
+	}
+	for _, session := range sessions {
+		if session.CheckValidity(now, config.Sessions.Timebox, config.Sessions.InactivityTimeout) != models.SessionValid {
+			continue
+		}
+
+		response.Sessions = append(response.Sessions, AdminSession{
+			ID:      session.ID,
+			Session: session,
+		})
+	}
+
+	return sendJSON(w, http.StatusOK, response)
+}
+
+// adminUserDeleteSession revokes a single session of a user, so that its
+// refresh tokens can no longer be used.
+func (a *API) adminUserDeleteSession(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	adminUser := getAdminUser(ctx)
+
+	sessionID, err := uuid.FromString(chi.URLParam(r, "session_id"))
+	if err != nil {
+		return badRequestError("session_id must be an UUID")
+	}
+
+	err = a.db.WithContext(ctx).Transaction(func(tx *storage.Connection) error {
+		session, terr := models.FindSessionByID(tx, sessionID, false)
+		if terr != nil {
+			if models.IsNotFoundError(terr) {
+				return notFoundError("Session not found")
+			}
+			return internalServerError("Database error finding session").WithInternalError(terr)
+		}
+
+		if session.UserID != user.ID {
+			return notFoundError("Session not found")
+		}
+
+		if terr := models.NewAuditLogEntry(r, tx, adminUser, models.LogoutAction, "", map[string]interface{}{
+			"user_id":    user.ID,
+			"session_id": session.ID,
+		}); terr != nil {
+			return terr
+		}
+
+		// the session's refresh tokens are deleted with it
+		if terr := models.LogoutSession(tx, session.ID); terr != nil {
+			return internalServerError("Database error revoking session").WithInternalError(terr)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// adminUserDeleteSessions revokes all sessions of a user.
+func (a *API) adminUserDeleteSessions(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	adminUser := getAdminUser(ctx)
+
+	err := a.db.WithContext(ctx).Transaction(func(tx *storage.Connection) error {
+		if terr := models.NewAuditLogEntry(r, tx, adminUser, models.LogoutAction, "", map[string]interface{}{
+			"user_id": user.ID,
+		}); terr != nil {
+			return terr
+		}
+
+		if terr := models.Logout(tx, user.ID); terr != nil {
+			return internalServerError("Database error revoking sessions").WithInternalError(terr)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -15,7 +16,9 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/crypto"
 	"github.com/supabase/gotrue/internal/models"
+	"golang.org/x/crypto/argon2"
 )
 
 type AdminTestSuite struct {
@@ -761,6 +764,35 @@ func (ts *AdminTestSuite) TestAdminUserGetFactors() {
 	require.Equal(ts.T(), getFactorsResp[0].Secret, "")
 }
 
+// TestAdminUserRegenerateRecoveryCodes tests API /admin/users/<user_id>/factors/<factor_id>/recovery_codes
+func (ts *AdminTestSuite) TestAdminUserRegenerateRecoveryCodes() {
+	u, err := models.NewUser("123456789", "test-recovery@example.com", "test", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+
+	f, err := models.NewFactor(u, "testSimpleName", models.TOTP, models.FactorStateVerified, "secretkey")
+	require.NoError(ts.T(), err, "Error creating test factor model")
+	require.NoError(ts.T(), ts.API.db.Create(f), "Error saving new test factor")
+
+	previousCodes, err := models.RegenerateRecoveryCodes(ts.API.db, f, 10)
+	require.NoError(ts.T(), err)
+
+	// Setup request
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/users/%s/factors/%s/recovery_codes", u.ID, f.ID), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	data := RecoveryCodesResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Len(ts.T(), data.RecoveryCodes, ts.Config.MFA.RecoveryCodesCount)
+
+	require.ErrorIs(ts.T(), models.ConsumeRecoveryCode(ts.API.db, f, previousCodes[0]), models.RecoveryCodeNotFoundError{})
+	require.NoError(ts.T(), models.ConsumeRecoveryCode(ts.API.db, f, data.RecoveryCodes[0]))
+}
+
 func (ts *AdminTestSuite) TestAdminUserUpdateFactor() {
 	u, err := models.NewUser("123456789", "test-delete@example.com", "test", ts.Config.JWT.Aud, nil)
 	require.NoError(ts.T(), err, "Error making new user")
@@ -813,3 +845,740 @@ func (ts *AdminTestSuite) TestAdminUserUpdateFactor() {
 	}
 
 }
+
+func (ts *AdminTestSuite) TestAdminUserUpdateVerification() {
+	u, err := models.NewUser("123456789", "test-verification@example.com", "test", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+
+	i, err := models.NewIdentity(u, "email", map[string]interface{}{
+		"sub":   u.ID.String(),
+		"email": u.GetEmail(),
+	})
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(i))
+
+	updateVerification := func(params map[string]interface{}) int {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+		req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/admin/users/%s/verification", u.ID), &buffer)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+		w := httptest.NewRecorder()
+
+		ts.API.handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	require.Equal(ts.T(), http.StatusBadRequest, updateVerification(map[string]interface{}{}))
+
+	require.Equal(ts.T(), http.StatusOK, updateVerification(map[string]interface{}{
+		"email_verified": true,
+		"phone_verified": true,
+	}))
+
+	user, err := models.FindUserByID(ts.API.db, u.ID)
+	require.NoError(ts.T(), err)
+	require.NotNil(ts.T(), user.EmailConfirmedAt)
+	require.NotNil(ts.T(), user.PhoneConfirmedAt)
+
+	identity, err := models.FindIdentityByIdAndProvider(ts.API.db, u.ID.String(), "email")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), true, identity.IdentityData["email_verified"])
+
+	require.Equal(ts.T(), http.StatusOK, updateVerification(map[string]interface{}{
+		"email_verified": false,
+	}))
+
+	user, err = models.FindUserByID(ts.API.db, u.ID)
+	require.NoError(ts.T(), err)
+	require.Nil(ts.T(), user.EmailConfirmedAt)
+	require.NotNil(ts.T(), user.PhoneConfirmedAt)
+
+	identity, err = models.FindIdentityByIdAndProvider(ts.API.db, u.ID.String(), "email")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), false, identity.IdentityData["email_verified"])
+
+	entries, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.UserModifiedAction), nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), entries, 2)
+
+	traits, ok := entries[0].Payload["traits"].(map[string]interface{})
+	require.True(ts.T(), ok)
+	require.Equal(ts.T(), u.ID.String(), traits["user_id"])
+	require.Equal(ts.T(), false, traits["email_verified"])
+}
+
+func (ts *AdminTestSuite) TestAdminUserUpdateVerificationWithoutPhone() {
+	u, err := models.NewUser("", "test-verification@example.com", "test", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"phone_verified": true,
+	}))
+
+	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/admin/users/%s/verification", u.ID), &buffer)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	user, err := models.FindUserByID(ts.API.db, u.ID)
+	require.NoError(ts.T(), err)
+	require.Nil(ts.T(), user.PhoneConfirmedAt)
+}
+
+func (ts *AdminTestSuite) TestAdminUserUnlock() {
+	security := ts.Config.Security
+	defer func() {
+		ts.Config.Security = security
+	}()
+	ts.Config.Security.MaxLoginAttempts = 1
+	ts.Config.Security.LockoutDuration = time.Hour
+
+	u, err := models.NewUser("", "test-unlock@example.com", "test-password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+
+	require.Equal(ts.T(), http.StatusTooManyRequests, ts.passwordGrant("test-unlock@example.com", "wrong-password"))
+	require.Equal(ts.T(), http.StatusTooManyRequests, ts.passwordGrant("test-unlock@example.com", "test-password"))
+
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/users/%s/unlock", u.ID), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	user, err := models.FindUserByID(ts.API.db, u.ID)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), user.IsLocked())
+
+	entries, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.UserUnlockedAction), nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), entries, 1)
+
+	require.Equal(ts.T(), http.StatusOK, ts.passwordGrant("test-unlock@example.com", "test-password"))
+}
+
+func (ts *AdminTestSuite) TestAdminUserImpersonate() {
+	impersonation := ts.Config.Impersonation
+	defer func() {
+		ts.Config.Impersonation = impersonation
+	}()
+	ts.Config.Impersonation.Roles = []string{"supabase_admin"}
+	ts.Config.Impersonation.Exp = 5 * time.Minute
+
+	u, err := models.NewUser("", "test-impersonate@example.com", "test-password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+
+	impersonate := func(role string) *httptest.ResponseRecorder {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &GoTrueClaims{
+			StandardClaims: jwt.StandardClaims{
+				Subject: "admin-id",
+			},
+			Role: role,
+		}).SignedString([]byte(ts.Config.JWT.Secret))
+		require.NoError(ts.T(), err)
+
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/users/%s/impersonate", u.ID), nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		w := httptest.NewRecorder()
+
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	ts.Config.Impersonation.Enabled = false
+	require.Equal(ts.T(), http.StatusNotFound, impersonate("supabase_admin").Code)
+
+	ts.Config.Impersonation.Enabled = true
+	require.Equal(ts.T(), http.StatusForbidden, impersonate("service_role").Code, "only the impersonation roles may impersonate")
+
+	w := impersonate("supabase_admin")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	data := map[string]interface{}{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.NotContains(ts.T(), data, "refresh_token")
+	require.Equal(ts.T(), 300.0, data["expires_in"])
+
+	claims := &GoTrueClaims{}
+	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
+	_, err = p.ParseWithClaims(data["access_token"].(string), claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(ts.Config.JWT.Secret), nil
+	})
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), u.ID.String(), claims.Subject)
+	require.True(ts.T(), claims.Impersonated)
+	require.Empty(ts.T(), claims.SessionId)
+	require.Equal(ts.T(), int64(300), claims.ExpiresAt-claims.IssuedAt)
+
+	// no session or refresh token is created for the user
+	sessions, err := models.FindSessionsByUserID(ts.API.db, u.ID)
+	require.NoError(ts.T(), err)
+	require.Empty(ts.T(), sessions)
+
+	entries, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.UserImpersonatedAction), nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), entries, 1)
+
+	traits := entries[0].Payload["traits"].(map[string]interface{})
+	require.Equal(ts.T(), u.ID.String(), traits["user_id"])
+	require.Equal(ts.T(), "admin-id", traits["admin_id"])
+}
+
+func (ts *AdminTestSuite) TestAdminUserSoftDeleteAndRestore() {
+	security := ts.Config.Security
+	defer func() {
+		ts.Config.Security = security
+	}()
+	ts.Config.Security.SoftDeleteUsers = true
+
+	u, err := models.NewUser("", "test-restore@example.com", "test-password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+
+	require.Equal(ts.T(), http.StatusOK, ts.passwordGrant("test-restore@example.com", "test-password"))
+
+	listUsers := func(query string) []*models.User {
+		req := httptest.NewRequest(http.MethodGet, "/admin/users"+query, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+		w := httptest.NewRecorder()
+
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		data := AdminListUsersResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		return data.Users
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/admin/users/%s", u.ID), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	deletedUser, err := models.FindUserByID(ts.API.db, u.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), deletedUser.IsDeleted())
+	require.Equal(ts.T(), "test-restore@example.com", deletedUser.GetEmail())
+
+	require.Equal(ts.T(), http.StatusBadRequest, ts.passwordGrant("test-restore@example.com", "test-password"))
+
+	require.Empty(ts.T(), listUsers(""))
+	deletedUsers := listUsers("?include_deleted=true")
+	require.Len(ts.T(), deletedUsers, 1)
+	require.Equal(ts.T(), u.ID, deletedUsers[0].ID)
+
+	req = httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/users/%s/restore", u.ID), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	w = httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	restoredUser, err := models.FindUserByID(ts.API.db, u.ID)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), restoredUser.IsDeleted())
+
+	entries, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.UserRestoredAction), nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), entries, 1)
+
+	require.Equal(ts.T(), http.StatusOK, ts.passwordGrant("test-restore@example.com", "test-password"))
+	require.Len(ts.T(), listUsers(""), 1)
+
+	// restoring a user that isn't deleted fails
+	req = httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/users/%s/restore", u.ID), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	w = httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *AdminTestSuite) importUsers(params map[string]interface{}) *AdminImportUsersResponse {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/users/import", &buffer)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	response := &AdminImportUsersResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(response))
+
+	return response
+}
+
+func (ts *AdminTestSuite) passwordGrant(email, password string) int {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"email":    email,
+		"password": password,
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/token?grant_type=password", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+
+	return w.Code
+}
+
+func (ts *AdminTestSuite) TestAdminUsersImport() {
+	bcryptHash, err := crypto.GenerateFromPassword(context.Background(), "bcrypt-password")
+	require.NoError(ts.T(), err)
+
+	salt := []byte("0123456789abcdef")
+	argon2Hash := fmt.Sprintf(
+		"$argon2id$v=%d$m=1024,t=1,p=1$%s$%s",
+		argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("argon2-password"), salt, 1, 1024, 1, 32)),
+	)
+
+	response := ts.importUsers(map[string]interface{}{
+		"users": []map[string]interface{}{
+			{
+				"email":         "bcrypt@example.com",
+				"password_hash": bcryptHash,
+				"email_confirm": true,
+				"user_metadata": map[string]interface{}{
+					"name": "bcrypt",
+				},
+			},
+			{
+				"email":         "argon2@example.com",
+				"password_hash": argon2Hash,
+				"email_confirm": true,
+			},
+			{
+				"phone":         "123456789",
+				"phone_confirm": true,
+			},
+			{
+				"email": "not-an-email",
+			},
+			{
+				"email":         "invalid-hash@example.com",
+				"password_hash": "plaintext",
+			},
+			{
+				"user_metadata": map[string]interface{}{
+					"name": "nobody",
+				},
+			},
+			{
+				"email": "BCRYPT@example.com",
+			},
+			{
+				// verifying the password would need 4 GiB of memory
+				"email": "costly-hash@example.com",
+				"password_hash": fmt.Sprintf(
+					"$argon2id$v=%d$m=4194304,t=1,p=1$%s$%s",
+					argon2.Version,
+					base64.RawStdEncoding.EncodeToString(salt),
+					base64.RawStdEncoding.EncodeToString(make([]byte, 32)),
+				),
+			},
+		},
+	})
+
+	require.Len(ts.T(), response.Users, 8)
+
+	expectedStatuses := []string{
+		adminImportCreated,
+		adminImportCreated,
+		adminImportCreated,
+		adminImportFailed,
+		adminImportFailed,
+		adminImportFailed,
+		adminImportSkipped,
+		adminImportFailed,
+	}
+
+	for i, status := range expectedStatuses {
+		result := response.Users[i]
+		require.Equal(ts.T(), i, result.Index)
+		require.Equal(ts.T(), status, result.Status, "user %d: %s", i, result.Error)
+
+		if status == adminImportFailed {
+			require.Nil(ts.T(), result.UserID)
+			require.NotEmpty(ts.T(), result.Error)
+		} else {
+			require.NotNil(ts.T(), result.UserID)
+			require.Empty(ts.T(), result.Error)
+		}
+	}
+
+	// duplicates are skipped and point to the existing user
+	require.Equal(ts.T(), *response.Users[0].UserID, *response.Users[6].UserID)
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, "bcrypt@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), "bcrypt", user.UserMetaData["name"])
+	require.Equal(ts.T(), []interface{}{"email"}, user.AppMetaData["providers"])
+	require.True(ts.T(), user.IsConfirmed())
+
+	user, err = models.FindUserByPhoneAndAudience(ts.API.db, "123456789", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), user.IsPhoneConfirmed())
+
+	// pre-hashed passwords can be used to sign in
+	require.Equal(ts.T(), http.StatusOK, ts.passwordGrant("bcrypt@example.com", "bcrypt-password"))
+	require.Equal(ts.T(), http.StatusOK, ts.passwordGrant("argon2@example.com", "argon2-password"))
+	require.Equal(ts.T(), http.StatusBadRequest, ts.passwordGrant("argon2@example.com", "bcrypt-password"))
+}
+
+func (ts *AdminTestSuite) TestAdminUsersImportOverwrite() {
+	response := ts.importUsers(map[string]interface{}{
+		"users": []map[string]interface{}{
+			{
+				"email":         "overwrite@example.com",
+				"email_confirm": true,
+				"user_metadata": map[string]interface{}{
+					"name": "before",
+				},
+			},
+		},
+	})
+	require.Equal(ts.T(), adminImportCreated, response.Users[0].Status)
+
+	passwordHash, err := crypto.GenerateFromPassword(context.Background(), "new-password")
+	require.NoError(ts.T(), err)
+
+	response = ts.importUsers(map[string]interface{}{
+		"overwrite": true,
+		"users": []map[string]interface{}{
+			{
+				"email":         "overwrite@example.com",
+				"password_hash": passwordHash,
+				"user_metadata": map[string]interface{}{
+					"name": "after",
+				},
+			},
+		},
+	})
+	require.Equal(ts.T(), adminImportUpdated, response.Users[0].Status)
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, "overwrite@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), *response.Users[0].UserID, user.ID)
+	require.Equal(ts.T(), "after", user.UserMetaData["name"])
+
+	require.Equal(ts.T(), http.StatusOK, ts.passwordGrant("overwrite@example.com", "new-password"))
+}
+
+// signIn signs in with a password grant from a client with the given user
+// agent and returns the issued tokens.
+func (ts *AdminTestSuite) signIn(email, password, userAgent string) *AccessTokenResponse {
+	return ts.signInWithHeaders(email, password, map[string]string{"User-Agent": userAgent})
+}
+
+func (ts *AdminTestSuite) signInWithHeaders(email, password string, headers map[string]string) *AccessTokenResponse {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"email":    email,
+		"password": password,
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/token?grant_type=password", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	token := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+	return token
+}
+
+// refresh performs a refresh token grant and returns the status code and,
+// on success, the new refresh token.
+func (ts *AdminTestSuite) adminUsersBatchDelete(params map[string]interface{}) (int, *AdminBatchDeleteResponse) {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/users/delete", &buffer)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+
+	data := &AdminBatchDeleteResponse{}
+	if w.Code == http.StatusOK {
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+	}
+
+	return w.Code, data
+}
+
+func (ts *AdminTestSuite) TestAdminUsersBatchDelete() {
+	createUser := func(email string, confirmed bool, createdAt time.Time) *models.User {
+		u, err := models.NewUser("", email, "test-password", ts.Config.JWT.Aud, nil)
+		require.NoError(ts.T(), err)
+		u.CreatedAt = createdAt
+		require.NoError(ts.T(), ts.API.db.Create(u))
+		require.NoError(ts.T(), ts.API.db.RawQuery("update users set created_at = ? where id = ?", createdAt, u.ID).Exec())
+		if confirmed {
+			require.NoError(ts.T(), u.Confirm(ts.API.db))
+		}
+		return u
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	recent := time.Now()
+
+	createUser("bot1@bots.example.com", false, old)
+	createUser("bot2@bots.example.com", false, recent)
+	createUser("bot3@BOTS.example.com", true, old)
+	createUser("user@example.com", false, old)
+	createUser("user@notbots.example.com", false, old)
+
+	cutoff := time.Now().Add(-24 * time.Hour).Format(time.RFC3339)
+
+	cases := []struct {
+		desc   string
+		filter map[string]interface{}
+		count  int
+	}{
+		{
+			desc:   "email domain",
+			filter: map[string]interface{}{"email_domain": "bots.example.com"},
+			count:  3,
+		},
+		{
+			desc:   "created before",
+			filter: map[string]interface{}{"created_before": cutoff},
+			count:  4,
+		},
+		{
+			desc:   "never confirmed",
+			filter: map[string]interface{}{"never_confirmed": true},
+			count:  4,
+		},
+		{
+			desc:   "all filters",
+			filter: map[string]interface{}{"email_domain": "bots.example.com", "created_before": cutoff, "never_confirmed": true},
+			count:  1,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			// dry runs are the default
+			status, data := ts.adminUsersBatchDelete(c.filter)
+			require.Equal(ts.T(), http.StatusOK, status)
+			require.True(ts.T(), data.DryRun)
+			require.Equal(ts.T(), c.count, data.Count)
+			require.NotEmpty(ts.T(), data.ConfirmationToken)
+		})
+	}
+
+	// an empty filter would select everyone
+	status, _ := ts.adminUsersBatchDelete(map[string]interface{}{"dry_run": true})
+	require.Equal(ts.T(), http.StatusBadRequest, status)
+
+	for _, domain := range []string{"", "%", "_%", "%.example.com", ".", "bots..example.com"} {
+		status, _ := ts.adminUsersBatchDelete(map[string]interface{}{"email_domain": domain, "never_confirmed": true})
+		require.Equal(ts.T(), http.StatusBadRequest, status, domain)
+	}
+
+	filter := map[string]interface{}{"email_domain": "bots.example.com", "never_confirmed": true}
+	status, preview := ts.adminUsersBatchDelete(filter)
+	require.Equal(ts.T(), http.StatusOK, status)
+	require.Equal(ts.T(), 2, preview.Count)
+
+	params := func(filter map[string]interface{}, token string) map[string]interface{} {
+		p := map[string]interface{}{"dry_run": false, "confirmation_token": token}
+		for key, value := range filter {
+			p[key] = value
+		}
+		return p
+	}
+
+	status, _ = ts.adminUsersBatchDelete(params(filter, ""))
+	require.Equal(ts.T(), http.StatusBadRequest, status, "deleting requires a confirmation token")
+
+	status, _ = ts.adminUsersBatchDelete(params(map[string]interface{}{"email_domain": "example.com"}, preview.ConfirmationToken))
+	require.Equal(ts.T(), http.StatusBadRequest, status, "the confirmation token is bound to the filter")
+
+	status, _ = ts.adminUsersBatchDelete(params(filter, ts.token))
+	require.Equal(ts.T(), http.StatusBadRequest, status, "access tokens aren't confirmation tokens")
+
+	status, data := ts.adminUsersBatchDelete(params(filter, preview.ConfirmationToken))
+	require.Equal(ts.T(), http.StatusOK, status)
+	require.False(ts.T(), data.DryRun)
+	require.Equal(ts.T(), 2, data.Count)
+
+	for _, email := range []string{"bot1@bots.example.com", "bot2@bots.example.com"} {
+		_, err := models.FindUserByEmailAndAudience(ts.API.db, email, ts.Config.JWT.Aud)
+		require.True(ts.T(), models.IsNotFoundError(err), email)
+	}
+
+	for _, email := range []string{"bot3@bots.example.com", "user@example.com", "user@notbots.example.com"} {
+		_, err := models.FindUserByEmailAndAudience(ts.API.db, email, ts.Config.JWT.Aud)
+		require.NoError(ts.T(), err, email)
+	}
+
+	// the matching users changed since the preview
+	status, _ = ts.adminUsersBatchDelete(params(filter, preview.ConfirmationToken))
+	require.Equal(ts.T(), http.StatusConflict, status)
+
+	entries, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.UsersBatchDeletedAction), nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), entries, 1)
+}
+
+func (ts *AdminTestSuite) refresh(refreshToken string) (int, string) {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"refresh_token": refreshToken,
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/token?grant_type=refresh_token", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+
+	token := &AccessTokenResponse{}
+	if w.Code == http.StatusOK {
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+	}
+	return w.Code, token.RefreshToken
+}
+
+func (ts *AdminTestSuite) adminUserSessions(u *models.User) []AdminSession {
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/admin/users/%s/sessions", u.ID), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	response := AdminSessionsResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&response))
+	return response.Sessions
+}
+
+func (ts *AdminTestSuite) adminDeleteSessions(path string) int {
+	req := httptest.NewRequest(http.MethodDelete, path, nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+func (ts *AdminTestSuite) TestAdminUserSessions() {
+	u, err := models.NewUser("", "test-sessions@example.com", "test-password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+
+	other, err := models.NewUser("", "test-sessions-other@example.com", "test-password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(other), "Error creating user")
+	require.NoError(ts.T(), other.Confirm(ts.API.db))
+
+	laptop := ts.signIn("test-sessions@example.com", "test-password", "laptop")
+	phone := ts.signIn("test-sessions@example.com", "test-password", "phone")
+	ts.signIn("test-sessions-other@example.com", "test-password", "other")
+
+	sessions := ts.adminUserSessions(u)
+	require.Len(ts.T(), sessions, 2)
+
+	// newest first
+	require.NotNil(ts.T(), sessions[0].UserAgent)
+	assert.Equal(ts.T(), "phone", *sessions[0].UserAgent)
+	require.NotNil(ts.T(), sessions[1].UserAgent)
+	assert.Equal(ts.T(), "laptop", *sessions[1].UserAgent)
+	assert.NotNil(ts.T(), sessions[1].IP)
+	assert.False(ts.T(), sessions[1].CreatedAt.IsZero())
+
+	laptopSessionID := sessions[1].ID
+
+	// sessions of other users can't be revoked through this user
+	otherSessions := ts.adminUserSessions(other)
+	require.Len(ts.T(), otherSessions, 1)
+	assert.Equal(ts.T(), http.StatusNotFound, ts.adminDeleteSessions(fmt.Sprintf("/admin/users/%s/sessions/%s", u.ID, otherSessions[0].ID)))
+	assert.Equal(ts.T(), http.StatusBadRequest, ts.adminDeleteSessions(fmt.Sprintf("/admin/users/%s/sessions/not-a-uuid", u.ID)))
+
+	// revoke a single session
+	require.Equal(ts.T(), http.StatusOK, ts.adminDeleteSessions(fmt.Sprintf("/admin/users/%s/sessions/%s", u.ID, laptopSessionID)))
+
+	sessions = ts.adminUserSessions(u)
+	require.Len(ts.T(), sessions, 1)
+	assert.NotEqual(ts.T(), laptopSessionID, sessions[0].ID)
+
+	code, _ := ts.refresh(laptop.RefreshToken)
+	assert.Equal(ts.T(), http.StatusBadRequest, code)
+
+	code, phoneRefreshToken := ts.refresh(phone.RefreshToken)
+	require.Equal(ts.T(), http.StatusOK, code)
+
+	// revoke all sessions
+	require.Equal(ts.T(), http.StatusOK, ts.adminDeleteSessions(fmt.Sprintf("/admin/users/%s/sessions", u.ID)))
+
+	assert.Empty(ts.T(), ts.adminUserSessions(u))
+
+	code, _ = ts.refresh(phoneRefreshToken)
+	assert.Equal(ts.T(), http.StatusBadRequest, code)
+
+	// other users are not affected
+	assert.Len(ts.T(), ts.adminUserSessions(other), 1)
+}
+
+func (ts *AdminTestSuite) TestAdminUserSessionsClientInfo() {
+	u, err := models.NewUser("", "test-session-client@example.com", "test-password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+	require.NoError(ts.T(), u.Confirm(ts.API.db))
+
+	defer func(trustedProxies []string) {
+		ts.Config.Security.TrustedProxies = trustedProxies
+	}(ts.Config.Security.TrustedProxies)
+
+	// httptest requests come from 192.0.2.1
+	ts.Config.Security.TrustedProxies = nil
+	ts.signInWithHeaders("test-session-client@example.com", "test-password", map[string]string{
+		"User-Agent":      "untrusted",
+		"X-Forwarded-For": "198.51.100.7",
+	})
+
+	ts.Config.Security.TrustedProxies = []string{"192.0.2.0/24"}
+	ts.signInWithHeaders("test-session-client@example.com", "test-password", map[string]string{
+		"User-Agent":      "  Mozilla/5.0\t(trusted)\x00 ",
+		"X-Forwarded-For": "127.0.0.1, 198.51.100.8",
+	})
+
+	sessions := ts.adminUserSessions(u)
+	require.Len(ts.T(), sessions, 2)
+
+	require.NotNil(ts.T(), sessions[0].UserAgent)
+	assert.Equal(ts.T(), "Mozilla/5.0 (trusted)", *sessions[0].UserAgent)
+	require.NotNil(ts.T(), sessions[0].IP)
+	assert.Equal(ts.T(), "198.51.100.8", *sessions[0].IP)
+
+	require.NotNil(ts.T(), sessions[1].IP)
+	assert.Equal(ts.T(), "192.0.2.1", *sessions[1].IP)
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+type adminUserVerificationParams struct {
+	EmailVerified *bool `json:"email_verified"`
+	PhoneVerified *bool `json:"phone_verified"`
+}
+
+// adminUserUpdateVerification marks a user's email address or phone number
+// as verified or not verified, without the user verifying it.
+func (a *API) adminUserUpdateVerification(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.db.WithContext(ctx)
+	user := getUser(ctx)
+	adminUser := getAdminUser(ctx)
+
+	params := &adminUserVerificationParams{}
+
+	body, err := getBodyBytes(r)
+	if err != nil {
+		return badRequestError("Could not read body").WithInternalError(err)
+	}
+
+	if err := json.Unmarshal(body, params); err != nil {
+		return badRequestError("Could not read verification params: %v", err)
+	}
+
+	if params.EmailVerified == nil && params.PhoneVerified == nil {
+		return badRequestError("email_verified or phone_verified required")
+	}
+
+	if params.EmailVerified != nil && *params.EmailVerified && user.GetEmail() == "" {
+		return unprocessableEntityError("User has no email address to verify")
+	}
+
+	if params.PhoneVerified != nil && *params.PhoneVerified && user.GetPhone() == "" {
+		return unprocessableEntityError("User has no phone number to verify")
+	}
+
+	err = db.Transaction(func(tx *storage.Connection) error {
+		traits := map[string]interface{}{
+			"user_id": user.ID,
+		}
+
+		if params.EmailVerified != nil {
+			if *params.EmailVerified && user.EmailConfirmedAt == nil {
+				if terr := user.Confirm(tx); terr != nil {
+					return internalServerError("Error updating user").WithInternalError(terr)
+				}
+			} else if !*params.EmailVerified && user.EmailConfirmedAt != nil {
+				if terr := user.UnconfirmEmail(tx); terr != nil {
+					return internalServerError("Error updating user").WithInternalError(terr)
+				}
+			}
+
+			if terr := updateIdentityVerified(tx, user, "email", "email_verified", *params.EmailVerified); terr != nil {
+				return internalServerError("Error updating identity").WithInternalError(terr)
+			}
+
+			traits["email_verified"] = *params.EmailVerified
+		}
+
+		if params.PhoneVerified != nil {
+			if *params.PhoneVerified && user.PhoneConfirmedAt == nil {
+				if terr := user.ConfirmPhone(tx); terr != nil {
+					return internalServerError("Error updating user").WithInternalError(terr)
+				}
+			} else if !*params.PhoneVerified && user.PhoneConfirmedAt != nil {
+				if terr := user.UnconfirmPhone(tx); terr != nil {
+					return internalServerError("Error updating user").WithInternalError(terr)
+				}
+			}
+
+			if terr := updateIdentityVerified(tx, user, "phone", "phone_verified", *params.PhoneVerified); terr != nil {
+				return internalServerError("Error updating identity").WithInternalError(terr)
+			}
+
+			traits["phone_verified"] = *params.PhoneVerified
+		}
+
+		return models.NewAuditLogEntry(r, tx, adminUser, models.UserModifiedAction, "", traits)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, user)
+}
+
+// updateIdentityVerified keeps the verification claim of the user's email or
+// phone identity in sync with the user, if the user has such an identity.
+func updateIdentityVerified(tx *storage.Connection, user *models.User, provider, claim string, verified bool) error {
+	identity, err := models.FindIdentityByIdAndProvider(tx, user.ID.String(), provider)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+
+	return identity.UpdateIdentityData(tx, map[string]interface{}{
+		claim: verified,
+	})
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/fatih/structs"
+	"github.com/gofrs/uuid"
+	"github.com/supabase/gotrue/internal/api/provider"
+	"github.com/supabase/gotrue/internal/metering"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// AnonymousGrantParams are the parameters the AnonymousGrant method accepts
+type AnonymousGrantParams struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+// AnonymousGrant implements the anonymous grant type flow, which creates a
+// user without any credentials and signs them in. The user can later be
+// converted into a permanent user by signing up with an email address or
+// signing in with an ID token while authenticated as the anonymous user.
+func (a *API) AnonymousGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	config := a.config
+	db := a.db.WithContext(ctx)
+
+	if !config.External.AnonymousUsers.Enabled {
+		return unprocessableEntityError("Anonymous sign-ins are disabled")
+	}
+
+	if config.DisableSignup || config.InviteOnly {
+		return signupDisabledError("Signups not allowed for this instance")
+	}
+
+	params := &AnonymousGrantParams{}
+
+	body, err := getBodyBytes(r)
+	if err != nil {
+		return badRequestError("Could not read body").WithInternalError(err)
+	}
+
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, params); err != nil {
+			return badRequestError("Could not read anonymous grant params: %v", err)
+		}
+	}
+
+	signupParams := &SignupParams{
+		Provider: "anonymous",
+		Aud:      a.requestAud(ctx, r),
+		Data:     params.Data,
+	}
+
+	var user *models.User
+	var token *AccessTokenResponse
+	err = db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		user, terr = a.signupNewUser(ctx, tx, signupParams, false /* <- isSSOUser */)
+		if terr != nil {
+			return terr
+		}
+		if terr = models.NewAuditLogEntry(r, tx, user, models.UserSignedUpAction, "", map[string]interface{}{
+			"provider": signupParams.Provider,
+		}); terr != nil {
+			return terr
+		}
+		if terr = triggerEventHooks(ctx, tx, SignupEvent, user, config); terr != nil {
+			return terr
+		}
+		var grantParams models.GrantParams
+		grantParams.FillGrantParams(r, config.Security.TrustedProxies)
+
+		token, terr = a.issueRefreshToken(ctx, tx, user, models.Anonymous, grantParams)
+		if terr != nil {
+			return terr
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the access token is only set once the transaction is committed
+	if err := a.setCookieTokens(config, token, false, w); err != nil {
+		return internalServerError("Failed to set JWT cookie. %s", err)
+	}
+
+	metering.RecordLogin("anonymous", user.ID)
+	return sendJSON(w, http.StatusOK, token)
+}
+
+// convertAnonymousUser attaches the email address and password of a signup
+// to an anonymous user, converting them into a permanent user. The email
+// address still needs to be confirmed like for any other signup.
+func (a *API) convertAnonymousUser(tx *storage.Connection, r *http.Request, user *models.User, session *models.Session, params *SignupParams) error {
+	if err := user.SetEmail(tx, params.Email); err != nil {
+		return internalServerError("Database error updating user").WithInternalError(err)
+	}
+
+	var sessionID *uuid.UUID
+	if session != nil {
+		sessionID = &session.ID
+	}
+
+	// keeps the session of the anonymous user
+	if err := user.UpdatePassword(tx, params.Password, sessionID); err != nil {
+		return internalServerError("Database error updating user").WithInternalError(err)
+	}
+
+	if err := user.UpdateUserMetaData(tx, params.Data); err != nil {
+		return internalServerError("Database error updating user").WithInternalError(err)
+	}
+
+	if params.Locale != "" {
+		if err := user.SetLocale(tx, params.Locale); err != nil {
+			return internalServerError("Database error updating user").WithInternalError(err)
+		}
+	}
+
+	identity, err := a.createNewIdentity(tx, user, params.Provider, structs.Map(provider.Claims{
+		Subject: user.ID.String(),
+		Email:   user.GetEmail(),
+	}))
+	if err != nil {
+		return err
+	}
+	user.Identities = []models.Identity{*identity}
+
+	if err := user.UpdateAppMetaData(tx, map[string]interface{}{"provider": params.Provider}); err != nil {
+		return internalServerError("Database error updating user").WithInternalError(err)
+	}
+
+	if err := user.UpdateAppMetaDataProviders(tx); err != nil {
+		return internalServerError("Database error updating user").WithInternalError(err)
+	}
+
+	if err := user.ConvertToPermanent(tx); err != nil {
+		return internalServerError("Database error updating user").WithInternalError(err)
+	}
+
+	return models.NewAuditLogEntry(r, tx, user, models.UserConvertedAction, "", map[string]interface{}{
+		"provider": params.Provider,
+	})
+}
@@ -4,22 +4,26 @@ import (
 	"context"
 	"net/http"
 	"regexp"
+	"sync"
 	"time"
 
-	"github.com/didip/tollbooth/v5"
-	"github.com/didip/tollbooth/v5/limiter"
 	"github.com/go-chi/chi"
 	"github.com/rs/cors"
 	"github.com/sebest/xff"
 	"github.com/sirupsen/logrus"
+	"github.com/supabase/gotrue/internal/api/provider"
 	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/crypto"
 	"github.com/supabase/gotrue/internal/mailer"
+	"github.com/supabase/gotrue/internal/models"
 	"github.com/supabase/gotrue/internal/observability"
+	"github.com/supabase/gotrue/internal/security"
 	"github.com/supabase/gotrue/internal/storage"
 )
 
 const (
 	audHeaderName  = "X-JWT-AUD"
+	audPathPrefix  = "/aud/"
 	defaultVersion = "unknown version"
 )
 
@@ -31,6 +35,20 @@ type API struct {
 	db      *storage.Connection
 	config  *conf.GlobalConfiguration
 	version string
+
+	oidcProviders       *provider.OIDCProviderCache
+	idTokenGrantLimiter *security.TokenBucketLimiter
+
+	// now returns the current time, tests may replace it to control
+	// time dependent behavior such as session expiry
+	now func() time.Time
+
+	// avatarClient fetches the profile pictures of external identities,
+	// tests may replace it to fetch from local servers
+	avatarClient *http.Client
+	// avatarFetches tracks the profile pictures being fetched in the
+	// background, so that tests can wait for them
+	avatarFetches sync.WaitGroup
 }
 
 // NewAPI instantiates a new REST API
@@ -52,17 +70,52 @@ func (a *API) deprecationNotices(ctx context.Context) {
 	}
 }
 
+// newIdTokenGrantLimiter allows id_token grant requests at the configured rate
+// per 5 minutes, all of which can be used at once.
+func newIdTokenGrantLimiter(config *conf.GlobalConfiguration) *security.TokenBucketLimiter {
+	return security.NewTokenBucketLimiter(config.RateLimitIdTokenGrant/(60*5), int(config.RateLimitIdTokenGrant), time.Hour)
+}
+
 // NewAPIWithVersion creates a new REST API using the specified version
 func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfiguration, db *storage.Connection, version string) *API {
-	api := &API{config: globalConfig, db: db, version: version}
+	api := &API{config: globalConfig, db: db, version: version, now: time.Now, avatarClient: newAvatarClient()}
+	api.oidcProviders = provider.NewOIDCProviderCache(globalConfig.External.OIDCProviderCacheTTL)
+	api.idTokenGrantLimiter = newIdTokenGrantLimiter(globalConfig)
 
 	api.deprecationNotices(ctx)
 
+	crypto.ConfigurePasswordHashing(&globalConfig.Security)
+	if err := crypto.ConfigureEncryption(&globalConfig.Security); err != nil {
+		logrus.WithError(err).Fatal("unable to configure encryption")
+	}
+	models.EncryptedIdentityDataFields = globalConfig.Security.EncryptedIdentityDataFields
+	if err := provider.ConfigureDiscoveryTLS(&globalConfig.External.TLS); err != nil {
+		logrus.WithError(err).Fatal("unable to configure external TLS")
+	}
+	provider.ConfigureDiscoveryRetry(&globalConfig.External.DiscoveryRetry)
+	if err := models.ConfigureAuditLog(&globalConfig.AuditLog); err != nil {
+		logrus.WithError(err).Fatal("unable to configure audit log")
+	}
+	if err := globalConfig.External.LoadOIDCProviders(); err != nil {
+		if globalConfig.External.OIDCProviders == nil {
+			logrus.WithError(err).Fatal("unable to load OIDC providers")
+		}
+
+		// the other providers are usable, and the files can be fixed
+		// while running
+		logrus.WithError(err).Error("unable to load some OIDC providers")
+	}
+	if globalConfig.External.OIDCProviders != nil {
+		go api.watchOIDCProviders(ctx)
+	}
+
 	xffmw, _ := xff.Default()
 	logger := observability.NewStructuredLogger(logrus.StandardLogger(), globalConfig)
 
 	r := newRouter()
 	r.Use(addRequestID(globalConfig))
+	r.Use(api.resolveAudience)
+	r.Use(api.resolveMailerTenant)
 
 	// request tracing should be added only when tracing or metrics is
 	// enabled
@@ -80,12 +133,17 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 	r.UseBypass(xffmw.Handler)
 	r.Use(recoverer)
+	r.Use(api.limitRequestBody)
+	r.Use(api.attachHookConnection)
 
 	if globalConfig.DB.CleanupEnabled {
 		r.UseBypass(api.databaseCleanup)
 	}
 
 	r.Get("/health", api.HealthCheck)
+	r.Get("/readyz", api.Readiness)
+	r.Get("/.well-known/jwks.json", api.JWKS)
+	r.Get("/avatars/{avatar_id}", api.AvatarGet)
 
 	r.Route("/callback", func(r *router) {
 		r.UseBypass(logger)
@@ -102,35 +160,40 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 		r.Get("/settings", api.Settings)
 
-		r.Get("/authorize", api.ExternalProviderRedirect)
+		r.With(api.requireValidRedirectTo).Get("/authorize", api.ExternalProviderRedirect)
 
 		sharedLimiter := api.limitEmailOrPhoneSentHandler()
-		r.With(sharedLimiter).With(api.requireAdminCredentials).Post("/invite", api.Invite)
-		r.With(sharedLimiter).With(api.verifyCaptcha).Post("/signup", api.Signup)
-		r.With(sharedLimiter).With(api.verifyCaptcha).With(api.requireEmailProvider).Post("/recover", api.Recover)
-		r.With(sharedLimiter).With(api.verifyCaptcha).Post("/resend", api.Resend)
-		r.With(sharedLimiter).With(api.verifyCaptcha).Post("/magiclink", api.MagicLink)
+		recipientLimiter := api.limitEmailPerRecipientHandler()
+		r.With(sharedLimiter).With(api.requireAdminCredentials).With(api.requireValidRedirectTo).Post("/invite", api.Invite)
+		r.With(sharedLimiter).With(api.verifyCaptcha).With(api.requireValidRedirectTo).Post("/signup", api.Signup)
+		r.With(sharedLimiter).With(api.verifyCaptcha).With(api.requireEmailProvider).With(api.requireValidRedirectTo).With(recipientLimiter).Post("/recover", api.Recover)
+		r.With(sharedLimiter).With(api.verifyCaptcha).With(api.requireValidRedirectTo).Post("/resend", api.Resend)
+		r.With(sharedLimiter).With(api.verifyCaptcha).With(api.requireValidRedirectTo).With(recipientLimiter).Post("/magiclink", api.MagicLink)
 
-		r.With(sharedLimiter).With(api.verifyCaptcha).Post("/otp", api.Otp)
+		r.With(sharedLimiter).With(api.verifyCaptcha).With(api.requireValidRedirectTo).With(recipientLimiter).Post("/otp", api.Otp)
 
 		r.With(api.limitHandler(
 			// Allow requests at the specified rate per 5 minutes.
-			tollbooth.NewLimiter(api.config.RateLimitTokenRefresh/(60*5), &limiter.ExpirableOptions{
-				DefaultExpirationTTL: time.Hour,
-			}).SetBurst(30),
+			security.NewTokenBucketLimiter(api.config.RateLimitTokenRefresh/(60*5), 30, time.Hour),
 		)).With(api.verifyCaptcha).Post("/token", api.Token)
 
+		// like the id_token grant, the ID token is the caller's credential,
+		// and it shares the grant's rate limit
+		r.Post("/token/verify", api.IdTokenVerify)
+		r.Post("/introspect", api.Introspect)
+
 		r.With(api.limitHandler(
 			// Allow requests at the specified rate per 5 minutes.
-			tollbooth.NewLimiter(api.config.RateLimitVerify/(60*5), &limiter.ExpirableOptions{
-				DefaultExpirationTTL: time.Hour,
-			}).SetBurst(30),
+			security.NewTokenBucketLimiter(api.config.RateLimitVerify/(60*5), 30, time.Hour),
 		)).Route("/verify", func(r *router) {
 			r.Get("/", api.Verify)
 			r.Post("/", api.Verify)
 		})
 
+		r.With(api.requireSessionIntrospectionEnabled).With(api.requireAccessToken).Get("/session", api.SessionGet)
+
 		r.With(api.requireAuthentication).Post("/logout", api.Logout)
+		r.With(api.requireAuthentication).Post("/logout/oidc", api.LogoutOIDC)
 
 		r.With(api.requireAuthentication).Route("/reauthenticate", func(r *router) {
 			r.Get("/", api.Reauthenticate)
@@ -138,23 +201,23 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 		r.With(api.requireAuthentication).Route("/user", func(r *router) {
 			r.Get("/", api.UserGet)
-			r.With(sharedLimiter).Put("/", api.UserUpdate)
+			r.With(sharedLimiter).With(api.requireValidRedirectTo).Put("/", api.UserUpdate)
+			r.Post("/identities/link", api.LinkIdentity)
+			r.Delete("/identities/{identity_id}", api.DeleteIdentity)
+			r.Get("/identities/{identity_id}/provider-token", api.ProviderToken)
 		})
 
 		r.With(api.requireAuthentication).Route("/factors", func(r *router) {
-			r.Post("/", api.EnrollFactor)
+			r.With(api.requireFactorManagementStepUp).Post("/", api.EnrollFactor)
 			r.Route("/{factor_id}", func(r *router) {
 				r.Use(api.loadFactor)
 
 				r.With(api.limitHandler(
-					tollbooth.NewLimiter(api.config.MFA.RateLimitChallengeAndVerify/60, &limiter.ExpirableOptions{
-						DefaultExpirationTTL: time.Minute,
-					}).SetBurst(30))).Post("/verify", api.VerifyFactor)
+					security.NewTokenBucketLimiter(api.config.MFA.RateLimitChallengeAndVerify/60, 30, time.Minute))).Post("/verify", api.VerifyFactor)
 				r.With(api.limitHandler(
-					tollbooth.NewLimiter(api.config.MFA.RateLimitChallengeAndVerify/60, &limiter.ExpirableOptions{
-						DefaultExpirationTTL: time.Minute,
-					}).SetBurst(30))).Post("/challenge", api.ChallengeFactor)
-				r.Delete("/", api.UnenrollFactor)
+					security.NewTokenBucketLimiter(api.config.MFA.RateLimitChallengeAndVerify/60, 30, time.Minute))).Post("/challenge", api.ChallengeFactor)
+				r.With(api.requireFactorManagementStepUp).Post("/recovery_codes", api.RegenerateRecoveryCodes)
+				r.With(api.requireFactorManagementStepUp).Delete("/", api.UnenrollFactor)
 
 			})
 		})
@@ -163,9 +226,7 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 			r.Use(api.requireSAMLEnabled)
 			r.With(api.limitHandler(
 				// Allow requests at the specified rate per 5 minutes.
-				tollbooth.NewLimiter(api.config.RateLimitSso/(60*5), &limiter.ExpirableOptions{
-					DefaultExpirationTTL: time.Hour,
-				}).SetBurst(30),
+				security.NewTokenBucketLimiter(api.config.RateLimitSso/(60*5), 30, time.Hour),
 			)).With(api.verifyCaptcha).Post("/", api.SingleSignOn)
 
 			r.Route("/saml", func(r *router) {
@@ -173,15 +234,14 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 				r.With(api.limitHandler(
 					// Allow requests at the specified rate per 5 minutes.
-					tollbooth.NewLimiter(api.config.SAML.RateLimitAssertion/(60*5), &limiter.ExpirableOptions{
-						DefaultExpirationTTL: time.Hour,
-					}).SetBurst(30),
+					security.NewTokenBucketLimiter(api.config.SAML.RateLimitAssertion/(60*5), 30, time.Hour),
 				)).Post("/acs", api.SAMLACS)
 			})
 		})
 
 		r.Route("/admin", func(r *router) {
 			r.Use(api.requireAdminCredentials)
+			r.Use(api.removeRequestBodyLimit)
 
 			r.Route("/audit", func(r *router) {
 				r.Get("/", api.adminAuditLog)
@@ -190,6 +250,8 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 			r.Route("/users", func(r *router) {
 				r.Get("/", api.adminUsers)
 				r.Post("/", api.adminUserCreate)
+				r.Post("/import", api.adminUsersImport)
+				r.Post("/delete", api.adminUsersBatchDelete)
 
 				r.Route("/{user_id}", func(r *router) {
 					r.Use(api.loadUser)
@@ -199,9 +261,21 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 							r.Use(api.loadFactor)
 							r.Delete("/", api.adminUserDeleteFactor)
 							r.Put("/", api.adminUserUpdateFactor)
+							r.Post("/recovery_codes", api.adminUserRegenerateRecoveryCodes)
 						})
 					})
 
+					r.Route("/sessions", func(r *router) {
+						r.Get("/", api.adminUserGetSessions)
+						r.Delete("/", api.adminUserDeleteSessions)
+						r.Delete("/{session_id}", api.adminUserDeleteSession)
+					})
+
+					r.Put("/verification", api.adminUserUpdateVerification)
+					r.Post("/unlock", api.adminUserUnlock)
+					r.Post("/restore", api.adminUserRestore)
+					r.Post("/impersonate", api.adminUserImpersonate)
+
 					r.Get("/", api.adminUserGet)
 					r.Put("/", api.adminUserUpdate)
 					r.Delete("/", api.adminUserDelete)
@@ -210,6 +284,14 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 			r.Post("/generate_link", api.GenerateLink)
 
+			r.Post("/identities", api.adminIdentityCreate)
+
+			r.Route("/external_bans", func(r *router) {
+				r.Get("/", api.adminExternalBans)
+				r.Post("/", api.adminExternalBanCreate)
+				r.Delete("/{provider}/{subject}", api.adminExternalBanDelete)
+			})
+
 			r.Route("/sso", func(r *router) {
 				r.Route("/providers", func(r *router) {
 					r.Get("/", api.adminSSOProvidersList)
@@ -257,5 +339,5 @@ func (a *API) HealthCheck(w http.ResponseWriter, r *http.Request) error {
 // Mailer returns NewMailer with the current tenant config
 func (a *API) Mailer(ctx context.Context) mailer.Mailer {
 	config := a.config
-	return mailer.NewMailer(config)
+	return mailer.NewMailer(config, getMailerTenant(ctx))
 }
@@ -14,7 +14,7 @@ import (
 
 // requireAuthentication checks incoming requests for tokens presented using the Authorization header
 func (a *API) requireAuthentication(w http.ResponseWriter, r *http.Request) (context.Context, error) {
-	token, err := a.extractBearerToken(r)
+	token, err := a.extractAccessToken(r)
 	config := a.config
 	if err != nil {
 		a.clearCookieTokens(config, w)
@@ -35,6 +35,54 @@ func (a *API) requireAuthentication(w http.ResponseWriter, r *http.Request) (con
 	return ctx, err
 }
 
+// requireAccessToken verifies the request's access token without loading its
+// user or session, for endpoints that only need its claims.
+func (a *API) requireAccessToken(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	token, err := a.extractAccessToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.parseJWTClaims(token, r)
+}
+
+// maybeLoadAnonymousUser returns the anonymous user, and their session, that
+// the request's bearer token was issued to. Requests without a bearer token,
+// or with one that wasn't issued to an anonymous user (such as the anon API
+// key), are not associated with an anonymous user.
+func (a *API) maybeLoadAnonymousUser(r *http.Request) (*models.User, *models.Session, error) {
+	if r.Header.Get("Authorization") == "" {
+		return nil, nil, nil
+	}
+
+	bearer, err := a.extractBearerToken(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, err := a.parseJWTClaims(bearer, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if claims := getClaims(ctx); claims == nil || claims.Subject == "" || !claims.IsAnonymous {
+		return nil, nil, nil
+	}
+
+	ctx, err = a.maybeLoadUserOrSession(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := getUser(ctx)
+	if !user.IsAnonymous {
+		// the user has been converted since the token was issued
+		return nil, nil, nil
+	}
+
+	return user, getSession(ctx), nil
+}
+
 func (a *API) requireAdmin(ctx context.Context, w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	// Find the administrative user
 	claims := getClaims(ctx)
@@ -54,6 +102,21 @@ func (a *API) requireAdmin(ctx context.Context, w http.ResponseWriter, r *http.R
 	return nil, unauthorizedError("User not allowed")
 }
 
+// extractAccessToken returns the bearer token of the request or, if cookie
+// authentication is enabled and there's no Authorization header, the access
+// token cookie.
+func (a *API) extractAccessToken(r *http.Request) (string, error) {
+	config := a.config
+
+	if config.Cookie.Authenticate && r.Header.Get("Authorization") == "" {
+		if cookie, err := r.Cookie(config.Cookie.Key + "-access-token"); err == nil && cookie.Value != "" {
+			return cookie.Value, nil
+		}
+	}
+
+	return a.extractBearerToken(r)
+}
+
 func (a *API) extractBearerToken(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	matches := bearerRegexp.FindStringSubmatch(authHeader)
@@ -68,10 +131,8 @@ func (a *API) parseJWTClaims(bearer string, r *http.Request) (context.Context, e
 	ctx := r.Context()
 	config := a.config
 
-	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
-	token, err := p.ParseWithClaims(bearer, &GoTrueClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.JWT.Secret), nil
-	})
+	p := jwt.Parser{ValidMethods: jwtValidMethods}
+	token, err := p.ParseWithClaims(bearer, &GoTrueClaims{}, jwtVerificationKey(&config.JWT, a.now()))
 	if err != nil {
 		return nil, unauthorizedError("invalid JWT: unable to parse or verify signature, %v", err)
 	}
@@ -104,6 +165,9 @@ func (a *API) maybeLoadUserOrSession(ctx context.Context) (context.Context, erro
 			}
 			return ctx, err
 		}
+		if user.IsDeleted() {
+			return ctx, unauthorizedError("User is deleted")
+		}
 		ctx = withUser(ctx, user)
 	}
 
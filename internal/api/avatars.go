@@ -0,0 +1,303 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/gofrs/uuid"
+	"github.com/supabase/gotrue/internal/api/provider"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/observability"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// avatarContentTypes are the image formats avatars are stored in. Other
+// formats, notably SVG, are rejected as they can contain scripts.
+var avatarContentTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// AvatarGet serves a stored avatar.
+func (a *API) AvatarGet(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.db.WithContext(ctx)
+
+	avatarID, err := uuid.FromString(chi.URLParam(r, "avatar_id"))
+	if err != nil {
+		return notFoundError("Avatar not found")
+	}
+
+	avatar, err := models.FindAvatarByID(db, avatarID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return notFoundError("Avatar not found")
+		}
+		return internalServerError("Database error finding avatar").WithInternalError(err)
+	}
+
+	// avatars are never updated, a changed picture is stored as a new one
+	w.Header().Set("Content-Type", avatar.ContentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(avatar.Data)
+	return err
+}
+
+// avatarMaxRedirects is how many redirects are followed when fetching an
+// avatar.
+const avatarMaxRedirects = 3
+
+// newAvatarClient returns the HTTP client avatars are fetched with. As the
+// URLs come from external identities, it only connects to public addresses
+// over HTTPS, so that they can't be used to reach internal services.
+func newAvatarClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		// the address is checked after it has been resolved, so
+		// that host names resolving to internal addresses are
+		// rejected too
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+
+			if !isPublicAvatarIP(addrPort.Addr()) {
+				return fmt.Errorf("avatar address %q is not public", addrPort.Addr())
+			}
+
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			// a proxy would be dialed instead of the avatar's host
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > avatarMaxRedirects {
+				return fmt.Errorf("avatar redirected more than %d times", avatarMaxRedirects)
+			}
+
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("avatar redirected to unsupported URL scheme %q", req.URL.Scheme)
+			}
+
+			return nil
+		},
+	}
+}
+
+// avatarDeniedPrefixes are the address ranges avatars are never fetched from,
+// as they are private, reserved or reach other networks than the internet.
+var avatarDeniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link local
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("::/96"),           // unspecified, loopback and IPv4 compatible
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments, including Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+	netip.MustParsePrefix("fe80::/10"),       // link local
+	netip.MustParsePrefix("fec0::/10"),       // site local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// nat64Prefix is the well-known NAT64 prefix, whose addresses reach the IPv4
+// address in their last 32 bits.
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// isPublicAvatarIP checks if avatars may be fetched from the IP address.
+func isPublicAvatarIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() {
+		return false
+	}
+
+	if nat64Prefix.Contains(ip) {
+		ip16 := ip.As16()
+		return isPublicAvatarIP(netip.AddrFrom4([4]byte{ip16[12], ip16[13], ip16[14], ip16[15]}))
+	}
+
+	for _, prefix := range avatarDeniedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// storeAvatars replaces the profile picture URLs of the claims by the URLs of
+// stored copies, if enabled. Pictures that aren't stored yet keep their
+// original URL, and are fetched and stored once the transaction commits, so
+// that the copies can be used from the next sign in on.
+func (a *API) storeAvatars(r *http.Request, tx *storage.Connection, claims *provider.Claims) {
+	if !a.config.External.Avatars.Enabled || claims == nil {
+		return
+	}
+
+	ctx := r.Context()
+	log := observability.GetLogEntry(r)
+
+	for _, pictureURL := range []*string{&claims.Picture, &claims.AvatarURL} {
+		if *pictureURL == "" {
+			continue
+		}
+
+		sourceURL := *pictureURL
+
+		avatar, err := models.FindAvatarBySourceURL(tx, sourceURL)
+		if err != nil {
+			if !models.IsNotFoundError(err) {
+				log.WithError(err).WithField("picture_url", sourceURL).Warn("Unable to find avatar, using the provider's URL")
+				continue
+			}
+
+			// fetching the picture must neither hold the transaction
+			// open nor delay the response, and a picture that can't
+			// be stored must not fail the sign in
+			_ = tx.AfterCommit(func() error {
+				a.avatarFetches.Add(1)
+				go func() {
+					defer a.avatarFetches.Done()
+
+					if err := a.storeAvatar(sourceURL); err != nil {
+						log.WithError(err).WithField("picture_url", sourceURL).Warn("Unable to store avatar, using the provider's URL")
+					}
+				}()
+
+				return nil
+			})
+			continue
+		}
+
+		avatarURL, err := a.avatarURL(ctx, avatar)
+		if err != nil {
+			log.WithError(err).WithField("picture_url", sourceURL).Warn("Unable to build avatar URL, using the provider's URL")
+			continue
+		}
+
+		*pictureURL = avatarURL
+	}
+}
+
+// storeAvatar fetches the picture at the source URL and stores a copy of it.
+// It runs after the request that found the picture has completed, so it is
+// only bounded by the avatar timeout.
+func (a *API) storeAvatar(sourceURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.External.Avatars.Timeout)
+	defer cancel()
+
+	contentType, data, err := a.fetchAvatar(ctx, sourceURL)
+	if err != nil {
+		return err
+	}
+
+	avatar := models.NewAvatar(sourceURL, contentType, data)
+	if err := a.db.WithContext(ctx).Create(avatar); err != nil {
+		return fmt.Errorf("database error creating avatar: %w", err)
+	}
+
+	return nil
+}
+
+func (a *API) fetchAvatar(ctx context.Context, sourceURL string) (string, []byte, error) {
+	config := &a.config.External.Avatars
+
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if u.Scheme != "https" {
+		return "", nil, fmt.Errorf("unsupported avatar URL scheme %q", u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	res, err := a.avatarClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("avatar responded with status %d", res.StatusCode)
+	}
+
+	if res.ContentLength > config.MaxSize {
+		return "", nil, fmt.Errorf("avatar is larger than %d bytes", config.MaxSize)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, config.MaxSize+1))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if int64(len(data)) > config.MaxSize {
+		return "", nil, fmt.Errorf("avatar is larger than %d bytes", config.MaxSize)
+	}
+
+	// the declared content type isn't trusted, as the avatar is served
+	// from our own origin
+	contentType := http.DetectContentType(data)
+	if !avatarContentTypes[contentType] {
+		return "", nil, fmt.Errorf("unsupported avatar content type %q", contentType)
+	}
+
+	return contentType, data, nil
+}
+
+func (a *API) avatarURL(ctx context.Context, avatar *models.Avatar) (string, error) {
+	externalURL := getExternalHost(ctx)
+	if externalURL == nil {
+		var err error
+		if externalURL, err = url.ParseRequestURI(a.config.API.ExternalURL); err != nil {
+			return "", err
+		}
+	}
+
+	u := *externalURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/avatars/" + avatar.ID.String()
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return u.String(), nil
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/supabase/gotrue/internal/api/provider"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+func (ts *ExternalTestSuite) TestCreateAccountFromExternalIdentityStoresAvatars() {
+	var picture bytes.Buffer
+	ts.Require().NoError(png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 1, 1))))
+
+	var requests int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/picture.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(picture.Bytes())
+		case "/picture.html":
+			// served as an image, but must not be stored as one
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte("<html><script>alert(1)</script></html>"))
+		case "/large.png":
+			_, _ = w.Write(append(picture.Bytes(), make([]byte, 1024)...))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	avatars, avatarClient := ts.Config.External.Avatars, ts.API.avatarClient
+	defer func() {
+		ts.Config.External.Avatars = avatars
+		ts.API.avatarClient = avatarClient
+	}()
+	// the test server listens on a loopback address
+	ts.API.avatarClient = server.Client()
+	ts.Config.External.Avatars.Enabled = true
+	ts.Config.External.Avatars.MaxSize = 1024
+	ts.Config.Mailer.Autoconfirm = true
+
+	signIn := func(picture, avatarURL string) *models.User {
+		userData := &provider.UserProvidedData{
+			Emails: []provider.Email{
+				{
+					Email:    "avatar@example.com",
+					Verified: true,
+					Primary:  true,
+				},
+			},
+			Metadata: &provider.Claims{
+				Subject:   "avatar-subject",
+				Email:     "avatar@example.com",
+				Picture:   picture,
+				AvatarURL: avatarURL,
+			},
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+		req = req.WithContext(withExternalHost(req.Context(), &url.URL{Scheme: "http", Host: "localhost", Path: "/auth/v1"}))
+
+		var user *models.User
+		ts.Require().NoError(ts.API.db.Transaction(func(tx *storage.Connection) error {
+			var terr error
+			user, _, terr = ts.API.createAccountFromExternalIdentity(tx, req, userData, "google", nil)
+			return terr
+		}))
+
+		// pictures are fetched in the background
+		ts.API.avatarFetches.Wait()
+
+		return user
+	}
+
+	// pictures are only stored once the sign in has completed
+	user := signIn(server.URL+"/picture.png", server.URL+"/missing.png")
+	ts.Require().Equal(server.URL+"/picture.png", user.UserMetaData["picture"])
+	ts.Require().Equal(int32(2), atomic.LoadInt32(&requests))
+
+	avatar, err := models.FindAvatarBySourceURL(ts.API.db, server.URL+"/picture.png")
+	ts.Require().NoError(err)
+
+	user = signIn(server.URL+"/picture.png", server.URL+"/missing.png")
+	ts.Require().Equal("http://localhost/auth/v1/avatars/"+avatar.ID.String(), user.UserMetaData["picture"])
+	ts.Require().Equal(server.URL+"/missing.png", user.UserMetaData["avatar_url"], "pictures that can't be fetched keep their URL")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/avatars/"+avatar.ID.String(), nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusOK, w.Code)
+	ts.Require().Equal("image/png", w.Header().Get("Content-Type"))
+	ts.Require().Equal(picture.Bytes(), w.Body.Bytes())
+
+	// the stored avatar is reused on the next sign in
+	atomic.StoreInt32(&requests, 0)
+	user = signIn(server.URL+"/picture.png", "")
+	ts.Require().Equal(int32(0), atomic.LoadInt32(&requests))
+	ts.Require().Equal("http://localhost/auth/v1/avatars/"+avatar.ID.String(), user.UserMetaData["picture"])
+
+	for _, path := range []string{"/picture.html", "/large.png"} {
+		signIn(server.URL+path, "")
+		user = signIn(server.URL+path, "")
+		ts.Require().Equal(server.URL+path, user.UserMetaData["picture"])
+
+		_, err = models.FindAvatarBySourceURL(ts.API.db, server.URL+path)
+		ts.Require().True(models.IsNotFoundError(err))
+	}
+	ts.Require().Equal(int32(4), atomic.LoadInt32(&requests))
+
+	// pictures are only fetched over HTTPS
+	atomic.StoreInt32(&requests, 0)
+	insecureURL := strings.Replace(server.URL, "https://", "http://", 1) + "/picture.png"
+	signIn(insecureURL, "")
+	ts.Require().Equal(int32(0), atomic.LoadInt32(&requests))
+	_, err = models.FindAvatarBySourceURL(ts.API.db, insecureURL)
+	ts.Require().True(models.IsNotFoundError(err))
+
+	ts.Config.External.Avatars.Enabled = false
+	user = signIn(server.URL+"/other.png", "")
+	ts.Require().Equal(server.URL+"/other.png", user.UserMetaData["picture"])
+	ts.Require().Equal(int32(0), atomic.LoadInt32(&requests), "no avatars are fetched if disabled")
+}
+
+func (ts *ExternalTestSuite) TestAvatarGetNotFound() {
+	for _, id := range []string{"not-a-uuid", "4a1b6c8e-3f1d-4b6a-9f8e-2c3d4e5f6a7b"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/avatars/"+id, nil)
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		ts.Require().Equal(http.StatusNotFound, w.Code)
+	}
+}
+
+func TestAvatarClientRejectsInternalAddresses(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	_, err := newAvatarClient().Get(server.URL)
+	require.ErrorContains(t, err, "is not public")
+}
+
+func TestIsPublicAvatarIP(t *testing.T) {
+	cases := []struct {
+		ip     string
+		public bool
+	}{
+		{ip: "93.184.216.34", public: true},
+		{ip: "8.8.8.8", public: true},
+		{ip: "2606:2800:220:1:248:1893:25c8:1946", public: true},
+		{ip: "::ffff:93.184.216.34", public: true},
+		{ip: "64:ff9b::5db8:d822", public: true},
+
+		{ip: "0.0.0.0", public: false},
+		{ip: "0.1.2.3", public: false},
+		{ip: "10.0.0.1", public: false},
+		{ip: "100.64.0.1", public: false},
+		{ip: "100.127.255.254", public: false},
+		{ip: "127.0.0.1", public: false},
+		{ip: "169.254.169.254", public: false},
+		{ip: "172.16.0.1", public: false},
+		{ip: "192.0.0.170", public: false},
+		{ip: "192.0.2.1", public: false},
+		{ip: "192.168.0.1", public: false},
+		{ip: "198.18.0.1", public: false},
+		{ip: "198.19.255.254", public: false},
+		{ip: "224.0.0.1", public: false},
+		{ip: "240.0.0.1", public: false},
+		{ip: "255.255.255.255", public: false},
+		{ip: "::", public: false},
+		{ip: "::1", public: false},
+		{ip: "::ffff:127.0.0.1", public: false},
+		{ip: "::ffff:10.0.0.1", public: false},
+		{ip: "64:ff9b::a00:1", public: false},
+		{ip: "64:ff9b::7f00:1", public: false},
+		{ip: "64:ff9b::a9fe:a9fe", public: false},
+		{ip: "64:ff9b:1::1", public: false},
+		{ip: "2001::1", public: false},
+		{ip: "2001:db8::1", public: false},
+		{ip: "2002:a00:1::1", public: false},
+		{ip: "fc00::1", public: false},
+		{ip: "fd00::1", public: false},
+		{ip: "fe80::1", public: false},
+		{ip: "ff02::1", public: false},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.public, isPublicAvatarIP(netip.MustParseAddr(c.ip)), c.ip)
+	}
+}
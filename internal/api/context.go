@@ -6,6 +6,7 @@ import (
 
 	jwt "github.com/golang-jwt/jwt"
 	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
 )
 
 type contextKey string
@@ -31,6 +32,8 @@ const (
 	ssoProviderKey          = contextKey("sso_provider")
 	externalHostKey         = contextKey("external_host")
 	flowStateKey            = contextKey("flow_state_id")
+	hookConnectionKey       = contextKey("hook_connection")
+	mailerTenantKey         = contextKey("mailer_tenant")
 )
 
 // withToken adds the JWT token to the context.
@@ -249,3 +252,37 @@ func getExternalHost(ctx context.Context) *url.URL {
 	}
 	return obj.(*url.URL)
 }
+
+// withHookConnection adds the database connection used by webhooks that are
+// retried after the request has finished to the context.
+func withHookConnection(ctx context.Context, conn *storage.Connection) context.Context {
+	return context.WithValue(ctx, hookConnectionKey, conn)
+}
+
+// getHookConnection reads the database connection used by webhooks that are
+// retried after the request has finished from the context. Without one, conn
+// is used unless it is a transaction, which will have ended by then.
+func getHookConnection(ctx context.Context, conn *storage.Connection) *storage.Connection {
+	if obj := ctx.Value(hookConnectionKey); obj != nil {
+		return obj.(*storage.Connection)
+	}
+	if conn != nil && conn.TX == nil {
+		return conn
+	}
+	return nil
+}
+
+// withMailerTenant adds the tenant whose email templates are used to the context.
+func withMailerTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, mailerTenantKey, tenant)
+}
+
+// getMailerTenant reads the tenant whose email templates are used from the context.
+func getMailerTenant(ctx context.Context) string {
+	obj := ctx.Value(mailerTenantKey)
+	if obj == nil {
+		return ""
+	}
+
+	return obj.(string)
+}
@@ -36,6 +36,8 @@ type OAuthError struct {
 	Description     string `json:"error_description,omitempty"`
 	InternalError   error  `json:"-"`
 	InternalMessage string `json:"-"`
+	// Code is the HTTP status code of the response, 400 if not set
+	Code int `json:"-"`
 }
 
 func (e *OAuthError) Error() string {
@@ -66,7 +68,158 @@ func (e *OAuthError) Cause() error {
 }
 
 func invalidPasswordLengthError(passwordMinLength int) *HTTPError {
-	return unprocessableEntityError(fmt.Sprintf("Password should be at least %d characters", passwordMinLength))
+	return weakPasswordError(fmt.Sprintf("Password should be at least %d characters", passwordMinLength), WeakPasswordLength)
+}
+
+// ErrorCodeWeakPassword identifies errors for passwords that are rejected by
+// the password strength checks.
+const ErrorCodeWeakPassword = "weak_password"
+
+// Reasons listed in WeakPasswordError.
+const (
+	WeakPasswordLength     = "length"
+	WeakPasswordCharacters = "characters"
+	WeakPasswordStrength   = "strength"
+	WeakPasswordPwned      = "pwned"
+)
+
+func weakPasswordError(message string, reasons ...string) *HTTPError {
+	err := unprocessableEntityError("%s", message)
+	err.ErrorCode = ErrorCodeWeakPassword
+	err.WeakPassword = &WeakPasswordError{
+		Reasons: reasons,
+	}
+	return err
+}
+
+// ErrorCodePasswordReused identifies errors for password updates to one of
+// the user's recent passwords.
+const ErrorCodePasswordReused = "password_reused"
+
+func passwordReusedError(length int) *HTTPError {
+	err := unprocessableEntityError("New password should be different from the last %d passwords", length)
+	err.ErrorCode = ErrorCodePasswordReused
+	return err
+}
+
+// ErrorCodeMFARequired identifies errors for operations that require a
+// recently completed MFA challenge.
+const ErrorCodeMFARequired = "mfa_required"
+
+func mfaRequiredError(fmtString string, args ...interface{}) *HTTPError {
+	err := forbiddenError(fmtString, args...)
+	err.ErrorCode = ErrorCodeMFARequired
+	return err
+}
+
+// ErrorCodeInvalidPhone identifies errors for phone numbers that can't be
+// normalized to E.164.
+const ErrorCodeInvalidPhone = "invalid_phone"
+
+func invalidPhoneError() *HTTPError {
+	err := unprocessableEntityError("Invalid phone number format (E.164 required)")
+	err.ErrorCode = ErrorCodeInvalidPhone
+	return err
+}
+
+// ErrorCodeAccountLocked identifies errors for password logins to accounts
+// that are locked after too many failed attempts.
+const ErrorCodeAccountLocked = "account_locked"
+
+func accountLockedError() *HTTPError {
+	err := tooManyRequestsError("Too many failed login attempts, try again later")
+	err.ErrorCode = ErrorCodeAccountLocked
+	return err
+}
+
+// ErrorCodeInvalidRedirectURL identifies errors for redirect URLs that don't
+// match the site URL or the URI allow list.
+const ErrorCodeInvalidRedirectURL = "invalid_redirect_url"
+
+func invalidRedirectURLError() *HTTPError {
+	err := badRequestError("Redirect URL is not allowed, add it to the URI allow list")
+	err.ErrorCode = ErrorCodeInvalidRedirectURL
+	return err
+}
+
+// ErrorCodeProviderTokenRevoked identifies errors for provider refresh tokens
+// that the provider no longer accepts.
+const ErrorCodeProviderTokenRevoked = "provider_token_revoked"
+
+func providerTokenRevokedError() *HTTPError {
+	err := unprocessableEntityError("Provider refresh token was revoked, sign in with the provider again")
+	err.ErrorCode = ErrorCodeProviderTokenRevoked
+	return err
+}
+
+// ErrorCodeSignupDisabled identifies errors for signups that are not
+// allowed, either because signups are disabled or because they are invite
+// only and there's no pending invite.
+const ErrorCodeSignupDisabled = "signup_disabled"
+
+func signupDisabledError(fmtString string, args ...interface{}) *HTTPError {
+	err := forbiddenError(fmtString, args...)
+	err.ErrorCode = ErrorCodeSignupDisabled
+	return err
+}
+
+// ErrorCodeIdentityLimitExceeded identifies errors for linking an identity to
+// a user that already has the maximum number of identities.
+const ErrorCodeIdentityLimitExceeded = "identity_limit_exceeded"
+
+func identityLimitExceededError(limit int) *HTTPError {
+	err := unprocessableEntityError("Users can't have more than %d linked identities", limit)
+	err.ErrorCode = ErrorCodeIdentityLimitExceeded
+	return err
+}
+
+// ErrorCodeEmailNotConfirmed identifies errors for signing in with an email
+// address that hasn't been verified.
+const ErrorCodeEmailNotConfirmed = "email_not_confirmed"
+
+func emailNotConfirmedError(format string, args ...interface{}) *HTTPError {
+	err := forbiddenError(format, args...)
+	err.ErrorCode = ErrorCodeEmailNotConfirmed
+	return err
+}
+
+// ErrorCodeSessionNotFound identifies errors for access tokens whose session
+// has been revoked or has expired.
+const ErrorCodeSessionNotFound = "session_not_found"
+
+func sessionNotFoundError() *HTTPError {
+	err := unauthorizedError("Session from session_id claim in JWT does not exist")
+	err.ErrorCode = ErrorCodeSessionNotFound
+	return err
+}
+
+// ErrorCodeRequestTooLarge identifies errors for request bodies larger than
+// the configured maximum request body size.
+const ErrorCodeRequestTooLarge = "request_too_large"
+
+func requestTooLargeError(limit int64) *HTTPError {
+	err := httpError(http.StatusRequestEntityTooLarge, "Request body must not be larger than %d bytes", limit)
+	err.ErrorCode = ErrorCodeRequestTooLarge
+	return err
+}
+
+// isRequestBodyTooLarge reports whether the error, or any of its causes, is
+// caused by reading more than the maximum request body size.
+func isRequestBodyTooLarge(err error) (int64, bool) {
+	for err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return maxBytesErr.Limit, true
+		}
+
+		cause, ok := err.(ErrorCause)
+		if !ok || cause.Cause() == err {
+			return 0, false
+		}
+		err = cause.Cause()
+	}
+
+	return 0, false
 }
 
 func invalidSignupError(config *conf.GlobalConfiguration) *HTTPError {
@@ -88,6 +241,24 @@ func oauthError(err string, description string) *OAuthError {
 	return &OAuthError{Err: err, Description: description}
 }
 
+// invalidGrantError is returned for invalid credentials, such as expired or
+// badly signed ID tokens, which the client can't fix by changing the request.
+func invalidGrantError(description string) *OAuthError {
+	return &OAuthError{Err: "invalid_grant", Description: description, Code: http.StatusUnauthorized}
+}
+
+// insufficientAssuranceError is returned for ID tokens that don't report the
+// authentication context or methods required by the provider's configuration.
+func insufficientAssuranceError(description string) *OAuthError {
+	return &OAuthError{Err: "insufficient_assurance", Description: description, Code: http.StatusForbidden}
+}
+
+// providerUnavailableError is returned when the provider's discovery document
+// or signing keys can't be fetched, even after retrying.
+func providerUnavailableError(description string) *OAuthError {
+	return &OAuthError{Err: "provider_unavailable", Description: description, Code: http.StatusServiceUnavailable}
+}
+
 func badRequestError(fmtString string, args ...interface{}) *HTTPError {
 	return httpError(http.StatusBadRequest, fmtString, args...)
 }
@@ -128,9 +299,18 @@ func conflictError(fmtString string, args ...interface{}) *HTTPError {
 type HTTPError struct {
 	Code            int    `json:"code"`
 	Message         string `json:"msg"`
+	ErrorCode       string `json:"error_code,omitempty"`
 	InternalError   error  `json:"-"`
 	InternalMessage string `json:"-"`
 	ErrorID         string `json:"error_id,omitempty"`
+
+	WeakPassword *WeakPasswordError `json:"weak_password,omitempty"`
+}
+
+// WeakPasswordError lists the password requirements that a rejected password
+// does not satisfy.
+type WeakPasswordError struct {
+	Reasons []string `json:"reasons"`
 }
 
 func (e *HTTPError) Error() string {
@@ -244,6 +424,12 @@ type ErrorCause interface {
 func handleError(err error, w http.ResponseWriter, r *http.Request) {
 	log := observability.GetLogEntry(r)
 	errorID := getRequestID(r.Context())
+
+	// handlers report failing to read the request body in different ways
+	if limit, ok := isRequestBodyTooLarge(err); ok {
+		err = requestTooLargeError(limit).WithInternalError(err)
+	}
+
 	switch e := err.(type) {
 	case *HTTPError:
 		if e.Code >= http.StatusInternalServerError {
@@ -267,7 +453,11 @@ func handleError(err error, w http.ResponseWriter, r *http.Request) {
 		}
 	case *OAuthError:
 		log.WithError(e.Cause()).Info(e.Error())
-		if jsonErr := sendJSON(w, http.StatusBadRequest, e); jsonErr != nil {
+		status := http.StatusBadRequest
+		if e.Code != 0 {
+			status = e.Code
+		}
+		if jsonErr := sendJSON(w, status, e); jsonErr != nil {
 			handleError(jsonErr, w, r)
 		}
 	case *OTPError:
@@ -14,6 +14,7 @@ import (
 	jwt "github.com/golang-jwt/jwt"
 	"github.com/sirupsen/logrus"
 	"github.com/supabase/gotrue/internal/api/provider"
+	"github.com/supabase/gotrue/internal/conf"
 	"github.com/supabase/gotrue/internal/models"
 	"github.com/supabase/gotrue/internal/observability"
 	"github.com/supabase/gotrue/internal/storage"
@@ -38,10 +39,18 @@ func (a *API) ExternalProviderRedirect(w http.ResponseWriter, r *http.Request) e
 
 	query := r.URL.Query()
 	providerType := query.Get("provider")
-	scopes := query.Get("scopes")
 	codeChallenge := query.Get("code_challenge")
 	codeChallengeMethod := query.Get("code_challenge_method")
 
+	scopes, err := authorizeScopes(config.External.OAuthProvider(providerType), query.Get("scopes"))
+	if err != nil {
+		return err
+	}
+
+	if err := validatePrompt(query.Get("prompt")); err != nil {
+		return err
+	}
+
 	p, err := a.Provider(ctx, providerType, scopes)
 	if err != nil {
 		return badRequestError("Unsupported provider: %+v", err).WithInternalError(err)
@@ -137,12 +146,49 @@ func (a *API) ExternalProviderCallback(w http.ResponseWriter, r *http.Request) e
 	if err != nil {
 		return err
 	}
-	a.redirectErrors(a.internalExternalProviderCallback, w, r, u)
+	a.redirectErrors(func(w http.ResponseWriter, r *http.Request) error {
+		err := a.internalExternalProviderCallback(w, r)
+		a.recordProviderLogin(r.Context(), getExternalProviderType(r.Context()), err)
+		return err
+	}, w, r, u)
 	return nil
 }
 
-// errReturnNil is a hack that signals internalExternalProviderCallback to return nil
-var errReturnNil = errors.New("createAccountFromExternalIdentity: return nil in internalExternalProviderCallback")
+// Reasons reported by signInSuppressedError.
+const (
+	signInSuppressedSignupDisabled        = "signup_disabled"
+	signInSuppressedEmailNotConfirmed     = "email_not_confirmed"
+	signInSuppressedEmailDomainNotAllowed = "email_domain_not_allowed"
+	signInSuppressedIdentityAlreadyExists = "identity_already_exists"
+	signInSuppressedLinkingNotAllowed     = "account_linking_not_allowed"
+	signInSuppressedIdentityLimitExceeded = "identity_limit_exceeded"
+)
+
+// signInSuppressedError is returned by createAccountFromExternalIdentity when
+// the external identity was processed but no session may be issued for it.
+// Reason is a machine-readable code reported to id_token grant clients, while
+// Err is the error reported in the OAuth callback flow. When Commit is set,
+// the changes made while processing the identity (such as creating the user
+// and sending a confirmation email) must be committed regardless.
+type signInSuppressedError struct {
+	Reason string
+	Err    *HTTPError
+	Commit bool
+}
+
+func (e *signInSuppressedError) Error() string {
+	return fmt.Sprintf("sign in suppressed (%s): %s", e.Reason, e.Err.Error())
+}
+
+// Cause returns the error reported in the OAuth callback flow
+func (e *signInSuppressedError) Cause() error {
+	return e.Err
+}
+
+// asOAuthError returns the error reported to id_token grant clients
+func (e *signInSuppressedError) asOAuthError() *OAuthError {
+	return oauthError(e.Reason, e.Err.Message)
+}
 
 func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -156,6 +202,8 @@ func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Re
 	var grantParams models.GrantParams
 	var err error
 
+	grantParams.FillGrantParams(r, config.Security.TrustedProxies)
+
 	if providerType == "twitter" {
 		// future OAuth1.0 providers will use this method
 		oAuthResponseData, err := a.oAuth1Callback(ctx, r, providerType)
@@ -174,6 +222,12 @@ func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Re
 		providerRefreshToken = oAuthResponseData.refreshToken
 	}
 
+	// providers that don't issue ID tokens never satisfy acr and amr
+	// requirements
+	if err := checkAssurance(config.External.OAuthProvider(providerType), userData.RawClaims); err != nil {
+		return err
+	}
+
 	var flowState *models.FlowState
 	// if there's a non-empty FlowStateID we perform PKCE Flow
 	if flowStateID := getFlowStateID(ctx); flowStateID != "" {
@@ -185,6 +239,7 @@ func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Re
 
 	var user *models.User
 	var token *AccessTokenResponse
+	var suppressed *signInSuppressedError
 	err = db.Transaction(func(tx *storage.Connection) error {
 		var terr error
 		inviteToken := getInviteToken(ctx)
@@ -193,14 +248,17 @@ func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Re
 				return terr
 			}
 		} else {
-			if user, terr = a.createAccountFromExternalIdentity(tx, r, userData, providerType); terr != nil {
-				if errors.Is(terr, errReturnNil) {
+			if user, _, terr = a.createAccountFromExternalIdentity(tx, r, userData, providerType, nil); terr != nil {
+				if errors.As(terr, &suppressed) && suppressed.Commit {
 					return nil
 				}
 
 				return terr
 			}
 		}
+		if terr := a.storeProviderRefreshToken(tx, providerType, userData, providerRefreshToken); terr != nil {
+			return terr
+		}
 		if flowState != nil {
 			// This means that the callback is using PKCE
 			flowState.ProviderAccessToken = providerAccessToken
@@ -221,7 +279,13 @@ func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Re
 	}
 
 	rurl := a.getExternalRedirectURL(r)
-	if flowState != nil {
+	if suppressed != nil {
+		// Left as hash fragment to comply with spec. Additionally, may override existing error query param if set to PKCE.
+		rurl, err = a.prepErrorRedirectURL(suppressed.Err, w, r, rurl, models.ImplicitFlow)
+		if err != nil {
+			return err
+		}
+	} else if flowState != nil {
 		// This means that the callback is using PKCE
 		// Set the flowState.AuthCode to the query param here
 		rurl, err = a.prepPKCERedirectURL(rurl, flowState.AuthCode)
@@ -242,19 +306,18 @@ func (a *API) internalExternalProviderCallback(w http.ResponseWriter, r *http.Re
 		if err := a.setCookieTokens(config, token, false, w); err != nil {
 			return internalServerError("Failed to set JWT cookie. %s", err)
 		}
-	} else {
-		// Left as hash fragment to comply with spec. Additionally, may override existing error query param if set to PKCE.
-		rurl, err = a.prepErrorRedirectURL(unauthorizedError("Unverified email with %v", providerType), w, r, rurl, models.ImplicitFlow)
-		if err != nil {
-			return err
-		}
 	}
 
 	http.Redirect(w, r, rurl, http.StatusFound)
 	return nil
 }
 
-func (a *API) createAccountFromExternalIdentity(tx *storage.Connection, r *http.Request, userData *provider.UserProvidedData, providerType string) (*models.User, error) {
+// createAccountFromExternalIdentity signs in the user of the external
+// identity, creating or linking the account as needed. It also reports
+// whether a new account was created. When anonymousUser is set, an identity
+// that doesn't belong to any account yet is attached to it instead, which
+// converts the anonymous user into a permanent user.
+func (a *API) createAccountFromExternalIdentity(tx *storage.Connection, r *http.Request, userData *provider.UserProvidedData, providerType string, anonymousUser *models.User) (*models.User, bool, error) {
 	ctx := r.Context()
 	aud := a.requestAud(ctx, r)
 	config := a.config
@@ -264,15 +327,66 @@ func (a *API) createAccountFromExternalIdentity(tx *storage.Connection, r *http.
 	var user *models.User
 	var identity *models.Identity
 
-	var emailData provider.Email
-	var identityData map[string]interface{}
-	if userData.Metadata != nil {
-		identityData = structs.Map(userData.Metadata)
+	providerConfig := config.External.OAuthProvider(providerType)
+
+	// users without an email address are only identified by the subject
+	// of their identity
+	noEmail := len(userData.Emails) == 0
+	if noEmail && (providerConfig == nil || !providerConfig.AllowEmptyEmail) {
+		return nil, false, badRequestError("An email address is required to sign in with %v", providerType)
+	}
+
+	if banned, terr := models.IsExternalSubjectBanned(tx, providerType, userData.Metadata.Subject); terr != nil {
+		return nil, false, internalServerError("Database error finding external subject ban").WithInternalError(terr)
+	} else if banned {
+		return nil, false, oauthError("access_denied", "This account is banned from signing in with "+providerType)
+	}
+
+	hasEmailDomainRestrictions := providerConfig != nil && providerConfig.HasEmailDomainRestrictions()
+
+	if hasEmailDomainRestrictions {
+		// only the email the user signs in with is checked, as providers
+		// also return secondary emails that aren't used
+		var signInEmail provider.Email
+		if !noEmail {
+			signInEmail = userData.Emails[0]
+			for _, e := range userData.Emails {
+				if e.Primary {
+					signInEmail = e
+					break
+				}
+			}
+		}
+
+		// the domain of an unverified email says nothing about the user
+		if !signInEmail.Verified {
+			return nil, false, &signInSuppressedError{
+				Reason: signInSuppressedEmailDomainNotAllowed,
+				Err:    forbiddenError("A verified email address is required to sign in with %v", providerType),
+			}
+		}
+
+		if !providerConfig.IsEmailDomainAllowed(signInEmail.Email) {
+			return nil, false, &signInSuppressedError{
+				Reason: signInSuppressedEmailDomainNotAllowed,
+				Err:    forbiddenError("Email domain not allowed to sign in with %v", providerType),
+			}
+		}
 	}
 
+	a.storeAvatars(r, tx, userData.Metadata)
+
+	var emailData provider.Email
+	identityData, storedIdentityData := a.identityDataFromUserData(userData, providerConfig)
+
 	var emails []string
 
 	for _, email := range userData.Emails {
+		// accounts are never linked through emails in other domains
+		if hasEmailDomainRestrictions && !providerConfig.IsEmailDomainAllowed(email.Email) {
+			continue
+		}
+
 		if email.Verified || config.Mailer.Autoconfirm {
 			emails = append(emails, strings.ToLower(email.Email))
 		}
@@ -280,13 +394,45 @@ func (a *API) createAccountFromExternalIdentity(tx *storage.Connection, r *http.
 
 	decision, terr := models.DetermineAccountLinking(tx, providerType, userData.Metadata.Subject, emails)
 	if terr != nil {
-		return nil, terr
+		return nil, false, terr
+	}
+
+	if providerType == "apple" {
+		var previousIdentityData map[string]interface{}
+		if decision.Decision == models.AccountExists {
+			previousIdentityData = decision.Identities[0].IdentityData
+		}
+
+		storedIdentityData = withAppleIdentityEmails(previousIdentityData, storedIdentityData)
+	}
+
+	if anonymousUser != nil && decision.Decision != models.CreateAccount {
+		return nil, false, &signInSuppressedError{
+			Reason: signInSuppressedIdentityAlreadyExists,
+			Err:    unprocessableEntityError("Identity is already linked to another user"),
+		}
 	}
 
 	switch decision.Decision {
 	case models.LinkAccount:
 		user = decision.User
 
+		if !a.isAccountLinkingAllowed(user, userData) {
+			return nil, false, &signInSuppressedError{
+				Reason: signInSuppressedLinkingNotAllowed,
+				Err:    unprocessableEntityError("A user with this email address already exists, sign in to link the %v identity to it", providerType),
+			}
+		}
+
+		if exceeded, terr := a.identityLimitExceeded(tx, user); terr != nil {
+			return nil, false, terr
+		} else if exceeded {
+			return nil, false, &signInSuppressedError{
+				Reason: signInSuppressedIdentityLimitExceeded,
+				Err:    identityLimitExceededError(config.External.MaxIdentitiesPerUser),
+			}
+		}
+
 		emailData = userData.Emails[0]
 		for _, e := range userData.Emails {
 			if e.Primary || e.Verified {
@@ -295,25 +441,94 @@ func (a *API) createAccountFromExternalIdentity(tx *storage.Connection, r *http.
 			}
 		}
 
-		if _, terr = a.createNewIdentity(tx, user, providerType, identityData); terr != nil {
-			return nil, terr
+		if _, terr = a.createNewIdentity(tx, user, providerType, storedIdentityData); terr != nil {
+			return nil, false, terr
 		}
 
 		if terr = user.UpdateAppMetaDataProviders(tx); terr != nil {
-			return nil, terr
+			return nil, false, terr
 		}
 
 	case models.CreateAccount:
+		if anonymousUser != nil {
+			user = anonymousUser
+
+			if exceeded, terr := a.identityLimitExceeded(tx, user); terr != nil {
+				return nil, false, terr
+			} else if exceeded {
+				return nil, false, &signInSuppressedError{
+					Reason: signInSuppressedIdentityLimitExceeded,
+					Err:    identityLimitExceededError(config.External.MaxIdentitiesPerUser),
+				}
+			}
+
+			if !noEmail {
+				emailData = userData.Emails[0]
+				for _, e := range userData.Emails {
+					if e.Primary {
+						emailData = e
+						break
+					}
+				}
+
+				if terr = user.SetEmail(tx, strings.ToLower(emailData.Email)); terr != nil {
+					return nil, false, internalServerError("Error updating user").WithInternalError(terr)
+				}
+			}
+
+			if _, terr = a.createNewIdentity(tx, user, providerType, storedIdentityData); terr != nil {
+				return nil, false, terr
+			}
+
+			if terr = user.UpdateUserMetaData(tx, identityData); terr != nil {
+				return nil, false, terr
+			}
+
+			if terr = user.UpdateAppMetaData(tx, map[string]interface{}{"provider": providerType}); terr != nil {
+				return nil, false, terr
+			}
+
+			if terr = user.UpdateAppMetaDataProviders(tx); terr != nil {
+				return nil, false, terr
+			}
+
+			if terr = user.ConvertToPermanent(tx); terr != nil {
+				return nil, false, internalServerError("Error updating user").WithInternalError(terr)
+			}
+
+			if terr = models.NewAuditLogEntry(r, tx, user, models.UserConvertedAction, "", map[string]interface{}{
+				"provider": providerType,
+			}); terr != nil {
+				return nil, false, terr
+			}
+
+			break
+		}
+
 		if config.DisableSignup {
-			return nil, forbiddenError("Signups not allowed for this instance")
+			return nil, false, &signInSuppressedError{
+				Reason: signInSuppressedSignupDisabled,
+				Err:    signupDisabledError("Signups not allowed for this instance"),
+			}
+		}
+
+		// invited users are linked to instead, so there's no pending
+		// invite for any of the emails
+		if config.InviteOnly {
+			return nil, false, &signInSuppressedError{
+				Reason: signInSuppressedSignupDisabled,
+				Err:    signupDisabledError("Signups are invite only for this instance"),
+			}
 		}
 
 		// prefer primary email for new signups
-		emailData = userData.Emails[0]
-		for _, e := range userData.Emails {
-			if e.Primary {
-				emailData = e
-				break
+		if !noEmail {
+			emailData = userData.Emails[0]
+			for _, e := range userData.Emails {
+				if e.Primary {
+					emailData = e
+					break
+				}
 			}
 		}
 
@@ -328,20 +543,20 @@ func (a *API) createAccountFromExternalIdentity(tx *storage.Connection, r *http.
 
 		user, terr = a.signupNewUser(ctx, tx, params, isSSOUser)
 		if terr != nil {
-			return nil, terr
+			return nil, false, terr
 		}
 
-		if _, terr = a.createNewIdentity(tx, user, providerType, identityData); terr != nil {
-			return nil, terr
+		if _, terr = a.createNewIdentity(tx, user, providerType, storedIdentityData); terr != nil {
+			return nil, false, terr
 		}
 
 	case models.AccountExists:
 		user = decision.User
 		identity = decision.Identities[0]
 
-		identity.IdentityData = identityData
+		identity.IdentityData = storedIdentityData
 		if terr = tx.UpdateOnly(identity, "identity_data", "last_sign_in_at"); terr != nil {
-			return nil, terr
+			return nil, false, terr
 		}
 		// email & verified status might have changed if identity's email changed
 		emailData = provider.Email{
@@ -349,21 +564,39 @@ func (a *API) createAccountFromExternalIdentity(tx *storage.Connection, r *http.
 			Verified: userData.Metadata.EmailVerified,
 		}
 		if terr = user.UpdateUserMetaData(tx, identityData); terr != nil {
-			return nil, terr
+			return nil, false, terr
 		}
 		if terr = user.UpdateAppMetaDataProviders(tx); terr != nil {
-			return nil, terr
+			return nil, false, terr
 		}
 
 	case models.MultipleAccounts:
-		return nil, internalServerError(fmt.Sprintf("Multiple accounts with the same email address in the same linking domain detected: %v", decision.LinkingDomain))
+		return nil, false, internalServerError(fmt.Sprintf("Multiple accounts with the same email address in the same linking domain detected: %v", decision.LinkingDomain))
 
 	default:
-		return nil, internalServerError(fmt.Sprintf("Unknown automatic linking decision: %v", decision.Decision))
+		return nil, false, internalServerError(fmt.Sprintf("Unknown automatic linking decision: %v", decision.Decision))
+	}
+
+	if user.IsBanned() || user.IsDeleted() {
+		return nil, false, unauthorizedError("User is unauthorized")
 	}
 
-	if user.IsBanned() {
-		return nil, unauthorizedError("User is unauthorized")
+	// no session is issued until the provider vouches for the email
+	// address, if there is one, regardless of how the user was confirmed
+	// before
+	if config.External.RequireVerifiedEmail && !emailData.Verified && !noEmail {
+		return nil, false, &signInSuppressedError{
+			Reason: signInSuppressedEmailNotConfirmed,
+			Err:    emailNotConfirmedError("Email address must be verified by %v to sign in", providerType),
+		}
+	}
+
+	created := decision.Decision == models.CreateAccount
+
+	if created {
+		if terr = triggerProviderEventHooks(ctx, tx, UserCreatedEvent, user, providerType, config); terr != nil {
+			return nil, false, terr
+		}
 	}
 
 	// an account with a previously unconfirmed email + password
@@ -373,49 +606,140 @@ func (a *API) createAccountFromExternalIdentity(tx *storage.Connection, r *http.
 	// potentially malicious door exists into their account; thus
 	// the password and phone needs to be removed.
 	if terr = user.RemoveUnconfirmedIdentities(tx); terr != nil {
-		return nil, internalServerError("Error updating user").WithInternalError(terr)
+		return nil, false, internalServerError("Error updating user").WithInternalError(terr)
 	}
 
 	if !user.IsConfirmed() {
-		if !emailData.Verified && !config.Mailer.Autoconfirm {
+		// there's no email address to confirm for users without one
+		if !emailData.Verified && !config.Mailer.Autoconfirm && !noEmail {
 			mailer := a.Mailer(ctx)
 			referrer := utilities.GetReferrer(r, config)
 			externalURL := getExternalHost(ctx)
 			if terr = sendConfirmation(tx, user, mailer, config.SMTP.MaxFrequency, referrer, externalURL, config.Mailer.OtpLength, models.ImplicitFlow); terr != nil {
 				if errors.Is(terr, MaxFrequencyLimitError) {
-					return nil, tooManyRequestsError("For security purposes, you can only request this once every minute")
+					return nil, false, tooManyRequestsError("For security purposes, you can only request this once every minute")
 				}
-				return nil, internalServerError("Error sending confirmation mail").WithInternalError(terr)
+				return nil, false, internalServerError("Error sending confirmation mail").WithInternalError(terr)
 			}
 			// email must be verified to issue a token
-			return nil, errReturnNil
+			return nil, false, &signInSuppressedError{
+				Reason: signInSuppressedEmailNotConfirmed,
+				Err:    unauthorizedError("Unverified email with %v", providerType),
+				Commit: true,
+			}
 		}
 
 		if terr := models.NewAuditLogEntry(r, tx, user, models.UserSignedUpAction, "", map[string]interface{}{
 			"provider": providerType,
 		}); terr != nil {
-			return nil, terr
+			return nil, false, terr
 		}
 		if terr = triggerEventHooks(ctx, tx, SignupEvent, user, config); terr != nil {
-			return nil, terr
+			return nil, false, terr
 		}
 
 		// fall through to auto-confirm and issue token
 		if terr = user.Confirm(tx); terr != nil {
-			return nil, internalServerError("Error updating user").WithInternalError(terr)
+			return nil, false, internalServerError("Error updating user").WithInternalError(terr)
 		}
 	} else {
 		if terr := models.NewAuditLogEntry(r, tx, user, models.LoginAction, "", map[string]interface{}{
 			"provider": providerType,
 		}); terr != nil {
-			return nil, terr
+			return nil, false, terr
 		}
 		if terr = triggerEventHooks(ctx, tx, LoginEvent, user, config); terr != nil {
-			return nil, terr
+			return nil, false, terr
 		}
 	}
 
-	return user, nil
+	if !created {
+		if terr = triggerProviderEventHooks(ctx, tx, UserSignedInEvent, user, providerType, config); terr != nil {
+			return nil, false, terr
+		}
+	}
+
+	return user, created, nil
+}
+
+// withAppleIdentityEmails returns a copy of the identity data of an Apple
+// identity that lists all email addresses seen for the identity in "emails",
+// as Apple users can switch between sharing their real email address and a
+// private relay address. The "email" of the identity stays the real address
+// if one is known, so that it can still be linked to other identities.
+func withAppleIdentityEmails(previousIdentityData, identityData map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(identityData)+1)
+	for key, value := range identityData {
+		result[key] = value
+	}
+
+	var emails []interface{}
+	addEmail := func(value interface{}) {
+		email, ok := value.(string)
+		if !ok || email == "" {
+			return
+		}
+
+		email = strings.ToLower(email)
+		for _, existing := range emails {
+			if existing == email {
+				return
+			}
+		}
+
+		emails = append(emails, email)
+	}
+
+	addEmail(identityData["email"])
+
+	if previousEmails, ok := previousIdentityData["emails"].([]interface{}); ok {
+		for _, email := range previousEmails {
+			addEmail(email)
+		}
+	}
+	addEmail(previousIdentityData["email"])
+
+	if len(emails) == 0 {
+		return result
+	}
+
+	result["emails"] = emails
+
+	if email, _ := identityData["email"].(string); email == "" || provider.IsApplePrivateRelayEmail(email) {
+		for _, known := range emails {
+			if !provider.IsApplePrivateRelayEmail(known.(string)) {
+				result["email"] = known
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// isAccountLinkingAllowed reports whether the account linking strategy
+// allows linking the external identity to the existing user with the same
+// email address.
+func (a *API) isAccountLinkingAllowed(user *models.User, userData *provider.UserProvidedData) bool {
+	switch a.config.External.AccountLinkingStrategy {
+	case conf.AccountLinkingManual:
+		return false
+
+	case conf.AccountLinkingVerifiedOnly:
+		if user.EmailConfirmedAt == nil {
+			return false
+		}
+
+		for _, email := range userData.Emails {
+			if email.Verified && strings.EqualFold(email.Email, user.GetEmail()) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
 }
 
 func (a *API) processInvite(r *http.Request, ctx context.Context, tx *storage.Connection, userData *provider.UserProvidedData, inviteToken, providerType string) (*models.User, error) {
@@ -510,6 +834,50 @@ func (a *API) loadExternalState(ctx context.Context, state string) (context.Cont
 	return withSignature(ctx, state), nil
 }
 
+// authorizePrompts are the prompt values of OpenID Connect Core 1.0, section
+// 3.1.2.1, that can be passed to /authorize.
+var authorizePrompts = []string{"none", "login", "consent", "select_account"}
+
+// authorizeScopes returns the comma separated scopes to request from the
+// provider: its configured scopes followed by the requested ones, which may
+// be separated by commas or spaces and must be allowed.
+func authorizeScopes(cfg *conf.OAuthProviderConfiguration, requested string) (string, error) {
+	if cfg == nil {
+		return requested, nil
+	}
+
+	scopes := append([]string{}, cfg.Scopes...)
+	for _, scope := range strings.FieldsFunc(requested, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !cfg.IsAllowedScope(scope) {
+			return "", badRequestError("Scope %q is not allowed", scope)
+		}
+
+		scopes = append(scopes, scope)
+	}
+
+	return strings.Join(scopes, ","), nil
+}
+
+// validatePrompt rejects prompt parameters that aren't a space separated
+// list of authorizePrompts.
+func validatePrompt(prompt string) error {
+	for _, value := range strings.Fields(prompt) {
+		allowed := false
+		for _, authorizePrompt := range authorizePrompts {
+			if value == authorizePrompt {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return badRequestError("Prompt %q is not allowed", value)
+		}
+	}
+
+	return nil
+}
+
 // Provider returns a Provider interface for the given name.
 func (a *API) Provider(ctx context.Context, name string, scopes string) (provider.Provider, error) {
 	config := a.config
@@ -559,6 +927,10 @@ func (a *API) Provider(ctx context.Context, name string, scopes string) (provide
 	case "zoom":
 		return provider.NewZoomProvider(config.External.Zoom)
 	default:
+		if _, cfg := config.External.DirectoryOIDCProvider(name, ""); cfg != nil {
+			return provider.NewGenericOIDCProvider(ctx, *cfg, scopes)
+		}
+
 		return nil, fmt.Errorf("Provider %s could not be found", name)
 	}
 }
@@ -626,6 +998,51 @@ func (a *API) getExternalRedirectURL(r *http.Request) string {
 	return config.SiteURL
 }
 
+// identityDataFromUserData returns the identity data of the user data, which
+// is also merged into the user's metadata, and the identity data that is
+// stored with the identity, which additionally includes the raw ID token
+// claims.
+func (a *API) identityDataFromUserData(userData *provider.UserProvidedData, providerConfig *conf.OAuthProviderConfiguration) (identityData map[string]interface{}, storedIdentityData map[string]interface{}) {
+	if userData.Metadata != nil {
+		identityData = structs.Map(userData.Metadata)
+	}
+
+	if providerConfig != nil && len(providerConfig.ClaimsMapping) > 0 {
+		if identityData == nil {
+			identityData = make(map[string]interface{})
+		}
+
+		for key, value := range provider.MapClaims(userData.RawClaims, providerConfig.ClaimsMapping) {
+			// mapped claims must not override the standard claims
+			if _, ok := identityData[key]; !ok {
+				identityData[key] = value
+			}
+		}
+	}
+
+	// the raw ID token claims and the client ID are only stored with the
+	// identity, and not in the user's metadata
+	storeClaims := len(userData.RawClaims) > 0 && !a.config.External.DisableIdTokenClaimsStorage
+
+	storedIdentityData = identityData
+	if storeClaims || userData.ClientID != "" {
+		storedIdentityData = make(map[string]interface{}, len(identityData)+2)
+		for key, value := range identityData {
+			storedIdentityData[key] = value
+		}
+
+		if storeClaims {
+			storedIdentityData["claims"] = provider.StorableClaims(userData.RawClaims)
+		}
+
+		if userData.ClientID != "" {
+			storedIdentityData["client_id"] = userData.ClientID
+		}
+	}
+
+	return identityData, storedIdentityData
+}
+
 func (a *API) createNewIdentity(tx *storage.Connection, user *models.User, providerType string, identityData map[string]interface{}) (*models.Identity, error) {
 	identity, err := models.NewIdentity(user, providerType, identityData)
 	if err != nil {
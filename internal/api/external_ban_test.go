@@ -0,0 +1,81 @@
+package api
+
+import (
+	"time"
+
+	"github.com/supabase/gotrue/internal/models"
+)
+
+func (ts *ExternalTestSuite) TestSignupExternalBannedSubject() {
+	ts.Config.Mailer.Autoconfirm = true
+
+	emails := `[{"id":1,"email":"gitlab@example.com"}]`
+
+	cases := []struct {
+		desc     string
+		ban      func()
+		isBanned bool
+	}{
+		{
+			desc: "not banned",
+			ban:  func() {},
+		},
+		{
+			desc: "banned",
+			ban: func() {
+				_, err := models.BanExternalSubject(ts.API.db, "gitlab", "123", 0)
+				ts.Require().NoError(err)
+			},
+			isBanned: true,
+		},
+		{
+			desc: "temporarily banned",
+			ban: func() {
+				_, err := models.BanExternalSubject(ts.API.db, "gitlab", "123", time.Hour)
+				ts.Require().NoError(err)
+			},
+			isBanned: true,
+		},
+		{
+			desc: "expired ban",
+			ban: func() {
+				_, err := models.BanExternalSubject(ts.API.db, "gitlab", "123", -time.Hour)
+				ts.Require().NoError(err)
+			},
+		},
+		{
+			desc: "other subject banned",
+			ban: func() {
+				_, err := models.BanExternalSubject(ts.API.db, "gitlab", "456", 0)
+				ts.Require().NoError(err)
+			},
+		},
+		{
+			desc: "subject banned on other provider",
+			ban: func() {
+				_, err := models.BanExternalSubject(ts.API.db, "github", "123", 0)
+				ts.Require().NoError(err)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			models.TruncateAll(ts.API.db)
+			c.ban()
+
+			tokenCount, userCount := 0, 0
+			server := GitlabTestSignupSetup(ts, &tokenCount, &userCount, "authcode", gitlabUser, emails)
+			defer server.Close()
+
+			u := performAuthorization(ts, "gitlab", "authcode", "")
+
+			if c.isBanned {
+				assertAuthorizationFailure(ts, u, "This account is banned from signing in with gitlab", "access_denied", "gitlab@example.com")
+				return
+			}
+
+			assertAuthorizationSuccess(ts, u, tokenCount, userCount, "gitlab@example.com", "GitLab Test", "123", "http://example.com/avatar")
+		})
+	}
+}
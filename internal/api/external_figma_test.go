@@ -98,6 +98,10 @@ func (ts *ExternalTestSuite) TestSignupExternalFigma_PKCE() {
 			desc:                "SHA256",
 			codeChallengeMethod: "s256",
 		},
+		{
+			desc:                "Plain",
+			codeChallengeMethod: "plain",
+		},
 	}
 
 	for _, c := range cases {
@@ -147,6 +151,33 @@ func (ts *ExternalTestSuite) TestSignupExternalFigma_PKCE() {
 	}
 }
 
+func (ts *ExternalTestSuite) TestSignupExternalFigma_PKCEVerifierMismatch() {
+	tokenCount, userCount := 0, 0
+	code := "authcode"
+	codeVerifier := "testtesttesttesttesttesttesttesttesttesttesttesttesttest"
+
+	server := FigmaTestSignupSetup(ts, &tokenCount, &userCount, code, "figma@example.com")
+	defer server.Close()
+
+	hashedCodeVerifier := sha256.Sum256([]byte(codeVerifier))
+	codeChallenge := base64.RawURLEncoding.EncodeToString(hashedCodeVerifier[:])
+
+	u := performPKCEAuthorization(ts, "figma", code, codeChallenge, "s256")
+	authCode := u.Query().Get("code")
+	require.NotEmpty(ts.T(), authCode)
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"code_verifier": codeVerifier + "mismatch",
+		"auth_code":     authCode,
+	}))
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=pkce", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
+}
+
 func (ts *ExternalTestSuite) TestSignupExternalFigmaDisableSignupErrorWhenNoUser() {
 	ts.Config.DisableSignup = true
 	tokenCount, userCount := 0, 0
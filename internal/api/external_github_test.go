@@ -181,6 +181,48 @@ func (ts *ExternalTestSuite) TestSignupExternalGitHubDisableSignupErrorWhenEmpty
 	assertAuthorizationFailure(ts, u, "Error getting user email from external provider", "server_error", "github@example.com")
 }
 
+func (ts *ExternalTestSuite) TestSignupExternalGitHubAllowEmptyEmail() {
+	ts.Config.External.Github.AllowEmptyEmail = true
+	defer func() {
+		ts.Config.External.Github.AllowEmptyEmail = false
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/login/oauth/access_token":
+			fmt.Fprint(w, `{"access_token":"github_token","expires_in":100000}`)
+		case "/api/v3/user":
+			fmt.Fprint(w, `{"id":123, "login":"octocat", "name":"GitHub Test"}`)
+		case "/api/v3/user/emails":
+			// all email addresses are private
+			fmt.Fprint(w, `[]`)
+		default:
+			w.WriteHeader(500)
+			ts.Fail("unknown github oauth call %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	ts.Config.External.Github.URL = server.URL
+
+	u := performAuthorization(ts, "github", "authcode", "")
+
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	ts.Require().NotEmpty(v.Get("access_token"))
+
+	identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "123", "github")
+	ts.Require().NoError(err)
+	ts.Equal("octocat", identity.IdentityData["preferred_username"])
+	ts.Equal("octocat", identity.IdentityData["user_name"])
+
+	user, err := models.FindUserByID(ts.API.db, identity.UserID)
+	ts.Require().NoError(err)
+	ts.Empty(user.GetEmail())
+}
+
 func (ts *ExternalTestSuite) TestSignupExternalGitHubDisableSignupSuccessWithPrimaryEmail() {
 	ts.Config.DisableSignup = true
 
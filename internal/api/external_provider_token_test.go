@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/supabase/gotrue/internal/crypto"
+	"github.com/supabase/gotrue/internal/models"
+)
+
+const providerTokenEncryptionKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+// providerTokenSetup starts a GitLab mock whose token endpoint issues the
+// refresh token on sign in, and accepts the refresh tokens that aren't
+// revoked.
+func providerTokenSetup(ts *ExternalTestSuite, revoked map[string]bool) *httptest.Server {
+	refreshCount := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/token":
+			w.Header().Add("Content-Type", "application/json")
+
+			switch r.FormValue("grant_type") {
+			case "authorization_code":
+				fmt.Fprint(w, `{"access_token":"gitlab_token","refresh_token":"gitlab_refresh_token","expires_in":100000}`)
+			case "refresh_token":
+				if revoked[r.FormValue("refresh_token")] {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, `{"error":"invalid_grant","error_description":"The provided authorization grant is invalid"}`)
+					return
+				}
+
+				refreshCount++
+				fmt.Fprintf(w, `{"access_token":"gitlab_token_%d","refresh_token":"gitlab_refresh_token_%d","expires_in":7200}`, refreshCount, refreshCount)
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		case "/api/v4/user":
+			w.Header().Add("Content-Type", "application/json")
+			fmt.Fprint(w, gitlabUser)
+		case "/api/v4/user/emails":
+			w.Header().Add("Content-Type", "application/json")
+			fmt.Fprint(w, `[{"id":1,"email":"gitlab@example.com"}]`)
+		default:
+			w.WriteHeader(500)
+			ts.Fail("unknown gitlab oauth call %s", r.URL.Path)
+		}
+	}))
+
+	ts.Config.External.Gitlab.URL = server.URL
+
+	return server
+}
+
+func (ts *ExternalTestSuite) requestProviderToken(accessToken, identityID string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/user/identities/"+identityID+"/provider-token", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func (ts *ExternalTestSuite) storedProviderRefreshToken() *string {
+	identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "123", "gitlab")
+	ts.Require().NoError(err)
+
+	if identity.ProviderRefreshToken == nil {
+		return nil
+	}
+
+	refreshToken, err := crypto.DecryptString([]byte("0123456789abcdef0123456789abcdef"), *identity.ProviderRefreshToken)
+	ts.Require().NoError(err)
+
+	return &refreshToken
+}
+
+func (ts *ExternalTestSuite) TestProviderTokenRefresh() {
+	ts.Config.Mailer.Autoconfirm = true
+	ts.Config.External.ProviderTokenEncryptionKey = providerTokenEncryptionKey
+	defer func() {
+		ts.Config.External.ProviderTokenEncryptionKey = ""
+	}()
+
+	server := providerTokenSetup(ts, nil)
+	defer server.Close()
+
+	u := performAuthorization(ts, "gitlab", "authcode", "")
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	accessToken := v.Get("access_token")
+	ts.Require().NotEmpty(accessToken)
+
+	// the refresh token is only stored encrypted
+	identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "123", "gitlab")
+	ts.Require().NoError(err)
+	ts.Require().NotNil(identity.ProviderRefreshToken)
+	ts.NotContains(*identity.ProviderRefreshToken, "gitlab_refresh_token")
+	ts.Equal("gitlab_refresh_token", *ts.storedProviderRefreshToken())
+
+	for i := 1; i <= 2; i++ {
+		w := ts.requestProviderToken(accessToken, "123")
+		ts.Require().Equal(http.StatusOK, w.Code)
+
+		data := ProviderTokenResponse{}
+		ts.Require().NoError(json.NewDecoder(w.Body).Decode(&data))
+		ts.Equal(fmt.Sprintf("gitlab_token_%d", i), data.ProviderToken)
+		ts.NotZero(data.ExpiresAt)
+
+		// rotated refresh tokens replace the stored one
+		ts.Equal(fmt.Sprintf("gitlab_refresh_token_%d", i), *ts.storedProviderRefreshToken())
+	}
+
+	w := ts.requestProviderToken(accessToken, "unknown")
+	ts.Equal(http.StatusNotFound, w.Code)
+}
+
+func (ts *ExternalTestSuite) TestProviderTokenRevoked() {
+	ts.Config.Mailer.Autoconfirm = true
+	ts.Config.External.ProviderTokenEncryptionKey = providerTokenEncryptionKey
+	defer func() {
+		ts.Config.External.ProviderTokenEncryptionKey = ""
+	}()
+
+	server := providerTokenSetup(ts, map[string]bool{"gitlab_refresh_token": true})
+	defer server.Close()
+
+	u := performAuthorization(ts, "gitlab", "authcode", "")
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+	accessToken := v.Get("access_token")
+
+	w := ts.requestProviderToken(accessToken, "123")
+	ts.Require().Equal(http.StatusUnprocessableEntity, w.Code)
+
+	data := HTTPError{}
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(&data))
+	ts.Equal(ErrorCodeProviderTokenRevoked, data.ErrorCode)
+
+	// the revoked refresh token is cleared
+	ts.Nil(ts.storedProviderRefreshToken())
+
+	w = ts.requestProviderToken(accessToken, "123")
+	ts.Equal(http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *ExternalTestSuite) TestProviderTokenNotStoredWithoutKey() {
+	ts.Config.Mailer.Autoconfirm = true
+
+	server := providerTokenSetup(ts, nil)
+	defer server.Close()
+
+	u := performAuthorization(ts, "gitlab", "authcode", "")
+	v, err := url.ParseQuery(u.Fragment)
+	ts.Require().NoError(err)
+
+	ts.Nil(ts.storedProviderRefreshToken())
+
+	w := ts.requestProviderToken(v.Get("access_token"), "123")
+	ts.Equal(http.StatusUnprocessableEntity, w.Code)
+}
@@ -1,15 +1,20 @@
 package api
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/supabase/gotrue/internal/api/provider"
 	"github.com/supabase/gotrue/internal/conf"
 	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
 )
 
 type ExternalTestSuite struct {
@@ -204,6 +209,725 @@ func (ts *ExternalTestSuite) TestSignupExternalUnsupported() {
 	ts.Equal(w.Code, http.StatusBadRequest)
 }
 
+func (ts *ExternalTestSuite) TestAuthorizeScopesAndPrompt() {
+	gitlab := ts.Config.External.Gitlab
+	defer func() {
+		ts.Config.External.Gitlab = gitlab
+	}()
+
+	ts.Config.External.Gitlab.Scopes = []string{"api"}
+	ts.Config.External.Gitlab.AllowedScopes = []string{"read_repository", "write_repository"}
+
+	cases := []struct {
+		desc           string
+		query          string
+		expectedCode   int
+		expectedScope  string
+		expectedPrompt string
+	}{
+		{
+			desc:          "configured scopes",
+			expectedCode:  http.StatusFound,
+			expectedScope: "read_user api",
+		},
+		{
+			desc:           "requested scopes and prompt",
+			query:          "&scopes=read_repository,write_repository&prompt=consent",
+			expectedCode:   http.StatusFound,
+			expectedScope:  "read_user api read_repository write_repository",
+			expectedPrompt: "consent",
+		},
+		{
+			desc:           "space separated scopes and prompts",
+			query:          "&scopes=read_repository%20write_repository&prompt=login%20consent",
+			expectedCode:   http.StatusFound,
+			expectedScope:  "read_user api read_repository write_repository",
+			expectedPrompt: "login consent",
+		},
+		{
+			desc:         "disallowed scope",
+			query:        "&scopes=read_repository,sudo",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			desc:         "disallowed prompt",
+			query:        "&prompt=always",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=gitlab"+c.query, nil)
+			w := httptest.NewRecorder()
+			ts.API.handler.ServeHTTP(w, req)
+			ts.Require().Equal(c.expectedCode, w.Code)
+
+			if c.expectedCode != http.StatusFound {
+				return
+			}
+
+			u, err := url.Parse(w.Header().Get("Location"))
+			ts.Require().NoError(err, "redirect url parse failed")
+			q := u.Query()
+			ts.Equal(c.expectedScope, q.Get("scope"))
+			ts.Equal(c.expectedPrompt, q.Get("prompt"))
+		})
+	}
+
+	// any scope can be requested without an allow list
+	ts.Config.External.Gitlab.AllowedScopes = nil
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=gitlab&scopes=sudo", nil)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ts.Require().NoError(err, "redirect url parse failed")
+	ts.Equal("read_user api sudo", u.Query().Get("scope"))
+}
+
+func (ts *ExternalTestSuite) TestCreateAccountFromExternalIdentitySuppressed() {
+	cases := []struct {
+		desc          string
+		disableSignup bool
+		reason        string
+		commit        bool
+	}{
+		{
+			desc:          "signups disabled",
+			disableSignup: true,
+			reason:        signInSuppressedSignupDisabled,
+			commit:        false,
+		},
+		{
+			desc:          "unverified email",
+			disableSignup: false,
+			reason:        signInSuppressedEmailNotConfirmed,
+			commit:        true,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			models.TruncateAll(ts.API.db)
+			ts.Config.DisableSignup = c.disableSignup
+
+			userData := &provider.UserProvidedData{
+				Emails: []provider.Email{
+					{
+						Email:    "suppressed@example.com",
+						Verified: false,
+						Primary:  true,
+					},
+				},
+				Metadata: &provider.Claims{
+					Subject: "suppressed-subject",
+					Email:   "suppressed@example.com",
+				},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+			req = req.WithContext(withExternalHost(req.Context(), &url.URL{Scheme: "http", Host: "localhost"}))
+
+			var suppressed *signInSuppressedError
+			ts.Require().NoError(ts.API.db.Transaction(func(tx *storage.Connection) error {
+				user, _, err := ts.API.createAccountFromExternalIdentity(tx, req, userData, "google", nil)
+				ts.Require().Nil(user)
+				ts.Require().ErrorAs(err, &suppressed)
+
+				return nil
+			}))
+
+			ts.Require().Equal(c.reason, suppressed.Reason)
+			ts.Require().Equal(c.commit, suppressed.Commit)
+			ts.Require().Equal(c.reason, suppressed.asOAuthError().Err)
+		})
+	}
+}
+
+func (ts *ExternalTestSuite) TestCreateAccountFromExternalIdentityRequireVerifiedEmail() {
+	defer func(autoconfirm bool) {
+		ts.Config.External.RequireVerifiedEmail = false
+		ts.Config.Mailer.Autoconfirm = autoconfirm
+	}(ts.Config.Mailer.Autoconfirm)
+
+	ts.Config.External.RequireVerifiedEmail = true
+	// unverified emails would otherwise be accepted
+	ts.Config.Mailer.Autoconfirm = true
+
+	cases := []struct {
+		desc     string
+		verified bool
+	}{
+		{
+			desc:     "verified email",
+			verified: true,
+		},
+		{
+			desc:     "unverified email",
+			verified: false,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			models.TruncateAll(ts.API.db)
+
+			userData := &provider.UserProvidedData{
+				Emails: []provider.Email{
+					{
+						Email:    "verified@example.com",
+						Verified: c.verified,
+						Primary:  true,
+					},
+				},
+				Metadata: &provider.Claims{
+					Subject:       "verified-subject",
+					Email:         "verified@example.com",
+					EmailVerified: c.verified,
+				},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+			req = req.WithContext(withExternalHost(req.Context(), &url.URL{Scheme: "http", Host: "localhost"}))
+
+			var user *models.User
+			err := ts.API.db.Transaction(func(tx *storage.Connection) error {
+				var terr error
+				user, _, terr = ts.API.createAccountFromExternalIdentity(tx, req, userData, "google", nil)
+				return terr
+			})
+
+			_, findErr := models.FindUserByEmailAndAudience(ts.API.db, "verified@example.com", ts.Config.JWT.Aud)
+
+			if !c.verified {
+				var suppressed *signInSuppressedError
+				ts.Require().ErrorAs(err, &suppressed)
+				ts.Require().Equal(signInSuppressedEmailNotConfirmed, suppressed.Reason)
+				ts.Require().Equal(ErrorCodeEmailNotConfirmed, suppressed.Err.ErrorCode)
+				ts.Require().False(suppressed.Commit)
+				ts.Require().True(models.IsNotFoundError(findErr))
+				return
+			}
+
+			ts.Require().NoError(err)
+			ts.Require().NoError(findErr)
+			ts.Require().True(user.IsConfirmed())
+		})
+	}
+}
+
+func (ts *ExternalTestSuite) TestCreateAccountFromExternalIdentityRequireVerifiedEmailExistingUser() {
+	defer func() {
+		ts.Config.External.RequireVerifiedEmail = false
+	}()
+
+	userData := &provider.UserProvidedData{
+		Emails: []provider.Email{
+			{
+				Email:    "existing@example.com",
+				Verified: true,
+				Primary:  true,
+			},
+		},
+		Metadata: &provider.Claims{
+			Subject:       "existing-subject",
+			Email:         "existing@example.com",
+			EmailVerified: true,
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+	req = req.WithContext(withExternalHost(req.Context(), &url.URL{Scheme: "http", Host: "localhost"}))
+
+	ts.Require().NoError(ts.API.db.Transaction(func(tx *storage.Connection) error {
+		_, _, terr := ts.API.createAccountFromExternalIdentity(tx, req, userData, "google", nil)
+		return terr
+	}))
+
+	// the provider no longer vouches for the email of the confirmed user
+	ts.Config.External.RequireVerifiedEmail = true
+	userData.Metadata.EmailVerified = false
+
+	err := ts.API.db.Transaction(func(tx *storage.Connection) error {
+		_, _, terr := ts.API.createAccountFromExternalIdentity(tx, req, userData, "google", nil)
+		return terr
+	})
+
+	var suppressed *signInSuppressedError
+	ts.Require().ErrorAs(err, &suppressed)
+	ts.Require().Equal(signInSuppressedEmailNotConfirmed, suppressed.Reason)
+	ts.Require().Equal(signInSuppressedEmailNotConfirmed, suppressed.asOAuthError().Err)
+}
+
+func (ts *ExternalTestSuite) TestCreateAccountFromExternalIdentityInviteOnly() {
+	defer func() {
+		ts.Config.DisableSignup = false
+		ts.Config.InviteOnly = false
+	}()
+
+	cases := []struct {
+		desc          string
+		disableSignup bool
+		inviteOnly    bool
+		invited       bool
+		isSuppressed  bool
+	}{
+		{
+			desc:          "signups disabled",
+			disableSignup: true,
+			isSuppressed:  true,
+		},
+		{
+			desc:         "invite only without invite",
+			inviteOnly:   true,
+			isSuppressed: true,
+		},
+		{
+			desc:       "invite only with invite",
+			inviteOnly: true,
+			invited:    true,
+		},
+		{
+			desc: "signups enabled",
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			models.TruncateAll(ts.API.db)
+			ts.Config.DisableSignup = c.disableSignup
+			ts.Config.InviteOnly = c.inviteOnly
+
+			var invited *models.User
+			if c.invited {
+				var err error
+				invited, err = models.NewUser("", "invited@example.com", "", ts.Config.JWT.Aud, nil)
+				ts.Require().NoError(err)
+				now := time.Now()
+				invited.InvitedAt = &now
+				ts.Require().NoError(ts.API.db.Create(invited))
+			}
+
+			userData := &provider.UserProvidedData{
+				Emails: []provider.Email{
+					{
+						Email:    "invited@example.com",
+						Verified: true,
+						Primary:  true,
+					},
+				},
+				Metadata: &provider.Claims{
+					Subject: "invited-subject",
+					Email:   "invited@example.com",
+				},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+			req = req.WithContext(withExternalHost(req.Context(), &url.URL{Scheme: "http", Host: "localhost"}))
+
+			var user *models.User
+			err := ts.API.db.Transaction(func(tx *storage.Connection) error {
+				var terr error
+				user, _, terr = ts.API.createAccountFromExternalIdentity(tx, req, userData, "google", nil)
+				return terr
+			})
+
+			if c.isSuppressed {
+				var suppressed *signInSuppressedError
+				ts.Require().ErrorAs(err, &suppressed)
+				ts.Require().Equal(signInSuppressedSignupDisabled, suppressed.Reason)
+				ts.Require().Equal(ErrorCodeSignupDisabled, suppressed.Err.ErrorCode)
+
+				_, err = models.FindUserByEmailAndAudience(ts.API.db, "invited@example.com", ts.Config.JWT.Aud)
+				ts.Require().True(models.IsNotFoundError(err))
+				return
+			}
+
+			ts.Require().NoError(err)
+			if invited != nil {
+				ts.Require().Equal(invited.ID, user.ID, "the identity is linked to the invited user")
+			}
+
+			_, err = models.FindIdentityByIdAndProvider(ts.API.db, "invited-subject", "google")
+			ts.Require().NoError(err)
+		})
+	}
+}
+
+func (ts *ExternalTestSuite) TestCreateAccountFromExternalIdentityIdentityLimit() {
+	defer func() {
+		ts.Config.External.MaxIdentitiesPerUser = 0
+	}()
+
+	for _, limit := range []int{1, 2} {
+		ts.Run(fmt.Sprintf("limit %d", limit), func() {
+			models.TruncateAll(ts.API.db)
+			ts.Config.External.MaxIdentitiesPerUser = limit
+
+			user, err := models.NewUser("", "limit@example.com", "password", ts.Config.JWT.Aud, nil)
+			ts.Require().NoError(err)
+			ts.Require().NoError(ts.API.db.Create(user))
+
+			identity, err := models.NewIdentity(user, "email", map[string]interface{}{
+				"sub":   user.ID.String(),
+				"email": "limit@example.com",
+			})
+			ts.Require().NoError(err)
+			ts.Require().NoError(ts.API.db.Create(identity))
+
+			userData := &provider.UserProvidedData{
+				Emails: []provider.Email{
+					{
+						Email:    "limit@example.com",
+						Verified: true,
+						Primary:  true,
+					},
+				},
+				Metadata: &provider.Claims{
+					Subject: "limit-subject",
+					Email:   "limit@example.com",
+				},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+			req = req.WithContext(withExternalHost(req.Context(), &url.URL{Scheme: "http", Host: "localhost"}))
+
+			err = ts.API.db.Transaction(func(tx *storage.Connection) error {
+				_, _, terr := ts.API.createAccountFromExternalIdentity(tx, req, userData, "google", nil)
+				return terr
+			})
+
+			_, findErr := models.FindIdentityByIdAndProvider(ts.API.db, "limit-subject", "google")
+
+			if limit == 1 {
+				var suppressed *signInSuppressedError
+				ts.Require().ErrorAs(err, &suppressed)
+				ts.Require().Equal(signInSuppressedIdentityLimitExceeded, suppressed.Reason)
+				ts.Require().Equal(ErrorCodeIdentityLimitExceeded, suppressed.Err.ErrorCode)
+				ts.Require().True(models.IsNotFoundError(findErr))
+				return
+			}
+
+			ts.Require().NoError(err)
+			ts.Require().NoError(findErr)
+		})
+	}
+}
+
+func (ts *ExternalTestSuite) TestCreateAccountFromExternalIdentityStoresClaims() {
+	defer func() {
+		ts.Config.External.DisableIdTokenClaimsStorage = false
+	}()
+
+	cases := []struct {
+		desc     string
+		disabled bool
+	}{
+		{
+			desc:     "claims stored",
+			disabled: false,
+		},
+		{
+			desc:     "claims storage disabled",
+			disabled: true,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			models.TruncateAll(ts.API.db)
+			ts.Config.External.DisableIdTokenClaimsStorage = c.disabled
+
+			userData := &provider.UserProvidedData{
+				Emails: []provider.Email{
+					{
+						Email:    "claims@example.com",
+						Verified: true,
+						Primary:  true,
+					},
+				},
+				Metadata: &provider.Claims{
+					Issuer:  provider.IssuerGoogle,
+					Subject: "claims-subject",
+					Email:   "claims@example.com",
+				},
+				RawClaims: map[string]interface{}{
+					"iss":     provider.IssuerGoogle,
+					"sub":     "claims-subject",
+					"email":   "claims@example.com",
+					"hd":      "example.com",
+					"at_hash": "at-hash",
+					"nonce":   "nonce",
+				},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+			req = req.WithContext(withExternalHost(req.Context(), &url.URL{Scheme: "http", Host: "localhost"}))
+
+			ts.Require().NoError(ts.API.db.Transaction(func(tx *storage.Connection) error {
+				_, _, err := ts.API.createAccountFromExternalIdentity(tx, req, userData, "google", nil)
+				return err
+			}))
+
+			identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "claims-subject", "google")
+			ts.Require().NoError(err)
+
+			user, err := models.FindUserByID(ts.API.db, identity.UserID)
+			ts.Require().NoError(err)
+			ts.Require().NotContains(user.UserMetaData, "claims")
+
+			if c.disabled {
+				ts.Require().NotContains(identity.IdentityData, "claims")
+				return
+			}
+
+			encoded, err := json.Marshal(identity.IdentityData["claims"])
+			ts.Require().NoError(err)
+			ts.Require().JSONEq(`{
+				"iss": "https://accounts.google.com",
+				"sub": "claims-subject",
+				"email": "claims@example.com",
+				"hd": "example.com"
+			}`, string(encoded))
+		})
+	}
+}
+
+func (ts *ExternalTestSuite) TestCreateAccountFromExternalIdentityEmailDomains() {
+	google := ts.Config.External.Google
+	defer func() {
+		ts.Config.External.Google = google
+	}()
+
+	ts.Config.External.Google.AllowedEmailDomains = []string{"example.com", "*.example.com"}
+	ts.Config.External.Google.BlockedEmailDomains = []string{"guests.example.com"}
+
+	cases := []struct {
+		desc    string
+		emails  []provider.Email
+		isError bool
+	}{
+		{
+			desc:   "allowed domain",
+			emails: []provider.Email{{Email: "domains@example.com", Verified: true, Primary: true}},
+		},
+		{
+			desc:   "allowed subdomain",
+			emails: []provider.Email{{Email: "domains@team.example.com", Verified: true, Primary: true}},
+		},
+		{
+			desc:    "blocked subdomain",
+			emails:  []provider.Email{{Email: "domains@guests.example.com", Verified: true, Primary: true}},
+			isError: true,
+		},
+		{
+			desc:    "domain not allowed",
+			emails:  []provider.Email{{Email: "domains@example.org", Verified: true, Primary: true}},
+			isError: true,
+		},
+		{
+			desc:    "unverified email",
+			emails:  []provider.Email{{Email: "domains@example.com", Verified: false, Primary: true}},
+			isError: true,
+		},
+		{
+			desc:    "missing email",
+			isError: true,
+		},
+		{
+			desc: "secondary emails in other domains",
+			emails: []provider.Email{
+				{Email: "domains@example.org", Verified: false},
+				{Email: "domains@example.com", Verified: true, Primary: true},
+				{Email: "domains@guests.example.com", Verified: true},
+			},
+		},
+		{
+			desc: "secondary email in allowed domain",
+			emails: []provider.Email{
+				{Email: "domains@example.org", Verified: true, Primary: true},
+				{Email: "domains@example.com", Verified: true},
+			},
+			isError: true,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			models.TruncateAll(ts.API.db)
+
+			userData := &provider.UserProvidedData{
+				Emails: c.emails,
+				Metadata: &provider.Claims{
+					Subject: "domains-subject",
+				},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+			req = req.WithContext(withExternalHost(req.Context(), &url.URL{Scheme: "http", Host: "localhost"}))
+
+			var suppressed *signInSuppressedError
+			err := ts.API.db.Transaction(func(tx *storage.Connection) error {
+				_, _, err := ts.API.createAccountFromExternalIdentity(tx, req, userData, "google", nil)
+				return err
+			})
+
+			if !c.isError {
+				ts.Require().NoError(err)
+				return
+			}
+
+			ts.Require().ErrorAs(err, &suppressed)
+			ts.Require().Equal(signInSuppressedEmailDomainNotAllowed, suppressed.Reason)
+			ts.Require().Equal(http.StatusForbidden, suppressed.Err.Code)
+
+			_, err = models.FindUserByEmailAndAudience(ts.API.db, "domains@example.com", ts.Config.JWT.Aud)
+			ts.Require().True(models.IsNotFoundError(err))
+		})
+	}
+
+	ts.Run("no linking through emails in other domains", func() {
+		models.TruncateAll(ts.API.db)
+
+		guest, err := models.NewUser("", "domains@guests.example.com", "", ts.Config.JWT.Aud, nil)
+		ts.Require().NoError(err)
+		now := time.Now()
+		guest.EmailConfirmedAt = &now
+		ts.Require().NoError(ts.API.db.Create(guest))
+
+		userData := &provider.UserProvidedData{
+			Emails: []provider.Email{
+				{Email: "domains@example.com", Verified: true, Primary: true},
+				{Email: "domains@guests.example.com", Verified: true},
+			},
+			Metadata: &provider.Claims{
+				Subject: "domains-subject",
+			},
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+		req = req.WithContext(withExternalHost(req.Context(), &url.URL{Scheme: "http", Host: "localhost"}))
+
+		var user *models.User
+		ts.Require().NoError(ts.API.db.Transaction(func(tx *storage.Connection) error {
+			var err error
+			user, _, err = ts.API.createAccountFromExternalIdentity(tx, req, userData, "google", nil)
+			return err
+		}))
+
+		ts.Require().NotEqual(guest.ID, user.ID)
+		ts.Require().Equal("domains@example.com", user.GetEmail())
+	})
+}
+
+func (ts *ExternalTestSuite) TestCreateAccountFromExternalIdentityApplePrivateRelay() {
+	models.TruncateAll(ts.API.db)
+
+	signIn := func(email string) *models.User {
+		userData := &provider.UserProvidedData{
+			Emails: []provider.Email{
+				{
+					Email:    email,
+					Verified: true,
+					Primary:  true,
+				},
+			},
+			Metadata: &provider.Claims{
+				Issuer:        provider.IssuerApple,
+				Subject:       "apple-subject",
+				Email:         email,
+				EmailVerified: true,
+			},
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+		req = req.WithContext(withExternalHost(req.Context(), &url.URL{Scheme: "http", Host: "localhost"}))
+
+		var user *models.User
+		ts.Require().NoError(ts.API.db.Transaction(func(tx *storage.Connection) error {
+			var err error
+			user, _, err = ts.API.createAccountFromExternalIdentity(tx, req, userData, "apple", nil)
+			return err
+		}))
+
+		return user
+	}
+
+	const relayEmail = "abc123@privaterelay.appleid.com"
+
+	first := signIn("apple@example.com")
+	second := signIn(relayEmail)
+	ts.Require().Equal(first.ID, second.ID)
+
+	identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "apple-subject", "apple")
+	ts.Require().NoError(err)
+	ts.Require().Equal("apple@example.com", identity.IdentityData["email"])
+	ts.Require().ElementsMatch([]interface{}{"apple@example.com", relayEmail}, identity.IdentityData["emails"])
+
+	user, err := models.FindUserByID(ts.API.db, first.ID)
+	ts.Require().NoError(err)
+	ts.Require().Equal("apple@example.com", user.GetEmail())
+
+	// switching back to the real email keeps both addresses
+	third := signIn("apple@example.com")
+	ts.Require().Equal(first.ID, third.ID)
+
+	identity, err = models.FindIdentityByIdAndProvider(ts.API.db, "apple-subject", "apple")
+	ts.Require().NoError(err)
+	ts.Require().Equal("apple@example.com", identity.IdentityData["email"])
+	ts.Require().ElementsMatch([]interface{}{"apple@example.com", relayEmail}, identity.IdentityData["emails"])
+}
+
+func (ts *ExternalTestSuite) TestCreateAccountFromExternalIdentityAppleClientID() {
+	models.TruncateAll(ts.API.db)
+
+	signIn := func(clientID string) *models.User {
+		userData := &provider.UserProvidedData{
+			Emails: []provider.Email{
+				{
+					Email:    "apple@example.com",
+					Verified: true,
+					Primary:  true,
+				},
+			},
+			Metadata: &provider.Claims{
+				Issuer:        provider.IssuerApple,
+				Subject:       "apple-subject",
+				Email:         "apple@example.com",
+				EmailVerified: true,
+			},
+			ClientID: clientID,
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+		req = req.WithContext(withExternalHost(req.Context(), &url.URL{Scheme: "http", Host: "localhost"}))
+
+		var user *models.User
+		ts.Require().NoError(ts.API.db.Transaction(func(tx *storage.Connection) error {
+			var err error
+			user, _, err = ts.API.createAccountFromExternalIdentity(tx, req, userData, "apple", nil)
+			return err
+		}))
+
+		return user
+	}
+
+	// signing in on a native app, with the bundle ID, and then on the web,
+	// with the Services ID, records the audience of the latest ID token
+	for _, clientID := range []string{"com.example.ios", "com.example.web"} {
+		user := signIn(clientID)
+
+		identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "apple-subject", "apple")
+		ts.Require().NoError(err)
+		ts.Require().Equal(user.ID, identity.UserID)
+		ts.Require().Equal(clientID, identity.IdentityData["client_id"])
+		ts.Require().NotContains(user.UserMetaData, "client_id")
+	}
+}
+
 func (ts *ExternalTestSuite) TestRedirectErrorsShouldPreserveParams() {
 	// Request with invalid external provider
 	req := httptest.NewRequest(http.MethodGet, "http://localhost/authorize?provider=external", nil)
@@ -10,7 +10,10 @@ import (
 	"github.com/pkg/errors"
 	"github.com/supabase/gotrue/internal/conf"
 	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/observability"
 	"github.com/supabase/gotrue/internal/utilities"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func addRequestID(globalConfig *conf.GlobalConfiguration) middlewareHandler {
@@ -30,6 +33,21 @@ func addRequestID(globalConfig *conf.GlobalConfiguration) middlewareHandler {
 	}
 }
 
+// validateLocale returns the locale in its canonical form, e.g. "pt-BR". An
+// empty locale is kept, so that the user's locale is used.
+func validateLocale(locale string) (string, error) {
+	if locale == "" {
+		return "", nil
+	}
+
+	canonical, ok := conf.CanonicalLocale(locale)
+	if !ok {
+		return "", badRequestError("Invalid locale %q", locale)
+	}
+
+	return canonical, nil
+}
+
 func sendJSON(w http.ResponseWriter, status int, obj interface{}) error {
 	w.Header().Set("Content-Type", "application/json")
 	b, err := json.Marshal(obj)
@@ -62,6 +80,16 @@ func (a *API) requestAud(ctx context.Context, r *http.Request) string {
 	return config.JWT.Aud
 }
 
+// startSpan starts a span for the operation if OpenTelemetry tracing is
+// enabled, continuing the trace of the request in the context.
+func (a *API) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !a.config.Tracing.Enabled || a.config.Tracing.Exporter != conf.OpenTelemetryTracing {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+
+	return observability.Tracer("gotrue").Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
 func isStringInSlice(checkValue string, list []string) bool {
 	for _, val := range list {
 		if val == checkValue {
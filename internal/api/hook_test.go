@@ -3,17 +3,21 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/supabase/gotrue/internal/conf"
 	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
 	"github.com/supabase/gotrue/internal/storage/test"
 )
 
@@ -164,4 +168,323 @@ func TestHookTimeout(t *testing.T) {
 	assert.Equal(t, 3, callCount)
 }
 
+func TestHookRetryDelay(t *testing.T) {
+	w := Webhook{
+		WebhookConfig: &conf.WebhookConfig{
+			RetryBaseDelay: time.Second,
+			RetryMaxDelay:  5 * time.Second,
+		},
+	}
+
+	for n, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		assert.Equal(t, expected, w.retryDelay(n+1))
+	}
+
+	w.WebhookConfig = &conf.WebhookConfig{}
+	assert.Equal(t, defaultHookRetryBaseDelay, w.retryDelay(1))
+	assert.Equal(t, defaultHookRetryMaxDelay, w.retryDelay(100))
+}
+
+// findWebhookDeadLetters returns the dead letters of the webhook at url.
+func findWebhookDeadLetters(t *testing.T, conn *storage.Connection, url string) []*models.WebhookDeadLetter {
+	deadLetters, err := models.FindWebhookDeadLetters(conn)
+	require.NoError(t, err)
+
+	found := []*models.WebhookDeadLetter{}
+	for _, deadLetter := range deadLetters {
+		if deadLetter.URL == url {
+			found = append(found, deadLetter)
+		}
+	}
+	return found
+}
+
+func TestEventHookRetriesInBackground(t *testing.T) {
+	globalConfig, err := conf.LoadGlobal(apiTestConfig)
+	require.NoError(t, err)
+
+	conn, err := test.SetupDBConnection(globalConfig)
+	require.NoError(t, err)
+
+	user, err := models.NewUser("", "test@truth.com", "thisisapassword", "", nil)
+	require.NoError(t, err)
+
+	var callCount atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fails transiently before succeeding
+		if callCount.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	config := &conf.GlobalConfiguration{
+		Webhook: conf.WebhookConfig{
+			URL:                svr.URL,
+			Retries:            3,
+			BackgroundDelivery: true,
+			RetryBaseDelay:     10 * time.Millisecond,
+			RetryMaxDelay:      20 * time.Millisecond,
+			Events:             []string{SignupEvent},
+		},
+	}
+
+	// the failed first attempt doesn't fail the request
+	require.NoError(t, triggerEventHooks(context.Background(), conn, SignupEvent, user, config))
+	assert.Equal(t, int32(1), callCount.Load())
+
+	require.Eventually(t, func() bool {
+		return callCount.Load() == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// give a dead letter a chance to be (wrongly) written
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, findWebhookDeadLetters(t, conn, svr.URL))
+}
+
+func TestEventHookDeadLetter(t *testing.T) {
+	globalConfig, err := conf.LoadGlobal(apiTestConfig)
+	require.NoError(t, err)
+
+	conn, err := test.SetupDBConnection(globalConfig)
+	require.NoError(t, err)
+
+	user, err := models.NewUser("", "test@truth.com", "thisisapassword", "", nil)
+	require.NoError(t, err)
+
+	var callCount atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer svr.Close()
+
+	config := &conf.GlobalConfiguration{
+		Webhook: conf.WebhookConfig{
+			URL:                svr.URL,
+			Retries:            3,
+			BackgroundDelivery: true,
+			RetryBaseDelay:     10 * time.Millisecond,
+			RetryMaxDelay:      20 * time.Millisecond,
+			Events:             []string{SignupEvent},
+		},
+	}
+
+	require.NoError(t, triggerEventHooks(context.Background(), conn, SignupEvent, user, config))
+
+	var deadLetters []*models.WebhookDeadLetter
+	require.Eventually(t, func() bool {
+		deadLetters = findWebhookDeadLetters(t, conn, svr.URL)
+		return len(deadLetters) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Len(t, deadLetters, 1)
+	assert.Equal(t, int32(3), callCount.Load())
+	assert.Equal(t, string(SignupEvent), deadLetters[0].Event)
+	assert.Equal(t, 3, deadLetters[0].Attempts)
+	assert.Contains(t, deadLetters[0].LastError, "500")
+
+	payload := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(deadLetters[0].Payload), &payload))
+	assert.Equal(t, string(SignupEvent), payload["event"])
+	assert.Equal(t, user.ID.String(), payload["user"].(map[string]interface{})["id"])
+}
+
+func TestEventHookFailsRequestWithoutBackgroundDelivery(t *testing.T) {
+	globalConfig, err := conf.LoadGlobal(apiTestConfig)
+	require.NoError(t, err)
+
+	conn, err := test.SetupDBConnection(globalConfig)
+	require.NoError(t, err)
+
+	user, err := models.NewUser("", "test@truth.com", "thisisapassword", "", nil)
+	require.NoError(t, err)
+
+	var callCount atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer svr.Close()
+
+	config := &conf.GlobalConfiguration{
+		Webhook: conf.WebhookConfig{
+			URL:     svr.URL,
+			Retries: 3,
+			Events:  []string{SignupEvent, LoginEvent},
+		},
+	}
+
+	for _, event := range []HookEvent{SignupEvent, LoginEvent} {
+		callCount.Store(0)
+		require.Error(t, triggerEventHooks(context.Background(), conn, event, user, config), event)
+		assert.Equal(t, int32(3), callCount.Load(), event)
+	}
+
+	assert.Empty(t, findWebhookDeadLetters(t, conn, svr.URL))
+}
+
+func TestEventHookBackgroundDeliveryAfterCommit(t *testing.T) {
+	globalConfig, err := conf.LoadGlobal(apiTestConfig)
+	require.NoError(t, err)
+
+	conn, err := test.SetupDBConnection(globalConfig)
+	require.NoError(t, err)
+
+	user, err := models.NewUser("", "test@truth.com", "thisisapassword", "", nil)
+	require.NoError(t, err)
+
+	var callCount atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	config := &conf.GlobalConfiguration{
+		Webhook: conf.WebhookConfig{
+			URL:                svr.URL,
+			BackgroundDelivery: true,
+			Events:             []string{SignupEvent},
+		},
+	}
+
+	require.NoError(t, conn.Transaction(func(tx *storage.Connection) error {
+		require.NoError(t, triggerEventHooks(context.Background(), tx, SignupEvent, user, config))
+		assert.Equal(t, int32(0), callCount.Load())
+		return nil
+	}))
+	assert.Equal(t, int32(1), callCount.Load())
+
+	// events of rolled back transactions aren't sent
+	require.Error(t, conn.Transaction(func(tx *storage.Connection) error {
+		require.NoError(t, triggerEventHooks(context.Background(), tx, SignupEvent, user, config))
+		return errors.New("rolled back")
+	}))
+	assert.Equal(t, int32(1), callCount.Load())
+}
+
+func TestCustomAccessTokenHook(t *testing.T) {
+	globalConfig, err := conf.LoadGlobal(apiTestConfig)
+	require.NoError(t, err)
+
+	conn, err := test.SetupDBConnection(globalConfig)
+	require.NoError(t, err)
+
+	user, err := models.NewUser("", "test@truth.com", "thisisapassword", "authenticated", nil)
+	require.NoError(t, err)
+
+	var callCount atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount.Add(1)
+		defer squash(r.Body.Close)
+
+		_, err := jwt.Parse(r.Header.Get(headerHookSignature), func(token *jwt.Token) (interface{}, error) {
+			return []byte("hooksecret"), nil
+		})
+		require.NoError(t, err)
+
+		data := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&data))
+		assert.Equal(t, CustomAccessTokenEvent, data["event"])
+		assert.Equal(t, user.ID.String(), data["user"].(map[string]interface{})["id"])
+
+		w.Header().Set("Content-Type", "application/json")
+		// flushing before writing the body makes the response chunked,
+		// without a Content-Length
+		w.(http.Flusher).Flush()
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+			"claims": map[string]interface{}{
+				"tenant_id": "tenant",
+				"roles":     []string{"admin"},
+			},
+		}))
+	}))
+	defer svr.Close()
+
+	config := &conf.GlobalConfiguration{
+		JWT: globalConfig.JWT,
+		Hook: conf.HookConfiguration{
+			CustomAccessToken: conf.HTTPHookConfiguration{
+				URL:    svr.URL,
+				Secret: "hooksecret",
+			},
+		},
+	}
+
+	// the hook is called within the transaction, but the access token is
+	// only signed once the transaction commits
+	var signed string
+	require.NoError(t, conn.Transaction(func(tx *storage.Connection) error {
+		_, err := generateAccessTokenWithHook(tx, user, nil, config, func(token string) {
+			signed = token
+		})
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), callCount.Load())
+		assert.Empty(t, signed)
+		return nil
+	}))
+	assert.NotEmpty(t, signed)
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(signed, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(config.JWT.Secret), nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "tenant", claims["tenant_id"])
+	assert.Equal(t, []interface{}{"admin"}, claims["roles"])
+	assert.Equal(t, user.ID.String(), claims["sub"])
+	assert.Equal(t, "test@truth.com", claims["email"])
+
+	// without a hook only the standard claims are included
+	config.Hook.CustomAccessToken.URL = ""
+
+	_, err = generateAccessTokenWithHook(conn, user, nil, config, func(token string) {
+		signed = token
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), callCount.Load())
+
+	claims = jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(signed, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(config.JWT.Secret), nil
+	})
+	require.NoError(t, err)
+	assert.NotContains(t, claims, "tenant_id")
+	assert.Equal(t, "authenticated", claims["aud"])
+}
+
+func TestCustomAccessTokenHookReservedClaims(t *testing.T) {
+	user, err := models.NewUser("", "test@truth.com", "thisisapassword", "authenticated", nil)
+	require.NoError(t, err)
+
+	for _, claim := range []string{"sub", "exp", "aud", "session_id", "role", "app_metadata", "user_metadata"} {
+		svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+				"claims": map[string]interface{}{
+					"tenant_id": "tenant",
+					claim:       "overridden",
+				},
+			}))
+		}))
+
+		config := &conf.GlobalConfiguration{
+			Hook: conf.HookConfiguration{
+				CustomAccessToken: conf.HTTPHookConfiguration{
+					URL: svr.URL,
+				},
+			},
+		}
+
+		customClaims, err := triggerCustomAccessTokenHook(user, nil, config)
+		require.Error(t, err, claim)
+		require.Nil(t, customClaims)
+
+		svr.Close()
+	}
+}
+
 func squash(f func() error) { _ = f }
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -34,10 +35,23 @@ const (
 	SignupEvent         = "signup"
 	EmailChangeEvent    = "email_change"
 	LoginEvent          = "login"
+
+	// UserCreatedEvent and UserSignedInEvent are sent for the users of
+	// external providers, with the provider in the payload, on the sign
+	// in that created the user and on every later sign in.
+	UserCreatedEvent  = "user.created"
+	UserSignedInEvent = "user.signedin"
+
+	CustomAccessTokenEvent = "custom_access_token"
 )
 
 var defaultTimeout = time.Second * 5
 
+const (
+	defaultHookRetryBaseDelay = time.Second
+	defaultHookRetryMaxDelay  = time.Minute
+)
+
 type webhookClaims struct {
 	jwt.StandardClaims
 	SHA256 string `json:"sha256"`
@@ -56,22 +70,58 @@ type WebhookResponse struct {
 	UserMetaData map[string]interface{} `json:"user_metadata,omitempty"`
 }
 
-func (w *Webhook) trigger() (io.ReadCloser, error) {
-	timeout := defaultTimeout
+func (w *Webhook) timeout() time.Duration {
 	if w.TimeoutSec > 0 {
-		timeout = time.Duration(w.TimeoutSec) * time.Second
-	}
-
-	if w.Retries == 0 {
-		w.Retries = defaultHookRetries
+		return time.Duration(w.TimeoutSec) * time.Second
 	}
+	return defaultTimeout
+}
 
-	hooklog := logrus.WithFields(logrus.Fields{
+func (w *Webhook) logger() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
 		"component":   "webhook",
 		"url":         w.URL,
 		"signed":      w.jwtSecret != "",
 		"instance_id": uuid.Nil.String(),
 	})
+}
+
+func (w *Webhook) newRequest() (*connectionWatcher, *http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewBuffer(w.payload))
+	if err != nil {
+		return nil, nil, internalServerError("Failed to make request object").WithInternalError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	watcher, req := watchForConnection(req)
+
+	if w.jwtSecret != "" {
+		header, jwtErr := w.generateSignature()
+		if jwtErr != nil {
+			return nil, nil, jwtErr
+		}
+		req.Header.Set(headerHookSignature, header)
+	}
+
+	return watcher, req, nil
+}
+
+func isHookSuccess(rsp *http.Response) bool {
+	switch rsp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusAccepted:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *Webhook) trigger() (io.ReadCloser, error) {
+	timeout := w.timeout()
+
+	if w.Retries == 0 {
+		w.Retries = defaultHookRetries
+	}
+
+	hooklog := w.logger()
 	client := http.Client{
 		Timeout: timeout,
 	}
@@ -80,19 +130,9 @@ func (w *Webhook) trigger() (io.ReadCloser, error) {
 		hooklog = hooklog.WithField("attempt", i+1)
 		hooklog.Info("Starting to perform signup hook request")
 
-		req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewBuffer(w.payload))
+		watcher, req, err := w.newRequest()
 		if err != nil {
-			return nil, internalServerError("Failed to make request object").WithInternalError(err)
-		}
-		req.Header.Set("Content-Type", "application/json")
-		watcher, req := watchForConnection(req)
-
-		if w.jwtSecret != "" {
-			header, jwtErr := w.generateSignature()
-			if jwtErr != nil {
-				return nil, jwtErr
-			}
-			req.Header.Set(headerHookSignature, header)
+			return nil, err
 		}
 
 		start := time.Now()
@@ -119,23 +159,126 @@ func (w *Webhook) trigger() (io.ReadCloser, error) {
 			"status_code": rsp.StatusCode,
 			"dur":         dur.Nanoseconds(),
 		})
-		switch rsp.StatusCode {
-		case http.StatusOK, http.StatusNoContent, http.StatusAccepted:
+		if isHookSuccess(rsp) {
 			rspLog.Infof("Finished processing webhook in %s", dur)
+			// chunked responses have an unknown (negative) length
 			var body io.ReadCloser
-			if rsp.ContentLength > 0 {
+			if rsp.ContentLength != 0 {
 				body = rsp.Body
 			}
 			return body, nil
-		default:
-			rspLog.Infof("Bad response for webhook %d in %s", rsp.StatusCode, dur)
 		}
+		rspLog.Infof("Bad response for webhook %d in %s", rsp.StatusCode, dur)
 	}
 
 	hooklog.Infof("Failed to process webhook for %s after %d attempts", w.URL, w.Retries)
 	return nil, unprocessableEntityError("Failed to handle signup webhook")
 }
 
+// attempt performs a single webhook request, treating any response other
+// than a success as an error.
+func (w *Webhook) attempt(client *http.Client) (io.ReadCloser, error) {
+	_, req, err := w.newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		closeBody(rsp)
+		return nil, err
+	}
+
+	if !isHookSuccess(rsp) {
+		closeBody(rsp)
+		return nil, fmt.Errorf("webhook responded with HTTP status %d", rsp.StatusCode)
+	}
+
+	// chunked responses have an unknown (negative) length
+	if rsp.ContentLength != 0 {
+		return rsp.Body, nil
+	}
+	closeBody(rsp)
+	return nil, nil
+}
+
+// retryDelay returns the delay before the nth background retry, doubling
+// from the base delay up to the max delay.
+func (w *Webhook) retryDelay(n int) time.Duration {
+	delay := w.RetryBaseDelay
+	if delay <= 0 {
+		delay = defaultHookRetryBaseDelay
+	}
+	maxDelay := w.RetryMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultHookRetryMaxDelay
+	}
+
+	for i := 1; i < n && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// deliver makes the first attempt at delivering an event webhook. If it
+// fails, the remaining attempts are made in the background with exponential
+// backoff, so that retries don't block the request, and the webhook is
+// stored as a dead letter in db if all of them fail.
+func (w *Webhook) deliver(db *storage.Connection, event HookEvent) (io.ReadCloser, error) {
+	if w.Retries == 0 {
+		w.Retries = defaultHookRetries
+	}
+
+	client := &http.Client{
+		Timeout: w.timeout(),
+	}
+
+	body, err := w.attempt(client)
+	if err == nil {
+		return body, nil
+	}
+
+	w.logger().WithError(err).WithField("attempt", 1).Warn("Webhook failed, retrying in the background")
+	go w.retry(db, event, client, err)
+
+	return nil, nil
+}
+
+func (w *Webhook) retry(db *storage.Connection, event HookEvent, client *http.Client, lastErr error) {
+	hooklog := w.logger().WithField("event", event)
+
+	for i := 1; i < w.Retries; i++ {
+		time.Sleep(w.retryDelay(i))
+
+		body, err := w.attempt(client)
+		if err == nil {
+			if body != nil {
+				utilities.SafeClose(body)
+			}
+			hooklog.WithField("attempt", i+1).Info("Finished processing webhook")
+			return
+		}
+
+		lastErr = err
+		hooklog.WithError(err).WithField("attempt", i+1).Warn("Webhook failed")
+	}
+
+	hooklog = hooklog.WithError(lastErr)
+	if db == nil {
+		hooklog.Errorf("Failed to process webhook after %d attempts", w.Retries)
+		return
+	}
+
+	if _, err := models.CreateWebhookDeadLetter(db, w.URL, string(event), w.payload, w.Retries, lastErr); err != nil {
+		hooklog.WithField("dead_letter_error", err.Error()).Errorf("Failed to process webhook after %d attempts and to store it as a dead letter", w.Retries)
+		return
+	}
+	hooklog.Errorf("Failed to process webhook after %d attempts, stored as a dead letter", w.Retries)
+}
+
 func (w *Webhook) generateSignature() (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, w.claims)
 	tokenString, err := token.SignedString([]byte(w.jwtSecret))
@@ -154,6 +297,13 @@ func closeBody(rsp *http.Response) {
 }
 
 func triggerEventHooks(ctx context.Context, conn *storage.Connection, event HookEvent, user *models.User, config *conf.GlobalConfiguration) error {
+	return triggerProviderEventHooks(ctx, conn, event, user, "", config)
+}
+
+// triggerProviderEventHooks triggers the hooks of an event like
+// triggerEventHooks, including the provider the user signed in with in the
+// payload.
+func triggerProviderEventHooks(ctx context.Context, conn *storage.Connection, event HookEvent, user *models.User, providerType string, config *conf.GlobalConfiguration) error {
 	if config.Webhook.URL != "" {
 		hookURL, err := url.Parse(config.Webhook.URL)
 		if err != nil {
@@ -162,7 +312,7 @@ func triggerEventHooks(ctx context.Context, conn *storage.Connection, event Hook
 		if !config.Webhook.HasEvent(string(event)) {
 			return nil
 		}
-		return triggerHook(ctx, hookURL, config.Webhook.Secret, conn, event, user, config)
+		return triggerHook(ctx, hookURL, config.Webhook.Secret, conn, event, user, providerType, config)
 	}
 
 	fun := getFunctionHooks(ctx)
@@ -175,7 +325,7 @@ func triggerEventHooks(ctx context.Context, conn *storage.Connection, event Hook
 		if err != nil {
 			return errors.Wrapf(err, "Failed to parse Event Function Hook URL")
 		}
-		err = triggerHook(ctx, hookURL, config.JWT.Secret, conn, event, user, config)
+		err = triggerHook(ctx, hookURL, config.JWT.Secret, conn, event, user, providerType, config)
 		if err != nil {
 			return err
 		}
@@ -183,7 +333,7 @@ func triggerEventHooks(ctx context.Context, conn *storage.Connection, event Hook
 	return nil
 }
 
-func triggerHook(ctx context.Context, hookURL *url.URL, secret string, conn *storage.Connection, event HookEvent, user *models.User, config *conf.GlobalConfiguration) error {
+func triggerHook(ctx context.Context, hookURL *url.URL, secret string, conn *storage.Connection, event HookEvent, user *models.User, providerType string, config *conf.GlobalConfiguration) error {
 	if !hookURL.IsAbs() {
 		siteURL, err := url.Parse(config.SiteURL)
 		if err != nil {
@@ -198,10 +348,12 @@ func triggerHook(ctx context.Context, hookURL *url.URL, secret string, conn *sto
 		Event      HookEvent    `json:"event"`
 		InstanceID uuid.UUID    `json:"instance_id,omitempty"`
 		User       *models.User `json:"user"`
+		Provider   string       `json:"provider,omitempty"`
 	}{
 		Event:      event,
 		InstanceID: uuid.Nil,
 		User:       user,
+		Provider:   providerType,
 	}
 	data, err := json.Marshal(&payload)
 	if err != nil {
@@ -222,8 +374,10 @@ func triggerHook(ctx context.Context, hookURL *url.URL, secret string, conn *sto
 		SHA256: sha,
 	}
 
+	// copied, as the URL is set per hook and retries outlive the request
+	hookConfig := config.Webhook
 	w := Webhook{
-		WebhookConfig: &config.Webhook,
+		WebhookConfig: &hookConfig,
 		jwtSecret:     secret,
 		claims:        claims,
 		payload:       data,
@@ -231,33 +385,174 @@ func triggerHook(ctx context.Context, hookURL *url.URL, secret string, conn *sto
 
 	w.URL = hookURL.String()
 
+	if event == ValidateEvent || !w.BackgroundDelivery {
+		// the response of validate decides whether the request is
+		// allowed, and without background delivery a failing webhook
+		// fails the request, so the webhook is retried right away
+		body, err := w.trigger()
+		if err != nil {
+			return err
+		}
+
+		return applyWebhookResponse(conn, user, body)
+	}
+
+	// delivered once the transaction commits, so that the webhook doesn't
+	// hold it open and events of requests that fail aren't sent
+	db := getHookConnection(ctx, conn)
+	return conn.AfterCommit(func() error {
+		hooklog := w.logger().WithField("event", event)
+
+		body, err := w.deliver(db, event)
+		if err != nil {
+			hooklog.WithError(err).Error("Failed to deliver webhook")
+			return nil
+		}
+
+		if body != nil && db == nil {
+			utilities.SafeClose(body)
+			hooklog.Warn("Ignoring webhook response without a database connection")
+			return nil
+		}
+
+		if err := applyWebhookResponse(db, user, body); err != nil {
+			hooklog.WithError(err).Error("Failed to apply webhook response")
+		}
+		return nil
+	})
+}
+
+// applyWebhookResponse updates the metadata of the user with the ones in the
+// response of an event webhook, if any.
+func applyWebhookResponse(conn *storage.Connection, user *models.User, body io.ReadCloser) error {
+	if body == nil {
+		return nil
+	}
+	defer utilities.SafeClose(body)
+
+	webhookRsp := &WebhookResponse{}
+	decoder := json.NewDecoder(body)
+	if err := decoder.Decode(webhookRsp); err == io.EOF {
+		// empty chunked response
+		return nil
+	} else if err != nil {
+		return internalServerError("Webhook returned malformed JSON: %v", err).WithInternalError(err)
+	}
+
+	return conn.Transaction(func(tx *storage.Connection) error {
+		if webhookRsp.UserMetaData != nil {
+			user.UserMetaData = nil
+			if terr := user.UpdateUserMetaData(tx, webhookRsp.UserMetaData); terr != nil {
+				return terr
+			}
+		}
+		if webhookRsp.AppMetaData != nil {
+			user.AppMetaData = nil
+			if terr := user.UpdateAppMetaData(tx, webhookRsp.AppMetaData); terr != nil {
+				return terr
+			}
+		}
+		return nil
+	})
+}
+
+// reservedAccessTokenClaims are the claims the custom access token hook can't
+// set, as they identify the user and session, control the token's validity
+// or decide what the token grants access to.
+var reservedAccessTokenClaims = map[string]bool{
+	"iss":           true,
+	"sub":           true,
+	"aud":           true,
+	"exp":           true,
+	"nbf":           true,
+	"iat":           true,
+	"jti":           true,
+	"email":         true,
+	"phone":         true,
+	"aal":           true,
+	"amr":           true,
+	"session_id":    true,
+	"is_anonymous":  true,
+	"role":          true,
+	"app_metadata":  true,
+	"user_metadata": true,
+}
+
+type CustomAccessTokenHookResponse struct {
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// triggerCustomAccessTokenHook calls the custom access token hook, if one is
+// configured, and returns the additional claims it responded with. Claims in
+// reservedAccessTokenClaims are rejected.
+func triggerCustomAccessTokenHook(user *models.User, sessionId *uuid.UUID, config *conf.GlobalConfiguration) (map[string]interface{}, error) {
+	hookConfig := config.Hook.CustomAccessToken
+	if hookConfig.URL == "" {
+		return nil, nil
+	}
+
+	payload := struct {
+		Event      HookEvent    `json:"event"`
+		InstanceID uuid.UUID    `json:"instance_id,omitempty"`
+		User       *models.User `json:"user"`
+		SessionID  *uuid.UUID   `json:"session_id,omitempty"`
+	}{
+		Event:      CustomAccessTokenEvent,
+		InstanceID: uuid.Nil,
+		User:       user,
+		SessionID:  sessionId,
+	}
+	data, err := json.Marshal(&payload)
+	if err != nil {
+		return nil, internalServerError("Failed to serialize the data for custom access token hook").WithInternalError(err)
+	}
+
+	sha, err := checksum(data)
+	if err != nil {
+		return nil, internalServerError("Failed to checksum the data for custom access token hook").WithInternalError(err)
+	}
+
+	w := Webhook{
+		WebhookConfig: &conf.WebhookConfig{
+			URL:        hookConfig.URL,
+			Retries:    hookConfig.Retries,
+			TimeoutSec: hookConfig.TimeoutSec,
+		},
+		jwtSecret: hookConfig.Secret,
+		claims: webhookClaims{
+			StandardClaims: jwt.StandardClaims{
+				IssuedAt: time.Now().Unix(),
+				Subject:  uuid.Nil.String(),
+				Issuer:   gotrueIssuer,
+			},
+			SHA256: sha,
+		},
+		payload: data,
+	}
+
 	body, err := w.trigger()
 	if body != nil {
 		defer utilities.SafeClose(body)
 	}
-	if err == nil && body != nil {
-		webhookRsp := &WebhookResponse{}
-		decoder := json.NewDecoder(body)
-		if err = decoder.Decode(webhookRsp); err != nil {
-			return internalServerError("Webhook returned malformed JSON: %v", err).WithInternalError(err)
+	if err != nil || body == nil {
+		return nil, err
+	}
+
+	hookRsp := &CustomAccessTokenHookResponse{}
+	if err := json.NewDecoder(body).Decode(hookRsp); err == io.EOF {
+		// empty chunked response
+		return nil, nil
+	} else if err != nil {
+		return nil, internalServerError("Custom access token hook returned malformed JSON: %v", err).WithInternalError(err)
+	}
+
+	for claim := range hookRsp.Claims {
+		if reservedAccessTokenClaims[claim] {
+			return nil, internalServerError("Custom access token hook attempted to set the reserved claim %q", claim)
 		}
-		return conn.Transaction(func(tx *storage.Connection) error {
-			if webhookRsp.UserMetaData != nil {
-				user.UserMetaData = nil
-				if terr := user.UpdateUserMetaData(tx, webhookRsp.UserMetaData); terr != nil {
-					return terr
-				}
-			}
-			if webhookRsp.AppMetaData != nil {
-				user.AppMetaData = nil
-				if terr := user.UpdateAppMetaData(tx, webhookRsp.AppMetaData); terr != nil {
-					return terr
-				}
-			}
-			return nil
-		})
 	}
-	return err
+
+	return hookRsp.Claims, nil
 }
 
 func watchForConnection(req *http.Request) (*connectionWatcher, *http.Request) {
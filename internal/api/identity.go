@@ -0,0 +1,340 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi"
+	"golang.org/x/oauth2"
+
+	"github.com/supabase/gotrue/internal/api/provider"
+	"github.com/supabase/gotrue/internal/crypto"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// LinkIdentity links the external identity of an ID token to the
+// authenticated user. Unlike the id_token grant, the identity is never
+// matched to a user by its email address.
+func (a *API) LinkIdentity(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.db.WithContext(ctx)
+	config := a.config
+
+	user := getUser(ctx)
+	if user.IsAnonymous {
+		return forbiddenError("Anonymous users can't link identities, sign in with the identity instead")
+	}
+
+	params := &IdTokenGrantParams{}
+
+	body, err := getBodyBytes(r)
+	if err != nil {
+		return badRequestError("Could not read body").WithInternalError(err)
+	}
+
+	if err := json.Unmarshal(body, params); err != nil {
+		return badRequestError("Could not read identity link params: %v", err)
+	}
+
+	idToken, userData, providerType, _, err := a.verifyIdToken(ctx, w, r, params)
+	if err != nil {
+		return err
+	}
+
+	_, storedIdentityData := a.identityDataFromUserData(userData, config.External.OAuthProvider(providerType))
+
+	err = db.Transaction(func(tx *storage.Connection) error {
+		identity, terr := models.FindIdentityByIdAndProvider(tx, userData.Metadata.Subject, providerType)
+		if terr == nil {
+			if identity.UserID == user.ID {
+				return unprocessableEntityError("Identity is already linked to this user")
+			}
+
+			return unprocessableEntityError("Identity is already linked to another user")
+		} else if !models.IsNotFoundError(terr) {
+			return internalServerError("Database error finding identity").WithInternalError(terr)
+		}
+
+		if exceeded, terr := a.identityLimitExceeded(tx, user); terr != nil {
+			return terr
+		} else if exceeded {
+			return identityLimitExceededError(config.External.MaxIdentitiesPerUser)
+		}
+
+		if _, terr := a.createNewIdentity(tx, user, providerType, storedIdentityData); terr != nil {
+			return terr
+		}
+
+		if terr := user.UpdateAppMetaDataProviders(tx); terr != nil {
+			return internalServerError("Error updating user").WithInternalError(terr)
+		}
+
+		return models.NewAuditLogEntry(r, tx, user, models.IdentityLinkedAction, "", map[string]interface{}{
+			"provider": providerType,
+			"issuer":   idToken.Issuer,
+			"subject":  idToken.Subject,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	user, err = models.FindUserByID(db, user.ID)
+	if err != nil {
+		return internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, user)
+}
+
+// identityLimitExceeded reports whether the user already has the maximum
+// number of identities, so that no further identity may be linked to them.
+func (a *API) identityLimitExceeded(tx *storage.Connection, user *models.User) (bool, error) {
+	limit := a.config.External.MaxIdentitiesPerUser
+	if limit == 0 {
+		return false, nil
+	}
+
+	count, err := models.CountIdentitiesByUserID(tx, user.ID)
+	if err != nil {
+		return false, internalServerError("Database error counting identities").WithInternalError(err)
+	}
+
+	return count >= limit, nil
+}
+
+// DeleteIdentity unlinks one of the authenticated user's identities. The
+// last identity is only removed if the user can still sign in with their
+// password, email address or phone number.
+func (a *API) DeleteIdentity(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.db.WithContext(ctx)
+
+	user := getUser(ctx)
+	identityID := chi.URLParam(r, "identity_id")
+	providerType := r.URL.Query().Get("provider")
+
+	err := db.Transaction(func(tx *storage.Connection) error {
+		identities, terr := models.FindIdentitiesByUserID(tx, user.ID)
+		if terr != nil {
+			return internalServerError("Database error finding identities").WithInternalError(terr)
+		}
+
+		identity, terr := matchIdentity(identities, identityID, providerType)
+		if terr != nil {
+			return terr
+		}
+
+		if len(identities) == 1 && user.EncryptedPassword == "" && user.GetEmail() == "" && user.GetPhone() == "" {
+			return unprocessableEntityError("User must have at least one other way to sign in to unlink this identity")
+		}
+
+		if terr := identity.Delete(tx); terr != nil {
+			return internalServerError("Database error deleting identity").WithInternalError(terr)
+		}
+
+		if terr := user.UpdateAppMetaDataProviders(tx); terr != nil {
+			return internalServerError("Error updating user").WithInternalError(terr)
+		}
+
+		if user.AppMetaData["provider"] == identity.Provider {
+			providers, _ := user.AppMetaData["providers"].([]string)
+
+			var provider interface{}
+			if len(providers) > 0 {
+				provider = providers[0]
+			}
+
+			if terr := user.UpdateAppMetaData(tx, map[string]interface{}{"provider": provider}); terr != nil {
+				return internalServerError("Error updating user").WithInternalError(terr)
+			}
+		}
+
+		return models.NewAuditLogEntry(r, tx, user, models.IdentityUnlinkedAction, "", map[string]interface{}{
+			"provider": identity.Provider,
+			"subject":  identity.ID,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// matchIdentity returns the identity with the id, and the provider if it's
+// not empty, among the user's identities.
+func matchIdentity(identities []*models.Identity, identityID, providerType string) (*models.Identity, error) {
+	var matches []*models.Identity
+	for _, identity := range identities {
+		if identity.ID == identityID && (providerType == "" || identity.Provider == providerType) {
+			matches = append(matches, identity)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, notFoundError("Identity not found")
+	} else if len(matches) > 1 {
+		return nil, badRequestError("Identity id is used by more than one provider, the provider query parameter is required")
+	}
+
+	return matches[0], nil
+}
+
+// ProviderTokenResponse is the provider access token returned by
+// ProviderToken.
+type ProviderTokenResponse struct {
+	ProviderToken string `json:"provider_token"`
+	ExpiresAt     int64  `json:"expires_at,omitempty"`
+}
+
+// tokenSourceProvider is implemented by the OAuth providers that can
+// refresh their access tokens, i.e. those embedding an oauth2.Config.
+type tokenSourceProvider interface {
+	TokenSource(context.Context, *oauth2.Token) oauth2.TokenSource
+}
+
+// ProviderToken returns a fresh provider access token for one of the
+// authenticated user's identities, obtained with the provider refresh token
+// stored when the user signed in with the provider.
+func (a *API) ProviderToken(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.db.WithContext(ctx)
+	config := a.config
+
+	user := getUser(ctx)
+	identityID := chi.URLParam(r, "identity_id")
+	providerType := r.URL.Query().Get("provider")
+
+	key, err := config.External.ProviderTokenKey()
+	if err != nil {
+		return internalServerError("Invalid provider token encryption key").WithInternalError(err)
+	} else if key == nil {
+		return unprocessableEntityError("Provider refresh tokens are not stored")
+	}
+
+	identities, err := models.FindIdentitiesByUserID(db, user.ID)
+	if err != nil {
+		return internalServerError("Database error finding identities").WithInternalError(err)
+	}
+
+	identity, err := matchIdentity(identities, identityID, providerType)
+	if err != nil {
+		return err
+	}
+
+	if identity.ProviderRefreshToken == nil {
+		return unprocessableEntityError("Identity has no provider refresh token")
+	}
+
+	refreshToken, err := crypto.DecryptString(key, *identity.ProviderRefreshToken)
+	if err != nil {
+		return internalServerError("Error decrypting provider refresh token").WithInternalError(err)
+	}
+
+	oAuthProvider, err := a.OAuthProvider(ctx, identity.Provider)
+	if err != nil {
+		return badRequestError("Unsupported provider: %+v", err).WithInternalError(err)
+	}
+
+	refresher, ok := oAuthProvider.(tokenSourceProvider)
+	if !ok {
+		return badRequestError("Provider %s does not support refreshing tokens", identity.Provider)
+	}
+
+	token, err := refresher.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		if !isRevokedRefreshTokenError(err) {
+			return internalServerError("Error refreshing provider token").WithInternalError(err)
+		}
+
+		if terr := identity.SetProviderRefreshToken(db, nil); terr != nil {
+			return internalServerError("Database error clearing provider refresh token").WithInternalError(terr)
+		}
+
+		return providerTokenRevokedError().WithInternalError(err)
+	}
+
+	// providers rotating refresh tokens return a new one
+	if token.RefreshToken != "" && token.RefreshToken != refreshToken {
+		if err := a.setProviderRefreshToken(db, identity, key, token.RefreshToken); err != nil {
+			return err
+		}
+	}
+
+	response := &ProviderTokenResponse{
+		ProviderToken: token.AccessToken,
+	}
+	if !token.Expiry.IsZero() {
+		response.ExpiresAt = token.Expiry.Unix()
+	}
+
+	return sendJSON(w, http.StatusOK, response)
+}
+
+// storeProviderRefreshToken stores the refresh token issued by the provider
+// on the identity of the user data, if provider refresh tokens are stored.
+func (a *API) storeProviderRefreshToken(tx *storage.Connection, providerType string, userData *provider.UserProvidedData, refreshToken string) error {
+	if refreshToken == "" || userData == nil || userData.Metadata == nil {
+		return nil
+	}
+
+	key, err := a.config.External.ProviderTokenKey()
+	if err != nil {
+		return internalServerError("Invalid provider token encryption key").WithInternalError(err)
+	} else if key == nil {
+		return nil
+	}
+
+	identity, err := models.FindIdentityByIdAndProvider(tx, userData.Metadata.Subject, providerType)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil
+		}
+		return internalServerError("Database error finding identity").WithInternalError(err)
+	}
+
+	return a.setProviderRefreshToken(tx, identity, key, refreshToken)
+}
+
+func (a *API) setProviderRefreshToken(tx *storage.Connection, identity *models.Identity, key []byte, refreshToken string) error {
+	encrypted, err := crypto.EncryptString(key, refreshToken)
+	if err != nil {
+		return internalServerError("Error encrypting provider refresh token").WithInternalError(err)
+	}
+
+	if err := identity.SetProviderRefreshToken(tx, &encrypted); err != nil {
+		return internalServerError("Database error storing provider refresh token").WithInternalError(err)
+	}
+
+	return nil
+}
+
+// isRevokedRefreshTokenError reports whether the provider's token endpoint
+// rejected the refresh token with an invalid_grant error, which is how
+// revoked and expired refresh tokens are reported.
+func isRevokedRefreshTokenError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(retrieveErr.Body, &body) == nil {
+		return body.Error == "invalid_grant"
+	}
+
+	// some providers respond with form encoded errors
+	values, err := url.ParseQuery(string(retrieveErr.Body))
+	if err != nil {
+		return false
+	}
+
+	return values.Get("error") == "invalid_grant"
+}
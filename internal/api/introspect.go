@@ -0,0 +1,208 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang-jwt/jwt"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// IntrospectionResponse is the response of the token introspection endpoint,
+// as defined by RFC 7662. Only Active is set for inactive tokens.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Role      string `json:"role,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// introspectedClaims are the claims of access tokens reported by the
+// introspection endpoint. The scope claim is never set by GoTrue itself, but
+// may be added by the custom access token hook.
+type introspectedClaims struct {
+	GoTrueClaims
+	Scope string `json:"scope"`
+}
+
+// Introspect reports whether an access or refresh token is active, as defined
+// by RFC 7662. Tokens are inactive if they are expired, badly signed or
+// unknown, or if their session has been revoked or has expired. Resource
+// servers authenticate with the credentials of an introspection client, with
+// HTTP Basic authentication or the client_id and client_secret parameters.
+func (a *API) Introspect(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.config
+
+	if !config.Introspection.Enabled {
+		return notFoundError("Token introspection is disabled")
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return oauthError("invalid_request", "Could not parse introspection request").WithInternalError(err)
+	}
+
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	if !a.isIntrospectionClient(clientID, secret) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		return &OAuthError{Err: "invalid_client", Description: "Invalid client credentials", Code: http.StatusUnauthorized}
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		return oauthError("invalid_request", "token required")
+	}
+
+	db := a.db.WithContext(ctx)
+
+	introspectors := []func(*storage.Connection, string) (*IntrospectionResponse, error){
+		a.introspectAccessToken,
+		a.introspectRefreshToken,
+	}
+	if r.PostForm.Get("token_type_hint") == "refresh_token" {
+		introspectors[0], introspectors[1] = introspectors[1], introspectors[0]
+	}
+
+	for _, introspect := range introspectors {
+		response, err := introspect(db, token)
+		if err != nil {
+			return err
+		}
+		if response != nil {
+			return sendJSON(w, http.StatusOK, response)
+		}
+	}
+
+	return sendJSON(w, http.StatusOK, &IntrospectionResponse{Active: false})
+}
+
+func (a *API) isIntrospectionClient(clientID, secret string) bool {
+	expected, ok := a.config.Introspection.Clients[clientID]
+	return ok && clientID != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1
+}
+
+// introspectAccessToken returns the introspection response of an active
+// access token, or nil if the token isn't one.
+func (a *API) introspectAccessToken(db *storage.Connection, token string) (*IntrospectionResponse, error) {
+	config := a.config
+
+	claims := &introspectedClaims{}
+	p := jwt.Parser{ValidMethods: jwtValidMethods}
+	if _, err := p.ParseWithClaims(token, claims, jwtVerificationKey(&config.JWT, a.now())); err != nil {
+		return nil, nil
+	}
+
+	userID, err := uuid.FromString(claims.Subject)
+	if err != nil {
+		return nil, nil
+	}
+
+	var sessionID *uuid.UUID
+	if claims.SessionId != "" && claims.SessionId != uuid.Nil.String() {
+		id, err := uuid.FromString(claims.SessionId)
+		if err != nil {
+			return nil, nil
+		}
+		sessionID = &id
+	}
+
+	if active, err := a.isUserSessionActive(db, userID, sessionID); err != nil || !active {
+		return nil, err
+	}
+
+	return &IntrospectionResponse{
+		Active:    true,
+		Scope:     claims.Scope,
+		TokenType: "bearer",
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		Role:      claims.Role,
+		SessionID: claims.SessionId,
+	}, nil
+}
+
+// introspectRefreshToken returns the introspection response of an active
+// refresh token, or nil if the token isn't one.
+func (a *API) introspectRefreshToken(db *storage.Connection, token string) (*IntrospectionResponse, error) {
+	user, refreshToken, _, err := models.FindUserWithRefreshToken(db, token, false)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, internalServerError("Database error finding refresh token").WithInternalError(err)
+	}
+
+	if refreshToken.Revoked {
+		return nil, nil
+	}
+
+	if active, err := a.isUserSessionActive(db, user.ID, refreshToken.SessionId); err != nil || !active {
+		return nil, err
+	}
+
+	response := &IntrospectionResponse{
+		Active:   true,
+		Subject:  user.ID.String(),
+		Audience: user.Aud,
+		Issuer:   a.config.JWT.IssuerForAudience(user.Aud),
+		IssuedAt: refreshToken.CreatedAt.Unix(),
+		Role:     a.config.JWT.RoleForUser(user.Role, user.AppMetaData),
+	}
+	if refreshToken.SessionId != nil {
+		response.SessionID = refreshToken.SessionId.String()
+	}
+
+	return response, nil
+}
+
+// isUserSessionActive reports whether the user exists and isn't deleted or
+// banned and, if a session ID is provided, whether the user's session with
+// that ID exists and hasn't expired.
+func (a *API) isUserSessionActive(db *storage.Connection, userID uuid.UUID, sessionID *uuid.UUID) (bool, error) {
+	config := a.config
+
+	user, err := models.FindUserByID(db, userID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, internalServerError("Database error finding user").WithInternalError(err)
+	}
+
+	if user.IsDeleted() || user.IsBanned() {
+		return false, nil
+	}
+
+	if sessionID == nil {
+		return true, nil
+	}
+
+	session, err := models.FindSessionByID(db, *sessionID, false)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, internalServerError("Database error finding session").WithInternalError(err)
+	}
+
+	if session.UserID != user.ID {
+		return false, nil
+	}
+
+	return session.CheckValidity(a.now(), config.Sessions.Timebox, config.Sessions.InactivityTimeout) == models.SessionValid, nil
+}
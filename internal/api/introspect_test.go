@@ -0,0 +1,192 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func (ts *TokenTestSuite) setupIntrospection() {
+	introspection := ts.Config.Introspection
+	ts.T().Cleanup(func() {
+		ts.Config.Introspection = introspection
+	})
+
+	ts.Config.Introspection.Enabled = true
+	ts.Config.Introspection.Clients = map[string]string{
+		"resource-server": "resource-server-secret",
+	}
+}
+
+func (ts *TokenTestSuite) introspect(params url.Values, clientID, secret string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/introspect", strings.NewReader(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientID != "" {
+		req.SetBasicAuth(clientID, secret)
+	}
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func (ts *TokenTestSuite) introspectToken(token, hint string) *IntrospectionResponse {
+	w := ts.introspect(url.Values{"token": {token}, "token_type_hint": {hint}}, "resource-server", "resource-server-secret")
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	response := &IntrospectionResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(response))
+
+	return response
+}
+
+func (ts *TokenTestSuite) TestIntrospectClientCredentials() {
+	token := ts.tokenGrant("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+
+	w := ts.introspect(url.Values{"token": {token.Token}}, "resource-server", "resource-server-secret")
+	require.Equal(ts.T(), http.StatusNotFound, w.Code, "introspection is disabled by default")
+
+	ts.setupIntrospection()
+
+	for _, example := range []struct {
+		clientID string
+		secret   string
+	}{
+		{"", ""},
+		{"resource-server", "wrong-secret"},
+		{"unknown-server", "resource-server-secret"},
+	} {
+		w = ts.introspect(url.Values{"token": {token.Token}}, example.clientID, example.secret)
+		require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+		require.NotEmpty(ts.T(), w.Header().Get("WWW-Authenticate"))
+
+		oauthError := OAuthError{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&oauthError))
+		require.Equal(ts.T(), "invalid_client", oauthError.Err)
+	}
+
+	// the credentials can also be sent as parameters
+	w = ts.introspect(url.Values{
+		"token":         {token.Token},
+		"client_id":     {"resource-server"},
+		"client_secret": {"resource-server-secret"},
+	}, "", "")
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	w = ts.introspect(url.Values{}, "resource-server", "resource-server-secret")
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *TokenTestSuite) TestIntrospectActiveTokens() {
+	ts.setupIntrospection()
+
+	token := ts.tokenGrant("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+	sessionID := ts.accessTokenSessionID(token)
+
+	response := ts.introspectToken(token.Token, "")
+	require.True(ts.T(), response.Active)
+	require.Equal(ts.T(), "bearer", response.TokenType)
+	require.Equal(ts.T(), ts.User.ID.String(), response.Subject)
+	require.Equal(ts.T(), ts.User.Aud, response.Audience)
+	require.Equal(ts.T(), ts.Config.JWT.RoleForUser(ts.User.Role, ts.User.AppMetaData), response.Role)
+	require.Equal(ts.T(), sessionID, response.SessionID)
+	require.Equal(ts.T(), token.ExpiresAt, response.ExpiresAt)
+	require.Empty(ts.T(), response.Scope)
+
+	// refresh tokens are found with or without the hint
+	for _, hint := range []string{"", "refresh_token"} {
+		response = ts.introspectToken(token.RefreshToken, hint)
+		require.True(ts.T(), response.Active)
+		require.Empty(ts.T(), response.TokenType)
+		require.Equal(ts.T(), ts.User.ID.String(), response.Subject)
+		require.Equal(ts.T(), sessionID, response.SessionID)
+	}
+
+	require.False(ts.T(), ts.introspectToken("not-a-token", "").Active)
+}
+
+func (ts *TokenTestSuite) TestIntrospectExpiredTokens() {
+	ts.setupIntrospection()
+
+	claims := &GoTrueClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   ts.User.ID.String(),
+			Audience:  ts.User.Aud,
+			IssuedAt:  time.Now().Add(-2 * time.Hour).Unix(),
+			ExpiresAt: time.Now().Add(-time.Hour).Unix(),
+		},
+		Role: "authenticated",
+	}
+
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(ts.Config.JWT.Secret))
+	require.NoError(ts.T(), err)
+
+	response := ts.introspectToken(expired, "")
+	require.False(ts.T(), response.Active)
+	require.Empty(ts.T(), response.Subject, "inactive tokens must not be described")
+
+	// tokens signed with another secret are inactive too
+	claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("another-secret"))
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), ts.introspectToken(forged, "").Active)
+
+	// as are tokens whose session expired
+	token := ts.tokenGrant("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+
+	timebox := ts.Config.Sessions.Timebox
+	defer func() {
+		ts.Config.Sessions.Timebox = timebox
+	}()
+
+	ts.Config.Sessions.Timebox = time.Nanosecond
+	require.False(ts.T(), ts.introspectToken(token.Token, "").Active)
+	require.False(ts.T(), ts.introspectToken(token.RefreshToken, "refresh_token").Active)
+}
+
+func (ts *TokenTestSuite) TestIntrospectRevokedSession() {
+	ts.setupIntrospection()
+
+	token := ts.tokenGrant("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+
+	// rotated refresh tokens are revoked, but the session isn't
+	refreshed := ts.tokenGrant("refresh_token", map[string]interface{}{
+		"refresh_token": token.RefreshToken,
+	})
+	require.False(ts.T(), ts.introspectToken(token.RefreshToken, "refresh_token").Active)
+	require.True(ts.T(), ts.introspectToken(token.Token, "").Active)
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+refreshed.Token)
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusNoContent, w.Code)
+
+	// the access tokens haven't expired yet, but their session is gone
+	for _, accessToken := range []string{token.Token, refreshed.Token} {
+		response := ts.introspectToken(accessToken, "")
+		require.False(ts.T(), response.Active)
+		require.Empty(ts.T(), response.SessionID)
+	}
+
+	require.False(ts.T(), ts.introspectToken(refreshed.RefreshToken, "refresh_token").Active)
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/supabase/gotrue/internal/conf"
+)
+
+// JSONWebKey is a public key in the JWK format (RFC 7517)
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Use       string `json:"use,omitempty"`
+}
+
+// JSONWebKeySet is the response of the JWKS endpoint
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS publishes the public keys that verify access tokens: the signing
+// key's and those of retired keys that haven't expired. Access tokens signed
+// with the HS256 secret can't be verified with a public key, so no keys are
+// published for them.
+func (a *API) JWKS(w http.ResponseWriter, r *http.Request) error {
+	config := a.config
+
+	keys := []JSONWebKey{}
+	for _, publicKey := range config.JWT.PublicKeys(a.now()) {
+		keys = append(keys, ed25519JSONWebKey(publicKey.Key, publicKey.KeyID))
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=600")
+	return sendJSON(w, http.StatusOK, &JSONWebKeySet{Keys: keys})
+}
+
+func ed25519JSONWebKey(publicKey ed25519.PublicKey, keyID string) JSONWebKey {
+	return JSONWebKey{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(publicKey),
+		KeyID:     keyID,
+		Algorithm: conf.JWTAlgorithmEdDSA,
+		Use:       "sig",
+	}
+}
+
+// jwtSigningMethodAndKey returns the signing method and key of access tokens
+func jwtSigningMethodAndKey(config *conf.JWTConfiguration) (jwt.SigningMethod, interface{}) {
+	if config.Algorithm == conf.JWTAlgorithmEdDSA {
+		return jwt.SigningMethodEdDSA, config.SigningKey
+	}
+
+	return jwt.SigningMethodHS256, []byte(config.Secret)
+}
+
+// jwtValidMethods are the signing methods accepted for access tokens. HS256
+// is always accepted, as the service role and anon keys are signed with the
+// secret.
+var jwtValidMethods = []string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+
+// jwtVerificationKey returns a jwt.Keyfunc that picks the key verifying an
+// access token by its signing method, so that an HS256 token can never be
+// verified with a public key. EdDSA tokens are verified with the public key
+// of their kid header, which may be a retired key that hasn't expired at the
+// provided time.
+func jwtVerificationKey(config *conf.JWTConfiguration, now time.Time) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.Alg() {
+		case jwt.SigningMethodHS256.Alg():
+			return []byte(config.Secret), nil
+
+		case jwt.SigningMethodEdDSA.Alg():
+			keyID, _ := token.Header["kid"].(string)
+
+			for _, publicKey := range config.PublicKeys(now) {
+				if publicKey.KeyID == keyID {
+					return publicKey.Key, nil
+				}
+			}
+
+			return nil, fmt.Errorf("unknown key ID %q", keyID)
+		}
+
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+type JWKSTestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.GlobalConfiguration
+
+	PublicKey ed25519.PublicKey
+}
+
+func TestJWKS(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	encoded, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+
+	api, config, err := setupAPIForTestWithCallback(func(config *conf.GlobalConfiguration, conn *storage.Connection) {
+		if config != nil {
+			config.JWT.Algorithm = conf.JWTAlgorithmEdDSA
+			config.JWT.PrivateKey = base64.StdEncoding.EncodeToString(encoded)
+			config.JWT.KeyID = ""
+			require.NoError(t, config.JWT.Validate())
+			require.NoError(t, config.JWT.PopulateFields())
+		}
+	})
+	require.NoError(t, err)
+
+	ts := &JWKSTestSuite{
+		API:       api,
+		Config:    config,
+		PublicKey: publicKey,
+	}
+	defer api.db.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *JWKSTestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+}
+
+func (ts *JWKSTestSuite) jwks() JSONWebKeySet {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/.well-known/jwks.json", nil)
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusOK, w.Code)
+
+	var jwks JSONWebKeySet
+	ts.Require().NoError(json.NewDecoder(w.Body).Decode(&jwks))
+
+	return jwks
+}
+
+func (ts *JWKSTestSuite) TestEdDSAAccessToken() {
+	jwks := ts.jwks()
+	ts.Require().Len(jwks.Keys, 1)
+
+	jwk := jwks.Keys[0]
+	ts.Require().Equal("OKP", jwk.KeyType)
+	ts.Require().Equal("Ed25519", jwk.Curve)
+	ts.Require().Equal("EdDSA", jwk.Algorithm)
+	ts.Require().Equal("sig", jwk.Use)
+	ts.Require().Equal(conf.Ed25519KeyThumbprint(ts.PublicKey), jwk.KeyID)
+
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	ts.Require().NoError(err)
+	ts.Require().Equal([]byte(ts.PublicKey), x)
+
+	user, err := models.NewUser("", "test@example.com", "password", ts.Config.JWT.Aud, nil)
+	ts.Require().NoError(err)
+	ts.Require().NoError(ts.API.db.Create(user))
+
+	signed, _, err := generateAccessToken(ts.API.db, user, nil, &ts.Config.JWT)
+	ts.Require().NoError(err)
+
+	// the token verifies with the published key only
+	claims := &GoTrueClaims{}
+	token, err := jwt.ParseWithClaims(signed, claims, func(token *jwt.Token) (interface{}, error) {
+		ts.Require().Equal(jwk.KeyID, token.Header["kid"])
+
+		for _, key := range jwks.Keys {
+			if key.KeyID == token.Header["kid"] {
+				x, err := base64.RawURLEncoding.DecodeString(key.X)
+				return ed25519.PublicKey(x), err
+			}
+		}
+
+		return nil, fmt.Errorf("unknown key %v", token.Header["kid"])
+	})
+	ts.Require().NoError(err)
+	ts.Require().Equal("EdDSA", token.Header["alg"])
+	ts.Require().Equal(user.ID.String(), claims.Subject)
+
+	_, err = jwt.ParseWithClaims(signed, &GoTrueClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return []byte(ts.Config.JWT.Secret), nil
+	})
+	ts.Require().Error(err)
+
+	// EdDSA and HS256 signed tokens are both accepted
+	hs256Config := ts.Config.JWT
+	hs256Config.Algorithm = conf.JWTAlgorithmHS256
+
+	hs256Signed, _, err := generateAccessToken(ts.API.db, user, nil, &hs256Config)
+	ts.Require().NoError(err)
+
+	for _, accessToken := range []string{signed, hs256Signed} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/user", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		ts.Require().Equal(http.StatusOK, w.Code)
+	}
+
+	// tokens signed with other keys are rejected
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	ts.Require().NoError(err)
+
+	otherConfig := ts.Config.JWT
+	otherConfig.SigningKey = otherKey
+
+	otherSigned, _, err := generateAccessToken(ts.API.db, user, nil, &otherConfig)
+	ts.Require().NoError(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/user", nil)
+	req.Header.Set("Authorization", "Bearer "+otherSigned)
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	ts.Require().Equal(http.StatusUnauthorized, w.Code)
+}
+
+func (ts *JWKSTestSuite) getUser(accessToken string) int {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/user", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+
+	return w.Code
+}
+
+func (ts *JWKSTestSuite) TestKeyRotation() {
+	previousJWT := ts.Config.JWT
+	defer func() {
+		ts.Config.JWT = previousJWT
+		ts.API.now = time.Now
+	}()
+
+	user, err := models.NewUser("", "test@example.com", "password", ts.Config.JWT.Aud, nil)
+	ts.Require().NoError(err)
+	ts.Require().NoError(ts.API.db.Create(user))
+
+	oldSigned, _, err := generateAccessToken(ts.API.db, user, nil, &ts.Config.JWT)
+	ts.Require().NoError(err)
+
+	// rotate to a new signing key, retiring the old one for an hour
+	_, newPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	ts.Require().NoError(err)
+
+	encodedPrivateKey, err := x509.MarshalPKCS8PrivateKey(newPrivateKey)
+	ts.Require().NoError(err)
+
+	encodedPublicKey, err := x509.MarshalPKIXPublicKey(ts.PublicKey)
+	ts.Require().NoError(err)
+
+	now := time.Now()
+	ts.API.now = func() time.Time {
+		return now
+	}
+
+	ts.Config.JWT.PrivateKey = base64.StdEncoding.EncodeToString(encodedPrivateKey)
+	ts.Config.JWT.KeyID = ""
+	ts.Config.JWT.RetiredKeys = conf.JWTRetiredKeys{
+		{
+			PublicKey: base64.StdEncoding.EncodeToString(encodedPublicKey),
+			ExpiresAt: now.Add(time.Hour),
+		},
+	}
+	ts.Require().NoError(ts.Config.JWT.Validate())
+	ts.Require().NoError(ts.Config.JWT.PopulateFields())
+
+	oldKeyID := conf.Ed25519KeyThumbprint(ts.PublicKey)
+	newKeyID := conf.Ed25519KeyThumbprint(newPrivateKey.Public().(ed25519.PublicKey))
+	ts.Require().Equal(newKeyID, ts.Config.JWT.KeyID)
+	ts.Require().Equal(oldKeyID, ts.Config.JWT.RetiredKeys[0].KeyID)
+
+	newSigned, _, err := generateAccessToken(ts.API.db, user, nil, &ts.Config.JWT)
+	ts.Require().NoError(err)
+
+	token, _, err := new(jwt.Parser).ParseUnverified(newSigned, &GoTrueClaims{})
+	ts.Require().NoError(err)
+	ts.Require().Equal(newKeyID, token.Header["kid"])
+
+	// both keys are published and verify tokens during the overlap
+	jwks := ts.jwks()
+	ts.Require().Len(jwks.Keys, 2)
+	ts.Require().Equal(newKeyID, jwks.Keys[0].KeyID)
+	ts.Require().Equal(oldKeyID, jwks.Keys[1].KeyID)
+
+	ts.Require().Equal(http.StatusOK, ts.getUser(oldSigned))
+	ts.Require().Equal(http.StatusOK, ts.getUser(newSigned))
+
+	// once the retired key expires, only the new key remains
+	now = now.Add(time.Hour)
+
+	jwks = ts.jwks()
+	ts.Require().Len(jwks.Keys, 1)
+	ts.Require().Equal(newKeyID, jwks.Keys[0].KeyID)
+
+	ts.Require().Equal(http.StatusUnauthorized, ts.getUser(oldSigned))
+	ts.Require().Equal(http.StatusOK, ts.getUser(newSigned))
+}
+
+func TestJWKSWithoutAsymmetricKeys(t *testing.T) {
+	api, _, err := setupAPIForTest()
+	require.NoError(t, err)
+	defer api.db.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/.well-known/jwks.json", nil)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"keys":[]}`, w.Body.String())
+}
@@ -1,11 +1,15 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
+	"github.com/supabase/gotrue/internal/api/provider"
 	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/observability"
 	"github.com/supabase/gotrue/internal/storage"
+	"github.com/supabase/gotrue/internal/utilities"
 )
 
 type LogoutBehavior string
@@ -18,6 +22,115 @@ const (
 
 // Logout is the endpoint for logging out a user and thereby revoking any refresh tokens
 func (a *API) Logout(w http.ResponseWriter, r *http.Request) error {
+	if err := a.logout(w, r); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// OIDCLogoutParams are the parameters the OIDC logout endpoint accepts
+type OIDCLogoutParams struct {
+	IdTokenHint string `json:"id_token_hint"`
+}
+
+// OIDCLogoutResponse is the response of the OIDC logout endpoint when the
+// user's session with the OIDC provider can be ended as well
+type OIDCLogoutResponse struct {
+	LogoutURL string `json:"logout_url"`
+}
+
+// LogoutOIDC is the endpoint for logging out a user like Logout, which
+// additionally returns the URL to end the user's session with the OIDC
+// provider they last signed in with (RP-initiated logout). Users that did not
+// sign in with an OIDC provider advertising an end_session_endpoint are only
+// logged out.
+func (a *API) LogoutOIDC(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	params := &OIDCLogoutParams{}
+
+	body, err := getBodyBytes(r)
+	if err != nil {
+		return badRequestError("Could not read body").WithInternalError(err)
+	}
+
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, params); err != nil {
+			return badRequestError("Could not read logout params: %v", err)
+		}
+	}
+
+	logoutURL := a.oidcLogoutURL(r, getUser(ctx), params.IdTokenHint)
+
+	if err := a.logout(w, r); err != nil {
+		return err
+	}
+
+	if logoutURL == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return sendJSON(w, http.StatusOK, &OIDCLogoutResponse{
+		LogoutURL: logoutURL,
+	})
+}
+
+// oidcLogoutURL returns the end_session_endpoint URL of the OIDC provider the
+// user last signed in with, or an empty string if there is none. Failures to
+// discover the provider are only logged, as they must not prevent the user
+// from being logged out.
+func (a *API) oidcLogoutURL(r *http.Request, u *models.User, idTokenHint string) string {
+	ctx := r.Context()
+	log := observability.GetLogEntry(r)
+	config := a.config
+
+	var identity *models.Identity
+	for i := range u.Identities {
+		candidate := &u.Identities[i]
+		if candidate.IsForSSOProvider() {
+			continue
+		}
+
+		if issuer, ok := candidate.IdentityData["iss"].(string); !ok || issuer == "" {
+			continue
+		}
+
+		if identity == nil || (candidate.LastSignInAt != nil && (identity.LastSignInAt == nil || candidate.LastSignInAt.After(*identity.LastSignInAt))) {
+			identity = candidate
+		}
+	}
+
+	if identity == nil {
+		return ""
+	}
+
+	issuer := identity.IdentityData["iss"].(string)
+
+	oidcProvider, err := a.oidcProviders.Get(ctx, issuer)
+	if err != nil {
+		log.WithError(err).WithField("issuer", issuer).Warn("Unable to discover OIDC provider for logout")
+		return ""
+	}
+
+	var clientID string
+	if oauthConfig := config.External.OAuthProvider(identity.Provider); oauthConfig != nil && len(oauthConfig.ClientID) > 0 {
+		clientID = oauthConfig.ClientID[0]
+	}
+
+	logoutURL, err := provider.EndSessionURL(oidcProvider, idTokenHint, clientID, utilities.GetReferrer(r, config))
+	if err != nil {
+		log.WithError(err).WithField("issuer", issuer).Warn("Unable to construct OIDC provider logout URL")
+		return ""
+	}
+
+	return logoutURL
+}
+
+func (a *API) logout(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	db := a.db.WithContext(ctx)
 	config := a.config
@@ -68,7 +181,6 @@ func (a *API) Logout(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	a.clearCookieTokens(config, w)
-	w.WriteHeader(http.StatusNoContent)
 
 	return nil
 }
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -76,3 +78,58 @@ func (ts *LogoutTestSuite) TestLogoutSuccess() {
 		}
 	}
 }
+
+func (ts *LogoutTestSuite) TestLogoutOIDCWithoutOIDCIdentity() {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/logout/oidc", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusNoContent, w.Code)
+	require.Empty(ts.T(), w.Body.String())
+}
+
+func (ts *LogoutTestSuite) TestLogoutOIDC() {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(ts.T(), json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":               server.URL,
+			"jwks_uri":             server.URL + "/jwks",
+			"end_session_endpoint": server.URL + "/logout",
+		}))
+	}))
+	defer server.Close()
+
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	identity, err := models.NewIdentity(u, "keycloak", map[string]interface{}{
+		"sub": "keycloak-subject",
+		"iss": server.URL,
+	})
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(identity))
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"id_token_hint": "id-token",
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/logout/oidc?redirect_to="+url.QueryEscape("http://localhost:3000/signed-out"), &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	var data OIDCLogoutResponse
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+
+	logoutURL, err := url.Parse(data.LogoutURL)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), server.URL+"/logout", logoutURL.Scheme+"://"+logoutURL.Host+logoutURL.Path)
+	require.Equal(ts.T(), "id-token", logoutURL.Query().Get("id_token_hint"))
+	require.Equal(ts.T(), "http://localhost:3000/signed-out", logoutURL.Query().Get("post_logout_redirect_uri"))
+}
@@ -20,6 +20,7 @@ type MagicLinkParams struct {
 	Data                map[string]interface{} `json:"data"`
 	CodeChallengeMethod string                 `json:"code_challenge_method"`
 	CodeChallenge       string                 `json:"code_challenge"`
+	Locale              string                 `json:"locale"`
 }
 
 func (p *MagicLinkParams) Validate() error {
@@ -34,6 +35,10 @@ func (p *MagicLinkParams) Validate() error {
 	if err := validatePKCEParams(p.CodeChallengeMethod, p.CodeChallenge); err != nil {
 		return err
 	}
+	p.Locale, err = validateLocale(p.Locale)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -80,7 +85,7 @@ func (a *API) MagicLink(w http.ResponseWriter, r *http.Request) error {
 	if isNewUser {
 		// User either doesn't exist or hasn't completed the signup process.
 		// Sign them up with temporary password.
-		password, err := password.Generate(64, 10, 0, false, true)
+		password, err := password.Generate(64, 10, 10, false, true)
 		if err != nil {
 			internalServerError("error creating user").WithInternalError(err)
 		}
@@ -91,6 +96,7 @@ func (a *API) MagicLink(w http.ResponseWriter, r *http.Request) error {
 			Data:                params.Data,
 			CodeChallengeMethod: params.CodeChallengeMethod,
 			CodeChallenge:       params.CodeChallenge,
+			Locale:              params.Locale,
 		}
 		newBodyContent, err := json.Marshal(signUpParams)
 		if err != nil {
@@ -110,6 +116,7 @@ func (a *API) MagicLink(w http.ResponseWriter, r *http.Request) error {
 				Data:                params.Data,
 				CodeChallengeMethod: params.CodeChallengeMethod,
 				CodeChallenge:       params.CodeChallenge,
+				Locale:              params.Locale,
 			}
 			metadata, err := json.Marshal(newBodyContent)
 			if err != nil {
@@ -126,6 +133,12 @@ func (a *API) MagicLink(w http.ResponseWriter, r *http.Request) error {
 		return sendJSON(w, http.StatusOK, make(map[string]string))
 	}
 
+	if params.Locale != "" {
+		// the email is sent in the requested locale, but it is not stored
+		// because we can't be sure of the user's claimed identity
+		user.Locale = params.Locale
+	}
+
 	err = db.Transaction(func(tx *storage.Connection) error {
 		if terr := models.NewAuditLogEntry(r, tx, user, models.UserRecoveryRequestedAction, "", nil); terr != nil {
 			return terr
@@ -63,8 +63,21 @@ func (a *API) GenerateLink(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+
+	// an email_change link confirms the new email address, which is only
+	// enough to change it if secure email change is disabled
+	if params.Type == emailChangeVerification {
+		if config.Mailer.SecureEmailChangeEnabled {
+			return unprocessableEntityError("Secure email change is enabled, generate email_change_current and email_change_new links instead")
+		}
+		params.Type = "email_change_new"
+	}
+
 	referrer := utilities.GetReferrer(r, config)
-	if utilities.IsRedirectURLValid(config, params.RedirectTo) {
+	if params.RedirectTo != "" {
+		if !utilities.IsRedirectURLValid(config, params.RedirectTo) {
+			return invalidRedirectURLError()
+		}
 		referrer = params.RedirectTo
 	}
 
@@ -102,7 +115,8 @@ func (a *API) GenerateLink(w http.ResponseWriter, r *http.Request) error {
 			}
 			user.RecoveryToken = hashedToken
 			user.RecoverySentAt = &now
-			terr = errors.Wrap(tx.UpdateOnly(user, "recovery_token", "recovery_sent_at"), "Database error updating user for recovery")
+			user.EmailOtpAttempts = 0
+			terr = errors.Wrap(tx.UpdateOnly(user, "recovery_token", "recovery_sent_at", "email_otp_attempts"), "Database error updating user for recovery")
 		case inviteVerification:
 			if user != nil {
 				if user.IsConfirmed() {
@@ -137,7 +151,8 @@ func (a *API) GenerateLink(w http.ResponseWriter, r *http.Request) error {
 			user.ConfirmationToken = hashedToken
 			user.ConfirmationSentAt = &now
 			user.InvitedAt = &now
-			terr = errors.Wrap(tx.UpdateOnly(user, "confirmation_token", "confirmation_sent_at", "invited_at"), "Database error updating user for invite")
+			user.EmailOtpAttempts = 0
+			terr = errors.Wrap(tx.UpdateOnly(user, "confirmation_token", "confirmation_sent_at", "invited_at", "email_otp_attempts"), "Database error updating user for invite")
 		case signupVerification:
 			if user != nil {
 				if user.IsConfirmed() {
@@ -175,7 +190,8 @@ func (a *API) GenerateLink(w http.ResponseWriter, r *http.Request) error {
 			}
 			user.ConfirmationToken = hashedToken
 			user.ConfirmationSentAt = &now
-			terr = errors.Wrap(tx.UpdateOnly(user, "confirmation_token", "confirmation_sent_at"), "Database error updating user for confirmation")
+			user.EmailOtpAttempts = 0
+			terr = errors.Wrap(tx.UpdateOnly(user, "confirmation_token", "confirmation_sent_at", "email_otp_attempts"), "Database error updating user for confirmation")
 		case "email_change_current", "email_change_new":
 			if !config.Mailer.SecureEmailChangeEnabled && params.Type == "email_change_current" {
 				return unprocessableEntityError("Enable secure email change to generate link for current email")
@@ -196,9 +212,13 @@ func (a *API) GenerateLink(w http.ResponseWriter, r *http.Request) error {
 			if params.Type == "email_change_current" {
 				user.EmailChangeTokenCurrent = hashedToken
 			} else if params.Type == "email_change_new" {
-				user.EmailChangeTokenNew = crypto.GenerateTokenHash(params.NewEmail, otp)
+				// the token of the new email address is hashed
+				// with that address
+				hashedToken = crypto.GenerateTokenHash(params.NewEmail, otp)
+				user.EmailChangeTokenNew = hashedToken
 			}
-			terr = errors.Wrap(tx.UpdateOnly(user, "email_change_token_current", "email_change_token_new", "email_change", "email_change_sent_at", "email_change_confirm_status"), "Database error updating user for email change")
+			user.EmailOtpAttempts = 0
+			terr = errors.Wrap(tx.UpdateOnly(user, "email_change_token_current", "email_change_token_new", "email_change", "email_change_sent_at", "email_change_confirm_status", "email_otp_attempts"), "Database error updating user for email change")
 		default:
 			return badRequestError("Invalid email action link type requested: %v", params.Type)
 		}
@@ -249,7 +269,8 @@ func sendConfirmation(tx *storage.Connection, u *models.User, mailer mailer.Mail
 		return errors.Wrap(err, "Error sending confirmation email")
 	}
 	u.ConfirmationSentAt = &now
-	return errors.Wrap(tx.UpdateOnly(u, "confirmation_token", "confirmation_sent_at"), "Database error updating user for confirmation")
+	u.EmailOtpAttempts = 0
+	return errors.Wrap(tx.UpdateOnly(u, "confirmation_token", "confirmation_sent_at", "email_otp_attempts"), "Database error updating user for confirmation")
 }
 
 func sendInvite(tx *storage.Connection, u *models.User, mailer mailer.Mailer, referrerURL string, externalURL *url.URL, otpLength int) error {
@@ -267,7 +288,8 @@ func sendInvite(tx *storage.Connection, u *models.User, mailer mailer.Mailer, re
 	}
 	u.InvitedAt = &now
 	u.ConfirmationSentAt = &now
-	return errors.Wrap(tx.UpdateOnly(u, "confirmation_token", "confirmation_sent_at", "invited_at"), "Database error updating user for invite")
+	u.EmailOtpAttempts = 0
+	return errors.Wrap(tx.UpdateOnly(u, "confirmation_token", "confirmation_sent_at", "invited_at", "email_otp_attempts"), "Database error updating user for invite")
 }
 
 func (a *API) sendPasswordRecovery(tx *storage.Connection, u *models.User, mailer mailer.Mailer, maxFrequency time.Duration, referrerURL string, externalURL *url.URL, otpLength int, flowType models.FlowType) error {
@@ -289,7 +311,8 @@ func (a *API) sendPasswordRecovery(tx *storage.Connection, u *models.User, maile
 		return errors.Wrap(err, "Error sending recovery email")
 	}
 	u.RecoverySentAt = &now
-	return errors.Wrap(tx.UpdateOnly(u, "recovery_token", "recovery_sent_at"), "Database error updating user for recovery")
+	u.EmailOtpAttempts = 0
+	return errors.Wrap(tx.UpdateOnly(u, "recovery_token", "recovery_sent_at", "email_otp_attempts"), "Database error updating user for recovery")
 }
 
 func (a *API) sendReauthenticationOtp(tx *storage.Connection, u *models.User, mailer mailer.Mailer, maxFrequency time.Duration, otpLength int) error {
@@ -337,7 +360,8 @@ func (a *API) sendMagicLink(tx *storage.Connection, u *models.User, mailer maile
 		return errors.Wrap(err, "Error sending magic link email")
 	}
 	u.RecoverySentAt = &now
-	return errors.Wrap(tx.UpdateOnly(u, "recovery_token", "recovery_sent_at"), "Database error updating user for recovery")
+	u.EmailOtpAttempts = 0
+	return errors.Wrap(tx.UpdateOnly(u, "recovery_token", "recovery_sent_at", "email_otp_attempts"), "Database error updating user for recovery")
 }
 
 // sendEmailChange sends out an email change token to the new email.
@@ -374,6 +398,7 @@ func (a *API) sendEmailChange(tx *storage.Connection, config *conf.GlobalConfigu
 	}
 
 	u.EmailChangeSentAt = &now
+	u.EmailOtpAttempts = 0
 	return errors.Wrap(tx.UpdateOnly(
 		u,
 		"email_change_token_current",
@@ -381,6 +406,7 @@ func (a *API) sendEmailChange(tx *storage.Connection, config *conf.GlobalConfigu
 		"email_change",
 		"email_change_sent_at",
 		"email_change_confirm_status",
+		"email_otp_attempts",
 	), "Database error updating user for email change")
 }
 
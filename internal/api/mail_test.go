@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/gobwas/glob"
 	"github.com/golang-jwt/jwt"
@@ -176,7 +177,11 @@ func (ts *MailTestSuite) TestGenerateLink() {
 			require.Equal(ts.T(), c.ExpectedResponse["redirect_to"], data["redirect_to"])
 
 			// check if hashed_token matches hash function of email and the raw otp
-			require.Equal(ts.T(), crypto.GenerateTokenHash(c.Body.Email, data["email_otp"].(string)), data["hashed_token"])
+			email := c.Body.Email
+			if c.Body.Type == "email_change_new" {
+				email = c.Body.NewEmail
+			}
+			require.Equal(ts.T(), crypto.GenerateTokenHash(email, data["email_otp"].(string)), data["hashed_token"])
 
 			// check if the host used in the email link matches the initial request host
 			u, err := url.ParseRequestURI(data["action_link"].(string))
@@ -186,6 +191,137 @@ func (ts *MailTestSuite) TestGenerateLink() {
 	}
 }
 
+func (ts *MailTestSuite) TestGenerateLinkVerify() {
+	claims := &GoTrueClaims{
+		Role: "supabase_admin",
+	}
+	adminToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(ts.Config.JWT.Secret))
+	require.NoError(ts.T(), err, "Error generating admin jwt")
+
+	generateLink := func(params GenerateLinkParams) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/admin/generate_link", &buffer)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", adminToken))
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	verify := func(verificationType, tokenHash string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"type":       verificationType,
+			"token_hash": tokenHash,
+		}))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/verify", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	defer func() {
+		ts.Config.Mailer.SecureEmailChangeEnabled = true
+	}()
+
+	cases := []struct {
+		desc       string
+		params     GenerateLinkParams
+		verifyType string
+		email      string
+	}{
+		{
+			desc:       "signup",
+			params:     GenerateLinkParams{Type: "signup", Email: "signup@example.com", Password: "secret123"},
+			verifyType: signupVerification,
+			email:      "signup@example.com",
+		},
+		{
+			desc:       "invite",
+			params:     GenerateLinkParams{Type: "invite", Email: "invite@example.com"},
+			verifyType: inviteVerification,
+			email:      "invite@example.com",
+		},
+		{
+			desc:       "magic link",
+			params:     GenerateLinkParams{Type: "magiclink", Email: "test@example.com"},
+			verifyType: magicLinkVerification,
+			email:      "test@example.com",
+		},
+		{
+			desc:       "magic link for a new user",
+			params:     GenerateLinkParams{Type: "magiclink", Email: "magic@example.com"},
+			verifyType: signupVerification,
+			email:      "magic@example.com",
+		},
+		{
+			desc:       "recovery",
+			params:     GenerateLinkParams{Type: "recovery", Email: "test@example.com"},
+			verifyType: recoveryVerification,
+			email:      "test@example.com",
+		},
+		{
+			desc:       "email change",
+			params:     GenerateLinkParams{Type: "email_change", Email: "test@example.com", NewEmail: "changed@example.com"},
+			verifyType: emailChangeVerification,
+			email:      "changed@example.com",
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			ts.SetupTest()
+			ts.Config.Mailer.SecureEmailChangeEnabled = false
+
+			w := generateLink(c.params)
+			require.Equal(ts.T(), http.StatusOK, w.Code)
+
+			link := GenerateLinkResponse{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&link))
+
+			w = verify(c.verifyType, link.HashedToken)
+			require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+			token := AccessTokenResponse{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&token))
+			require.NotEmpty(ts.T(), token.Token)
+			require.Equal(ts.T(), c.email, token.User.GetEmail())
+			require.True(ts.T(), token.User.IsConfirmed())
+
+			// the token can only be used once
+			w = verify(c.verifyType, link.HashedToken)
+			require.NotEqual(ts.T(), http.StatusOK, w.Code)
+		})
+	}
+
+	ts.Run("expired token", func() {
+		ts.SetupTest()
+
+		w := generateLink(GenerateLinkParams{Type: "recovery", Email: "test@example.com"})
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		link := GenerateLinkResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&link))
+
+		user, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+		require.NoError(ts.T(), err)
+		sentAt := time.Now().Add(-time.Duration(ts.Config.Mailer.OtpExp+1) * time.Second)
+		user.RecoverySentAt = &sentAt
+		require.NoError(ts.T(), ts.API.db.UpdateOnly(user, "recovery_sent_at"))
+
+		w = verify(recoveryVerification, link.HashedToken)
+		require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+	})
+
+	ts.Run("email change with secure email change", func() {
+		ts.SetupTest()
+
+		w := generateLink(GenerateLinkParams{Type: "email_change", Email: "test@example.com", NewEmail: "changed@example.com"})
+		require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+	})
+}
+
 func (ts *MailTestSuite) setURIAllowListMap(uris ...string) {
 	for _, uri := range uris {
 		g := glob.MustCompile(uri, '.', '/')
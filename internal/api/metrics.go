@@ -0,0 +1,55 @@
+package api
+
+import (
+	"context"
+
+	"github.com/supabase/gotrue/internal/observability"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Outcomes of the operations counted by the auth flow metrics.
+const (
+	metricOutcomeSuccess = "success"
+	metricOutcomeFailure = "failure"
+)
+
+var (
+	signupCounter               = observability.ObtainMetricCounter("gotrue_signups", "Number of signup attempts")
+	tokenGrantCounter           = observability.ObtainMetricCounter("gotrue_token_grants", "Number of token grant requests")
+	tokenGrantDuration          = observability.ObtainMetricHistogram("gotrue_token_grant_duration_seconds", "Duration of token grant requests in seconds")
+	providerLoginCounter        = observability.ObtainMetricCounter("gotrue_provider_logins", "Number of sign in attempts with external providers")
+	refreshTokenRotationCounter = observability.ObtainMetricCounter("gotrue_refresh_token_rotations", "Number of refresh token grants by how the refresh token was rotated")
+)
+
+func metricOutcome(err error) attribute.KeyValue {
+	if err != nil {
+		return attribute.String("outcome", metricOutcomeFailure)
+	}
+
+	return attribute.String("outcome", metricOutcomeSuccess)
+}
+
+// metricGrantType keeps arbitrary grant types out of the metric labels.
+func metricGrantType(grantType string) attribute.KeyValue {
+	switch grantType {
+	case "password", "refresh_token", "id_token", "provider_access_token", "pkce", "anonymous":
+		return attribute.String("grant_type", grantType)
+	}
+
+	return attribute.String("grant_type", "unsupported")
+}
+
+// metricProvider keeps arbitrary provider names and OIDC issuers out of the
+// metric labels, as they are controlled by the request. Only the built in
+// OAuth providers are labelled by name.
+func (a *API) metricProvider(providerType string) attribute.KeyValue {
+	if a.config.External.OAuthProvider(providerType) != nil {
+		return attribute.String("provider", providerType)
+	}
+
+	return attribute.String("provider", "other")
+}
+
+func (a *API) recordProviderLogin(ctx context.Context, providerType string, err error) {
+	providerLoginCounter.Add(ctx, 1, a.metricProvider(providerType), metricOutcome(err))
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/models"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// metricRecorder records the measurements of a counter or histogram.
+type metricRecorder struct {
+	mu           sync.Mutex
+	measurements []attribute.Set
+}
+
+func (m *metricRecorder) Add(ctx context.Context, incr int64, attrs ...attribute.KeyValue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := int64(0); i < incr; i++ {
+		m.measurements = append(m.measurements, attribute.NewSet(attrs...))
+	}
+}
+
+func (m *metricRecorder) Record(ctx context.Context, value float64, attrs ...attribute.KeyValue) {
+	m.Add(ctx, 1, attrs...)
+}
+
+// count returns the number of measurements with all the attributes.
+func (m *metricRecorder) count(attrs ...attribute.KeyValue) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, set := range m.measurements {
+		matches := true
+		for _, attr := range attrs {
+			if value, ok := set.Value(attr.Key); !ok || value != attr.Value {
+				matches = false
+			}
+		}
+
+		if matches {
+			count++
+		}
+	}
+
+	return count
+}
+
+type MetricsTestSuite struct {
+	suite.Suite
+	API    *API
+	Config *conf.GlobalConfiguration
+
+	TokenGrants   *metricRecorder
+	GrantDuration *metricRecorder
+	ProviderLogin *metricRecorder
+	Rotations     *metricRecorder
+}
+
+func TestMetrics(t *testing.T) {
+	api, config, err := setupAPIForTest()
+	require.NoError(t, err)
+
+	ts := &MetricsTestSuite{
+		API:    api,
+		Config: config,
+	}
+	defer api.db.Close()
+
+	suite.Run(t, ts)
+}
+
+func (ts *MetricsTestSuite) SetupTest() {
+	models.TruncateAll(ts.API.db)
+
+	u, err := models.NewUser("", "test@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	now := time.Now()
+	u.EmailConfirmedAt = &now
+	require.NoError(ts.T(), ts.API.db.Create(u))
+
+	ts.TokenGrants = &metricRecorder{}
+	ts.GrantDuration = &metricRecorder{}
+	ts.ProviderLogin = &metricRecorder{}
+	ts.Rotations = &metricRecorder{}
+
+	grants, duration, logins, rotations := tokenGrantCounter, tokenGrantDuration, providerLoginCounter, refreshTokenRotationCounter
+	ts.T().Cleanup(func() {
+		tokenGrantCounter, tokenGrantDuration, providerLoginCounter, refreshTokenRotationCounter = grants, duration, logins, rotations
+	})
+
+	tokenGrantCounter = ts.TokenGrants
+	tokenGrantDuration = ts.GrantDuration
+	providerLoginCounter = ts.ProviderLogin
+	refreshTokenRotationCounter = ts.Rotations
+}
+
+func (ts *MetricsTestSuite) token(grantType string, params map[string]interface{}) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type="+grantType, &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func (ts *MetricsTestSuite) TestTokenGrantMetrics() {
+	w := ts.token("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w = ts.token("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "wrong-password",
+	})
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	w = ts.token("user-1234", nil)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	password := attribute.String("grant_type", "password")
+	success := attribute.String("outcome", "success")
+	failure := attribute.String("outcome", "failure")
+
+	require.Equal(ts.T(), 3, ts.TokenGrants.count())
+	require.Equal(ts.T(), 1, ts.TokenGrants.count(password, success))
+	require.Equal(ts.T(), 1, ts.TokenGrants.count(password, failure))
+	require.Equal(ts.T(), 1, ts.TokenGrants.count(attribute.String("grant_type", "unsupported"), failure))
+	require.Equal(ts.T(), 1, ts.GrantDuration.count(password, success))
+}
+
+func (ts *MetricsTestSuite) TestRefreshTokenRotationMetrics() {
+	w := ts.token("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	token := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+
+	w = ts.token("refresh_token", map[string]interface{}{
+		"refresh_token": token.RefreshToken,
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	require.Equal(ts.T(), 1, ts.Rotations.count(attribute.String("rotation", "rotated")))
+	require.Equal(ts.T(), 1, ts.TokenGrants.count(attribute.String("grant_type", "refresh_token"), attribute.String("outcome", "success")))
+}
+
+func (ts *MetricsTestSuite) TestIdTokenGrantMetrics() {
+	// the provider is not enabled
+	w := ts.token("id_token", map[string]interface{}{
+		"provider": "linkedin_oidc",
+		"id_token": "not-an-id-token",
+	})
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	// request controlled provider names aren't used as labels
+	w = ts.token("id_token", map[string]interface{}{
+		"provider": "user-1234",
+		"id_token": "not-an-id-token",
+	})
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	failure := attribute.String("outcome", "failure")
+
+	require.Equal(ts.T(), 1, ts.ProviderLogin.count(attribute.String("provider", "linkedin_oidc"), failure))
+	require.Equal(ts.T(), 1, ts.ProviderLogin.count(attribute.String("provider", "other"), failure))
+	require.Equal(ts.T(), 2, ts.TokenGrants.count(attribute.String("grant_type", "id_token"), failure))
+}
@@ -2,8 +2,11 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
 
 	"net/url"
 
@@ -16,6 +19,7 @@ import (
 	"github.com/supabase/gotrue/internal/models"
 	"github.com/supabase/gotrue/internal/storage"
 	"github.com/supabase/gotrue/internal/utilities"
+	"github.com/supabase/gotrue/internal/webauthn"
 )
 
 const DefaultQRSize = 3
@@ -32,31 +36,83 @@ type TOTPObject struct {
 	URI    string `json:"uri"`
 }
 
+// WebAuthnObject holds the options to pass to navigator.credentials.create()
+// for unverified factors, or navigator.credentials.get() for verified ones.
+type WebAuthnObject struct {
+	CreationOptions *webauthn.CreationOptions `json:"creation_options,omitempty"`
+	RequestOptions  *webauthn.RequestOptions  `json:"request_options,omitempty"`
+}
+
 type EnrollFactorResponse struct {
-	ID   uuid.UUID  `json:"id"`
-	Type string     `json:"type"`
-	TOTP TOTPObject `json:"totp,omitempty"`
+	ID            uuid.UUID   `json:"id"`
+	Type          string      `json:"type"`
+	TOTP          *TOTPObject `json:"totp,omitempty"`
+	RecoveryCodes []string    `json:"recovery_codes,omitempty"`
 }
 
 type VerifyFactorParams struct {
-	ChallengeID uuid.UUID `json:"challenge_id"`
-	Code        string    `json:"code"`
+	ChallengeID  uuid.UUID                     `json:"challenge_id"`
+	Code         string                        `json:"code"`
+	RecoveryCode string                        `json:"recovery_code"`
+	WebAuthn     *webauthn.PublicKeyCredential `json:"webauthn"`
 }
 
 type ChallengeFactorResponse struct {
-	ID        uuid.UUID `json:"id"`
-	ExpiresAt int64     `json:"expires_at"`
+	ID        uuid.UUID       `json:"id"`
+	ExpiresAt int64           `json:"expires_at"`
+	WebAuthn  *WebAuthnObject `json:"webauthn,omitempty"`
 }
 
 type UnenrollFactorResponse struct {
 	ID uuid.UUID `json:"id"`
 }
 
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
 const (
 	InvalidFactorOwnerErrorMessage = "Factor does not belong to user"
 	QRCodeGenerationErrorMessage   = "Error generating QR Code"
+	WebAuthnDisabledErrorMessage   = "WebAuthn factors are disabled"
+	RecoveryCodesDisabledMessage   = "Recovery codes are disabled"
 )
 
+// requireStepUp returns an mfa_required error unless the user has no verified
+// factor or completed an MFA challenge in the current session within the
+// configured step-up max age.
+func (a *API) requireStepUp(ctx context.Context, db *storage.Connection, user *models.User) error {
+	factors, err := models.FindFactorsByUser(db, user)
+	if err != nil {
+		return internalServerError("Database error finding factors").WithInternalError(err)
+	}
+
+	hasVerifiedFactor := false
+	for _, factor := range factors {
+		if factor.IsVerified() {
+			hasVerifiedFactor = true
+			break
+		}
+	}
+
+	if !hasVerifiedFactor {
+		// users without MFA can't step up
+		return nil
+	}
+
+	session := getSession(ctx)
+	if session == nil || !session.IsAAL2() {
+		return mfaRequiredError("AAL2 session is required for this operation")
+	}
+
+	lastMFAAt := session.LastMFAAt()
+	if lastMFAAt == nil || time.Since(*lastMFAAt) > a.config.MFA.StepUp.MaxAge {
+		return mfaRequiredError("A recent MFA challenge is required for this operation")
+	}
+
+	return nil
+}
+
 func (a *API) EnrollFactor(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	user := getUser(ctx)
@@ -77,8 +133,12 @@ func (a *API) EnrollFactor(w http.ResponseWriter, r *http.Request) error {
 		return unprocessableEntityError("MFA enrollment only supported for non-SSO users at this time")
 	}
 
-	if params.FactorType != models.TOTP {
-		return badRequestError("factor_type needs to be totp")
+	if params.FactorType == models.WebAuthn {
+		if !config.MFA.WebAuthn.Enabled {
+			return badRequestError(WebAuthnDisabledErrorMessage)
+		}
+	} else if params.FactorType != models.TOTP {
+		return badRequestError("factor_type needs to be totp or webauthn")
 	}
 
 	if params.Issuer == "" {
@@ -112,6 +172,22 @@ func (a *API) EnrollFactor(w http.ResponseWriter, r *http.Request) error {
 		return forbiddenError("Maximum number of enrolled factors reached, unenroll to continue")
 	}
 
+	if params.FactorType == models.WebAuthn {
+		// the credential is registered when verifying the factor
+		factor, err := models.NewFactor(user, params.FriendlyName, params.FactorType, models.FactorStateUnverified, "")
+		if err != nil {
+			return internalServerError("database error creating factor").WithInternalError(err)
+		}
+		if _, err := a.createFactor(r, user, factor); err != nil {
+			return err
+		}
+
+		return sendJSON(w, http.StatusOK, &EnrollFactorResponse{
+			ID:   factor.ID,
+			Type: models.WebAuthn,
+		})
+	}
+
 	key, err := totp.Generate(totp.GenerateOpts{
 		Issuer:      issuer,
 		AccountName: user.GetEmail(),
@@ -133,17 +209,7 @@ func (a *API) EnrollFactor(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return internalServerError("database error creating factor").WithInternalError(err)
 	}
-	err = a.db.Transaction(func(tx *storage.Connection) error {
-		if terr := tx.Create(factor); terr != nil {
-			return terr
-		}
-		if terr := models.NewAuditLogEntry(r, tx, user, models.EnrollFactorAction, r.RemoteAddr, map[string]interface{}{
-			"factor_id": factor.ID,
-		}); terr != nil {
-			return terr
-		}
-		return nil
-	})
+	recoveryCodes, err := a.createFactor(r, user, factor)
 	if err != nil {
 		return err
 	}
@@ -151,13 +217,118 @@ func (a *API) EnrollFactor(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, &EnrollFactorResponse{
 		ID:   factor.ID,
 		Type: models.TOTP,
-		TOTP: TOTPObject{
+		TOTP: &TOTPObject{
 			// See: https://css-tricks.com/probably-dont-base64-svg/
 			QRCode: buf.String(),
 			Secret: factor.Secret,
 			URI:    key.URL(),
 		},
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+// createFactor saves a newly enrolled factor, generating the recovery codes
+// of TOTP factors if they are enabled.
+func (a *API) createFactor(r *http.Request, user *models.User, factor *models.Factor) ([]string, error) {
+	var recoveryCodes []string
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if terr = tx.Create(factor); terr != nil {
+			return terr
+		}
+		if terr = models.NewAuditLogEntry(r, tx, user, models.EnrollFactorAction, r.RemoteAddr, map[string]interface{}{
+			"factor_id": factor.ID,
+		}); terr != nil {
+			return terr
+		}
+		if factor.FactorType == models.TOTP && a.config.MFA.RecoveryCodesCount > 0 {
+			if recoveryCodes, terr = models.RegenerateRecoveryCodes(tx, factor, a.config.MFA.RecoveryCodesCount); terr != nil {
+				return terr
+			}
+		}
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// webAuthnRelyingParty returns the relying party that verifies webauthn
+// factor ceremonies.
+func (a *API) webAuthnRelyingParty() *webauthn.RelyingParty {
+	config := a.config.MFA.WebAuthn
+	return &webauthn.RelyingParty{
+		ID:      config.RPID,
+		Name:    config.RPDisplayName,
+		Origins: config.RPOrigins,
+	}
+}
+
+// webAuthnOptions returns the credential options for a challenge of a
+// webauthn factor. The challenge ID, a random UUID, is used as the WebAuthn
+// challenge so that it is bound to the challenge it was issued for.
+func (a *API) webAuthnOptions(user *models.User, factor *models.Factor, challenge *models.Challenge) (*WebAuthnObject, error) {
+	rp := a.webAuthnRelyingParty()
+	timeout := time.Second * time.Duration(a.config.MFA.ChallengeExpiryDuration)
+
+	if !factor.IsVerified() {
+		name := user.GetEmail()
+		if name == "" {
+			name = user.GetPhone()
+		}
+
+		return &WebAuthnObject{
+			CreationOptions: rp.CreationOptions(challenge.ID.Bytes(), webauthn.UserEntity{
+				ID:          user.ID.Bytes(),
+				Name:        name,
+				DisplayName: name,
+			}, timeout),
+		}, nil
+	}
+
+	if factor.WebAuthnCredential == nil {
+		return nil, internalServerError("WebAuthn factor has no registered credential")
+	}
+
+	return &WebAuthnObject{
+		RequestOptions: rp.RequestOptions(challenge.ID.Bytes(), &factor.WebAuthnCredential.Credential, timeout),
+	}, nil
+}
+
+// verifyWebAuthnFactor verifies the registration of an unverified webauthn
+// factor or an assertion of a verified one, returning the credential to
+// store on the factor.
+func (a *API) verifyWebAuthnFactor(factor *models.Factor, challenge *models.Challenge, pkc *webauthn.PublicKeyCredential) (*webauthn.Credential, error) {
+	if pkc == nil {
+		return nil, badRequestError("webauthn credential is required")
+	}
+
+	rp := a.webAuthnRelyingParty()
+
+	if !factor.IsVerified() {
+		credential, err := rp.VerifyRegistration(challenge.ID.Bytes(), pkc)
+		if err != nil {
+			return nil, badRequestError("Invalid WebAuthn credential").WithInternalError(err)
+		}
+		return credential, nil
+	}
+
+	if factor.WebAuthnCredential == nil {
+		return nil, internalServerError("WebAuthn factor has no registered credential")
+	}
+
+	credential := factor.WebAuthnCredential.Credential
+	signCount, err := rp.VerifyAssertion(challenge.ID.Bytes(), &credential, pkc)
+	if err != nil {
+		if errors.Is(err, webauthn.ErrSignCountNotIncreased) {
+			return nil, badRequestError("WebAuthn signature counter did not increase, the authenticator may have been cloned").WithInternalError(err)
+		}
+		return nil, badRequestError("Invalid WebAuthn assertion").WithInternalError(err)
+	}
+	credential.SignCount = signCount
+
+	return &credential, nil
 }
 
 func (a *API) ChallengeFactor(w http.ResponseWriter, r *http.Request) error {
@@ -167,11 +338,23 @@ func (a *API) ChallengeFactor(w http.ResponseWriter, r *http.Request) error {
 	user := getUser(ctx)
 	factor := getFactor(ctx)
 	ipAddress := utilities.GetIPAddress(r)
+
+	if factor.FactorType == models.WebAuthn && !config.MFA.WebAuthn.Enabled {
+		return badRequestError(WebAuthnDisabledErrorMessage)
+	}
+
 	challenge, err := models.NewChallenge(factor, ipAddress)
 	if err != nil {
 		return internalServerError("Database error creating challenge").WithInternalError(err)
 	}
 
+	var webAuthnObject *WebAuthnObject
+	if factor.FactorType == models.WebAuthn {
+		if webAuthnObject, err = a.webAuthnOptions(user, factor, challenge); err != nil {
+			return err
+		}
+	}
+
 	err = a.db.Transaction(func(tx *storage.Connection) error {
 		if terr := tx.Create(challenge); terr != nil {
 			return terr
@@ -191,6 +374,7 @@ func (a *API) ChallengeFactor(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, &ChallengeFactorResponse{
 		ID:        challenge.ID,
 		ExpiresAt: challenge.GetExpiryTime(config.MFA.ChallengeExpiryDuration).Unix(),
+		WebAuthn:  webAuthnObject,
 	})
 }
 
@@ -217,6 +401,10 @@ func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError(InvalidFactorOwnerErrorMessage)
 	}
 
+	if factor.FactorType == models.WebAuthn && !config.MFA.WebAuthn.Enabled {
+		return badRequestError(WebAuthnDisabledErrorMessage)
+	}
+
 	challenge, err := models.FindChallengeByChallengeID(a.db, params.ChallengeID)
 	if err != nil {
 		if models.IsNotFoundError(err) {
@@ -243,7 +431,19 @@ func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("%v has expired, verify against another challenge or create a new challenge.", challenge.ID)
 	}
 
-	if valid := totp.Validate(params.Code, factor.Secret); !valid {
+	authenticationMethod := models.TOTPSignIn
+	var credential *webauthn.Credential
+	if factor.FactorType == models.WebAuthn {
+		authenticationMethod = models.WebAuthnSignIn
+		if credential, err = a.verifyWebAuthnFactor(factor, challenge, params.WebAuthn); err != nil {
+			return err
+		}
+	} else if params.RecoveryCode != "" {
+		// the recovery code is consumed in the transaction below
+		if !factor.IsVerified() {
+			return badRequestError("Recovery codes can only be used with verified factors")
+		}
+	} else if valid := totp.Validate(params.Code, factor.Secret); !valid {
 		return badRequestError("Invalid TOTP code entered")
 	}
 
@@ -251,14 +451,28 @@ func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
 	err = a.db.Transaction(func(tx *storage.Connection) error {
 		var terr error
 		if terr = models.NewAuditLogEntry(r, tx, user, models.VerifyFactorAction, r.RemoteAddr, map[string]interface{}{
-			"factor_id":    factor.ID,
-			"challenge_id": challenge.ID,
+			"factor_id":     factor.ID,
+			"challenge_id":  challenge.ID,
+			"recovery_code": params.RecoveryCode != "",
 		}); terr != nil {
 			return terr
 		}
+		if params.RecoveryCode != "" && factor.FactorType == models.TOTP {
+			if terr = models.ConsumeRecoveryCode(tx, factor, params.RecoveryCode); terr != nil {
+				if models.IsNotFoundError(terr) {
+					return badRequestError("Invalid recovery code entered")
+				}
+				return terr
+			}
+		}
 		if terr = challenge.Verify(tx); terr != nil {
 			return terr
 		}
+		if credential != nil {
+			if terr = factor.UpdateWebAuthnCredential(tx, credential); terr != nil {
+				return terr
+			}
+		}
 		if !factor.IsVerified() {
 			if terr = factor.UpdateStatus(tx, models.FactorStateVerified); terr != nil {
 				return terr
@@ -268,15 +482,12 @@ func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
 		if terr != nil {
 			return terr
 		}
-		token, terr = a.updateMFASessionAndClaims(r, tx, user, models.TOTPSignIn, models.GrantParams{
+		token, terr = a.updateMFASessionAndClaims(r, tx, user, authenticationMethod, models.GrantParams{
 			FactorID: &factor.ID,
 		})
 		if terr != nil {
 			return terr
 		}
-		if terr = a.setCookieTokens(config, token, false, w); terr != nil {
-			return internalServerError("Failed to set JWT cookie. %s", terr)
-		}
 		if terr = models.InvalidateSessionsWithAALLessThan(tx, user.ID, models.AAL2.String()); terr != nil {
 			return internalServerError("Failed to update sessions. %s", terr)
 		}
@@ -288,12 +499,66 @@ func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+
+	// the access token is only set once the transaction is committed
+	if err := a.setCookieTokens(config, token, false, w); err != nil {
+		return internalServerError("Failed to set JWT cookie. %s", err)
+	}
+
 	metering.RecordLogin(string(models.MFACodeLoginAction), user.ID)
 
 	return sendJSON(w, http.StatusOK, token)
 
 }
 
+// RegenerateRecoveryCodes replaces the recovery codes of a TOTP factor,
+// invalidating the previous ones.
+func (a *API) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	factor := getFactor(ctx)
+	session := getSession(ctx)
+	config := a.config
+	if factor == nil || session == nil || user == nil {
+		return internalServerError("A valid session and factor are required to regenerate recovery codes")
+	}
+
+	if !factor.IsOwnedBy(user) {
+		return internalServerError(InvalidFactorOwnerErrorMessage)
+	}
+	if factor.FactorType != models.TOTP {
+		return badRequestError("Recovery codes are only supported for totp factors")
+	}
+	if config.MFA.RecoveryCodesCount <= 0 {
+		return badRequestError(RecoveryCodesDisabledMessage)
+	}
+	if factor.IsVerified() && !session.IsAAL2() {
+		return badRequestError("AAL2 required to regenerate recovery codes of a verified factor")
+	}
+
+	var recoveryCodes []string
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if recoveryCodes, terr = models.RegenerateRecoveryCodes(tx, factor, config.MFA.RecoveryCodesCount); terr != nil {
+			return terr
+		}
+		if terr = models.NewAuditLogEntry(r, tx, user, models.GenerateRecoveryCodesAction, r.RemoteAddr, map[string]interface{}{
+			"factor_id":  factor.ID,
+			"session_id": session.ID,
+		}); terr != nil {
+			return terr
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, &RecoveryCodesResponse{
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
 func (a *API) UnenrollFactor(w http.ResponseWriter, r *http.Request) error {
 	var err error
 	ctx := r.Context()
@@ -3,6 +3,12 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -11,10 +17,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gofrs/uuid"
 	"github.com/pquerna/otp"
 	"github.com/supabase/gotrue/internal/conf"
 	"github.com/supabase/gotrue/internal/models"
 	"github.com/supabase/gotrue/internal/utilities"
+	"github.com/supabase/gotrue/internal/webauthn"
 
 	"github.com/jackc/pgx/v4"
 
@@ -434,6 +442,62 @@ func (ts *MFATestSuite) TestMFAFollowedByPasswordSignIn() {
 	require.True(ts.T(), session.IsAAL2())
 }
 
+func (ts *MFATestSuite) TestTokenResponseAssurance() {
+	email := "test1@example.com"
+	password := "test123"
+
+	token := func(grantType string, params map[string]interface{}) *AccessTokenResponse {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type="+grantType, &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		data := &AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+		return data
+	}
+
+	// users without factors
+	signUpResp := signUp(ts, email, password)
+	require.Equal(ts.T(), models.AAL1.String(), signUpResp.AAL)
+	require.NotNil(ts.T(), signUpResp.EnrolledFactors)
+	require.Empty(ts.T(), signUpResp.EnrolledFactors)
+
+	// verifying a factor upgrades the session
+	verifyResp := enrollAndVerify(ts, signUpResp.User, signUpResp.Token)
+	require.Equal(ts.T(), models.AAL2.String(), verifyResp.AAL)
+	require.Equal(ts.T(), []string{models.TOTP}, verifyResp.EnrolledFactors)
+
+	refreshResp := token("refresh_token", map[string]interface{}{
+		"refresh_token": verifyResp.RefreshToken,
+	})
+	require.Equal(ts.T(), models.AAL2.String(), refreshResp.AAL)
+	require.Equal(ts.T(), []string{models.TOTP}, refreshResp.EnrolledFactors)
+
+	// new sign ins need to be upgraded with the enrolled factor
+	passwordResp := token("password", map[string]interface{}{
+		"email":    email,
+		"password": password,
+	})
+	require.Equal(ts.T(), models.AAL1.String(), passwordResp.AAL)
+	require.Equal(ts.T(), []string{models.TOTP}, passwordResp.EnrolledFactors)
+
+	// unverified factors aren't enrolled
+	factor, err := models.NewFactor(signUpResp.User, "unverified", models.WebAuthn, models.FactorStateUnverified, "")
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(factor))
+
+	passwordResp = token("password", map[string]interface{}{
+		"email":    email,
+		"password": password,
+	})
+	require.Equal(ts.T(), []string{models.TOTP}, passwordResp.EnrolledFactors)
+}
+
 func signUp(ts *MFATestSuite, email, password string) (signUpResp AccessTokenResponse) {
 	var buffer bytes.Buffer
 
@@ -520,3 +584,370 @@ func enrollAndVerify(ts *MFATestSuite, user *models.User, token string) (verifyR
 	require.NoError(ts.T(), json.NewDecoder(y.Body).Decode(&verifyResp))
 	return verifyResp
 }
+
+func (ts *MFATestSuite) TestWebAuthnFactor() {
+	webAuthnConfig := ts.Config.MFA.WebAuthn
+	defer func() {
+		ts.Config.MFA.WebAuthn = webAuthnConfig
+	}()
+	ts.Config.MFA.WebAuthn = conf.WebAuthnConfiguration{
+		Enabled:       true,
+		RPID:          webAuthnTestRPID,
+		RPDisplayName: "Example",
+		RPOrigins:     []string{webAuthnTestOrigin},
+	}
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.TestEmail, ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	r, err := models.GrantAuthenticatedUser(ts.API.db, user, models.GrantParams{})
+	require.NoError(ts.T(), err)
+	token, _, err := generateAccessToken(ts.API.db, user, r.SessionId, &ts.Config.JWT)
+	require.NoError(ts.T(), err)
+
+	request := func(path string, body interface{}) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+		req := httptest.NewRequest(http.MethodPost, path, &buffer)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	challenge := func(factorID uuid.UUID) *ChallengeFactorResponse {
+		w := request(fmt.Sprintf("/factors/%s/challenge", factorID), map[string]interface{}{})
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		challengeResp := &ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(challengeResp))
+		require.NotNil(ts.T(), challengeResp.WebAuthn)
+		return challengeResp
+	}
+
+	// Enroll
+	w := request("/factors", map[string]string{"friendly_name": "passkey", "factor_type": models.WebAuthn})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	require.Equal(ts.T(), models.WebAuthn, enrollResp.Type)
+	require.Nil(ts.T(), enrollResp.TOTP)
+	factorID := enrollResp.ID
+
+	// Registration
+	authenticator := newWebAuthnTestAuthenticator(ts.T())
+	challengeResp := challenge(factorID)
+	creationOptions := challengeResp.WebAuthn.CreationOptions
+	require.NotNil(ts.T(), creationOptions)
+	require.Equal(ts.T(), webAuthnTestRPID, creationOptions.RelyingParty.ID)
+	require.Equal(ts.T(), webauthn.URLEncodedBytes(user.ID.Bytes()), creationOptions.User.ID)
+
+	w = request(fmt.Sprintf("/factors/%s/verify", factorID), map[string]interface{}{
+		"challenge_id": challengeResp.ID,
+		"webauthn":     authenticator.create(ts.T(), creationOptions.Challenge),
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, factorID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), factor.IsVerified())
+	require.NotNil(ts.T(), factor.WebAuthnCredential)
+	require.Equal(ts.T(), authenticator.credentialID, factor.WebAuthnCredential.ID)
+
+	// Successful assertion
+	authenticator.signCount = 1
+	challengeResp = challenge(factorID)
+	requestOptions := challengeResp.WebAuthn.RequestOptions
+	require.NotNil(ts.T(), requestOptions)
+	require.Len(ts.T(), requestOptions.AllowCredentials, 1)
+	require.Equal(ts.T(), webauthn.URLEncodedBytes(authenticator.credentialID), requestOptions.AllowCredentials[0].ID)
+
+	w = request(fmt.Sprintf("/factors/%s/verify", factorID), map[string]interface{}{
+		"challenge_id": challengeResp.ID,
+		"webauthn":     authenticator.get(ts.T(), requestOptions.Challenge),
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	verifyResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(verifyResp))
+
+	factor, err = models.FindFactorByFactorID(ts.API.db, factorID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), uint32(1), factor.WebAuthnCredential.SignCount)
+
+	session, err := models.FindSessionByID(ts.API.db, *r.SessionId, true)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), session.IsAAL2())
+
+	// Counter replay is rejected
+	challengeResp = challenge(factorID)
+	w = request(fmt.Sprintf("/factors/%s/verify", factorID), map[string]interface{}{
+		"challenge_id": challengeResp.ID,
+		"webauthn":     authenticator.get(ts.T(), challengeResp.WebAuthn.RequestOptions.Challenge),
+	})
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	factor, err = models.FindFactorByFactorID(ts.API.db, factorID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), uint32(1), factor.WebAuthnCredential.SignCount)
+}
+
+func (ts *MFATestSuite) TestWebAuthnFactorDisabled() {
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.TestEmail, ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	token, _, err := generateAccessToken(ts.API.db, user, nil, &ts.Config.JWT)
+	require.NoError(ts.T(), err)
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]string{"factor_type": models.WebAuthn}))
+	req := httptest.NewRequest(http.MethodPost, "/factors", &buffer)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+const (
+	webAuthnTestRPID   = "example.com"
+	webAuthnTestOrigin = "https://example.com"
+)
+
+// webAuthnTestAuthenticator emulates an authenticator holding a single P-256
+// credential.
+type webAuthnTestAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newWebAuthnTestAuthenticator(t *testing.T) *webAuthnTestAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return &webAuthnTestAuthenticator{
+		key:          key,
+		credentialID: []byte("test-credential-id"),
+	}
+}
+
+func (a *webAuthnTestAuthenticator) clientData(t *testing.T, ceremony string, challenge []byte) []byte {
+	clientData, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    webAuthnTestOrigin,
+	})
+	require.NoError(t, err)
+	return clientData
+}
+
+func (a *webAuthnTestAuthenticator) authenticatorData(flags byte, attestedCredentialData []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(webAuthnTestRPID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attestedCredentialData...)
+}
+
+func (a *webAuthnTestAuthenticator) create(t *testing.T, challenge []byte) *webauthn.PublicKeyCredential {
+	// CBOR encoded EC2 COSE key: {1: 2, 3: -7, -1: 1, -2: x, -3: y}
+	coseKey := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20}
+	coseKey = append(coseKey, a.key.PublicKey.X.FillBytes(make([]byte, 32))...)
+	coseKey = append(coseKey, 0x22, 0x58, 0x20)
+	coseKey = append(coseKey, a.key.PublicKey.Y.FillBytes(make([]byte, 32))...)
+
+	attestedCredentialData := make([]byte, 16)
+	attestedCredentialData = binary.BigEndian.AppendUint16(attestedCredentialData, uint16(len(a.credentialID)))
+	attestedCredentialData = append(attestedCredentialData, a.credentialID...)
+	attestedCredentialData = append(attestedCredentialData, coseKey...)
+	authData := a.authenticatorData(0x41, attestedCredentialData)
+
+	// CBOR encoded attestation object: {"fmt": "none", "attStmt": {}, "authData": authData}
+	attestationObject := []byte{0xa3, 0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e', 0x67, 'a', 't', 't', 'S', 't', 'm', 't', 0xa0, 0x68, 'a', 'u', 't', 'h', 'D', 'a', 't', 'a', 0x59}
+	attestationObject = binary.BigEndian.AppendUint16(attestationObject, uint16(len(authData)))
+	attestationObject = append(attestationObject, authData...)
+
+	return &webauthn.PublicKeyCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  webauthn.PublicKeyCredentialType,
+		Response: webauthn.AuthenticatorResponse{
+			ClientDataJSON:    a.clientData(t, webauthn.CeremonyCreate, challenge),
+			AttestationObject: attestationObject,
+		},
+	}
+}
+
+func (a *webAuthnTestAuthenticator) get(t *testing.T, challenge []byte) *webauthn.PublicKeyCredential {
+	clientData := a.clientData(t, webauthn.CeremonyGet, challenge)
+	authData := a.authenticatorData(0x01, nil)
+
+	clientDataHash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, signed[:])
+	require.NoError(t, err)
+
+	return &webauthn.PublicKeyCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  webauthn.PublicKeyCredentialType,
+		Response: webauthn.AuthenticatorResponse{
+			ClientDataJSON:    clientData,
+			AuthenticatorData: authData,
+			Signature:         signature,
+		},
+	}
+}
+
+func (ts *MFATestSuite) TestRecoveryCodes() {
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.TestEmail, ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	r, err := models.GrantAuthenticatedUser(ts.API.db, user, models.GrantParams{})
+	require.NoError(ts.T(), err)
+	token, _, err := generateAccessToken(ts.API.db, user, r.SessionId, &ts.Config.JWT)
+	require.NoError(ts.T(), err)
+
+	request := func(path string, body interface{}) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+		req := httptest.NewRequest(http.MethodPost, path, &buffer)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	verifyWithRecoveryCode := func(factorID uuid.UUID, recoveryCode string) int {
+		w := request(fmt.Sprintf("/factors/%s/challenge", factorID), map[string]interface{}{})
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		challengeResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+		return request(fmt.Sprintf("/factors/%s/verify", factorID), map[string]interface{}{
+			"challenge_id":  challengeResp.ID,
+			"recovery_code": recoveryCode,
+		}).Code
+	}
+
+	w := request("/factors", map[string]string{"friendly_name": "recoverable", "factor_type": models.TOTP})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	require.Len(ts.T(), enrollResp.RecoveryCodes, ts.Config.MFA.RecoveryCodesCount)
+	factorID := enrollResp.ID
+
+	// recovery codes can't be used to verify a factor
+	require.Equal(ts.T(), http.StatusBadRequest, verifyWithRecoveryCode(factorID, enrollResp.RecoveryCodes[0]))
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, factorID)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), factor.UpdateStatus(ts.API.db, models.FactorStateVerified))
+
+	// a recovery code works exactly once
+	require.Equal(ts.T(), http.StatusOK, verifyWithRecoveryCode(factorID, enrollResp.RecoveryCodes[0]))
+	require.Equal(ts.T(), http.StatusBadRequest, verifyWithRecoveryCode(factorID, enrollResp.RecoveryCodes[0]))
+
+	// regeneration invalidates prior codes
+	w = request(fmt.Sprintf("/factors/%s/recovery_codes", factorID), map[string]interface{}{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	recoveryCodesResp := RecoveryCodesResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&recoveryCodesResp))
+	require.Len(ts.T(), recoveryCodesResp.RecoveryCodes, ts.Config.MFA.RecoveryCodesCount)
+
+	require.Equal(ts.T(), http.StatusBadRequest, verifyWithRecoveryCode(factorID, enrollResp.RecoveryCodes[1]))
+	require.Equal(ts.T(), http.StatusOK, verifyWithRecoveryCode(factorID, recoveryCodesResp.RecoveryCodes[0]))
+}
+
+func (ts *MFATestSuite) TestRegenerateRecoveryCodesRequiresAAL2() {
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, ts.TestEmail, ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	s, err := models.FindSessionByUserID(ts.API.db, user.ID)
+	require.NoError(ts.T(), err)
+	factors, err := models.FindFactorsByUser(ts.API.db, user)
+	require.NoError(ts.T(), err)
+	f := factors[0]
+	require.NoError(ts.T(), f.UpdateStatus(ts.API.db, models.FactorStateVerified))
+
+	token, _, err := generateAccessToken(ts.API.db, user, &s.ID, &ts.Config.JWT)
+	require.NoError(ts.T(), err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/factors/%s/recovery_codes", f.ID), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *MFATestSuite) TestStepUp() {
+	defer func(stepUp conf.MFAStepUpConfiguration) {
+		ts.Config.MFA.StepUp = stepUp
+	}(ts.Config.MFA.StepUp)
+	ts.Config.MFA.StepUp = conf.MFAStepUpConfiguration{
+		PasswordUpdate:   true,
+		FactorManagement: true,
+		MaxAge:           10 * time.Minute,
+	}
+
+	email := "test1@example.com"
+	password := "test123"
+	aal2 := signUpAndVerify(ts, email, password)
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"email":    email,
+		"password": password,
+	}))
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	aal1 := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(aal1))
+
+	updatePassword := func(token string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"password": "new-password-123",
+		}))
+		req := httptest.NewRequest(http.MethodPut, "http://localhost/user", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	requireMFARequired := func(w *httptest.ResponseRecorder) {
+		require.Equal(ts.T(), http.StatusForbidden, w.Code)
+		data := &HTTPError{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+		require.Equal(ts.T(), ErrorCodeMFARequired, data.ErrorCode)
+	}
+
+	ts.Run("AAL1 session is rejected", func() {
+		requireMFARequired(updatePassword(aal1.Token))
+
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]string{"friendly_name": "jane", "factor_type": models.TOTP, "issuer": ts.TestDomain}))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/factors/", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", aal1.Token))
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		requireMFARequired(w)
+	})
+
+	ts.Run("AAL2 session within the max age is accepted", func() {
+		require.Equal(ts.T(), http.StatusOK, updatePassword(aal2.Token).Code)
+	})
+
+	ts.Run("AAL2 session after the max age is rejected", func() {
+		claims, err := ts.API.parseJWTClaims(aal2.Token, httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+		require.NoError(ts.T(), err)
+		require.NoError(ts.T(), ts.API.db.RawQuery(
+			"update mfa_amr_claims set updated_at = ? where session_id = ?",
+			time.Now().Add(-time.Hour), getClaims(claims).SessionId,
+		).Exec())
+
+		requireMFARequired(updatePassword(aal2.Token))
+	})
+}
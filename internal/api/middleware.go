@@ -3,18 +3,21 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"io"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/supabase/gotrue/internal/api/sms_provider"
 	"github.com/supabase/gotrue/internal/models"
 	"github.com/supabase/gotrue/internal/observability"
 	"github.com/supabase/gotrue/internal/security"
+	"github.com/supabase/gotrue/internal/utilities"
 	"go.opentelemetry.io/otel/attribute"
 
-	"github.com/didip/tollbooth/v5"
-	"github.com/didip/tollbooth/v5/limiter"
 	jwt "github.com/golang-jwt/jwt"
 )
 
@@ -51,7 +54,28 @@ func (f *FunctionHooks) UnmarshalJSON(b []byte) error {
 
 var emailRateLimitCounter = observability.ObtainMetricCounter("gotrue_email_rate_limit_counter", "Number of times an email rate limit has been triggered")
 
-func (a *API) limitHandler(lmt *limiter.Limiter) middlewareHandler {
+// rateLimit takes a request from the bucket of key and returns whether the
+// request is allowed. The X-RateLimit headers describe the state of the
+// bucket, unless the request was already limited more restrictively by
+// another limiter. Retry-After is set if the request isn't allowed.
+func (a *API) rateLimit(w http.ResponseWriter, lmt *security.TokenBucketLimiter, key string) bool {
+	status := lmt.Take(key, a.now())
+
+	header := w.Header()
+	if remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining")); err != nil || status.Remaining <= remaining {
+		header.Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+		header.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(status.Reset.Seconds()))))
+	}
+
+	if !status.Allowed {
+		header.Set("Retry-After", strconv.Itoa(int(math.Ceil(status.RetryAfter.Seconds()))))
+	}
+
+	return status.Allowed
+}
+
+func (a *API) limitHandler(lmt *security.TokenBucketLimiter) middlewareHandler {
 	return func(w http.ResponseWriter, req *http.Request) (context.Context, error) {
 		c := req.Context()
 
@@ -63,8 +87,7 @@ func (a *API) limitHandler(lmt *limiter.Limiter) middlewareHandler {
 				log.WithField("header", limitHeader).Warn("request does not have a value for the rate limiting header, rate limiting is not applied")
 				return c, nil
 			} else {
-				err := tollbooth.LimitByKeys(lmt, []string{key})
-				if err != nil {
+				if !a.rateLimit(w, lmt, key) {
 					return c, httpError(http.StatusTooManyRequests, "Rate limit exceeded")
 				}
 			}
@@ -77,14 +100,11 @@ func (a *API) limitEmailOrPhoneSentHandler() middlewareHandler {
 	// limit per hour
 	emailFreq := a.config.RateLimitEmailSent / (60 * 60)
 	smsFreq := a.config.RateLimitSmsSent / (60 * 60)
+	whatsappFreq := a.config.RateLimitWhatsappSent / (60 * 60)
 
-	emailLimiter := tollbooth.NewLimiter(emailFreq, &limiter.ExpirableOptions{
-		DefaultExpirationTTL: time.Hour,
-	}).SetBurst(int(a.config.RateLimitEmailSent)).SetMethods([]string{"PUT", "POST"})
-
-	phoneLimiter := tollbooth.NewLimiter(smsFreq, &limiter.ExpirableOptions{
-		DefaultExpirationTTL: time.Hour,
-	}).SetBurst(int(a.config.RateLimitSmsSent)).SetMethods([]string{"PUT", "POST"})
+	emailLimiter := security.NewTokenBucketLimiter(emailFreq, int(a.config.RateLimitEmailSent), time.Hour)
+	phoneLimiter := security.NewTokenBucketLimiter(smsFreq, int(a.config.RateLimitSmsSent), time.Hour)
+	whatsappLimiter := security.NewTokenBucketLimiter(whatsappFreq, int(a.config.RateLimitWhatsappSent), time.Hour)
 
 	return func(w http.ResponseWriter, req *http.Request) (context.Context, error) {
 		c := req.Context()
@@ -100,8 +120,9 @@ func (a *API) limitEmailOrPhoneSentHandler() middlewareHandler {
 				}
 
 				var requestBody struct {
-					Email string `json:"email"`
-					Phone string `json:"phone"`
+					Email   string `json:"email"`
+					Phone   string `json:"phone"`
+					Channel string `json:"channel"`
 				}
 
 				if err := json.Unmarshal(bodyBytes, &requestBody); err != nil {
@@ -110,7 +131,7 @@ func (a *API) limitEmailOrPhoneSentHandler() middlewareHandler {
 
 				if shouldRateLimitEmail {
 					if requestBody.Email != "" {
-						if err := tollbooth.LimitByKeys(emailLimiter, []string{"email_functions"}); err != nil {
+						if !a.rateLimit(w, emailLimiter, "email_functions") {
 							emailRateLimitCounter.Add(
 								req.Context(),
 								1,
@@ -123,7 +144,13 @@ func (a *API) limitEmailOrPhoneSentHandler() middlewareHandler {
 
 				if shouldRateLimitPhone {
 					if requestBody.Phone != "" {
-						if err := tollbooth.LimitByKeys(phoneLimiter, []string{"phone_functions"}); err != nil {
+						// each channel has its own budget, as they are
+						// usually billed and throttled separately
+						if requestBody.Channel == sms_provider.WhatsappProvider {
+							if !a.rateLimit(w, whatsappLimiter, "whatsapp_functions") {
+								return c, httpError(http.StatusTooManyRequests, "WhatsApp rate limit exceeded")
+							}
+						} else if !a.rateLimit(w, phoneLimiter, "phone_functions") {
 							return c, httpError(http.StatusTooManyRequests, "Sms rate limit exceeded")
 						}
 					}
@@ -135,6 +162,136 @@ func (a *API) limitEmailOrPhoneSentHandler() middlewareHandler {
 	}
 }
 
+// limitEmailPerRecipientHandler limits the number of emails sent to the same
+// address per hour, independently of the client sending the requests, so that
+// an address can't be flooded with emails.
+func (a *API) limitEmailPerRecipientHandler() middlewareHandler {
+	recipientLimiter := security.NewSlidingWindowLimiter(time.Hour)
+
+	return func(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+		c := req.Context()
+		config := a.config
+
+		if !config.External.Email.Enabled || config.RateLimitEmailPerRecipient <= 0 {
+			return c, nil
+		}
+
+		bodyBytes, err := getBodyBytes(req)
+		if err != nil {
+			return c, internalServerError("Error invalid request body").WithInternalError(err)
+		}
+
+		var requestBody struct {
+			Email string `json:"email"`
+		}
+
+		if err := json.Unmarshal(bodyBytes, &requestBody); err != nil {
+			return c, badRequestError("Error invalid request body").WithInternalError(err)
+		}
+
+		email := strings.ToLower(strings.TrimSpace(requestBody.Email))
+		if email == "" {
+			return c, nil
+		}
+
+		if !recipientLimiter.Allow(email, int(config.RateLimitEmailPerRecipient), a.now()) {
+			emailRateLimitCounter.Add(
+				req.Context(),
+				1,
+				attribute.String("path", req.URL.Path),
+			)
+			return c, httpError(http.StatusTooManyRequests, "Email rate limit exceeded for this address")
+		}
+
+		return c, nil
+	}
+}
+
+// attachHookConnection makes the database available to event webhooks that
+// are retried in the background, after the request's transaction has ended.
+func (a *API) attachHookConnection(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	return withHookConnection(req.Context(), a.db), nil
+}
+
+// limitedRequestBody is a request body limited to MaxRequestBodySize, which
+// keeps the original body so that the limit can be lifted.
+type limitedRequestBody struct {
+	io.ReadCloser
+	original io.ReadCloser
+}
+
+// limitRequestBody limits request bodies to MaxRequestBodySize. Reading a
+// larger body fails, which handleError reports with a 413, so that huge
+// bodies are never read into memory.
+func (a *API) limitRequestBody(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	limit := a.config.API.MaxRequestBodySize
+	if limit <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return req.Context(), nil
+	}
+
+	if req.ContentLength > limit {
+		return nil, requestTooLargeError(limit)
+	}
+
+	req.Body = &limitedRequestBody{
+		ReadCloser: http.MaxBytesReader(w, req.Body, limit),
+		original:   req.Body,
+	}
+
+	return req.Context(), nil
+}
+
+// removeRequestBodyLimit lifts the limit of limitRequestBody, for the admin
+// API whose requests, like user imports, can be larger.
+func (a *API) removeRequestBodyLimit(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	if body, ok := req.Body.(*limitedRequestBody); ok {
+		req.Body = body.original
+	}
+
+	return req.Context(), nil
+}
+
+// resolveAudience selects the audience of a request from the audience
+// header, or from an /aud/{audience} path prefix which is stripped before
+// routing. Audiences that aren't allowed are rejected.
+func (a *API) resolveAudience(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	aud := req.Header.Get(audHeaderName)
+
+	if strings.HasPrefix(req.URL.Path, audPathPrefix) {
+		pathAud, path, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, audPathPrefix), "/")
+		if pathAud == "" {
+			return nil, badRequestError("Audience missing from path")
+		}
+
+		if aud != "" && aud != pathAud {
+			return nil, badRequestError("Audience in path does not match the %s header", audHeaderName)
+		}
+
+		aud = pathAud
+
+		req.Header.Set(audHeaderName, aud)
+		req.URL.Path = "/" + path
+		req.URL.RawPath = ""
+	}
+
+	if aud != "" && !a.config.JWT.IsAllowedAudience(aud) {
+		return nil, badRequestError("Audience %q is not allowed", aud)
+	}
+
+	return req.Context(), nil
+}
+
+// resolveMailerTenant selects the email templates of the tenant in the
+// configured header, or of the request's audience if the header is not set.
+func (a *API) resolveMailerTenant(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	tenant := req.Header.Get(a.config.Mailer.TenantHeader)
+	if tenant == "" {
+		tenant = req.Header.Get(audHeaderName)
+	}
+
+	return withMailerTenant(req.Context(), tenant), nil
+}
+
 func (a *API) requireAdminCredentials(w http.ResponseWriter, req *http.Request) (context.Context, error) {
 	t, err := a.extractBearerToken(req)
 	if err != nil || t == "" {
@@ -176,7 +333,7 @@ func (a *API) verifyCaptcha(w http.ResponseWriter, req *http.Request) (context.C
 		return ctx, nil
 	}
 
-	verificationResult, err := security.VerifyRequest(req, strings.TrimSpace(config.Security.Captcha.Secret), config.Security.Captcha.Provider)
+	verificationResult, err := security.VerifyRequest(req, strings.TrimSpace(config.Security.Captcha.Secret), config.Security.Captcha.Provider, config.Security.Captcha.VerifyURL)
 	if err != nil {
 		return nil, internalServerError("captcha verification process failed").WithInternalError(err)
 	}
@@ -224,6 +381,20 @@ func (a *API) isValidExternalHost(w http.ResponseWriter, req *http.Request) (con
 	return withExternalHost(ctx, u), nil
 }
 
+// requireValidRedirectTo rejects requests with a redirect_to that doesn't
+// match the site URL or the URI allow list, instead of silently falling back
+// to the site URL.
+func (a *API) requireValidRedirectTo(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	ctx := req.Context()
+
+	redirectTo := utilities.GetRedirectTo(req)
+	if redirectTo != "" && !utilities.IsRedirectURLValid(a.config, redirectTo) {
+		return nil, invalidRedirectURLError()
+	}
+
+	return ctx, nil
+}
+
 func (a *API) requireSAMLEnabled(w http.ResponseWriter, req *http.Request) (context.Context, error) {
 	ctx := req.Context()
 	if !a.config.SAML.Enabled {
@@ -232,6 +403,27 @@ func (a *API) requireSAMLEnabled(w http.ResponseWriter, req *http.Request) (cont
 	return ctx, nil
 }
 
+func (a *API) requireSessionIntrospectionEnabled(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	ctx := req.Context()
+	if !a.config.Sessions.IntrospectionEnabled {
+		return nil, notFoundError("Session introspection is disabled")
+	}
+	return ctx, nil
+}
+
+func (a *API) requireFactorManagementStepUp(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	ctx := req.Context()
+	if !a.config.MFA.StepUp.FactorManagement {
+		return ctx, nil
+	}
+
+	if err := a.requireStepUp(ctx, a.db.WithContext(ctx), getUser(ctx)); err != nil {
+		return nil, err
+	}
+
+	return ctx, nil
+}
+
 func (a *API) databaseCleanup(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		next.ServeHTTP(w, r)
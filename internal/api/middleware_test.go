@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"testing"
+	"time"
 
 	jwt "github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
@@ -182,6 +184,97 @@ func (ts *MiddlewareTestSuite) TestVerifyCaptchaInvalid() {
 	}
 }
 
+func (ts *MiddlewareTestSuite) TestVerifyCaptchaStubbedProvider() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(ts.T(), r.ParseForm())
+		switch r.PostForm.Get("response") {
+		case "valid":
+			w.Write([]byte(`{"success": true}`))
+		case "invalid":
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	defer func(captcha conf.CaptchaConfiguration) {
+		ts.Config.Security.Captcha = captcha
+	}(ts.Config.Security.Captcha)
+	ts.Config.Security.Captcha = conf.CaptchaConfiguration{
+		Enabled:   true,
+		Provider:  "turnstile",
+		Secret:    "secret",
+		VerifyURL: server.URL,
+	}
+
+	cases := []struct {
+		desc         string
+		token        string
+		path         string
+		expectedCode int
+		expectedMsg  string
+	}{
+		{
+			desc:  "Valid token on signup",
+			token: "valid",
+			path:  "/signup",
+		},
+		{
+			desc:  "Valid token on password sign in",
+			token: "valid",
+			path:  "/token?grant_type=password",
+		},
+		{
+			desc:         "Invalid token on otp",
+			token:        "invalid",
+			path:         "/otp",
+			expectedCode: http.StatusBadRequest,
+			expectedMsg:  "captcha protection: request disallowed (invalid-input-response)",
+		},
+		{
+			desc:         "Provider error fails closed",
+			token:        "provider-error",
+			path:         "/signup",
+			expectedCode: http.StatusInternalServerError,
+			expectedMsg:  "captcha verification process failed",
+		},
+		{
+			desc:         "Missing token fails closed",
+			token:        "",
+			path:         "/signup",
+			expectedCode: http.StatusInternalServerError,
+			expectedMsg:  "captcha verification process failed",
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			var buffer bytes.Buffer
+			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+				"email":    "test@example.com",
+				"password": "secret",
+				"gotrue_meta_security": map[string]interface{}{
+					"captcha_token": c.token,
+				},
+			}))
+			req := httptest.NewRequest(http.MethodPost, "http://localhost"+c.path, &buffer)
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			_, err := ts.API.verifyCaptcha(w, req)
+			if c.expectedCode == 0 {
+				require.NoError(ts.T(), err)
+				return
+			}
+
+			require.Error(ts.T(), err)
+			require.Equal(ts.T(), c.expectedCode, err.(*HTTPError).Code)
+			require.Equal(ts.T(), c.expectedMsg, err.(*HTTPError).Message)
+		})
+	}
+}
+
 func (ts *MiddlewareTestSuite) TestLimitEmailOrPhoneSentHandler() {
 	// Set up rate limit config for this test
 	ts.Config.RateLimitEmailSent = 5
@@ -221,16 +314,138 @@ func (ts *MiddlewareTestSuite) TestLimitEmailOrPhoneSentHandler() {
 			for i := 0; i < 5; i++ {
 				_, err := limiter(w, req)
 				require.NoError(ts.T(), err)
+				require.Equal(ts.T(), "5", w.Header().Get("X-RateLimit-Limit"))
+				require.Equal(ts.T(), strconv.Itoa(4-i), w.Header().Get("X-RateLimit-Remaining"))
 			}
 
 			// should exceed rate limit on 5th try
 			_, err := limiter(w, req)
 			require.Error(ts.T(), err)
 			require.Equal(ts.T(), c.expectedErrorMsg, err.Error())
+			require.Equal(ts.T(), "0", w.Header().Get("X-RateLimit-Remaining"))
+			require.NotEmpty(ts.T(), w.Header().Get("X-RateLimit-Reset"))
+			require.NotEmpty(ts.T(), w.Header().Get("Retry-After"))
 		})
 	}
 }
 
+func (ts *MiddlewareTestSuite) TestLimitPhoneSentPerChannel() {
+	defer func(smsSent, whatsappSent float64, phoneEnabled bool) {
+		ts.Config.RateLimitSmsSent = smsSent
+		ts.Config.RateLimitWhatsappSent = whatsappSent
+		ts.Config.External.Phone.Enabled = phoneEnabled
+	}(ts.Config.RateLimitSmsSent, ts.Config.RateLimitWhatsappSent, ts.Config.External.Phone.Enabled)
+	ts.Config.RateLimitSmsSent = 2
+	ts.Config.RateLimitWhatsappSent = 3
+	ts.Config.External.Phone.Enabled = true
+
+	limiter := ts.API.limitEmailOrPhoneSentHandler()
+	send := func(channel string) error {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"phone":   "12015550123",
+			"channel": channel,
+		}))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/otp", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		_, err := limiter(w, req)
+		return err
+	}
+
+	// requests without a channel are sent by sms
+	require.NoError(ts.T(), send("sms"))
+	require.NoError(ts.T(), send(""))
+	err := send("sms")
+	require.Error(ts.T(), err)
+	require.Equal(ts.T(), "429: Sms rate limit exceeded", err.Error())
+
+	// whatsapp has its own budget
+	for i := 0; i < 3; i++ {
+		require.NoError(ts.T(), send("whatsapp"))
+	}
+	err = send("whatsapp")
+	require.Error(ts.T(), err)
+	require.Equal(ts.T(), "429: WhatsApp rate limit exceeded", err.Error())
+}
+
+func (ts *MiddlewareTestSuite) TestLimitEmailPerRecipientHandler() {
+	defer func(limit float64) {
+		ts.Config.RateLimitEmailPerRecipient = limit
+	}(ts.Config.RateLimitEmailPerRecipient)
+	ts.Config.RateLimitEmailPerRecipient = 3
+
+	limiter := ts.API.limitEmailPerRecipientHandler()
+	sendTo := func(email string) error {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"email": email,
+		}))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/magiclink", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		_, err := limiter(w, req)
+		return err
+	}
+
+	// emails are normalized, so that case variations share the budget
+	require.NoError(ts.T(), sendTo("victim@example.com"))
+	require.NoError(ts.T(), sendTo("Victim@Example.com"))
+	require.NoError(ts.T(), sendTo(" victim@example.com "))
+
+	err := sendTo("victim@example.com")
+	require.Error(ts.T(), err)
+	require.Equal(ts.T(), "429: Email rate limit exceeded for this address", err.Error())
+
+	// other recipients are not affected
+	require.NoError(ts.T(), sendTo("other@example.com"))
+}
+
+func (ts *MiddlewareTestSuite) TestLimitEmailPerRecipientOnOtp() {
+	defer func(limit float64, maxFrequency time.Duration) {
+		ts.Config.RateLimitEmailPerRecipient = limit
+		ts.Config.SMTP.MaxFrequency = maxFrequency
+	}(ts.Config.RateLimitEmailPerRecipient, ts.Config.SMTP.MaxFrequency)
+	ts.Config.RateLimitEmailPerRecipient = 2
+	ts.Config.SMTP.MaxFrequency = 0
+
+	now := time.Now()
+	ts.API.now = func() time.Time {
+		return now
+	}
+	defer func() {
+		ts.API.now = time.Now
+	}()
+
+	otp := func(email string) int {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"email": email,
+		}))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/otp", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		ts.API.handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		require.Equal(ts.T(), http.StatusOK, otp("limited@example.com"))
+	}
+	require.Equal(ts.T(), http.StatusTooManyRequests, otp("limited@example.com"))
+	require.Equal(ts.T(), http.StatusOK, otp("unlimited@example.com"))
+
+	// the window slides with the API clock
+	now = now.Add(59 * time.Minute)
+	require.Equal(ts.T(), http.StatusTooManyRequests, otp("limited@example.com"))
+
+	now = now.Add(2 * time.Minute)
+	require.Equal(ts.T(), http.StatusOK, otp("limited@example.com"))
+}
+
 func (ts *MiddlewareTestSuite) TestIsValidExternalHost() {
 	cases := []struct {
 		desc        string
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// watchOIDCProviders reloads the providers directory every interval until
+// the context is done, so that OIDC providers can be added, changed and
+// removed without a restart.
+func (a *API) watchOIDCProviders(ctx context.Context) {
+	external := &a.config.External
+	log := logrus.WithField("component", "api").WithField("providers_directory", external.ProvidersDirectory)
+
+	ticker := time.NewTicker(external.ProvidersDirectoryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := external.OIDCProviders.Reload(); err != nil {
+				log.WithError(err).Error("unable to reload OIDC providers")
+			}
+		}
+	}
+}
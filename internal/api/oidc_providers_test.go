@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/models"
+)
+
+// setupOIDCProvidersDirectory configures a providers directory, and returns a
+// function that defines a provider in it verifying ID tokens with a test key,
+// along with a function minting ID tokens for the provider.
+func (ts *TokenTestSuite) setupOIDCProvidersDirectory() func(name string) func(jwt.MapClaims) string {
+	external := ts.Config.External
+	ts.T().Cleanup(func() {
+		ts.Config.External.ProvidersDirectory = external.ProvidersDirectory
+		ts.Config.External.OIDCProviders = external.OIDCProviders
+	})
+
+	dir := ts.T().TempDir()
+	ts.Config.External.ProvidersDirectory = dir
+	require.NoError(ts.T(), ts.Config.External.LoadOIDCProviders())
+
+	return func(name string) func(jwt.MapClaims) string {
+		jwksURL, mintIDToken := newTestJWKS(ts.T())
+		issuer := fmt.Sprintf("https://%s.example.com", name)
+
+		contents, err := json.Marshal(map[string]interface{}{
+			"issuer":    issuer,
+			"client_id": []string{name + "-client"},
+			"jwks_url":  jwksURL,
+		})
+		require.NoError(ts.T(), err)
+		require.NoError(ts.T(), os.WriteFile(filepath.Join(dir, name+".json"), contents, 0600))
+
+		return func(claims jwt.MapClaims) string {
+			standardClaims := jwt.MapClaims{
+				"iss":            issuer,
+				"aud":            name + "-client",
+				"sub":            name + "-subject",
+				"email":          name + "@example.com",
+				"email_verified": true,
+				"iat":            time.Now().Unix(),
+				"exp":            time.Now().Add(time.Hour).Unix(),
+			}
+
+			for key, value := range claims {
+				standardClaims[key] = value
+			}
+
+			return mintIDToken(standardClaims)
+		}
+	}
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantDirectoryOIDCProvider() {
+	addProvider := ts.setupOIDCProvidersDirectory()
+
+	mintIDToken := addProvider("acme")
+
+	// the provider isn't known until the directory is reloaded
+	w := ts.idTokenGrant(map[string]interface{}{
+		"provider": "acme",
+		"id_token": mintIDToken(jwt.MapClaims{}),
+	})
+	require.NotEqual(ts.T(), http.StatusOK, w.Code)
+
+	require.NoError(ts.T(), ts.Config.External.OIDCProviders.Reload())
+
+	w = ts.idTokenGrant(map[string]interface{}{
+		"provider": "acme",
+		"id_token": mintIDToken(jwt.MapClaims{}),
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	data := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), "acme@example.com", data.User.GetEmail())
+
+	identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "acme-subject", "acme")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), data.User.ID, identity.UserID)
+
+	// the provider can also be selected by its issuer
+	w = ts.idTokenGrant(map[string]interface{}{
+		"issuer":   "https://acme.example.com",
+		"id_token": mintIDToken(jwt.MapClaims{}),
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	// ID tokens issued to other clients are rejected
+	w = ts.idTokenGrant(map[string]interface{}{
+		"provider": "acme",
+		"id_token": mintIDToken(jwt.MapClaims{"aud": "other-client"}),
+	})
+	require.NotEqual(ts.T(), http.StatusOK, w.Code)
+}
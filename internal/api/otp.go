@@ -8,6 +8,7 @@ import (
 
 	"github.com/sethvargo/go-password/password"
 	"github.com/supabase/gotrue/internal/api/sms_provider"
+	"github.com/supabase/gotrue/internal/conf"
 	"github.com/supabase/gotrue/internal/models"
 	"github.com/supabase/gotrue/internal/storage"
 )
@@ -21,6 +22,7 @@ type OtpParams struct {
 	Channel             string                 `json:"channel"`
 	CodeChallengeMethod string                 `json:"code_challenge_method"`
 	CodeChallenge       string                 `json:"code_challenge"`
+	Locale              string                 `json:"locale"`
 }
 
 // SmsParams contains the request body params for sms otp
@@ -30,6 +32,7 @@ type SmsParams struct {
 	Data                map[string]interface{} `json:"data"`
 	CodeChallengeMethod string                 `json:"code_challenge_method"`
 	CodeChallenge       string                 `json:"code_challenge"`
+	Locale              string                 `json:"locale"`
 }
 
 func (p *OtpParams) Validate() error {
@@ -42,16 +45,24 @@ func (p *OtpParams) Validate() error {
 	if err := validatePKCEParams(p.CodeChallengeMethod, p.CodeChallenge); err != nil {
 		return err
 	}
+	if _, err := validateLocale(p.Locale); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (p *SmsParams) Validate(smsProvider string) error {
-	if p.Phone != "" && !sms_provider.IsValidMessageChannel(p.Channel, smsProvider) {
+func (p *SmsParams) Validate(config *conf.GlobalConfiguration) error {
+	if p.Phone != "" && !sms_provider.IsValidMessageChannel(p.Channel, config.Sms.Provider) {
 		return badRequestError(InvalidChannelError)
 	}
 
 	var err error
-	p.Phone, err = validatePhone(p.Phone)
+	p.Phone, err = validatePhone(p.Phone, config.Sms.DefaultRegion)
+	if err != nil {
+		return err
+	}
+
+	p.Locale, err = validateLocale(p.Locale)
 	if err != nil {
 		return err
 	}
@@ -129,7 +140,7 @@ func (a *API) SmsOtp(w http.ResponseWriter, r *http.Request) error {
 		params.Channel = sms_provider.SMSProvider
 	}
 
-	if err := params.Validate(config.Sms.Provider); err != nil {
+	if err := params.Validate(config); err != nil {
 		return err
 	}
 
@@ -149,7 +160,7 @@ func (a *API) SmsOtp(w http.ResponseWriter, r *http.Request) error {
 	if isNewUser {
 		// User either doesn't exist or hasn't completed the signup process.
 		// Sign them up with temporary password.
-		password, err := password.Generate(64, 10, 0, false, true)
+		password, err := password.Generate(64, 10, 10, false, true)
 		if err != nil {
 			internalServerError("error creating user").WithInternalError(err)
 		}
@@ -159,6 +170,7 @@ func (a *API) SmsOtp(w http.ResponseWriter, r *http.Request) error {
 			Password: password,
 			Data:     params.Data,
 			Channel:  params.Channel,
+			Locale:   params.Locale,
 		}
 		newBodyContent, err := json.Marshal(signUpParams)
 		if err != nil {
@@ -177,6 +189,7 @@ func (a *API) SmsOtp(w http.ResponseWriter, r *http.Request) error {
 			signUpParams := &SignupParams{
 				Phone:   params.Phone,
 				Channel: params.Channel,
+				Locale:  params.Locale,
 			}
 			newBodyContent, err := json.Marshal(signUpParams)
 			if err != nil {
@@ -192,6 +205,12 @@ func (a *API) SmsOtp(w http.ResponseWriter, r *http.Request) error {
 		return sendJSON(w, http.StatusOK, make(map[string]string))
 	}
 
+	if params.Locale != "" {
+		// the message is sent in the requested locale, but it is not
+		// stored because we can't be sure of the user's claimed identity
+		user.Locale = params.Locale
+	}
+
 	messageID := ""
 	err = db.Transaction(func(tx *storage.Connection) error {
 		if err := models.NewAuditLogEntry(r, tx, user, models.UserRecoveryRequestedAction, "", map[string]interface{}{
@@ -205,7 +224,7 @@ func (a *API) SmsOtp(w http.ResponseWriter, r *http.Request) error {
 		}
 		mID, serr := a.sendPhoneConfirmation(ctx, tx, user, params.Phone, phoneConfirmationOtp, smsProvider, params.Channel)
 		if serr != nil {
-			return badRequestError("Error sending sms OTP: %v", err)
+			return badRequestError("Error sending sms OTP: %v", serr)
 		}
 		messageID = mID
 		return nil
@@ -235,7 +254,7 @@ func (a *API) shouldCreateUser(r *http.Request, params *OtpParams) (bool, error)
 			}
 			_, err = models.FindUserByEmailAndAudience(db, params.Email, aud)
 		} else if params.Phone != "" {
-			params.Phone, err = validatePhone(params.Phone)
+			params.Phone, err = validatePhone(params.Phone, a.config.Sms.DefaultRegion)
 			if err != nil {
 				return false, err
 			}
@@ -10,6 +10,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/supabase/gotrue/internal/api/sms_provider"
 	"github.com/supabase/gotrue/internal/conf"
 	"github.com/supabase/gotrue/internal/models"
 )
@@ -304,3 +305,93 @@ func (ts *OtpTestSuite) TestSubsequentOtp() {
 	require.Empty(ts.T(), user.RecoverySentAt)
 	require.Empty(ts.T(), user.EmailConfirmedAt)
 }
+
+func (ts *OtpTestSuite) TestOtpChannel() {
+	defer func(sms conf.SmsProviderConfiguration, phoneEnabled bool) {
+		ts.Config.Sms = sms
+		ts.Config.External.Phone.Enabled = phoneEnabled
+	}(ts.Config.Sms, ts.Config.External.Phone.Enabled)
+
+	var received []sms_provider.HTTPProviderRequest
+	gatewayStatus := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body sms_provider.HTTPProviderRequest
+		require.NoError(ts.T(), json.NewDecoder(r.Body).Decode(&body))
+		received = append(received, body)
+
+		w.WriteHeader(gatewayStatus)
+		if gatewayStatus == http.StatusOK {
+			require.NoError(ts.T(), json.NewEncoder(w).Encode(sms_provider.HTTPProviderResponse{MessageID: "msg-1"}))
+		}
+	}))
+	defer server.Close()
+
+	ts.Config.External.Phone.Enabled = true
+	ts.Config.Sms.Provider = "http"
+	ts.Config.Sms.HTTP = conf.HTTPProviderConfiguration{URL: server.URL}
+	ts.Config.Sms.TestOTP = nil
+	ts.Config.Sms.MaxFrequency = 0
+
+	sendOtp := func(params map[string]interface{}) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+		req := httptest.NewRequest(http.MethodPost, "/otp", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	ts.Run("defaults to sms", func() {
+		received = nil
+		w := sendOtp(map[string]interface{}{"phone": "12015550123"})
+		require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+		require.Len(ts.T(), received, 1)
+		require.Equal(ts.T(), "12015550123", received[0].Phone)
+		require.Equal(ts.T(), sms_provider.SMSProvider, received[0].Channel)
+
+		data := SmsOtpResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.Equal(ts.T(), "msg-1", data.MessageID)
+	})
+
+	ts.Run("whatsapp reaches the provider", func() {
+		received = nil
+		w := sendOtp(map[string]interface{}{"phone": "12015550123", "channel": "whatsapp"})
+		require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+		require.Len(ts.T(), received, 1)
+		require.Equal(ts.T(), sms_provider.WhatsappProvider, received[0].Channel)
+	})
+
+	ts.Run("provider errors are returned", func() {
+		received = nil
+		gatewayStatus = http.StatusBadGateway
+		defer func() {
+			gatewayStatus = http.StatusOK
+		}()
+
+		w := sendOtp(map[string]interface{}{"phone": "12015550123", "channel": "whatsapp"})
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+		require.Contains(ts.T(), w.Body.String(), "status 502")
+	})
+
+	ts.Run("channel not supported by the provider", func() {
+		received = nil
+		ts.Config.Sms.Provider = "messagebird"
+		ts.Config.Sms.Messagebird = conf.MessagebirdProviderConfiguration{
+			AccessKey:  "test_access_key",
+			Originator: "test_originator",
+		}
+		defer func() {
+			ts.Config.Sms.Provider = "http"
+		}()
+
+		w := sendOtp(map[string]interface{}{"phone": "12015550123", "channel": "whatsapp"})
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+		data := make(map[string]interface{})
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.Equal(ts.T(), InvalidChannelError, data["msg"])
+		require.Empty(ts.T(), received)
+	})
+}
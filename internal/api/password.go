@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/observability"
+	"github.com/supabase/gotrue/internal/security"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// checkPasswordStrength rejects passwords that don't satisfy the configured
+// password requirements, listing every requirement that failed. Passwords
+// that do are then checked against breached passwords.
+func (a *API) checkPasswordStrength(r *http.Request, password string, userInputs ...string) error {
+	config := a.config
+	requirements := &config.Security.PasswordRequirements
+
+	var messages, reasons []string
+
+	if len(password) < config.PasswordMinLength {
+		messages = append(messages, fmt.Sprintf("Password should be at least %d characters", config.PasswordMinLength))
+		reasons = append(reasons, WeakPasswordLength)
+	}
+
+	if len(requirements.RequiredCharacterClasses) > 0 {
+		classes := security.PasswordCharacterClasses(password)
+
+		var missing []string
+		for _, class := range requirements.RequiredCharacterClasses {
+			if !classes[class] {
+				missing = append(missing, class)
+			}
+		}
+
+		if len(missing) > 0 {
+			messages = append(messages, fmt.Sprintf("Password should contain %s characters", strings.Join(missing, ", ")))
+			reasons = append(reasons, WeakPasswordCharacters)
+		}
+	}
+
+	if requirements.MinStrengthScore > 0 && security.PasswordStrengthScore(password, userInputs...) < requirements.MinStrengthScore {
+		messages = append(messages, "Password is too easy to guess")
+		reasons = append(reasons, WeakPasswordStrength)
+	}
+
+	if len(reasons) > 0 {
+		return weakPasswordError(strings.Join(messages, ". "), reasons...)
+	}
+
+	return a.checkPwnedPassword(r, password)
+}
+
+// checkPasswordHistory rejects passwords that are among the user's recent
+// passwords, if the password history is enabled.
+func (a *API) checkPasswordHistory(tx *storage.Connection, user *models.User, password string) error {
+	length := a.config.Security.PasswordHistoryLength
+	if length == 0 {
+		return nil
+	}
+
+	reused, err := models.IsPasswordReused(tx, user, password, length)
+	if err != nil {
+		return internalServerError("Database error checking password history").WithInternalError(err)
+	}
+
+	if reused {
+		return passwordReusedError(length)
+	}
+
+	return nil
+}
+
+// recordPasswordHistory adds the user's current password to their password
+// history before it's replaced, if enabled.
+func (a *API) recordPasswordHistory(tx *storage.Connection, user *models.User) error {
+	length := a.config.Security.PasswordHistoryLength
+	if length == 0 {
+		return nil
+	}
+
+	if err := models.AddToPasswordHistory(tx, user, length); err != nil {
+		return internalServerError("Database error updating password history").WithInternalError(err)
+	}
+
+	return nil
+}
+
+// checkPwnedPassword rejects passwords that appear in the HaveIBeenPwned
+// corpus of breached passwords, if enabled. When the check can't be
+// completed, the password is accepted unless the check is configured to
+// fail closed.
+func (a *API) checkPwnedPassword(r *http.Request, password string) error {
+	config := &a.config.Security
+	if !config.CheckPwnedPasswords {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.PwnedPasswordsTimeout)
+	defer cancel()
+
+	pwned, err := security.IsPwnedPassword(ctx, http.DefaultClient, config.PwnedPasswordsURL, password)
+	if err != nil {
+		if config.PwnedPasswordsFailClosed {
+			return internalServerError("Unable to check the password against breached passwords, try again later").WithInternalError(err)
+		}
+
+		observability.GetLogEntry(r).WithError(err).Warn("Unable to check the password against breached passwords, accepting it")
+		return nil
+	}
+
+	if pwned {
+		return weakPasswordError("Password is known to have been leaked in a data breach, please choose a different password", WeakPasswordPwned)
+	}
+
+	return nil
+}
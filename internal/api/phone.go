@@ -8,6 +8,7 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/nyaruka/phonenumbers"
 	"github.com/pkg/errors"
 	"github.com/supabase/gotrue/internal/api/sms_provider"
 	"github.com/supabase/gotrue/internal/crypto"
@@ -22,10 +23,38 @@ const (
 	phoneReauthenticationOtp = "reauthentication"
 )
 
-func validatePhone(phone string) (string, error) {
-	phone = formatPhoneNumber(phone)
+// validatePhone normalizes a phone number to E.164, without the leading "+".
+// Numbers starting with "+" are in international format. Other numbers are
+// parsed in the national format of the default region, or as international
+// numbers without the "+" if no default region is configured. National
+// numbers must be valid numbers of the default region.
+func validatePhone(phone, defaultRegion string) (string, error) {
+	phone = strings.TrimSpace(phone)
+
+	national := defaultRegion != "" && !strings.HasPrefix(phone, "+")
+	if !national && !strings.HasPrefix(phone, "+") {
+		phone = "+" + phone
+	}
+
+	number, err := phonenumbers.Parse(phone, defaultRegion)
+	if err != nil {
+		return "", invalidPhoneError().WithInternalError(err)
+	}
+
+	if national {
+		if !phonenumbers.IsValidNumberForRegion(number, defaultRegion) {
+			return "", invalidPhoneError()
+		}
+	} else {
+		switch phonenumbers.IsPossibleNumberWithReason(number) {
+		case phonenumbers.INVALID_COUNTRY_CODE, phonenumbers.TOO_LONG:
+			return "", invalidPhoneError()
+		}
+	}
+
+	phone = formatPhoneNumber(phonenumbers.Format(number, phonenumbers.E164))
 	if isValid := validateE164Format(phone); !isValid {
-		return "", unprocessableEntityError("Invalid phone number format (E.164 required)")
+		return "", invalidPhoneError()
 	}
 	return phone, nil
 }
@@ -88,7 +117,14 @@ func (a *API) sendPhoneConfirmation(ctx context.Context, tx *storage.Connection,
 			return "", internalServerError("error generating otp").WithInternalError(err)
 		}
 
-		message, err := generateSMSFromTemplate(config.Sms.SMSTemplate, otp)
+		locale, localized := config.Localization.Resolve(user.Locale)
+
+		smsTemplate := config.Sms.SMSTemplate
+		if localized.SMS != nil {
+			smsTemplate = localized.SMS
+		}
+
+		message, err := generateSMSFromTemplate(smsTemplate, otp, locale)
 		if err != nil {
 			return "", err
 		}
@@ -113,11 +149,12 @@ func (a *API) sendPhoneConfirmation(ctx context.Context, tx *storage.Connection,
 	return messageID, errors.Wrap(tx.UpdateOnly(user, includeFields...), "Database error updating user for confirmation")
 }
 
-func generateSMSFromTemplate(SMSTemplate *template.Template, otp string) (string, error) {
+func generateSMSFromTemplate(SMSTemplate *template.Template, otp, locale string) (string, error) {
 	var message bytes.Buffer
 	if err := SMSTemplate.Execute(&message, struct {
-		Code string
-	}{Code: otp}); err != nil {
+		Code   string
+		Locale string
+	}{Code: otp, Locale: locale}); err != nil {
 		return "", err
 	}
 	return message.String(), nil
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/stretchr/testify/assert"
@@ -17,6 +19,7 @@ import (
 	"github.com/stretchr/testify/suite"
 	"github.com/supabase/gotrue/internal/api/sms_provider"
 	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/crypto"
 	"github.com/supabase/gotrue/internal/models"
 )
 
@@ -30,11 +33,16 @@ type TestSmsProvider struct {
 	mock.Mock
 
 	SentMessages int
+	LastPhone    string
+	LastMessage  string
+	Err          error
 }
 
 func (t *TestSmsProvider) SendMessage(phone, message, channel, otp string) (string, error) {
 	t.SentMessages += 1
-	return "", nil
+	t.LastPhone = phone
+	t.LastMessage = message
+	return "", t.Err
 }
 
 func TestPhone(t *testing.T) {
@@ -69,6 +77,137 @@ func (ts *PhoneTestSuite) TestFormatPhoneNumber() {
 	assert.Equal(ts.T(), "123456789", actual)
 }
 
+func (ts *PhoneTestSuite) TestValidatePhone() {
+	cases := []struct {
+		desc          string
+		phone         string
+		defaultRegion string
+		expected      string
+		valid         bool
+	}{
+		{
+			desc:     "E.164",
+			phone:    "+12015550123",
+			expected: "12015550123",
+			valid:    true,
+		},
+		{
+			desc:     "E.164 without plus",
+			phone:    "12015550123",
+			expected: "12015550123",
+			valid:    true,
+		},
+		{
+			desc:     "international format with punctuation",
+			phone:    " +1 (201) 555-0123 ",
+			expected: "12015550123",
+			valid:    true,
+		},
+		{
+			desc:          "E.164 with a different default region",
+			phone:         "+44 121 234 5678",
+			defaultRegion: "US",
+			expected:      "441212345678",
+			valid:         true,
+		},
+		{
+			desc:          "national format with default region",
+			phone:         "(201) 555-0123",
+			defaultRegion: "US",
+			expected:      "12015550123",
+			valid:         true,
+		},
+		{
+			desc:          "national format with trunk prefix",
+			phone:         "0121 234 5678",
+			defaultRegion: "GB",
+			expected:      "441212345678",
+			valid:         true,
+		},
+		{
+			desc:          "invalid national number",
+			phone:         "12345",
+			defaultRegion: "US",
+			valid:         false,
+		},
+		{
+			desc:  "unknown country calling code",
+			phone: "+999 123456",
+			valid: false,
+		},
+		{
+			desc:  "too long",
+			phone: "+1201555012345678901",
+			valid: false,
+		},
+		{
+			desc:  "not a number",
+			phone: "not a number",
+			valid: false,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			phone, err := validatePhone(c.phone, c.defaultRegion)
+			if !c.valid {
+				require.Error(ts.T(), err)
+				httpErr, ok := err.(*HTTPError)
+				require.True(ts.T(), ok)
+				require.Equal(ts.T(), http.StatusUnprocessableEntity, httpErr.Code)
+				require.Equal(ts.T(), ErrorCodeInvalidPhone, httpErr.ErrorCode)
+				return
+			}
+
+			require.NoError(ts.T(), err)
+			require.Equal(ts.T(), c.expected, phone)
+		})
+	}
+}
+
+func (ts *PhoneTestSuite) TestOtpNormalizesNationalPhone() {
+	defer func(defaultRegion string) {
+		ts.Config.Sms.DefaultRegion = defaultRegion
+	}(ts.Config.Sms.DefaultRegion)
+	ts.Config.Sms.DefaultRegion = "US"
+
+	u, err := models.NewUser("12015550123", "", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(u))
+
+	for _, phone := range []string{"(201) 555-0123", "+1 201-555-0123"} {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"phone":       phone,
+			"create_user": false,
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "/otp", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+
+		// the user is found, sending the OTP fails later on as no SMS
+		// provider is configured in tests
+		require.NotEqual(ts.T(), http.StatusUnprocessableEntity, w.Code, w.Body.String())
+		require.NotContains(ts.T(), w.Body.String(), "Signups not allowed for otp")
+	}
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"phone": "555-0123",
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/otp", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	data := &HTTPError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+	require.Equal(ts.T(), ErrorCodeInvalidPhone, data.ErrorCode)
+}
+
 func doTestSendPhoneConfirmation(ts *PhoneTestSuite, useTestOTP bool) {
 	u, err := models.FindUserByPhoneAndAudience(ts.API.db, "123456789", ts.Config.JWT.Aud)
 	require.NoError(ts.T(), err)
@@ -149,6 +288,51 @@ func (ts *PhoneTestSuite) TestSendPhoneConfirmationWithTestOTP() {
 	doTestSendPhoneConfirmation(ts, true)
 }
 
+func (ts *PhoneTestSuite) TestSendPhoneConfirmationMessage() {
+	u, err := models.FindUserByPhoneAndAudience(ts.API.db, "123456789", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	defer func(smsTemplate *template.Template, testOTP map[string]string) {
+		ts.Config.Sms.SMSTemplate = smsTemplate
+		ts.Config.Sms.TestOTP = testOTP
+	}(ts.Config.Sms.SMSTemplate, ts.Config.Sms.TestOTP)
+	ts.Config.Sms.SMSTemplate = template.Must(template.New("").Parse("Your code is {{ .Code }}"))
+	ts.Config.Sms.TestOTP = nil
+
+	provider := &TestSmsProvider{}
+	_, err = ts.API.sendPhoneConfirmation(context.Background(), ts.API.db, u, "123456789", phoneConfirmationOtp, provider, sms_provider.SMSProvider)
+	require.NoError(ts.T(), err)
+
+	require.Equal(ts.T(), 1, provider.SentMessages)
+	require.Equal(ts.T(), "123456789", provider.LastPhone)
+	require.Regexp(ts.T(), `^Your code is \d+$`, provider.LastMessage)
+
+	otp := strings.TrimPrefix(provider.LastMessage, "Your code is ")
+	u, err = models.FindUserByPhoneAndAudience(ts.API.db, "123456789", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), crypto.GenerateTokenHash("123456789", otp), u.ConfirmationToken)
+}
+
+func (ts *PhoneTestSuite) TestSendPhoneConfirmationProviderError() {
+	u, err := models.FindUserByPhoneAndAudience(ts.API.db, "123456789", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	defer func(testOTP map[string]string) {
+		ts.Config.Sms.TestOTP = testOTP
+	}(ts.Config.Sms.TestOTP)
+	ts.Config.Sms.TestOTP = nil
+
+	providerErr := errors.New("gateway unavailable")
+	provider := &TestSmsProvider{Err: providerErr}
+	_, err = ts.API.sendPhoneConfirmation(context.Background(), ts.API.db, u, "123456789", phoneConfirmationOtp, provider, sms_provider.SMSProvider)
+	require.Equal(ts.T(), providerErr, err)
+
+	u, err = models.FindUserByPhoneAndAudience(ts.API.db, "123456789", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	require.Empty(ts.T(), u.ConfirmationToken)
+	require.Nil(ts.T(), u.ConfirmationSentAt)
+}
+
 func (ts *PhoneTestSuite) TestMissingSmsProviderConfig() {
 	u, err := models.FindUserByPhoneAndAudience(ts.API.db, "123456789", ts.Config.JWT.Aud)
 	require.NoError(ts.T(), err)
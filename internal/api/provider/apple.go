@@ -14,6 +14,16 @@ import (
 
 const IssuerApple = "https://appleid.apple.com"
 
+// ApplePrivateRelayDomain is the domain of the email addresses relayed by
+// Apple's private email relay service ("Hide My Email").
+const ApplePrivateRelayDomain = "privaterelay.appleid.com"
+
+// IsApplePrivateRelayEmail reports whether the email address is a private
+// relay address, which is unique to each app the user signed in to.
+func IsApplePrivateRelayEmail(email string) bool {
+	return strings.HasSuffix(strings.ToLower(email), "@"+ApplePrivateRelayDomain)
+}
+
 // AppleProvider stores the custom config for apple provider
 type AppleProvider struct {
 	*oauth2.Config
@@ -41,7 +51,7 @@ func NewAppleProvider(ctx context.Context, ext conf.OAuthProviderConfiguration)
 		logrus.Warn("Apple OAuth provider has URL config set which is ignored (check GOTRUE_EXTERNAL_APPLE_URL)")
 	}
 
-	oidcProvider, err := oidc.NewProvider(ctx, IssuerApple)
+	oidcProvider, err := oidc.NewProvider(discoveryContext(ctx), IssuerApple)
 	if err != nil {
 		return nil, err
 	}
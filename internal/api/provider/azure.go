@@ -44,6 +44,37 @@ func IsAzureIssuer(issuer string) bool {
 	return azureIssuerRegexp.MatchString(issuer)
 }
 
+// AzureTenantIssuer returns the OIDC issuer Azure uses in ID tokens issued
+// by the tenant with the provided ID.
+func AzureTenantIssuer(tenant string) string {
+	return "https://login.microsoftonline.com/" + tenant + "/v2.0"
+}
+
+// DetectAzureIDTokenIssuer returns the iss claim of the provided ID token
+// without verifying its signature. The returned issuer must only be used to
+// discover the provider that will then verify the ID token.
+func DetectAzureIDTokenIssuer(ctx context.Context, idToken string) (string, error) {
+	var payload struct {
+		Issuer string `json:"iss"`
+	}
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("azure: invalid ID token")
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("azure: invalid ID token %w", err)
+	}
+
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return "", fmt.Errorf("azure: invalid ID token %w", err)
+	}
+
+	return payload.Issuer, nil
+}
+
 // NewAzureProvider creates a Azure account provider.
 func NewAzureProvider(ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
 	if err := ext.ValidateOAuth(); err != nil {
@@ -90,33 +121,11 @@ func (g azureProvider) GetOAuthToken(code string) (*oauth2.Token, error) {
 	return g.Exchange(context.Background(), code)
 }
 
-func (g azureProvider) detectIDTokenIssuer(ctx context.Context, idToken string) (string, error) {
-	var payload struct {
-		Issuer string `json:"iss"`
-	}
-
-	parts := strings.Split(idToken, ".")
-	if len(parts) != 3 {
-		return "", fmt.Errorf("azure: invalid ID token")
-	}
-
-	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
-	if err != nil {
-		return "", fmt.Errorf("azure: invalid ID token %w", err)
-	}
-
-	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
-		return "", fmt.Errorf("azure: invalid ID token %w", err)
-	}
-
-	return payload.Issuer, nil
-}
-
 func (g azureProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*UserProvidedData, error) {
 	idToken := tok.Extra("id_token")
 
 	if idToken != nil {
-		issuer, err := g.detectIDTokenIssuer(ctx, idToken.(string))
+		issuer, err := DetectAzureIDTokenIssuer(ctx, idToken.(string))
 		if err != nil {
 			return nil, err
 		}
@@ -133,7 +142,7 @@ func (g azureProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*Use
 			return nil, fmt.Errorf("azure: ID token issuer %q does not match expected issuer %q", issuer, g.ExpectedIssuer)
 		}
 
-		provider, err := oidc.NewProvider(ctx, issuer)
+		provider, err := oidc.NewProvider(discoveryContext(ctx), issuer)
 		if err != nil {
 			return nil, err
 		}
@@ -15,11 +15,16 @@ import (
 const (
 	defaultGitHubAuthBase = "github.com"
 	defaultGitHubAPIBase  = "api.github.com"
+
+	// IssuerGitHub is the issuer of the ID tokens of GitHub Actions, which
+	// identify workflow runs rather than GitHub users.
+	IssuerGitHub = "https://token.actions.githubusercontent.com"
 )
 
 type githubProvider struct {
 	*oauth2.Config
-	APIHost string
+	APIHost         string
+	allowEmptyEmail bool
 }
 
 type githubUser struct {
@@ -67,7 +72,8 @@ func NewGithubProvider(ext conf.OAuthProviderConfiguration, scopes string) (OAut
 			RedirectURL: ext.RedirectURI,
 			Scopes:      oauthScopes,
 		},
-		APIHost: apiHost,
+		APIHost:         apiHost,
+		allowEmptyEmail: ext.AllowEmptyEmail,
 	}, nil
 }
 
@@ -96,15 +102,13 @@ func (g githubProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*Us
 		},
 	}
 
-	var emails []*githubUserEmail
-	if err := makeRequest(ctx, tok, g.Config, g.APIHost+"/user/emails", &emails); err != nil {
+	emails, err := g.getEmails(ctx, tok)
+	if err != nil {
 		return nil, err
 	}
 
 	for _, e := range emails {
-		if e.Email != "" {
-			data.Emails = append(data.Emails, Email{Email: e.Email, Verified: e.Verified, Primary: e.Primary})
-		}
+		data.Emails = append(data.Emails, e)
 
 		if e.Primary {
 			data.Metadata.Email = e.Email
@@ -112,9 +116,27 @@ func (g githubProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*Us
 		}
 	}
 
-	if len(data.Emails) <= 0 {
+	return data, nil
+}
+
+func (g githubProvider) getEmails(ctx context.Context, tok *oauth2.Token) ([]Email, error) {
+	var emails []*githubUserEmail
+	if err := makeRequest(ctx, tok, g.Config, g.APIHost+"/user/emails", &emails); err != nil {
+		return nil, err
+	}
+
+	var result []Email
+	for _, e := range emails {
+		if e.Email != "" {
+			result = append(result, Email{Email: e.Email, Verified: e.Verified, Primary: e.Primary})
+		}
+	}
+
+	// users can hide all their email addresses, in which case they are only
+	// identified by their GitHub user ID if configured
+	if len(result) <= 0 && !g.allowEmptyEmail {
 		return nil, errors.New("unable to find email with GitHub provider")
 	}
 
-	return data, nil
+	return result, nil
 }
@@ -56,7 +56,7 @@ func NewGoogleProvider(ctx context.Context, ext conf.OAuthProviderConfiguration,
 		oauthScopes = append(oauthScopes, strings.Split(scopes, ",")...)
 	}
 
-	oidcProvider, err := oidc.NewProvider(ctx, internalIssuerGoogle)
+	oidcProvider, err := oidc.NewProvider(discoveryContext(ctx), internalIssuerGoogle)
 	if err != nil {
 		return nil, err
 	}
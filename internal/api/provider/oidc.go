@@ -4,19 +4,56 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/golang-jwt/jwt"
+	"github.com/supabase/gotrue/internal/observability"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type ParseIDTokenOptions struct {
 	SkipAccessTokenCheck bool
 	AccessToken          string
+
+	// ClockSkewTolerance is how far the current time may be past the exp
+	// claim, or before the iat claim, of an ID token that is accepted.
+	ClockSkewTolerance time.Duration
+
+	// InferSigningAlgorithm accepts ID tokens signed with any of the
+	// InferableSigningAlgorithms named in their header, instead of only
+	// those the provider advertises (RS256 if it advertises none). This
+	// allows verifying ID tokens with keys that don't declare their
+	// algorithm.
+	InferSigningAlgorithm bool
+
+	// AllowEmptyEmail accepts ID tokens of generic OIDC providers that
+	// don't contain an email address.
+	AllowEmptyEmail bool
+}
+
+// InferableSigningAlgorithms are the algorithms an ID token may be signed
+// with when its signing algorithm is inferred from its header. Symmetric
+// algorithms are never inferred, as the provider's public key would be used
+// as the secret.
+var InferableSigningAlgorithms = []string{
+	oidc.RS256, oidc.RS384, oidc.RS512,
+	oidc.ES256, oidc.ES384, oidc.ES512,
+	oidc.PS256, oidc.PS384, oidc.PS512,
 }
 
+// ErrIssuedInFuture is returned by ParseIDToken when the iat claim of the ID
+// token is further in the future than the clock skew tolerance.
+var ErrIssuedInFuture = errors.New("provider: ID token is issued in the future")
+
+// ErrMissingAccessToken is returned by ParseIDToken when the ID token has an
+// at_hash claim and the access token check was requested, but no access token
+// was provided.
+var ErrMissingAccessToken = errors.New("provider: ID token has at_hash claim but no access token was provided")
+
 // OverrideVerifiers can be used to set a custom verifier for an OIDC provider
 // (identified by the provider's Endpoint().AuthURL string). Should only be
 // used in tests.
@@ -27,6 +64,19 @@ var OverrideVerifiers = make(map[string]func(context.Context, *oidc.Config) *oid
 var OverrideClock func() time.Time
 
 func ParseIDToken(ctx context.Context, provider *oidc.Provider, config *oidc.Config, idToken string, options ParseIDTokenOptions) (*oidc.IDToken, *UserProvidedData, error) {
+	ctx, span := observability.StartChildSpan(ctx, "oidc.parse_id_token")
+
+	token, data, err := parseIDToken(ctx, provider, config, idToken, options)
+	if token != nil {
+		span.SetAttributes(attribute.String("gotrue.oidc.issuer", token.Issuer))
+	}
+
+	observability.EndSpan(span, err)
+
+	return token, data, err
+}
+
+func parseIDToken(ctx context.Context, provider *oidc.Provider, config *oidc.Config, idToken string, options ParseIDTokenOptions) (*oidc.IDToken, *UserProvidedData, error) {
 	if config == nil {
 		config = &oidc.Config{
 			// aud claim check to be performed by other flows
@@ -34,13 +84,36 @@ func ParseIDToken(ctx context.Context, provider *oidc.Provider, config *oidc.Con
 		}
 	}
 
+	now := time.Now
+	if config.Now != nil {
+		now = config.Now
+	}
+
 	if OverrideClock != nil {
+		now = OverrideClock
+	}
+
+	if OverrideClock != nil || options.ClockSkewTolerance > 0 {
 		clonedConfig := *config
-		clonedConfig.Now = OverrideClock
+		clonedConfig.Now = func() time.Time {
+			// the verifier rejects ID tokens that expired before
+			// this time
+			return now().Add(-options.ClockSkewTolerance)
+		}
 		config = &clonedConfig
 	}
 
-	verifier := provider.VerifierContext(ctx, config)
+	if options.InferSigningAlgorithm {
+		if alg := inferSigningAlgorithm(idToken); alg != "" {
+			clonedConfig := *config
+			clonedConfig.SupportedSigningAlgs = []string{alg}
+			config = &clonedConfig
+		}
+	}
+
+	// the key set fetches signing keys with the discovery client, which
+	// enforces the TLS requirements and retries failing requests
+	verifier := provider.VerifierContext(discoveryContext(ctx), config)
 	overrideVerifier, ok := OverrideVerifiers[provider.Endpoint().AuthURL]
 	if ok && overrideVerifier != nil {
 		verifier = overrideVerifier(ctx, config)
@@ -51,6 +124,10 @@ func ParseIDToken(ctx context.Context, provider *oidc.Provider, config *oidc.Con
 		return nil, nil, err
 	}
 
+	if token.IssuedAt.After(now().Add(options.ClockSkewTolerance)) {
+		return nil, nil, ErrIssuedInFuture
+	}
+
 	var data *UserProvidedData
 
 	switch token.Issuer {
@@ -64,7 +141,7 @@ func ParseIDToken(ctx context.Context, provider *oidc.Provider, config *oidc.Con
 		if IsAzureIssuer(token.Issuer) {
 			token, data, err = parseAzureIDToken(token)
 		} else {
-			token, data, err = parseGenericIDToken(token)
+			token, data, err = parseGenericIDToken(token, options.AllowEmptyEmail)
 		}
 	}
 
@@ -72,7 +149,15 @@ func ParseIDToken(ctx context.Context, provider *oidc.Provider, config *oidc.Con
 		return nil, nil, err
 	}
 
+	if err := token.Claims(&data.RawClaims); err != nil {
+		return nil, nil, err
+	}
+
 	if !options.SkipAccessTokenCheck && token.AccessTokenHash != "" {
+		if options.AccessToken == "" {
+			return nil, nil, ErrMissingAccessToken
+		}
+
 		if err := token.VerifyAccessToken(options.AccessToken); err != nil {
 			return nil, nil, err
 		}
@@ -81,6 +166,26 @@ func ParseIDToken(ctx context.Context, provider *oidc.Provider, config *oidc.Con
 	return token, data, nil
 }
 
+// inferSigningAlgorithm returns the signing algorithm in the header of the ID
+// token if it's one of the InferableSigningAlgorithms. The signature is
+// still verified with the provider's keys, which must be of the algorithm's
+// key type.
+func inferSigningAlgorithm(idToken string) string {
+	token, _, err := new(jwt.Parser).ParseUnverified(idToken, jwt.MapClaims{})
+	if err != nil {
+		return ""
+	}
+
+	alg, _ := token.Header["alg"].(string)
+	for _, inferable := range InferableSigningAlgorithms {
+		if alg == inferable {
+			return alg
+		}
+	}
+
+	return ""
+}
+
 func parseGoogleIDToken(token *oidc.IDToken) (*oidc.IDToken, *UserProvidedData, error) {
 	var claims googleUser
 	if err := token.Claims(&claims); err != nil {
@@ -175,13 +280,32 @@ type LinkedinIDTokenClaims struct {
 	jwt.StandardClaims
 
 	Email         string `json:"email"`
-	EmailVerified string `json:"email_verified"`
+	EmailVerified any    `json:"email_verified"`
+	Name          string `json:"name"`
 	FamilyName    string `json:"family_name"`
 	GivenName     string `json:"given_name"`
 	Locale        string `json:"locale"`
 	Picture       string `json:"picture"`
 }
 
+// IsEmailVerified reports whether the email_verified claim is set. LinkedIn
+// has been seen to encode it both as a JSON boolean and as a string.
+func (c *LinkedinIDTokenClaims) IsEmailVerified() (bool, error) {
+	switch v := c.EmailVerified.(type) {
+	case nil:
+		return false, nil
+
+	case bool:
+		return v, nil
+
+	case string:
+		return strconv.ParseBool(v)
+
+	default:
+		return false, fmt.Errorf("provider: unsupported email_verified claim type %T in LinkedIn ID token", v)
+	}
+}
+
 func parseLinkedinIDToken(token *oidc.IDToken) (*oidc.IDToken, *UserProvidedData, error) {
 	var claims LinkedinIDTokenClaims
 	if err := token.Claims(&claims); err != nil {
@@ -189,27 +313,43 @@ func parseLinkedinIDToken(token *oidc.IDToken) (*oidc.IDToken, *UserProvidedData
 	}
 
 	var data UserProvidedData
-	emailVerified, err := strconv.ParseBool(claims.EmailVerified)
+	emailVerified, err := claims.IsEmailVerified()
 	if err != nil {
 		return nil, nil, err
 	}
-	data.Emails = append(data.Emails, Email{
-		Email:    claims.Email,
-		Verified: emailVerified,
-		Primary:  true,
-	})
+
+	if claims.Email != "" {
+		data.Emails = append(data.Emails, Email{
+			Email:    claims.Email,
+			Verified: emailVerified,
+			Primary:  true,
+		})
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = strings.TrimSpace(claims.GivenName + " " + claims.FamilyName)
+	}
 
 	data.Metadata = &Claims{
 		Issuer:        token.Issuer,
 		Subject:       token.Subject,
 		Email:         claims.Email,
 		EmailVerified: emailVerified,
-		Name:          strings.TrimSpace(claims.GivenName + " " + claims.FamilyName),
+		Name:          name,
 		GivenName:     claims.GivenName,
 		FamilyName:    claims.FamilyName,
 		Locale:        claims.Locale,
 		Picture:       claims.Picture,
 		ProviderId:    token.Subject,
+
+		// To be deprecated
+		AvatarURL: claims.Picture,
+		FullName:  name,
+	}
+
+	if len(data.Emails) <= 0 {
+		return nil, nil, errors.New("provider: LinkedIn ID token must contain an email address")
 	}
 
 	return token, &data, nil
@@ -221,6 +361,7 @@ type AzureIDTokenClaims struct {
 	Email                              string `json:"email"`
 	Name                               string `json:"name"`
 	PreferredUsername                  string `json:"preferred_username"`
+	TenantID                           string `json:"tid"`
 	XMicrosoftEmailDomainOwnerVerified any    `json:"xms_edov"`
 }
 
@@ -326,7 +467,7 @@ func parseAzureIDToken(token *oidc.IDToken) (*oidc.IDToken, *UserProvidedData, e
 	return token, &data, nil
 }
 
-func parseGenericIDToken(token *oidc.IDToken) (*oidc.IDToken, *UserProvidedData, error) {
+func parseGenericIDToken(token *oidc.IDToken, allowEmptyEmail bool) (*oidc.IDToken, *UserProvidedData, error) {
 	var data UserProvidedData
 
 	if err := token.Claims(&data.Metadata); err != nil {
@@ -341,9 +482,46 @@ func parseGenericIDToken(token *oidc.IDToken) (*oidc.IDToken, *UserProvidedData,
 		})
 	}
 
-	if len(data.Emails) <= 0 {
+	if len(data.Emails) <= 0 && !allowEmptyEmail {
 		return nil, nil, fmt.Errorf("provider: Generic OIDC ID token from issuer %q must contain an email address", token.Issuer)
 	}
 
 	return token, &data, nil
 }
+
+// EndSessionURL returns the URL of the provider's end_session_endpoint for
+// RP-initiated logout, with the optional id_token_hint, client_id and
+// post_logout_redirect_uri parameters set. It returns an empty string if the
+// provider does not advertise an end_session_endpoint.
+func EndSessionURL(p *oidc.Provider, idTokenHint, clientID, postLogoutRedirectURI string) (string, error) {
+	var claims struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+
+	if err := p.Claims(&claims); err != nil {
+		return "", err
+	}
+
+	if claims.EndSessionEndpoint == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(claims.EndSessionEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	if idTokenHint != "" {
+		q.Set("id_token_hint", idTokenHint)
+	}
+	if clientID != "" {
+		q.Set("client_id", clientID)
+	}
+	if postLogoutRedirectURI != "" {
+		q.Set("post_logout_redirect_uri", postLogoutRedirectURI)
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
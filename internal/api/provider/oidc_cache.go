@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/supabase/gotrue/internal/observability"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
+)
+
+type oidcProviderCacheEntry struct {
+	provider  *oidc.Provider
+	expiresAt time.Time
+}
+
+// OIDCProviderCache caches OIDC providers (discovery document and JWKS
+// endpoint) by discovery URL, so that they are not discovered again on every
+// request. Concurrent discoveries of the same URL are deduplicated and failed
+// discoveries are not cached.
+//
+// Caching a provider does not prevent picking up rotated signing keys, as the
+// provider's key set fetches the JWKS again when it encounters an ID token
+// signed with an unknown key. Only these fetches are retried by the discovery
+// client (see ConfigureDiscoveryRetry), never requests using cached providers.
+type OIDCProviderCache struct {
+	ttl   time.Duration
+	now   func() time.Time
+	group singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]oidcProviderCacheEntry
+}
+
+// NewOIDCProviderCache creates a cache that keeps providers for the TTL. A
+// TTL of zero or less disables caching.
+func NewOIDCProviderCache(ttl time.Duration) *OIDCProviderCache {
+	return &OIDCProviderCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]oidcProviderCacheEntry),
+	}
+}
+
+// Get returns the cached provider for the discovery URL, discovering it with
+// oidc.NewProvider if it's not cached or has expired. Since providers are
+// cached by discovery URL only, any issuer override set on the context with
+// oidc.InsecureIssuerURLContext must always be the same for a given URL.
+func (c *OIDCProviderCache) Get(ctx context.Context, discoveryURL string) (*oidc.Provider, error) {
+	return c.get(ctx, "discovery:"+discoveryURL, func(ctx context.Context) (*oidc.Provider, error) {
+		ctx, span := observability.StartChildSpan(ctx, "oidc.discover_provider", attribute.String("gotrue.oidc.discovery_url", discoveryURL))
+
+		oidcProvider, err := oidc.NewProvider(discoveryContext(ctx), discoveryURL)
+		observability.EndSpan(span, err)
+
+		return oidcProvider, err
+	})
+}
+
+// GetWithJWKS returns the cached provider for the issuer that fetches its
+// signing keys from the JWKS URL, without using OIDC discovery. This allows
+// verifying ID tokens whose issuer is not reachable from GoTrue, as the keys
+// can be fetched from another (e.g. internal) URL.
+func (c *OIDCProviderCache) GetWithJWKS(ctx context.Context, issuer, jwksURL string) (*oidc.Provider, error) {
+	return c.get(ctx, "jwks:"+issuer+" "+jwksURL, func(ctx context.Context) (*oidc.Provider, error) {
+		return (&oidc.ProviderConfig{
+			IssuerURL: issuer,
+			JWKSURL:   jwksURL,
+		}).NewProvider(discoveryContext(ctx)), nil
+	})
+}
+
+func (c *OIDCProviderCache) get(ctx context.Context, key string, newProvider func(context.Context) (*oidc.Provider, error)) (*oidc.Provider, error) {
+	if c == nil || c.ttl <= 0 {
+		return newProvider(ctx)
+	}
+
+	if cached := c.lookup(key); cached != nil {
+		return cached, nil
+	}
+
+	result, err, _ := c.group.Do(key, func() (interface{}, error) {
+		// another caller may have just finished discovering it
+		if cached := c.lookup(key); cached != nil {
+			return cached, nil
+		}
+
+		// the discovery is shared by all callers waiting for it, so it
+		// must not fail when the caller that started it goes away
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, defaultTimeout)
+		defer cancel()
+
+		oidcProvider, err := newProvider(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.entries[key] = oidcProviderCacheEntry{
+			provider:  oidcProvider,
+			expiresAt: c.now().Add(c.ttl),
+		}
+
+		return oidcProvider, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(*oidc.Provider), nil
+}
+
+func (c *OIDCProviderCache) lookup(key string) *oidc.Provider {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if !c.now().Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil
+	}
+
+	return entry.provider
+}
+
+// detachedContext keeps the values of its parent, such as the span, HTTP
+// client or issuer override, but is never cancelled with it.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
@@ -0,0 +1,281 @@
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestDiscoveryServer(t *testing.T) (*httptest.Server, *int32) {
+	var discoveries int32
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/.well-known/openid-configuration") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		atomic.AddInt32(&discoveries, 1)
+
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+			"end_session_endpoint":   server.URL + "/logout?tenant=example",
+		}))
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, &discoveries
+}
+
+func TestOIDCProviderCache(t *testing.T) {
+	server, discoveries := newTestDiscoveryServer(t)
+
+	now := time.Now()
+
+	cache := NewOIDCProviderCache(time.Minute)
+	cache.now = func() time.Time {
+		return now
+	}
+
+	first, err := cache.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(discoveries))
+
+	second, err := cache.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(discoveries), "cached provider should be used")
+	require.Same(t, first, second)
+
+	now = now.Add(time.Minute)
+
+	third, err := cache.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(discoveries), "expired provider should be discovered again")
+	require.NotSame(t, first, third)
+
+	_, err = cache.Get(context.Background(), server.URL+"/failing")
+	require.Error(t, err)
+
+	_, err = cache.Get(context.Background(), server.URL+"/failing")
+	require.Error(t, err)
+	require.Equal(t, int32(4), atomic.LoadInt32(discoveries), "failed discoveries should not be cached")
+}
+
+func TestOIDCProviderCacheSpans(t *testing.T) {
+	server, _ := newTestDiscoveryServer(t)
+
+	exporter := tracetest.NewInMemoryExporter()
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSpanProcessor(sdktrace.NewSimpleSpanProcessor(exporter)),
+	)
+
+	cache := NewOIDCProviderCache(0)
+
+	// discoveries are only traced as part of a traced operation
+	_, err := cache.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	require.Empty(t, exporter.GetSpans())
+
+	ctx, parent := tracerProvider.Tracer("test").Start(context.Background(), "parent")
+
+	_, err = cache.Get(ctx, server.URL)
+	require.NoError(t, err)
+
+	_, err = cache.Get(ctx, server.URL+"/failing")
+	require.Error(t, err)
+
+	parent.End()
+
+	spans := exporter.GetSpans().Snapshots()
+	require.Len(t, spans, 3)
+
+	for i, expected := range []struct {
+		url     string
+		outcome string
+		status  codes.Code
+	}{
+		{server.URL, "success", codes.Unset},
+		{server.URL + "/failing", "failure", codes.Error},
+	} {
+		span := spans[i]
+		require.Equal(t, "oidc.discover_provider", span.Name())
+		require.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+		require.Contains(t, span.Attributes(), attribute.String("gotrue.oidc.discovery_url", expected.url))
+		require.Contains(t, span.Attributes(), attribute.String("gotrue.outcome", expected.outcome))
+		require.Equal(t, expected.status, span.Status().Code)
+	}
+}
+
+func TestOIDCProviderCacheConcurrentDiscovery(t *testing.T) {
+	server, discoveries := newTestDiscoveryServer(t)
+
+	cache := NewOIDCProviderCache(time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := cache.Get(context.Background(), server.URL)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(discoveries))
+}
+
+func TestOIDCProviderCacheDisabled(t *testing.T) {
+	server, discoveries := newTestDiscoveryServer(t)
+
+	cache := NewOIDCProviderCache(0)
+
+	for i := 0; i < 3; i++ {
+		_, err := cache.Get(context.Background(), server.URL)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, int32(3), atomic.LoadInt32(discoveries))
+}
+
+func TestOIDCProviderCacheWithJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var jwksRequests int32
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&jwksRequests, 1)
+
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]any{
+				{
+					"kty": "RSA",
+					"kid": "internal-key",
+					"alg": "RS256",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+				},
+			},
+		}))
+	}))
+	defer jwksServer.Close()
+
+	const publicIssuer = "https://keycloak.example.com/realms/public"
+
+	mintIDToken := func(issuer string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":   issuer,
+			"sub":   "keycloak-subject",
+			"email": "keycloak@example.com",
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "internal-key"
+
+		idToken, err := token.SignedString(key)
+		require.NoError(t, err)
+
+		return idToken
+	}
+
+	cache := NewOIDCProviderCache(time.Minute)
+
+	oidcProvider, err := cache.GetWithJWKS(context.Background(), publicIssuer, jwksServer.URL)
+	require.NoError(t, err)
+
+	_, data, err := ParseIDToken(context.Background(), oidcProvider, nil, mintIDToken(publicIssuer), ParseIDTokenOptions{
+		SkipAccessTokenCheck: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "keycloak@example.com", data.Emails[0].Email)
+
+	_, _, err = ParseIDToken(context.Background(), oidcProvider, nil, mintIDToken(jwksServer.URL), ParseIDTokenOptions{
+		SkipAccessTokenCheck: true,
+	})
+	require.Error(t, err, "ID tokens not issued by the configured issuer must be rejected")
+
+	cachedProvider, err := cache.GetWithJWKS(context.Background(), publicIssuer, jwksServer.URL)
+	require.NoError(t, err)
+	require.Same(t, oidcProvider, cachedProvider)
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&jwksRequests), "JWKS should only be fetched once")
+}
+
+func TestOIDCProviderCacheCancelledCaller(t *testing.T) {
+	server, discoveries := newTestDiscoveryServer(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer slowServer.Close()
+
+	cache := NewOIDCProviderCache(time.Minute)
+
+	// the issuer override of the first caller must still be used
+	issuerContext := oidc.InsecureIssuerURLContext(context.Background(), server.URL)
+	ctx, cancel := context.WithCancel(issuerContext)
+
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := cache.Get(ctx, slowServer.URL)
+		firstErr <- err
+	}()
+
+	<-started
+
+	secondErr := make(chan error, 1)
+	go func() {
+		_, err := cache.Get(issuerContext, slowServer.URL)
+		secondErr <- err
+	}()
+
+	// the second caller must be waiting for the discovery of the first
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	close(release)
+
+	require.NoError(t, <-firstErr)
+	require.NoError(t, <-secondErr, "cancelling the first caller must not fail the others")
+	require.Equal(t, int32(1), atomic.LoadInt32(discoveries))
+}
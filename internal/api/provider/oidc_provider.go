@@ -0,0 +1,75 @@
+package provider
+
+import (
+	"context"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/supabase/gotrue/internal/conf"
+	"golang.org/x/oauth2"
+)
+
+type genericOIDCProvider struct {
+	*oauth2.Config
+	oidc            *oidc.Provider
+	allowEmptyEmail bool
+}
+
+// NewGenericOIDCProvider creates a provider for an OIDC provider that's
+// discovered from its issuer, such as the providers loaded from the
+// providers directory.
+func NewGenericOIDCProvider(ctx context.Context, ext conf.OAuthProviderConfiguration, scopes string) (OAuthProvider, error) {
+	if err := ext.ValidateOAuth(); err != nil {
+		return nil, err
+	}
+
+	oidcProvider, err := oidc.NewProvider(discoveryContext(ctx), ext.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	oauthScopes := []string{
+		oidc.ScopeOpenID,
+		"email",
+		"profile",
+	}
+
+	if scopes != "" {
+		oauthScopes = append(oauthScopes, strings.Split(scopes, ",")...)
+	}
+
+	return &genericOIDCProvider{
+		oidc:            oidcProvider,
+		allowEmptyEmail: ext.AllowEmptyEmail,
+		Config: &oauth2.Config{
+			ClientID:     ext.ClientID[0],
+			ClientSecret: ext.Secret,
+			Endpoint:     oidcProvider.Endpoint(),
+			Scopes:       oauthScopes,
+			RedirectURL:  ext.RedirectURI,
+		},
+	}, nil
+}
+
+func (p genericOIDCProvider) GetOAuthToken(code string) (*oauth2.Token, error) {
+	return p.Exchange(context.Background(), code)
+}
+
+func (p genericOIDCProvider) GetUserData(ctx context.Context, tok *oauth2.Token) (*UserProvidedData, error) {
+	idToken := tok.Extra("id_token")
+	if tok.AccessToken == "" || idToken == nil {
+		return &UserProvidedData{}, nil
+	}
+
+	_, data, err := ParseIDToken(ctx, p.oidc, &oidc.Config{
+		ClientID: p.ClientID,
+	}, idToken.(string), ParseIDTokenOptions{
+		AccessToken:     tok.AccessToken,
+		AllowEmptyEmail: p.allowEmptyEmail,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -3,13 +3,22 @@ package provider
 import (
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/require"
 )
 
@@ -183,3 +192,340 @@ func TestAzureIDTokenClaimsIsEmailVerified(t *testing.T) {
 		}
 	}
 }
+
+// testIDTokenProvider returns an OIDC provider for the issuer whose verifier
+// trusts a freshly generated key, along with a function that signs ID tokens
+// with that key. It does not make any network requests.
+func testIDTokenProvider(t *testing.T, issuer string) (*oidc.Provider, func(jwt.MapClaims) string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	oidcProvider := (&oidc.ProviderConfig{
+		IssuerURL: issuer,
+		AuthURL:   issuer + "/authorize",
+		TokenURL:  issuer + "/token",
+		JWKSURL:   issuer + "/jwks",
+	}).NewProvider(context.Background())
+
+	OverrideVerifiers[oidcProvider.Endpoint().AuthURL] = func(ctx context.Context, config *oidc.Config) *oidc.IDTokenVerifier {
+		return oidc.NewVerifier(issuer, &oidc.StaticKeySet{
+			PublicKeys: []crypto.PublicKey{&key.PublicKey},
+		}, config)
+	}
+
+	t.Cleanup(func() {
+		delete(OverrideVerifiers, oidcProvider.Endpoint().AuthURL)
+	})
+
+	return oidcProvider, func(claims jwt.MapClaims) string {
+		now := time.Now()
+
+		if _, ok := claims["iss"]; !ok {
+			claims["iss"] = issuer
+		}
+
+		claims["iat"] = now.Unix()
+		claims["exp"] = now.Add(time.Hour).Unix()
+
+		idToken, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+		require.NoError(t, err)
+
+		return idToken
+	}
+}
+
+func TestParseLinkedinIDToken(t *testing.T) {
+	oidcProvider, mintIDToken := testIDTokenProvider(t, IssuerLinkedin)
+
+	examples := []struct {
+		emailVerified any
+		expected      bool
+	}{
+		{emailVerified: true, expected: true},
+		{emailVerified: "true", expected: true},
+		{emailVerified: false, expected: false},
+		{emailVerified: nil, expected: false},
+	}
+
+	for _, example := range examples {
+		claims := jwt.MapClaims{
+			"sub":     "linkedin-subject",
+			"aud":     "linkedin-client-id",
+			"email":   "linkedin@example.com",
+			"name":    "Linked In",
+			"picture": "https://media.licdn.com/picture.jpg",
+		}
+
+		if example.emailVerified != nil {
+			claims["email_verified"] = example.emailVerified
+		}
+
+		_, data, err := ParseIDToken(context.Background(), oidcProvider, nil, mintIDToken(claims), ParseIDTokenOptions{
+			SkipAccessTokenCheck: true,
+		})
+		require.NoError(t, err)
+
+		require.Len(t, data.Emails, 1)
+		require.Equal(t, "linkedin@example.com", data.Emails[0].Email)
+		require.Equal(t, example.expected, data.Emails[0].Verified)
+		require.Equal(t, example.expected, data.Metadata.EmailVerified)
+		require.Equal(t, "linkedin-subject", data.Metadata.Subject)
+		require.Equal(t, "Linked In", data.Metadata.Name)
+		require.Equal(t, "https://media.licdn.com/picture.jpg", data.Metadata.Picture)
+	}
+
+	_, _, err := ParseIDToken(context.Background(), oidcProvider, nil, mintIDToken(jwt.MapClaims{
+		"sub": "linkedin-subject",
+	}), ParseIDTokenOptions{
+		SkipAccessTokenCheck: true,
+	})
+	require.Error(t, err, "LinkedIn ID tokens without an email address must be rejected")
+}
+
+func TestParseGenericIDTokenAllowEmptyEmail(t *testing.T) {
+	oidcProvider, mintIDToken := testIDTokenProvider(t, "https://oidc.example.com")
+
+	idToken := mintIDToken(jwt.MapClaims{
+		"sub": "oidc-subject",
+		"aud": "oidc-client-id",
+	})
+
+	_, _, err := ParseIDToken(context.Background(), oidcProvider, nil, idToken, ParseIDTokenOptions{
+		SkipAccessTokenCheck: true,
+	})
+	require.Error(t, err, "ID tokens without an email address must be rejected by default")
+
+	_, data, err := ParseIDToken(context.Background(), oidcProvider, nil, idToken, ParseIDTokenOptions{
+		SkipAccessTokenCheck: true,
+		AllowEmptyEmail:      true,
+	})
+	require.NoError(t, err)
+	require.Empty(t, data.Emails)
+	require.Equal(t, "oidc-subject", data.Metadata.Subject)
+}
+
+func TestParseIDTokenAccessTokenCheck(t *testing.T) {
+	oidcProvider, mintIDToken := testIDTokenProvider(t, "https://oidc.example.com")
+
+	accessTokenHash := sha256.Sum256([]byte("access-token"))
+
+	idToken := mintIDToken(jwt.MapClaims{
+		"sub":     "oidc-subject",
+		"email":   "oidc@example.com",
+		"at_hash": base64.RawURLEncoding.EncodeToString(accessTokenHash[:len(accessTokenHash)/2]),
+	})
+
+	_, _, err := ParseIDToken(context.Background(), oidcProvider, nil, idToken, ParseIDTokenOptions{
+		AccessToken: "access-token",
+	})
+	require.NoError(t, err)
+
+	_, _, err = ParseIDToken(context.Background(), oidcProvider, nil, idToken, ParseIDTokenOptions{
+		SkipAccessTokenCheck: true,
+	})
+	require.NoError(t, err)
+
+	_, _, err = ParseIDToken(context.Background(), oidcProvider, nil, idToken, ParseIDTokenOptions{})
+	require.ErrorIs(t, err, ErrMissingAccessToken)
+
+	_, _, err = ParseIDToken(context.Background(), oidcProvider, nil, idToken, ParseIDTokenOptions{
+		AccessToken: "other-access-token",
+	})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrMissingAccessToken)
+}
+
+func TestParseIDTokenInferSigningAlgorithm(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	// the key doesn't declare its algorithm, and there's no discovery
+	// document advertising it either
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]interface{}{
+				{
+					"kty": "EC",
+					"kid": "ec-key",
+					"crv": "P-256",
+					"use": "sig",
+					"x":   base64.RawURLEncoding.EncodeToString(key.PublicKey.X.FillBytes(make([]byte, 32))),
+					"y":   base64.RawURLEncoding.EncodeToString(key.PublicKey.Y.FillBytes(make([]byte, 32))),
+				},
+			},
+		}))
+	}))
+	defer server.Close()
+
+	const issuer = "https://oidc.example.com"
+
+	oidcProvider := (&oidc.ProviderConfig{
+		IssuerURL: issuer,
+		JWKSURL:   server.URL,
+	}).NewProvider(context.Background())
+
+	mintIDToken := func(method jwt.SigningMethod, signingKey interface{}) string {
+		now := time.Now()
+
+		token := jwt.NewWithClaims(method, jwt.MapClaims{
+			"iss":   issuer,
+			"sub":   "oidc-subject",
+			"email": "oidc@example.com",
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "ec-key"
+
+		idToken, err := token.SignedString(signingKey)
+		require.NoError(t, err)
+
+		return idToken
+	}
+
+	idToken := mintIDToken(jwt.SigningMethodES256, key)
+
+	_, _, err = ParseIDToken(context.Background(), oidcProvider, nil, idToken, ParseIDTokenOptions{
+		SkipAccessTokenCheck: true,
+	})
+	require.Error(t, err, "only RS256 is accepted by default")
+
+	_, data, err := ParseIDToken(context.Background(), oidcProvider, nil, idToken, ParseIDTokenOptions{
+		SkipAccessTokenCheck:  true,
+		InferSigningAlgorithm: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "oidc-subject", data.Metadata.Subject)
+
+	// symmetric algorithms are never inferred
+	_, _, err = ParseIDToken(context.Background(), oidcProvider, nil, mintIDToken(jwt.SigningMethodHS256, []byte("secret")), ParseIDTokenOptions{
+		SkipAccessTokenCheck:  true,
+		InferSigningAlgorithm: true,
+	})
+	require.Error(t, err)
+
+	// the key must still match the inferred algorithm
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	_, _, err = ParseIDToken(context.Background(), oidcProvider, nil, mintIDToken(jwt.SigningMethodRS256, rsaKey), ParseIDTokenOptions{
+		SkipAccessTokenCheck:  true,
+		InferSigningAlgorithm: true,
+	})
+	require.Error(t, err)
+}
+
+func TestParseIDTokenRawClaims(t *testing.T) {
+	oidcProvider, mintIDToken := testIDTokenProvider(t, "https://issuer.example.com")
+
+	_, data, err := ParseIDToken(context.Background(), oidcProvider, nil, mintIDToken(jwt.MapClaims{
+		"sub":   "generic-subject",
+		"email": "generic@example.com",
+		"realm_access": map[string]interface{}{
+			"roles": []string{"admin"},
+		},
+	}), ParseIDTokenOptions{
+		SkipAccessTokenCheck: true,
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, "generic-subject", data.RawClaims["sub"])
+	require.Equal(t, map[string]interface{}{
+		"roles": []interface{}{"admin"},
+	}, data.RawClaims["realm_access"])
+}
+
+func TestMapClaims(t *testing.T) {
+	claims := map[string]interface{}{
+		"department":                "engineering",
+		"https://example.com/roles": []interface{}{"admin"},
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"editor"},
+		},
+		"unmapped": "ignored",
+	}
+
+	mapped := MapClaims(claims, map[string]string{
+		"department":                "department",
+		"https://example.com/roles": "roles",
+		"realm_access.roles":        "realm_roles",
+		"realm_access.missing":      "missing",
+		"department.name":           "department_name",
+	})
+
+	require.Equal(t, map[string]interface{}{
+		"department":  "engineering",
+		"roles":       []interface{}{"admin"},
+		"realm_roles": []interface{}{"editor"},
+	}, mapped)
+
+	require.Empty(t, MapClaims(nil, map[string]string{"department": "department"}))
+}
+
+func TestEndSessionURL(t *testing.T) {
+	server, _ := newTestDiscoveryServer(t)
+
+	oidcProvider, err := oidc.NewProvider(context.Background(), server.URL)
+	require.NoError(t, err)
+
+	logoutURL, err := EndSessionURL(oidcProvider, "id-token", "client-id", "https://example.com/signed-out?a=b")
+	require.NoError(t, err)
+
+	u, err := url.Parse(logoutURL)
+	require.NoError(t, err)
+	require.Equal(t, server.URL+"/logout", u.Scheme+"://"+u.Host+u.Path)
+	require.Equal(t, url.Values{
+		"tenant":                   {"example"},
+		"id_token_hint":            {"id-token"},
+		"client_id":                {"client-id"},
+		"post_logout_redirect_uri": {"https://example.com/signed-out?a=b"},
+	}, u.Query())
+
+	logoutURL, err = EndSessionURL(oidcProvider, "", "", "")
+	require.NoError(t, err)
+	require.Equal(t, server.URL+"/logout?tenant=example", logoutURL)
+}
+
+func TestEndSessionURLNotAdvertised(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]any{
+			"issuer":   server.URL,
+			"jwks_uri": server.URL + "/jwks",
+		}))
+	}))
+	defer server.Close()
+
+	oidcProvider, err := oidc.NewProvider(context.Background(), server.URL)
+	require.NoError(t, err)
+
+	logoutURL, err := EndSessionURL(oidcProvider, "id-token", "", "")
+	require.NoError(t, err)
+	require.Empty(t, logoutURL)
+}
+
+func TestStorableClaims(t *testing.T) {
+	claims := map[string]interface{}{
+		"iss":     "https://issuer.example.com",
+		"sub":     "subject",
+		"at_hash": "at-hash",
+		"c_hash":  "c-hash",
+		"nonce":   "nonce",
+	}
+
+	require.Equal(t, map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"sub": "subject",
+	}, StorableClaims(claims))
+
+	// the claims passed in are not modified
+	require.Len(t, claims, 5)
+}
+
+func TestIsApplePrivateRelayEmail(t *testing.T) {
+	require.True(t, IsApplePrivateRelayEmail("abc123@privaterelay.appleid.com"))
+	require.True(t, IsApplePrivateRelayEmail("ABC123@PrivateRelay.AppleID.com"))
+	require.False(t, IsApplePrivateRelayEmail("apple@example.com"))
+	require.False(t, IsApplePrivateRelayEmail("abc123@notprivaterelay.appleid.com"))
+}
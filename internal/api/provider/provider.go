@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/supabase/gotrue/internal/utilities"
@@ -77,6 +78,71 @@ type Email struct {
 type UserProvidedData struct {
 	Emails   []Email
 	Metadata *Claims
+
+	// RawClaims holds all claims of the verified ID token the data was
+	// extracted from, if any.
+	RawClaims map[string]interface{}
+
+	// ClientID is the client ID the identity's token was issued to, if it
+	// was verified by a grant.
+	ClientID string
+}
+
+// verificationClaims are ID token claims that are only needed to verify the
+// ID token, and are not worth storing.
+var verificationClaims = []string{"at_hash", "c_hash", "nonce"}
+
+// StorableClaims returns a copy of the ID token claims without the claims
+// only needed to verify the ID token, like at_hash and nonce.
+func StorableClaims(claims map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(claims))
+
+	for key, value := range claims {
+		result[key] = value
+	}
+
+	for _, key := range verificationClaims {
+		delete(result, key)
+	}
+
+	return result
+}
+
+// MapClaims returns the values of the claims selected by the mapping, keyed
+// by the names they are mapped to. Claims are looked up by their exact name
+// first, and otherwise by treating the name as a dotted path into nested
+// claims. Claims not found are ignored.
+func MapClaims(claims map[string]interface{}, mapping map[string]string) map[string]interface{} {
+	result := make(map[string]interface{})
+
+	for claim, key := range mapping {
+		if value, ok := lookupClaim(claims, claim); ok {
+			result[key] = value
+		}
+	}
+
+	return result
+}
+
+func lookupClaim(claims map[string]interface{}, path string) (interface{}, bool) {
+	if value, ok := claims[path]; ok {
+		return value, true
+	}
+
+	var current interface{} = claims
+	for _, part := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		current, ok = object[part]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
 }
 
 // Provider is an interface for interacting with external account providers
@@ -0,0 +1,149 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/supabase/gotrue/internal/conf"
+)
+
+// ErrProviderUnavailable is returned by OIDC discovery and JWKS requests that
+// keep failing with a network error or a server error after all retries.
+var ErrProviderUnavailable = errors.New("oidc provider unavailable")
+
+// ConfigureDiscoveryRetry makes the requests that discover OIDC providers and
+// fetch their signing keys retry network errors and server errors. It wraps
+// the client set by ConfigureDiscoveryTLS, so it must be called after it.
+func ConfigureDiscoveryRetry(config *conf.ProviderRetryConfiguration) {
+	transport := http.DefaultTransport
+	if discoveryHTTPClient != nil && discoveryHTTPClient.Transport != nil {
+		transport = discoveryHTTPClient.Transport
+	}
+
+	discoveryHTTPClient = &http.Client{
+		Transport: newRetryTransport(transport, config),
+	}
+}
+
+// IsProviderUnavailable reports whether the error is caused by an OIDC
+// discovery or JWKS request that failed after all retries. go-oidc formats
+// errors fetching signing keys with %v, so those are matched by message.
+func IsProviderUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	return errors.Is(err, ErrProviderUnavailable) || strings.Contains(err.Error(), ErrProviderUnavailable.Error())
+}
+
+// retryTransport retries GET requests that fail with a network error, or
+// with a 429 or 5xx response, with a jittered exponential backoff. Requests
+// are only made when a provider isn't cached yet or its key set encounters an
+// unknown key, so retries don't slow down requests using cached providers.
+type retryTransport struct {
+	base        http.RoundTripper
+	maxAttempts int
+	backoff     time.Duration
+	timeout     time.Duration
+}
+
+func newRetryTransport(base http.RoundTripper, config *conf.ProviderRetryConfiguration) *retryTransport {
+	maxAttempts := config.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	return &retryTransport{
+		base:        base,
+		maxAttempts: maxAttempts,
+		backoff:     config.Backoff,
+		timeout:     config.Timeout,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	}
+
+	var err error
+	attempts := 0
+
+	for attempts < t.maxAttempts {
+		if attempts > 0 {
+			if sleepErr := sleepContext(ctx, t.backoffDuration(attempts)); sleepErr != nil {
+				break
+			}
+		}
+
+		attempts++
+
+		var resp *http.Response
+		resp, err = t.base.RoundTrip(req.WithContext(ctx))
+		if err == nil {
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < http.StatusInternalServerError {
+				// the response body is read after returning, so the
+				// timeout is only cancelled once it's closed
+				resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+				return resp, nil
+			}
+
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	cancel()
+
+	return nil, fmt.Errorf("%w: %s %s failed after %d attempts: %v", ErrProviderUnavailable, req.Method, req.URL.Redacted(), attempts, err)
+}
+
+// backoffDuration returns how long to wait before the retry following the
+// given number of attempts, a random duration between half and all of the
+// exponentially growing backoff.
+func (t *retryTransport) backoffDuration(attempts int) time.Duration {
+	backoff := t.backoff << (attempts - 1)
+	if backoff <= 0 {
+		return 0
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
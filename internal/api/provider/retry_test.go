@@ -0,0 +1,189 @@
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/conf"
+)
+
+func configureTestDiscoveryRetry(t *testing.T, config *conf.ProviderRetryConfiguration) {
+	client := discoveryHTTPClient
+	t.Cleanup(func() {
+		discoveryHTTPClient = client
+	})
+
+	discoveryHTTPClient = nil
+	ConfigureDiscoveryRetry(config)
+}
+
+// newFlakyServer returns a server whose first failures requests fail, with
+// a malformed or a 503 response in turns, before handler is called.
+func newFlakyServer(t *testing.T, failures int32, handler http.HandlerFunc) (*httptest.Server, *int32) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+
+		switch {
+		case n > failures:
+			handler(w, r)
+
+		case n%2 == 1:
+			// the transport itself retries requests whose connection is
+			// closed without a response, so break it with garbage
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			_, _ = conn.Write([]byte("garbage\r\n\r\n"))
+			conn.Close()
+
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestDiscoveryRetry(t *testing.T) {
+	configureTestDiscoveryRetry(t, &conf.ProviderRetryConfiguration{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		Timeout:     10 * time.Second,
+	})
+
+	var server *httptest.Server
+	server, requests := newFlakyServer(t, 1, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		}))
+	})
+
+	cache := NewOIDCProviderCache(time.Minute)
+
+	first, err := cache.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(requests), "discovery should succeed on the second attempt")
+
+	second, err := cache.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	require.Same(t, first, second)
+	require.Equal(t, int32(2), atomic.LoadInt32(requests), "cached provider should be used")
+}
+
+func TestDiscoveryRetryExhausted(t *testing.T) {
+	configureTestDiscoveryRetry(t, &conf.ProviderRetryConfiguration{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+	})
+
+	server, requests := newFlakyServer(t, 3, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	_, err := NewOIDCProviderCache(time.Minute).Get(context.Background(), server.URL)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrProviderUnavailable))
+	require.True(t, IsProviderUnavailable(err))
+	require.Equal(t, int32(3), atomic.LoadInt32(requests))
+
+	// client errors aren't retried
+	_, err = NewOIDCProviderCache(time.Minute).Get(context.Background(), server.URL)
+	require.Error(t, err)
+	require.False(t, IsProviderUnavailable(err))
+	require.Equal(t, int32(4), atomic.LoadInt32(requests))
+}
+
+func TestDiscoveryRetryTimeout(t *testing.T) {
+	configureTestDiscoveryRetry(t, &conf.ProviderRetryConfiguration{
+		MaxAttempts: 100,
+		Backoff:     20 * time.Millisecond,
+		Timeout:     50 * time.Millisecond,
+	})
+
+	server, requests := newFlakyServer(t, 100, nil)
+
+	_, err := NewOIDCProviderCache(0).Get(context.Background(), server.URL)
+	require.True(t, IsProviderUnavailable(err))
+	require.Less(t, atomic.LoadInt32(requests), int32(100), "retries should stop once the timeout has passed")
+}
+
+func TestJWKSRetry(t *testing.T) {
+	configureTestDiscoveryRetry(t, &conf.ProviderRetryConfiguration{
+		MaxAttempts: 2,
+		Backoff:     time.Millisecond,
+	})
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	serveJWKS := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]any{
+				{
+					"kty": "RSA",
+					"kid": "flaky-key",
+					"alg": "RS256",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+				},
+			},
+		}))
+	}
+
+	const issuer = "https://flaky.example.com"
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   issuer,
+		"sub":   "flaky-subject",
+		"email": "flaky@example.com",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = "flaky-key"
+
+	idToken, err := token.SignedString(key)
+	require.NoError(t, err)
+
+	flakyServer, requests := newFlakyServer(t, 1, serveJWKS)
+
+	oidcProvider, err := NewOIDCProviderCache(0).GetWithJWKS(context.Background(), issuer, flakyServer.URL)
+	require.NoError(t, err)
+
+	_, data, err := ParseIDToken(context.Background(), oidcProvider, nil, idToken, ParseIDTokenOptions{
+		SkipAccessTokenCheck: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "flaky@example.com", data.Emails[0].Email)
+	require.Equal(t, int32(2), atomic.LoadInt32(requests), "JWKS should be fetched on the second attempt")
+
+	downServer, _ := newFlakyServer(t, 2, serveJWKS)
+
+	oidcProvider, err = NewOIDCProviderCache(0).GetWithJWKS(context.Background(), issuer, downServer.URL)
+	require.NoError(t, err)
+
+	_, _, err = ParseIDToken(context.Background(), oidcProvider, nil, idToken, ParseIDTokenOptions{
+		SkipAccessTokenCheck: true,
+	})
+	require.True(t, IsProviderUnavailable(err))
+}
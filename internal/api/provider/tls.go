@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/supabase/gotrue/internal/conf"
+)
+
+// discoveryHTTPClient is the HTTP client used to discover OIDC providers and
+// fetch their signing keys. It's nil, using the default client, until
+// ConfigureDiscoveryTLS is called.
+var discoveryHTTPClient *http.Client
+
+// ConfigureDiscoveryTLS sets the TLS requirements of the requests that
+// discover OIDC providers and fetch their signing keys.
+func ConfigureDiscoveryTLS(config *conf.ProviderTLSConfiguration) error {
+	client, err := newTLSHTTPClient(config, nil)
+	if err != nil {
+		return err
+	}
+
+	discoveryHTTPClient = client
+
+	return nil
+}
+
+// discoveryContext returns the context to pass to oidc.NewProvider, which
+// carries the HTTP client that enforces the TLS requirements. The provider
+// keeps using the client to fetch its signing keys.
+func discoveryContext(ctx context.Context) context.Context {
+	if discoveryHTTPClient == nil {
+		return ctx
+	}
+
+	return oidc.ClientContext(ctx, discoveryHTTPClient)
+}
+
+// newTLSHTTPClient returns an HTTP client that rejects connections below the
+// minimum TLS version and, if any public keys are pinned, to servers whose
+// verified certificate chain doesn't contain one of them. Root CAs default to
+// the system's if nil.
+func newTLSHTTPClient(config *conf.ProviderTLSConfiguration, rootCAs *x509.CertPool) (*http.Client, error) {
+	minVersion, err := config.TLSMinVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	pins, err := config.PublicKeyPins()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: minVersion,
+		RootCAs:    rootCAs,
+	}
+
+	if len(pins) > 0 {
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, chain := range state.VerifiedChains {
+				for _, cert := range chain {
+					hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					for _, pin := range pins {
+						if hash == pin {
+							return nil
+						}
+					}
+				}
+			}
+
+			return errors.New("server certificate chain doesn't contain a pinned public key")
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport}, nil
+}
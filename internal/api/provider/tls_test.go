@@ -0,0 +1,130 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/conf"
+)
+
+func newTestTLSDiscoveryServer(t *testing.T, maxVersion uint16) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		}))
+	}))
+	server.TLS = &tls.Config{MaxVersion: maxVersion}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestTLSHTTPClient(t *testing.T) {
+	server := newTestTLSDiscoveryServer(t, tls.VersionTLS13)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	serverPin := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	otherPin := sha256.Sum256([]byte("other"))
+
+	examples := []struct {
+		desc   string
+		config conf.ProviderTLSConfiguration
+		valid  bool
+	}{
+		{
+			desc:   "no pins",
+			config: conf.ProviderTLSConfiguration{},
+			valid:  true,
+		},
+		{
+			desc: "matching pin",
+			config: conf.ProviderTLSConfiguration{
+				PinnedPublicKeys: []string{
+					base64.StdEncoding.EncodeToString(otherPin[:]),
+					"sha256/" + base64.StdEncoding.EncodeToString(serverPin[:]),
+				},
+			},
+			valid: true,
+		},
+		{
+			desc: "mismatched pin",
+			config: conf.ProviderTLSConfiguration{
+				PinnedPublicKeys: []string{base64.StdEncoding.EncodeToString(otherPin[:])},
+			},
+			valid: false,
+		},
+	}
+
+	for _, example := range examples {
+		t.Run(example.desc, func(t *testing.T) {
+			client, err := newTLSHTTPClient(&example.config, rootCAs)
+			require.NoError(t, err)
+
+			_, err = oidc.NewProvider(oidc.ClientContext(context.Background(), client), server.URL)
+			if example.valid {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, "pinned public key")
+			}
+		})
+	}
+}
+
+func TestTLSHTTPClientMinVersion(t *testing.T) {
+	server := newTestTLSDiscoveryServer(t, tls.VersionTLS12)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	client, err := newTLSHTTPClient(&conf.ProviderTLSConfiguration{MinVersion: "1.2"}, rootCAs)
+	require.NoError(t, err)
+
+	_, err = oidc.NewProvider(oidc.ClientContext(context.Background(), client), server.URL)
+	require.NoError(t, err)
+
+	client, err = newTLSHTTPClient(&conf.ProviderTLSConfiguration{MinVersion: "1.3"}, rootCAs)
+	require.NoError(t, err)
+
+	_, err = oidc.NewProvider(oidc.ClientContext(context.Background(), client), server.URL)
+	require.ErrorContains(t, err, "protocol version")
+}
+
+func TestDiscoveryContext(t *testing.T) {
+	defer func(client *http.Client) {
+		discoveryHTTPClient = client
+	}(discoveryHTTPClient)
+
+	require.Error(t, ConfigureDiscoveryTLS(&conf.ProviderTLSConfiguration{MinVersion: "1.4"}))
+	require.NoError(t, ConfigureDiscoveryTLS(&conf.ProviderTLSConfiguration{}))
+
+	server := newTestTLSDiscoveryServer(t, tls.VersionTLS13)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	// the test server is only trusted by the discovery client, not the
+	// default one
+	client, err := newTLSHTTPClient(&conf.ProviderTLSConfiguration{}, rootCAs)
+	require.NoError(t, err)
+	discoveryHTTPClient = client
+
+	_, err = NewOIDCProviderCache(0).Get(context.Background(), server.URL)
+	require.NoError(t, err)
+}
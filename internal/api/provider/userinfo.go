@@ -0,0 +1,155 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/supabase/gotrue/internal/observability"
+	"github.com/supabase/gotrue/internal/utilities"
+	"golang.org/x/oauth2"
+)
+
+// ErrIntrospectionNotSupported is returned by IntrospectAccessToken when the
+// provider does not advertise an introspection_endpoint.
+var ErrIntrospectionNotSupported = errors.New("provider: token introspection is not supported by the provider")
+
+// FetchUserInfo looks up the user of the access token at the provider's
+// userinfo endpoint. The issuer is not part of the userinfo response, so the
+// returned user data has the provider's issuer.
+func FetchUserInfo(ctx context.Context, p *oidc.Provider, accessToken string) (*UserProvidedData, error) {
+	ctx, span := observability.StartChildSpan(ctx, "oidc.fetch_userinfo")
+
+	data, err := fetchUserInfo(ctx, p, accessToken)
+	observability.EndSpan(span, err)
+
+	return data, err
+}
+
+func fetchUserInfo(ctx context.Context, p *oidc.Provider, accessToken string) (*UserProvidedData, error) {
+	var discovery struct {
+		Issuer string `json:"issuer"`
+	}
+
+	if err := p.Claims(&discovery); err != nil {
+		return nil, err
+	}
+
+	userInfo, err := p.UserInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
+	if err != nil {
+		return nil, err
+	}
+
+	var data UserProvidedData
+
+	if err := userInfo.Claims(&data.Metadata); err != nil {
+		return nil, err
+	}
+
+	if err := userInfo.Claims(&data.RawClaims); err != nil {
+		return nil, err
+	}
+
+	if data.Metadata.Subject == "" {
+		return nil, errors.New("provider: userinfo response must contain a sub claim")
+	}
+
+	data.Metadata.Issuer = discovery.Issuer
+
+	if data.Metadata.Email != "" {
+		data.Emails = append(data.Emails, Email{
+			Email:    data.Metadata.Email,
+			Verified: data.Metadata.EmailVerified,
+			Primary:  true,
+		})
+	}
+
+	if len(data.Emails) <= 0 {
+		return nil, fmt.Errorf("provider: userinfo response from issuer %q must contain an email address", discovery.Issuer)
+	}
+
+	return &data, nil
+}
+
+// TokenIntrospection is the response of an OAuth 2.0 token introspection
+// endpoint (RFC 7662).
+type TokenIntrospection struct {
+	Active   bool     `json:"active"`
+	ClientID string   `json:"client_id"`
+	Subject  string   `json:"sub"`
+	Audience []string `json:"-"`
+}
+
+// IntrospectAccessToken asks the provider's introspection endpoint whether
+// the access token is active and who it was issued to, authenticating with
+// the client ID and secret. It returns ErrIntrospectionNotSupported if the
+// provider does not advertise an introspection endpoint.
+func IntrospectAccessToken(ctx context.Context, p *oidc.Provider, clientID, secret, accessToken string) (*TokenIntrospection, error) {
+	var discovery struct {
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+	}
+
+	if err := p.Claims(&discovery); err != nil {
+		return nil, err
+	}
+
+	if discovery.IntrospectionEndpoint == "" {
+		return nil, ErrIntrospectionNotSupported
+	}
+
+	form := url.Values{}
+	form.Set("token", accessToken)
+	form.Set("token_type_hint", "access_token")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.IntrospectionEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+
+	client := http.DefaultClient
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		client = c
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer utilities.SafeClose(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("provider: token introspection failed with status %d", res.StatusCode)
+	}
+
+	var body struct {
+		TokenIntrospection
+		Audience json.RawMessage `json:"aud"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	introspection := body.TokenIntrospection
+
+	// aud is either a single string or an array of strings
+	if len(body.Audience) > 0 {
+		var audience string
+		if err := json.Unmarshal(body.Audience, &audience); err == nil {
+			introspection.Audience = []string{audience}
+		} else if err := json.Unmarshal(body.Audience, &introspection.Audience); err != nil {
+			return nil, err
+		}
+	}
+
+	return &introspection, nil
+}
@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestUserInfoProvider(t *testing.T, introspectionResponse map[string]interface{}) *oidc.Provider {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			discovery := map[string]interface{}{
+				"issuer":                 server.URL,
+				"authorization_endpoint": server.URL + "/authorize",
+				"token_endpoint":         server.URL + "/token",
+				"jwks_uri":               server.URL + "/jwks",
+				"userinfo_endpoint":      server.URL + "/userinfo",
+			}
+			if introspectionResponse != nil {
+				discovery["introspection_endpoint"] = server.URL + "/introspect"
+			}
+
+			require.NoError(t, json.NewEncoder(w).Encode(discovery))
+
+		case "/userinfo":
+			if r.Header.Get("Authorization") != "Bearer valid" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+				"sub":            "subject",
+				"email":          "userinfo@example.com",
+				"email_verified": true,
+				"locale":         "en",
+			}))
+
+		case "/introspect":
+			clientID, secret, ok := r.BasicAuth()
+			if !ok || clientID != "client" || secret != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			require.NoError(t, json.NewEncoder(w).Encode(introspectionResponse))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	p, err := oidc.NewProvider(context.Background(), server.URL)
+	require.NoError(t, err)
+
+	return p
+}
+
+func TestFetchUserInfo(t *testing.T) {
+	p := newTestUserInfoProvider(t, nil)
+
+	data, err := FetchUserInfo(context.Background(), p, "valid")
+	require.NoError(t, err)
+	require.Equal(t, "subject", data.Metadata.Subject)
+	require.NotEmpty(t, data.Metadata.Issuer)
+	require.Equal(t, []Email{{Email: "userinfo@example.com", Verified: true, Primary: true}}, data.Emails)
+	require.Equal(t, "en", data.RawClaims["locale"])
+
+	_, err = FetchUserInfo(context.Background(), p, "invalid")
+	require.Error(t, err)
+}
+
+func TestIntrospectAccessToken(t *testing.T) {
+	_, err := IntrospectAccessToken(context.Background(), newTestUserInfoProvider(t, nil), "client", "secret", "valid")
+	require.ErrorIs(t, err, ErrIntrospectionNotSupported)
+
+	examples := []struct {
+		desc     string
+		response map[string]interface{}
+		expected TokenIntrospection
+	}{
+		{
+			desc:     "single audience",
+			response: map[string]interface{}{"active": true, "aud": "client", "sub": "subject"},
+			expected: TokenIntrospection{Active: true, Subject: "subject", Audience: []string{"client"}},
+		},
+		{
+			desc:     "multiple audiences",
+			response: map[string]interface{}{"active": true, "aud": []string{"api", "client"}, "client_id": "client"},
+			expected: TokenIntrospection{Active: true, ClientID: "client", Audience: []string{"api", "client"}},
+		},
+		{
+			desc:     "inactive",
+			response: map[string]interface{}{"active": false},
+			expected: TokenIntrospection{Active: false},
+		},
+	}
+
+	for _, example := range examples {
+		t.Run(example.desc, func(t *testing.T) {
+			p := newTestUserInfoProvider(t, example.response)
+
+			introspection, err := IntrospectAccessToken(context.Background(), p, "client", "secret", "valid")
+			require.NoError(t, err)
+			require.Equal(t, example.expected, *introspection)
+
+			_, err = IntrospectAccessToken(context.Background(), p, "client", "wrong", "valid")
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/supabase/gotrue/internal/api/provider"
+	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/observability"
+)
+
+// readinessCheckTimeout bounds each check of the readiness endpoint.
+const readinessCheckTimeout = 5 * time.Second
+
+// Readiness check statuses.
+const (
+	ReadinessStatusOK          = "ok"
+	ReadinessStatusUnavailable = "unavailable"
+)
+
+// ReadinessCheck is the result of one of the readiness checks.
+type ReadinessCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReadinessResponse is returned by the readiness endpoint. Its status is
+// only ok if all checks are.
+type ReadinessResponse struct {
+	Status string                     `json:"status"`
+	Checks map[string]*ReadinessCheck `json:"checks"`
+}
+
+// Readiness reports whether the service can handle requests, by checking
+// that the database is reachable and, if EXTERNAL_READINESS_CHECK is
+// enabled, that the OIDC discovery documents of the enabled providers are.
+// Unlike HealthCheck, it responds with 503 Service Unavailable if any check
+// fails.
+func (a *API) Readiness(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	log := observability.GetLogEntry(r)
+	config := a.config
+
+	checks := map[string]func(context.Context) error{
+		"database": a.checkDatabase,
+	}
+
+	if config.External.ReadinessCheck {
+		for name, discoveryURL := range readinessDiscoveryURLs(&config.External) {
+			discoveryURL := discoveryURL
+			checks["provider:"+name] = func(ctx context.Context) error {
+				return checkURLReachable(ctx, discoveryURL)
+			}
+		}
+	}
+
+	response := &ReadinessResponse{
+		Status: ReadinessStatusOK,
+		Checks: make(map[string]*ReadinessCheck, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		name, check := name, check
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result := &ReadinessCheck{Status: ReadinessStatusOK}
+			if err := check(ctx); err != nil {
+				log.WithError(err).WithField("check", name).Warn("readiness check failed")
+
+				// the cause is only logged, as it may reveal
+				// internal details
+				result = &ReadinessCheck{Status: ReadinessStatusUnavailable, Error: "unreachable"}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			response.Checks[name] = result
+			if result.Status != ReadinessStatusOK {
+				response.Status = ReadinessStatusUnavailable
+			}
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if response.Status != ReadinessStatusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	return sendJSON(w, status, response)
+}
+
+func (a *API) checkDatabase(ctx context.Context) error {
+	return a.db.WithContext(ctx).RawQuery("select 1").Exec()
+}
+
+// readinessDiscoveryURLs returns the URLs of the OIDC discovery documents,
+// or JWKS, of the enabled providers, keyed by the provider's name.
+func readinessDiscoveryURLs(config *conf.ProviderConfiguration) map[string]string {
+	issuers := make(map[string]string)
+
+	if config.Apple.Enabled {
+		issuers["apple"] = provider.IssuerApple
+	}
+
+	if config.Google.Enabled {
+		issuers["google"] = provider.IssuerGoogle
+	}
+
+	if config.Azure.Enabled {
+		issuers["azure"] = provider.IssuerAzureCommon
+		if config.Azure.Tenant != "" {
+			issuers["azure"] = provider.AzureTenantIssuer(config.Azure.Tenant)
+		}
+	}
+
+	if config.LinkedinOIDC.Enabled {
+		// LinkedIn serves its discovery document from a different URL
+		// than its issuer
+		issuers["linkedin_oidc"] = provider.IssuerLinkedin + "/oauth"
+	}
+
+	if config.Keycloak.Enabled && config.Keycloak.URL != "" {
+		issuers["keycloak"] = config.Keycloak.URL
+	}
+
+	urls := make(map[string]string, len(issuers))
+	for name, issuer := range issuers {
+		urls[name] = strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	}
+
+	if config.Keycloak.Enabled && config.Keycloak.JWKSURL != "" {
+		// the keys are fetched from the JWKS URL without discovery
+		urls["keycloak"] = config.Keycloak.JWKSURL
+	}
+
+	return urls
+}
+
+func checkURLReachable(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Timeout: readinessCheckTimeout,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+
+	return nil
+}
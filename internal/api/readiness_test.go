@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/storage/test"
+)
+
+func readiness(t *testing.T, api *API) (int, *ReadinessResponse) {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/readyz", nil)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+
+	response := &ReadinessResponse{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(response))
+
+	return w.Code, response
+}
+
+func TestReadiness(t *testing.T) {
+	api, _, err := setupAPIForTest()
+	require.NoError(t, err)
+	defer api.db.Close()
+
+	status, response := readiness(t, api)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, ReadinessStatusOK, response.Status)
+	require.Equal(t, map[string]*ReadinessCheck{
+		"database": {Status: ReadinessStatusOK},
+	}, response.Checks, "providers are only checked if enabled")
+}
+
+func TestReadinessDatabaseDown(t *testing.T) {
+	config, err := conf.LoadGlobal(apiTestConfig)
+	require.NoError(t, err)
+
+	conn, err := test.SetupDBConnection(config)
+	require.NoError(t, err)
+
+	api := NewAPIWithVersion(context.Background(), config, conn, apiTestVersion)
+	require.NoError(t, conn.Close())
+
+	status, response := readiness(t, api)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, ReadinessStatusUnavailable, response.Status)
+	require.Equal(t, ReadinessStatusUnavailable, response.Checks["database"].Status)
+
+	// liveness doesn't depend on the database
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/health", nil)
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestReadinessProviders(t *testing.T) {
+	up := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/realms/test/.well-known/openid-configuration", r.URL.Path)
+
+		if !up {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"issuer":"` + "http://" + r.Host + `/realms/test"}`))
+	}))
+	defer server.Close()
+
+	api, config, err := setupAPIForTest()
+	require.NoError(t, err)
+	defer api.db.Close()
+
+	config.External = conf.ProviderConfiguration{
+		Keycloak: conf.OAuthProviderConfiguration{
+			Enabled: true,
+			URL:     server.URL + "/realms/test",
+		},
+		ReadinessCheck: true,
+	}
+
+	status, response := readiness(t, api)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, map[string]*ReadinessCheck{
+		"database":          {Status: ReadinessStatusOK},
+		"provider:keycloak": {Status: ReadinessStatusOK},
+	}, response.Checks)
+
+	up = false
+
+	status, response = readiness(t, api)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, ReadinessStatusUnavailable, response.Status)
+	require.Equal(t, ReadinessStatusOK, response.Checks["database"].Status)
+	require.Equal(t, ReadinessStatusUnavailable, response.Checks["provider:keycloak"].Status)
+
+	// providers aren't checked unless enabled, so that readiness isn't
+	// coupled to third parties
+	config.External.ReadinessCheck = false
+
+	status, response = readiness(t, api)
+	require.Equal(t, http.StatusOK, status)
+	require.NotContains(t, response.Checks, "provider:keycloak")
+}
@@ -51,7 +51,7 @@ func (p *ResendConfirmationParams) Validate(config *conf.GlobalConfiguration) er
 		if !config.External.Phone.Enabled {
 			return badRequestError("Phone logins are disabled")
 		}
-		p.Phone, err = validatePhone(p.Phone)
+		p.Phone, err = validatePhone(p.Phone, config.Sms.DefaultRegion)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/supabase/gotrue/internal/models"
+)
+
+// SessionResponse is the response of the session endpoint. Only the fields
+// configured with SESSIONS_INTROSPECTION_FIELDS are set besides the ID.
+type SessionResponse struct {
+	SessionID uuid.UUID  `json:"session_id"`
+	UserID    *uuid.UUID `json:"user_id,omitempty"`
+	AAL       string     `json:"aal,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+}
+
+// SessionGet checks that the session in the session_id claim of the access
+// token hasn't been revoked or expired. It only looks up the session, so that
+// services verifying access tokens themselves can cheaply check for
+// revocation.
+func (a *API) SessionGet(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.config
+	claims := getClaims(ctx)
+
+	if claims.SessionId == "" || claims.SessionId == uuid.Nil.String() {
+		return badRequestError("JWT was not issued for a session")
+	}
+
+	sessionID, err := uuid.FromString(claims.SessionId)
+	if err != nil {
+		return badRequestError("invalid claim: session_id claim must be a UUID").WithInternalError(err)
+	}
+
+	session, err := models.FindSessionByID(a.db.WithContext(ctx), sessionID, false)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return sessionNotFoundError()
+		}
+		return internalServerError("Database error finding session").WithInternalError(err)
+	}
+
+	if session.UserID.String() != claims.Subject {
+		return sessionNotFoundError()
+	}
+
+	if session.CheckValidity(a.now(), config.Sessions.Timebox, config.Sessions.InactivityTimeout) != models.SessionValid {
+		return sessionNotFoundError()
+	}
+
+	response := &SessionResponse{
+		SessionID: session.ID,
+	}
+
+	if config.Sessions.IsIntrospectionField("user_id") {
+		response.UserID = &session.UserID
+	}
+
+	if config.Sessions.IsIntrospectionField("aal") {
+		response.AAL = session.GetAAL()
+	}
+
+	if config.Sessions.IsIntrospectionField("not_after") {
+		response.NotAfter = session.NotAfter
+	}
+
+	return sendJSON(w, http.StatusOK, response)
+}
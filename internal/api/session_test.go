@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/models"
+)
+
+func (ts *TokenTestSuite) tokenGrant(grantType string, params map[string]interface{}) *AccessTokenResponse {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type="+grantType, &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	token := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+
+	return token
+}
+
+func (ts *TokenTestSuite) accessTokenSessionID(token *AccessTokenResponse) string {
+	claims := &GoTrueClaims{}
+	_, err := jwt.ParseWithClaims(token.Token, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(ts.Config.JWT.Secret), nil
+	})
+	require.NoError(ts.T(), err)
+
+	return claims.SessionId
+}
+
+func (ts *TokenTestSuite) getSession(accessToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/session", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func (ts *TokenTestSuite) TestAccessTokenSessionIDClaim() {
+	token := ts.tokenGrant("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+
+	_, refreshToken, _, err := models.FindUserWithRefreshToken(ts.API.db, token.RefreshToken, false)
+	require.NoError(ts.T(), err)
+	require.NotNil(ts.T(), refreshToken.SessionId)
+
+	sessionID := ts.accessTokenSessionID(token)
+	require.Equal(ts.T(), refreshToken.SessionId.String(), sessionID)
+
+	// refreshing keeps the session
+	for i := 0; i < 2; i++ {
+		token = ts.tokenGrant("refresh_token", map[string]interface{}{
+			"refresh_token": token.RefreshToken,
+		})
+		require.Equal(ts.T(), sessionID, ts.accessTokenSessionID(token))
+	}
+
+	// signing in again creates another session
+	other := ts.tokenGrant("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+	require.NotEqual(ts.T(), sessionID, ts.accessTokenSessionID(other))
+}
+
+func (ts *TokenTestSuite) TestSessionGet() {
+	sessionsConfig := ts.Config.Sessions
+	defer func() {
+		ts.Config.Sessions = sessionsConfig
+	}()
+	ts.Config.Sessions.IntrospectionEnabled = true
+
+	token := ts.tokenGrant("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+	sessionID := ts.accessTokenSessionID(token)
+
+	w := ts.getSession(token.Token)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	data := SessionResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), sessionID, data.SessionID.String())
+	require.NotNil(ts.T(), data.UserID)
+	require.Equal(ts.T(), ts.User.ID, *data.UserID)
+	require.Equal(ts.T(), models.AAL1.String(), data.AAL)
+
+	// expired sessions are reported like revoked ones
+	timebox := ts.Config.Sessions.Timebox
+	ts.Config.Sessions.Timebox = time.Nanosecond
+	w = ts.getSession(token.Token)
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+	ts.Config.Sessions.Timebox = timebox
+
+	// access tokens of revoked sessions are still valid JWTs, but their
+	// session no longer exists
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	logout := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(logout, req)
+	require.Equal(ts.T(), http.StatusNoContent, logout.Code)
+
+	w = ts.getSession(token.Token)
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+	httpError := HTTPError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&httpError))
+	require.Equal(ts.T(), ErrorCodeSessionNotFound, httpError.ErrorCode)
+
+	// access tokens without a session can't be checked
+	accessToken, _, err := generateAccessToken(ts.API.db, ts.User, nil, &ts.Config.JWT)
+	require.NoError(ts.T(), err)
+
+	w = ts.getSession(accessToken)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *TokenTestSuite) TestSessionGetConfiguration() {
+	sessionsConfig := ts.Config.Sessions
+	defer func() {
+		ts.Config.Sessions = sessionsConfig
+	}()
+
+	token := ts.tokenGrant("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+
+	// the endpoint is disabled by default
+	ts.Config.Sessions.IntrospectionEnabled = false
+	w := ts.getSession(token.Token)
+	require.Equal(ts.T(), http.StatusNotFound, w.Code)
+
+	// only the configured fields are reported besides the session ID
+	ts.Config.Sessions.IntrospectionEnabled = true
+	ts.Config.Sessions.IntrospectionFields = []string{"aal"}
+	w = ts.getSession(token.Token)
+	require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+	data := map[string]interface{}{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), map[string]interface{}{
+		"session_id": ts.accessTokenSessionID(token),
+		"aal":        models.AAL1.String(),
+	}, data)
+}
@@ -1,6 +1,10 @@
 package api
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/supabase/gotrue/internal/conf"
+)
 
 type ProviderSettings struct {
 	Apple        bool `json:"apple"`
@@ -25,22 +29,43 @@ type ProviderSettings struct {
 	Twitter      bool `json:"twitter"`
 	Email        bool `json:"email"`
 	Phone        bool `json:"phone"`
+	Anonymous    bool `json:"anonymous_users"`
 	Zoom         bool `json:"zoom"`
+
+	// OIDCProviders reports the providers of the providers directory by
+	// name, as they can be added and removed without a restart.
+	OIDCProviders map[string]bool `json:"oidc_providers,omitempty"`
+}
+
+// PasswordRequirementsSettings publishes the password policy, so that
+// front-ends can validate passwords before submitting them.
+type PasswordRequirementsSettings struct {
+	MinLength                int      `json:"min_length"`
+	RequiredCharacterClasses []string `json:"required_character_classes"`
+	MinStrengthScore         int      `json:"min_strength_score"`
+	CheckPwnedPasswords      bool     `json:"check_pwned_passwords"`
 }
 
 type Settings struct {
-	ExternalProviders ProviderSettings `json:"external"`
-	DisableSignup     bool             `json:"disable_signup"`
-	MailerAutoconfirm bool             `json:"mailer_autoconfirm"`
-	PhoneAutoconfirm  bool             `json:"phone_autoconfirm"`
-	SmsProvider       string           `json:"sms_provider"`
-	MFAEnabled        bool             `json:"mfa_enabled"`
-	SAMLEnabled       bool             `json:"saml_enabled"`
+	ExternalProviders    ProviderSettings             `json:"external"`
+	DisableSignup        bool                         `json:"disable_signup"`
+	InviteOnly           bool                         `json:"invite_only"`
+	MailerAutoconfirm    bool                         `json:"mailer_autoconfirm"`
+	PhoneAutoconfirm     bool                         `json:"phone_autoconfirm"`
+	SmsProvider          string                       `json:"sms_provider"`
+	MFAEnabled           bool                         `json:"mfa_enabled"`
+	SAMLEnabled          bool                         `json:"saml_enabled"`
+	PasswordRequirements PasswordRequirementsSettings `json:"password_requirements"`
 }
 
 func (a *API) Settings(w http.ResponseWriter, r *http.Request) error {
 	config := a.config
 
+	requiredCharacterClasses := config.Security.PasswordRequirements.RequiredCharacterClasses
+	if requiredCharacterClasses == nil {
+		requiredCharacterClasses = []string{}
+	}
+
 	return sendJSON(w, http.StatusOK, &Settings{
 		ExternalProviders: ProviderSettings{
 			Apple:        config.External.Apple.Enabled,
@@ -65,14 +90,42 @@ func (a *API) Settings(w http.ResponseWriter, r *http.Request) error {
 			WorkOS:       config.External.WorkOS.Enabled,
 			Email:        config.External.Email.Enabled,
 			Phone:        config.External.Phone.Enabled,
+			Anonymous:    config.External.AnonymousUsers.Enabled,
 			Zoom:         config.External.Zoom.Enabled,
+
+			OIDCProviders: oidcProviderSettings(config.External.OIDCProviders),
 		},
 
 		DisableSignup:     config.DisableSignup,
+		InviteOnly:        config.InviteOnly,
 		MailerAutoconfirm: config.Mailer.Autoconfirm,
 		PhoneAutoconfirm:  config.Sms.Autoconfirm,
 		SmsProvider:       config.Sms.Provider,
 		MFAEnabled:        config.MFA.Enabled,
 		SAMLEnabled:       config.SAML.Enabled,
+
+		PasswordRequirements: PasswordRequirementsSettings{
+			MinLength:                config.PasswordMinLength,
+			RequiredCharacterClasses: requiredCharacterClasses,
+			MinStrengthScore:         config.Security.PasswordRequirements.MinStrengthScore,
+			CheckPwnedPasswords:      config.Security.CheckPwnedPasswords,
+		},
 	})
 }
+
+// oidcProviderSettings reports whether each provider of the providers
+// directory is enabled, or nil without a providers directory.
+func oidcProviderSettings(directory *conf.OIDCProviderDirectory) map[string]bool {
+	if directory == nil {
+		return nil
+	}
+
+	providers := make(map[string]bool)
+	for _, name := range directory.Names() {
+		if provider := directory.Provider(name); provider != nil {
+			providers[name] = provider.Enabled
+		}
+	}
+
+	return providers
+}
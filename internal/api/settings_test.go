@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -44,6 +46,7 @@ func TestSettings_DefaultProviders(t *testing.T) {
 	require.True(t, p.Twitch)
 	require.True(t, p.WorkOS)
 	require.True(t, p.Zoom)
+	require.Nil(t, p.OIDCProviders)
 }
 
 func TestSettings_EmailDisabled(t *testing.T) {
@@ -68,3 +71,111 @@ func TestSettings_EmailDisabled(t *testing.T) {
 	p := resp.ExternalProviders
 	require.False(t, p.Email)
 }
+
+func TestSettings_PasswordRequirements(t *testing.T) {
+	api, config, err := setupAPIForTest()
+	require.NoError(t, err)
+
+	config.PasswordMinLength = 10
+	config.Security.PasswordRequirements.RequiredCharacterClasses = []string{"lowercase", "digits"}
+	config.Security.PasswordRequirements.MinStrengthScore = 3
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/settings", nil)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := Settings{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+	require.Equal(t, PasswordRequirementsSettings{
+		MinLength:                10,
+		RequiredCharacterClasses: []string{"lowercase", "digits"},
+		MinStrengthScore:         3,
+	}, resp.PasswordRequirements)
+}
+
+func TestSettings_Toggles(t *testing.T) {
+	api, config, err := setupAPIForTest()
+	require.NoError(t, err)
+
+	config.DisableSignup = true
+	config.Mailer.Autoconfirm = true
+	config.Sms.Autoconfirm = true
+	config.External.Phone.Enabled = true
+	config.External.Github.Enabled = false
+	config.External.LinkedinOIDC.Enabled = true
+	config.MFA.Enabled = true
+	config.SAML.Enabled = true
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/settings", nil)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := Settings{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+	require.True(t, resp.DisableSignup)
+	require.True(t, resp.MailerAutoconfirm)
+	require.True(t, resp.PhoneAutoconfirm)
+	require.True(t, resp.MFAEnabled)
+	require.True(t, resp.SAMLEnabled)
+	require.True(t, resp.ExternalProviders.Phone)
+	require.False(t, resp.ExternalProviders.GitHub)
+	require.True(t, resp.ExternalProviders.LinkedinOIDC)
+}
+
+func TestSettings_OIDCProviders(t *testing.T) {
+	api, config, err := setupAPIForTest()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "acme.yaml"), []byte("issuer: https://acme.example.com\nclient_id: acme-client\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "initech.json"), []byte(`{"issuer": "https://initech.example.com", "client_id": "initech-client", "enabled": false}`), 0600))
+
+	config.External.ProvidersDirectory = dir
+	require.NoError(t, config.External.LoadOIDCProviders())
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/settings", nil)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := Settings{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+	require.Equal(t, map[string]bool{
+		"acme":    true,
+		"initech": false,
+	}, resp.ExternalProviders.OIDCProviders)
+}
+
+func TestSettings_NoSecrets(t *testing.T) {
+	api, config, err := setupAPIForTest()
+	require.NoError(t, err)
+
+	config.External.Github.Secret = "github-client-secret"
+	config.External.Google.Secret = "google-client-secret"
+	config.Security.Captcha.Secret = "captcha-secret"
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/settings", nil)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	body := w.Body.String()
+	for _, secret := range []string{
+		"github-client-secret",
+		"google-client-secret",
+		"captcha-secret",
+		config.JWT.Secret,
+	} {
+		require.NotContains(t, body, secret)
+	}
+}
@@ -29,15 +29,13 @@ type SignupParams struct {
 	Channel             string                 `json:"channel"`
 	CodeChallengeMethod string                 `json:"code_challenge_method"`
 	CodeChallenge       string                 `json:"code_challenge"`
+	Locale              string                 `json:"locale"`
 }
 
-func (p *SignupParams) Validate(passwordMinLength int, smsProvider string) error {
+func (p *SignupParams) Validate(smsProvider string) error {
 	if p.Password == "" {
 		return unprocessableEntityError("Signup requires a valid password")
 	}
-	if len(p.Password) < passwordMinLength {
-		return invalidPasswordLengthError(passwordMinLength)
-	}
 	if p.Email != "" && p.Phone != "" {
 		return unprocessableEntityError("Only an email address or phone number should be provided on signup.")
 	}
@@ -52,6 +50,12 @@ func (p *SignupParams) Validate(passwordMinLength int, smsProvider string) error
 		return err
 	}
 
+	var err error
+	p.Locale, err = validateLocale(p.Locale)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -73,13 +77,17 @@ func (p *SignupParams) ConfigureDefaults() {
 }
 
 // Signup is the endpoint for registering a new user
-func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
+func (a *API) Signup(w http.ResponseWriter, r *http.Request) (err error) {
 	ctx := r.Context()
 	config := a.config
 	db := a.db.WithContext(ctx)
 
+	defer func() {
+		signupCounter.Add(ctx, 1, metricOutcome(err))
+	}()
+
 	if config.DisableSignup {
-		return forbiddenError("Signups not allowed for this instance")
+		return signupDisabledError("Signups not allowed for this instance")
 	}
 
 	params := &SignupParams{}
@@ -93,7 +101,10 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Could not read Signup params: %v", err)
 	}
 	params.ConfigureDefaults()
-	if err := params.Validate(config.PasswordMinLength, config.Sms.Provider); err != nil {
+	if err := params.Validate(config.Sms.Provider); err != nil {
+		return err
+	}
+	if err := a.checkPasswordStrength(r, params.Password, params.Email, params.Phone); err != nil {
 		return err
 	}
 
@@ -108,6 +119,8 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 
 	var user *models.User
 	var grantParams models.GrantParams
+	grantParams.FillGrantParams(r, config.Security.TrustedProxies)
+
 	params.Aud = a.requestAud(ctx, r)
 
 	switch params.Provider {
@@ -124,7 +137,7 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 		if !config.External.Phone.Enabled {
 			return badRequestError("Phone signups are disabled")
 		}
-		params.Phone, err = validatePhone(params.Phone)
+		params.Phone, err = validatePhone(params.Phone, config.Sms.DefaultRegion)
 		if err != nil {
 			return err
 		}
@@ -137,6 +150,25 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError("Database error finding user").WithInternalError(err)
 	}
 
+	if config.InviteOnly && (user == nil || !user.HasPendingInvite()) {
+		return signupDisabledError("Signups are invite only for this instance")
+	}
+
+	// an anonymous user signing up is converted into a permanent user,
+	// instead of creating another user
+	anonymousUser, anonymousSession, err := a.maybeLoadAnonymousUser(r)
+	if err != nil {
+		return err
+	}
+	if anonymousUser != nil {
+		if params.Provider != "email" {
+			return badRequestError("Anonymous users can only be converted with an email signup")
+		}
+		if user != nil {
+			return unprocessableEntityError("A user with this email address has already been registered")
+		}
+	}
+
 	err = db.Transaction(func(tx *storage.Connection) error {
 		var terr error
 		if user != nil {
@@ -145,6 +177,11 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 			}
 
 			// do not update the user because we can't be sure of their claimed identity
+		} else if anonymousUser != nil {
+			user = anonymousUser
+			if terr = a.convertAnonymousUser(tx, r, user, anonymousSession, params); terr != nil {
+				return terr
+			}
 		} else {
 			user, terr = a.signupNewUser(ctx, tx, params, false /* <- isSSOUser */)
 			if terr != nil {
@@ -275,15 +312,16 @@ func (a *API) Signup(w http.ResponseWriter, r *http.Request) error {
 			if terr != nil {
 				return terr
 			}
-
-			if terr = a.setCookieTokens(config, token, false, w); terr != nil {
-				return internalServerError("Failed to set JWT cookie. %s", terr)
-			}
 			return nil
 		})
 		if err != nil {
 			return err
 		}
+
+		// the access token is only set once the transaction is committed
+		if err := a.setCookieTokens(config, token, false, w); err != nil {
+			return internalServerError("Failed to set JWT cookie. %s", err)
+		}
 		metering.RecordLogin("password", user.ID)
 		return sendJSON(w, http.StatusOK, token)
 	}
@@ -345,6 +383,8 @@ func (a *API) signupNewUser(ctx context.Context, conn *storage.Connection, param
 		return nil, internalServerError("Database error creating user").WithInternalError(err)
 	}
 	user.IsSSOUser = isSSOUser
+	user.IsAnonymous = params.Provider == "anonymous"
+	user.Locale = params.Locale
 	if user.AppMetaData == nil {
 		user.AppMetaData = make(map[string]interface{})
 	}
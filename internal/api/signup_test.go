@@ -2,12 +2,16 @@ package api
 
 import (
 	"bytes"
+	"crypto/sha1" //#nosec G505 -- SHA-1 is mandated by the Pwned Passwords range API
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -44,6 +48,203 @@ func (ts *SignupTestSuite) SetupTest() {
 	ts.Config.Webhook = conf.WebhookConfig{}
 }
 
+// pwnedPasswordsServer stubs the Pwned Passwords range API, which reports
+// password as breached and responds after delay.
+func pwnedPasswordsServer(password string, delay *atomic.Int64) *httptest.Server {
+	sum := sha1.Sum([]byte(password)) //#nosec G401 -- SHA-1 is mandated by the Pwned Passwords range API
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Duration(delay.Load())):
+		case <-r.Context().Done():
+			return
+		}
+
+		if r.URL.Path != "/range/"+hash[:5] {
+			// unrelated hashes, including padding
+			fmt.Fprintf(w, "%s:0\r\n", strings.Repeat("0", 35))
+			return
+		}
+
+		fmt.Fprintf(w, "%s:0\r\n%s:42\r\n", strings.Repeat("F", 35), hash[5:])
+	}))
+}
+
+func (ts *SignupTestSuite) TestSignupPwnedPasswords() {
+	var delay atomic.Int64
+	server := pwnedPasswordsServer("breached-password", &delay)
+	defer server.Close()
+
+	security := ts.Config.Security
+	defer func() {
+		ts.Config.Security = security
+	}()
+
+	ts.Config.Security.CheckPwnedPasswords = true
+	ts.Config.Security.PwnedPasswordsURL = server.URL
+	ts.Config.Security.PwnedPasswordsTimeout = 100 * time.Millisecond
+
+	cases := []struct {
+		desc         string
+		password     string
+		delay        time.Duration
+		failClosed   bool
+		expectedCode int
+	}{
+		{
+			desc:         "Breached password",
+			password:     "breached-password",
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			desc:         "Clean password",
+			password:     "clean-password",
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "Timeout fails open",
+			password:     "breached-password",
+			delay:        time.Second,
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "Timeout fails closed",
+			password:     "breached-password",
+			delay:        time.Second,
+			failClosed:   true,
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for i, c := range cases {
+		ts.Run(c.desc, func() {
+			delay.Store(int64(c.delay))
+			ts.Config.Security.PwnedPasswordsFailClosed = c.failClosed
+
+			var buffer bytes.Buffer
+			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+				"email":    fmt.Sprintf("pwned%d@example.com", i),
+				"password": c.password,
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/signup", &buffer)
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			ts.API.handler.ServeHTTP(w, req)
+			require.Equal(ts.T(), c.expectedCode, w.Code)
+
+			if c.expectedCode == http.StatusUnprocessableEntity {
+				var data HTTPError
+				require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+				require.Equal(ts.T(), ErrorCodeWeakPassword, data.ErrorCode)
+			}
+		})
+	}
+
+	ts.Run("Password update", func() {
+		delay.Store(0)
+
+		u, err := models.NewUser("", "pwned-update@example.com", "clean-password", ts.Config.JWT.Aud, nil)
+		require.NoError(ts.T(), err)
+		require.NoError(ts.T(), ts.API.db.Create(u))
+
+		token, _, err := generateAccessToken(ts.API.db, u, nil, &ts.Config.JWT)
+		require.NoError(ts.T(), err)
+
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"password": "breached-password",
+		}))
+
+		req := httptest.NewRequest(http.MethodPut, "/user", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+		var data HTTPError
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.Equal(ts.T(), ErrorCodeWeakPassword, data.ErrorCode)
+	})
+}
+
+func (ts *SignupTestSuite) TestSignupPasswordRequirements() {
+	security := ts.Config.Security
+	passwordMinLength := ts.Config.PasswordMinLength
+	defer func() {
+		ts.Config.Security = security
+		ts.Config.PasswordMinLength = passwordMinLength
+	}()
+
+	ts.Config.PasswordMinLength = 10
+	ts.Config.Security.PasswordRequirements.RequiredCharacterClasses = []string{"lowercase", "uppercase", "digits"}
+	ts.Config.Security.PasswordRequirements.MinStrengthScore = 3
+
+	cases := []struct {
+		desc            string
+		password        string
+		expectedReasons []string
+	}{
+		{
+			desc:            "Too short",
+			password:        "xK7#mQ2z",
+			expectedReasons: []string{WeakPasswordLength},
+		},
+		{
+			desc:            "Missing character classes",
+			password:        "xk7#mq2zpw9!",
+			expectedReasons: []string{WeakPasswordCharacters},
+		},
+		{
+			desc:            "Too easy to guess",
+			password:        "Abcdefgh12",
+			expectedReasons: []string{WeakPasswordStrength},
+		},
+		{
+			desc:            "Every requirement fails",
+			password:        "aaaa",
+			expectedReasons: []string{WeakPasswordLength, WeakPasswordCharacters, WeakPasswordStrength},
+		},
+		{
+			desc:     "Strong password",
+			password: "xK7#mQ2zPw9!",
+		},
+	}
+
+	for i, c := range cases {
+		ts.Run(c.desc, func() {
+			var buffer bytes.Buffer
+			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+				"email":    fmt.Sprintf("requirements%d@example.com", i),
+				"password": c.password,
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/signup", &buffer)
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			ts.API.handler.ServeHTTP(w, req)
+
+			if len(c.expectedReasons) == 0 {
+				require.Equal(ts.T(), http.StatusOK, w.Code)
+				return
+			}
+
+			require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+			var data HTTPError
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+			require.Equal(ts.T(), ErrorCodeWeakPassword, data.ErrorCode)
+			require.NotNil(ts.T(), data.WeakPassword)
+			require.Equal(ts.T(), c.expectedReasons, data.WeakPassword.Reasons)
+		})
+	}
+}
+
 // TestSignup tests API /signup route
 func (ts *SignupTestSuite) TestSignup() {
 	// Request body
@@ -76,6 +277,85 @@ func (ts *SignupTestSuite) TestSignup() {
 	assert.Equal(ts.T(), []interface{}{"email"}, data.AppMetaData["providers"])
 }
 
+func (ts *SignupTestSuite) TestSignupLocale() {
+	signup := func(email, locale string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"email":    email,
+			"password": "test123",
+			"locale":   locale,
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "/signup", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := signup("locale@example.com", "pt-br")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	data := models.User{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	assert.Equal(ts.T(), "pt-BR", data.Locale)
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, "locale@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	assert.Equal(ts.T(), "pt-BR", user.Locale)
+
+	w = signup("invalid-locale@example.com", "not a locale")
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *SignupTestSuite) TestSignupRedirectTo() {
+	cases := []struct {
+		desc         string
+		redirectTo   string
+		expectedCode int
+	}{
+		{
+			desc:         "site url",
+			redirectTo:   ts.Config.SiteURL + "/welcome",
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "allow listed url",
+			redirectTo:   "http://localhost:3000",
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "url not in the allow list",
+			redirectTo:   "https://evil.com/welcome",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for i, c := range cases {
+		ts.Run(c.desc, func() {
+			var buffer bytes.Buffer
+			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+				"email":    fmt.Sprintf("redirect-%d@example.com", i),
+				"password": "test123",
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/signup?redirect_to="+url.QueryEscape(c.redirectTo), &buffer)
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			ts.API.handler.ServeHTTP(w, req)
+			require.Equal(ts.T(), c.expectedCode, w.Code)
+
+			if c.expectedCode == http.StatusBadRequest {
+				data := HTTPError{}
+				require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+				require.Equal(ts.T(), ErrorCodeInvalidRedirectURL, data.ErrorCode)
+			}
+		})
+	}
+}
+
 func (ts *SignupTestSuite) TestWebhookTriggered() {
 	var callCount int
 	require := ts.Require()
@@ -178,6 +458,60 @@ func (ts *SignupTestSuite) TestFailingWebhook() {
 }
 
 // TestSignupTwice checks to make sure the same email cannot be registered twice
+func (ts *SignupTestSuite) TestSignupInviteOnly() {
+	defer func() {
+		ts.Config.DisableSignup = false
+		ts.Config.InviteOnly = false
+	}()
+
+	invited, err := models.NewUser("", "invited@example.com", "", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	now := time.Now()
+	invited.InvitedAt = &now
+	require.NoError(ts.T(), ts.API.db.Create(invited))
+
+	signup := func(email string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"email":    email,
+			"password": "test123",
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/signup", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	assertSignupDisabled := func(w *httptest.ResponseRecorder) {
+		require.Equal(ts.T(), http.StatusForbidden, w.Code)
+
+		data := HTTPError{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.Equal(ts.T(), ErrorCodeSignupDisabled, data.ErrorCode)
+	}
+
+	ts.Config.DisableSignup = true
+	assertSignupDisabled(signup("invited@example.com"))
+
+	ts.Config.DisableSignup = false
+	ts.Config.InviteOnly = true
+	assertSignupDisabled(signup("uninvited@example.com"))
+
+	_, err = models.FindUserByEmailAndAudience(ts.API.db, "uninvited@example.com", ts.Config.JWT.Aud)
+	require.True(ts.T(), models.IsNotFoundError(err))
+
+	w := signup("invited@example.com")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	data := models.User{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), invited.ID, data.ID)
+}
+
 func (ts *SignupTestSuite) TestSignupTwice() {
 	// Request body
 	var buffer bytes.Buffer
@@ -224,6 +558,88 @@ func (ts *SignupTestSuite) TestSignupTwice() {
 	assert.Equal(ts.T(), []interface{}{"email"}, data.AppMetaData["providers"])
 }
 
+func (ts *SignupTestSuite) TestSignupConvertsAnonymousUser() {
+	defer func() {
+		ts.Config.External.AnonymousUsers.Enabled = false
+	}()
+	ts.Config.External.AnonymousUsers.Enabled = true
+
+	signup := func(accessToken string, params map[string]interface{}) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/signup", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	anonymous := anonymousSignIn(ts.T(), ts.API)
+
+	w := signup(anonymous.Token, map[string]interface{}{
+		"email":    "converted@example.com",
+		"password": "test123",
+		"data": map[string]interface{}{
+			"a": 1,
+		},
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	data := models.User{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), anonymous.User.ID, data.ID)
+	require.False(ts.T(), data.IsAnonymous)
+	require.Equal(ts.T(), "converted@example.com", data.GetEmail())
+	require.Equal(ts.T(), []interface{}{"email"}, data.AppMetaData["providers"])
+
+	user, err := models.FindUserByID(ts.API.db, anonymous.User.ID)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), user.IsAnonymous)
+	require.True(ts.T(), user.Authenticate("test123"))
+	require.NotNil(ts.T(), user.ConfirmationSentAt)
+	require.Equal(ts.T(), 1.0, user.UserMetaData["a"])
+
+	_, err = models.FindIdentityByIdAndProvider(ts.API.db, user.ID.String(), "email")
+	require.NoError(ts.T(), err)
+
+	// the session of the anonymous user remains valid
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"refresh_token": anonymous.RefreshToken,
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=refresh_token", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	// emails of other users can't be claimed
+	other := anonymousSignIn(ts.T(), ts.API)
+
+	w = signup(other.Token, map[string]interface{}{
+		"email":    "converted@example.com",
+		"password": "test123",
+	})
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	// only email signups convert anonymous users
+	w = signup(other.Token, map[string]interface{}{
+		"phone":    "123456789",
+		"password": "test123",
+	})
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	user, err = models.FindUserByID(ts.API.db, other.User.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), user.IsAnonymous)
+}
+
 func (ts *SignupTestSuite) TestVerifySignup() {
 	user, err := models.NewUser("123456789", "test@example.com", "testing", ts.Config.JWT.Aud, nil)
 	user.ConfirmationToken = "asdf3"
@@ -0,0 +1,93 @@
+package sms_provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/utilities"
+)
+
+// HTTPProvider sends messages through a custom SMS gateway by POSTing them
+// as JSON to the configured URL.
+type HTTPProvider struct {
+	Config *conf.HTTPProviderConfiguration
+}
+
+type HTTPProviderRequest struct {
+	Phone   string `json:"phone"`
+	Message string `json:"message"`
+	Channel string `json:"channel"`
+}
+
+type HTTPProviderResponse struct {
+	MessageID string `json:"message_id"`
+}
+
+// HTTPProviderError is returned when the gateway responds with a non-2xx
+// status code.
+type HTTPProviderError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPProviderError) Error() string {
+	return fmt.Sprintf("sms gateway error: status %d: %s", e.StatusCode, e.Body)
+}
+
+// Creates a SmsProvider with the HTTP Config
+func NewHTTPProvider(config conf.HTTPProviderConfiguration) (SmsProvider, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &HTTPProvider{
+		Config: &config,
+	}, nil
+}
+
+func (t *HTTPProvider) SendMessage(phone, message, channel, otp string) (string, error) {
+	body, err := json.Marshal(HTTPProviderRequest{
+		Phone:   phone,
+		Message: message,
+		Channel: channel,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: defaultTimeout}
+	r, err := http.NewRequest("POST", t.Config.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	r.Header.Add("Content-Type", "application/json")
+	if t.Config.Secret != "" {
+		r.Header.Add("Authorization", "Bearer "+t.Config.Secret)
+	}
+
+	res, err := client.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer utilities.SafeClose(res.Body)
+
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		errBody, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", &HTTPProviderError{
+			StatusCode: res.StatusCode,
+			Body:       string(errBody),
+		}
+	}
+
+	// the message ID is optional, gateways may respond with an empty body
+	resp := &HTTPProviderResponse{}
+	if err := json.NewDecoder(res.Body).Decode(resp); err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return resp.MessageID, nil
+}
@@ -56,6 +56,10 @@ func TestSmsProvider(t *testing.T) {
 					ApiKey: "test_api_key",
 					Sender: "test_sender",
 				},
+				HTTP: conf.HTTPProviderConfiguration{
+					URL:    "https://sms.example.com/send",
+					Secret: "test_secret",
+				},
 			},
 		},
 	}
@@ -285,3 +289,87 @@ func (ts *SmsProviderTestSuite) TestTwilioVerifySendSms() {
 		})
 	}
 }
+
+func (ts *SmsProviderTestSuite) TestHTTPSendSms() {
+	defer gock.Off()
+	provider, err := NewHTTPProvider(ts.Config.Sms.HTTP)
+	require.NoError(ts.T(), err)
+
+	httpProvider, ok := provider.(*HTTPProvider)
+	require.Equal(ts.T(), true, ok)
+
+	phone := "123456789"
+	message := "This is the sms code: 123456"
+	body := HTTPProviderRequest{
+		Phone:   phone,
+		Message: message,
+		Channel: SMSProvider,
+	}
+
+	cases := []struct {
+		Desc              string
+		Response          func() *gock.Response
+		ExpectedMessageID string
+		ExpectedError     error
+	}{
+		{
+			Desc: "Successfully sent sms",
+			Response: func() *gock.Response {
+				return gock.New(httpProvider.Config.URL).Post("").
+					MatchHeader("Authorization", "Bearer test_secret").
+					MatchType("json").JSON(body).
+					Reply(200).JSON(HTTPProviderResponse{MessageID: "abcdef"})
+			},
+			ExpectedMessageID: "abcdef",
+		},
+		{
+			Desc: "Empty response body",
+			Response: func() *gock.Response {
+				return gock.New(httpProvider.Config.URL).Post("").
+					MatchType("json").JSON(body).
+					Reply(204)
+			},
+		},
+		{
+			Desc: "Non-2xx status code returned",
+			Response: func() *gock.Response {
+				return gock.New(httpProvider.Config.URL).Post("").
+					MatchType("json").JSON(body).
+					Reply(502).BodyString("bad gateway")
+			},
+			ExpectedError: &HTTPProviderError{
+				StatusCode: 502,
+				Body:       "bad gateway",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.Desc, func() {
+			c.Response()
+			messageID, err := httpProvider.SendMessage(phone, message, SMSProvider, "123456")
+			require.Equal(ts.T(), c.ExpectedError, err)
+			require.Equal(ts.T(), c.ExpectedMessageID, messageID)
+			require.True(ts.T(), gock.IsDone())
+		})
+	}
+}
+
+func (ts *SmsProviderTestSuite) TestHTTPProviderConfig() {
+	_, err := GetSmsProvider(conf.GlobalConfiguration{
+		Sms: conf.SmsProviderConfiguration{
+			Provider: "http",
+		},
+	})
+	require.EqualError(ts.T(), err, "missing SMS gateway URL")
+
+	provider, err := GetSmsProvider(conf.GlobalConfiguration{
+		Sms: conf.SmsProviderConfiguration{
+			Provider: "http",
+			HTTP:     ts.Config.Sms.HTTP,
+		},
+	})
+	require.NoError(ts.T(), err)
+	require.IsType(ts.T(), &HTTPProvider{}, provider)
+	require.True(ts.T(), IsValidMessageChannel(WhatsappProvider, "http"))
+}
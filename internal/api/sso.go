@@ -58,6 +58,10 @@ func (a *API) SingleSignOn(w http.ResponseWriter, r *http.Request) error {
 	if hasProviderID, err = params.validate(); err != nil {
 		return err
 	}
+
+	if params.RedirectTo != "" && !utilities.IsRedirectURLValid(a.config, params.RedirectTo) {
+		return invalidRedirectURLError()
+	}
 	codeChallengeMethod := params.CodeChallengeMethod
 	codeChallenge := params.CodeChallenge
 
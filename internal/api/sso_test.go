@@ -2,15 +2,26 @@ package api
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/gofrs/uuid"
 	jwt "github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -747,6 +758,215 @@ func (ts *SSOTestSuite) TestSingleSignOn() {
 	}
 }
 
+// testSAMLIdentityProvider returns an identity provider with a freshly
+// generated signing key, used to issue signed SAML responses in tests.
+func testSAMLIdentityProvider(t *testing.T) *saml.IdentityProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "idp.example.com",
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(24 * time.Hour),
+	}
+
+	rawCertificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	certificate, err := x509.ParseCertificate(rawCertificate)
+	require.NoError(t, err)
+
+	metadataURL, err := url.Parse("https://idp.example.com/saml/metadata")
+	require.NoError(t, err)
+
+	ssoURL, err := url.Parse("https://idp.example.com/saml/sso")
+	require.NoError(t, err)
+
+	return &saml.IdentityProvider{
+		Key:             key,
+		Certificate:     certificate,
+		MetadataURL:     *metadataURL,
+		SSOURL:          *ssoURL,
+		SignatureMethod: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+	}
+}
+
+// makeSAMLResponse returns an IdP initiated SAML response signed by idp,
+// asserting the user identified by nameID with the provided email address.
+func (ts *SSOTestSuite) makeSAMLResponse(idp *saml.IdentityProvider, nameID, email string) []byte {
+	spMetadata := ts.API.getSAMLServiceProvider(nil, true).Metadata()
+
+	// without key descriptors the identity provider does not encrypt the assertion
+	spDescriptor := spMetadata.SPSSODescriptors[0]
+	spDescriptor.KeyDescriptors = nil
+
+	acs := spDescriptor.AssertionConsumerServices[0]
+	now := time.Now().UTC()
+
+	req := &saml.IdpAuthnRequest{
+		IDP:                     idp,
+		HTTPRequest:             httptest.NewRequest(http.MethodPost, idp.SSOURL.String(), nil),
+		Now:                     now,
+		ServiceProviderMetadata: spMetadata,
+		SPSSODescriptor:         &spDescriptor,
+		ACSEndpoint:             &acs,
+	}
+
+	req.Assertion = &saml.Assertion{
+		ID:           "id-" + uuid.Must(uuid.NewV4()).String(),
+		IssueInstant: now,
+		Version:      "2.0",
+		Issuer: saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.MetadataURL.String(),
+		},
+		Subject: &saml.Subject{
+			NameID: &saml.NameID{
+				Format: string(saml.PersistentNameIDFormat),
+				Value:  nameID,
+			},
+			SubjectConfirmations: []saml.SubjectConfirmation{
+				{
+					Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
+					SubjectConfirmationData: &saml.SubjectConfirmationData{
+						NotOnOrAfter: now.Add(5 * time.Minute),
+						Recipient:    acs.Location,
+					},
+				},
+			},
+		},
+		Conditions: &saml.Conditions{
+			NotBefore:    now.Add(-time.Minute),
+			NotOnOrAfter: now.Add(5 * time.Minute),
+			AudienceRestrictions: []saml.AudienceRestriction{
+				{
+					Audience: saml.Audience{
+						Value: spMetadata.EntityID,
+					},
+				},
+			},
+		},
+		AuthnStatements: []saml.AuthnStatement{
+			{
+				AuthnInstant: now,
+				SessionIndex: "session-" + nameID,
+				AuthnContext: saml.AuthnContext{
+					AuthnContextClassRef: &saml.AuthnContextClassRef{
+						Value: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+					},
+				},
+			},
+		},
+		AttributeStatements: []saml.AttributeStatement{
+			{
+				Attributes: []saml.Attribute{
+					{
+						FriendlyName: "mail",
+						Name:         "urn:oid:0.9.2342.19200300.100.1.3",
+						NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+						Values: []saml.AttributeValue{
+							{
+								Type:  "xs:string",
+								Value: email,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	require.NoError(ts.T(), req.MakeResponse())
+
+	doc := etree.NewDocument()
+	doc.SetRoot(req.ResponseEl)
+
+	response, err := doc.WriteToBytes()
+	require.NoError(ts.T(), err)
+
+	return response
+}
+
+func (ts *SSOTestSuite) postSAMLResponse(response []byte) *httptest.ResponseRecorder {
+	form := url.Values{}
+	form.Set("SAMLResponse", base64.StdEncoding.EncodeToString(response))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/sso/saml/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func (ts *SSOTestSuite) TestSAMLAssertionConsumerService() {
+	idp := testSAMLIdentityProvider(ts.T())
+
+	metadata, err := xml.Marshal(idp.Metadata())
+	require.NoError(ts.T(), err)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"type":         "saml",
+		"metadata_xml": string(metadata),
+	})
+	require.NoError(ts.T(), err)
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/admin/sso/providers", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+ts.AdminJWT)
+	w := httptest.NewRecorder()
+
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusCreated, w.Code)
+
+	var ssoProvider struct {
+		ID string `json:"id"`
+	}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&ssoProvider))
+
+	ts.Run("Tampered assertion is rejected", func() {
+		response := ts.makeSAMLResponse(idp, "tampered-user", "saml@example.com")
+		response = bytes.ReplaceAll(response, []byte("saml@example.com"), []byte("attacker@example.com"))
+
+		w := ts.postSAMLResponse(response)
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+		_, err := models.FindIdentityByIdAndProvider(ts.API.db, "tampered-user", "sso:"+ssoProvider.ID)
+		require.True(ts.T(), models.IsNotFoundError(err))
+	})
+
+	ts.Run("Assertion signed by another identity provider is rejected", func() {
+		impostor := testSAMLIdentityProvider(ts.T())
+
+		w := ts.postSAMLResponse(ts.makeSAMLResponse(impostor, "impostor-user", "saml@example.com"))
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	})
+
+	ts.Run("Signed assertion creates the user", func() {
+		w := ts.postSAMLResponse(ts.makeSAMLResponse(idp, "saml-user", "saml@example.com"))
+		require.Equal(ts.T(), http.StatusFound, w.Code)
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(ts.T(), err)
+
+		fragment, err := url.ParseQuery(location.Fragment)
+		require.NoError(ts.T(), err)
+		require.NotEmpty(ts.T(), fragment.Get("access_token"))
+		require.NotEmpty(ts.T(), fragment.Get("refresh_token"))
+
+		identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "saml-user", "sso:"+ssoProvider.ID)
+		require.NoError(ts.T(), err)
+
+		user, err := models.FindUserByID(ts.API.db, identity.UserID)
+		require.NoError(ts.T(), err)
+		require.Equal(ts.T(), "saml@example.com", user.GetEmail())
+		require.True(ts.T(), user.IsSSOUser)
+	})
+}
+
 func TestSSOCreateParamsValidation(t *testing.T) {
 	// TODO
 }
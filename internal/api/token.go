@@ -11,11 +11,14 @@ import (
 
 	"github.com/gofrs/uuid"
 	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
 
 	"github.com/supabase/gotrue/internal/conf"
 	"github.com/supabase/gotrue/internal/metering"
 	"github.com/supabase/gotrue/internal/models"
 	"github.com/supabase/gotrue/internal/storage"
+	"github.com/supabase/gotrue/internal/utilities"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // GoTrueClaims is a struct thats used for JWT claims
@@ -29,6 +32,11 @@ type GoTrueClaims struct {
 	AuthenticatorAssuranceLevel   string                 `json:"aal,omitempty"`
 	AuthenticationMethodReference []models.AMREntry      `json:"amr,omitempty"`
 	SessionId                     string                 `json:"session_id,omitempty"`
+	IsAnonymous                   bool                   `json:"is_anonymous"`
+
+	// Impersonated is set on access tokens issued by admins for the user,
+	// rather than by the user signing in.
+	Impersonated bool `json:"impersonated,omitempty"`
 }
 
 // AccessTokenResponse represents an OAuth2 success response
@@ -41,6 +49,48 @@ type AccessTokenResponse struct {
 	User                 *models.User `json:"user"`
 	ProviderAccessToken  string       `json:"provider_token,omitempty"`
 	ProviderRefreshToken string       `json:"provider_refresh_token,omitempty"`
+
+	// ProviderIssuer is the OIDC issuer resolved for an id_token grant.
+	// Only populated when debugging is enabled.
+	ProviderIssuer string `json:"provider_issuer,omitempty"`
+
+	// AAL is the authenticator assurance level of the session, and
+	// EnrolledFactors the types of the user's verified MFA factors, so
+	// that clients know whether to prompt for MFA without another request.
+	AAL             string   `json:"aal"`
+	EnrolledFactors []string `json:"enrolled_factors"`
+}
+
+// setAssurance sets the AAL of the session, or AAL1 if there is none, and
+// the factor types the user has enrolled.
+func (r *AccessTokenResponse) setAssurance(tx *storage.Connection, user *models.User, sessionId *uuid.UUID) error {
+	r.AAL = models.AAL1.String()
+	if sessionId != nil {
+		session, err := models.FindSessionByID(tx, *sessionId, false)
+		if err != nil {
+			return err
+		}
+
+		if r.AAL, _, err = session.CalculateAALAndAMR(tx); err != nil {
+			return err
+		}
+	}
+
+	factors, err := models.FindFactorsByUser(tx, user)
+	if err != nil {
+		return err
+	}
+
+	r.EnrolledFactors = []string{}
+	enrolled := make(map[string]bool)
+	for _, factor := range factors {
+		if factor.IsVerified() && !enrolled[factor.FactorType] {
+			enrolled[factor.FactorType] = true
+			r.EnrolledFactors = append(r.EnrolledFactors, factor.FactorType)
+		}
+	}
+
+	return nil
 }
 
 // AsRedirectURL encodes the AccessTokenResponse as a redirect URL that
@@ -75,6 +125,18 @@ const InvalidLoginMessage = "Invalid login credentials"
 func (a *API) Token(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	grantType := r.FormValue("grant_type")
+
+	start := time.Now()
+	err := a.grantToken(ctx, w, r, grantType)
+
+	attrs := []attribute.KeyValue{metricGrantType(grantType), metricOutcome(err)}
+	tokenGrantCounter.Add(ctx, 1, attrs...)
+	tokenGrantDuration.Record(ctx, time.Since(start).Seconds(), attrs...)
+
+	return err
+}
+
+func (a *API) grantToken(ctx context.Context, w http.ResponseWriter, r *http.Request, grantType string) error {
 	switch grantType {
 	case "password":
 		return a.ResourceOwnerPasswordGrant(ctx, w, r)
@@ -82,8 +144,12 @@ func (a *API) Token(w http.ResponseWriter, r *http.Request) error {
 		return a.RefreshTokenGrant(ctx, w, r)
 	case "id_token":
 		return a.IdTokenGrant(ctx, w, r)
+	case "provider_access_token":
+		return a.ProviderAccessTokenGrant(ctx, w, r)
 	case "pkce":
 		return a.PKCE(ctx, w, r)
+	case "anonymous":
+		return a.AnonymousGrant(ctx, w, r)
 	default:
 		return oauthError("unsupported_grant_type", "")
 	}
@@ -112,6 +178,8 @@ func (a *API) ResourceOwnerPasswordGrant(ctx context.Context, w http.ResponseWri
 	}
 	var user *models.User
 	var grantParams models.GrantParams
+	grantParams.FillGrantParams(r, config.Security.TrustedProxies)
+
 	var provider string
 	if params.Email != "" {
 		provider = "email"
@@ -124,7 +192,13 @@ func (a *API) ResourceOwnerPasswordGrant(ctx context.Context, w http.ResponseWri
 		if !config.External.Phone.Enabled {
 			return badRequestError("Phone logins are disabled")
 		}
-		params.Phone = formatPhoneNumber(params.Phone)
+		if phone, perr := validatePhone(params.Phone, config.Sms.DefaultRegion); perr == nil {
+			params.Phone = phone
+		} else {
+			// unnormalizable numbers can't match a user created through
+			// the API, but may match one created before normalization
+			params.Phone = formatPhoneNumber(params.Phone)
+		}
 		user, err = models.FindUserByPhoneAndAudience(db, params.Phone, aud)
 	} else {
 		return oauthError("invalid_grant", InvalidLoginMessage)
@@ -137,7 +211,28 @@ func (a *API) ResourceOwnerPasswordGrant(ctx context.Context, w http.ResponseWri
 		return internalServerError("Database error querying schema").WithInternalError(err)
 	}
 
-	if user.IsBanned() || !user.Authenticate(params.Password) {
+	lockoutEnabled := config.Security.MaxLoginAttempts > 0
+
+	// locked accounts are rejected before checking the password, so that
+	// passwords can't be guessed while the account is locked
+	if lockoutEnabled && user.IsLocked() {
+		return accountLockedError()
+	}
+
+	if user.IsBanned() || user.IsDeleted() {
+		return oauthError("invalid_grant", InvalidLoginMessage)
+	}
+
+	if !user.Authenticate(params.Password) {
+		if lockoutEnabled {
+			locked, terr := a.incrementFailedLoginAttempts(r, user)
+			if terr != nil {
+				return internalServerError("Database error updating user").WithInternalError(terr)
+			}
+			if locked {
+				return accountLockedError()
+			}
+		}
 		return oauthError("invalid_grant", InvalidLoginMessage)
 	}
 
@@ -158,27 +253,55 @@ func (a *API) ResourceOwnerPasswordGrant(ctx context.Context, w http.ResponseWri
 		if terr = triggerEventHooks(ctx, tx, LoginEvent, user, config); terr != nil {
 			return terr
 		}
+		if terr = user.ResetFailedLoginAttempts(tx); terr != nil {
+			return internalServerError("Database error updating user").WithInternalError(terr)
+		}
+		if config.Security.PasswordHashUpgradeEnabled {
+			if terr = user.UpgradePasswordHash(tx, params.Password); terr != nil {
+				return internalServerError("Error upgrading password hash").WithInternalError(terr)
+			}
+		}
 		token, terr = a.issueRefreshToken(ctx, tx, user, models.PasswordGrant, grantParams)
 
 		if terr != nil {
 			return terr
 		}
-
-		if terr = a.setCookieTokens(config, token, false, w); terr != nil {
-			return internalServerError("Failed to set JWT cookie. %s", terr)
-		}
 		return nil
 	})
 	if err != nil {
 		return err
 	}
+
+	// the access token is only set once the transaction is committed
+	if err := a.setCookieTokens(config, token, false, w); err != nil {
+		return internalServerError("Failed to set JWT cookie. %s", err)
+	}
 	metering.RecordLogin("password", user.ID)
 	return sendJSON(w, http.StatusOK, token)
 }
 
+// incrementFailedLoginAttempts records a failed password login and reports
+// whether the user's account has been locked. The attempt is recorded in its
+// own transaction, so that it is kept when the login fails.
+func (a *API) incrementFailedLoginAttempts(r *http.Request, user *models.User) (bool, error) {
+	var locked bool
+	err := a.db.WithContext(r.Context()).Transaction(func(tx *storage.Connection) error {
+		var terr error
+		locked, terr = user.IncrementFailedLoginAttempts(tx, a.config.Security.MaxLoginAttempts, a.config.Security.LockoutDuration)
+		if terr != nil || !locked {
+			return terr
+		}
+		return models.NewAuditLogEntry(r, tx, user, models.UserLockedAction, "", map[string]interface{}{
+			"locked_until": user.LockedUntil,
+		})
+	})
+	return locked, err
+}
+
 func (a *API) PKCE(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	db := a.db.WithContext(ctx)
 	var grantParams models.GrantParams
+	grantParams.FillGrantParams(r, a.config.Security.TrustedProxies)
 
 	params := &PKCEGrantParams{}
 	body, err := getBodyBytes(r)
@@ -249,22 +372,74 @@ func (a *API) PKCE(ctx context.Context, w http.ResponseWriter, r *http.Request)
 }
 
 func generateAccessToken(tx *storage.Connection, user *models.User, sessionId *uuid.UUID, config *conf.JWTConfiguration) (string, int64, error) {
+	return generateAccessTokenWithClaims(tx, user, sessionId, config, nil)
+}
+
+// generateAccessTokenWithHook generates an access token that includes the
+// claims returned by the custom access token hook, if one is configured. The
+// hook is called right away, so that a failing hook rolls back the
+// transaction of tx, but the access token is only signed once the
+// transaction commits and passed to setToken then. The expiry of the access
+// token is returned right away.
+func generateAccessTokenWithHook(tx *storage.Connection, user *models.User, sessionId *uuid.UUID, config *conf.GlobalConfiguration, setToken func(string)) (int64, error) {
+	claims, err := accessTokenClaims(tx, user, sessionId, &config.JWT)
+	if err != nil {
+		return 0, err
+	}
+
+	customClaims, err := triggerCustomAccessTokenHook(user, sessionId, config)
+	if err != nil {
+		return 0, err
+	}
+
+	return claims.ExpiresAt, tx.AfterCommit(func() error {
+		signed, err := signAccessTokenWithClaims(claims, &config.JWT, customClaims)
+		if err != nil {
+			return internalServerError("error generating jwt token").WithInternalError(err)
+		}
+
+		setToken(signed)
+		return nil
+	})
+}
+
+// generateAccessTokenWithClaims generates an access token with the
+// additional custom claims merged into the standard GoTrue claims.
+func generateAccessTokenWithClaims(tx *storage.Connection, user *models.User, sessionId *uuid.UUID, config *conf.JWTConfiguration, customClaims map[string]interface{}) (string, int64, error) {
+	claims, err := accessTokenClaims(tx, user, sessionId, config)
+	if err != nil {
+		return "", 0, err
+	}
+
+	signed, err := signAccessTokenWithClaims(claims, config, customClaims)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return signed, claims.ExpiresAt, nil
+}
+
+// accessTokenClaims returns the standard GoTrue claims of an access token of
+// the user and session.
+func accessTokenClaims(tx *storage.Connection, user *models.User, sessionId *uuid.UUID, config *conf.JWTConfiguration) (*GoTrueClaims, error) {
 	aal, amr := models.AAL1.String(), []models.AMREntry{}
 	sid := ""
+	exp := config.Exp
 	if sessionId != nil {
 		sid = sessionId.String()
 		session, terr := models.FindSessionByID(tx, *sessionId, false)
 		if terr != nil {
-			return "", 0, terr
+			return nil, terr
 		}
 		aal, amr, terr = session.CalculateAALAndAMR(tx)
 		if terr != nil {
-			return "", 0, terr
+			return nil, terr
 		}
+		exp = config.ExpForGrant(session.GrantMethod())
 	}
 
 	issuedAt := time.Now().UTC()
-	expiresAt := issuedAt.Add(time.Second * time.Duration(config.Exp)).Unix()
+	expiresAt := issuedAt.Add(time.Second * time.Duration(exp)).Unix()
 
 	claims := &GoTrueClaims{
 		StandardClaims: jwt.StandardClaims{
@@ -272,20 +447,43 @@ func generateAccessToken(tx *storage.Connection, user *models.User, sessionId *u
 			Audience:  user.Aud,
 			IssuedAt:  issuedAt.Unix(),
 			ExpiresAt: expiresAt,
-			Issuer:    config.Issuer,
+			Issuer:    config.IssuerForAudience(user.Aud),
 		},
 		Email:                         user.GetEmail(),
 		Phone:                         user.GetPhone(),
 		AppMetaData:                   user.AppMetaData,
 		UserMetaData:                  user.UserMetaData,
-		Role:                          user.Role,
+		Role:                          config.RoleForUser(user.Role, user.AppMetaData),
 		SessionId:                     sid,
 		AuthenticatorAssuranceLevel:   aal,
 		AuthenticationMethodReference: amr,
+		IsAnonymous:                   user.IsAnonymous,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return claims, nil
+}
+
+// signAccessTokenWithClaims signs the claims of an access token with the
+// custom claims merged into them.
+func signAccessTokenWithClaims(claims *GoTrueClaims, config *conf.JWTConfiguration, customClaims map[string]interface{}) (string, error) {
+	if len(customClaims) == 0 {
+		return signAccessToken(claims, config)
+	}
+
+	mapClaims, err := mergeCustomClaims(claims, customClaims)
+	if err != nil {
+		return "", err
+	}
+
+	return signAccessToken(mapClaims, config)
+}
+
+// signAccessToken signs the claims of an access token with the configured
+// signing key.
+func signAccessToken(claims jwt.Claims, config *conf.JWTConfiguration) (string, error) {
+	signingMethod, signingKey := jwtSigningMethodAndKey(config)
 
+	token := jwt.NewWithClaims(signingMethod, claims)
 	if config.KeyID != "" {
 		if token.Header == nil {
 			token.Header = make(map[string]interface{})
@@ -294,12 +492,26 @@ func generateAccessToken(tx *storage.Connection, user *models.User, sessionId *u
 		token.Header["kid"] = config.KeyID
 	}
 
-	signed, err := token.SignedString([]byte(config.Secret))
+	return token.SignedString(signingKey)
+}
+
+// mergeCustomClaims returns the claims with the custom claims added to them.
+func mergeCustomClaims(claims *GoTrueClaims, customClaims map[string]interface{}) (jwt.MapClaims, error) {
+	encoded, err := json.Marshal(claims)
 	if err != nil {
-		return "", 0, err
+		return nil, err
+	}
+
+	mapClaims := jwt.MapClaims{}
+	if err := json.Unmarshal(encoded, &mapClaims); err != nil {
+		return nil, err
+	}
+
+	for key, value := range customClaims {
+		mapClaims[key] = value
 	}
 
-	return signed, expiresAt, nil
+	return mapClaims, nil
 }
 
 func (a *API) issueRefreshToken(ctx context.Context, conn *storage.Connection, user *models.User, authenticationMethod models.AuthenticationMethod, grantParams models.GrantParams) (*AccessTokenResponse, error) {
@@ -308,48 +520,100 @@ func (a *API) issueRefreshToken(ctx context.Context, conn *storage.Connection, u
 	now := time.Now()
 	user.LastSignInAt = &now
 
-	var tokenString string
-	var expiresAt int64
+	// the access token is set once the transaction commits
+	token := &AccessTokenResponse{
+		TokenType: "bearer",
+		ExpiresIn: config.JWT.ExpForGrant(authenticationMethod.String()),
+		User:      user,
+	}
+
 	var refreshToken *models.RefreshToken
+	var persistErr error
 
-	err := conn.Transaction(func(tx *storage.Connection) error {
+	persist := func(tx *storage.Connection) error {
 		var terr error
 
 		refreshToken, terr = models.GrantAuthenticatedUser(tx, user, grantParams)
 		if terr != nil {
+			persistErr = terr
 			return internalServerError("Database error granting user").WithInternalError(terr)
 		}
 
 		terr = models.AddClaimToSession(tx, *refreshToken.SessionId, authenticationMethod)
 		if terr != nil {
+			persistErr = terr
 			return terr
 		}
 
-		tokenString, expiresAt, terr = generateAccessToken(tx, user, refreshToken.SessionId, &config.JWT)
+		token.ExpiresAt, terr = generateAccessTokenWithHook(tx, user, refreshToken.SessionId, config, func(signed string) {
+			token.Token = signed
+		})
 		if terr != nil {
 			return internalServerError("error generating jwt token").WithInternalError(terr)
 		}
 		return nil
-	})
+	}
+
+	var err error
+	if config.Sessions.AllowAccessTokenOnlyFallback {
+		// the savepoint keeps the surrounding transaction usable
+		// should the session fail to be persisted
+		err = conn.Savepoint("issue_refresh_token", persist)
+		if err != nil && persistErr != nil && utilities.IsTransientPostgresError(persistErr) {
+			logrus.WithField("component", "api").WithField("user_id", user.ID).WithError(persistErr).Warn("Unable to persist session, issuing an access token without a refresh token")
+
+			return a.issueAccessTokenOnly(conn, user)
+		}
+	} else {
+		err = conn.Transaction(persist)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &AccessTokenResponse{
-		Token:        tokenString,
-		TokenType:    "bearer",
-		ExpiresIn:    config.JWT.Exp,
-		ExpiresAt:    expiresAt,
-		RefreshToken: refreshToken.Token,
-		User:         user,
-	}, nil
+	token.RefreshToken = refreshToken.Token
+	if err := token.setAssurance(conn, user, refreshToken.SessionId); err != nil {
+		return nil, internalServerError("Database error finding assurance level").WithInternalError(err)
+	}
+
+	return token, nil
+}
+
+// issueAccessTokenOnly issues an access token that isn't bound to a session,
+// and thus can't be refreshed, for when the session can't be persisted.
+func (a *API) issueAccessTokenOnly(conn *storage.Connection, user *models.User) (*AccessTokenResponse, error) {
+	config := a.config
+
+	// the access token is set once the transaction commits
+	token := &AccessTokenResponse{
+		TokenType: "bearer",
+		ExpiresIn: config.JWT.Exp,
+		User:      user,
+	}
+
+	var err error
+	token.ExpiresAt, err = generateAccessTokenWithHook(conn, user, nil, config, func(signed string) {
+		token.Token = signed
+	})
+	if err != nil {
+		return nil, internalServerError("error generating jwt token").WithInternalError(err)
+	}
+
+	if err := token.setAssurance(conn, user, nil); err != nil {
+		return nil, internalServerError("Database error finding assurance level").WithInternalError(err)
+	}
+
+	return token, nil
 }
 
 func (a *API) updateMFASessionAndClaims(r *http.Request, tx *storage.Connection, user *models.User, authenticationMethod models.AuthenticationMethod, grantParams models.GrantParams) (*AccessTokenResponse, error) {
 	ctx := r.Context()
 	config := a.config
-	var tokenString string
-	var expiresAt int64
+	// the access token is set once the transaction commits
+	token := &AccessTokenResponse{
+		TokenType: "bearer",
+		User:      user,
+	}
 	var refreshToken *models.RefreshToken
 	currentClaims := getClaims(ctx)
 	sessionId, err := uuid.FromString(currentClaims.SessionId)
@@ -385,24 +649,24 @@ func (a *API) updateMFASessionAndClaims(r *http.Request, tx *storage.Connection,
 			return err
 		}
 
-		tokenString, expiresAt, terr = generateAccessToken(tx, user, &sessionId, &config.JWT)
+		token.ExpiresAt, terr = generateAccessTokenWithHook(tx, user, &sessionId, config, func(signed string) {
+			token.Token = signed
+		})
 
 		if terr != nil {
 			return internalServerError("error generating jwt token").WithInternalError(terr)
 		}
+		token.ExpiresIn = config.JWT.ExpForGrant(session.GrantMethod())
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &AccessTokenResponse{
-		Token:        tokenString,
-		TokenType:    "bearer",
-		ExpiresIn:    config.JWT.Exp,
-		ExpiresAt:    expiresAt,
-		RefreshToken: refreshToken.Token,
-		User:         user,
-	}, nil
+	token.RefreshToken = refreshToken.Token
+	if err := token.setAssurance(tx, user, &sessionId); err != nil {
+		return nil, internalServerError("Database error finding assurance level").WithInternalError(err)
+	}
+	return token, nil
 }
 
 // setCookieTokens sets the access_token & refresh_token in the cookies
@@ -426,6 +690,7 @@ func (a *API) setCookieToken(config *conf.GlobalConfiguration, name string, toke
 		HttpOnly: true,
 		Path:     "/",
 		Domain:   config.Cookie.Domain,
+		SameSite: config.Cookie.SameSiteMode(),
 	}
 	if !session {
 		cookie.Expires = time.Now().Add(exp)
@@ -455,5 +720,6 @@ func (a *API) clearCookieToken(config *conf.GlobalConfiguration, name string, w
 		HttpOnly: true,
 		Path:     "/",
 		Domain:   config.Cookie.Domain,
+		SameSite: config.Cookie.SameSiteMode(),
 	})
 }
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/supabase/gotrue/internal/api/provider"
+	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/observability"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ProviderAccessTokenGrantParams are the parameters the
+// ProviderAccessTokenGrant method accepts
+type ProviderAccessTokenGrantParams struct {
+	AccessToken string `json:"access_token"`
+	Provider    string `json:"provider"`
+	ClientID    string `json:"client_id"`
+	Issuer      string `json:"issuer"`
+}
+
+// idTokenGrantParams returns the id_token grant params that select the same
+// provider, so that the provider is resolved and rate limited like it is for
+// the id_token grant.
+func (p *ProviderAccessTokenGrantParams) idTokenGrantParams() *IdTokenGrantParams {
+	return &IdTokenGrantParams{
+		AccessToken: p.AccessToken,
+		Provider:    p.Provider,
+		ClientID:    p.ClientID,
+		Issuer:      p.Issuer,
+	}
+}
+
+// ProviderAccessTokenGrant implements the provider_access_token grant type
+// flow, for clients that only get an access token (and no ID token) from an
+// OIDC provider. The user is looked up at the provider's userinfo endpoint,
+// and if the provider supports token introspection, the access token must
+// have been issued to one of the provider's client IDs.
+func (a *API) ProviderAccessTokenGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) (err error) {
+	log := observability.GetLogEntry(r)
+	config := a.config
+
+	params := &ProviderAccessTokenGrantParams{}
+
+	ctx, span := a.startSpan(ctx, "provider_access_token_grant")
+
+	var providerType, issuer string
+	defer func() {
+		span.SetAttributes(
+			attribute.String("gotrue.provider", providerType),
+			attribute.String("gotrue.oidc.issuer", issuer),
+		)
+		observability.EndSpan(span, err)
+
+		if providerType == "" {
+			providerType = params.Provider
+		}
+
+		a.recordProviderLogin(ctx, providerType, err)
+	}()
+
+	body, err := getBodyBytes(r)
+	if err != nil {
+		return badRequestError("Could not read body").WithInternalError(err)
+	}
+
+	if err := json.Unmarshal(body, params); err != nil {
+		return badRequestError("Could not read provider access token grant params: %v", err)
+	}
+
+	if params.AccessToken == "" {
+		return oauthError("invalid request", "access_token required")
+	}
+
+	if params.Provider == "" && (params.ClientID == "" || params.Issuer == "") {
+		return oauthError("invalid request", "provider or client_id and issuer required")
+	}
+
+	idTokenParams := params.idTokenGrantParams()
+
+	if err := a.limitIdTokenGrant(w, r, idTokenParams); err != nil {
+		return err
+	}
+
+	oidcProvider, oauthConfig, providerType, acceptableClientIDs, err := idTokenParams.getProvider(ctx, config, a.oidcProviders, r)
+	if err != nil {
+		return err
+	}
+
+	var clientID, secret string
+	if len(acceptableClientIDs) > 0 {
+		clientID = acceptableClientIDs[0]
+	}
+	if oauthConfig != nil {
+		secret = oauthConfig.Secret
+	}
+
+	introspection, err := provider.IntrospectAccessToken(ctx, oidcProvider, clientID, secret, params.AccessToken)
+	if err != nil {
+		if !errors.Is(err, provider.ErrIntrospectionNotSupported) {
+			return invalidGrantError("Unable to introspect access_token").WithInternalError(err)
+		}
+
+		log.WithField("provider", providerType).Warn("Provider does not support token introspection, the audience of the access_token can't be verified.")
+	} else {
+		if !introspection.Active {
+			return invalidGrantError("Inactive access_token")
+		}
+
+		var correctAudience bool
+		clientID, correctAudience = matchAcceptableAudience(introspection.Audience, introspection.ClientID, acceptableClientIDs)
+		if !correctAudience {
+			return invalidGrantError("Unacceptable audience in access_token")
+		}
+	}
+
+	userData, err := provider.FetchUserInfo(ctx, oidcProvider, params.AccessToken)
+	if err != nil {
+		return invalidGrantError("Bad access token").WithInternalError(err)
+	}
+
+	issuer = userData.Metadata.Issuer
+
+	if introspection != nil && introspection.Subject != "" && introspection.Subject != userData.Metadata.Subject {
+		return invalidGrantError("Subject of access_token does not match userinfo")
+	}
+
+	if err := checkAssurance(oauthConfig, userData.RawClaims); err != nil {
+		return err
+	}
+
+	token, err := a.signInWithExternalIdentity(ctx, w, r, userData, providerType, clientID, models.ProviderAccessTokenGrantAction, map[string]interface{}{
+		"provider":  providerType,
+		"issuer":    userData.Metadata.Issuer,
+		"subject":   userData.Metadata.Subject,
+		"client_id": clientID,
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, token)
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/models"
+)
+
+// setupKeycloakUserInfo configures the Keycloak provider to be discovered at
+// a test server whose userinfo endpoint accepts the access token "valid", and
+// whose introspection endpoint, if enabled, reports it as issued to the
+// audience.
+func (ts *TokenTestSuite) setupKeycloakUserInfo(introspection bool, audience string) *httptest.Server {
+	keycloak := ts.Config.External.Keycloak
+	ts.T().Cleanup(func() {
+		ts.Config.External.Keycloak = keycloak
+	})
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			discovery := map[string]interface{}{
+				"issuer":                 server.URL,
+				"authorization_endpoint": server.URL + "/authorize",
+				"token_endpoint":         server.URL + "/token",
+				"jwks_uri":               server.URL + "/jwks",
+				"userinfo_endpoint":      server.URL + "/userinfo",
+			}
+			if introspection {
+				discovery["introspection_endpoint"] = server.URL + "/introspect"
+			}
+
+			require.NoError(ts.T(), json.NewEncoder(w).Encode(discovery))
+
+		case "/userinfo":
+			if r.Header.Get("Authorization") != "Bearer valid" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			require.NoError(ts.T(), json.NewEncoder(w).Encode(map[string]interface{}{
+				"sub":            "keycloak-subject",
+				"email":          "keycloak@example.com",
+				"email_verified": true,
+			}))
+
+		case "/introspect":
+			clientID, secret, ok := r.BasicAuth()
+			require.True(ts.T(), ok)
+			require.Equal(ts.T(), "keycloak-client", clientID)
+			require.Equal(ts.T(), "keycloak-secret", secret)
+
+			require.NoError(ts.T(), r.ParseForm())
+
+			require.NoError(ts.T(), json.NewEncoder(w).Encode(map[string]interface{}{
+				"active": r.PostForm.Get("token") == "valid",
+				"aud":    audience,
+				"sub":    "keycloak-subject",
+			}))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	ts.T().Cleanup(server.Close)
+
+	ts.Config.External.Keycloak.URL = server.URL
+	ts.Config.External.Keycloak.Issuer = ""
+	ts.Config.External.Keycloak.JWKSURL = ""
+	ts.Config.External.Keycloak.ClientID = []string{"keycloak-client"}
+	ts.Config.External.Keycloak.Secret = "keycloak-secret"
+
+	return server
+}
+
+func (ts *TokenTestSuite) providerAccessTokenGrant(params map[string]interface{}) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=provider_access_token", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func (ts *TokenTestSuite) TestProviderAccessTokenGrant() {
+	for _, introspection := range []bool{false, true} {
+		models.TruncateAll(ts.API.db)
+		server := ts.setupKeycloakUserInfo(introspection, "keycloak-client")
+
+		w := ts.providerAccessTokenGrant(map[string]interface{}{
+			"provider":     "keycloak",
+			"access_token": "valid",
+		})
+		require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+		data := AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.NotEmpty(ts.T(), data.RefreshToken)
+		require.Equal(ts.T(), "keycloak@example.com", data.User.GetEmail())
+
+		identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "keycloak-subject", "keycloak")
+		require.NoError(ts.T(), err)
+		require.Equal(ts.T(), data.User.ID, identity.UserID)
+		require.Equal(ts.T(), server.URL, identity.IdentityData["iss"])
+
+		entries, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.ProviderAccessTokenGrantAction), nil)
+		require.NoError(ts.T(), err)
+		require.Len(ts.T(), entries, 1)
+	}
+}
+
+func (ts *TokenTestSuite) TestProviderAccessTokenGrantInvalidToken() {
+	cases := []struct {
+		desc          string
+		introspection bool
+		audience      string
+		accessToken   string
+	}{
+		{
+			desc:        "rejected by userinfo",
+			accessToken: "invalid",
+		},
+		{
+			desc:          "inactive",
+			introspection: true,
+			audience:      "keycloak-client",
+			accessToken:   "invalid",
+		},
+		{
+			desc:          "issued to another client",
+			introspection: true,
+			audience:      "other-client",
+			accessToken:   "valid",
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			ts.setupKeycloakUserInfo(c.introspection, c.audience)
+
+			w := ts.providerAccessTokenGrant(map[string]interface{}{
+				"provider":     "keycloak",
+				"access_token": c.accessToken,
+			})
+			require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+			data := &OAuthError{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+			require.Equal(ts.T(), "invalid_grant", data.Err)
+
+			_, err := models.FindIdentityByIdAndProvider(ts.API.db, "keycloak-subject", "keycloak")
+			require.True(ts.T(), models.IsNotFoundError(err))
+		})
+	}
+}
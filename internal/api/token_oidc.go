@@ -14,62 +14,103 @@ import (
 	"github.com/supabase/gotrue/internal/models"
 	"github.com/supabase/gotrue/internal/observability"
 	"github.com/supabase/gotrue/internal/storage"
+	"github.com/supabase/gotrue/internal/utilities"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // IdTokenGrantParams are the parameters the IdTokenGrant method accepts
 type IdTokenGrantParams struct {
-	IdToken     string `json:"id_token"`
-	AccessToken string `json:"access_token"`
-	Nonce       string `json:"nonce"`
-	Provider    string `json:"provider"`
-	ClientID    string `json:"client_id"`
-	Issuer      string `json:"issuer"`
+	IdToken     string   `json:"id_token"`
+	AccessToken string   `json:"access_token"`
+	Nonce       string   `json:"nonce"`
+	Nonces      []string `json:"nonces"`
+	Provider    string   `json:"provider"`
+	ClientID    string   `json:"client_id"`
+	Issuer      string   `json:"issuer"`
 }
 
-func (p *IdTokenGrantParams) getProvider(ctx context.Context, config *conf.GlobalConfiguration, r *http.Request) (*oidc.Provider, *conf.OAuthProviderConfiguration, string, []string, error) {
+func (p *IdTokenGrantParams) getProvider(ctx context.Context, config *conf.GlobalConfiguration, providers *provider.OIDCProviderCache, r *http.Request) (*oidc.Provider, *conf.OAuthProviderConfiguration, string, []string, error) {
 	log := observability.GetLogEntry(r)
 
 	var cfg *conf.OAuthProviderConfiguration
 	var issuer string
 	var providerType string
 	var acceptableClientIDs []string
+	var discoveryURL string
+	var jwksURL string
+
+	directoryProviderType, directoryCfg := config.External.DirectoryOIDCProvider(p.Provider, p.Issuer)
 
 	switch true {
 	case p.Provider == "apple" || p.Issuer == provider.IssuerApple:
 		cfg = &config.External.Apple
 		providerType = "apple"
 		issuer = provider.IssuerApple
-		acceptableClientIDs = append(acceptableClientIDs, config.External.Apple.ClientID...)
-
-		if config.External.IosBundleId != "" {
-			acceptableClientIDs = append(acceptableClientIDs, config.External.IosBundleId)
-		}
+		acceptableClientIDs = appleClientIDs(&config.External)
 
 	case p.Provider == "google" || p.Issuer == provider.IssuerGoogle:
 		cfg = &config.External.Google
 		providerType = "google"
 		issuer = provider.IssuerGoogle
-		acceptableClientIDs = append(acceptableClientIDs, config.External.Google.ClientID...)
+		acceptableClientIDs = providerClientIDs(cfg)
 
-	case p.Provider == "azure" || p.Issuer == provider.IssuerAzureCommon || p.Issuer == provider.IssuerAzureOrganizations:
+	case p.Provider == "azure" || p.Issuer == provider.IssuerAzureCommon || p.Issuer == provider.IssuerAzureOrganizations || (config.External.Azure.Tenant != "" && p.Issuer == provider.AzureTenantIssuer(config.External.Azure.Tenant)):
 		cfg = &config.External.Azure
 		providerType = "azure"
-		issuer = p.Issuer
-		acceptableClientIDs = append(acceptableClientIDs, config.External.Azure.ClientID...)
+		acceptableClientIDs = providerClientIDs(cfg)
+
+		var err error
+		issuer, err = p.azureIssuer(ctx, config.External.Azure.Tenant)
+		if err != nil {
+			return nil, nil, "", nil, err
+		}
 
 	case p.Provider == "facebook" || p.Issuer == provider.IssuerFacebook:
 		cfg = &config.External.Facebook
 		providerType = "facebook"
 		issuer = provider.IssuerFacebook
-		acceptableClientIDs = append(acceptableClientIDs, config.External.Facebook.ClientID...)
+		acceptableClientIDs = providerClientIDs(cfg)
+
+	case p.Provider == "linkedin_oidc" || p.Issuer == provider.IssuerLinkedin:
+		cfg = &config.External.LinkedinOIDC
+		providerType = "linkedin_oidc"
+		issuer = provider.IssuerLinkedin
+		acceptableClientIDs = providerClientIDs(cfg)
+
+		// LinkedIn serves its discovery document from a different
+		// URL than the issuer found in its ID tokens
+		ctx = oidc.InsecureIssuerURLContext(ctx, provider.IssuerLinkedin)
+		discoveryURL = provider.IssuerLinkedin + "/oauth"
 
-	case p.Provider == "keycloak" || (config.External.Keycloak.Enabled && config.External.Keycloak.URL != "" && p.Issuer == config.External.Keycloak.URL):
+	case p.Provider == "github" || p.Issuer == provider.IssuerGitHub:
+		// the only ID tokens GitHub issues are those of GitHub Actions,
+		// whose subject is a repository and never a GitHub user
+		return nil, nil, "", nil, badRequestError("GitHub does not issue ID tokens for users, sign in with GitHub through /authorize instead")
+
+	case p.Provider == "keycloak" || (config.External.Keycloak.Enabled && config.External.Keycloak.URL != "" && p.Issuer == config.External.Keycloak.URL) || (config.External.Keycloak.Enabled && config.External.Keycloak.Issuer != "" && p.Issuer == config.External.Keycloak.Issuer):
 		cfg = &config.External.Keycloak
 		providerType = "keycloak"
 		issuer = config.External.Keycloak.URL
-		acceptableClientIDs = append(acceptableClientIDs, config.External.Keycloak.ClientID...)
+		acceptableClientIDs = providerClientIDs(cfg)
+
+		if config.External.Keycloak.Issuer != "" {
+			issuer = config.External.Keycloak.Issuer
+		}
+
+		jwksURL = config.External.Keycloak.JWKSURL
+
+	case directoryCfg != nil:
+		cfg = directoryCfg
+		providerType = directoryProviderType
+		issuer = directoryCfg.Issuer
+		acceptableClientIDs = providerClientIDs(cfg)
+		jwksURL = directoryCfg.JWKSURL
 
 	default:
+		if config.External.DisableArbitraryIssuers {
+			return nil, nil, "", nil, badRequestError(fmt.Sprintf("Custom OIDC provider %q not allowed", p.Issuer))
+		}
+
 		log.WithField("issuer", p.Issuer).WithField("client_id", p.ClientID).Warn("Use of POST /token with arbitrary issuer and client_id is deprecated for security reasons. Please switch to using the API with provider only!")
 
 		allowed := false
@@ -92,91 +133,285 @@ func (p *IdTokenGrantParams) getProvider(ctx context.Context, config *conf.Globa
 		return nil, nil, "", nil, badRequestError(fmt.Sprintf("Provider (issuer %q) is not enabled", issuer))
 	}
 
-	oidcProvider, err := oidc.NewProvider(ctx, issuer)
+	var oidcProvider *oidc.Provider
+	var err error
+
+	if jwksURL != "" {
+		oidcProvider, err = providers.GetWithJWKS(ctx, issuer, jwksURL)
+	} else {
+		if discoveryURL == "" {
+			discoveryURL = issuer
+		}
+
+		oidcProvider, err = providers.Get(ctx, discoveryURL)
+	}
 	if err != nil {
+		if provider.IsProviderUnavailable(err) {
+			return nil, nil, "", nil, providerUnavailableError(fmt.Sprintf("Unable to reach provider (issuer %q)", issuer)).WithInternalError(err)
+		}
+
 		return nil, nil, "", nil, err
 	}
 
 	return oidcProvider, cfg, providerType, acceptableClientIDs, nil
 }
 
-// IdTokenGrant implements the id_token grant type flow
-func (a *API) IdTokenGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	log := observability.GetLogEntry(r)
+// azureIssuer resolves the tenant-specific issuer that must have issued the
+// Azure ID token. The common and organizations issuers never appear in ID
+// tokens, so when they (or no issuer) are requested the actual issuer is
+// read from the ID token. Either way, the issuer must be an Azure issuer. If
+// a tenant is configured, only ID tokens from that tenant's issuer are
+// accepted.
+func (p *IdTokenGrantParams) azureIssuer(ctx context.Context, tenant string) (string, error) {
+	if tenant != "" {
+		tenantIssuer := provider.AzureTenantIssuer(tenant)
+
+		if p.Issuer != "" && p.Issuer != tenantIssuer {
+			return "", badRequestError(fmt.Sprintf("Azure issuer %q does not match configured tenant %q", p.Issuer, tenant))
+		}
 
-	db := a.db.WithContext(ctx)
-	config := a.config
+		return tenantIssuer, nil
+	}
 
-	params := &IdTokenGrantParams{}
+	if p.Issuer != "" && p.Issuer != provider.IssuerAzureCommon && p.Issuer != provider.IssuerAzureOrganizations {
+		if !provider.IsAzureIssuer(p.Issuer) {
+			return "", badRequestError(fmt.Sprintf("Issuer %q is not an Azure issuer", p.Issuer))
+		}
 
-	body, err := getBodyBytes(r)
+		return p.Issuer, nil
+	}
+
+	detectedIssuer, err := provider.DetectAzureIDTokenIssuer(ctx, p.IdToken)
 	if err != nil {
-		return badRequestError("Could not read body").WithInternalError(err)
+		return "", badRequestError("Unable to detect issuer in ID token for Azure provider").WithInternalError(err)
 	}
 
-	if err := json.Unmarshal(body, params); err != nil {
-		return badRequestError("Could not read id token grant params: %v", err)
+	if !provider.IsAzureIssuer(detectedIssuer) {
+		return "", badRequestError(fmt.Sprintf("Issuer %q in ID token is not an Azure issuer", detectedIssuer))
+	}
+
+	if p.Issuer == provider.IssuerAzureOrganizations && detectedIssuer == provider.IssuerAzureMicrosoft {
+		return "", badRequestError("Personal Microsoft accounts are not accepted by the organizations issuer")
+	}
+
+	return detectedIssuer, nil
+}
+
+// verifyNonce checks the nonce claim of the ID token against the nonce (or
+// any of the nonces) passed by the client. Depending on the hashing, the ID
+// token is expected to contain the hex-encoded SHA-256 hash of the nonce
+// (the default) or the nonce itself.
+func (p *IdTokenGrantParams) verifyNonce(tokenNonce string, hashing string) error {
+	nonces := p.Nonces
+	if p.Nonce != "" {
+		nonces = []string{p.Nonce}
+	}
+
+	tokenHasNonce := tokenNonce != ""
+	paramsHasNonce := len(nonces) > 0
+
+	if tokenHasNonce != paramsHasNonce {
+		return oauthError("invalid request", "Passed nonce and nonce in id_token should either both exist or not.")
+	} else if tokenHasNonce && paramsHasNonce {
+		// verify nonce to mitigate replay attacks
+		for _, nonce := range nonces {
+			expected := nonce
+			if hashing != conf.NonceHashingPlain {
+				expected = fmt.Sprintf("%x", sha256.Sum256([]byte(nonce)))
+			}
+
+			if expected == tokenNonce {
+				return nil
+			}
+		}
+
+		return oauthError("invalid nonce", "Nonces mismatch")
+	}
+
+	return nil
+}
+
+// providerClientIDs returns the client IDs whose ID tokens are accepted for a
+// provider: its client IDs, its web client IDs and the platform identifiers,
+// such as the iOS bundle ID, that the provider issues ID tokens to.
+func providerClientIDs(cfg *conf.OAuthProviderConfiguration, platformIDs ...string) []string {
+	var clientIDs []string
+
+	clientIDs = append(clientIDs, cfg.ClientID...)
+	clientIDs = append(clientIDs, cfg.WebClientID...)
+
+	for _, id := range platformIDs {
+		if id != "" {
+			clientIDs = append(clientIDs, id)
+		}
+	}
+
+	return clientIDs
+}
+
+// appleClientIDs returns the client IDs whose Apple ID tokens are accepted:
+// the App IDs of native apps, which are the bundle IDs, and the Services IDs
+// of web apps.
+func appleClientIDs(config *conf.ProviderConfiguration) []string {
+	clientIDs := providerClientIDs(&config.Apple, config.IosBundleId, config.AndroidPackageName)
+
+	for _, id := range config.Apple.ServicesID {
+		if id != "" {
+			clientIDs = append(clientIDs, id)
+		}
+	}
+
+	return clientIDs
+}
+
+// matchAcceptableAudience returns the first acceptable client ID that is in
+// the audience of the ID token or is its authorized party (azp claim), or
+// false if there is none. Pass an empty authorized party if it should not be
+// considered.
+func matchAcceptableAudience(audience []string, authorizedParty string, acceptableClientIDs []string) (string, bool) {
+	for _, clientID := range acceptableClientIDs {
+		if clientID == "" {
+			continue
+		}
+
+		if clientID == authorizedParty {
+			return clientID, true
+		}
+
+		for _, aud := range audience {
+			if aud == clientID {
+				return clientID, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// limitIdTokenGrant applies the id_token grant rate limit, separately for
+// each client IP address and provider (or issuer).
+func (a *API) limitIdTokenGrant(w http.ResponseWriter, r *http.Request, params *IdTokenGrantParams) error {
+	providerKey := params.Provider
+	if providerKey == "" {
+		providerKey = params.Issuer
 	}
 
+	if !a.rateLimit(w, a.idTokenGrantLimiter, utilities.GetClientIPAddress(r, a.config.Security.TrustedProxies)+"|"+providerKey) {
+		return httpError(http.StatusTooManyRequests, "Rate limit exceeded")
+	}
+
+	return nil
+}
+
+// verifyIdToken runs all checks of the id_token grant on the ID token in the
+// params, without making any changes. It returns the verified ID token, the
+// user data extracted from it, the provider type and the acceptable client ID
+// the ID token was issued to.
+func (a *API) verifyIdToken(ctx context.Context, w http.ResponseWriter, r *http.Request, params *IdTokenGrantParams) (*oidc.IDToken, *provider.UserProvidedData, string, string, error) {
+	log := observability.GetLogEntry(r)
+
+	config := a.config
+
 	if params.IdToken == "" {
-		return oauthError("invalid request", "id_token required")
+		return nil, nil, "", "", oauthError("invalid request", "id_token required")
 	}
 
 	if params.Provider == "" && (params.ClientID == "" || params.Issuer == "") {
-		return oauthError("invalid request", "provider or client_id and issuer required")
+		return nil, nil, "", "", oauthError("invalid request", "provider or client_id and issuer required")
+	}
+
+	if err := a.limitIdTokenGrant(w, r, params); err != nil {
+		return nil, nil, "", "", err
 	}
 
-	oidcProvider, oauthConfig, providerType, acceptableClientIDs, err := params.getProvider(ctx, config, r)
+	if params.Nonce != "" && len(params.Nonces) > 0 {
+		return nil, nil, "", "", oauthError("invalid request", "Only one of nonce or nonces can be provided")
+	}
+
+	for _, nonce := range params.Nonces {
+		if nonce == "" {
+			return nil, nil, "", "", oauthError("invalid request", "nonces must not contain empty values")
+		}
+	}
+
+	oidcProvider, oauthConfig, providerType, acceptableClientIDs, err := params.getProvider(ctx, config, a.oidcProviders, r)
 	if err != nil {
-		return err
+		return nil, nil, "", "", err
 	}
 
+	requireAccessToken := oauthConfig != nil && oauthConfig.RequireAccessToken
+
 	idToken, userData, err := provider.ParseIDToken(ctx, oidcProvider, nil, params.IdToken, provider.ParseIDTokenOptions{
-		SkipAccessTokenCheck: params.AccessToken == "",
-		AccessToken:          params.AccessToken,
+		SkipAccessTokenCheck:  params.AccessToken == "" && !requireAccessToken,
+		AccessToken:           params.AccessToken,
+		ClockSkewTolerance:    config.External.IdTokenClockSkewTolerance(oauthConfig),
+		InferSigningAlgorithm: config.External.InferIdTokenSigningAlgorithm,
+		AllowEmptyEmail:       oauthConfig != nil && oauthConfig.AllowEmptyEmail,
 	})
 	if err != nil {
-		return oauthError("invalid request", "Bad ID token").WithInternalError(err)
+		if errors.Is(err, provider.ErrMissingAccessToken) {
+			return nil, nil, "", "", oauthError("invalid request", "access_token required for ID token with at_hash claim").WithInternalError(err)
+		}
+
+		if provider.IsProviderUnavailable(err) {
+			return nil, nil, "", "", providerUnavailableError("Unable to fetch the provider's signing keys").WithInternalError(err)
+		}
+
+		return nil, nil, "", "", invalidGrantError("Bad ID token").WithInternalError(err)
 	}
 
 	if idToken.Subject == "" {
-		return oauthError("invalid request", "Missing sub claim in id_token")
+		return nil, nil, "", "", invalidGrantError("Missing sub claim in id_token")
 	}
 
-	correctAudience := false
-	for _, clientID := range acceptableClientIDs {
-		if clientID == "" {
-			continue
-		}
+	if len(userData.Emails) <= 0 && (oauthConfig == nil || !oauthConfig.AllowEmptyEmail) {
+		return nil, nil, "", "", oauthError("invalid request", "Missing email address in id_token")
+	}
 
-		for _, aud := range idToken.Audience {
-			if aud == clientID {
-				correctAudience = true
-				break
-			}
+	allowAuthorizedParty := providerType == "google" || (oauthConfig != nil && oauthConfig.AllowAuthorizedParty)
+
+	var authorizedParty string
+	if allowAuthorizedParty {
+		var claims struct {
+			AuthorizedParty string `json:"azp"`
 		}
 
-		if correctAudience {
-			break
+		if err := idToken.Claims(&claims); err != nil {
+			return nil, nil, "", "", invalidGrantError("Bad ID token").WithInternalError(err)
 		}
+
+		authorizedParty = claims.AuthorizedParty
 	}
 
+	clientID, correctAudience := matchAcceptableAudience(idToken.Audience, authorizedParty, acceptableClientIDs)
+
 	if !correctAudience {
-		return oauthError("invalid request", "Unacceptable audience in id_token")
+		return nil, nil, "", "", invalidGrantError("Unacceptable audience in id_token")
 	}
 
-	if !oauthConfig.SkipNonceCheck {
-		tokenHasNonce := idToken.Nonce != ""
-		paramsHasNonce := params.Nonce != ""
+	if err := checkAssurance(oauthConfig, userData.RawClaims); err != nil {
+		return nil, nil, "", "", err
+	}
 
-		if tokenHasNonce != paramsHasNonce {
-			return oauthError("invalid request", "Passed nonce and nonce in id_token should either both exist or not.")
-		} else if tokenHasNonce && paramsHasNonce {
-			// verify nonce to mitigate replay attacks
-			hash := fmt.Sprintf("%x", sha256.Sum256([]byte(params.Nonce)))
-			if hash != idToken.Nonce {
-				return oauthError("invalid nonce", "Nonces mismatch")
-			}
+	if providerType == "azure" && oauthConfig.Tenant != "" {
+		var claims provider.AzureIDTokenClaims
+		if err := idToken.Claims(&claims); err != nil {
+			return nil, nil, "", "", invalidGrantError("Bad ID token").WithInternalError(err)
+		}
+
+		if claims.TenantID != oauthConfig.Tenant {
+			return nil, nil, "", "", invalidGrantError("Unacceptable tenant in id_token")
+		}
+	}
+
+	if oauthConfig == nil || !oauthConfig.SkipNonceCheck {
+		var nonceHashing string
+		if oauthConfig != nil {
+			nonceHashing = oauthConfig.NonceHashing
+		}
+
+		if err := params.verifyNonce(idToken.Nonce, nonceHashing); err != nil {
+			return nil, nil, "", "", err
 		}
 	}
 
@@ -190,16 +425,38 @@ func (a *API) IdTokenGrant(ctx context.Context, w http.ResponseWriter, r *http.R
 		}
 	}
 
+	return idToken, userData, providerType, clientID, nil
+}
+
+// signInWithExternalIdentity signs in the user of the external identity
+// verified by a grant, issuing a session for the client ID and recording the
+// grant's audit action. An anonymous user signing in is converted into a
+// permanent user instead of signing in to another account.
+func (a *API) signInWithExternalIdentity(ctx context.Context, w http.ResponseWriter, r *http.Request, userData *provider.UserProvidedData, providerType, clientID string, action models.AuditAction, traits map[string]interface{}) (*AccessTokenResponse, error) {
+	db := a.db.WithContext(ctx)
+	config := a.config
+
+	anonymousUser, _, err := a.maybeLoadAnonymousUser(r)
+	if err != nil {
+		return nil, err
+	}
+
 	var token *AccessTokenResponse
 	var grantParams models.GrantParams
+	var suppressed *signInSuppressedError
+
+	grantParams.FillGrantParams(r, config.Security.TrustedProxies)
+	grantParams.ClientID = clientID
+	userData.ClientID = clientID
 
 	if err := db.Transaction(func(tx *storage.Connection) error {
 		var user *models.User
+		var created bool
 		var terr error
 
-		user, terr = a.createAccountFromExternalIdentity(tx, r, userData, providerType)
+		user, created, terr = a.createAccountFromExternalIdentity(tx, r, userData, providerType, anonymousUser)
 		if terr != nil {
-			if errors.Is(terr, errReturnNil) {
+			if errors.As(terr, &suppressed) && suppressed.Commit {
 				return nil
 			}
 
@@ -211,10 +468,181 @@ func (a *API) IdTokenGrant(ctx context.Context, w http.ResponseWriter, r *http.R
 			return terr
 		}
 
+		auditTraits := map[string]interface{}{
+			"user_id": user.ID,
+			"created": created,
+		}
+		for key, value := range traits {
+			auditTraits[key] = value
+		}
+
+		if terr := models.NewAuditLogEntry(r, tx, user, action, "", auditTraits); terr != nil {
+			return terr
+		}
+
 		return nil
 	}); err != nil {
-		return oauthError("server_error", "Internal Server Error").WithInternalError(err)
+		if errors.As(err, &suppressed) {
+			return nil, suppressed.asOAuthError()
+		}
+
+		return nil, oauthError("server_error", "Internal Server Error").WithInternalError(err)
+	}
+
+	if suppressed != nil {
+		return nil, suppressed.asOAuthError()
+	}
+
+	// the access token is only set once the transaction is committed
+	if err := a.setCookieTokens(config, token, false, w); err != nil {
+		return nil, internalServerError("Failed to set JWT cookie. %s", err)
+	}
+
+	return token, nil
+}
+
+// IdTokenGrant implements the id_token grant type flow
+func (a *API) IdTokenGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) (err error) {
+	config := a.config
+
+	params := &IdTokenGrantParams{}
+
+	ctx, span := a.startSpan(ctx, "id_token_grant")
+
+	var providerType, issuer string
+	defer func() {
+		span.SetAttributes(
+			attribute.String("gotrue.provider", providerType),
+			attribute.String("gotrue.oidc.issuer", issuer),
+		)
+		observability.EndSpan(span, err)
+
+		if providerType == "" {
+			providerType = params.Provider
+		}
+
+		a.recordProviderLogin(ctx, providerType, err)
+	}()
+
+	body, err := getBodyBytes(r)
+	if err != nil {
+		return badRequestError("Could not read body").WithInternalError(err)
+	}
+
+	if err := json.Unmarshal(body, params); err != nil {
+		return badRequestError("Could not read id token grant params: %v", err)
+	}
+
+	issuer = params.Issuer
+
+	idToken, userData, providerType, clientID, err := a.verifyIdToken(ctx, w, r, params)
+	if err != nil {
+		return err
+	}
+
+	issuer = idToken.Issuer
+
+	token, err := a.signInWithExternalIdentity(ctx, w, r, userData, providerType, clientID, models.IdTokenGrantAction, map[string]interface{}{
+		"provider":  providerType,
+		"issuer":    idToken.Issuer,
+		"subject":   idToken.Subject,
+		"client_id": clientID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if config.Debug {
+		// the verifier ensures the ID token's issuer is the one
+		// resolved by getProvider
+		token.ProviderIssuer = idToken.Issuer
 	}
 
 	return sendJSON(w, http.StatusOK, token)
 }
+
+// IdTokenVerifyResponse is the response of the id_token verification endpoint
+type IdTokenVerifyResponse struct {
+	Valid            bool                   `json:"valid"`
+	Provider         string                 `json:"provider,omitempty"`
+	Issuer           string                 `json:"issuer,omitempty"`
+	ClientID         string                 `json:"client_id,omitempty"`
+	Claims           map[string]interface{} `json:"claims,omitempty"`
+	Error            string                 `json:"error,omitempty"`
+	ErrorDescription string                 `json:"error_description,omitempty"`
+}
+
+// IdTokenVerify verifies an ID token like the id_token grant does, without
+// signing the user in or making any changes, to help debug provider
+// configurations. Rejected ID tokens are reported with valid set to false,
+// along with the error the id_token grant would have returned.
+func (a *API) IdTokenVerify(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	params := &IdTokenGrantParams{}
+
+	body, err := getBodyBytes(r)
+	if err != nil {
+		return badRequestError("Could not read body").WithInternalError(err)
+	}
+
+	if err := json.Unmarshal(body, params); err != nil {
+		return badRequestError("Could not read id token grant params: %v", err)
+	}
+
+	idToken, userData, providerType, clientID, err := a.verifyIdToken(ctx, w, r, params)
+	if err != nil {
+		var oauthErr *OAuthError
+		if errors.As(err, &oauthErr) {
+			return sendJSON(w, http.StatusOK, &IdTokenVerifyResponse{
+				Valid:            false,
+				Error:            oauthErr.Err,
+				ErrorDescription: oauthErr.Description,
+			})
+		}
+
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, &IdTokenVerifyResponse{
+		Valid:    true,
+		Provider: providerType,
+		Issuer:   idToken.Issuer,
+		ClientID: clientID,
+		Claims:   userData.RawClaims,
+	})
+}
+
+// checkAssurance verifies that the ID token claims satisfy the acr and amr
+// requirements of the provider, if any.
+func checkAssurance(oauthConfig *conf.OAuthProviderConfiguration, claims map[string]interface{}) error {
+	if oauthConfig == nil {
+		return nil
+	}
+
+	if len(oauthConfig.RequiredACR) > 0 {
+		acr, _ := claims["acr"].(string)
+		if !isStringInSlice(acr, oauthConfig.RequiredACR) {
+			return insufficientAssuranceError("id_token acr claim does not match the required authentication context")
+		}
+	}
+
+	if len(oauthConfig.RequiredAMR) > 0 {
+		var amr []string
+		if values, ok := claims["amr"].([]interface{}); ok {
+			for _, value := range values {
+				if method, ok := value.(string); ok {
+					amr = append(amr, method)
+				}
+			}
+		}
+
+		for _, method := range oauthConfig.RequiredAMR {
+			if !isStringInSlice(method, amr) {
+				return insufficientAssuranceError("id_token amr claim does not contain the required authentication methods")
+			}
+		}
+	}
+
+	return nil
+}
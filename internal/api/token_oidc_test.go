@@ -0,0 +1,437 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/api/provider"
+	"github.com/supabase/gotrue/internal/conf"
+)
+
+// unsignedIDToken returns a JWT-shaped string with the provided payload and
+// an empty signature, useful for exercising code that only inspects claims.
+func unsignedIDToken(payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + "."
+}
+
+// newTestSigningKey returns a handler serving the JWKS of a newly generated
+// RSA key, along with a function that mints ID tokens signed with the key.
+func newTestSigningKey(t *testing.T) (http.HandlerFunc, func(jwt.MapClaims) string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	serveJWKS := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]interface{}{
+				{
+					"kty": "RSA",
+					"kid": "test-key",
+					"alg": "RS256",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+				},
+			},
+		}))
+	}
+
+	return serveJWKS, func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test-key"
+
+		idToken, err := token.SignedString(key)
+		require.NoError(t, err)
+
+		return idToken
+	}
+}
+
+// newTestJWKS serves the JWKS of a newly generated RSA key and returns its URL,
+// along with a function that mints ID tokens signed with the key.
+func newTestJWKS(t *testing.T) (string, func(jwt.MapClaims) string) {
+	serveJWKS, mintIDToken := newTestSigningKey(t)
+
+	server := httptest.NewServer(serveJWKS)
+	t.Cleanup(server.Close)
+
+	return server.URL, mintIDToken
+}
+
+func TestIdTokenGrantAzureIssuer(t *testing.T) {
+	const tenant = "b0e4d5a1-6c67-4c5b-b112-36a304b66dad"
+	tenantIssuer := provider.AzureTenantIssuer(tenant)
+
+	cases := []struct {
+		desc     string
+		params   IdTokenGrantParams
+		tenant   string
+		expected string
+		isError  bool
+	}{
+		{
+			desc: "common issuer resolves to the ID token issuer",
+			params: IdTokenGrantParams{
+				Issuer:  provider.IssuerAzureCommon,
+				IdToken: unsignedIDToken(`{"iss":"` + tenantIssuer + `"}`),
+			},
+			expected: tenantIssuer,
+		},
+		{
+			desc: "provider only resolves to the ID token issuer",
+			params: IdTokenGrantParams{
+				Provider: "azure",
+				IdToken:  unsignedIDToken(`{"iss":"` + provider.IssuerAzureMicrosoft + `"}`),
+			},
+			expected: provider.IssuerAzureMicrosoft,
+		},
+		{
+			desc: "organizations issuer resolves to the ID token issuer",
+			params: IdTokenGrantParams{
+				Issuer:  provider.IssuerAzureOrganizations,
+				IdToken: unsignedIDToken(`{"iss":"` + tenantIssuer + `"}`),
+			},
+			expected: tenantIssuer,
+		},
+		{
+			desc: "organizations issuer rejects personal accounts",
+			params: IdTokenGrantParams{
+				Issuer:  provider.IssuerAzureOrganizations,
+				IdToken: unsignedIDToken(`{"iss":"` + provider.IssuerAzureMicrosoft + `"}`),
+			},
+			isError: true,
+		},
+		{
+			desc: "non-Azure issuer in ID token is rejected",
+			params: IdTokenGrantParams{
+				Issuer:  provider.IssuerAzureCommon,
+				IdToken: unsignedIDToken(`{"iss":"https://accounts.google.com"}`),
+			},
+			isError: true,
+		},
+		{
+			desc: "non-Azure issuer is rejected",
+			params: IdTokenGrantParams{
+				Provider: "azure",
+				Issuer:   "https://issuer.example.com",
+				IdToken:  unsignedIDToken(`{"iss":"https://issuer.example.com"}`),
+			},
+			isError: true,
+		},
+		{
+			desc: "tenant issuer is accepted",
+			params: IdTokenGrantParams{
+				Provider: "azure",
+				Issuer:   tenantIssuer,
+			},
+			expected: tenantIssuer,
+		},
+		{
+			desc: "pinned tenant resolves to the tenant issuer",
+			params: IdTokenGrantParams{
+				Provider: "azure",
+				IdToken:  unsignedIDToken(`{"iss":"` + provider.IssuerAzureMicrosoft + `"}`),
+			},
+			tenant:   tenant,
+			expected: tenantIssuer,
+		},
+		{
+			desc: "pinned tenant accepts the tenant issuer",
+			params: IdTokenGrantParams{
+				Issuer: tenantIssuer,
+			},
+			tenant:   tenant,
+			expected: tenantIssuer,
+		},
+		{
+			desc: "pinned tenant rejects other issuers",
+			params: IdTokenGrantParams{
+				Issuer: provider.IssuerAzureMicrosoft,
+			},
+			tenant:  tenant,
+			isError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			issuer, err := c.params.azureIssuer(context.Background(), c.tenant)
+			if c.isError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, c.expected, issuer)
+		})
+	}
+}
+
+func TestIdTokenGrantVerifyNonce(t *testing.T) {
+	hashedNonce := func(nonce string) string {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(nonce)))
+	}
+
+	cases := []struct {
+		desc       string
+		params     IdTokenGrantParams
+		hashing    string
+		tokenNonce string
+		isError    bool
+	}{
+		{
+			desc:       "single nonce matches",
+			params:     IdTokenGrantParams{Nonce: "first"},
+			tokenNonce: hashedNonce("first"),
+		},
+		{
+			desc:       "single nonce mismatches",
+			params:     IdTokenGrantParams{Nonce: "first"},
+			tokenNonce: hashedNonce("second"),
+			isError:    true,
+		},
+		{
+			desc:       "any of multiple nonces matches",
+			params:     IdTokenGrantParams{Nonces: []string{"first", "second"}},
+			tokenNonce: hashedNonce("second"),
+		},
+		{
+			desc:       "none of multiple nonces matches",
+			params:     IdTokenGrantParams{Nonces: []string{"first", "second"}},
+			tokenNonce: hashedNonce("third"),
+			isError:    true,
+		},
+		{
+			desc:       "nonce passed but not in ID token",
+			params:     IdTokenGrantParams{Nonces: []string{"first"}},
+			tokenNonce: "",
+			isError:    true,
+		},
+		{
+			desc:       "nonce in ID token but not passed",
+			params:     IdTokenGrantParams{},
+			tokenNonce: hashedNonce("first"),
+			isError:    true,
+		},
+		{
+			desc:       "no nonce anywhere",
+			params:     IdTokenGrantParams{},
+			tokenNonce: "",
+		},
+		{
+			desc:       "explicit sha256 hashing matches",
+			params:     IdTokenGrantParams{Nonce: "first"},
+			hashing:    conf.NonceHashingSHA256,
+			tokenNonce: hashedNonce("first"),
+		},
+		{
+			desc:       "sha256 hashing rejects plain nonce",
+			params:     IdTokenGrantParams{Nonce: "first"},
+			hashing:    conf.NonceHashingSHA256,
+			tokenNonce: "first",
+			isError:    true,
+		},
+		{
+			desc:       "plain nonce matches",
+			params:     IdTokenGrantParams{Nonce: "first"},
+			hashing:    conf.NonceHashingPlain,
+			tokenNonce: "first",
+		},
+		{
+			desc:       "plain nonce mismatches",
+			params:     IdTokenGrantParams{Nonces: []string{"first", "second"}},
+			hashing:    conf.NonceHashingPlain,
+			tokenNonce: "third",
+			isError:    true,
+		},
+		{
+			desc:       "plain hashing rejects hashed nonce",
+			params:     IdTokenGrantParams{Nonce: "first"},
+			hashing:    conf.NonceHashingPlain,
+			tokenNonce: hashedNonce("first"),
+			isError:    true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			err := c.params.verifyNonce(c.tokenNonce, c.hashing)
+			if c.isError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestIdTokenGrantArbitraryIssuers(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":   server.URL,
+			"jwks_uri": server.URL + "/jwks",
+		}))
+	}))
+	defer server.Close()
+
+	params := &IdTokenGrantParams{
+		Issuer:   server.URL,
+		ClientID: "client-id",
+	}
+
+	config := &conf.GlobalConfiguration{}
+	config.External.AllowedIdTokenIssuers = []string{server.URL}
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+
+	oidcProvider, _, providerType, acceptableClientIDs, err := params.getProvider(context.Background(), config, nil, req)
+	require.NoError(t, err)
+	require.NotNil(t, oidcProvider)
+	require.Equal(t, server.URL, providerType)
+	require.Equal(t, []string{"client-id"}, acceptableClientIDs)
+
+	config.External.DisableArbitraryIssuers = true
+
+	_, _, _, _, err = params.getProvider(context.Background(), config, nil, req)
+	require.Error(t, err)
+
+	var httpError *HTTPError
+	require.ErrorAs(t, err, &httpError)
+	require.Equal(t, http.StatusBadRequest, httpError.Code)
+}
+
+func TestIdTokenGrantProviderUnavailable(t *testing.T) {
+	require.NoError(t, provider.ConfigureDiscoveryTLS(&conf.ProviderTLSConfiguration{}))
+	provider.ConfigureDiscoveryRetry(&conf.ProviderRetryConfiguration{MaxAttempts: 2})
+
+	var discoveries int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&discoveries, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	params := &IdTokenGrantParams{
+		Issuer:   server.URL,
+		ClientID: "client-id",
+	}
+
+	config := &conf.GlobalConfiguration{}
+	config.External.AllowedIdTokenIssuers = []string{server.URL}
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", nil)
+
+	_, _, _, _, err := params.getProvider(context.Background(), config, nil, req)
+	require.Error(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&discoveries))
+
+	var oauthError *OAuthError
+	require.ErrorAs(t, err, &oauthError)
+	require.Equal(t, "provider_unavailable", oauthError.Err)
+	require.Equal(t, http.StatusServiceUnavailable, oauthError.Code)
+}
+
+func TestIdTokenGrantMatchAcceptableAudience(t *testing.T) {
+	cases := []struct {
+		desc            string
+		audience        []string
+		authorizedParty string
+		expected        bool
+		clientID        string
+	}{
+		{
+			desc:     "audience matches",
+			audience: []string{"other-client-id", "client-id"},
+			expected: true,
+			clientID: "client-id",
+		},
+		{
+			desc:            "authorized party matches",
+			audience:        []string{"other-client-id"},
+			authorizedParty: "client-id",
+			expected:        true,
+			clientID:        "client-id",
+		},
+		{
+			desc:            "neither matches",
+			audience:        []string{"other-client-id"},
+			authorizedParty: "another-client-id",
+			expected:        false,
+		},
+		{
+			desc:     "no audience or authorized party",
+			expected: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			clientID, ok := matchAcceptableAudience(c.audience, c.authorizedParty, []string{"", "client-id"})
+			require.Equal(t, c.expected, ok)
+			require.Equal(t, c.clientID, clientID)
+		})
+	}
+}
+
+func TestIdTokenGrantProviderClientIDs(t *testing.T) {
+	config := &conf.GlobalConfiguration{}
+	config.External.Apple.ClientID = []string{"com.example.service"}
+	config.External.Apple.WebClientID = []string{"com.example.web"}
+	config.External.IosBundleId = "com.example.ios"
+	config.External.AndroidPackageName = "com.example.android"
+	config.External.Google.ClientID = []string{"google-client"}
+	config.External.Google.WebClientID = []string{"google-web-client"}
+
+	require.Equal(t, []string{
+		"com.example.service",
+		"com.example.web",
+		"com.example.ios",
+		"com.example.android",
+	}, providerClientIDs(&config.External.Apple, config.External.IosBundleId, config.External.AndroidPackageName))
+
+	require.Equal(t, []string{
+		"google-client",
+		"google-web-client",
+	}, providerClientIDs(&config.External.Google))
+
+	// unset platform identifiers are not acceptable client IDs
+	require.Equal(t, []string{"com.example.service", "com.example.web"}, providerClientIDs(&config.External.Apple, "", ""))
+}
+
+func TestIdTokenGrantAppleClientIDs(t *testing.T) {
+	config := &conf.GlobalConfiguration{}
+	config.External.Apple.ClientID = []string{"com.example.app"}
+	config.External.IosBundleId = "com.example.ios"
+
+	require.Equal(t, []string{"com.example.app", "com.example.ios"}, appleClientIDs(&config.External))
+
+	config.External.Apple.ServicesID = []string{"com.example.web", "", "com.example.admin"}
+
+	clientIDs := appleClientIDs(&config.External)
+	require.Equal(t, []string{"com.example.app", "com.example.ios", "com.example.web", "com.example.admin"}, clientIDs)
+
+	// ID tokens of native apps are issued to the bundle ID, and those of web
+	// apps to the Services ID
+	for _, audience := range []string{"com.example.ios", "com.example.web", "com.example.admin"} {
+		clientID, ok := matchAcceptableAudience([]string{audience}, "", clientIDs)
+		require.True(t, ok)
+		require.Equal(t, audience, clientID)
+	}
+
+	_, ok := matchAcceptableAudience([]string{"com.example.other"}, "", clientIDs)
+	require.False(t, ok)
+}
@@ -2,14 +2,19 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	mathRand "math/rand"
 	"net/http"
 	"time"
 
+	"github.com/supabase/gotrue/internal/conf"
 	"github.com/supabase/gotrue/internal/metering"
 	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/observability"
 	"github.com/supabase/gotrue/internal/storage"
+	"github.com/supabase/gotrue/internal/utilities"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const retryLoopDuration = 5.0
@@ -17,6 +22,12 @@ const retryLoopDuration = 5.0
 // RefreshTokenGrantParams are the parameters the RefreshTokenGrant method accepts
 type RefreshTokenGrantParams struct {
 	RefreshToken string `json:"refresh_token"`
+
+	// Silent refreshes only issue a new access token. The refresh token
+	// isn't rotated and the session's last activity isn't updated, so
+	// background polling doesn't keep idle sessions alive. It can also be
+	// set with the silent=true query parameter.
+	Silent bool `json:"silent"`
 }
 
 // RefreshTokenGrant implements the refresh_token grant type flow
@@ -39,6 +50,10 @@ func (a *API) RefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *h
 		return oauthError("invalid_request", "refresh_token required")
 	}
 
+	if r.URL.Query().Get("silent") == "true" {
+		params.Silent = true
+	}
+
 	// A 5 second retry loop is used to make sure that refresh token
 	// requests do not waste database connections waiting for each other.
 	// Instead of waiting at the database level, they're waiting at the API
@@ -50,7 +65,7 @@ func (a *API) RefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *h
 	for retry && time.Since(retryStart).Seconds() < retryLoopDuration {
 		retry = false
 
-		user, _, session, err := models.FindUserWithRefreshToken(db, params.RefreshToken, false)
+		user, token, session, err := models.FindUserWithRefreshToken(db, params.RefreshToken, false)
 		if err != nil {
 			if models.IsNotFoundError(err) {
 				return oauthError("invalid_grant", "Invalid Refresh Token: Refresh Token Not Found")
@@ -62,15 +77,22 @@ func (a *API) RefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *h
 			return oauthError("invalid_grant", "Invalid Refresh Token: User Banned")
 		}
 
-		if session != nil {
-			var notAfter time.Time
+		if user.IsDeleted() {
+			return oauthError("invalid_grant", "Invalid Refresh Token: User Deleted")
+		}
 
-			if session.NotAfter != nil {
-				notAfter = *session.NotAfter
-			}
+		if err := a.verifyRefreshTokenFingerprint(r, token); err != nil {
+			return err
+		}
+
+		now := a.now()
 
-			if !notAfter.IsZero() && time.Now().UTC().After(notAfter) {
+		if session != nil {
+			switch session.CheckValidity(now, config.Sessions.Timebox, config.Sessions.InactivityTimeout) {
+			case models.SessionPastNotAfter, models.SessionPastTimebox:
 				return oauthError("invalid_grant", "Invalid Refresh Token: Session Expired")
+			case models.SessionTimedOut:
+				return oauthError("invalid_grant", "Invalid Refresh Token: Session Expired (Inactivity)")
 			}
 		}
 
@@ -81,9 +103,9 @@ func (a *API) RefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *h
 		// and the whole process will be retried a bit later so that
 		// the connection pool does not get exhausted.
 
-		var tokenString string
-		var expiresAt int64
 		var newTokenResponse *AccessTokenResponse
+		var reuseError error
+		var rotation string
 
 		err = db.Transaction(func(tx *storage.Connection) error {
 			user, token, session, terr := models.FindUserWithRefreshToken(tx, params.RefreshToken, true /* forUpdate */)
@@ -114,8 +136,12 @@ func (a *API) RefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *h
 					return internalServerError(terr.Error())
 				}
 
-				if activeRefreshToken != nil && activeRefreshToken.Parent.String() == token.Token {
-					// Token was revoked, but it's the
+				// For a revoked refresh token to be reused, it
+				// has to fall within the reuse interval.
+				reuseUntil := token.UpdatedAt.Add(config.Sessions.RefreshTokenReuseInterval)
+
+				if !now.After(reuseUntil) && activeRefreshToken != nil && activeRefreshToken.Parent.String() == token.Token {
+					// Token was just revoked and it's the
 					// parent of the currently active one.
 					// This indicates that the client was
 					// not able to store the result when it
@@ -124,32 +150,55 @@ func (a *API) RefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *h
 					// active refresh token instead of
 					// creating a new one.
 					issuedToken = activeRefreshToken
+					rotation = "reissued"
 				} else {
-					// For a revoked refresh token to be reused, it
-					// has to fall within the reuse interval.
-					reuseUntil := token.UpdatedAt.Add(
-						time.Second * time.Duration(config.Security.RefreshTokenReuseInterval))
-
-					if time.Now().After(reuseUntil) {
-						a.clearCookieTokens(config, w)
-						// not OK to reuse this token
-
-						if config.Security.RefreshTokenRotationEnabled {
-							// Revoke all tokens in token family
-							if err := models.RevokeTokenFamily(tx, token); err != nil {
-								return internalServerError(err.Error())
-							}
-						}
+					a.clearCookieTokens(config, w)
+					// not OK to reuse this token
 
-						return oauthError("invalid_grant", "Invalid Refresh Token: Already Used").WithInternalMessage("Possible abuse attempt: %v", token.ID)
+					if config.Security.RefreshTokenRotationEnabled {
+						// Revoke all tokens in token family
+						if err := models.RevokeTokenFamily(tx, token); err != nil {
+							return internalServerError(err.Error())
+						}
+						if terr := models.NewAuditLogEntry(r, tx, user, models.TokenRevokedAction, "", map[string]interface{}{
+							"reason":     "refresh_token_reuse",
+							"session_id": token.SessionId,
+						}); terr != nil {
+							return terr
+						}
 					}
+
+					// the revocation of the token family has
+					// to be committed, so the error is only
+					// returned once the transaction is done
+					reuseError = oauthError("invalid_grant", "Invalid Refresh Token: Already Used").WithInternalMessage("Possible abuse attempt: %v", token.ID)
+					rotation = "reuse_detected"
+					return nil
+				}
+			}
+
+			var traits map[string]interface{}
+			if params.Silent {
+				traits = map[string]interface{}{
+					"silent": true,
 				}
 			}
 
-			if terr = models.NewAuditLogEntry(r, tx, user, models.TokenRefreshedAction, "", nil); terr != nil {
+			if terr = models.NewAuditLogEntry(r, tx, user, models.TokenRefreshedAction, "", traits); terr != nil {
 				return terr
 			}
 
+			if session != nil && !params.Silent {
+				if terr = session.UpdateLastActiveAt(tx, now); terr != nil {
+					return internalServerError("Failed to update session").WithInternalError(terr)
+				}
+			}
+
+			if issuedToken == nil && params.Silent {
+				issuedToken = token
+				rotation = "silent"
+			}
+
 			if issuedToken == nil {
 				newToken, terr := models.GrantRefreshTokenSwap(r, tx, user, token)
 				if terr != nil {
@@ -157,29 +206,49 @@ func (a *API) RefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *h
 				}
 
 				issuedToken = newToken
+				rotation = "rotated"
 			}
 
-			tokenString, expiresAt, terr = generateAccessToken(tx, user, issuedToken.SessionId, &config.JWT)
-			if terr != nil {
-				return internalServerError("error generating jwt token").WithInternalError(terr)
+			expiresIn := config.JWT.Exp
+			if session != nil {
+				expiresIn = config.JWT.ExpForGrant(session.GrantMethod())
 			}
 
-			newTokenResponse = &AccessTokenResponse{
-				Token:        tokenString,
+			// the access token is set once the transaction commits
+			tokenResponse := &AccessTokenResponse{
 				TokenType:    "bearer",
-				ExpiresIn:    config.JWT.Exp,
-				ExpiresAt:    expiresAt,
+				ExpiresIn:    expiresIn,
 				RefreshToken: issuedToken.Token,
 				User:         user,
 			}
-			if terr = a.setCookieTokens(config, newTokenResponse, false, w); terr != nil {
-				return internalServerError("Failed to set JWT cookie. %s", terr)
+			tokenResponse.ExpiresAt, terr = generateAccessTokenWithHook(tx, user, issuedToken.SessionId, config, func(signed string) {
+				tokenResponse.Token = signed
+			})
+			if terr != nil {
+				return internalServerError("error generating jwt token").WithInternalError(terr)
+			}
+
+			if terr = tokenResponse.setAssurance(tx, user, issuedToken.SessionId); terr != nil {
+				return internalServerError("Database error finding assurance level").WithInternalError(terr)
 			}
 
+			newTokenResponse = tokenResponse
 			return nil
 		})
+		if err == nil {
+			refreshTokenRotationCounter.Add(ctx, 1, attribute.String("rotation", rotation))
+		}
+
+		if err == nil && reuseError != nil {
+			return reuseError
+		}
+
 		if err == nil {
 			// success
+			if err := a.setCookieTokens(config, newTokenResponse, false, w); err != nil {
+				return internalServerError("Failed to set JWT cookie. %s", err)
+			}
+
 			metering.RecordLogin("token", user.ID)
 			return sendJSON(w, http.StatusOK, newTokenResponse)
 		}
@@ -199,3 +268,26 @@ func (a *API) RefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *h
 
 	return conflictError("Too many concurrent token refresh requests on the same session or refresh token")
 }
+
+// verifyRefreshTokenFingerprint checks that a refresh token is used by the
+// client it was issued to. Tokens issued without a fingerprint can be used
+// by any client.
+func (a *API) verifyRefreshTokenFingerprint(r *http.Request, token *models.RefreshToken) error {
+	mode := a.config.Security.RefreshTokenFingerprintMode
+	if mode == conf.RefreshTokenFingerprintOff || token.Fingerprint == "" {
+		return nil
+	}
+
+	fingerprint := utilities.ClientFingerprint(r)
+	if subtle.ConstantTimeCompare([]byte(fingerprint), []byte(token.Fingerprint.String())) == 1 {
+		return nil
+	}
+
+	observability.GetLogEntry(r).WithField("session_id", token.SessionId).Warn("Refresh token used by a different client")
+
+	if mode == conf.RefreshTokenFingerprintEnforce {
+		return oauthError("invalid_grant", "Invalid Refresh Token: Client Mismatch")
+	}
+
+	return nil
+}
@@ -2,22 +2,38 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gofrs/uuid"
+	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/supabase/gotrue/internal/api/provider"
 	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/crypto"
 	"github.com/supabase/gotrue/internal/models"
+	"github.com/supabase/gotrue/internal/security"
+	"github.com/supabase/gotrue/internal/storage"
+	"github.com/supabase/gotrue/internal/utilities"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 type TokenTestSuite struct {
@@ -138,6 +154,56 @@ func (ts *TokenTestSuite) TestRateLimitTokenRefresh() {
 	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
 }
 
+func (ts *TokenTestSuite) TestRateLimitHeaders() {
+	defer func() {
+		ts.API.now = time.Now
+	}()
+	now := time.Now()
+	ts.API.now = func() time.Time {
+		return now
+	}
+
+	tokenRequest := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token", &bytes.Buffer{})
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("My-Custom-Header", "rate-limit-headers")
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// bursts of 30 requests, refilled at 30 requests per 5 minutes
+	for remaining := 29; remaining >= 0; remaining-- {
+		w := tokenRequest()
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+		require.Equal(ts.T(), "30", w.Header().Get("X-RateLimit-Limit"))
+		require.Equal(ts.T(), strconv.Itoa(remaining), w.Header().Get("X-RateLimit-Remaining"))
+		require.Equal(ts.T(), strconv.Itoa((30-remaining)*10), w.Header().Get("X-RateLimit-Reset"))
+		require.Empty(ts.T(), w.Header().Get("Retry-After"))
+	}
+
+	w := tokenRequest()
+	require.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+	require.Equal(ts.T(), "30", w.Header().Get("X-RateLimit-Limit"))
+	require.Equal(ts.T(), "0", w.Header().Get("X-RateLimit-Remaining"))
+	require.Equal(ts.T(), "300", w.Header().Get("X-RateLimit-Reset"))
+	require.Equal(ts.T(), "10", w.Header().Get("Retry-After"))
+
+	now = now.Add(25 * time.Second)
+	w = tokenRequest()
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	require.Equal(ts.T(), "1", w.Header().Get("X-RateLimit-Remaining"))
+	require.Equal(ts.T(), "285", w.Header().Get("X-RateLimit-Reset"))
+
+	// the limit resets once the bucket is refilled
+	now = now.Add(5 * time.Minute)
+	w = tokenRequest()
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	require.Equal(ts.T(), "29", w.Header().Get("X-RateLimit-Remaining"))
+	require.Equal(ts.T(), "10", w.Header().Get("X-RateLimit-Reset"))
+}
+
 func (ts *TokenTestSuite) TestTokenPasswordGrantSuccess() {
 	var buffer bytes.Buffer
 	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
@@ -153,6 +219,219 @@ func (ts *TokenTestSuite) TestTokenPasswordGrantSuccess() {
 	assert.Equal(ts.T(), http.StatusOK, w.Code)
 }
 
+func (ts *TokenTestSuite) TestTokenPasswordGrantSetsCookies() {
+	cookie := ts.Config.Cookie
+	defer func() {
+		ts.Config.Cookie = cookie
+	}()
+	ts.Config.Cookie.Domain = "example.com"
+	ts.Config.Cookie.SameSite = conf.CookieSameSiteStrict
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	data := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+
+	cookies := map[string]*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+
+	for name, value := range map[string]string{
+		ts.Config.Cookie.Key + "-access-token":  data.Token,
+		ts.Config.Cookie.Key + "-refresh-token": data.RefreshToken,
+	} {
+		c, ok := cookies[name]
+		require.True(ts.T(), ok, "cookie %s was not set", name)
+		assert.Equal(ts.T(), value, c.Value)
+		assert.Equal(ts.T(), "example.com", c.Domain)
+		assert.Equal(ts.T(), http.SameSiteStrictMode, c.SameSite)
+		assert.True(ts.T(), c.Secure)
+		assert.True(ts.T(), c.HttpOnly)
+	}
+}
+
+func (ts *TokenTestSuite) TestTokenPasswordGrantUpgradesPasswordHash() {
+	security := ts.Config.Security
+	defer func() {
+		ts.Config.Security = security
+		crypto.ConfigurePasswordHashing(&ts.Config.Security)
+	}()
+
+	ts.Config.Security.PasswordHashAlgorithm = crypto.Argon2id
+	ts.Config.Security.PasswordHashArgon2Memory = 64
+	ts.Config.Security.PasswordHashArgon2Time = 1
+	ts.Config.Security.PasswordHashArgon2Parallelism = 1
+	ts.Config.Security.PasswordHashUpgradeEnabled = true
+	crypto.ConfigurePasswordHashing(&ts.Config.Security)
+
+	// the test user's password has been hashed with bcrypt
+	require.True(ts.T(), strings.HasPrefix(ts.User.EncryptedPassword, "$2a$"))
+
+	for i := 0; i < 2; i++ {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"email":    "test@example.com",
+			"password": "password",
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		user, err := models.FindUserByID(ts.API.db, ts.User.ID)
+		require.NoError(ts.T(), err)
+		require.True(ts.T(), strings.HasPrefix(user.EncryptedPassword, "$argon2id$"))
+		require.False(ts.T(), crypto.NeedsRehash(user.EncryptedPassword))
+	}
+}
+
+func (ts *TokenTestSuite) TestTokenPasswordGrantPhone() {
+	phoneConfig := ts.Config.External.Phone
+	defer func() {
+		ts.Config.External.Phone = phoneConfig
+	}()
+	ts.Config.External.Phone.Enabled = true
+
+	u, err := models.NewUser("12015550123", "", "phone-password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(u))
+
+	passwordGrant := func(params map[string]interface{}) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// the phone number has to be verified
+	w := passwordGrant(map[string]interface{}{
+		"phone":    "12015550123",
+		"password": "phone-password",
+	})
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	require.NoError(ts.T(), u.ConfirmPhone(ts.API.db))
+
+	// the phone number is normalized to E.164
+	w = passwordGrant(map[string]interface{}{
+		"phone":    "+1 (201) 555-0123",
+		"password": "phone-password",
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	token := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+	require.NotEmpty(ts.T(), token.RefreshToken)
+	require.Equal(ts.T(), u.ID, token.User.ID)
+
+	w = passwordGrant(map[string]interface{}{
+		"phone":    "12015550123",
+		"password": "wrong-password",
+	})
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	// the number is not looked up as an email address
+	w = passwordGrant(map[string]interface{}{
+		"email":    "12015550123",
+		"password": "phone-password",
+	})
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	w = passwordGrant(map[string]interface{}{
+		"email":    "test@example.com",
+		"phone":    "12015550123",
+		"password": "phone-password",
+	})
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *TokenTestSuite) TestTokenPasswordGrantLockout() {
+	security := ts.Config.Security
+	defer func() {
+		ts.Config.Security = security
+	}()
+	ts.Config.Security.MaxLoginAttempts = 3
+	ts.Config.Security.LockoutDuration = time.Hour
+
+	passwordGrant := func(password string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"email":    "test@example.com",
+			"password": password,
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	requireLocked := func(w *httptest.ResponseRecorder) {
+		require.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+
+		httpError := &HTTPError{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(httpError))
+		require.Equal(ts.T(), ErrorCodeAccountLocked, httpError.ErrorCode)
+	}
+
+	// a successful login resets the failed attempts
+	require.Equal(ts.T(), http.StatusBadRequest, passwordGrant("wrong-password").Code)
+	require.Equal(ts.T(), http.StatusOK, passwordGrant("password").Code)
+
+	user, err := models.FindUserByID(ts.API.db, ts.User.ID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 0, user.FailedLoginAttempts)
+
+	require.Equal(ts.T(), http.StatusBadRequest, passwordGrant("wrong-password").Code)
+	require.Equal(ts.T(), http.StatusBadRequest, passwordGrant("wrong-password").Code)
+	requireLocked(passwordGrant("wrong-password"))
+
+	// the correct password is rejected while the account is locked
+	requireLocked(passwordGrant("password"))
+
+	user, err = models.FindUserByID(ts.API.db, ts.User.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), user.IsLocked())
+
+	entries, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.UserLockedAction), nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), entries, 1)
+
+	// the lockout ends after the lockout duration
+	lockedUntil := time.Now().Add(-time.Second)
+	user.LockedUntil = &lockedUntil
+	require.NoError(ts.T(), ts.API.db.UpdateOnly(user, "locked_until"))
+
+	require.Equal(ts.T(), http.StatusOK, passwordGrant("password").Code)
+
+	user, err = models.FindUserByID(ts.API.db, ts.User.ID)
+	require.NoError(ts.T(), err)
+	require.Nil(ts.T(), user.LockedUntil)
+	require.Equal(ts.T(), 0, user.FailedLoginAttempts)
+}
+
 func (ts *TokenTestSuite) TestTokenRefreshTokenGrantSuccess() {
 	var buffer bytes.Buffer
 	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
@@ -184,6 +463,75 @@ func (ts *TokenTestSuite) TestTokenPasswordGrantFailure() {
 	assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
 }
 
+func (ts *TokenTestSuite) TestTokenRefreshTokenFingerprint() {
+	security := ts.Config.Security
+	defer func() {
+		ts.Config.Security = security
+	}()
+
+	grant := func(grantType string, params map[string]interface{}, clientKey string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type="+grantType, &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "test-app/1.0")
+		req.Header.Set(utilities.ClientKeyHeader, clientKey)
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	refresh := func(refreshToken, clientKey string) *httptest.ResponseRecorder {
+		return grant("refresh_token", map[string]interface{}{
+			"refresh_token": refreshToken,
+		}, clientKey)
+	}
+
+	cases := []struct {
+		mode             string
+		mismatchedStatus int
+	}{
+		{conf.RefreshTokenFingerprintOff, http.StatusOK},
+		{conf.RefreshTokenFingerprintLog, http.StatusOK},
+		{conf.RefreshTokenFingerprintEnforce, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		ts.Config.Security.RefreshTokenFingerprintMode = c.mode
+
+		w := grant("password", map[string]interface{}{
+			"email":    "test@example.com",
+			"password": "password",
+		}, "client-a")
+		require.Equal(ts.T(), http.StatusOK, w.Code, c.mode)
+
+		token := &AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+
+		// the fingerprint is kept when the refresh token is rotated
+		w = refresh(token.RefreshToken, "client-a")
+		require.Equal(ts.T(), http.StatusOK, w.Code, c.mode)
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+
+		w = refresh(token.RefreshToken, "client-b")
+		require.Equal(ts.T(), c.mismatchedStatus, w.Code, c.mode)
+
+		if c.mismatchedStatus != http.StatusOK {
+			oauthErr := &OAuthError{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(oauthErr))
+			require.Equal(ts.T(), "invalid_grant", oauthErr.Err)
+
+			// the refresh token can still be used by its client
+			require.Equal(ts.T(), http.StatusOK, refresh(token.RefreshToken, "client-a").Code, c.mode)
+		}
+	}
+
+	// tokens issued without a fingerprint are not bound to a client
+	require.Equal(ts.T(), http.StatusOK, refresh(ts.RefreshToken.Token, "client-b").Code)
+}
+
 func (ts *TokenTestSuite) TestTokenPKCEGrantFailure() {
 	authCode := "1234563"
 	codeVerifier := "4a9505b9-0857-42bb-ab3c-098b4d28ddc2"
@@ -262,18 +610,33 @@ func (ts *TokenTestSuite) TestTokenRefreshTokenRotation() {
 	second, err := models.GrantRefreshTokenSwap(&http.Request{}, ts.API.db, u, first)
 	require.NoError(ts.T(), err)
 
+	sessionsConfig := ts.Config.Sessions
+	defer func() {
+		ts.Config.Sessions = sessionsConfig
+	}()
+
 	cases := []struct {
 		desc                        string
 		refreshTokenRotationEnabled bool
-		reuseInterval               int
+		reuseInterval               time.Duration
 		refreshToken                string
 		expectedCode                int
 		expectedBody                map[string]interface{}
 	}{
+		{
+			desc:                        "Valid refresh",
+			refreshTokenRotationEnabled: true,
+			reuseInterval:               30 * time.Second,
+			refreshToken:                second.Token,
+			expectedCode:                http.StatusOK,
+			expectedBody: map[string]interface{}{
+				"refresh_token": "some-new-refresh-token",
+			},
+		},
 		{
 			desc:                        "Valid refresh within reuse interval",
 			refreshTokenRotationEnabled: true,
-			reuseInterval:               30,
+			reuseInterval:               30 * time.Second,
 			refreshToken:                second.Token,
 			expectedCode:                http.StatusOK,
 			expectedBody: map[string]interface{}{
@@ -284,7 +647,7 @@ func (ts *TokenTestSuite) TestTokenRefreshTokenRotation() {
 			desc:                        "Invalid refresh outside reuse interval",
 			refreshTokenRotationEnabled: true,
 			reuseInterval:               0,
-			refreshToken:                first.Token,
+			refreshToken:                second.Token,
 			expectedCode:                http.StatusBadRequest,
 			expectedBody: map[string]interface{}{
 				"error":             "invalid_grant",
@@ -292,9 +655,20 @@ func (ts *TokenTestSuite) TestTokenRefreshTokenRotation() {
 			},
 		},
 		{
-			desc:                        "Invalid refresh, revoke third token",
+			desc:                        "Invalid refresh of revoked token family within reuse interval",
 			refreshTokenRotationEnabled: true,
-			reuseInterval:               0,
+			reuseInterval:               30 * time.Second,
+			refreshToken:                second.Token,
+			expectedCode:                http.StatusBadRequest,
+			expectedBody: map[string]interface{}{
+				"error":             "invalid_grant",
+				"error_description": "Invalid Refresh Token: Already Used",
+			},
+		},
+		{
+			desc:                        "Invalid refresh of older token",
+			refreshTokenRotationEnabled: true,
+			reuseInterval:               30 * time.Second,
 			refreshToken:                first.Token,
 			expectedCode:                http.StatusBadRequest,
 			expectedBody: map[string]interface{}{
@@ -307,7 +681,7 @@ func (ts *TokenTestSuite) TestTokenRefreshTokenRotation() {
 	for _, c := range cases {
 		ts.Run(c.desc, func() {
 			ts.Config.Security.RefreshTokenRotationEnabled = c.refreshTokenRotationEnabled
-			ts.Config.Security.RefreshTokenReuseInterval = c.reuseInterval
+			ts.Config.Sessions.RefreshTokenReuseInterval = c.reuseInterval
 			var buffer bytes.Buffer
 			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
 				"refresh_token": c.refreshToken,
@@ -331,6 +705,123 @@ func (ts *TokenTestSuite) TestTokenRefreshTokenRotation() {
 	}
 }
 
+func (ts *TokenTestSuite) TestTokenRefreshTokenReuseRevokesFamily() {
+	sessionsConfig := ts.Config.Sessions
+	defer func() {
+		ts.Config.Sessions = sessionsConfig
+	}()
+	ts.Config.Security.RefreshTokenRotationEnabled = true
+	ts.Config.Sessions.RefreshTokenReuseInterval = 0
+
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"refresh_token": refreshToken,
+		}))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=refresh_token", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// legitimate rotation chain: first -> second -> third
+	chain := []string{ts.RefreshToken.Token}
+	for i := 0; i < 2; i++ {
+		w := refresh(chain[len(chain)-1])
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		data := &AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+		chain = append(chain, data.RefreshToken)
+	}
+
+	for i := 1; i < len(chain); i++ {
+		_, token, _, err := models.FindUserWithRefreshToken(ts.API.db, chain[i], false)
+		require.NoError(ts.T(), err)
+		require.Equal(ts.T(), chain[i-1], token.Parent.String())
+	}
+
+	// an attacker replays the already rotated first token
+	w := refresh(chain[0])
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	data := &OAuthError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+	require.Equal(ts.T(), "invalid_grant", data.Err)
+
+	// the whole family is revoked
+	tokens := []models.RefreshToken{}
+	require.NoError(ts.T(), ts.API.db.Q().Where("session_id = ?", ts.RefreshToken.SessionId).All(&tokens))
+	require.Len(ts.T(), tokens, len(chain))
+	for _, token := range tokens {
+		require.True(ts.T(), token.Revoked, "refresh token %d was not revoked", token.ID)
+	}
+
+	// so the latest token of the legitimate chain can't be used anymore
+	w = refresh(chain[len(chain)-1])
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *TokenTestSuite) TestTokenRefreshTokenReuseInterval() {
+	sessionsConfig := ts.Config.Sessions
+	defer func() {
+		ts.Config.Sessions = sessionsConfig
+		ts.API.now = time.Now
+	}()
+	ts.Config.Security.RefreshTokenRotationEnabled = true
+	ts.Config.Sessions.RefreshTokenReuseInterval = 10 * time.Second
+
+	refresh := func(refreshToken string, now time.Time) *httptest.ResponseRecorder {
+		ts.API.now = func() time.Time {
+			return now
+		}
+
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"refresh_token": refreshToken,
+		}))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=refresh_token", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := refresh(ts.RefreshToken.Token, time.Now())
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	rotated := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(rotated))
+
+	_, token, _, err := models.FindUserWithRefreshToken(ts.API.db, ts.RefreshToken.Token, false)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), token.Revoked)
+
+	// the response was lost, so the client retries with the rotated token
+	// within the reuse interval and gets the same refresh token again
+	for i := 0; i < 2; i++ {
+		w = refresh(ts.RefreshToken.Token, token.UpdatedAt.Add(5*time.Second))
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		data := &AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+		require.Equal(ts.T(), rotated.RefreshToken, data.RefreshToken)
+		require.NotEmpty(ts.T(), data.Token)
+	}
+
+	_, active, _, err := models.FindUserWithRefreshToken(ts.API.db, rotated.RefreshToken, false)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), active.Revoked, "retries within the reuse interval don't revoke anything")
+
+	// past the reuse interval, the retry is considered a reuse attempt
+	w = refresh(ts.RefreshToken.Token, token.UpdatedAt.Add(11*time.Second))
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	data := &OAuthError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+	require.Equal(ts.T(), "invalid_grant", data.Err)
+
+	_, active, _, err = models.FindUserWithRefreshToken(ts.API.db, rotated.RefreshToken, false)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), active.Revoked, "the token family is revoked")
+}
+
 func (ts *TokenTestSuite) createBannedUser() *models.User {
 	u, err := models.NewUser("", "banned@example.com", "password", ts.Config.JWT.Aud, nil)
 	require.NoError(ts.T(), err, "Error creating test user model")
@@ -392,6 +883,156 @@ func (ts *TokenTestSuite) TestTokenRefreshWithUnexpiredSession() {
 	assert.Equal(ts.T(), http.StatusOK, w.Code)
 }
 
+func (ts *TokenTestSuite) TestTokenRefreshWithSessionTimeouts() {
+	sessionsConfig := ts.Config.Sessions
+	defer func() {
+		ts.Config.Sessions = sessionsConfig
+		ts.API.now = time.Now
+	}()
+	ts.Config.Sessions.Timebox = 8 * time.Hour
+	ts.Config.Sessions.InactivityTimeout = time.Hour
+
+	refresh := func(refreshToken string, now time.Time) *httptest.ResponseRecorder {
+		ts.API.now = func() time.Time {
+			return now
+		}
+
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"refresh_token": refreshToken,
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=refresh_token", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	requireInvalidGrant := func(w *httptest.ResponseRecorder) {
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+		data := &OAuthError{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+		require.Equal(ts.T(), "invalid_grant", data.Err)
+	}
+
+	ts.Run("refreshing within bounds until the timebox is exceeded", func() {
+		start := time.Now()
+		token, err := models.GrantAuthenticatedUser(ts.API.db, ts.User, models.GrantParams{})
+		require.NoError(ts.T(), err)
+
+		refreshToken := token.Token
+		for now := start.Add(50 * time.Minute); now.Before(start.Add(8 * time.Hour)); now = now.Add(50 * time.Minute) {
+			w := refresh(refreshToken, now)
+			require.Equal(ts.T(), http.StatusOK, w.Code)
+
+			data := &AccessTokenResponse{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+			refreshToken = data.RefreshToken
+		}
+
+		requireInvalidGrant(refresh(refreshToken, start.Add(8*time.Hour+10*time.Minute)))
+	})
+
+	ts.Run("refreshing after the inactivity timeout", func() {
+		start := time.Now()
+		token, err := models.GrantAuthenticatedUser(ts.API.db, ts.User, models.GrantParams{})
+		require.NoError(ts.T(), err)
+
+		w := refresh(token.Token, start.Add(30*time.Minute))
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		data := &AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+
+		requireInvalidGrant(refresh(data.RefreshToken, start.Add(30*time.Minute+time.Hour+time.Second)))
+	})
+}
+
+func (ts *TokenTestSuite) TestTokenRefreshSilent() {
+	sessionsConfig := ts.Config.Sessions
+	defer func() {
+		ts.Config.Sessions = sessionsConfig
+		ts.API.now = time.Now
+	}()
+	ts.Config.Security.RefreshTokenRotationEnabled = true
+	ts.Config.Sessions.InactivityTimeout = time.Hour
+
+	refresh := func(query string, body map[string]interface{}, now time.Time) *httptest.ResponseRecorder {
+		ts.API.now = func() time.Time {
+			return now
+		}
+
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=refresh_token"+query, &buffer)
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	start := time.Now()
+	token, err := models.GrantAuthenticatedUser(ts.API.db, ts.User, models.GrantParams{})
+	require.NoError(ts.T(), err)
+
+	// a normal refresh rotates the refresh token and postpones the
+	// inactivity timeout
+	w := refresh("", map[string]interface{}{"refresh_token": token.Token}, start.Add(30*time.Minute))
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	rotated := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(rotated))
+	require.NotEqual(ts.T(), token.Token, rotated.RefreshToken)
+
+	session, err := models.FindSessionByID(ts.API.db, *token.SessionId, false)
+	require.NoError(ts.T(), err)
+	require.NotNil(ts.T(), session.LastActiveAt)
+	lastActiveAt := *session.LastActiveAt
+	require.WithinDuration(ts.T(), start.Add(30*time.Minute), lastActiveAt, time.Second)
+
+	for _, example := range []struct {
+		query string
+		body  map[string]interface{}
+		now   time.Time
+	}{
+		{
+			body: map[string]interface{}{"refresh_token": rotated.RefreshToken, "silent": true},
+			now:  start.Add(60 * time.Minute),
+		},
+		{
+			query: "&silent=true",
+			body:  map[string]interface{}{"refresh_token": rotated.RefreshToken},
+			now:   start.Add(80 * time.Minute),
+		},
+	} {
+		w = refresh(example.query, example.body, example.now)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		data := &AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+		require.NotEmpty(ts.T(), data.Token)
+		require.Equal(ts.T(), rotated.RefreshToken, data.RefreshToken, "silent refreshes don't rotate the refresh token")
+
+		_, active, _, err := models.FindUserWithRefreshToken(ts.API.db, rotated.RefreshToken, false)
+		require.NoError(ts.T(), err)
+		require.False(ts.T(), active.Revoked)
+
+		session, err = models.FindSessionByID(ts.API.db, *token.SessionId, false)
+		require.NoError(ts.T(), err)
+		require.WithinDuration(ts.T(), lastActiveAt, *session.LastActiveAt, time.Second, "silent refreshes don't update the last activity")
+	}
+
+	// silent refreshes didn't keep the session alive
+	w = refresh("", map[string]interface{}{"refresh_token": rotated.RefreshToken, "silent": true}, start.Add(91*time.Minute))
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	data := &OAuthError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+	require.Equal(ts.T(), "invalid_grant", data.Err)
+}
+
 func (ts *TokenTestSuite) TestMagicLinkPKCESignIn() {
 	var buffer bytes.Buffer
 	// Send OTP
@@ -450,3 +1091,1787 @@ func (ts *TokenTestSuite) TestMagicLinkPKCESignIn() {
 	require.NotEmpty(ts.T(), verifyResp.Token)
 
 }
+
+func (ts *TokenTestSuite) TestIdTokenGrantRateLimit() {
+	defaultLimiter := ts.API.idTokenGrantLimiter
+	defer func() {
+		ts.API.idTokenGrantLimiter = defaultLimiter
+	}()
+
+	// allow a burst of 3 requests, then one request per minute
+	ts.API.idTokenGrantLimiter = security.NewTokenBucketLimiter(1.0/60, 3, time.Hour)
+
+	idTokenGrant := func(issuer string) *httptest.ResponseRecorder {
+		return ts.idTokenGrant(map[string]interface{}{
+			"id_token":  "id-token",
+			"issuer":    issuer,
+			"client_id": "client-id",
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		w := idTokenGrant("https://first.example.com")
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+		require.Empty(ts.T(), w.Header().Get("Retry-After"))
+	}
+
+	w := idTokenGrant("https://first.example.com")
+	require.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+	require.Equal(ts.T(), "60", w.Header().Get("Retry-After"))
+
+	// other providers are limited separately
+	w = idTokenGrant("https://second.example.com")
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	// other grant types are not limited
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantRateLimitForwardedFor() {
+	defaultLimiter := ts.API.idTokenGrantLimiter
+	defer func(rateLimit float64, trustedProxies []string) {
+		ts.API.idTokenGrantLimiter = defaultLimiter
+		ts.Config.RateLimitIdTokenGrant = rateLimit
+		ts.Config.Security.TrustedProxies = trustedProxies
+	}(ts.Config.RateLimitIdTokenGrant, ts.Config.Security.TrustedProxies)
+
+	// the burst is the configured number of requests per 5 minutes
+	ts.Config.RateLimitIdTokenGrant = 2
+	ts.Config.Security.TrustedProxies = nil
+	ts.API.idTokenGrantLimiter = newIdTokenGrantLimiter(ts.Config)
+
+	idTokenGrant := func(forwardedFor string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"id_token":  "id-token",
+			"issuer":    "https://forwarded.example.com",
+			"client_id": "client-id",
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	require.Equal(ts.T(), http.StatusBadRequest, idTokenGrant("198.51.100.1").Code)
+	require.Equal(ts.T(), http.StatusBadRequest, idTokenGrant("198.51.100.2").Code)
+
+	// the header of untrusted clients doesn't get them a new bucket
+	require.Equal(ts.T(), http.StatusTooManyRequests, idTokenGrant("198.51.100.3").Code)
+}
+
+// setupKeycloakIdTokenGrant configures the Keycloak provider to verify ID
+// tokens with a test key, and returns a function minting ID tokens for it.
+func (ts *TokenTestSuite) setupKeycloakIdTokenGrant() func(jwt.MapClaims) string {
+	keycloak := ts.Config.External.Keycloak
+	ts.T().Cleanup(func() {
+		ts.Config.External.Keycloak = keycloak
+	})
+
+	jwksURL, mintIDToken := newTestJWKS(ts.T())
+
+	ts.Config.External.Keycloak.Issuer = "https://keycloak.example.com/realms/test"
+	ts.Config.External.Keycloak.JWKSURL = jwksURL
+	ts.Config.External.Keycloak.ClientID = []string{"keycloak-client"}
+
+	return func(claims jwt.MapClaims) string {
+		standardClaims := jwt.MapClaims{
+			"iss":            "https://keycloak.example.com/realms/test",
+			"aud":            "keycloak-client",
+			"sub":            "keycloak-subject",
+			"email":          "keycloak@example.com",
+			"email_verified": true,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+
+		for key, value := range claims {
+			standardClaims[key] = value
+		}
+
+		return mintIDToken(standardClaims)
+	}
+}
+
+func (ts *TokenTestSuite) idTokenGrant(params map[string]interface{}) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+
+	return w
+}
+
+// interceptIdTokenProvider serves the discovery document, found at the
+// discovery URL, and the JWKS of an OIDC provider with the issuer, by routing
+// all HTTPS requests of the discovery client to a test server. This allows
+// testing providers with fixed issuers, such as Azure. It returns a function
+// minting ID tokens signed with the provider's key.
+func (ts *TokenTestSuite) interceptIdTokenProvider(issuer, discoveryURL string) func(jwt.MapClaims) string {
+	serveJWKS, mintIDToken := newTestSigningKey(ts.T())
+
+	u, err := url.Parse(discoveryURL)
+	require.NoError(ts.T(), err)
+
+	discoveryPath := strings.TrimSuffix(u.Path, "/") + "/.well-known/openid-configuration"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case discoveryPath:
+			w.Header().Set("Content-Type", "application/json")
+			require.NoError(ts.T(), json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":   issuer,
+				"jwks_uri": "https://" + u.Host + "/test-jwks",
+			}))
+
+		case "/test-jwks":
+			serveJWKS(w, r)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	ts.T().Cleanup(server.Close)
+
+	transport := http.DefaultTransport
+	intercepting := transport.(*http.Transport).Clone()
+	intercepting.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// the transport uses connections returned from DialTLSContext as
+		// they are, so the test server can speak plain HTTP
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+
+	oidcProviders := ts.API.oidcProviders
+	configureDiscovery := func() {
+		require.NoError(ts.T(), provider.ConfigureDiscoveryTLS(&ts.Config.External.TLS))
+		provider.ConfigureDiscoveryRetry(&ts.Config.External.DiscoveryRetry)
+	}
+
+	ts.T().Cleanup(func() {
+		http.DefaultTransport = transport
+		configureDiscovery()
+		ts.API.oidcProviders = oidcProviders
+	})
+
+	http.DefaultTransport = intercepting
+	configureDiscovery()
+	ts.API.oidcProviders = provider.NewOIDCProviderCache(0)
+
+	return mintIDToken
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantAzureTenant() {
+	const tenant = "b0e4d5a1-6c67-4c5b-b112-36a304b66dad"
+	const otherTenant = "5f0b3e0c-9b2b-4a43-9d2e-4c3c0a3f1d27"
+
+	azure := ts.Config.External.Azure
+	ts.T().Cleanup(func() {
+		ts.Config.External.Azure = azure
+	})
+
+	ts.Config.External.Azure.Enabled = true
+	ts.Config.External.Azure.ClientID = []string{"azure-client"}
+	ts.Config.External.Azure.Tenant = tenant
+
+	issuer := provider.AzureTenantIssuer(tenant)
+	mintIDToken := ts.interceptIdTokenProvider(issuer, issuer)
+
+	azureIDToken := func(iss, tid string) string {
+		return mintIDToken(jwt.MapClaims{
+			"iss":   iss,
+			"aud":   "azure-client",
+			"sub":   "azure-subject",
+			"tid":   tid,
+			"email": "azure@example.com",
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		})
+	}
+
+	cases := []struct {
+		desc    string
+		idToken string
+		status  int
+	}{
+		{
+			desc:    "token of the pinned tenant",
+			idToken: azureIDToken(issuer, tenant),
+			status:  http.StatusOK,
+		},
+		{
+			desc:    "token of another tenant",
+			idToken: azureIDToken(provider.AzureTenantIssuer(otherTenant), otherTenant),
+			status:  http.StatusUnauthorized,
+		},
+		{
+			desc:    "token with the pinned issuer but another tid",
+			idToken: azureIDToken(issuer, otherTenant),
+			status:  http.StatusUnauthorized,
+		},
+		{
+			desc:    "token without tid",
+			idToken: azureIDToken(issuer, ""),
+			status:  http.StatusUnauthorized,
+		},
+	}
+
+	for _, c := range cases {
+		w := ts.idTokenGrant(map[string]interface{}{
+			"provider": "azure",
+			"id_token": c.idToken,
+		})
+		require.Equal(ts.T(), c.status, w.Code, c.desc+": "+w.Body.String())
+
+		if c.status != http.StatusOK {
+			var data OAuthError
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+			require.Equal(ts.T(), "invalid_grant", data.Err, c.desc)
+		}
+	}
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantLinkedinOIDC() {
+	linkedin := ts.Config.External.LinkedinOIDC
+	ts.T().Cleanup(func() {
+		ts.Config.External.LinkedinOIDC = linkedin
+	})
+
+	ts.Config.External.LinkedinOIDC.Enabled = true
+	ts.Config.External.LinkedinOIDC.ClientID = []string{"linkedin-client"}
+
+	// LinkedIn serves its discovery document below /oauth, with that URL as
+	// the issuer, but issues ID tokens without it
+	discoveryURL := provider.IssuerLinkedin + "/oauth"
+	mintIDToken := ts.interceptIdTokenProvider(discoveryURL, discoveryURL)
+
+	linkedinIDToken := func(iss string) string {
+		return mintIDToken(jwt.MapClaims{
+			"iss":            iss,
+			"aud":            "linkedin-client",
+			"sub":            "linkedin-subject",
+			"email":          "linkedin@example.com",
+			"email_verified": "true",
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		})
+	}
+
+	for _, params := range []map[string]interface{}{
+		{"provider": "linkedin_oidc"},
+		{"issuer": provider.IssuerLinkedin, "client_id": "linkedin-client"},
+	} {
+		params["id_token"] = linkedinIDToken(provider.IssuerLinkedin)
+
+		w := ts.idTokenGrant(params)
+		require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+	}
+
+	identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "linkedin-subject", "linkedin_oidc")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), "linkedin@example.com", identity.IdentityData["email"])
+
+	// the issuer of the discovery document isn't accepted in ID tokens
+	w := ts.idTokenGrant(map[string]interface{}{
+		"provider": "linkedin_oidc",
+		"id_token": linkedinIDToken(discoveryURL),
+	})
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code, w.Body.String())
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantRequireAccessToken() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	const accessToken = "keycloak-access-token"
+
+	sum := sha256.Sum256([]byte(accessToken))
+	idToken := mintIDToken(jwt.MapClaims{
+		"at_hash": base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]),
+	})
+
+	cases := []struct {
+		desc               string
+		requireAccessToken bool
+		accessToken        string
+		status             int
+		code               string
+	}{
+		{
+			desc:        "missing access token is allowed by default",
+			accessToken: "",
+			status:      http.StatusOK,
+		},
+		{
+			desc:        "mismatched access token is rejected by default",
+			accessToken: "other-access-token",
+			status:      http.StatusUnauthorized,
+			code:        "invalid_grant",
+		},
+		{
+			desc:               "missing access token is rejected when required",
+			requireAccessToken: true,
+			accessToken:        "",
+			status:             http.StatusBadRequest,
+			code:               "invalid request",
+		},
+		{
+			desc:               "mismatched access token is rejected when required",
+			requireAccessToken: true,
+			accessToken:        "other-access-token",
+			status:             http.StatusUnauthorized,
+			code:               "invalid_grant",
+		},
+		{
+			desc:               "matching access token is accepted when required",
+			requireAccessToken: true,
+			accessToken:        accessToken,
+			status:             http.StatusOK,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Config.External.Keycloak.RequireAccessToken = c.requireAccessToken
+
+		w := ts.idTokenGrant(map[string]interface{}{
+			"provider":     "keycloak",
+			"id_token":     idToken,
+			"access_token": c.accessToken,
+		})
+		require.Equal(ts.T(), c.status, w.Code, c.desc+": "+w.Body.String())
+
+		if c.code != "" {
+			var data OAuthError
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+			require.Equal(ts.T(), c.code, data.Err, c.desc)
+		}
+	}
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantGitHub() {
+	// GitHub Actions ID tokens identify repositories, not GitHub users
+	for _, params := range []map[string]interface{}{
+		{"provider": "github"},
+		{"issuer": provider.IssuerGitHub, "client_id": "github-client"},
+	} {
+		params["id_token"] = "id-token"
+		params["access_token"] = "github-access-token"
+
+		w := ts.idTokenGrant(params)
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code, w.Body.String())
+		require.Contains(ts.T(), w.Body.String(), "GitHub does not issue ID tokens for users")
+	}
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantProviderIssuer() {
+	debug := ts.Config.Debug
+	ts.T().Cleanup(func() {
+		ts.Config.Debug = debug
+	})
+
+	// ID tokens of the common Azure issuer are issued by the tenant
+	const tenant = "b0e4d5a1-6c67-4c5b-b112-36a304b66dad"
+	issuer := provider.AzureTenantIssuer(tenant)
+	mintIDToken := ts.interceptIdTokenProvider(issuer, issuer)
+
+	for _, debug := range []bool{false, true} {
+		ts.Config.Debug = debug
+
+		w := ts.idTokenGrant(map[string]interface{}{
+			"issuer":    provider.IssuerAzureCommon,
+			"client_id": ts.Config.External.Azure.ClientID[0],
+			"id_token": mintIDToken(jwt.MapClaims{
+				"iss":   issuer,
+				"aud":   ts.Config.External.Azure.ClientID[0],
+				"sub":   "azure-subject",
+				"tid":   tenant,
+				"email": "azure@example.com",
+				"iat":   time.Now().Unix(),
+				"exp":   time.Now().Add(time.Hour).Unix(),
+			}),
+		})
+		require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+		var data map[string]interface{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.NotEmpty(ts.T(), data["access_token"])
+
+		if debug {
+			require.Equal(ts.T(), issuer, data["provider_issuer"])
+		} else {
+			require.NotContains(ts.T(), data, "provider_issuer")
+		}
+	}
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantRequiredAssurance() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	cases := []struct {
+		desc        string
+		requiredACR []string
+		requiredAMR []string
+		claims      jwt.MapClaims
+		isRejected  bool
+	}{
+		{
+			desc:   "no requirements",
+			claims: jwt.MapClaims{},
+		},
+		{
+			desc:        "matching acr",
+			requiredACR: []string{"gold", "silver"},
+			claims:      jwt.MapClaims{"acr": "silver"},
+		},
+		{
+			desc:        "missing acr",
+			requiredACR: []string{"gold"},
+			claims:      jwt.MapClaims{},
+			isRejected:  true,
+		},
+		{
+			desc:        "non-matching acr",
+			requiredACR: []string{"gold"},
+			claims:      jwt.MapClaims{"acr": "bronze"},
+			isRejected:  true,
+		},
+		{
+			desc:        "matching amr",
+			requiredAMR: []string{"pwd", "mfa"},
+			claims:      jwt.MapClaims{"amr": []string{"mfa", "otp", "pwd"}},
+		},
+		{
+			desc:        "missing amr",
+			requiredAMR: []string{"mfa"},
+			claims:      jwt.MapClaims{},
+			isRejected:  true,
+		},
+		{
+			desc:        "non-matching amr",
+			requiredAMR: []string{"pwd", "mfa"},
+			claims:      jwt.MapClaims{"amr": []string{"pwd"}},
+			isRejected:  true,
+		},
+		{
+			desc:        "matching acr and non-matching amr",
+			requiredACR: []string{"gold"},
+			requiredAMR: []string{"hwk"},
+			claims:      jwt.MapClaims{"acr": "gold", "amr": []string{"mfa"}},
+			isRejected:  true,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			ts.Config.External.Keycloak.RequiredACR = c.requiredACR
+			ts.Config.External.Keycloak.RequiredAMR = c.requiredAMR
+
+			w := ts.idTokenGrant(map[string]interface{}{
+				"provider": "keycloak",
+				"id_token": mintIDToken(c.claims),
+			})
+
+			if !c.isRejected {
+				require.Equal(ts.T(), http.StatusOK, w.Code)
+				return
+			}
+
+			require.Equal(ts.T(), http.StatusForbidden, w.Code)
+
+			data := OAuthError{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+			require.Equal(ts.T(), "insufficient_assurance", data.Err)
+		})
+	}
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantMaxRequestBodySize() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	maxRequestBodySize := ts.Config.API.MaxRequestBodySize
+	defer func() {
+		ts.Config.API.MaxRequestBodySize = maxRequestBodySize
+	}()
+	ts.Config.API.MaxRequestBodySize = 4096
+
+	body := func(padding int) []byte {
+		encoded, err := json.Marshal(map[string]interface{}{
+			"provider": "keycloak",
+			"id_token": mintIDToken(jwt.MapClaims{}),
+			"padding":  strings.Repeat("a", padding),
+		})
+		require.NoError(ts.T(), err)
+		return encoded
+	}
+
+	cases := []struct {
+		desc          string
+		body          []byte
+		contentLength bool
+		expected      int
+	}{
+		{
+			desc:          "normal body",
+			body:          body(0),
+			contentLength: true,
+			expected:      http.StatusOK,
+		},
+		{
+			desc:          "oversized body",
+			body:          body(1 << 20),
+			contentLength: true,
+			expected:      http.StatusRequestEntityTooLarge,
+		},
+		{
+			desc:     "oversized body without a content length",
+			body:     body(1 << 20),
+			expected: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", bytes.NewReader(c.body))
+			req.Header.Set("Content-Type", "application/json")
+			if !c.contentLength {
+				req.ContentLength = -1
+			}
+
+			w := httptest.NewRecorder()
+			ts.API.handler.ServeHTTP(w, req)
+			require.Equal(ts.T(), c.expected, w.Code, w.Body.String())
+
+			if c.expected == http.StatusRequestEntityTooLarge {
+				data := HTTPError{}
+				require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+				require.Equal(ts.T(), ErrorCodeRequestTooLarge, data.ErrorCode)
+			}
+		})
+	}
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantAllowEmptyEmail() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	claims := jwt.MapClaims{
+		"email":          nil,
+		"email_verified": nil,
+	}
+
+	// ID tokens without an email address are rejected by default
+	w := ts.idTokenGrant(map[string]interface{}{
+		"provider": "keycloak",
+		"id_token": mintIDToken(claims),
+	})
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+	ts.Config.External.Keycloak.AllowEmptyEmail = true
+
+	var userID uuid.UUID
+	for i := 0; i < 2; i++ {
+		w := ts.idTokenGrant(map[string]interface{}{
+			"provider": "keycloak",
+			"id_token": mintIDToken(claims),
+		})
+		require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+
+		data := AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.NotEmpty(ts.T(), data.RefreshToken)
+		require.Empty(ts.T(), data.User.GetEmail())
+
+		if i == 0 {
+			userID = data.User.ID
+		} else {
+			// the second sign in is matched to the same user by the
+			// identity's subject
+			require.Equal(ts.T(), userID, data.User.ID)
+		}
+	}
+
+	user, err := models.FindUserByID(ts.API.db, userID)
+	require.NoError(ts.T(), err)
+	require.Empty(ts.T(), user.GetEmail())
+	require.True(ts.T(), user.IsConfirmed())
+
+	identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "keycloak-subject", "keycloak")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), userID, identity.UserID)
+
+	// only one user was created
+	signups, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.UserSignedUpAction), nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), signups, 1)
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantAuditLog() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	idTokenGrantEntries := func() []*models.AuditLogEntry {
+		entries, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.IdTokenGrantAction), nil)
+		require.NoError(ts.T(), err)
+
+		return entries
+	}
+
+	// rejected ID tokens are not logged
+	w := ts.idTokenGrant(map[string]interface{}{
+		"provider": "keycloak",
+		"id_token": mintIDToken(jwt.MapClaims{"aud": "other-client"}),
+	})
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+	require.Empty(ts.T(), idTokenGrantEntries())
+
+	for _, created := range []bool{true, false} {
+		w = ts.idTokenGrant(map[string]interface{}{
+			"provider": "keycloak",
+			"id_token": mintIDToken(nil),
+		})
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		user, err := models.FindUserByEmailAndAudience(ts.API.db, "keycloak@example.com", ts.Config.JWT.Aud)
+		require.NoError(ts.T(), err)
+
+		entries := idTokenGrantEntries()
+		require.NotEmpty(ts.T(), entries)
+
+		traits, ok := entries[0].Payload["traits"].(map[string]interface{})
+		require.True(ts.T(), ok)
+		require.Equal(ts.T(), "keycloak", traits["provider"])
+		require.Equal(ts.T(), "https://keycloak.example.com/realms/test", traits["issuer"])
+		require.Equal(ts.T(), "keycloak-subject", traits["subject"])
+		require.Equal(ts.T(), user.ID.String(), traits["user_id"])
+		require.Equal(ts.T(), created, traits["created"])
+	}
+
+	require.Len(ts.T(), idTokenGrantEntries(), 2)
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantRecordsClientID() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+	ts.Config.External.Keycloak.WebClientID = []string{"keycloak-web", "keycloak-admin-web"}
+
+	for _, clientID := range []string{"keycloak-client", "keycloak-web", "keycloak-admin-web"} {
+		w := ts.idTokenGrant(map[string]interface{}{
+			"provider": "keycloak",
+			"id_token": mintIDToken(jwt.MapClaims{"aud": clientID}),
+		})
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		data := AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+
+		_, _, session, err := models.FindUserWithRefreshToken(ts.API.db, data.RefreshToken, false)
+		require.NoError(ts.T(), err)
+		require.NotNil(ts.T(), session.ClientID)
+		require.Equal(ts.T(), clientID, *session.ClientID)
+
+		// the identity records the client ID of its last sign in, but
+		// the user's metadata doesn't
+		identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "keycloak-subject", "keycloak")
+		require.NoError(ts.T(), err)
+		require.Equal(ts.T(), clientID, identity.IdentityData["client_id"])
+		require.NotContains(ts.T(), data.User.UserMetaData, "client_id")
+	}
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantClockSkewTolerance() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	tolerance := ts.Config.External.ClockSkewTolerance
+	defer func() {
+		ts.Config.External.ClockSkewTolerance = tolerance
+	}()
+
+	ts.Config.External.ClockSkewTolerance = 30 * time.Second
+
+	now := time.Now()
+
+	cases := []struct {
+		desc              string
+		claims            jwt.MapClaims
+		providerTolerance time.Duration
+		expectedCode      int
+	}{
+		{
+			desc:         "expired within tolerance",
+			claims:       jwt.MapClaims{"iat": now.Add(-time.Hour).Unix(), "exp": now.Add(-10 * time.Second).Unix()},
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "expired beyond tolerance",
+			claims:       jwt.MapClaims{"iat": now.Add(-time.Hour).Unix(), "exp": now.Add(-time.Minute).Unix()},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			desc:         "issued in the future within tolerance",
+			claims:       jwt.MapClaims{"iat": now.Add(10 * time.Second).Unix()},
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "issued in the future beyond tolerance",
+			claims:       jwt.MapClaims{"iat": now.Add(time.Minute).Unix()},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			desc:              "expired within provider tolerance",
+			claims:            jwt.MapClaims{"iat": now.Add(-time.Hour).Unix(), "exp": now.Add(-time.Minute).Unix()},
+			providerTolerance: 2 * time.Minute,
+			expectedCode:      http.StatusOK,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			ts.Config.External.Keycloak.ClockSkewTolerance = c.providerTolerance
+
+			w := ts.idTokenGrant(map[string]interface{}{
+				"provider": "keycloak",
+				"id_token": mintIDToken(c.claims),
+			})
+			require.Equal(ts.T(), c.expectedCode, w.Code)
+		})
+	}
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantUserEvents() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	type hookPayload struct {
+		Event    string                 `json:"event"`
+		Provider string                 `json:"provider"`
+		User     map[string]interface{} `json:"user"`
+	}
+
+	var payloads []hookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload hookPayload
+		require.NoError(ts.T(), json.NewDecoder(r.Body).Decode(&payload))
+		payloads = append(payloads, payload)
+	}))
+	defer server.Close()
+
+	webhook := ts.Config.Webhook
+	defer func() {
+		ts.Config.Webhook = webhook
+	}()
+
+	ts.Config.Webhook = conf.WebhookConfig{
+		URL:        server.URL,
+		Retries:    1,
+		TimeoutSec: 1,
+		Events:     []string{UserCreatedEvent, UserSignedInEvent},
+	}
+
+	for i := 0; i < 3; i++ {
+		w := ts.idTokenGrant(map[string]interface{}{
+			"provider": "keycloak",
+			"id_token": mintIDToken(nil),
+		})
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+	}
+
+	user, err := models.FindUserByEmailAndAudience(ts.API.db, "keycloak@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	require.Len(ts.T(), payloads, 3)
+	for i, payload := range payloads {
+		expectedEvent := UserSignedInEvent
+		if i == 0 {
+			expectedEvent = UserCreatedEvent
+		}
+
+		require.Equal(ts.T(), expectedEvent, payload.Event)
+		require.Equal(ts.T(), "keycloak", payload.Provider)
+		require.Equal(ts.T(), user.ID.String(), payload.User["id"])
+	}
+}
+
+func (ts *TokenTestSuite) TestTokenRoleFromAppMetadata() {
+	jwtConfig := ts.Config.JWT
+	defer func() {
+		ts.Config.JWT = jwtConfig
+	}()
+	ts.Config.JWT.RoleAppMetadataKey = "role"
+
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	passwordGrantRole := func() string {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"email":    "test@example.com",
+			"password": "password",
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		token := &AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+
+		claims := &GoTrueClaims{}
+		_, _, err := new(jwt.Parser).ParseUnverified(token.Token, claims)
+		require.NoError(ts.T(), err)
+
+		return claims.Role
+	}
+
+	// user_metadata can be changed by the user, so it never drives the role
+	require.NoError(ts.T(), u.UpdateUserMetaData(ts.API.db, map[string]interface{}{"role": "superuser"}))
+	require.Equal(ts.T(), u.Role, passwordGrantRole())
+
+	require.NoError(ts.T(), u.UpdateAppMetaData(ts.API.db, map[string]interface{}{"role": "editor"}))
+	require.Equal(ts.T(), "editor", passwordGrantRole())
+
+	require.NoError(ts.T(), u.UpdateAppMetaData(ts.API.db, map[string]interface{}{"role": "service_role"}))
+	require.Equal(ts.T(), u.Role, passwordGrantRole(), "admin roles are never mapped")
+}
+
+func (ts *TokenTestSuite) TestTokenExpiryByGrant() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	jwtConfig := ts.Config.JWT
+	defer func() {
+		ts.Config.JWT = jwtConfig
+	}()
+
+	ts.Config.JWT.ExpiryByGrant = map[string]int{
+		models.PasswordGrant.String(): 86400,
+		models.OAuth.String():         600,
+	}
+
+	tokenGrant := func(grantType string, params map[string]interface{}) *AccessTokenResponse {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type="+grantType, &buffer)
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusOK, w.Code, grantType)
+
+		token := &AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+
+		return token
+	}
+
+	requireExpiry := func(token *AccessTokenResponse, exp int) {
+		claims := &GoTrueClaims{}
+		_, _, err := new(jwt.Parser).ParseUnverified(token.Token, claims)
+		require.NoError(ts.T(), err)
+		require.Equal(ts.T(), int64(exp), claims.ExpiresAt-claims.IssuedAt)
+		require.Equal(ts.T(), exp, token.ExpiresIn)
+	}
+
+	passwordToken := tokenGrant("password", map[string]interface{}{
+		"email":    "test@example.com",
+		"password": "password",
+	})
+	requireExpiry(passwordToken, 86400)
+
+	idToken := tokenGrant("id_token", map[string]interface{}{
+		"provider": "keycloak",
+		"id_token": mintIDToken(nil),
+	})
+	requireExpiry(idToken, 600)
+
+	// refreshed sessions keep the expiry of the grant that created them
+	refreshedToken := tokenGrant("refresh_token", map[string]interface{}{
+		"refresh_token": passwordToken.RefreshToken,
+	})
+	requireExpiry(refreshedToken, 86400)
+
+	// grants without an override fall back to the global expiry
+	anonymousConfig := ts.Config.External.AnonymousUsers
+	defer func() {
+		ts.Config.External.AnonymousUsers = anonymousConfig
+	}()
+	ts.Config.External.AnonymousUsers.Enabled = true
+
+	requireExpiry(tokenGrant("anonymous", map[string]interface{}{}), ts.Config.JWT.Exp)
+}
+
+func (ts *TokenTestSuite) TestIdTokenVerify() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	verifyWithToken := func(token string, params map[string]interface{}) (*httptest.ResponseRecorder, IdTokenVerifyResponse) {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token/verify", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+
+		var data IdTokenVerifyResponse
+		if w.Code == http.StatusOK {
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		}
+
+		return w, data
+	}
+
+	verify := func(params map[string]interface{}) (*httptest.ResponseRecorder, IdTokenVerifyResponse) {
+		return verifyWithToken("", params)
+	}
+
+	// clients verify their own ID tokens, without being signed in
+	w, data := verifyWithToken("", map[string]interface{}{
+		"provider": "keycloak",
+		"id_token": mintIDToken(nil),
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.True(ts.T(), data.Valid)
+
+	userToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &GoTrueClaims{
+		Role: "authenticated",
+	}).SignedString([]byte(ts.Config.JWT.Secret))
+	require.NoError(ts.T(), err)
+
+	w, data = verifyWithToken(userToken, map[string]interface{}{
+		"provider": "keycloak",
+		"id_token": mintIDToken(nil),
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.True(ts.T(), data.Valid)
+
+	w, data = verify(map[string]interface{}{
+		"provider": "keycloak",
+		"id_token": mintIDToken(jwt.MapClaims{"department": "engineering"}),
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.True(ts.T(), data.Valid)
+	require.Equal(ts.T(), "keycloak", data.Provider)
+	require.Equal(ts.T(), "https://keycloak.example.com/realms/test", data.Issuer)
+	require.Equal(ts.T(), "keycloak-subject", data.Claims["sub"])
+	require.Equal(ts.T(), "engineering", data.Claims["department"])
+
+	cases := []struct {
+		desc        string
+		params      map[string]interface{}
+		code        string
+		description string
+	}{
+		{
+			desc:        "missing id_token",
+			params:      map[string]interface{}{"provider": "keycloak"},
+			code:        "invalid request",
+			description: "id_token required",
+		},
+		{
+			desc: "unacceptable audience",
+			params: map[string]interface{}{
+				"provider": "keycloak",
+				"id_token": mintIDToken(jwt.MapClaims{"aud": "other-client"}),
+			},
+			code:        "invalid_grant",
+			description: "Unacceptable audience in id_token",
+		},
+		{
+			desc: "expired id_token",
+			params: map[string]interface{}{
+				"provider": "keycloak",
+				"id_token": mintIDToken(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}),
+			},
+			code:        "invalid_grant",
+			description: "Bad ID token",
+		},
+		{
+			desc: "nonce mismatch",
+			params: map[string]interface{}{
+				"provider": "keycloak",
+				"id_token": mintIDToken(jwt.MapClaims{"nonce": "other-nonce"}),
+				"nonce":    "nonce",
+			},
+			code:        "invalid nonce",
+			description: "Nonces mismatch",
+		},
+	}
+
+	for _, c := range cases {
+		w, data := verify(c.params)
+		require.Equal(ts.T(), http.StatusOK, w.Code, c.desc)
+		require.False(ts.T(), data.Valid, c.desc)
+		require.Equal(ts.T(), c.code, data.Error, c.desc)
+		require.Equal(ts.T(), c.description, data.ErrorDescription, c.desc)
+		require.Empty(ts.T(), data.Claims, c.desc)
+	}
+
+	// errors not caused by the ID token are returned as usual
+	w, _ = verify(map[string]interface{}{
+		"issuer":    "https://unknown.example.com",
+		"client_id": "client-id",
+		"id_token":  mintIDToken(nil),
+	})
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	// nothing is written to the database
+	_, err = models.FindUserByEmailAndAudience(ts.API.db, "keycloak@example.com", ts.Config.JWT.Aud)
+	require.True(ts.T(), models.IsNotFoundError(err))
+
+	_, err = models.FindIdentityByIdAndProvider(ts.API.db, "keycloak-subject", "keycloak")
+	require.True(ts.T(), models.IsNotFoundError(err))
+
+	refreshTokens, err := ts.API.db.Q().Count(&models.RefreshToken{})
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 1, refreshTokens)
+
+	// verifications are limited like id_token grants
+	defaultLimiter := ts.API.idTokenGrantLimiter
+	defer func() {
+		ts.API.idTokenGrantLimiter = defaultLimiter
+	}()
+
+	ts.API.idTokenGrantLimiter = security.NewTokenBucketLimiter(1.0/60, 1, time.Hour)
+
+	w, _ = verify(map[string]interface{}{
+		"provider": "keycloak",
+		"id_token": mintIDToken(nil),
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w, _ = verify(map[string]interface{}{
+		"provider": "keycloak",
+		"id_token": mintIDToken(nil),
+	})
+	require.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+	require.Equal(ts.T(), "60", w.Header().Get("Retry-After"))
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantInvalidToken() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+	_, mintOtherIDToken := newTestJWKS(ts.T())
+
+	cases := []struct {
+		desc   string
+		params map[string]interface{}
+		status int
+		code   string
+	}{
+		{
+			desc: "expired",
+			params: map[string]interface{}{
+				"provider": "keycloak",
+				"id_token": mintIDToken(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}),
+			},
+			status: http.StatusUnauthorized,
+			code:   "invalid_grant",
+		},
+		{
+			desc: "bad signature",
+			params: map[string]interface{}{
+				"provider": "keycloak",
+				"id_token": mintOtherIDToken(jwt.MapClaims{
+					"iss": "https://keycloak.example.com/realms/test",
+					"aud": "keycloak-client",
+					"sub": "keycloak-subject",
+					"iat": time.Now().Unix(),
+					"exp": time.Now().Add(time.Hour).Unix(),
+				}),
+			},
+			status: http.StatusUnauthorized,
+			code:   "invalid_grant",
+		},
+		{
+			desc: "unacceptable audience",
+			params: map[string]interface{}{
+				"provider": "keycloak",
+				"id_token": mintIDToken(jwt.MapClaims{"aud": "other-client"}),
+			},
+			status: http.StatusUnauthorized,
+			code:   "invalid_grant",
+		},
+		{
+			desc: "missing id_token",
+			params: map[string]interface{}{
+				"provider": "keycloak",
+			},
+			status: http.StatusBadRequest,
+			code:   "invalid request",
+		},
+	}
+
+	for _, c := range cases {
+		w := ts.idTokenGrant(c.params)
+		require.Equal(ts.T(), c.status, w.Code, c.desc)
+
+		var data OAuthError
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.Equal(ts.T(), c.code, data.Err, c.desc)
+	}
+
+	// malformed bodies are bad requests
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", bytes.NewBufferString("{"))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+// anonymousSignIn signs in a new anonymous user with the anonymous grant.
+func anonymousSignIn(t *testing.T, api *API) *AccessTokenResponse {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=anonymous", nil)
+
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	token := &AccessTokenResponse{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(token))
+
+	return token
+}
+
+func (ts *TokenTestSuite) TestAnonymousGrant() {
+	defer func() {
+		ts.Config.External.AnonymousUsers.Enabled = false
+		ts.Config.DisableSignup = false
+	}()
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"data": map[string]interface{}{
+			"theme": "dark",
+		},
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=anonymous", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	ts.Config.External.AnonymousUsers.Enabled = true
+
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=anonymous", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	token := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+	require.NotEmpty(ts.T(), token.Token)
+	require.NotEmpty(ts.T(), token.RefreshToken)
+	require.True(ts.T(), token.User.IsAnonymous)
+	require.Empty(ts.T(), token.User.GetEmail())
+	require.Empty(ts.T(), token.User.GetPhone())
+	require.Equal(ts.T(), "dark", token.User.UserMetaData["theme"])
+
+	user, err := models.FindUserByID(ts.API.db, token.User.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), user.IsAnonymous)
+	require.Equal(ts.T(), "anonymous", user.AppMetaData["provider"])
+
+	claims := &GoTrueClaims{}
+	_, err = jwt.ParseWithClaims(token.Token, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(ts.Config.JWT.Secret), nil
+	})
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), claims.IsAnonymous)
+	require.NotEmpty(ts.T(), claims.SessionId)
+	require.Len(ts.T(), claims.AuthenticationMethodReference, 1)
+	require.Equal(ts.T(), models.Anonymous.String(), claims.AuthenticationMethodReference[0].Method)
+
+	// the session can be refreshed like any other
+	buffer.Reset()
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"refresh_token": token.RefreshToken,
+	}))
+
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=refresh_token", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	ts.Config.DisableSignup = true
+
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=anonymous", nil)
+
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantConvertsAnonymousUser() {
+	defer func() {
+		ts.Config.External.AnonymousUsers.Enabled = false
+	}()
+	ts.Config.External.AnonymousUsers.Enabled = true
+
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	idTokenGrant := func(accessToken string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"provider": "keycloak",
+			"id_token": mintIDToken(nil),
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=id_token", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	anonymous := anonymousSignIn(ts.T(), ts.API)
+
+	w := idTokenGrant(anonymous.Token)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	token := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+	require.Equal(ts.T(), anonymous.User.ID, token.User.ID)
+	require.False(ts.T(), token.User.IsAnonymous)
+	require.Equal(ts.T(), "keycloak@example.com", token.User.GetEmail())
+
+	user, err := models.FindUserByID(ts.API.db, anonymous.User.ID)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), user.IsAnonymous)
+	require.True(ts.T(), user.IsConfirmed())
+	require.Equal(ts.T(), "keycloak", user.AppMetaData["provider"])
+
+	_, err = models.FindIdentityByIdAndProvider(ts.API.db, "keycloak-subject", "keycloak")
+	require.NoError(ts.T(), err)
+
+	// the identity now belongs to a permanent user, so it can't be
+	// linked to another anonymous user
+	other := anonymousSignIn(ts.T(), ts.API)
+
+	w = idTokenGrant(other.Token)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	var data OAuthError
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), signInSuppressedIdentityAlreadyExists, data.Err)
+
+	user, err = models.FindUserByID(ts.API.db, other.User.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), user.IsAnonymous)
+}
+
+func (ts *TokenTestSuite) TestLinkIdentity() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	linkIdentity := func(user *models.User, idToken string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"provider": "keycloak",
+			"id_token": idToken,
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/user/identities/link", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+
+		if user != nil {
+			token, _, err := generateAccessToken(ts.API.db, user, nil, &ts.Config.JWT)
+			require.NoError(ts.T(), err)
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	// linking requires a signed in user
+	w := linkIdentity(nil, mintIDToken(nil))
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+	// the identity's email address differs from the user's, so it is
+	// linked only because the user is signed in
+	w = linkIdentity(ts.User, mintIDToken(nil))
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	data := &models.User{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+	require.Equal(ts.T(), ts.User.ID, data.ID)
+	require.Equal(ts.T(), "test@example.com", data.GetEmail())
+	require.Contains(ts.T(), data.AppMetaData["providers"], "keycloak")
+
+	identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "keycloak-subject", "keycloak")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), ts.User.ID, identity.UserID)
+
+	entries, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.IdentityLinkedAction), nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), entries, 1)
+
+	// linking the same identity again is rejected
+	w = linkIdentity(ts.User, mintIDToken(nil))
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	// an identity can't be moved to another user
+	other, err := models.NewUser("", "other@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(other))
+
+	w = linkIdentity(other, mintIDToken(nil))
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	identity, err = models.FindIdentityByIdAndProvider(ts.API.db, "keycloak-subject", "keycloak")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), ts.User.ID, identity.UserID)
+
+	// rejected ID tokens don't link anything
+	w = linkIdentity(other, mintIDToken(jwt.MapClaims{"sub": "other-subject", "aud": "other-client"}))
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+	_, err = models.FindIdentityByIdAndProvider(ts.API.db, "other-subject", "keycloak")
+	require.True(ts.T(), models.IsNotFoundError(err))
+}
+
+func (ts *TokenTestSuite) TestLinkIdentityLimit() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	defer func() {
+		ts.Config.External.MaxIdentitiesPerUser = 0
+	}()
+
+	linkIdentity := func(subject string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"provider": "keycloak",
+			"id_token": mintIDToken(jwt.MapClaims{"sub": subject}),
+		}))
+
+		token, _, err := generateAccessToken(ts.API.db, ts.User, nil, &ts.Config.JWT)
+		require.NoError(ts.T(), err)
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/user/identities/link", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	count, err := models.CountIdentitiesByUserID(ts.API.db, ts.User.ID)
+	require.NoError(ts.T(), err)
+
+	// one more identity can be linked
+	ts.Config.External.MaxIdentitiesPerUser = count + 1
+
+	w := linkIdentity("keycloak-subject")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w = linkIdentity("other-subject")
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	data := HTTPError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), ErrorCodeIdentityLimitExceeded, data.ErrorCode)
+
+	_, err = models.FindIdentityByIdAndProvider(ts.API.db, "other-subject", "keycloak")
+	require.True(ts.T(), models.IsNotFoundError(err))
+
+	// the limit is disabled by default
+	ts.Config.External.MaxIdentitiesPerUser = 0
+
+	w = linkIdentity("other-subject")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+}
+
+func (ts *TokenTestSuite) TestDeleteIdentity() {
+	createIdentity := func(user *models.User, provider, subject string) *models.Identity {
+		identity, err := models.NewIdentity(user, provider, map[string]interface{}{"sub": subject})
+		require.NoError(ts.T(), err)
+		require.NoError(ts.T(), ts.API.db.Create(identity))
+		require.NoError(ts.T(), user.UpdateAppMetaDataProviders(ts.API.db))
+
+		return identity
+	}
+
+	deleteIdentity := func(user *models.User, identityID string) *httptest.ResponseRecorder {
+		token, _, err := generateAccessToken(ts.API.db, user, nil, &ts.Config.JWT)
+		require.NoError(ts.T(), err)
+
+		req := httptest.NewRequest(http.MethodDelete, "http://localhost/user/identities/"+identityID, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	createIdentity(ts.User, "keycloak", "keycloak-subject")
+	createIdentity(ts.User, "github", "github-subject")
+
+	// identities of other users can't be unlinked
+	other, err := models.NewUser("", "", "", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(other))
+	createIdentity(other, "google", "google-subject")
+
+	w := deleteIdentity(ts.User, "google-subject")
+	require.Equal(ts.T(), http.StatusNotFound, w.Code)
+
+	_, err = models.FindIdentityByIdAndProvider(ts.API.db, "google-subject", "google")
+	require.NoError(ts.T(), err)
+
+	// the user can still sign in with their password and other identities
+	w = deleteIdentity(ts.User, "keycloak-subject")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	_, err = models.FindIdentityByIdAndProvider(ts.API.db, "keycloak-subject", "keycloak")
+	require.True(ts.T(), models.IsNotFoundError(err))
+
+	user, err := models.FindUserByID(ts.API.db, ts.User.ID)
+	require.NoError(ts.T(), err)
+	require.NotContains(ts.T(), user.AppMetaData["providers"], "keycloak")
+	require.Contains(ts.T(), user.AppMetaData["providers"], "github")
+
+	entries, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(models.IdentityUnlinkedAction), nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), entries, 1)
+
+	// the other user's only identity is their only way to sign in
+	w = deleteIdentity(other, "google-subject")
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	_, err = models.FindIdentityByIdAndProvider(ts.API.db, "google-subject", "google")
+	require.NoError(ts.T(), err)
+
+	// once they have another identity, it can be unlinked
+	createIdentity(other, "keycloak", "keycloak-subject")
+
+	w = deleteIdentity(other, "google-subject")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	user, err = models.FindUserByID(ts.API.db, other.ID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), []interface{}{"keycloak"}, user.AppMetaData["providers"])
+}
+
+func (ts *TokenTestSuite) TestTokenPasswordGrantAudience() {
+	jwtConfig := ts.Config.JWT
+	defer func() {
+		ts.Config.JWT = jwtConfig
+	}()
+
+	ts.Config.JWT.Issuer = "https://example.com"
+	ts.Config.JWT.AllowedAudiences = []string{"app-a"}
+	ts.Config.JWT.AudienceIssuers = map[string]string{"app-a": "https://a.example.com"}
+
+	u, err := models.NewUser("", "app-a@example.com", "password", "app-a", nil)
+	require.NoError(ts.T(), err)
+	now := time.Now()
+	u.EmailConfirmedAt = &now
+	require.NoError(ts.T(), ts.API.db.Create(u))
+
+	passwordGrant := func(path, aud, email string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"email":    email,
+			"password": "password",
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "http://localhost"+path+"?grant_type=password", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		if aud != "" {
+			req.Header.Set(audHeaderName, aud)
+		}
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	cases := []struct {
+		desc   string
+		path   string
+		aud    string
+		user   *models.User
+		issuer string
+	}{
+		{
+			desc:   "default audience",
+			path:   "/token",
+			user:   ts.User,
+			issuer: "https://example.com",
+		},
+		{
+			desc:   "audience from header",
+			path:   "/token",
+			aud:    "app-a",
+			user:   u,
+			issuer: "https://a.example.com",
+		},
+		{
+			desc:   "audience from path",
+			path:   "/aud/app-a/token",
+			user:   u,
+			issuer: "https://a.example.com",
+		},
+		{
+			desc:   "audience from path and header",
+			path:   "/aud/app-a/token",
+			aud:    "app-a",
+			user:   u,
+			issuer: "https://a.example.com",
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			w := passwordGrant(c.path, c.aud, c.user.GetEmail())
+			require.Equal(ts.T(), http.StatusOK, w.Code)
+
+			token := &AccessTokenResponse{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+
+			claims := &GoTrueClaims{}
+			_, _, err := new(jwt.Parser).ParseUnverified(token.Token, claims)
+			require.NoError(ts.T(), err)
+			require.Equal(ts.T(), c.user.ID, token.User.ID)
+			require.Equal(ts.T(), c.user.Aud, claims.Audience)
+			require.Equal(ts.T(), c.issuer, claims.Issuer)
+		})
+	}
+
+	for path, aud := range map[string]string{
+		"/token":           "app-b",
+		"/aud/app-b/token": "",
+		"/aud/app-a/token": jwtConfig.Aud,
+	} {
+		w := passwordGrant(path, aud, u.GetEmail())
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code, path)
+	}
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantSpans() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSpanProcessor(sdktrace.NewSimpleSpanProcessor(exporter)),
+	))
+
+	// spans are only recorded with OpenTelemetry tracing enabled
+	w := ts.idTokenGrant(map[string]interface{}{
+		"provider": "keycloak",
+		"id_token": mintIDToken(nil),
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.Empty(ts.T(), exporter.GetSpans())
+
+	tracing := ts.Config.Tracing
+	defer func() {
+		ts.Config.Tracing = tracing
+	}()
+	ts.Config.Tracing.Enabled = true
+	ts.Config.Tracing.Exporter = conf.OpenTelemetryTracing
+
+	w = ts.idTokenGrant(map[string]interface{}{
+		"provider": "keycloak",
+		"id_token": mintIDToken(nil),
+	})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w = ts.idTokenGrant(map[string]interface{}{
+		"provider": "keycloak",
+		"id_token": mintIDToken(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}),
+	})
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+	spans := exporter.GetSpans().Snapshots()
+	require.Len(ts.T(), spans, 4)
+
+	for i, outcome := range []string{"success", "failure"} {
+		parse, grant := spans[2*i], spans[2*i+1]
+
+		require.Equal(ts.T(), "oidc.parse_id_token", parse.Name())
+		require.Equal(ts.T(), grant.SpanContext().SpanID(), parse.Parent().SpanID())
+		require.Contains(ts.T(), parse.Attributes(), attribute.String("gotrue.outcome", outcome))
+
+		require.Equal(ts.T(), "id_token_grant", grant.Name())
+		require.Contains(ts.T(), grant.Attributes(), attribute.String("gotrue.provider", "keycloak"))
+		require.Contains(ts.T(), grant.Attributes(), attribute.String("gotrue.outcome", outcome))
+	}
+
+	require.Contains(ts.T(), spans[0].Attributes(), attribute.String("gotrue.oidc.issuer", "https://keycloak.example.com/realms/test"))
+	require.Contains(ts.T(), spans[1].Attributes(), attribute.String("gotrue.oidc.issuer", "https://keycloak.example.com/realms/test"))
+	require.Equal(ts.T(), codes.Error, spans[3].Status().Code)
+}
+
+func (ts *TokenTestSuite) TestIdTokenGrantAccountLinkingStrategy() {
+	mintIDToken := ts.setupKeycloakIdTokenGrant()
+
+	external := ts.Config.External
+	mailer := ts.Config.Mailer
+	defer func() {
+		ts.Config.External = external
+		ts.Config.Mailer = mailer
+	}()
+
+	cases := []struct {
+		strategy      string
+		userConfirmed bool
+		emailVerified bool
+		autoconfirm   bool
+		linked        bool
+	}{
+		{strategy: conf.AccountLinkingAutomatic, userConfirmed: true, emailVerified: true, linked: true},
+		{strategy: conf.AccountLinkingAutomatic, userConfirmed: false, emailVerified: true, linked: true},
+		{strategy: conf.AccountLinkingAutomatic, userConfirmed: true, emailVerified: false, autoconfirm: true, linked: true},
+		{strategy: conf.AccountLinkingManual, userConfirmed: true, emailVerified: true, linked: false},
+		{strategy: conf.AccountLinkingManual, userConfirmed: true, emailVerified: false, autoconfirm: true, linked: false},
+		{strategy: conf.AccountLinkingVerifiedOnly, userConfirmed: true, emailVerified: true, linked: true},
+		{strategy: conf.AccountLinkingVerifiedOnly, userConfirmed: false, emailVerified: true, linked: false},
+		{strategy: conf.AccountLinkingVerifiedOnly, userConfirmed: true, emailVerified: false, autoconfirm: true, linked: false},
+	}
+
+	for _, c := range cases {
+		desc := fmt.Sprintf("%s with confirmed user %v and verified email %v", c.strategy, c.userConfirmed, c.emailVerified)
+
+		ts.Run(desc, func() {
+			ts.SetupTest()
+			ts.Config.External.AccountLinkingStrategy = c.strategy
+			ts.Config.Mailer.Autoconfirm = c.autoconfirm
+
+			user, err := models.NewUser("", "keycloak@example.com", "password", ts.Config.JWT.Aud, nil)
+			require.NoError(ts.T(), err)
+			if c.userConfirmed {
+				now := time.Now()
+				user.EmailConfirmedAt = &now
+			}
+			require.NoError(ts.T(), ts.API.db.Create(user))
+
+			w := ts.idTokenGrant(map[string]interface{}{
+				"provider": "keycloak",
+				"id_token": mintIDToken(jwt.MapClaims{"email_verified": c.emailVerified}),
+			})
+
+			identity, err := models.FindIdentityByIdAndProvider(ts.API.db, "keycloak-subject", "keycloak")
+
+			if c.linked {
+				require.Equal(ts.T(), http.StatusOK, w.Code)
+
+				token := &AccessTokenResponse{}
+				require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+				require.Equal(ts.T(), user.ID, token.User.ID)
+
+				require.NoError(ts.T(), err)
+				require.Equal(ts.T(), user.ID, identity.UserID)
+			} else {
+				require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+				var data OAuthError
+				require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+				require.Equal(ts.T(), signInSuppressedLinkingNotAllowed, data.Err)
+
+				require.True(ts.T(), models.IsNotFoundError(err))
+			}
+		})
+	}
+}
+
+func (ts *TokenTestSuite) TestIssueRefreshTokenAccessTokenOnlyFallback() {
+	defer func() {
+		ts.Config.Sessions.AllowAccessTokenOnlyFallback = false
+	}()
+
+	// a read-only transaction fails to persist the session like a
+	// database in the middle of a failover does
+	issueReadOnly := func() (*AccessTokenResponse, error) {
+		var token *AccessTokenResponse
+		err := ts.API.db.Transaction(func(tx *storage.Connection) error {
+			if terr := tx.RawQuery("SET TRANSACTION READ ONLY").Exec(); terr != nil {
+				return terr
+			}
+
+			var terr error
+			token, terr = ts.API.issueRefreshToken(context.Background(), tx, ts.User, models.PasswordGrant, models.GrantParams{})
+			return terr
+		})
+
+		return token, err
+	}
+
+	sessionCount := func() int {
+		count, err := ts.API.db.Count(&models.Session{})
+		require.NoError(ts.T(), err)
+		return count
+	}
+
+	sessions := sessionCount()
+
+	_, err := issueReadOnly()
+	require.Error(ts.T(), err)
+
+	ts.Config.Sessions.AllowAccessTokenOnlyFallback = true
+
+	token, err := issueReadOnly()
+	require.NoError(ts.T(), err)
+	require.NotEmpty(ts.T(), token.Token)
+	require.Empty(ts.T(), token.RefreshToken)
+	require.Equal(ts.T(), sessions, sessionCount())
+
+	claims := &GoTrueClaims{}
+	_, err = jwt.ParseWithClaims(token.Token, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(ts.Config.JWT.Secret), nil
+	})
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), ts.User.ID.String(), claims.Subject)
+	require.Empty(ts.T(), claims.SessionId)
+
+	// the access token is accepted even though it has no session
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/user", nil)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	// sessions are still persisted when the database is writable
+	require.NoError(ts.T(), ts.API.db.Transaction(func(tx *storage.Connection) error {
+		token, err = ts.API.issueRefreshToken(context.Background(), tx, ts.User, models.PasswordGrant, models.GrantParams{})
+		return err
+	}))
+	require.NotEmpty(ts.T(), token.RefreshToken)
+	require.Equal(ts.T(), sessions+1, sessionCount())
+}
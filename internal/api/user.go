@@ -51,7 +51,7 @@ func (p *UserUpdateParams) Validate(tx *storage.Connection, user *models.User, a
 			return badRequestError(InvalidChannelError)
 		}
 		if p.Phone != user.GetPhone() {
-			if p.Phone, err = validatePhone(p.Phone); err != nil {
+			if p.Phone, err = validatePhone(p.Phone, config.Sms.DefaultRegion); err != nil {
 				return err
 			}
 			if exists, err := models.IsDuplicatedPhone(tx, p.Phone, aud); err != nil {
@@ -69,10 +69,6 @@ func (p *UserUpdateParams) Validate(tx *storage.Connection, user *models.User, a
 	if p.Password != nil {
 		password := *p.Password
 
-		if len(password) < config.PasswordMinLength {
-			return invalidPasswordLengthError(config.PasswordMinLength)
-		}
-
 		if user.EncryptedPassword != "" && user.Authenticate(password) {
 			return unprocessableEntityError("New password should be different from the old password.")
 		}
@@ -99,6 +95,13 @@ func (a *API) UserGet(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	user := getUser(ctx)
+
+	if a.config.External.ExposeProviderClaims {
+		for i := range user.Identities {
+			user.Identities[i].ProviderClaims = user.Identities[i].StoredClaims(a.config.External.ProviderClaimsAllowList)
+		}
+	}
+
 	return sendJSON(w, http.StatusOK, user)
 }
 
@@ -129,6 +132,18 @@ func (a *API) UserUpdate(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	if params.Password != nil {
+		if config.MFA.StepUp.PasswordUpdate {
+			if err := a.requireStepUp(ctx, db, user); err != nil {
+				return err
+			}
+		}
+
+		if err := a.checkPasswordStrength(r, *params.Password, user.GetEmail(), user.GetPhone()); err != nil {
+			return err
+		}
+	}
+
 	err = db.Transaction(func(tx *storage.Connection) error {
 		var terr error
 		if params.Password != nil {
@@ -150,6 +165,14 @@ func (a *API) UserUpdate(w http.ResponseWriter, r *http.Request) error {
 				sessionID = &session.ID
 			}
 
+			if terr = a.checkPasswordHistory(tx, user, *params.Password); terr != nil {
+				return terr
+			}
+
+			if terr = a.recordPasswordHistory(tx, user); terr != nil {
+				return terr
+			}
+
 			if terr = user.UpdatePassword(tx, *params.Password, sessionID); terr != nil {
 				return internalServerError("Error during password storage").WithInternalError(terr)
 			}
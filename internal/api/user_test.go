@@ -61,6 +61,102 @@ func (ts *UserTestSuite) TestUserGet() {
 	require.Equal(ts.T(), http.StatusOK, w.Code)
 }
 
+func (ts *UserTestSuite) TestUserGetCookieAuthentication() {
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	token, _, err := generateAccessToken(ts.API.db, u, nil, &ts.Config.JWT)
+	require.NoError(ts.T(), err)
+
+	getUser := func() int {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/user", nil)
+		req.AddCookie(&http.Cookie{
+			Name:  ts.Config.Cookie.Key + "-access-token",
+			Value: token,
+		})
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	require.Equal(ts.T(), http.StatusUnauthorized, getUser(), "cookies are only accepted if enabled")
+
+	ts.Config.Cookie.Authenticate = true
+	defer func() {
+		ts.Config.Cookie.Authenticate = false
+	}()
+
+	require.Equal(ts.T(), http.StatusOK, getUser())
+}
+
+func (ts *UserTestSuite) TestUserGetProviderClaims() {
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	identity, err := models.NewIdentity(u, "google", map[string]interface{}{
+		"sub": "claims-subject",
+		"claims": map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"sub":            "claims-subject",
+			"email":          "test@example.com",
+			"email_verified": true,
+			"hd":             "example.com",
+			"internal_id":    "secret",
+		},
+	})
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(identity))
+
+	token, _, err := generateAccessToken(ts.API.db, u, nil, &ts.Config.JWT)
+	require.NoError(ts.T(), err)
+
+	getIdentities := func() []models.Identity {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/user", nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		data := models.User{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+
+		return data.Identities
+	}
+
+	identities := getIdentities()
+	require.Len(ts.T(), identities, 1)
+	require.Nil(ts.T(), identities[0].ProviderClaims, "provider claims are only returned if enabled")
+
+	ts.Config.External.ExposeProviderClaims = true
+	defer func() {
+		ts.Config.External.ExposeProviderClaims = false
+	}()
+
+	identities = getIdentities()
+	require.Len(ts.T(), identities, 1)
+	require.Equal(ts.T(), map[string]interface{}{
+		"iss":            "https://accounts.google.com",
+		"sub":            "claims-subject",
+		"email":          "test@example.com",
+		"email_verified": true,
+		"hd":             "example.com",
+	}, identities[0].ProviderClaims)
+
+	allowList := ts.Config.External.ProviderClaimsAllowList
+	ts.Config.External.ProviderClaimsAllowList = []string{"sub", "internal_id"}
+	defer func() {
+		ts.Config.External.ProviderClaimsAllowList = allowList
+	}()
+
+	identities = getIdentities()
+	require.Equal(ts.T(), map[string]interface{}{
+		"sub":         "claims-subject",
+		"internal_id": "secret",
+	}, identities[0].ProviderClaims)
+}
+
 func (ts *UserTestSuite) TestUserUpdateEmail() {
 	cases := []struct {
 		desc                       string
@@ -368,6 +464,63 @@ func (ts *UserTestSuite) TestUserUpdatePasswordReauthentication() {
 	require.NotEmpty(ts.T(), u.ReauthenticationSentAt)
 }
 
+func (ts *UserTestSuite) TestUserUpdatePasswordReauthenticationExpired() {
+	security := ts.Config.Security
+	defer func() {
+		ts.Config.Security = security
+	}()
+	ts.Config.Security.UpdatePasswordRequireReauthentication = true
+
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	now := time.Now()
+	u.EmailConfirmedAt = &now
+	require.NoError(ts.T(), ts.API.db.Update(u), "Error updating new test user")
+
+	token, _, err := generateAccessToken(ts.API.db, u, nil, &ts.Config.JWT)
+	require.NoError(ts.T(), err)
+
+	updatePassword := func(nonce string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"password": "newpass",
+			"nonce":    nonce,
+		}))
+
+		req := httptest.NewRequest(http.MethodPut, "http://localhost/user", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// a nonce sent longer ago than the OTP expiry is rejected
+	sentAt := now.Add(-time.Duration(ts.Config.Mailer.OtpExp+60) * time.Second)
+	u.ReauthenticationToken = crypto.GenerateTokenHash(u.GetEmail(), "123456")
+	u.ReauthenticationSentAt = &sentAt
+	require.NoError(ts.T(), ts.API.db.Update(u))
+
+	w := updatePassword("123456")
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	// a valid nonce can only be used once
+	u.ReauthenticationSentAt = &now
+	require.NoError(ts.T(), ts.API.db.Update(u))
+
+	w = updatePassword("123456")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w = updatePassword("123456")
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	u, err = models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), u.Authenticate("newpass"))
+}
+
 func (ts *UserTestSuite) TestUserUpdatePasswordLogoutOtherSessions() {
 	ts.Config.Security.UpdatePasswordRequireReauthentication = false
 	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
@@ -444,3 +597,60 @@ func (ts *UserTestSuite) TestUserUpdatePasswordLogoutOtherSessions() {
 	ts.API.handler.ServeHTTP(w, req)
 	require.NotEqual(ts.T(), http.StatusOK, w.Code)
 }
+
+func (ts *UserTestSuite) TestUserUpdatePasswordHistory() {
+	security := ts.Config.Security
+	defer func() {
+		ts.Config.Security = security
+	}()
+	ts.Config.Security.UpdatePasswordRequireReauthentication = false
+	ts.Config.Security.PasswordHistoryLength = 2
+
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	token, _, err := generateAccessToken(ts.API.db, u, nil, &ts.Config.JWT)
+	require.NoError(ts.T(), err)
+
+	updatePassword := func(password string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"password": password,
+		}))
+
+		req := httptest.NewRequest(http.MethodPut, "http://localhost/user", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	requireReused := func(password string) {
+		w := updatePassword(password)
+		require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+		data := &HTTPError{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+		require.Equal(ts.T(), ErrorCodePasswordReused, data.ErrorCode)
+	}
+
+	require.Equal(ts.T(), http.StatusOK, updatePassword("password1").Code)
+	requireReused("password")
+
+	require.Equal(ts.T(), http.StatusOK, updatePassword("password2").Code)
+	require.Equal(ts.T(), http.StatusOK, updatePassword("password3").Code)
+	requireReused("password1")
+
+	// only the 2 most recent previous passwords are kept
+	entries, err := models.FindPasswordHistory(ts.API.db, u)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), entries, 2)
+
+	require.Equal(ts.T(), http.StatusOK, updatePassword("password").Code)
+
+	u, err = models.FindUserByID(ts.API.db, u.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), u.Authenticate("password"))
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/sethvargo/go-password/password"
 	"github.com/supabase/gotrue/internal/api/sms_provider"
+	"github.com/supabase/gotrue/internal/conf"
 	"github.com/supabase/gotrue/internal/crypto"
 	"github.com/supabase/gotrue/internal/models"
 	"github.com/supabase/gotrue/internal/observability"
@@ -54,7 +55,7 @@ type VerifyParams struct {
 	RedirectTo string `json:"redirect_to"`
 }
 
-func (p *VerifyParams) Validate(r *http.Request) error {
+func (p *VerifyParams) Validate(r *http.Request, config *conf.GlobalConfiguration) error {
 	var err error
 	if p.Type == "" {
 		return badRequestError("Verify requires a verification type")
@@ -72,7 +73,7 @@ func (p *VerifyParams) Validate(r *http.Request) error {
 		}
 		if p.Token != "" {
 			if isPhoneOtpVerification(p) {
-				p.Phone, err = validatePhone(p.Phone)
+				p.Phone, err = validatePhone(p.Phone, config.Sms.DefaultRegion)
 				if err != nil {
 					return err
 				}
@@ -105,7 +106,7 @@ func (a *API) Verify(w http.ResponseWriter, r *http.Request) error {
 		params.Token = r.FormValue("token")
 		params.Type = r.FormValue("type")
 		params.RedirectTo = utilities.GetReferrer(r, a.config)
-		if err := params.Validate(r); err != nil {
+		if err := params.Validate(r, a.config); err != nil {
 			return err
 		}
 		return a.verifyGet(w, r, params)
@@ -117,7 +118,7 @@ func (a *API) Verify(w http.ResponseWriter, r *http.Request) error {
 		if err := json.Unmarshal(body, params); err != nil {
 			return badRequestError("Could not parse verification params: %v", err)
 		}
-		if err := params.Validate(r); err != nil {
+		if err := params.Validate(r, a.config); err != nil {
 			return err
 		}
 		return a.verifyPost(w, r, params)
@@ -138,6 +139,8 @@ func (a *API) verifyGet(w http.ResponseWriter, r *http.Request, params *VerifyPa
 		token       *AccessTokenResponse
 		authCode    string
 	)
+
+	grantParams.FillGrantParams(r, config.Security.TrustedProxies)
 	flowType := models.ImplicitFlow
 	var authenticationMethod models.AuthenticationMethod
 	if strings.HasPrefix(params.Token, PKCEPrefix) {
@@ -183,10 +186,6 @@ func (a *API) verifyGet(w http.ResponseWriter, r *http.Request, params *VerifyPa
 			if terr != nil {
 				return terr
 			}
-
-			if terr = a.setCookieTokens(config, token, false, w); terr != nil {
-				return internalServerError("Failed to set JWT cookie. %s", terr)
-			}
 		} else if isPKCEFlow(flowType) {
 			if authCode, terr = issueAuthCode(tx, user, a.config.External.FlowStateExpiryDuration, authenticationMethod); terr != nil {
 				return badRequestError("No associated flow state found. %s", terr)
@@ -208,6 +207,11 @@ func (a *API) verifyGet(w http.ResponseWriter, r *http.Request, params *VerifyPa
 	}
 	rurl := params.RedirectTo
 	if isImplicitFlow(flowType) && token != nil {
+		// the access token is only set once the transaction is committed
+		if err := a.setCookieTokens(config, token, false, w); err != nil {
+			return internalServerError("Failed to set JWT cookie. %s", err)
+		}
+
 		q := url.Values{}
 		q.Set("type", params.Type)
 		rurl = token.AsRedirectURL(rurl, q)
@@ -233,6 +237,12 @@ func (a *API) verifyPost(w http.ResponseWriter, r *http.Request, params *VerifyP
 	)
 	var isSingleConfirmationResponse = false
 
+	grantParams.FillGrantParams(r, config.Security.TrustedProxies)
+
+	if !isUsingTokenHash(params) && isEmailOtpVerification(params) && config.Mailer.OTPMode == conf.EmailOTPModeLink {
+		return badRequestError("Email OTP codes are disabled, use the link sent in the email instead")
+	}
+
 	err := db.Transaction(func(tx *storage.Connection) error {
 		var terr error
 		aud := a.requestAud(ctx, r)
@@ -270,21 +280,23 @@ func (a *API) verifyPost(w http.ResponseWriter, r *http.Request, params *VerifyP
 		if terr != nil {
 			return terr
 		}
-
-		if terr = a.setCookieTokens(config, token, false, w); terr != nil {
-			return internalServerError("Failed to set JWT cookie. %s", terr)
-		}
 		return nil
 	})
 	if err != nil {
 		return err
 	}
+
 	if isSingleConfirmationResponse {
 		return sendJSON(w, http.StatusOK, map[string]string{
 			"msg":  singleConfirmationAccepted,
 			"code": strconv.Itoa(http.StatusOK),
 		})
 	}
+
+	// the access token is only set once the transaction is committed
+	if err := a.setCookieTokens(config, token, false, w); err != nil {
+		return internalServerError("Failed to set JWT cookie. %s", err)
+	}
 	return sendJSON(w, http.StatusOK, token)
 }
 
@@ -520,7 +532,7 @@ func (a *API) verifyTokenHash(ctx context.Context, conn *storage.Connection, par
 		return nil, internalServerError("Database error finding user from email link").WithInternalError(err)
 	}
 
-	if user.IsBanned() {
+	if user.IsBanned() || user.IsDeleted() {
 		return nil, unauthorizedError("Error confirming user").WithInternalError(errRedirectWithQuery)
 	}
 
@@ -575,7 +587,7 @@ func (a *API) verifyUserAndToken(ctx context.Context, conn *storage.Connection,
 		return nil, internalServerError("Database error finding user").WithInternalError(err)
 	}
 
-	if user.IsBanned() {
+	if user.IsBanned() || user.IsDeleted() {
 		return nil, unauthorizedError("Error confirming user").WithInternalError(errRedirectWithQuery)
 	}
 
@@ -624,12 +636,35 @@ func (a *API) verifyUserAndToken(ctx context.Context, conn *storage.Connection,
 		isValid = isOtpValid(tokenHash, expectedToken, sentAt, config.Sms.OtpExp)
 	}
 
+	if !isValid && isEmailOtpVerification(params) {
+		locked, err := a.incrementEmailOtpAttempts(ctx, user)
+		if err != nil {
+			return nil, internalServerError("Database error updating user").WithInternalError(err)
+		}
+		if locked {
+			return nil, tooManyRequestsError("Too many failed attempts, request a new code")
+		}
+	}
+
 	if !isValid || err != nil {
 		return nil, expiredTokenError("Token has expired or is invalid").WithInternalError(errRedirectWithQuery)
 	}
 	return user, nil
 }
 
+// incrementEmailOtpAttempts records a failed email OTP attempt and reports
+// whether the user's email OTPs have been invalidated. It runs in its own
+// transaction, as the verification transaction is rolled back on failure.
+func (a *API) incrementEmailOtpAttempts(ctx context.Context, user *models.User) (bool, error) {
+	var locked bool
+	err := a.db.WithContext(ctx).Transaction(func(tx *storage.Connection) error {
+		var terr error
+		locked, terr = user.IncrementEmailOtpAttempts(tx, a.config.Mailer.OtpMaxAttempts)
+		return terr
+	})
+	return locked, err
+}
+
 // isOtpValid checks the actual otp sent against the expected otp and ensures that it's within the valid window
 func isOtpValid(actual, expected string, sentAt *time.Time, otpExp uint) bool {
 	if expected == "" || sentAt == nil {
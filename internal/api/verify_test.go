@@ -284,6 +284,139 @@ func (ts *VerifyTestSuite) TestExpiredConfirmationToken() {
 	assert.Equal(ts.T(), "unauthorized_client", f.Get("error"))
 }
 
+func (ts *VerifyTestSuite) TestVerifyEmailChangeConfirmationModes() {
+	secureEmailChangeEnabled := ts.Config.Mailer.SecureEmailChangeEnabled
+	defer func() {
+		ts.Config.Mailer.SecureEmailChangeEnabled = secureEmailChangeEnabled
+	}()
+
+	verifyEmailChange := func(token string) *url.Values {
+		reqURL := fmt.Sprintf("http://localhost/verify?type=%s&token=%s", emailChangeVerification, token)
+		req := httptest.NewRequest(http.MethodGet, reqURL, nil)
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusSeeOther, w.Code)
+
+		rurl, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(ts.T(), err, "redirect url parse failed")
+
+		f, err := url.ParseQuery(rurl.Fragment)
+		require.NoError(ts.T(), err)
+
+		return &f
+	}
+
+	cases := []struct {
+		desc                     string
+		secureEmailChangeEnabled bool
+		// tokens are verified in order, the email only changes after
+		// the last one
+		tokens []string
+	}{
+		{
+			desc:                     "confirm new email only",
+			secureEmailChangeEnabled: false,
+			tokens:                   []string{"new_email_change_token"},
+		},
+		{
+			desc:                     "confirm both emails",
+			secureEmailChangeEnabled: true,
+			tokens:                   []string{"current_email_change_token", "new_email_change_token"},
+		},
+		{
+			desc:                     "confirm both emails, new email first",
+			secureEmailChangeEnabled: true,
+			tokens:                   []string{"new_email_change_token", "current_email_change_token"},
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			ts.Config.Mailer.SecureEmailChangeEnabled = c.secureEmailChangeEnabled
+
+			u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+			require.NoError(ts.T(), err)
+
+			now := time.Now()
+			u.EmailChange = "new@example.com"
+			u.EmailChangeTokenCurrent = "current_email_change_token"
+			u.EmailChangeTokenNew = "new_email_change_token"
+			u.EmailChangeSentAt = &now
+			u.EmailChangeConfirmStatus = zeroConfirmation
+			require.NoError(ts.T(), ts.API.db.Update(u))
+
+			for i, token := range c.tokens {
+				f := verifyEmailChange(token)
+				require.Empty(ts.T(), f.Get("error"))
+
+				last := i == len(c.tokens)-1
+				if !last {
+					require.NotEmpty(ts.T(), f.Get("message"))
+
+					u, err = models.FindUserByID(ts.API.db, u.ID)
+					require.NoError(ts.T(), err)
+					require.Equal(ts.T(), "test@example.com", u.GetEmail())
+					require.Equal(ts.T(), singleConfirmation, u.EmailChangeConfirmStatus)
+				} else {
+					require.NotEmpty(ts.T(), f.Get("access_token"))
+				}
+			}
+
+			u, err = models.FindUserByID(ts.API.db, u.ID)
+			require.NoError(ts.T(), err)
+			require.Equal(ts.T(), "new@example.com", u.GetEmail())
+			require.Empty(ts.T(), u.EmailChange)
+			require.Equal(ts.T(), zeroConfirmation, u.EmailChangeConfirmStatus)
+
+			// restore the email for the next case
+			require.NoError(ts.T(), u.SetEmail(ts.API.db, "test@example.com"))
+		})
+	}
+}
+
+func (ts *VerifyTestSuite) TestExpiredEmailChangeToken() {
+	secureEmailChangeEnabled := ts.Config.Mailer.SecureEmailChangeEnabled
+	defer func() {
+		ts.Config.Mailer.SecureEmailChangeEnabled = secureEmailChangeEnabled
+	}()
+
+	for _, enabled := range []bool{false, true} {
+		ts.Config.Mailer.SecureEmailChangeEnabled = enabled
+
+		u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+		require.NoError(ts.T(), err)
+
+		sentTime := time.Now().Add(-48 * time.Hour)
+		u.EmailChange = "new@example.com"
+		u.EmailChangeTokenCurrent = "current_email_change_token"
+		u.EmailChangeTokenNew = "new_email_change_token"
+		u.EmailChangeSentAt = &sentTime
+		u.EmailChangeConfirmStatus = zeroConfirmation
+		require.NoError(ts.T(), ts.API.db.Update(u))
+
+		reqURL := fmt.Sprintf("http://localhost/verify?type=%s&token=%s", emailChangeVerification, u.EmailChangeTokenNew)
+		req := httptest.NewRequest(http.MethodGet, reqURL, nil)
+
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusSeeOther, w.Code)
+
+		rurl, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(ts.T(), err, "redirect url parse failed")
+
+		f, err := url.ParseQuery(rurl.Fragment)
+		require.NoError(ts.T(), err)
+		assert.Equal(ts.T(), "401", f.Get("error_code"))
+		assert.Equal(ts.T(), "Email link is invalid or has expired", f.Get("error_description"))
+
+		u, err = models.FindUserByID(ts.API.db, u.ID)
+		require.NoError(ts.T(), err)
+		require.Equal(ts.T(), "test@example.com", u.GetEmail())
+		require.Equal(ts.T(), zeroConfirmation, u.EmailChangeConfirmStatus)
+	}
+}
+
 func (ts *VerifyTestSuite) TestInvalidOtp() {
 	u, err := models.FindUserByPhoneAndAudience(ts.API.db, "12345678", ts.Config.JWT.Aud)
 	require.NoError(ts.T(), err)
@@ -934,6 +1067,122 @@ func (ts *VerifyTestSuite) TestVerifyValidOtp() {
 	}
 }
 
+func (ts *VerifyTestSuite) verifyEmailOtp(email, otp string) *httptest.ResponseRecorder {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"type":  emailOTPVerification,
+		"email": email,
+		"token": otp,
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/verify", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	return w
+}
+
+func (ts *VerifyTestSuite) TestVerifyEmailOtpCode() {
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	defer func(mode string, maxAttempts int) {
+		ts.Config.Mailer.OTPMode = mode
+		ts.Config.Mailer.OtpMaxAttempts = maxAttempts
+	}(ts.Config.Mailer.OTPMode, ts.Config.Mailer.OtpMaxAttempts)
+	ts.Config.Mailer.OtpMaxAttempts = 3
+
+	setOtp := func(otp string, sentAt time.Time) {
+		u.RecoveryToken = crypto.GenerateTokenHash(u.GetEmail(), otp)
+		u.RecoverySentAt = &sentAt
+		u.EmailOtpAttempts = 0
+		require.NoError(ts.T(), ts.API.db.Update(u))
+	}
+
+	ts.Run("Code is disabled in link mode", func() {
+		ts.Config.Mailer.OTPMode = conf.EmailOTPModeLink
+		setOtp("123456", time.Now())
+
+		w := ts.verifyEmailOtp(u.GetEmail(), "123456")
+		assert.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	})
+
+	ts.Config.Mailer.OTPMode = conf.EmailOTPModeCode
+
+	ts.Run("Expired code", func() {
+		setOtp("123456", time.Now().Add(-time.Duration(ts.Config.Mailer.OtpExp+1)*time.Second))
+
+		w := ts.verifyEmailOtp(u.GetEmail(), "123456")
+		assert.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+	})
+
+	ts.Run("Lockout after too many failed attempts", func() {
+		setOtp("123456", time.Now())
+
+		for i := 1; i < ts.Config.Mailer.OtpMaxAttempts; i++ {
+			w := ts.verifyEmailOtp(u.GetEmail(), "654321")
+			assert.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+			user, err := models.FindUserByID(ts.API.db, u.ID)
+			require.NoError(ts.T(), err)
+			assert.Equal(ts.T(), i, user.EmailOtpAttempts)
+		}
+
+		w := ts.verifyEmailOtp(u.GetEmail(), "654321")
+		assert.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+
+		// the code has been invalidated and a new one has to be requested
+		w = ts.verifyEmailOtp(u.GetEmail(), "123456")
+		assert.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+		user, err := models.FindUserByID(ts.API.db, u.ID)
+		require.NoError(ts.T(), err)
+		assert.Empty(ts.T(), user.RecoveryToken)
+	})
+
+	ts.Run("Valid code issues a session", func() {
+		setOtp("123456", time.Now())
+
+		w := ts.verifyEmailOtp(u.GetEmail(), "654321")
+		assert.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+		w = ts.verifyEmailOtp(u.GetEmail(), "123456")
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		token := &AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(token))
+		assert.NotEmpty(ts.T(), token.Token)
+		assert.NotEmpty(ts.T(), token.RefreshToken)
+		assert.Equal(ts.T(), u.ID, token.User.ID)
+	})
+}
+
+func (ts *VerifyTestSuite) TestSendingEmailOtpResetsAttempts() {
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+	u.EmailOtpAttempts = 2
+	u.RecoverySentAt = &time.Time{}
+	require.NoError(ts.T(), ts.API.db.Update(u))
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"email": u.GetEmail(),
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/magiclink", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	user, err := models.FindUserByID(ts.API.db, u.ID)
+	require.NoError(ts.T(), err)
+	assert.NotEmpty(ts.T(), user.RecoveryToken)
+	assert.Equal(ts.T(), 0, user.EmailOtpAttempts)
+}
+
 func (ts *VerifyTestSuite) TestSecureEmailChangeWithTokenHash() {
 	ts.Config.Mailer.SecureEmailChangeEnabled = true
 	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
@@ -1178,7 +1427,7 @@ func (ts *VerifyTestSuite) TestVerifyValidateParams() {
 	for _, c := range cases {
 		ts.Run(c.desc, func() {
 			req := httptest.NewRequest(c.method, "http://localhost", nil)
-			err := c.params.Validate(req)
+			err := c.params.Validate(req, ts.Config)
 			require.Equal(ts.T(), c.expected, err)
 		})
 	}
@@ -2,10 +2,21 @@ package conf
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"text/template"
 	"time"
@@ -18,6 +29,9 @@ import (
 const defaultMinPasswordLength int = 6
 const defaultChallengeExpiryDuration float64 = 300
 const defaultFlowStateExpiryDuration time.Duration = 300 * time.Second
+const defaultStepUpMaxAge time.Duration = 10 * time.Minute
+
+var regionCodePattern = regexp.MustCompile("^[A-Z]{2}$")
 
 // Time is used to represent timestamps in the configuration, as envconfig has
 // trouble parsing empty strings, due to time.Time.UnmarshalText().
@@ -48,8 +62,100 @@ type OAuthProviderConfiguration struct {
 	ApiURL         string   `json:"api_url" split_words:"true"`
 	Enabled        bool     `json:"enabled"`
 	SkipNonceCheck bool     `json:"skip_nonce_check" split_words:"true"`
+	// WebClientID lists additional client IDs, e.g. of web apps, whose ID
+	// tokens are accepted by the id_token grant.
+	WebClientID []string `json:"web_client_id" split_words:"true"`
+	// RequireAccessToken rejects ID tokens with an at_hash claim unless
+	// a matching access token is provided alongside them.
+	RequireAccessToken bool `json:"require_access_token" split_words:"true"`
+	// Tenant pins the Azure tenant whose ID tokens are accepted. Only
+	// used by the azure provider.
+	Tenant string `json:"tenant"`
+	// ServicesID lists the Services IDs of web apps, whose ID tokens are
+	// accepted by the id_token grant in addition to those issued to the
+	// App IDs of native apps. Only used by the apple provider.
+	ServicesID []string `json:"services_id" split_words:"true"`
+	// Issuer and JWKSURL allow verifying ID tokens with keys fetched
+	// from JWKSURL instead of using OIDC discovery, while still requiring
+	// the tokens to be issued by Issuer. Only used by the keycloak
+	// provider.
+	Issuer  string `json:"issuer"`
+	JWKSURL string `json:"jwks_url" envconfig:"JWKS_URL"`
+	// ClaimsMapping maps (dotted) ID token claim paths to the user
+	// metadata keys their values are copied to.
+	ClaimsMapping ClaimsMapping `json:"claims_mapping" split_words:"true"`
+	// AllowAuthorizedParty accepts ID tokens whose authorized party (azp
+	// claim) is the client ID even if it's not in the audience. This is
+	// always allowed for Google.
+	AllowAuthorizedParty bool `json:"allow_authorized_party" split_words:"true"`
+	// AllowedEmailDomains and BlockedEmailDomains restrict the email
+	// domains of the users that can sign in with the provider. Domains
+	// starting with "*." match all subdomains of the domain.
+	AllowedEmailDomains []string `json:"allowed_email_domains" split_words:"true"`
+	BlockedEmailDomains []string `json:"blocked_email_domains" split_words:"true"`
+	// NonceHashing is how the nonce passed to the id_token grant is
+	// expected to be stored in the nonce claim of ID tokens, either
+	// NonceHashingSHA256 (the default) or NonceHashingPlain.
+	NonceHashing string `json:"nonce_hashing" split_words:"true"`
+	// ClockSkewTolerance overrides the clock skew tolerance of
+	// ProviderConfiguration for the provider's ID tokens, if set.
+	ClockSkewTolerance time.Duration `json:"clock_skew_tolerance" split_words:"true"`
+	// Scopes are requested from the provider on every authorization, in
+	// addition to the provider's default scopes.
+	Scopes []string `json:"scopes"`
+	// AllowedScopes restricts the scopes that can be requested with the
+	// scopes parameter of /authorize. Any scope is allowed if empty.
+	AllowedScopes []string `json:"allowed_scopes" split_words:"true"`
+	// RequiredACR and RequiredAMR require the ID tokens of the provider to
+	// report that the user authenticated with sufficient assurance: the acr
+	// claim must be one of RequiredACR, and the amr claim must contain all
+	// of RequiredAMR.
+	RequiredACR []string `json:"required_acr" split_words:"true"`
+	RequiredAMR []string `json:"required_amr" split_words:"true"`
+	// AllowEmptyEmail allows signing in with identities of the provider
+	// that have no email address. Their users have no email address either
+	// and are only identified by the identity's subject.
+	AllowEmptyEmail bool `json:"allow_empty_email" split_words:"true"`
+}
+
+// IsAllowedScope reports whether the scope may be requested with the scopes
+// parameter of /authorize.
+func (o *OAuthProviderConfiguration) IsAllowedScope(scope string) bool {
+	if len(o.AllowedScopes) == 0 {
+		return true
+	}
+
+	for _, allowed := range o.AllowedScopes {
+		if scope == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClaimsMapping is configured as a JSON object, as claim names can be URLs
+// and contain the separators of envconfig maps.
+type ClaimsMapping map[string]string
+
+// Decode implements envconfig.Decoder
+func (m *ClaimsMapping) Decode(value string) error {
+	if err := json.Unmarshal([]byte(value), m); err != nil {
+		return fmt.Errorf("claims mapping not a JSON object of claims to metadata keys: %w", err)
+	}
+
+	return nil
 }
 
+const (
+	// NonceHashingSHA256 expects the nonce claim of ID tokens to be the
+	// hex-encoded SHA-256 hash of the nonce.
+	NonceHashingSHA256 = "sha256"
+	// NonceHashingPlain expects the nonce claim of ID tokens to be the
+	// nonce itself.
+	NonceHashingPlain = "plain"
+)
+
 type EmailProviderConfiguration struct {
 	Enabled bool `json:"enabled" default:"true"`
 }
@@ -83,6 +189,33 @@ type JWTConfiguration struct {
 	DefaultGroupName string   `json:"default_group_name" split_words:"true"`
 	Issuer           string   `json:"issuer"`
 	KeyID            string   `json:"key_id" split_words:"true"`
+
+	// Algorithm signs access tokens, either HS256 with the secret or
+	// EdDSA with the private key.
+	Algorithm  string `json:"algorithm"`
+	PrivateKey string `json:"-" split_words:"true"`
+
+	SigningKey ed25519.PrivateKey `json:"-" ignored:"true"`
+
+	// RetiredKeys are the public keys of previous signing keys, which
+	// still verify access tokens during the rotation.
+	RetiredKeys JWTRetiredKeys `json:"-" split_words:"true"`
+
+	// AllowedAudiences are the audiences, besides Aud, that requests may
+	// select. Any audience may be selected if none are configured.
+	AllowedAudiences []string `json:"allowed_audiences" split_words:"true"`
+
+	// AudienceIssuers overrides Issuer for access tokens of an audience.
+	AudienceIssuers map[string]string `json:"audience_issuers" split_words:"true"`
+
+	// ExpiryByGrant overrides Exp, in seconds, for the sessions created
+	// by an authentication method, such as password or oauth.
+	ExpiryByGrant map[string]int `json:"expiry_by_grant" split_words:"true"`
+
+	// RoleAppMetadataKey is the key of the app_metadata whose value is used
+	// as the role claim of access tokens. Only app_metadata can be used, as
+	// users can change their user_metadata themselves.
+	RoleAppMetadataKey string `json:"role_app_metadata_key" split_words:"true"`
 }
 
 // MFAConfiguration holds all the MFA related Configuration
@@ -92,6 +225,28 @@ type MFAConfiguration struct {
 	RateLimitChallengeAndVerify float64 `split_words:"true" default:"15"`
 	MaxEnrolledFactors          float64 `split_words:"true" default:"10"`
 	MaxVerifiedFactors          int     `split_words:"true" default:"10"`
+	RecoveryCodesCount          int     `split_words:"true" default:"10"`
+
+	WebAuthn WebAuthnConfiguration  `json:"web_authn" split_words:"true"`
+	StepUp   MFAStepUpConfiguration `json:"step_up" split_words:"true"`
+}
+
+// MFAStepUpConfiguration lists the sensitive operations that require users
+// with a verified factor to have completed an MFA challenge in the current
+// session within MaxAge.
+type MFAStepUpConfiguration struct {
+	PasswordUpdate   bool          `json:"password_update" split_words:"true"`
+	FactorManagement bool          `json:"factor_management" split_words:"true"`
+	MaxAge           time.Duration `json:"max_age" split_words:"true" default:"10m"`
+}
+
+// WebAuthnConfiguration holds the relying party configuration of webauthn
+// factors. The relying party ID and origins default to the site URL.
+type WebAuthnConfiguration struct {
+	Enabled       bool     `json:"enabled" default:"false"`
+	RPID          string   `json:"rp_id" envconfig:"RP_ID"`
+	RPDisplayName string   `json:"rp_display_name" split_words:"true"`
+	RPOrigins     []string `json:"rp_origins" split_words:"true"`
 }
 
 type APIConfiguration struct {
@@ -100,6 +255,9 @@ type APIConfiguration struct {
 	Endpoint        string
 	RequestIDHeader string `envconfig:"REQUEST_ID_HEADER"`
 	ExternalURL     string `json:"external_url" envconfig:"API_EXTERNAL_URL" required:"true"`
+	// MaxRequestBodySize is the largest request body, in bytes, that is
+	// accepted outside of the admin API. Zero disables the limit.
+	MaxRequestBodySize int64 `json:"max_request_body_size" split_words:"true" default:"1048576"`
 }
 
 func (a *APIConfiguration) Validate() error {
@@ -113,40 +271,272 @@ func (a *APIConfiguration) Validate() error {
 
 // GlobalConfiguration holds all the configuration that applies to all instances.
 type GlobalConfiguration struct {
-	API                   APIConfiguration
-	DB                    DBConfiguration
-	External              ProviderConfiguration
-	Logging               LoggingConfig  `envconfig:"LOG"`
-	Profiler              ProfilerConfig `envconfig:"PROFILER"`
-	OperatorToken         string         `split_words:"true" required:"false"`
-	Tracing               TracingConfig
-	Metrics               MetricsConfig
-	SMTP                  SMTPConfiguration
-	RateLimitHeader       string  `split_words:"true"`
-	RateLimitEmailSent    float64 `split_words:"true" default:"30"`
-	RateLimitSmsSent      float64 `split_words:"true" default:"30"`
-	RateLimitVerify       float64 `split_words:"true" default:"30"`
-	RateLimitTokenRefresh float64 `split_words:"true" default:"30"`
-	RateLimitSso          float64 `split_words:"true" default:"30"`
+	API                        APIConfiguration
+	DB                         DBConfiguration
+	External                   ProviderConfiguration
+	Logging                    LoggingConfig  `envconfig:"LOG"`
+	Profiler                   ProfilerConfig `envconfig:"PROFILER"`
+	OperatorToken              string         `split_words:"true" required:"false"`
+	Debug                      bool           `json:"debug"`
+	Tracing                    TracingConfig
+	Metrics                    MetricsConfig
+	SMTP                       SMTPConfiguration
+	RateLimitHeader            string  `split_words:"true"`
+	RateLimitEmailSent         float64 `split_words:"true" default:"30"`
+	RateLimitEmailPerRecipient float64 `split_words:"true" default:"5"`
+	RateLimitSmsSent           float64 `split_words:"true" default:"30"`
+	RateLimitWhatsappSent      float64 `split_words:"true" default:"30"`
+	RateLimitVerify            float64 `split_words:"true" default:"30"`
+	RateLimitTokenRefresh      float64 `split_words:"true" default:"30"`
+	RateLimitSso               float64 `split_words:"true" default:"30"`
+	RateLimitIdTokenGrant      float64 `split_words:"true" default:"30"`
 
 	SiteURL           string   `json:"site_url" split_words:"true" required:"true"`
 	URIAllowList      []string `json:"uri_allow_list" split_words:"true"`
 	URIAllowListMap   map[string]glob.Glob
-	PasswordMinLength int                      `json:"password_min_length" split_words:"true"`
-	JWT               JWTConfiguration         `json:"jwt"`
-	Mailer            MailerConfiguration      `json:"mailer"`
-	Sms               SmsProviderConfiguration `json:"sms"`
-	DisableSignup     bool                     `json:"disable_signup" split_words:"true"`
-	Webhook           WebhookConfig            `json:"webhook" split_words:"true"`
-	Security          SecurityConfiguration    `json:"security"`
-	MFA               MFAConfiguration         `json:"MFA"`
-	Cookie            struct {
-		Key      string `json:"key"`
-		Domain   string `json:"domain"`
-		Duration int    `json:"duration"`
-	} `json:"cookies"`
-	SAML SAMLConfiguration `json:"saml"`
-	CORS CORSConfiguration `json:"cors"`
+	PasswordMinLength int                       `json:"password_min_length" split_words:"true"`
+	JWT               JWTConfiguration          `json:"jwt"`
+	Mailer            MailerConfiguration       `json:"mailer"`
+	Sms               SmsProviderConfiguration  `json:"sms"`
+	Localization      LocalizationConfiguration `json:"localization"`
+	DisableSignup     bool                      `json:"disable_signup" split_words:"true"`
+	InviteOnly        bool                      `json:"invite_only" split_words:"true"`
+	Webhook           WebhookConfig             `json:"webhook" split_words:"true"`
+	Hook              HookConfiguration         `json:"hook"`
+	Security          SecurityConfiguration     `json:"security"`
+	MFA               MFAConfiguration          `json:"MFA"`
+	Cookie            CookieConfiguration       `json:"cookies"`
+	SAML              SAMLConfiguration         `json:"saml"`
+	CORS              CORSConfiguration         `json:"cors"`
+	Sessions          SessionsConfiguration     `json:"sessions"`
+
+	Impersonation ImpersonationConfiguration `json:"impersonation"`
+	AuditLog      AuditLogConfiguration      `json:"audit_log" split_words:"true"`
+	Introspection IntrospectionConfiguration `json:"introspection"`
+}
+
+// Audit log sinks.
+const (
+	AuditLogSinkDatabase = "database"
+	AuditLogSinkFile     = "file"
+	AuditLogSinkHTTP     = "http"
+)
+
+// AuditLogConfiguration selects the sinks audit log entries are written to.
+type AuditLogConfiguration struct {
+	Sinks []string `json:"sinks" default:"database"`
+
+	File AuditLogFileConfiguration `json:"file"`
+	HTTP AuditLogHTTPConfiguration `json:"http"`
+}
+
+// AuditLogFileConfiguration is the file audit log entries are appended to as
+// JSON lines.
+type AuditLogFileConfiguration struct {
+	Path string `json:"path"`
+}
+
+// AuditLogHTTPConfiguration is the URL audit log entries are posted to as
+// JSON. Entries are posted in the background, and dropped if more than
+// BufferSize entries are waiting to be posted.
+type AuditLogHTTPConfiguration struct {
+	URL        string            `json:"url"`
+	Headers    map[string]string `json:"headers"`
+	BufferSize int               `json:"buffer_size" split_words:"true" default:"1000"`
+	Timeout    time.Duration     `json:"timeout" default:"10s"`
+}
+
+func (c *AuditLogConfiguration) Validate() error {
+	for _, sink := range c.Sinks {
+		switch sink {
+		case AuditLogSinkDatabase:
+		case AuditLogSinkFile:
+			if c.File.Path == "" {
+				return errors.New("audit log file path is required for the file sink")
+			}
+		case AuditLogSinkHTTP:
+			if c.HTTP.URL == "" {
+				return errors.New("audit log HTTP URL is required for the http sink")
+			}
+			if c.HTTP.BufferSize <= 0 {
+				return errors.New("audit log HTTP buffer size must be positive")
+			}
+		default:
+			return fmt.Errorf("unsupported audit log sink %q", sink)
+		}
+	}
+
+	return nil
+}
+
+// ImpersonationConfiguration controls the short-lived access tokens admins
+// can issue for users to reproduce their state.
+type ImpersonationConfiguration struct {
+	Enabled bool `json:"enabled"`
+
+	// Roles are the admin roles allowed to impersonate users.
+	Roles []string `json:"roles" default:"supabase_admin"`
+
+	// Exp is the lifetime of impersonation access tokens.
+	Exp time.Duration `json:"exp" default:"5m"`
+}
+
+func (c *ImpersonationConfiguration) Validate() error {
+	if c.Enabled && (c.Exp <= 0 || c.Exp > time.Hour) {
+		return errors.New("impersonation exp must be positive and at most an hour")
+	}
+	return nil
+}
+
+// IntrospectionConfiguration controls the token introspection endpoint, which
+// resource servers call with the credentials of one of the Clients.
+type IntrospectionConfiguration struct {
+	Enabled bool `json:"enabled"`
+
+	// Clients maps the client IDs of resource servers to their secrets.
+	Clients map[string]string `json:"-"`
+}
+
+func (c *IntrospectionConfiguration) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if len(c.Clients) == 0 {
+		return errors.New("introspection requires at least one client")
+	}
+
+	for clientID, secret := range c.Clients {
+		if clientID == "" || secret == "" {
+			return errors.New("introspection client IDs and secrets must not be empty")
+		}
+	}
+
+	return nil
+}
+
+// Cookie SameSite modes.
+const (
+	CookieSameSiteLax    = "lax"
+	CookieSameSiteStrict = "strict"
+	CookieSameSiteNone   = "none"
+)
+
+// CookieConfiguration holds the cookies the access and refresh tokens of
+// successful grants are set in, named Key followed by -access-token and
+// -refresh-token.
+type CookieConfiguration struct {
+	Key      string `json:"key"`
+	Domain   string `json:"domain"`
+	Duration int    `json:"duration"`
+	SameSite string `json:"same_site" split_words:"true" default:"lax"`
+
+	// Authenticate accepts the access token cookie on authenticated
+	// endpoints, for requests without an Authorization header.
+	Authenticate bool `json:"authenticate"`
+}
+
+func (c *CookieConfiguration) Validate() error {
+	switch c.SameSite {
+	case "", CookieSameSiteLax, CookieSameSiteStrict:
+		return nil
+
+	case CookieSameSiteNone:
+		if c.Authenticate {
+			// cross-site requests would be authenticated by the
+			// cookie, allowing cross-site request forgery
+			return errors.New("cookie same site mode none can't be used with cookie authentication")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported cookie same site mode %q, must be %s, %s or %s", c.SameSite, CookieSameSiteLax, CookieSameSiteStrict, CookieSameSiteNone)
+}
+
+// SameSiteMode returns the SameSite attribute of the cookies.
+func (c *CookieConfiguration) SameSiteMode() http.SameSite {
+	switch c.SameSite {
+	case CookieSameSiteStrict:
+		return http.SameSiteStrictMode
+	case CookieSameSiteNone:
+		return http.SameSiteNoneMode
+	}
+
+	return http.SameSiteLaxMode
+}
+
+// SessionsConfiguration holds the lifetime limits of sessions. Zero values
+// disable the respective limit.
+type SessionsConfiguration struct {
+	// Timebox is the absolute lifetime of a session, regardless of
+	// refresh activity.
+	Timebox time.Duration `json:"timebox"`
+
+	// InactivityTimeout is how long a session can go without being
+	// refreshed before it expires.
+	InactivityTimeout time.Duration `json:"inactivity_timeout" split_words:"true"`
+
+	// RefreshTokenReuseInterval is how long after it was rotated a refresh
+	// token can be used again, returning the refresh token it was rotated
+	// to, before its use is considered a reuse attempt.
+	RefreshTokenReuseInterval time.Duration `json:"refresh_token_reuse_interval" split_words:"true" default:"10s"`
+
+	// AllowAccessTokenOnlyFallback issues an access token without a
+	// refresh token if the session fails to be persisted due to a
+	// transient database error, instead of failing the grant.
+	AllowAccessTokenOnlyFallback bool `json:"allow_access_token_only_fallback" split_words:"true"`
+
+	// IntrospectionEnabled enables the session endpoint, which reports
+	// whether the session of an access token is still valid.
+	IntrospectionEnabled bool `json:"introspection_enabled" split_words:"true"`
+
+	// IntrospectionFields are the fields of the session the session
+	// endpoint reports besides its ID, out of SessionIntrospectionFields.
+	IntrospectionFields []string `json:"introspection_fields" split_words:"true" default:"user_id,aal,not_after"`
+}
+
+// SessionIntrospectionFields are the fields of a session that the session
+// endpoint can report.
+var SessionIntrospectionFields = []string{"user_id", "aal", "not_after"}
+
+// IsIntrospectionField reports whether the session endpoint reports the
+// field.
+func (c *SessionsConfiguration) IsIntrospectionField(field string) bool {
+	for _, f := range c.IntrospectionFields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *SessionsConfiguration) Validate() error {
+	if c.Timebox < 0 {
+		return errors.New("sessions timebox must not be negative")
+	}
+	if c.InactivityTimeout < 0 {
+		return errors.New("sessions inactivity timeout must not be negative")
+	}
+	if c.RefreshTokenReuseInterval < 0 {
+		return errors.New("sessions refresh token reuse interval must not be negative")
+	}
+	for _, field := range c.IntrospectionFields {
+		if !isSessionIntrospectionField(field) {
+			return fmt.Errorf("unsupported sessions introspection field %q", field)
+		}
+	}
+	return nil
+}
+
+func isSessionIntrospectionField(field string) bool {
+	for _, f := range SessionIntrospectionFields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
 }
 
 type CORSConfiguration struct {
@@ -208,9 +598,337 @@ type ProviderConfiguration struct {
 	Phone                   PhoneProviderConfiguration `json:"phone"`
 	Zoom                    OAuthProviderConfiguration `json:"zoom"`
 	IosBundleId             string                     `json:"ios_bundle_id" split_words:"true"`
+	AndroidPackageName      string                     `json:"android_package_name" split_words:"true"`
 	RedirectURL             string                     `json:"redirect_url"`
 	AllowedIdTokenIssuers   []string                   `json:"allowed_id_token_issuers" split_words:"true"`
 	FlowStateExpiryDuration time.Duration              `json:"flow_state_expiry_duration" split_words:"true"`
+	OIDCProviderCacheTTL    time.Duration              `json:"oidc_provider_cache_ttl" envconfig:"OIDC_PROVIDER_CACHE_TTL" default:"10m"`
+
+	// ClockSkewTolerance is how far the current time may be past the exp
+	// claim, or before the iat claim, of ID tokens passed to the
+	// id_token grant.
+	ClockSkewTolerance time.Duration `json:"clock_skew_tolerance" split_words:"true" default:"30s"`
+
+	// DisableArbitraryIssuers rejects id_token grant requests that don't
+	// match a named provider, even if their issuer is in
+	// AllowedIdTokenIssuers.
+	DisableArbitraryIssuers bool `json:"disable_arbitrary_issuers" split_words:"true"`
+
+	// InferIdTokenSigningAlgorithm accepts ID tokens passed to the
+	// id_token grant that are signed with an asymmetric algorithm named in
+	// their header, for providers whose keys don't declare an algorithm.
+	InferIdTokenSigningAlgorithm bool `json:"infer_id_token_signing_algorithm" split_words:"true"`
+
+	// DisableIdTokenClaimsStorage prevents storing the verified ID token
+	// claims in the identity data of external identities.
+	DisableIdTokenClaimsStorage bool `json:"disable_id_token_claims_storage" split_words:"true"`
+
+	// ExposeProviderClaims includes the stored ID token claims of each
+	// identity in the provider_claims of the user endpoint, limited to the
+	// claims in ProviderClaimsAllowList.
+	ExposeProviderClaims    bool     `json:"expose_provider_claims" split_words:"true"`
+	ProviderClaimsAllowList []string `json:"provider_claims_allow_list" split_words:"true" default:"iss,sub,email,email_verified,name,given_name,family_name,picture,locale,hd"`
+
+	// ProviderTokenEncryptionKey is the Base64 encoded AES-256 key that
+	// encrypts the provider refresh tokens stored on identities. Provider
+	// refresh tokens are only stored if it's set.
+	ProviderTokenEncryptionKey string `json:"-" split_words:"true"`
+
+	// ReadinessCheck makes the readiness endpoint also check that the
+	// OIDC discovery documents of the enabled providers are reachable.
+	ReadinessCheck bool `json:"readiness_check" split_words:"true"`
+
+	// AnonymousUsers allows creating users without any credentials via
+	// the anonymous grant.
+	AnonymousUsers AnonymousProviderConfiguration `json:"anonymous_users" split_words:"true"`
+
+	// AccountLinkingStrategy decides whether external identities are
+	// linked to existing users with the same email address.
+	AccountLinkingStrategy string `json:"account_linking_strategy" split_words:"true" default:"automatic"`
+
+	// MaxIdentitiesPerUser limits the number of identities that can be
+	// linked to a user. Zero means no limit.
+	MaxIdentitiesPerUser int `json:"max_identities_per_user" split_words:"true"`
+
+	// ProvidersDirectory is a directory of files defining additional OIDC
+	// providers, which is reloaded every ProvidersDirectoryInterval.
+	ProvidersDirectory         string        `json:"providers_directory" split_words:"true"`
+	ProvidersDirectoryInterval time.Duration `json:"providers_directory_interval" split_words:"true" default:"10s"`
+
+	// OIDCProviders holds the providers loaded from ProvidersDirectory, if
+	// set.
+	OIDCProviders *OIDCProviderDirectory `json:"-" ignored:"true"`
+
+	// RequireVerifiedEmail rejects sign ins with external identities whose
+	// email address isn't verified by the provider, even if the user has
+	// already been confirmed.
+	RequireVerifiedEmail bool `json:"require_verified_email" split_words:"true"`
+
+	// Avatars stores copies of the profile pictures of external
+	// identities and puts their URLs in the user metadata instead.
+	Avatars AvatarsConfiguration `json:"avatars"`
+
+	// TLS holds the TLS requirements of OIDC discovery and JWKS requests.
+	TLS ProviderTLSConfiguration `json:"tls"`
+
+	// DiscoveryRetry holds how failing OIDC discovery and JWKS requests
+	// are retried.
+	DiscoveryRetry ProviderRetryConfiguration `json:"discovery_retry" split_words:"true"`
+}
+
+// ProviderRetryConfiguration holds how OIDC discovery and JWKS requests that
+// fail with a network error or a server error are retried. Requests are
+// attempted up to MaxAttempts times, waiting a jittered and exponentially
+// growing multiple of Backoff in between, and give up once Timeout has passed
+// since the first attempt. Zero values mean a single attempt, no wait and no
+// timeout respectively.
+type ProviderRetryConfiguration struct {
+	MaxAttempts int           `json:"max_attempts" split_words:"true" default:"3"`
+	Backoff     time.Duration `json:"backoff" default:"200ms"`
+	Timeout     time.Duration `json:"timeout" default:"10s"`
+}
+
+func (c *ProviderRetryConfiguration) Validate() error {
+	if c.MaxAttempts < 0 || c.Backoff < 0 || c.Timeout < 0 {
+		return errors.New("external discovery retry max attempts, backoff and timeout must not be negative")
+	}
+
+	return nil
+}
+
+// ProviderTLSConfiguration holds the minimum TLS version of OIDC discovery and
+// JWKS requests and, optionally, the public keys servers must present. A
+// server is accepted if any certificate of its verified chain has one of the
+// PinnedPublicKeys, which are Base64 encoded SHA-256 hashes of the
+// certificates' DER encoded SubjectPublicKeyInfo.
+type ProviderTLSConfiguration struct {
+	MinVersion       string   `json:"min_version" split_words:"true" default:"1.2"`
+	PinnedPublicKeys []string `json:"pinned_public_keys" split_words:"true"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c *ProviderTLSConfiguration) Validate() error {
+	if _, err := c.TLSMinVersion(); err != nil {
+		return err
+	}
+
+	_, err := c.PublicKeyPins()
+	return err
+}
+
+// TLSMinVersion returns the minimum TLS version, TLS 1.2 if it's not set.
+func (c *ProviderTLSConfiguration) TLSMinVersion() (uint16, error) {
+	if c.MinVersion == "" {
+		return tls.VersionTLS12, nil
+	}
+
+	version, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return 0, fmt.Errorf("unsupported external TLS min version %q, must be 1.0, 1.1, 1.2 or 1.3", c.MinVersion)
+	}
+
+	return version, nil
+}
+
+// PublicKeyPins returns the decoded PinnedPublicKeys.
+func (c *ProviderTLSConfiguration) PublicKeyPins() ([][sha256.Size]byte, error) {
+	var pins [][sha256.Size]byte
+
+	for _, pinnedPublicKey := range c.PinnedPublicKeys {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pinnedPublicKey), "sha256/"))
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("external TLS pinned public key %q is not a Base64 encoded SHA-256 hash", pinnedPublicKey)
+		}
+
+		var pin [sha256.Size]byte
+		copy(pin[:], decoded)
+		pins = append(pins, pin)
+	}
+
+	return pins, nil
+}
+
+// AvatarsConfiguration configures fetching the profile pictures of external
+// identities. Pictures larger than MaxSize bytes, or that can't be fetched
+// within Timeout, aren't stored.
+type AvatarsConfiguration struct {
+	Enabled bool          `json:"enabled"`
+	MaxSize int64         `json:"max_size" split_words:"true" default:"1048576"`
+	Timeout time.Duration `json:"timeout" default:"5s"`
+}
+
+const (
+	// AccountLinkingAutomatic links external identities with a verified
+	// email address to the existing user with that email address.
+	AccountLinkingAutomatic = "automatic"
+	// AccountLinkingManual never links external identities to existing
+	// users, which have to link them while signed in instead.
+	AccountLinkingManual = "manual"
+	// AccountLinkingVerifiedOnly links external identities only if both
+	// the identity's and the existing user's email address are verified.
+	AccountLinkingVerifiedOnly = "verified-only"
+)
+
+// OAuthProvider returns the configuration of the external OAuth provider with
+// the provided name, or nil if there is no such provider.
+func (c *ProviderConfiguration) OAuthProvider(name string) *OAuthProviderConfiguration {
+	if p, ok := c.oauthProviders()[name]; ok {
+		return p
+	}
+
+	if c.OIDCProviders != nil {
+		return c.OIDCProviders.Provider(name)
+	}
+
+	return nil
+}
+
+// DirectoryOIDCProvider returns the name and configuration of the provider
+// loaded from the providers directory with the name or, if no name is given,
+// with the issuer. It returns nil if there is none.
+func (c *ProviderConfiguration) DirectoryOIDCProvider(name, issuer string) (string, *OAuthProviderConfiguration) {
+	if c.OIDCProviders == nil {
+		return "", nil
+	}
+
+	if name != "" {
+		if p := c.OIDCProviders.Provider(name); p != nil {
+			return name, p
+		}
+
+		return "", nil
+	}
+
+	if issuer != "" {
+		return c.OIDCProviders.ProviderByIssuer(issuer)
+	}
+
+	return "", nil
+}
+
+// LoadOIDCProviders loads the providers of the providers directory, if one
+// is configured. Files that fail to load are reported in the returned error,
+// while the other providers are loaded regardless. OIDCProviders is only nil
+// afterwards if the directory can't be read.
+func (c *ProviderConfiguration) LoadOIDCProviders() error {
+	if c.ProvidersDirectory == "" {
+		return nil
+	}
+
+	providers, err := LoadOIDCProviderDirectory(c.ProvidersDirectory, c.oauthProviders())
+	if providers != nil {
+		c.OIDCProviders = providers
+	}
+
+	return err
+}
+
+// IdTokenClockSkewTolerance returns the clock skew tolerance for the ID tokens
+// of a provider, whose configuration is nil for arbitrary issuers.
+func (c *ProviderConfiguration) IdTokenClockSkewTolerance(p *OAuthProviderConfiguration) time.Duration {
+	if p != nil && p.ClockSkewTolerance > 0 {
+		return p.ClockSkewTolerance
+	}
+
+	return c.ClockSkewTolerance
+}
+
+func (c *ProviderConfiguration) oauthProviders() map[string]*OAuthProviderConfiguration {
+	return map[string]*OAuthProviderConfiguration{
+		"apple":         &c.Apple,
+		"azure":         &c.Azure,
+		"bitbucket":     &c.Bitbucket,
+		"discord":       &c.Discord,
+		"facebook":      &c.Facebook,
+		"figma":         &c.Figma,
+		"fly":           &c.Fly,
+		"github":        &c.Github,
+		"gitlab":        &c.Gitlab,
+		"google":        &c.Google,
+		"kakao":         &c.Kakao,
+		"keycloak":      &c.Keycloak,
+		"linkedin":      &c.Linkedin,
+		"linkedin_oidc": &c.LinkedinOIDC,
+		"notion":        &c.Notion,
+		"spotify":       &c.Spotify,
+		"slack":         &c.Slack,
+		"twitch":        &c.Twitch,
+		"twitter":       &c.Twitter,
+		"workos":        &c.WorkOS,
+		"zoom":          &c.Zoom,
+	}
+}
+
+// ProviderTokenKey decodes ProviderTokenEncryptionKey. It returns nil if no
+// key is configured.
+func (c *ProviderConfiguration) ProviderTokenKey() ([]byte, error) {
+	if c.ProviderTokenEncryptionKey == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(c.ProviderTokenEncryptionKey)
+	if err != nil {
+		return nil, errors.New("external provider token encryption key not in standard Base64 format")
+	}
+
+	if len(key) != 32 {
+		return nil, errors.New("external provider token encryption key must be 32 bytes long")
+	}
+
+	return key, nil
+}
+
+// Validate validates the configurations of the external OAuth providers.
+func (c *ProviderConfiguration) Validate() error {
+	for name, p := range c.oauthProviders() {
+		if err := p.validate(name); err != nil {
+			return err
+		}
+	}
+
+	if c.ClockSkewTolerance < 0 {
+		return errors.New("external provider clock skew tolerance must not be negative")
+	}
+
+	if c.ProviderTokenEncryptionKey != "" {
+		if _, err := c.ProviderTokenKey(); err != nil {
+			return err
+		}
+	}
+
+	switch c.AccountLinkingStrategy {
+	case "", AccountLinkingAutomatic, AccountLinkingManual, AccountLinkingVerifiedOnly:
+	default:
+		return fmt.Errorf("unsupported account linking strategy %q, must be %s, %s or %s", c.AccountLinkingStrategy, AccountLinkingAutomatic, AccountLinkingManual, AccountLinkingVerifiedOnly)
+	}
+
+	if err := c.TLS.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.DiscoveryRetry.Validate(); err != nil {
+		return err
+	}
+
+	if c.MaxIdentitiesPerUser < 0 {
+		return errors.New("external max identities per user must not be negative")
+	}
+
+	if c.Avatars.Enabled && (c.Avatars.MaxSize <= 0 || c.Avatars.Timeout <= 0) {
+		return errors.New("external avatars max size and timeout must be positive")
+	}
+
+	if c.ProvidersDirectory != "" && c.ProvidersDirectoryInterval <= 0 {
+		return errors.New("external providers directory interval must be positive")
+	}
+
+	return nil
 }
 
 type SMTPConfiguration struct {
@@ -235,12 +953,141 @@ type MailerConfiguration struct {
 	SecureEmailChangeEnabled bool                      `json:"secure_email_change_enabled" split_words:"true" default:"true"`
 	OtpExp                   uint                      `json:"otp_exp" split_words:"true"`
 	OtpLength                int                       `json:"otp_length" split_words:"true"`
+
+	// OTPMode controls whether emails contain a link, a code or both to
+	// verify the email address. Codes are verified on /verify with the
+	// token and email.
+	OTPMode        string `json:"otp_mode" split_words:"true"`
+	OtpMaxAttempts int    `json:"otp_max_attempts" split_words:"true"`
+
+	// TenantTemplatesPath is a directory with a subdirectory of email
+	// templates for each tenant, e.g. <path>/<tenant>/confirmation.html.
+	// The tenant of a request is read from the TenantHeader, or the
+	// audience of the request if the header is not set.
+	TenantTemplatesPath string `json:"tenant_templates_path" split_words:"true"`
+	TenantHeader        string `json:"tenant_header" split_words:"true" default:"X-Tenant-ID"`
+
+	// TenantTemplates holds the template overrides of each tenant, loaded
+	// from TenantTemplatesPath.
+	TenantTemplates map[string]EmailContentConfiguration `json:"-"`
+}
+
+// Email OTP modes supported in MailerConfiguration.OTPMode.
+const (
+	EmailOTPModeLink = "link"
+	EmailOTPModeCode = "code"
+	EmailOTPModeBoth = "both"
+)
+
+// emailContentFiles maps the file names of email templates, without the
+// extension, to the email they are used for.
+var emailContentFiles = map[string]func(*EmailContentConfiguration) *string{
+	"invite":           func(c *EmailContentConfiguration) *string { return &c.Invite },
+	"confirmation":     func(c *EmailContentConfiguration) *string { return &c.Confirmation },
+	"recovery":         func(c *EmailContentConfiguration) *string { return &c.Recovery },
+	"email_change":     func(c *EmailContentConfiguration) *string { return &c.EmailChange },
+	"magic_link":       func(c *EmailContentConfiguration) *string { return &c.MagicLink },
+	"reauthentication": func(c *EmailContentConfiguration) *string { return &c.Reauthentication },
+}
+
+// readTemplateFile reads a template file and checks that it parses. A
+// missing file is returned as an empty template.
+func readTemplateFile(path string, parse func(body string) error) (string, error) {
+	body, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if err := parse(string(body)); err != nil {
+		return "", fmt.Errorf("invalid template %s: %w", path, err)
+	}
+
+	return string(body), nil
+}
+
+// loadEmailContent reads the email templates with the extension from dir.
+func loadEmailContent(dir, ext string, parse func(body string) error) (EmailContentConfiguration, error) {
+	content := EmailContentConfiguration{}
+
+	for name, field := range emailContentFiles {
+		body, err := readTemplateFile(filepath.Join(dir, name+ext), parse)
+		if err != nil {
+			return content, err
+		}
+
+		*field(&content) = body
+	}
+
+	return content, nil
+}
+
+func parseHTMLTemplate(body string) error {
+	_, err := htmltemplate.New("").Parse(body)
+	return err
+}
+
+func parseTextTemplate(body string) error {
+	_, err := template.New("").Parse(body)
+	return err
+}
+
+// LoadTenantTemplates reads the email templates of every tenant in
+// TenantTemplatesPath. Templates that fail to parse are rejected here, so
+// that a broken template is not only noticed when an email is sent.
+func (c *MailerConfiguration) LoadTenantTemplates() error {
+	if c.TenantTemplatesPath == "" {
+		return nil
+	}
+
+	tenants, err := os.ReadDir(c.TenantTemplatesPath)
+	if err != nil {
+		return fmt.Errorf("mailer tenant templates: %w", err)
+	}
+
+	c.TenantTemplates = make(map[string]EmailContentConfiguration)
+
+	for _, tenant := range tenants {
+		if !tenant.IsDir() {
+			continue
+		}
+
+		templates, err := loadEmailContent(filepath.Join(c.TenantTemplatesPath, tenant.Name()), ".html", parseHTMLTemplate)
+		if err != nil {
+			return fmt.Errorf("mailer tenant templates: %w", err)
+		}
+
+		c.TenantTemplates[tenant.Name()] = templates
+	}
+
+	return nil
+}
+
+func (c *MailerConfiguration) Validate() error {
+	switch c.OTPMode {
+	case EmailOTPModeLink, EmailOTPModeCode, EmailOTPModeBoth:
+		// supported mode
+
+	default:
+		return fmt.Errorf("unsupported mailer otp mode: %s", c.OTPMode)
+	}
+
+	if c.OtpMaxAttempts < 0 {
+		return errors.New("mailer otp max attempts must not be negative")
+	}
+
+	return nil
 }
 
 type PhoneProviderConfiguration struct {
 	Enabled bool `json:"enabled" default:"false"`
 }
 
+type AnonymousProviderConfiguration struct {
+	Enabled bool `json:"enabled" default:"false"`
+}
+
 type SmsProviderConfiguration struct {
 	Autoconfirm       bool               `json:"autoconfirm"`
 	MaxFrequency      time.Duration      `json:"max_frequency" split_words:"true"`
@@ -251,12 +1098,22 @@ type SmsProviderConfiguration struct {
 	TestOTP           map[string]string  `json:"test_otp" split_words:"true"`
 	TestOTPValidUntil Time               `json:"test_otp_valid_until" split_words:"true"`
 	SMSTemplate       *template.Template `json:"-"`
+	DefaultRegion     string             `json:"default_region" split_words:"true"`
 
 	Twilio       TwilioProviderConfiguration       `json:"twilio"`
 	TwilioVerify TwilioVerifyProviderConfiguration `json:"twilio_verify" split_words:"true"`
 	Messagebird  MessagebirdProviderConfiguration  `json:"messagebird"`
 	Textlocal    TextlocalProviderConfiguration    `json:"textlocal"`
 	Vonage       VonageProviderConfiguration       `json:"vonage"`
+	HTTP         HTTPProviderConfiguration         `json:"http"`
+}
+
+// Validate checks that the default region is an ISO 3166-1 alpha-2 code.
+func (c *SmsProviderConfiguration) Validate() error {
+	if c.DefaultRegion != "" && !regionCodePattern.MatchString(c.DefaultRegion) {
+		return fmt.Errorf("invalid SMS default region %q, expected an ISO 3166-1 alpha-2 code such as US", c.DefaultRegion)
+	}
+	return nil
 }
 
 func (c *SmsProviderConfiguration) GetTestOTP(phone string, now time.Time) (string, bool) {
@@ -275,6 +1132,13 @@ type TwilioProviderConfiguration struct {
 	ContentSid        string `json:"content_sid" split_words:"true"`
 }
 
+// HTTPProviderConfiguration configures a custom SMS gateway. The optional
+// secret is sent as a bearer token.
+type HTTPProviderConfiguration struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
 type TwilioVerifyProviderConfiguration struct {
 	AccountSid        string `json:"account_sid" split_words:"true"`
 	AuthToken         string `json:"auth_token" split_words:"true"`
@@ -298,9 +1162,10 @@ type VonageProviderConfiguration struct {
 }
 
 type CaptchaConfiguration struct {
-	Enabled  bool   `json:"enabled" default:"false"`
-	Provider string `json:"provider" default:"hcaptcha"`
-	Secret   string `json:"provider_secret"`
+	Enabled   bool   `json:"enabled" default:"false"`
+	Provider  string `json:"provider" default:"hcaptcha"`
+	Secret    string `json:"provider_secret"`
+	VerifyURL string `json:"verify_url" split_words:"true"`
 }
 
 func (c *CaptchaConfiguration) Validate() error {
@@ -318,17 +1183,250 @@ func (c *CaptchaConfiguration) Validate() error {
 		return errors.New("captcha provider secret is empty")
 	}
 
+	if c.VerifyURL != "" {
+		if _, err := url.ParseRequestURI(c.VerifyURL); err != nil {
+			return fmt.Errorf("invalid captcha verify URL: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// The maximum Argon2 parameters of password hashes, both configured and
+// imported, as they decide how much memory and CPU verifying a password
+// takes. Memory is in KiB.
+const (
+	MaxArgon2Memory      = 256 * 1024
+	MaxArgon2Time        = 16
+	MaxArgon2Parallelism = 16
+)
+
 type SecurityConfiguration struct {
 	Captcha                               CaptchaConfiguration `json:"captcha"`
 	RefreshTokenRotationEnabled           bool                 `json:"refresh_token_rotation_enabled" split_words:"true" default:"true"`
-	RefreshTokenReuseInterval             int                  `json:"refresh_token_reuse_interval" split_words:"true"`
+	RefreshTokenReuseInterval             int                  `json:"refresh_token_reuse_interval" split_words:"true"` // deprecated, use Sessions.RefreshTokenReuseInterval
 	UpdatePasswordRequireReauthentication bool                 `json:"update_password_require_reauthentication" split_words:"true"`
+
+	PasswordHashAlgorithm         string `json:"password_hash_algorithm" split_words:"true" default:"bcrypt"`
+	PasswordHashArgon2Memory      uint32 `json:"password_hash_argon2_memory" split_words:"true" default:"19456"`
+	PasswordHashArgon2Time        uint32 `json:"password_hash_argon2_time" split_words:"true" default:"2"`
+	PasswordHashArgon2Parallelism uint8  `json:"password_hash_argon2_parallelism" split_words:"true" default:"1"`
+	PasswordHashUpgradeEnabled    bool   `json:"password_hash_upgrade_enabled" split_words:"true"`
+
+	PasswordRequirements PasswordRequirementsConfiguration `json:"password_requirements" split_words:"true"`
+
+	CheckPwnedPasswords      bool          `json:"check_pwned_passwords" split_words:"true"`
+	PwnedPasswordsURL        string        `json:"pwned_passwords_url" split_words:"true" default:"https://api.pwnedpasswords.com"`
+	PwnedPasswordsTimeout    time.Duration `json:"pwned_passwords_timeout" split_words:"true" default:"2s"`
+	PwnedPasswordsFailClosed bool          `json:"pwned_passwords_fail_closed" split_words:"true"`
+
+	// PasswordHistoryLength is the number of previous passwords of a user
+	// that are kept and can't be set again, like the current one. Zero
+	// disables the password history.
+	PasswordHistoryLength int `json:"password_history_length" split_words:"true"`
+
+	TrustedProxies []string `json:"trusted_proxies" split_words:"true"`
+
+	// MaxLoginAttempts is the number of consecutive failed password logins
+	// after which an account is locked for LockoutDuration. Zero disables
+	// the lockout.
+	MaxLoginAttempts int           `json:"max_login_attempts" split_words:"true"`
+	LockoutDuration  time.Duration `json:"lockout_duration" split_words:"true" default:"15m"`
+
+	// SoftDeleteUsers makes deleting a user through the admin API only
+	// mark the user as deleted, so that it can be restored later.
+	SoftDeleteUsers bool `json:"soft_delete_users" split_words:"true"`
+
+	// RefreshTokenFingerprintMode controls whether refresh tokens can only
+	// be used by the client they were issued to.
+	RefreshTokenFingerprintMode string `json:"refresh_token_fingerprint_mode" split_words:"true" default:"off"`
+
+	// EncryptionKey is the Base64 encoded AES-256 key that encrypts the
+	// EncryptedIdentityDataFields of identities at rest. Encrypted values
+	// are tagged with EncryptionKeyID, so that after a key rotation the
+	// values encrypted with the previous keys, listed by ID in
+	// DecryptionKeys, can still be decrypted.
+	EncryptionKey               string            `json:"-" split_words:"true"`
+	EncryptionKeyID             string            `json:"encryption_key_id" split_words:"true" default:"default"`
+	DecryptionKeys              map[string]string `json:"-" split_words:"true"`
+	EncryptedIdentityDataFields []string          `json:"encrypted_identity_data_fields" split_words:"true" default:"claims"`
+}
+
+// unencryptableIdentityDataFields are the identity_data fields that are
+// queried by the database, and therefore can't be encrypted.
+var unencryptableIdentityDataFields = []string{"sub", "email", "phone"}
+
+// EncryptionKeys decodes the encryption key and the decryption keys, keyed by
+// their IDs.
+func (c *SecurityConfiguration) EncryptionKeys() (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+
+	for keyID, encoded := range c.DecryptionKeys {
+		if keyID == "" || strings.Contains(keyID, ":") {
+			return nil, fmt.Errorf("decryption key ID %q must not be empty or contain colons", keyID)
+		}
+
+		key, err := decodeEncryptionKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decryption key %q: %w", keyID, err)
+		}
+
+		keys[keyID] = key
+	}
+
+	if c.EncryptionKey != "" {
+		if c.EncryptionKeyID == "" || strings.Contains(c.EncryptionKeyID, ":") {
+			return nil, fmt.Errorf("encryption key ID %q must not be empty or contain colons", c.EncryptionKeyID)
+		}
+
+		key, err := decodeEncryptionKey(c.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key: %w", err)
+		}
+
+		keys[c.EncryptionKeyID] = key
+	}
+
+	return keys, nil
+}
+
+func decodeEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("not in standard Base64 format")
+	}
+
+	if len(key) != 32 {
+		return nil, errors.New("must be 32 bytes long")
+	}
+
+	return key, nil
+}
+
+// Refresh token fingerprint modes supported in
+// SecurityConfiguration.RefreshTokenFingerprintMode.
+const (
+	// RefreshTokenFingerprintOff does not compare fingerprints.
+	RefreshTokenFingerprintOff = "off"
+
+	// RefreshTokenFingerprintLog logs refreshes from a different client,
+	// e.g. to find out how often fingerprints change before enforcing
+	// them.
+	RefreshTokenFingerprintLog = "log"
+
+	// RefreshTokenFingerprintEnforce rejects refreshes from a different
+	// client.
+	RefreshTokenFingerprintEnforce = "enforce"
+)
+
+// PasswordRequirementsConfiguration holds the policy that new passwords must
+// satisfy. The minimum length is merged with PasswordMinLength.
+type PasswordRequirementsConfiguration struct {
+	MinLength                int      `json:"min_length" split_words:"true"`
+	RequiredCharacterClasses []string `json:"required_character_classes" split_words:"true"`
+	MinStrengthScore         int      `json:"min_strength_score" split_words:"true"`
+}
+
+func (c *PasswordRequirementsConfiguration) Validate() error {
+	if c.MinLength < 0 {
+		return errors.New("password requirements min length must not be negative")
+	}
+
+	for _, class := range c.RequiredCharacterClasses {
+		switch class {
+		case "lowercase", "uppercase", "digits", "symbols":
+			// supported character class
+
+		default:
+			return fmt.Errorf("unsupported password character class: %s", class)
+		}
+	}
+
+	if c.MinStrengthScore < 0 || c.MinStrengthScore > 4 {
+		return errors.New("password requirements min strength score must be between 0 and 4")
+	}
+
+	return nil
 }
 
 func (c *SecurityConfiguration) Validate() error {
+	if err := c.PasswordRequirements.Validate(); err != nil {
+		return err
+	}
+
+	for _, proxy := range c.TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return fmt.Errorf("invalid trusted proxy range %q: %w", proxy, err)
+			}
+		} else if net.ParseIP(proxy) == nil {
+			return fmt.Errorf("invalid trusted proxy address %q", proxy)
+		}
+	}
+
+	switch c.PasswordHashAlgorithm {
+	case "", "bcrypt":
+		// bcrypt needs no further configuration
+
+	case "argon2id":
+		if c.PasswordHashArgon2Time == 0 || c.PasswordHashArgon2Parallelism == 0 {
+			return errors.New("argon2id password hashing requires a positive time and parallelism")
+		}
+
+		if c.PasswordHashArgon2Memory < 8*uint32(c.PasswordHashArgon2Parallelism) {
+			return errors.New("argon2id password hashing requires at least 8 KiB of memory per thread")
+		}
+
+		if c.PasswordHashArgon2Memory > MaxArgon2Memory || c.PasswordHashArgon2Time > MaxArgon2Time || c.PasswordHashArgon2Parallelism > MaxArgon2Parallelism {
+			return fmt.Errorf("argon2id password hashing allows at most %d KiB of memory, a time of %d and a parallelism of %d", MaxArgon2Memory, MaxArgon2Time, MaxArgon2Parallelism)
+		}
+
+	default:
+		return fmt.Errorf("unsupported password hash algorithm: %s", c.PasswordHashAlgorithm)
+	}
+
+	switch c.RefreshTokenFingerprintMode {
+	case RefreshTokenFingerprintOff, RefreshTokenFingerprintLog, RefreshTokenFingerprintEnforce:
+		// supported mode
+
+	default:
+		return fmt.Errorf("unsupported refresh token fingerprint mode: %s", c.RefreshTokenFingerprintMode)
+	}
+
+	if c.MaxLoginAttempts < 0 {
+		return errors.New("max login attempts must not be negative")
+	}
+
+	if c.PasswordHistoryLength < 0 {
+		return errors.New("password history length must not be negative")
+	}
+
+	if c.MaxLoginAttempts > 0 && c.LockoutDuration <= 0 {
+		return errors.New("lockout duration must be positive")
+	}
+
+	if _, err := c.EncryptionKeys(); err != nil {
+		return err
+	}
+
+	for _, field := range c.EncryptedIdentityDataFields {
+		for _, unencryptable := range unencryptableIdentityDataFields {
+			if field == unencryptable {
+				return fmt.Errorf("identity data field %q can't be encrypted", field)
+			}
+		}
+	}
+
+	if c.CheckPwnedPasswords {
+		if _, err := url.ParseRequestURI(c.PwnedPasswordsURL); err != nil {
+			return fmt.Errorf("invalid pwned passwords URL: %w", err)
+		}
+
+		if c.PwnedPasswordsTimeout <= 0 {
+			return errors.New("pwned passwords timeout must be positive")
+		}
+	}
+
 	return c.Captcha.Validate()
 }
 
@@ -352,6 +1450,34 @@ type WebhookConfig struct {
 	TimeoutSec int      `json:"timeout_sec"`
 	Secret     string   `json:"secret"`
 	Events     []string `json:"events"`
+
+	// BackgroundDelivery delivers event webhooks other than validate once
+	// the request's transaction has committed, retrying failed ones in
+	// the background instead of failing the request.
+	BackgroundDelivery bool `json:"background_delivery" split_words:"true"`
+
+	// RetryBaseDelay is the delay before the first background retry of an
+	// event webhook, which doubles with every further retry up to
+	// RetryMaxDelay.
+	RetryBaseDelay time.Duration `json:"retry_base_delay" split_words:"true"`
+	RetryMaxDelay  time.Duration `json:"retry_max_delay" split_words:"true"`
+}
+
+// HookConfiguration holds the hooks that are called synchronously to extend
+// GoTrue's behavior.
+type HookConfiguration struct {
+	// CustomAccessToken is called whenever an access token is issued and
+	// can add claims to it.
+	CustomAccessToken HTTPHookConfiguration `json:"custom_access_token" split_words:"true"`
+}
+
+// HTTPHookConfiguration configures a hook that is called with an HTTP POST
+// request. The hook is disabled when no URL is set.
+type HTTPHookConfiguration struct {
+	URL        string `json:"url"`
+	Retries    int    `json:"retries"`
+	TimeoutSec int    `json:"timeout_sec" split_words:"true"`
+	Secret     string `json:"secret"`
 }
 
 func (w *WebhookConfig) HasEvent(event string) bool {
@@ -381,6 +1507,10 @@ func LoadGlobal(filename string) (*GlobalConfiguration, error) {
 		return nil, err
 	}
 
+	if err := config.JWT.PopulateFields(); err != nil {
+		return nil, err
+	}
+
 	if config.SAML.Enabled {
 		if err := config.SAML.PopulateFields(config.API.ExternalURL); err != nil {
 			return nil, err
@@ -388,6 +1518,14 @@ func LoadGlobal(filename string) (*GlobalConfiguration, error) {
 	} else {
 		config.SAML.PrivateKey = ""
 	}
+	if err := config.Mailer.LoadTenantTemplates(); err != nil {
+		return nil, err
+	}
+
+	if err := config.Localization.LoadTemplates(); err != nil {
+		return nil, err
+	}
+
 	if config.Sms.Provider != "" {
 		SMSTemplate := config.Sms.Template
 		if SMSTemplate == "" {
@@ -417,6 +1555,15 @@ func (config *GlobalConfiguration) ApplyDefaults() error {
 		config.JWT.Exp = 3600
 	}
 
+	// the reuse interval in seconds is still honored if it's set
+	if config.Security.RefreshTokenReuseInterval > 0 {
+		config.Sessions.RefreshTokenReuseInterval = time.Duration(config.Security.RefreshTokenReuseInterval) * time.Second
+	}
+
+	if config.JWT.Algorithm == "" {
+		config.JWT.Algorithm = JWTAlgorithmHS256
+	}
+
 	if config.Mailer.URLPaths.Invite == "" {
 		config.Mailer.URLPaths.Invite = "/verify"
 	}
@@ -442,6 +1589,14 @@ func (config *GlobalConfiguration) ApplyDefaults() error {
 		config.Mailer.OtpLength = 6
 	}
 
+	if config.Mailer.OTPMode == "" {
+		config.Mailer.OTPMode = EmailOTPModeBoth
+	}
+
+	if config.Mailer.OtpMaxAttempts == 0 {
+		config.Mailer.OtpMaxAttempts = 5
+	}
+
 	if config.SMTP.MaxFrequency == 0 {
 		config.SMTP.MaxFrequency = 1 * time.Minute
 	}
@@ -490,9 +1645,29 @@ func (config *GlobalConfiguration) ApplyDefaults() error {
 	if config.PasswordMinLength < defaultMinPasswordLength {
 		config.PasswordMinLength = defaultMinPasswordLength
 	}
+	if config.PasswordMinLength < config.Security.PasswordRequirements.MinLength {
+		config.PasswordMinLength = config.Security.PasswordRequirements.MinLength
+	}
+	config.Security.PasswordRequirements.MinLength = config.PasswordMinLength
 	if config.MFA.ChallengeExpiryDuration < defaultChallengeExpiryDuration {
 		config.MFA.ChallengeExpiryDuration = defaultChallengeExpiryDuration
 	}
+	if config.MFA.WebAuthn.RPID == "" || len(config.MFA.WebAuthn.RPOrigins) == 0 {
+		if u, err := url.ParseRequestURI(config.SiteURL); err == nil {
+			if config.MFA.WebAuthn.RPID == "" {
+				config.MFA.WebAuthn.RPID = u.Hostname()
+			}
+			if len(config.MFA.WebAuthn.RPOrigins) == 0 {
+				config.MFA.WebAuthn.RPOrigins = []string{u.Scheme + "://" + u.Host}
+			}
+		}
+	}
+	if config.MFA.StepUp.MaxAge <= 0 {
+		config.MFA.StepUp.MaxAge = defaultStepUpMaxAge
+	}
+	if config.MFA.WebAuthn.RPDisplayName == "" {
+		config.MFA.WebAuthn.RPDisplayName = config.MFA.WebAuthn.RPID
+	}
 	if config.External.FlowStateExpiryDuration < defaultFlowStateExpiryDuration {
 		config.External.FlowStateExpiryDuration = defaultFlowStateExpiryDuration
 	}
@@ -511,11 +1686,21 @@ func (c *GlobalConfiguration) Validate() error {
 	}{
 		&c.API,
 		&c.DB,
+		&c.JWT,
 		&c.Tracing,
 		&c.Metrics,
 		&c.SMTP,
+		&c.Mailer,
+		&c.Sms,
+		&c.Localization,
 		&c.SAML,
 		&c.Security,
+		&c.External,
+		&c.Sessions,
+		&c.Impersonation,
+		&c.Cookie,
+		&c.AuditLog,
+		&c.Introspection,
 	}
 
 	for _, validatable := range validatables {
@@ -527,6 +1712,22 @@ func (c *GlobalConfiguration) Validate() error {
 	return nil
 }
 
+// validate checks the settings of the provider with the name that apply
+// regardless of whether it's enabled.
+func (o *OAuthProviderConfiguration) validate(name string) error {
+	switch o.NonceHashing {
+	case "", NonceHashingSHA256, NonceHashingPlain:
+	default:
+		return fmt.Errorf("unsupported nonce hashing %q for external provider %s", o.NonceHashing, name)
+	}
+
+	if o.ClockSkewTolerance < 0 {
+		return fmt.Errorf("clock skew tolerance for external provider %s must not be negative", name)
+	}
+
+	return nil
+}
+
 func (o *OAuthProviderConfiguration) ValidateOAuth() error {
 	if !o.Enabled {
 		return errors.New("provider is not enabled")
@@ -543,6 +1744,51 @@ func (o *OAuthProviderConfiguration) ValidateOAuth() error {
 	return nil
 }
 
+// HasEmailDomainRestrictions reports whether the email domains of the users
+// that can sign in with the provider are restricted.
+func (o *OAuthProviderConfiguration) HasEmailDomainRestrictions() bool {
+	return len(o.AllowedEmailDomains) > 0 || len(o.BlockedEmailDomains) > 0
+}
+
+// IsEmailDomainAllowed reports whether the domain of the email address is in
+// AllowedEmailDomains (if set) and not in BlockedEmailDomains.
+func (o *OAuthProviderConfiguration) IsEmailDomainAllowed(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	domain := strings.ToLower(email[at+1:])
+
+	for _, blocked := range o.BlockedEmailDomains {
+		if matchesEmailDomain(domain, blocked) {
+			return false
+		}
+	}
+
+	if len(o.AllowedEmailDomains) == 0 {
+		return true
+	}
+
+	for _, allowed := range o.AllowedEmailDomains {
+		if matchesEmailDomain(domain, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesEmailDomain(domain, pattern string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(domain, pattern[1:])
+	}
+
+	return domain == pattern
+}
+
 func (t *TwilioProviderConfiguration) Validate() error {
 	if t.AccountSid == "" {
 		return errors.New("missing Twilio account SID")
@@ -602,6 +1848,16 @@ func (t *VonageProviderConfiguration) Validate() error {
 	return nil
 }
 
+func (t *HTTPProviderConfiguration) Validate() error {
+	if t.URL == "" {
+		return errors.New("missing SMS gateway URL")
+	}
+	if _, err := url.ParseRequestURI(t.URL); err != nil {
+		return fmt.Errorf("invalid SMS gateway URL: %w", err)
+	}
+	return nil
+}
+
 func (t *SmsProviderConfiguration) IsTwilioVerifyProvider() bool {
 	return t.Provider == "twilio_verify"
 }
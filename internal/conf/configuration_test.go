@@ -1,9 +1,16 @@
 package conf
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/kelseyhightower/envconfig"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -25,4 +32,352 @@ func TestGlobal(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, gc)
 	assert.Equal(t, "X-Request-ID", gc.API.RequestIDHeader)
+	assert.Equal(t, 10*time.Second, gc.Sessions.RefreshTokenReuseInterval)
+	assert.False(t, gc.Sessions.IntrospectionEnabled)
+	assert.Equal(t, []string{"user_id", "aal", "not_after"}, gc.Sessions.IntrospectionFields)
+
+	// the deprecated reuse interval in seconds is still honored
+	os.Setenv("GOTRUE_SECURITY_REFRESH_TOKEN_REUSE_INTERVAL", "30")
+	defer os.Unsetenv("GOTRUE_SECURITY_REFRESH_TOKEN_REUSE_INTERVAL")
+	gc, err = LoadGlobal("")
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, gc.Sessions.RefreshTokenReuseInterval)
+}
+
+func TestOAuthProviderEmailDomains(t *testing.T) {
+	cases := []struct {
+		desc     string
+		config   OAuthProviderConfiguration
+		email    string
+		expected bool
+	}{
+		{
+			desc:     "no restrictions",
+			email:    "user@example.com",
+			expected: true,
+		},
+		{
+			desc:     "allowed domain",
+			config:   OAuthProviderConfiguration{AllowedEmailDomains: []string{"example.com"}},
+			email:    "user@Example.com",
+			expected: true,
+		},
+		{
+			desc:     "domain not allowed",
+			config:   OAuthProviderConfiguration{AllowedEmailDomains: []string{"example.com"}},
+			email:    "user@example.org",
+			expected: false,
+		},
+		{
+			desc:     "subdomain not allowed without wildcard",
+			config:   OAuthProviderConfiguration{AllowedEmailDomains: []string{"example.com"}},
+			email:    "user@mail.example.com",
+			expected: false,
+		},
+		{
+			desc:     "wildcard allows subdomains",
+			config:   OAuthProviderConfiguration{AllowedEmailDomains: []string{"*.example.com"}},
+			email:    "user@mail.example.com",
+			expected: true,
+		},
+		{
+			desc:     "wildcard does not allow the domain itself",
+			config:   OAuthProviderConfiguration{AllowedEmailDomains: []string{"*.example.com"}},
+			email:    "user@example.com",
+			expected: false,
+		},
+		{
+			desc:     "wildcard does not allow other domains with the same suffix",
+			config:   OAuthProviderConfiguration{AllowedEmailDomains: []string{"*.example.com"}},
+			email:    "user@notexample.com",
+			expected: false,
+		},
+		{
+			desc:     "blocked domain",
+			config:   OAuthProviderConfiguration{BlockedEmailDomains: []string{"example.org"}},
+			email:    "user@example.org",
+			expected: false,
+		},
+		{
+			desc: "blocked subdomain of allowed domain",
+			config: OAuthProviderConfiguration{
+				AllowedEmailDomains: []string{"*.example.com"},
+				BlockedEmailDomains: []string{"*.guests.example.com"},
+			},
+			email:    "user@team.guests.example.com",
+			expected: false,
+		},
+		{
+			desc:     "missing domain",
+			config:   OAuthProviderConfiguration{BlockedEmailDomains: []string{"example.org"}},
+			email:    "user",
+			expected: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			assert.Equal(t, c.expected, c.config.IsEmailDomainAllowed(c.email))
+		})
+	}
+
+	assert.False(t, (&OAuthProviderConfiguration{}).HasEmailDomainRestrictions())
+	assert.True(t, (&OAuthProviderConfiguration{BlockedEmailDomains: []string{"example.org"}}).HasEmailDomainRestrictions())
+}
+
+func TestProviderConfigurationValidateNonceHashing(t *testing.T) {
+	for _, hashing := range []string{"", NonceHashingSHA256, NonceHashingPlain} {
+		c := &ProviderConfiguration{}
+		c.Keycloak.NonceHashing = hashing
+		assert.NoError(t, c.Validate())
+	}
+
+	c := &ProviderConfiguration{}
+	c.Keycloak.NonceHashing = "md5"
+	assert.Error(t, c.Validate())
+}
+
+func TestOAuthProviderClaimsMapping(t *testing.T) {
+	t.Setenv("GOTRUE_EXTERNAL_KEYCLOAK_CLAIMS_MAPPING", `{"https://example.com/claims/groups": "groups", "realm_access.roles": "roles"}`)
+
+	var c struct {
+		External ProviderConfiguration
+	}
+	require.NoError(t, envconfig.Process("gotrue", &c))
+	require.Equal(t, ClaimsMapping{
+		"https://example.com/claims/groups": "groups",
+		"realm_access.roles":                "roles",
+	}, c.External.Keycloak.ClaimsMapping)
+
+	var mapping ClaimsMapping
+	require.Error(t, mapping.Decode("department:department"))
+}
+
+func TestProviderConfigurationProviderTokenKey(t *testing.T) {
+	c := &ProviderConfiguration{}
+	key, err := c.ProviderTokenKey()
+	require.NoError(t, err)
+	require.Nil(t, key)
+
+	c.ProviderTokenEncryptionKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	key, err = c.ProviderTokenKey()
+	require.NoError(t, err)
+	require.Equal(t, []byte("0123456789abcdef0123456789abcdef"), key)
+	assert.NoError(t, c.Validate())
+
+	for _, invalid := range []string{"InvalidBase64!", "c2hvcnQ="} {
+		c.ProviderTokenEncryptionKey = invalid
+		assert.Error(t, c.Validate())
+	}
+}
+
+func TestSecurityConfigurationEncryptionKeys(t *testing.T) {
+	c := &SecurityConfiguration{
+		EncryptionKey:   "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=",
+		EncryptionKeyID: "key-2",
+		DecryptionKeys:  map[string]string{"key-1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="},
+	}
+
+	keys, err := c.EncryptionKeys()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{
+		"key-1": []byte("0123456789abcdef0123456789abcdef"),
+		"key-2": []byte("fedcba9876543210fedcba9876543210"),
+	}, keys)
+
+	invalidExamples := []*SecurityConfiguration{
+		{EncryptionKey: "c2hvcnQ=", EncryptionKeyID: "key-1"},
+		{EncryptionKey: "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="},
+		{EncryptionKey: "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=", EncryptionKeyID: "key:2"},
+		{DecryptionKeys: map[string]string{"key-1": "InvalidBase64!"}},
+	}
+
+	for i, example := range invalidExamples {
+		_, err := example.EncryptionKeys()
+		require.Error(t, err, "Invalid example %d was regarded as valid", i)
+	}
+}
+
+func TestMailerConfigurationLoadTenantTemplates(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "brand-a"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "brand-a", "confirmation.html"), []byte(`<a href="{{ .ConfirmationURL }}">Brand A</a>`), 0o600))
+
+	c := MailerConfiguration{TenantTemplatesPath: dir}
+	require.NoError(t, c.LoadTenantTemplates())
+	require.Contains(t, c.TenantTemplates, "brand-a")
+	assert.Equal(t, `<a href="{{ .ConfirmationURL }}">Brand A</a>`, c.TenantTemplates["brand-a"].Confirmation)
+	assert.Equal(t, "", c.TenantTemplates["brand-a"].Recovery)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "brand-b"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "brand-b", "recovery.html"), []byte(`{{ .ConfirmationURL `), 0o600))
+
+	c = MailerConfiguration{TenantTemplatesPath: dir}
+	require.ErrorContains(t, c.LoadTenantTemplates(), "recovery.html")
+}
+
+func TestIntrospectionConfigurationValidate(t *testing.T) {
+	validExamples := []*IntrospectionConfiguration{
+		{},
+		{Clients: map[string]string{"": ""}},
+		{Enabled: true, Clients: map[string]string{"resource-server": "secret"}},
+	}
+
+	for i, example := range validExamples {
+		require.NoError(t, example.Validate(), "Valid example %d was regarded as invalid", i)
+	}
+
+	invalidExamples := []*IntrospectionConfiguration{
+		{Enabled: true},
+		{Enabled: true, Clients: map[string]string{"resource-server": ""}},
+		{Enabled: true, Clients: map[string]string{"": "secret"}},
+	}
+
+	for i, example := range invalidExamples {
+		require.Error(t, example.Validate(), "Invalid example %d was regarded as valid", i)
+	}
+}
+
+func TestSessionsConfigurationValidate(t *testing.T) {
+	validExamples := []*SessionsConfiguration{
+		{},
+		{IntrospectionEnabled: true, IntrospectionFields: []string{"user_id", "aal", "not_after"}},
+		{IntrospectionEnabled: true, IntrospectionFields: []string{}},
+	}
+
+	for i, example := range validExamples {
+		require.NoError(t, example.Validate(), "Valid example %d was regarded as invalid", i)
+	}
+
+	invalidExamples := []*SessionsConfiguration{
+		{Timebox: -1},
+		{IntrospectionFields: []string{"refresh_token"}},
+		{IntrospectionFields: []string{"user_id", ""}},
+	}
+
+	for i, example := range invalidExamples {
+		require.Error(t, example.Validate(), "Invalid example %d was regarded as valid", i)
+	}
+}
+
+func TestCookieConfigurationValidate(t *testing.T) {
+	validExamples := []*CookieConfiguration{
+		{},
+		{SameSite: CookieSameSiteLax, Authenticate: true},
+		{SameSite: CookieSameSiteStrict, Authenticate: true},
+		{SameSite: CookieSameSiteNone},
+	}
+
+	for i, example := range validExamples {
+		require.NoError(t, example.Validate(), "Valid example %d was regarded as invalid", i)
+	}
+
+	invalidExamples := []*CookieConfiguration{
+		{SameSite: "Lax"},
+		{SameSite: "default"},
+		{SameSite: CookieSameSiteNone, Authenticate: true},
+	}
+
+	for i, example := range invalidExamples {
+		require.Error(t, example.Validate(), "Invalid example %d was regarded as valid", i)
+	}
+
+	assert.Equal(t, http.SameSiteLaxMode, (&CookieConfiguration{}).SameSiteMode())
+	assert.Equal(t, http.SameSiteStrictMode, (&CookieConfiguration{SameSite: CookieSameSiteStrict}).SameSiteMode())
+	assert.Equal(t, http.SameSiteNoneMode, (&CookieConfiguration{SameSite: CookieSameSiteNone}).SameSiteMode())
+}
+
+func TestProviderTLSConfigurationValidate(t *testing.T) {
+	pin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	validExamples := []*ProviderTLSConfiguration{
+		{},
+		{MinVersion: "1.3"},
+		{MinVersion: "1.2", PinnedPublicKeys: []string{pin, "sha256/" + pin}},
+	}
+
+	for i, example := range validExamples {
+		require.NoError(t, example.Validate(), "Valid example %d was regarded as invalid", i)
+	}
+
+	invalidExamples := []*ProviderTLSConfiguration{
+		{MinVersion: "1.4"},
+		{MinVersion: "TLS1.2"},
+		{PinnedPublicKeys: []string{"not base64"}},
+		{PinnedPublicKeys: []string{base64.StdEncoding.EncodeToString(make([]byte, 20))}},
+	}
+
+	for i, example := range invalidExamples {
+		require.Error(t, example.Validate(), "Invalid example %d was regarded as valid", i)
+	}
+
+	version, err := (&ProviderTLSConfiguration{}).TLSMinVersion()
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), version)
+}
+
+func TestProviderRetryConfigurationValidate(t *testing.T) {
+	validExamples := []*ProviderRetryConfiguration{
+		{},
+		{MaxAttempts: 3, Backoff: 200 * time.Millisecond, Timeout: 10 * time.Second},
+	}
+
+	for i, example := range validExamples {
+		require.NoError(t, example.Validate(), "Valid example %d was regarded as invalid", i)
+	}
+
+	invalidExamples := []*ProviderRetryConfiguration{
+		{MaxAttempts: -1},
+		{Backoff: -time.Second},
+		{Timeout: -time.Second},
+	}
+
+	for i, example := range invalidExamples {
+		require.Error(t, example.Validate(), "Invalid example %d was regarded as valid", i)
+	}
+}
+
+func TestAuditLogConfigurationValidate(t *testing.T) {
+	validExamples := []*AuditLogConfiguration{
+		{},
+		{Sinks: []string{AuditLogSinkDatabase}},
+		{Sinks: []string{AuditLogSinkFile}, File: AuditLogFileConfiguration{Path: "/var/log/gotrue/audit.log"}},
+		{Sinks: []string{AuditLogSinkDatabase, AuditLogSinkHTTP}, HTTP: AuditLogHTTPConfiguration{URL: "https://siem.example.com", BufferSize: 100}},
+	}
+
+	for i, example := range validExamples {
+		require.NoError(t, example.Validate(), "Valid example %d was regarded as invalid", i)
+	}
+
+	invalidExamples := []*AuditLogConfiguration{
+		{Sinks: []string{"syslog"}},
+		{Sinks: []string{AuditLogSinkFile}},
+		{Sinks: []string{AuditLogSinkHTTP}, HTTP: AuditLogHTTPConfiguration{BufferSize: 100}},
+		{Sinks: []string{AuditLogSinkHTTP}, HTTP: AuditLogHTTPConfiguration{URL: "https://siem.example.com"}},
+	}
+
+	for i, example := range invalidExamples {
+		require.Error(t, example.Validate(), "Invalid example %d was regarded as valid", i)
+	}
+}
+
+func TestSecurityConfigurationArgon2Params(t *testing.T) {
+	valid := SecurityConfiguration{
+		PasswordHashAlgorithm:         "argon2id",
+		PasswordHashArgon2Memory:      MaxArgon2Memory,
+		PasswordHashArgon2Time:        MaxArgon2Time,
+		PasswordHashArgon2Parallelism: MaxArgon2Parallelism,
+		RefreshTokenFingerprintMode:   RefreshTokenFingerprintOff,
+	}
+	require.NoError(t, valid.Validate())
+
+	invalidExamples := []SecurityConfiguration{valid, valid, valid}
+	invalidExamples[0].PasswordHashArgon2Memory++
+	invalidExamples[1].PasswordHashArgon2Time++
+	invalidExamples[2].PasswordHashArgon2Parallelism++
+
+	for i, example := range invalidExamples {
+		require.Error(t, example.Validate(), "Invalid example %d was regarded as valid", i)
+	}
 }
@@ -0,0 +1,267 @@
+package conf
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Algorithms that can sign access tokens.
+const (
+	JWTAlgorithmHS256 = "HS256"
+	JWTAlgorithmEdDSA = "EdDSA"
+)
+
+// JWTRetiredKey is the public key of a rotated out signing key. Access
+// tokens signed with it are accepted, and it is published, until it
+// expires, so that tokens issued before the rotation remain valid.
+type JWTRetiredKey struct {
+	KeyID     string    `json:"kid"`
+	PublicKey string    `json:"public_key"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	Key ed25519.PublicKey `json:"-"`
+}
+
+// IsExpired reports whether tokens signed with the key are no longer
+// accepted at the provided time. Keys without an expiry never expire.
+func (k *JWTRetiredKey) IsExpired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// JWTRetiredKeys is configured as a JSON array of retired keys.
+type JWTRetiredKeys []JWTRetiredKey
+
+// Decode implements envconfig.Decoder
+func (k *JWTRetiredKeys) Decode(value string) error {
+	if err := json.Unmarshal([]byte(value), k); err != nil {
+		return fmt.Errorf("JWT retired keys not a JSON array of keys: %w", err)
+	}
+
+	return nil
+}
+
+// JWTPublicKey is a public key that verifies access tokens.
+type JWTPublicKey struct {
+	KeyID string
+	Key   ed25519.PublicKey
+}
+
+func (c *JWTConfiguration) Validate() error {
+	for i, retiredKey := range c.RetiredKeys {
+		if _, err := parseEd25519PublicKey(retiredKey.PublicKey); err != nil {
+			return fmt.Errorf("JWT retired key %d: %w", i, err)
+		}
+	}
+
+	for audience := range c.AudienceIssuers {
+		if !c.IsAllowedAudience(audience) {
+			return fmt.Errorf("JWT audience issuer configured for audience %q, which is not allowed", audience)
+		}
+	}
+
+	for method, exp := range c.ExpiryByGrant {
+		if exp <= 0 {
+			return fmt.Errorf("JWT expiry for grant %q must be positive", method)
+		}
+	}
+
+	switch c.Algorithm {
+	case "", JWTAlgorithmHS256:
+		return nil
+
+	case JWTAlgorithmEdDSA:
+		_, err := parseEd25519PrivateKey(c.PrivateKey)
+		return err
+	}
+
+	return fmt.Errorf("unsupported JWT algorithm %q, must be %s or %s", c.Algorithm, JWTAlgorithmHS256, JWTAlgorithmEdDSA)
+}
+
+// PopulateFields parses the private key of asymmetric algorithms and the
+// retired keys, deriving their key IDs unless configured.
+func (c *JWTConfiguration) PopulateFields() error {
+	keyIDs := make(map[string]bool)
+
+	if c.Algorithm == JWTAlgorithmEdDSA {
+		privateKey, err := parseEd25519PrivateKey(c.PrivateKey)
+		if err != nil {
+			return err
+		}
+
+		c.SigningKey = privateKey
+
+		if c.KeyID == "" {
+			c.KeyID = Ed25519KeyThumbprint(privateKey.Public().(ed25519.PublicKey))
+		}
+
+		keyIDs[c.KeyID] = true
+	}
+
+	for i := range c.RetiredKeys {
+		retiredKey := &c.RetiredKeys[i]
+
+		publicKey, err := parseEd25519PublicKey(retiredKey.PublicKey)
+		if err != nil {
+			return fmt.Errorf("JWT retired key %d: %w", i, err)
+		}
+
+		retiredKey.Key = publicKey
+
+		if retiredKey.KeyID == "" {
+			retiredKey.KeyID = Ed25519KeyThumbprint(publicKey)
+		}
+
+		if keyIDs[retiredKey.KeyID] {
+			return fmt.Errorf("JWT retired key %d: key ID %q is already in use", i, retiredKey.KeyID)
+		}
+
+		keyIDs[retiredKey.KeyID] = true
+	}
+
+	return nil
+}
+
+// PublicKeys returns the public keys that verify access tokens at the
+// provided time: the signing key's, followed by the retired keys that
+// haven't expired.
+func (c *JWTConfiguration) PublicKeys(now time.Time) []JWTPublicKey {
+	var publicKeys []JWTPublicKey
+
+	if c.SigningKey != nil {
+		publicKeys = append(publicKeys, JWTPublicKey{
+			KeyID: c.KeyID,
+			Key:   c.SigningKey.Public().(ed25519.PublicKey),
+		})
+	}
+
+	for _, retiredKey := range c.RetiredKeys {
+		if retiredKey.Key != nil && !retiredKey.IsExpired(now) {
+			publicKeys = append(publicKeys, JWTPublicKey{
+				KeyID: retiredKey.KeyID,
+				Key:   retiredKey.Key,
+			})
+		}
+	}
+
+	return publicKeys
+}
+
+// IsAllowedAudience reports whether requests may select the audience.
+func (c *JWTConfiguration) IsAllowedAudience(audience string) bool {
+	if audience == c.Aud || len(c.AllowedAudiences) == 0 {
+		return true
+	}
+
+	for _, allowedAudience := range c.AllowedAudiences {
+		if audience == allowedAudience {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IssuerForAudience returns the issuer of access tokens for the audience.
+func (c *JWTConfiguration) IssuerForAudience(audience string) string {
+	if issuer, ok := c.AudienceIssuers[audience]; ok {
+		return issuer
+	}
+
+	return c.Issuer
+}
+
+// ExpForGrant returns the expiry, in seconds, of access tokens for sessions
+// created by the authentication method.
+func (c *JWTConfiguration) ExpForGrant(method string) int {
+	if exp, ok := c.ExpiryByGrant[method]; ok {
+		return exp
+	}
+
+	return c.Exp
+}
+
+// RoleForUser returns the role claim of access tokens for a user with the
+// role and app_metadata. The value of RoleAppMetadataKey in the app_metadata
+// takes precedence, unless it's one of the admin roles, and otherwise the
+// user's role or DefaultGroupName is used.
+func (c *JWTConfiguration) RoleForUser(role string, appMetaData map[string]interface{}) string {
+	if c.RoleAppMetadataKey != "" {
+		if mapped, ok := appMetaData[c.RoleAppMetadataKey].(string); ok && mapped != "" && !c.isAdminRole(mapped) {
+			return mapped
+		}
+	}
+
+	if role == "" {
+		return c.DefaultGroupName
+	}
+
+	return role
+}
+
+func (c *JWTConfiguration) isAdminRole(role string) bool {
+	for _, adminRole := range c.AdminRoles {
+		if role == adminRole {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseEd25519PrivateKey(encoded string) (ed25519.PrivateKey, error) {
+	if encoded == "" {
+		return nil, errors.New("JWT private key is required for the EdDSA algorithm")
+	}
+
+	bytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("JWT private key not in standard Base64 format")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(bytes)
+	if err != nil {
+		return nil, errors.New("JWT private key not in PKCS#8 format")
+	}
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("JWT private key is not an Ed25519 key")
+	}
+
+	return privateKey, nil
+}
+
+func parseEd25519PublicKey(encoded string) (ed25519.PublicKey, error) {
+	bytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("public key not in standard Base64 format")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(bytes)
+	if err != nil {
+		return nil, errors.New("public key not in PKIX format")
+	}
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an Ed25519 key")
+	}
+
+	return publicKey, nil
+}
+
+// Ed25519KeyThumbprint returns the RFC 7638 JWK thumbprint of the public key,
+// which is used as its key ID.
+func Ed25519KeyThumbprint(publicKey ed25519.PublicKey) string {
+	// members in lexicographic order, without whitespace
+	jwk := `{"crv":"Ed25519","kty":"OKP","x":"` + base64.RawURLEncoding.EncodeToString(publicKey) + `"}`
+	thumbprint := sha256.Sum256([]byte(jwk))
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint[:])
+}
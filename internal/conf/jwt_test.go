@@ -0,0 +1,190 @@
+package conf
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rfc8037PrivateKey is the Ed25519 key of RFC 8037, Appendix A.1.
+func rfc8037PrivateKey(t *testing.T) ed25519.PrivateKey {
+	seed, err := base64.RawURLEncoding.DecodeString("nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A")
+	require.NoError(t, err)
+
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+func TestJWTConfigurationValidate(t *testing.T) {
+	privateKey := rfc8037PrivateKey(t)
+
+	encoded, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+
+	validExamples := []*JWTConfiguration{
+		{},
+		{Algorithm: JWTAlgorithmHS256},
+		{Algorithm: JWTAlgorithmEdDSA, PrivateKey: base64.StdEncoding.EncodeToString(encoded)},
+		{AudienceIssuers: map[string]string{"app-a": "https://a.example.com"}},
+		{Aud: "authenticated", AllowedAudiences: []string{"app-a"}, AudienceIssuers: map[string]string{"authenticated": "https://example.com", "app-a": "https://a.example.com"}},
+		{ExpiryByGrant: map[string]int{"password": 86400}},
+	}
+
+	for i, example := range validExamples {
+		require.NoError(t, example.Validate(), "Valid example %d was regarded as invalid", i)
+	}
+
+	invalidExamples := []*JWTConfiguration{
+		{Algorithm: "RS256"},
+		{Algorithm: JWTAlgorithmEdDSA},
+		{Algorithm: JWTAlgorithmEdDSA, PrivateKey: "InvalidBase64!"},
+		{Algorithm: JWTAlgorithmEdDSA, PrivateKey: base64.StdEncoding.EncodeToString([]byte("not PKCS#8"))},
+		// the PKCS#8 encoding of an RSA key
+		{Algorithm: JWTAlgorithmEdDSA, PrivateKey: "MIIBVAIBADANBgkqhkiG9w0BAQEFAASCAT4wggE6AgEAAkEArPXQPtqcr1yvFsZN" +
+			"Kre9Gzedou9pvHuViAagZHZJeJBfbwzZVk7TH4JTqeArJ0THU039P0J0N+NBtjZD" +
+			"Nfh4GQIDAQABAkAA7YvhqnHIwKokm+++2Oy0zRMvB2XKOXq15IM1YF6u8BhKFt/4" +
+			"Vi9OO/OlnYwfkr9hygyOHCoYuBBT9SJBcPs5AiEAyf+C7eXR0Xtvum28aYDPWI40" +
+			"aMP/9UbsCsa4mwetFNcCIQDbMvyf//T3bwZz+ufzgpWltvPCYbBvJ0+SXo3PqXZM" +
+			"jwIgG8CLEHw+s3UuCIMDG8uisRv4f1xOUjiIPYLH4iTP1skCIGW7NCPN1xM/I++P" +
+			"8zbA1FMkpd0BGbF8vSFhYM+QBqdhAiEAowkj1iMi8isWj6lbQ+IJ/stAbzweo4sO" +
+			"Ld6Y5CjjlPc="},
+		{Aud: "authenticated", AllowedAudiences: []string{"app-a"}, AudienceIssuers: map[string]string{"app-b": "https://b.example.com"}},
+		{ExpiryByGrant: map[string]int{"password": 0}},
+	}
+
+	for i, example := range invalidExamples {
+		require.Error(t, example.Validate(), "Invalid example %d was regarded as valid", i)
+	}
+}
+
+func TestJWTConfigurationAudiences(t *testing.T) {
+	c := &JWTConfiguration{
+		Aud:    "authenticated",
+		Issuer: "https://example.com",
+	}
+
+	require.True(t, c.IsAllowedAudience("authenticated"))
+	require.True(t, c.IsAllowedAudience("app-a"))
+	require.Equal(t, "https://example.com", c.IssuerForAudience("app-a"))
+
+	c.AllowedAudiences = []string{"app-a"}
+	c.AudienceIssuers = map[string]string{"app-a": "https://a.example.com"}
+
+	require.True(t, c.IsAllowedAudience("authenticated"))
+	require.True(t, c.IsAllowedAudience("app-a"))
+	require.False(t, c.IsAllowedAudience("app-b"))
+	require.Equal(t, "https://a.example.com", c.IssuerForAudience("app-a"))
+	require.Equal(t, "https://example.com", c.IssuerForAudience("authenticated"))
+}
+
+func TestJWTConfigurationExpForGrant(t *testing.T) {
+	c := &JWTConfiguration{
+		Exp:           3600,
+		ExpiryByGrant: map[string]int{"password": 86400},
+	}
+
+	require.Equal(t, 86400, c.ExpForGrant("password"))
+	require.Equal(t, 3600, c.ExpForGrant("oauth"))
+	require.Equal(t, 3600, c.ExpForGrant(""))
+}
+
+func TestJWTConfigurationRoleForUser(t *testing.T) {
+	c := &JWTConfiguration{
+		AdminRoles: []string{"service_role", "supabase_admin"},
+	}
+
+	require.Equal(t, "authenticated", c.RoleForUser("authenticated", map[string]interface{}{"role": "editor"}), "roles aren't mapped unless configured")
+	require.Equal(t, "", c.RoleForUser("", nil))
+
+	c.RoleAppMetadataKey = "role"
+	c.DefaultGroupName = "member"
+
+	require.Equal(t, "editor", c.RoleForUser("authenticated", map[string]interface{}{"role": "editor"}))
+	require.Equal(t, "authenticated", c.RoleForUser("authenticated", map[string]interface{}{}))
+	require.Equal(t, "authenticated", c.RoleForUser("authenticated", map[string]interface{}{"role": 42}))
+	require.Equal(t, "authenticated", c.RoleForUser("authenticated", map[string]interface{}{"role": "service_role"}), "admin roles are never mapped")
+	require.Equal(t, "member", c.RoleForUser("", nil))
+}
+
+func TestJWTConfigurationPopulateFields(t *testing.T) {
+	privateKey := rfc8037PrivateKey(t)
+
+	encoded, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+
+	c := &JWTConfiguration{
+		Algorithm:  JWTAlgorithmEdDSA,
+		PrivateKey: base64.StdEncoding.EncodeToString(encoded),
+	}
+	require.NoError(t, c.PopulateFields())
+	require.Equal(t, privateKey, c.SigningKey)
+
+	// the thumbprint of RFC 8037, Appendix A.3
+	require.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", c.KeyID)
+
+	// configured key IDs are kept
+	c.KeyID = "configured"
+	require.NoError(t, c.PopulateFields())
+	require.Equal(t, "configured", c.KeyID)
+
+	// symmetric algorithms have no signing key
+	c = &JWTConfiguration{Algorithm: JWTAlgorithmHS256}
+	require.NoError(t, c.PopulateFields())
+	require.Nil(t, c.SigningKey)
+}
+
+func TestJWTConfigurationRetiredKeys(t *testing.T) {
+	privateKey := rfc8037PrivateKey(t)
+
+	encodedPrivateKey, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+
+	retiredPublicKey, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	encodedPublicKey, err := x509.MarshalPKIXPublicKey(retiredPublicKey)
+	require.NoError(t, err)
+
+	var retiredKeys JWTRetiredKeys
+	require.NoError(t, retiredKeys.Decode(`[
+		{"public_key": "`+base64.StdEncoding.EncodeToString(encodedPublicKey)+`", "expires_at": "2023-10-14T12:00:00Z"},
+		{"kid": "unexpiring", "public_key": "`+base64.StdEncoding.EncodeToString(encodedPublicKey)+`"}
+	]`))
+	require.Error(t, retiredKeys.Decode(`{}`))
+
+	c := &JWTConfiguration{
+		Algorithm:   JWTAlgorithmEdDSA,
+		PrivateKey:  base64.StdEncoding.EncodeToString(encodedPrivateKey),
+		RetiredKeys: retiredKeys,
+	}
+	require.NoError(t, c.Validate())
+	require.NoError(t, c.PopulateFields())
+
+	require.Equal(t, Ed25519KeyThumbprint(retiredPublicKey), c.RetiredKeys[0].KeyID)
+	require.Equal(t, retiredPublicKey, c.RetiredKeys[0].Key)
+	require.Equal(t, "unexpiring", c.RetiredKeys[1].KeyID)
+
+	expiresAt := c.RetiredKeys[0].ExpiresAt
+
+	publicKeys := c.PublicKeys(expiresAt.Add(-time.Second))
+	require.Len(t, publicKeys, 3)
+	require.Equal(t, c.KeyID, publicKeys[0].KeyID)
+	require.Equal(t, c.RetiredKeys[0].KeyID, publicKeys[1].KeyID)
+	require.Equal(t, "unexpiring", publicKeys[2].KeyID)
+
+	publicKeys = c.PublicKeys(expiresAt)
+	require.Len(t, publicKeys, 2)
+	require.Equal(t, c.KeyID, publicKeys[0].KeyID)
+	require.Equal(t, "unexpiring", publicKeys[1].KeyID)
+
+	// retired keys can't reuse the key ID of another key
+	c.RetiredKeys[1].KeyID = c.KeyID
+	require.Error(t, c.PopulateFields())
+
+	// retired keys must be Ed25519 public keys in PKIX format
+	c.RetiredKeys[1].PublicKey = base64.StdEncoding.EncodeToString(encodedPrivateKey)
+	require.Error(t, c.Validate())
+}
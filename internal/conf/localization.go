@@ -0,0 +1,146 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// LocalizationConfiguration holds the localized email and SMS templates.
+type LocalizationConfiguration struct {
+	// DefaultLocale is used for users without a locale, or with a locale
+	// that has no templates.
+	DefaultLocale string `json:"default_locale" split_words:"true" default:"en"`
+
+	// TemplatesPath is a directory with a subdirectory of templates for
+	// each locale, e.g. <path>/de/confirmation.html.
+	TemplatesPath string `json:"templates_path" split_words:"true"`
+
+	// Locales holds the templates of each locale, loaded from
+	// TemplatesPath.
+	Locales map[string]LocaleTemplates `json:"-"`
+}
+
+// LocaleTemplates holds the templates of a locale. Empty templates fall back
+// to the configured or default templates.
+type LocaleTemplates struct {
+	Templates EmailContentConfiguration
+	Subjects  EmailContentConfiguration
+	SMS       *template.Template
+}
+
+// CanonicalLocale returns the locale, e.g. "pt-br", in its canonical form
+// "pt-BR", or false if it is not a valid locale.
+func CanonicalLocale(locale string) (string, bool) {
+	if !localePattern.MatchString(locale) {
+		return "", false
+	}
+
+	subtags := strings.Split(locale, "-")
+	subtags[0] = strings.ToLower(subtags[0])
+
+	for i := 1; i < len(subtags); i++ {
+		switch len(subtags[i]) {
+		case 2:
+			// region, e.g. BR
+			subtags[i] = strings.ToUpper(subtags[i])
+
+		case 4:
+			// script, e.g. Hant
+			subtags[i] = strings.ToUpper(subtags[i][:1]) + strings.ToLower(subtags[i][1:])
+
+		default:
+			subtags[i] = strings.ToLower(subtags[i])
+		}
+	}
+
+	return strings.Join(subtags, "-"), true
+}
+
+func (c *LocalizationConfiguration) Validate() error {
+	if _, ok := CanonicalLocale(c.DefaultLocale); !ok {
+		return fmt.Errorf("localization: invalid default locale %q", c.DefaultLocale)
+	}
+
+	return nil
+}
+
+// LoadTemplates reads the templates of every locale in TemplatesPath.
+func (c *LocalizationConfiguration) LoadTemplates() error {
+	if c.TemplatesPath == "" {
+		return nil
+	}
+
+	locales, err := os.ReadDir(c.TemplatesPath)
+	if err != nil {
+		return fmt.Errorf("localization templates: %w", err)
+	}
+
+	c.Locales = make(map[string]LocaleTemplates)
+
+	for _, entry := range locales {
+		if !entry.IsDir() {
+			continue
+		}
+
+		locale, ok := CanonicalLocale(entry.Name())
+		if !ok {
+			return fmt.Errorf("localization templates: invalid locale %q", entry.Name())
+		}
+
+		dir := filepath.Join(c.TemplatesPath, entry.Name())
+
+		templates := LocaleTemplates{}
+
+		if templates.Templates, err = loadEmailContent(dir, ".html", parseHTMLTemplate); err != nil {
+			return fmt.Errorf("localization templates: %w", err)
+		}
+
+		if templates.Subjects, err = loadEmailContent(dir, ".subject", parseTextTemplate); err != nil {
+			return fmt.Errorf("localization templates: %w", err)
+		}
+
+		sms, err := readTemplateFile(filepath.Join(dir, "sms.txt"), parseTextTemplate)
+		if err != nil {
+			return fmt.Errorf("localization templates: %w", err)
+		}
+
+		if sms != "" {
+			templates.SMS = template.Must(template.New("").Parse(sms))
+		}
+
+		c.Locales[locale] = templates
+	}
+
+	return nil
+}
+
+// Resolve returns the locale whose templates are used for a user's locale
+// and its templates. It falls back from a regional locale, e.g. "pt-BR", to
+// its language "pt" and then to the default locale.
+func (c *LocalizationConfiguration) Resolve(locale string) (string, LocaleTemplates) {
+	candidates := []string{}
+
+	if canonical, ok := CanonicalLocale(locale); ok {
+		candidates = append(candidates, canonical)
+
+		if language, _, found := strings.Cut(canonical, "-"); found {
+			candidates = append(candidates, language)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if templates, ok := c.Locales[candidate]; ok {
+			return candidate, templates
+		}
+	}
+
+	defaultLocale, _ := CanonicalLocale(c.DefaultLocale)
+
+	return defaultLocale, c.Locales[defaultLocale]
+}
@@ -0,0 +1,81 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalLocale(t *testing.T) {
+	cases := []struct {
+		locale   string
+		expected string
+		valid    bool
+	}{
+		{"en", "en", true},
+		{"DE", "de", true},
+		{"pt-br", "pt-BR", true},
+		{"zh-hant-tw", "zh-Hant-TW", true},
+		{"", "", false},
+		{"e", "", false},
+		{"en_US", "", false},
+		{"../en", "", false},
+	}
+
+	for _, c := range cases {
+		locale, valid := CanonicalLocale(c.locale)
+		assert.Equal(t, c.valid, valid, c.locale)
+		assert.Equal(t, c.expected, locale, c.locale)
+	}
+}
+
+func TestLocalizationConfigurationLoadTemplates(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, locale := range []string{"en", "pt", "pt-BR"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, locale), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, locale, "confirmation.html"), []byte(locale+`: {{ .ConfirmationURL }}`), 0o600))
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pt", "confirmation.subject"), []byte("Confirme seu email"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pt", "sms.txt"), []byte("Seu código é {{ .Code }}"), 0o600))
+
+	config := LocalizationConfiguration{DefaultLocale: "en", TemplatesPath: dir}
+	require.NoError(t, config.LoadTemplates())
+
+	cases := []struct {
+		locale   string
+		resolved string
+	}{
+		{"pt-BR", "pt-BR"},
+		{"PT-br", "pt-BR"},
+		{"pt-PT", "pt"},
+		{"pt", "pt"},
+		{"de", "en"},
+		{"", "en"},
+	}
+
+	for _, c := range cases {
+		locale, templates := config.Resolve(c.locale)
+		assert.Equal(t, c.resolved, locale, c.locale)
+		assert.Equal(t, c.resolved+`: {{ .ConfirmationURL }}`, templates.Templates.Confirmation, c.locale)
+	}
+
+	_, templates := config.Resolve("pt")
+	assert.Equal(t, "Confirme seu email", templates.Subjects.Confirmation)
+	require.NotNil(t, templates.SMS)
+
+	// a default locale without templates uses the configured templates
+	config.DefaultLocale = "fr"
+	locale, templates := config.Resolve("de")
+	assert.Equal(t, "fr", locale)
+	assert.Equal(t, LocaleTemplates{}, templates)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "en", "sms.txt"), []byte("{{ .Code "), 0o600))
+
+	config = LocalizationConfiguration{DefaultLocale: "en", TemplatesPath: dir}
+	require.ErrorContains(t, config.LoadTemplates(), "sms.txt")
+}
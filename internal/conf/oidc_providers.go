@@ -0,0 +1,246 @@
+package conf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// oidcProviderNamePattern restricts the names of the providers defined in a
+// providers directory, which are taken from the file names.
+var oidcProviderNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+type oidcProviderFile struct {
+	modTime  time.Time
+	size     int64
+	name     string
+	provider *OAuthProviderConfiguration
+}
+
+// OIDCProviderDirectory holds the OIDC providers defined by the JSON (.json)
+// or YAML (.yaml, .yml) files of a directory, one provider per file, named
+// after the file without its extension. Each file has the same fields as the
+// configuration of a built in provider, such as issuer, client_id, secret,
+// redirect_uri, scopes and claims_mapping, and is enabled unless it sets
+// enabled to false.
+type OIDCProviderDirectory struct {
+	path     string
+	builtins map[string]*OAuthProviderConfiguration
+
+	mu    sync.RWMutex
+	files map[string]oidcProviderFile
+}
+
+// LoadOIDCProviderDirectory loads the providers defined in the directory.
+// Providers can't have the name of a built in provider. Files that fail to
+// load are reported in the returned error, while the other providers are
+// loaded regardless. No directory is returned if it can't be read.
+func LoadOIDCProviderDirectory(path string, builtins map[string]*OAuthProviderConfiguration) (*OIDCProviderDirectory, error) {
+	if info, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("unable to read providers directory: %w", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("providers directory %q is not a directory", path)
+	}
+
+	d := &OIDCProviderDirectory{
+		path:     path,
+		builtins: builtins,
+		files:    make(map[string]oidcProviderFile),
+	}
+
+	if err := d.Reload(); err != nil {
+		return d, err
+	}
+
+	return d, nil
+}
+
+// Reload loads the files of the directory that were added or changed since
+// they were last loaded, and removes the providers whose files were removed.
+// A file that fails to load keeps the provider it defined before, if any, so
+// that a partially written file doesn't remove the provider.
+func (d *OIDCProviderDirectory) Reload() error {
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return fmt.Errorf("unable to read providers directory: %w", err)
+	}
+
+	d.mu.RLock()
+	previous := d.files
+	d.mu.RUnlock()
+
+	files := make(map[string]oidcProviderFile, len(entries))
+	names := make(map[string]string, len(entries))
+
+	var failures []string
+
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".json" && ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", entry.Name(), err))
+			continue
+		}
+
+		file, ok := previous[entry.Name()]
+		if !ok || !file.modTime.Equal(info.ModTime()) || file.size != info.Size() {
+			loaded, err := d.loadFile(entry.Name(), info)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", entry.Name(), err))
+
+				if !ok {
+					continue
+				}
+			} else {
+				file = loaded
+			}
+		}
+
+		if other, ok := names[file.name]; ok {
+			failures = append(failures, fmt.Sprintf("%s: provider %q is already defined by %s", entry.Name(), file.name, other))
+			continue
+		}
+
+		names[file.name] = entry.Name()
+		files[entry.Name()] = file
+	}
+
+	d.mu.Lock()
+	d.files = files
+	d.mu.Unlock()
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return fmt.Errorf("unable to load providers: %s", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+func (d *OIDCProviderDirectory) loadFile(fileName string, info os.FileInfo) (oidcProviderFile, error) {
+	name := strings.ToLower(strings.TrimSuffix(fileName, filepath.Ext(fileName)))
+	if !oidcProviderNamePattern.MatchString(name) {
+		return oidcProviderFile{}, fmt.Errorf("provider name %q must only contain lowercase letters, digits, _ and -", name)
+	}
+
+	if _, ok := d.builtins[name]; ok {
+		return oidcProviderFile{}, fmt.Errorf("provider name %q is reserved for a built in provider", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(d.path, fileName))
+	if err != nil {
+		return oidcProviderFile{}, err
+	}
+
+	// the fields of both formats are named by their JSON tags
+	var values map[string]interface{}
+	if ext := strings.ToLower(filepath.Ext(fileName)); ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(data, &values)
+	} else {
+		err = json.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return oidcProviderFile{}, err
+	}
+
+	// like in the environment, lists can be a comma separated string
+	for _, key := range []string{"client_id", "web_client_id", "scopes"} {
+		if clientID, ok := values[key].(string); ok {
+			values[key] = strings.Split(clientID, ",")
+		}
+	}
+
+	if data, err = json.Marshal(values); err != nil {
+		return oidcProviderFile{}, err
+	}
+
+	provider := &OAuthProviderConfiguration{Enabled: true}
+	if err := json.Unmarshal(data, provider); err != nil {
+		return oidcProviderFile{}, err
+	}
+
+	if err := provider.validateOIDCProvider(name); err != nil {
+		return oidcProviderFile{}, err
+	}
+
+	return oidcProviderFile{
+		modTime:  info.ModTime(),
+		size:     info.Size(),
+		name:     name,
+		provider: provider,
+	}, nil
+}
+
+func (o *OAuthProviderConfiguration) validateOIDCProvider(name string) error {
+	if o.Issuer == "" {
+		return errors.New("issuer is required")
+	}
+
+	if u, err := url.Parse(o.Issuer); err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("issuer must be an https URL")
+	}
+
+	if len(o.ClientID) == 0 {
+		return errors.New("client_id is required")
+	}
+
+	return o.validate(name)
+}
+
+// Provider returns the provider with the name, or nil if there is none.
+func (d *OIDCProviderDirectory) Provider(name string) *OAuthProviderConfiguration {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, file := range d.files {
+		if file.name == name {
+			return file.provider
+		}
+	}
+
+	return nil
+}
+
+// ProviderByIssuer returns the name and the provider with the issuer, or nil
+// if there is none.
+func (d *OIDCProviderDirectory) ProviderByIssuer(issuer string) (string, *OAuthProviderConfiguration) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, file := range d.files {
+		if file.provider.Issuer == issuer {
+			return file.name, file.provider
+		}
+	}
+
+	return "", nil
+}
+
+// Names returns the names of the providers, sorted.
+func (d *OIDCProviderDirectory) Names() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	names := make([]string, 0, len(d.files))
+	for _, file := range d.files {
+		names = append(names, file.name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,185 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeOIDCProviderFile(t *testing.T, dir, name, contents string) {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+
+	// make sure a rewritten file is detected even if the file system's
+	// modification times are coarse
+	modTime := time.Now().Add(time.Duration(len(contents)) * time.Second)
+	if info, err := os.Stat(path); err == nil && !info.ModTime().Before(modTime) {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestLoadOIDCProviderDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	writeOIDCProviderFile(t, dir, "acme.json", `{
+		"issuer": "https://acme.example.com",
+		"client_id": ["acme-client", "acme-ios"],
+		"secret": "acme-secret",
+		"redirect_uri": "https://auth.example.com/callback",
+		"claims_mapping": {"name": "display_name"}
+	}`)
+	writeOIDCProviderFile(t, dir, "Corp.yaml", `
+issuer: https://corp.example.com/realms/main
+client_id: corp-client
+scopes: groups,offline_access
+enabled: false
+`)
+	writeOIDCProviderFile(t, dir, "README.md", "not a provider")
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "nested.json"), 0700))
+
+	d, err := LoadOIDCProviderDirectory(dir, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"acme", "corp"}, d.Names())
+
+	acme := d.Provider("acme")
+	require.NotNil(t, acme)
+	require.True(t, acme.Enabled)
+	require.Equal(t, "https://acme.example.com", acme.Issuer)
+	require.Equal(t, []string{"acme-client", "acme-ios"}, acme.ClientID)
+	require.Equal(t, "acme-secret", acme.Secret)
+	require.Equal(t, "display_name", acme.ClaimsMapping["name"])
+
+	corp := d.Provider("corp")
+	require.NotNil(t, corp)
+	require.False(t, corp.Enabled)
+	require.Equal(t, []string{"corp-client"}, corp.ClientID)
+
+	name, p := d.ProviderByIssuer("https://corp.example.com/realms/main")
+	require.Equal(t, "corp", name)
+	require.Equal(t, corp, p)
+
+	name, p = d.ProviderByIssuer("https://unknown.example.com")
+	require.Empty(t, name)
+	require.Nil(t, p)
+
+	require.Nil(t, d.Provider("unknown"))
+
+	_, err = LoadOIDCProviderDirectory(filepath.Join(dir, "missing"), nil)
+	require.Error(t, err)
+
+	_, err = LoadOIDCProviderDirectory(filepath.Join(dir, "acme.json"), nil)
+	require.Error(t, err)
+}
+
+func TestOIDCProviderDirectoryReload(t *testing.T) {
+	dir := t.TempDir()
+
+	writeOIDCProviderFile(t, dir, "acme.json", `{"issuer": "https://acme.example.com", "client_id": "acme-client"}`)
+
+	d, err := LoadOIDCProviderDirectory(dir, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"acme"}, d.Names())
+
+	// added files register new providers
+	writeOIDCProviderFile(t, dir, "corp.yml", "issuer: https://corp.example.com\nclient_id: corp-client\n")
+	require.NoError(t, d.Reload())
+	require.Equal(t, []string{"acme", "corp"}, d.Names())
+
+	// unchanged files keep their provider
+	acme := d.Provider("acme")
+	require.NoError(t, d.Reload())
+	require.Same(t, acme, d.Provider("acme"))
+
+	// changed files replace their provider
+	writeOIDCProviderFile(t, dir, "acme.json", `{"issuer": "https://login.acme.example.com", "client_id": "acme-client"}`)
+	require.NoError(t, d.Reload())
+	require.Equal(t, "https://login.acme.example.com", d.Provider("acme").Issuer)
+
+	// removed files remove their provider
+	require.NoError(t, os.Remove(filepath.Join(dir, "corp.yml")))
+	require.NoError(t, d.Reload())
+	require.Equal(t, []string{"acme"}, d.Names())
+	require.Nil(t, d.Provider("corp"))
+}
+
+func TestOIDCProviderDirectoryMalformedFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	writeOIDCProviderFile(t, dir, "acme.json", `{"issuer": "https://acme.example.com", "client_id": "acme-client"}`)
+	writeOIDCProviderFile(t, dir, "syntax.json", `{"issuer": `)
+	writeOIDCProviderFile(t, dir, "indentation.yaml", "issuer: https://indentation.example.com\n  client_id: client\n")
+	writeOIDCProviderFile(t, dir, "no-issuer.json", `{"client_id": "client"}`)
+	writeOIDCProviderFile(t, dir, "http-issuer.json", `{"issuer": "http://insecure.example.com", "client_id": "client"}`)
+	writeOIDCProviderFile(t, dir, "no-client.json", `{"issuer": "https://no-client.example.com"}`)
+	writeOIDCProviderFile(t, dir, "bad name.json", `{"issuer": "https://bad-name.example.com", "client_id": "client"}`)
+	writeOIDCProviderFile(t, dir, "keycloak.json", `{"issuer": "https://keycloak.example.com", "client_id": "client"}`)
+	writeOIDCProviderFile(t, dir, "acme.yaml", "issuer: https://other-acme.example.com\nclient_id: client\n")
+
+	builtins := map[string]*OAuthProviderConfiguration{
+		"keycloak": {},
+	}
+
+	d, err := LoadOIDCProviderDirectory(dir, builtins)
+	require.Error(t, err)
+	require.NotNil(t, d)
+
+	for _, fileName := range []string{"syntax.json", "indentation.yaml", "no-issuer.json", "http-issuer.json", "no-client.json", "bad name.json", "keycloak.json", "acme.yaml"} {
+		require.Contains(t, err.Error(), fileName)
+	}
+
+	// the valid providers are loaded regardless
+	require.Equal(t, []string{"acme"}, d.Names())
+	require.Equal(t, "https://acme.example.com", d.Provider("acme").Issuer)
+
+	for _, fileName := range []string{"syntax.json", "indentation.yaml", "no-issuer.json", "http-issuer.json", "no-client.json", "bad name.json", "keycloak.json", "acme.yaml"} {
+		require.NoError(t, os.Remove(filepath.Join(dir, fileName)))
+	}
+	require.NoError(t, d.Reload())
+
+	// a file that becomes malformed keeps its previous provider
+	writeOIDCProviderFile(t, dir, "acme.json", `{"issuer": "https://acme.exam`)
+	require.Error(t, d.Reload())
+	require.Equal(t, "https://acme.example.com", d.Provider("acme").Issuer)
+
+	writeOIDCProviderFile(t, dir, "acme.json", `{"issuer": "https://login.acme.example.com", "client_id": "acme-client"}`)
+	require.NoError(t, d.Reload())
+	require.Equal(t, "https://login.acme.example.com", d.Provider("acme").Issuer)
+}
+
+func TestProviderConfigurationLoadOIDCProviders(t *testing.T) {
+	dir := t.TempDir()
+	writeOIDCProviderFile(t, dir, "acme.json", `{"issuer": "https://acme.example.com", "client_id": "acme-client"}`)
+
+	c := &ProviderConfiguration{}
+	require.NoError(t, c.LoadOIDCProviders())
+	require.Nil(t, c.OIDCProviders)
+	require.Nil(t, c.OAuthProvider("acme"))
+
+	c.ProvidersDirectory = dir
+	require.NoError(t, c.LoadOIDCProviders())
+	require.NotNil(t, c.OIDCProviders)
+
+	require.Equal(t, "https://acme.example.com", c.OAuthProvider("acme").Issuer)
+	require.NotNil(t, c.OAuthProvider("keycloak"))
+
+	name, p := c.DirectoryOIDCProvider("acme", "")
+	require.Equal(t, "acme", name)
+	require.NotNil(t, p)
+
+	name, p = c.DirectoryOIDCProvider("", "https://acme.example.com")
+	require.Equal(t, "acme", name)
+	require.NotNil(t, p)
+
+	// built in providers aren't returned
+	_, p = c.DirectoryOIDCProvider("keycloak", "")
+	require.Nil(t, p)
+
+	// an unreadable directory keeps the previously loaded providers
+	c.ProvidersDirectory = filepath.Join(dir, "missing")
+	require.Error(t, c.LoadOIDCProviders())
+	require.NotNil(t, c.OAuthProvider("acme"))
+}
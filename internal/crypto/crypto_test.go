@@ -0,0 +1,121 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/conf"
+)
+
+func TestGenerateOtp(t *testing.T) {
+	for _, digits := range []int{6, 8, 10} {
+		otp, err := GenerateOtp(digits)
+		require.NoError(t, err)
+		require.Len(t, otp, digits)
+
+		for _, r := range otp {
+			require.True(t, r >= '0' && r <= '9', "otp %q contains a non-digit", otp)
+		}
+	}
+}
+
+func TestEncryptString(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	encrypted, err := EncryptString(key, "provider-refresh-token")
+	require.NoError(t, err)
+	require.NotContains(t, encrypted, "provider-refresh-token")
+
+	// every encryption uses a new nonce
+	other, err := EncryptString(key, "provider-refresh-token")
+	require.NoError(t, err)
+	require.NotEqual(t, encrypted, other)
+
+	decrypted, err := DecryptString(key, encrypted)
+	require.NoError(t, err)
+	require.Equal(t, "provider-refresh-token", decrypted)
+
+	_, err = DecryptString([]byte("fedcba9876543210fedcba9876543210"), encrypted)
+	require.Error(t, err)
+
+	_, err = DecryptString(key, "InvalidBase64!")
+	require.Error(t, err)
+
+	_, err = DecryptString(key, "c2hvcnQ=")
+	require.Error(t, err)
+
+	_, err = EncryptString([]byte("short"), "provider-refresh-token")
+	require.Error(t, err)
+}
+
+func useEncryption(t *testing.T, config *conf.SecurityConfiguration) {
+	require.NoError(t, ConfigureEncryption(config))
+
+	t.Cleanup(func() {
+		require.NoError(t, ConfigureEncryption(&conf.SecurityConfiguration{}))
+	})
+}
+
+func TestEncrypt(t *testing.T) {
+	_, err := Encrypt("claims")
+	require.Error(t, err, "encryption is disabled without a key")
+
+	useEncryption(t, &conf.SecurityConfiguration{
+		EncryptionKey:   "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		EncryptionKeyID: "key-1",
+	})
+	require.True(t, EncryptionEnabled())
+
+	encrypted, err := Encrypt("claims")
+	require.NoError(t, err)
+	require.True(t, IsEncrypted(encrypted))
+	require.True(t, strings.HasPrefix(encrypted, "enc:key-1:"))
+
+	decrypted, err := Decrypt(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, "claims", decrypted)
+
+	require.False(t, IsEncrypted("claims"))
+	_, err = Decrypt("claims")
+	require.Error(t, err)
+
+	_, err = Decrypt("enc:unknown-key:" + strings.TrimPrefix(encrypted, "enc:key-1:"))
+	require.Error(t, err)
+}
+
+func TestEncryptKeyRotation(t *testing.T) {
+	useEncryption(t, &conf.SecurityConfiguration{
+		EncryptionKey:   "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		EncryptionKeyID: "key-1",
+	})
+
+	old, err := Encrypt("claims")
+	require.NoError(t, err)
+
+	// rotate the key, keeping the previous one for decryption
+	useEncryption(t, &conf.SecurityConfiguration{
+		EncryptionKey:   "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=",
+		EncryptionKeyID: "key-2",
+		DecryptionKeys:  map[string]string{"key-1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="},
+	})
+
+	encrypted, err := Encrypt("claims")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(encrypted, "enc:key-2:"))
+
+	for _, value := range []string{old, encrypted} {
+		decrypted, err := Decrypt(value)
+		require.NoError(t, err)
+		require.Equal(t, "claims", decrypted)
+	}
+
+	// values of removed keys can't be decrypted anymore
+	useEncryption(t, &conf.SecurityConfiguration{
+		EncryptionKey:   "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=",
+		EncryptionKeyID: "key-2",
+	})
+
+	_, err = Decrypt(old)
+	require.Error(t, err)
+}
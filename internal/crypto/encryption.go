@@ -0,0 +1,78 @@
+package crypto
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/supabase/gotrue/internal/conf"
+)
+
+// encryptedValuePrefix starts values encrypted by Encrypt, followed by the ID
+// of the key that encrypted them.
+const encryptedValuePrefix = "enc:"
+
+// EncryptionKeyID is the ID of the key used by Encrypt. Values are only
+// encrypted if it's set.
+var EncryptionKeyID string
+
+// EncryptionKeys are the keys, by ID, that Decrypt can decrypt values with.
+var EncryptionKeys = map[string][]byte{}
+
+// ConfigureEncryption sets the keys used to encrypt and decrypt sensitive
+// values at rest from the security configuration.
+func ConfigureEncryption(config *conf.SecurityConfiguration) error {
+	keys, err := config.EncryptionKeys()
+	if err != nil {
+		return err
+	}
+
+	EncryptionKeys = keys
+	EncryptionKeyID = ""
+	if config.EncryptionKey != "" {
+		EncryptionKeyID = config.EncryptionKeyID
+	}
+
+	return nil
+}
+
+// EncryptionEnabled reports whether Encrypt encrypts values.
+func EncryptionEnabled() bool {
+	return EncryptionKeyID != ""
+}
+
+// Encrypt encrypts the value with the current encryption key, tagging it
+// with the key's ID.
+func Encrypt(value string) (string, error) {
+	key, ok := EncryptionKeys[EncryptionKeyID]
+	if !EncryptionEnabled() || !ok {
+		return "", errors.New("Encryption is not configured")
+	}
+
+	encrypted, err := EncryptString(key, value)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedValuePrefix + EncryptionKeyID + ":" + encrypted, nil
+}
+
+// IsEncrypted reports whether the value was encrypted by Encrypt.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedValuePrefix)
+}
+
+// Decrypt decrypts a value encrypted by Encrypt with the key it's tagged
+// with, which may be a previous encryption key.
+func Decrypt(value string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedValuePrefix), ":", 2)
+	if !IsEncrypted(value) || len(parts) != 2 {
+		return "", errors.New("Value is not encrypted")
+	}
+
+	key, ok := EncryptionKeys[parts[0]]
+	if !ok {
+		return "", errors.Errorf("Unknown encryption key %q", parts[0])
+	}
+
+	return DecryptString(key, parts[1])
+}
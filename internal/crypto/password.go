@@ -2,11 +2,18 @@ package crypto
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"strings"
 
+	"github.com/supabase/gotrue/internal/conf"
 	"github.com/supabase/gotrue/internal/observability"
 	"go.opentelemetry.io/otel/attribute"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -28,6 +35,80 @@ const (
 // GenerateHashFromPassword.
 var PasswordHashCost = DefaultHashCost
 
+type HashAlgorithm = string
+
+const (
+	// Bcrypt hashes passwords with bcrypt.
+	Bcrypt HashAlgorithm = "bcrypt"
+
+	// Argon2id hashes passwords with Argon2id, encoded in the PHC
+	// string format.
+	Argon2id HashAlgorithm = "argon2id"
+)
+
+// Argon2Params holds the tunable parameters of Argon2 hashes. Memory is in
+// KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Time        uint32
+	Parallelism uint8
+}
+
+// quickArgon2Params are the cheapest Argon2 parameters, used with
+// QuickHashCost.
+var quickArgon2Params = Argon2Params{
+	Memory:      64,
+	Time:        1,
+	Parallelism: 1,
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+
+	// the salts and hashes of imported hashes can be longer, up to
+	// these lengths
+	argon2MaxSaltLength = 64
+	argon2MaxKeyLength  = 64
+)
+
+// PasswordHashAlgorithm is the algorithm used for all new hashes
+// generated with GenerateFromPassword.
+var PasswordHashAlgorithm = Bcrypt
+
+// PasswordArgon2Params are the parameters used for all new Argon2id hashes
+// generated with GenerateFromPassword. The defaults follow the OWASP
+// recommendation.
+var PasswordArgon2Params = Argon2Params{
+	Memory:      19456,
+	Time:        2,
+	Parallelism: 1,
+}
+
+// ConfigurePasswordHashing sets the algorithm and parameters used for new
+// password hashes from the security configuration.
+func ConfigurePasswordHashing(config *conf.SecurityConfiguration) {
+	if config.PasswordHashAlgorithm != Argon2id {
+		PasswordHashAlgorithm = Bcrypt
+		return
+	}
+
+	PasswordHashAlgorithm = Argon2id
+	PasswordArgon2Params = Argon2Params{
+		Memory:      config.PasswordHashArgon2Memory,
+		Time:        config.PasswordHashArgon2Time,
+		Parallelism: config.PasswordHashArgon2Parallelism,
+	}
+}
+
+func currentArgon2Params() Argon2Params {
+	if PasswordHashCost == QuickHashCost {
+		return quickArgon2Params
+	}
+
+	return PasswordArgon2Params
+}
+
 var (
 	generateFromPasswordSubmittedCounter = observability.ObtainMetricCounter("gotrue_generate_from_password_submitted", "Number of submitted GenerateFromPassword hashing attempts")
 	generateFromPasswordCompletedCounter = observability.ObtainMetricCounter("gotrue_generate_from_password_completed", "Number of completed GenerateFromPassword hashing attempts")
@@ -38,10 +119,158 @@ var (
 	compareHashAndPasswordCompletedCounter = observability.ObtainMetricCounter("gotrue_compare_hash_and_password_completed", "Number of completed CompareHashAndPassword hashing attempts")
 )
 
+// ErrArgon2MismatchedHashAndPassword is returned by CompareHashAndPassword
+// when an Argon2 hash does not match the password.
+var ErrArgon2MismatchedHashAndPassword = errors.New("crypto: argon2 hash and password mismatch")
+
+// argon2HashInput holds the parameters of an Argon2 hash in the PHC string
+// format, e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+type argon2HashInput struct {
+	alg     string
+	v       int
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	hash    []byte
+}
+
+func isArgon2Hash(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2i$") || strings.HasPrefix(hash, "$argon2id$")
+}
+
+func parseArgon2Hash(hash string) (*argon2HashInput, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return nil, errors.New("crypto: argon2 hash is not in the PHC string format")
+	}
+
+	input := &argon2HashInput{
+		alg: parts[1],
+	}
+
+	if input.alg != "argon2i" && input.alg != "argon2id" {
+		return nil, fmt.Errorf("crypto: argon2 hash uses unsupported algorithm %q", input.alg)
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &input.v); err != nil {
+		return nil, errors.New("crypto: argon2 hash has an invalid version")
+	}
+
+	if input.v != argon2.Version {
+		return nil, fmt.Errorf("crypto: argon2 hash uses unsupported version %d", input.v)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &input.memory, &input.time, &input.threads); err != nil {
+		return nil, errors.New("crypto: argon2 hash has invalid parameters")
+	}
+
+	if input.memory == 0 || input.time == 0 || input.threads == 0 {
+		return nil, errors.New("crypto: argon2 hash has invalid parameters")
+	}
+
+	if input.memory > conf.MaxArgon2Memory || input.time > conf.MaxArgon2Time || input.threads > conf.MaxArgon2Parallelism {
+		return nil, errors.New("crypto: argon2 hash parameters exceed the maximum")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) > argon2MaxSaltLength {
+		return nil, errors.New("crypto: argon2 hash has an invalid salt")
+	}
+
+	rawHash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(rawHash) == 0 || len(rawHash) > argon2MaxKeyLength {
+		return nil, errors.New("crypto: argon2 hash has an invalid hash")
+	}
+
+	input.salt = salt
+	input.hash = rawHash
+
+	return input, nil
+}
+
+func compareHashAndPasswordArgon2(ctx context.Context, hash, password string) error {
+	input, err := parseArgon2Hash(hash)
+	if err != nil {
+		return err
+	}
+
+	attributes := []attribute.KeyValue{
+		attribute.String("alg", input.alg),
+		attribute.Int("argon2_m", int(input.memory)),
+		attribute.Int("argon2_t", int(input.time)),
+		attribute.Int("argon2_p", int(input.threads)),
+	}
+
+	compareHashAndPasswordSubmittedCounter.Add(ctx, 1, attributes...)
+	defer func() {
+		attributes = append(attributes, attribute.Bool(
+			"match",
+			!errors.Is(err, ErrArgon2MismatchedHashAndPassword),
+		))
+
+		compareHashAndPasswordCompletedCounter.Add(ctx, 1, attributes...)
+	}()
+
+	var derivedKey []byte
+
+	switch input.alg {
+	case "argon2i":
+		derivedKey = argon2.Key([]byte(password), input.salt, input.time, input.memory, input.threads, uint32(len(input.hash)))
+
+	case "argon2id":
+		derivedKey = argon2.IDKey([]byte(password), input.salt, input.time, input.memory, input.threads, uint32(len(input.hash)))
+	}
+
+	if subtle.ConstantTimeCompare(derivedKey, input.hash) != 1 {
+		err = ErrArgon2MismatchedHashAndPassword
+	}
+
+	return err
+}
+
+// NeedsRehash reports whether hash was not generated with the current
+// PasswordHashAlgorithm, or for Argon2id with the current parameters, so
+// that it should be replaced after the password has been verified.
+func NeedsRehash(hash string) bool {
+	if PasswordHashAlgorithm != Argon2id {
+		return isArgon2Hash(hash)
+	}
+
+	input, err := parseArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+
+	params := currentArgon2Params()
+
+	return input.alg != Argon2id ||
+		input.memory != params.Memory ||
+		input.time != params.Time ||
+		input.threads != params.Parallelism
+}
+
+// ValidatePasswordHash checks that hash is a bcrypt or Argon2 (PHC string
+// format) password hash that CompareHashAndPassword can verify.
+func ValidatePasswordHash(hash string) error {
+	if isArgon2Hash(hash) {
+		_, err := parseArgon2Hash(hash)
+		return err
+	}
+
+	_, err := bcrypt.Cost([]byte(hash))
+	return err
+}
+
 // CompareHashAndPassword compares the hash and
-// password, returns nil if equal otherwise an error. Context can be used to
-// cancel the hashing if the algorithm supports it.
+// password, returns nil if equal otherwise an error. Hashes can be bcrypt or
+// Argon2 in the PHC string format. Context can be used to cancel the hashing
+// if the algorithm supports it.
 func CompareHashAndPassword(ctx context.Context, hash, password string) error {
+	if isArgon2Hash(hash) {
+		return compareHashAndPasswordArgon2(ctx, hash, password)
+	}
+
 	hashCost, err := bcrypt.Cost([]byte(hash))
 	if err != nil {
 		return err
@@ -68,9 +297,13 @@ func CompareHashAndPassword(ctx context.Context, hash, password string) error {
 }
 
 // GenerateFromPassword generates a password hash from a
-// password, using PasswordHashCost. Context can be used to cancel the hashing
-// if the algorithm supports it.
+// password, using PasswordHashAlgorithm and PasswordHashCost. Context can
+// be used to cancel the hashing if the algorithm supports it.
 func GenerateFromPassword(ctx context.Context, password string) (string, error) {
+	if PasswordHashAlgorithm == Argon2id {
+		return generateFromPasswordArgon2id(ctx, password)
+	}
+
 	var hashCost int
 
 	switch PasswordHashCost {
@@ -96,3 +329,35 @@ func GenerateFromPassword(ctx context.Context, password string) (string, error)
 
 	return string(hash), nil
 }
+
+func generateFromPasswordArgon2id(ctx context.Context, password string) (string, error) {
+	params := currentArgon2Params()
+
+	attributes := []attribute.KeyValue{
+		attribute.String("alg", Argon2id),
+		attribute.Int("argon2_m", int(params.Memory)),
+		attribute.Int("argon2_t", int(params.Time)),
+		attribute.Int("argon2_p", int(params.Parallelism)),
+	}
+
+	generateFromPasswordSubmittedCounter.Add(ctx, 1, attributes...)
+	defer generateFromPasswordCompletedCounter.Add(ctx, 1, attributes...)
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Parallelism, argon2KeyLength)
+
+	return fmt.Sprintf(
+		"$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		Argon2id,
+		argon2.Version,
+		params.Memory,
+		params.Time,
+		params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
@@ -0,0 +1,105 @@
+package crypto
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/conf"
+)
+
+func init() {
+	PasswordHashCost = QuickHashCost
+}
+
+func useArgon2id(t *testing.T) {
+	ConfigurePasswordHashing(&conf.SecurityConfiguration{
+		PasswordHashAlgorithm:         Argon2id,
+		PasswordHashArgon2Memory:      19456,
+		PasswordHashArgon2Time:        2,
+		PasswordHashArgon2Parallelism: 1,
+	})
+
+	t.Cleanup(func() {
+		ConfigurePasswordHashing(&conf.SecurityConfiguration{})
+	})
+}
+
+func TestGenerateFromPasswordBcrypt(t *testing.T) {
+	hash, err := GenerateFromPassword(context.Background(), "password")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$2a$"))
+
+	require.NoError(t, ValidatePasswordHash(hash))
+	require.NoError(t, CompareHashAndPassword(context.Background(), hash, "password"))
+	require.Error(t, CompareHashAndPassword(context.Background(), hash, "wrong password"))
+	require.False(t, NeedsRehash(hash))
+}
+
+func TestGenerateFromPasswordArgon2id(t *testing.T) {
+	useArgon2id(t)
+
+	hash, err := GenerateFromPassword(context.Background(), "password")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$"))
+
+	otherHash, err := GenerateFromPassword(context.Background(), "password")
+	require.NoError(t, err)
+	require.NotEqual(t, hash, otherHash, "hashes must be salted")
+
+	require.NoError(t, ValidatePasswordHash(hash))
+	require.NoError(t, CompareHashAndPassword(context.Background(), hash, "password"))
+	require.ErrorIs(t, CompareHashAndPassword(context.Background(), hash, "wrong password"), ErrArgon2MismatchedHashAndPassword)
+	require.False(t, NeedsRehash(hash))
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcryptHash, err := GenerateFromPassword(context.Background(), "password")
+	require.NoError(t, err)
+
+	useArgon2id(t)
+
+	// existing bcrypt hashes keep working, but should be upgraded
+	require.NoError(t, CompareHashAndPassword(context.Background(), bcryptHash, "password"))
+	require.True(t, NeedsRehash(bcryptHash))
+
+	argon2idHash, err := GenerateFromPassword(context.Background(), "password")
+	require.NoError(t, err)
+	require.False(t, NeedsRehash(argon2idHash))
+
+	// hashes with outdated parameters should be upgraded too
+	require.True(t, NeedsRehash(strings.Replace(argon2idHash, "m=64,t=1,p=1", "m=32,t=1,p=1", 1)))
+	require.True(t, NeedsRehash(strings.Replace(argon2idHash, "$argon2id$", "$argon2i$", 1)))
+	require.True(t, NeedsRehash(""))
+
+	ConfigurePasswordHashing(&conf.SecurityConfiguration{})
+
+	require.False(t, NeedsRehash(bcryptHash))
+	require.True(t, NeedsRehash(argon2idHash))
+}
+
+func TestValidatePasswordHash(t *testing.T) {
+	invalidHashes := []string{
+		"",
+		"password",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$",
+		"$argon2d$v=19$m=64,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=262145,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=64,t=17,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=17$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$" + base64.RawStdEncoding.EncodeToString(make([]byte, 65)),
+		"$argon2id$v=19$m=64,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(make([]byte, 65)) + "$aGFzaA",
+	}
+
+	for _, hash := range invalidHashes {
+		require.Error(t, ValidatePasswordHash(hash), "hash %q", hash)
+	}
+
+	require.NoError(t, ValidatePasswordHash("$argon2i$v=19$m=64,t=1,p=1$c2FsdA$aGFzaA"))
+	require.NoError(t, ValidatePasswordHash("$argon2id$v=19$m=262144,t=16,p=16$c2FsdA$aGFzaA"))
+}
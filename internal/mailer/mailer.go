@@ -31,8 +31,9 @@ type EmailParams struct {
 	RedirectTo string
 }
 
-// NewMailer returns a new gotrue mailer
-func NewMailer(globalConfig *conf.GlobalConfiguration) Mailer {
+// NewMailer returns a new gotrue mailer, which uses the template overrides
+// of the tenant if it has any.
+func NewMailer(globalConfig *conf.GlobalConfiguration, tenant string) Mailer {
 	mail := gomail.NewMessage()
 
 	// so that messages are not grouped under each other
@@ -60,12 +61,17 @@ func NewMailer(globalConfig *conf.GlobalConfiguration) Mailer {
 		SiteURL: globalConfig.SiteURL,
 		Config:  globalConfig,
 		Mailer:  mailClient,
+		Tenant:  tenant,
 	}
 }
 
-func withDefault(value, defaultValue string) string {
-	if value == "" {
-		return defaultValue
+// withDefault returns the first value that is not empty.
+func withDefault(value string, defaultValues ...string) string {
+	for _, defaultValue := range defaultValues {
+		if value != "" {
+			break
+		}
+		value = defaultValue
 	}
 	return value
 }
@@ -1,11 +1,17 @@
 package mailer
 
 import (
+	"bytes"
+	"html/template"
 	"net/url"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/models"
 )
 
 var urlRegexp = regexp.MustCompile(`^https?://[^/]+`)
@@ -85,3 +91,168 @@ func TestRelativeURL(t *testing.T) {
 		assert.Equal(t, c.Expected, res, c.URL)
 	}
 }
+
+type recordingMailClient struct {
+	subject         string
+	templateURL     string
+	defaultTemplate string
+	data            map[string]interface{}
+}
+
+func (m *recordingMailClient) Mail(to, subjectTemplate, templateURL, defaultTemplate string, templateData map[string]interface{}) error {
+	m.subject = subjectTemplate
+	m.templateURL = templateURL
+	m.defaultTemplate = defaultTemplate
+	m.data = templateData
+	return nil
+}
+
+func TestMagicLinkMailOTPMode(t *testing.T) {
+	cases := []struct {
+		Mode     string
+		HasLink  bool
+		HasToken bool
+	}{
+		{conf.EmailOTPModeLink, true, false},
+		{conf.EmailOTPModeCode, false, true},
+		{conf.EmailOTPModeBoth, true, true},
+	}
+
+	externalURL, err := url.ParseRequestURI("https://test.example.com")
+	require.NoError(t, err)
+
+	user, err := models.NewUser("", "test@example.com", "", "authenticated", nil)
+	require.NoError(t, err)
+
+	for _, c := range cases {
+		client := &recordingMailClient{}
+		m := &TemplateMailer{
+			Config: &conf.GlobalConfiguration{
+				Mailer: conf.MailerConfiguration{
+					OTPMode: c.Mode,
+				},
+			},
+			Mailer: client,
+		}
+
+		require.NoError(t, m.MagicLinkMail(user, "123456", "", externalURL))
+		assert.Equal(t, "123456", client.data["Token"], c.Mode)
+		assert.Equal(t, c.HasLink, strings.Contains(client.defaultTemplate, "{{ .ConfirmationURL }}"), c.Mode)
+		assert.Equal(t, c.HasToken, strings.Contains(client.defaultTemplate, "{{ .Token }}"), c.Mode)
+	}
+}
+
+func TestConfirmationMailTenantTemplates(t *testing.T) {
+	externalURL, err := url.ParseRequestURI("https://test.example.com")
+	require.NoError(t, err)
+
+	user, err := models.NewUser("", "test@example.com", "", "authenticated", map[string]interface{}{
+		"name": "Jane",
+	})
+	require.NoError(t, err)
+	user.ConfirmationToken = "token-hash"
+
+	config := &conf.GlobalConfiguration{
+		SiteURL: "https://brand-a.example.com",
+		Mailer: conf.MailerConfiguration{
+			OTPMode: conf.EmailOTPModeBoth,
+			Templates: conf.EmailContentConfiguration{
+				Confirmation: "https://templates.example.com/confirmation.html",
+			},
+			URLPaths: conf.EmailContentConfiguration{
+				Confirmation: "/verify",
+			},
+			TenantTemplates: map[string]conf.EmailContentConfiguration{
+				"brand-a": {
+					Confirmation: `Hi {{ .Data.name }}, confirm at {{ .ConfirmationURL }} on {{ .SiteURL }} or enter {{ .Token }}`,
+				},
+			},
+		},
+	}
+
+	client := &recordingMailClient{}
+	m := &TemplateMailer{Config: config, Mailer: client, Tenant: "brand-a"}
+	require.NoError(t, m.ConfirmationMail(user, "123456", "", externalURL))
+	assert.Equal(t, "", client.templateURL)
+
+	tmpl, err := template.New("confirmation").Parse(client.defaultTemplate)
+	require.NoError(t, err)
+
+	var body bytes.Buffer
+	require.NoError(t, tmpl.Execute(&body, client.data))
+	assert.Equal(t, "Hi Jane, confirm at https://test.example.com/verify?token=token-hash&amp;type=signup&amp;redirect_to= on https://brand-a.example.com or enter 123456", body.String())
+
+	// a tenant without an override of the email falls back to the defaults
+	for _, tenant := range []string{"brand-b", ""} {
+		client = &recordingMailClient{}
+		m = &TemplateMailer{Config: config, Mailer: client, Tenant: tenant}
+		require.NoError(t, m.ConfirmationMail(user, "123456", "", externalURL))
+		assert.Equal(t, "https://templates.example.com/confirmation.html", client.templateURL, tenant)
+		assert.Equal(t, defaultConfirmationMail, client.defaultTemplate, tenant)
+	}
+
+	client = &recordingMailClient{}
+	m = &TemplateMailer{Config: config, Mailer: client, Tenant: "brand-a"}
+	require.NoError(t, m.RecoveryMail(user, "123456", "", externalURL))
+	assert.Equal(t, defaultRecoveryMail, client.defaultTemplate)
+}
+
+func TestConfirmationMailLocale(t *testing.T) {
+	externalURL, err := url.ParseRequestURI("https://test.example.com")
+	require.NoError(t, err)
+
+	config := &conf.GlobalConfiguration{
+		Mailer: conf.MailerConfiguration{
+			OTPMode: conf.EmailOTPModeBoth,
+			Subjects: conf.EmailContentConfiguration{
+				Confirmation: "Confirm",
+			},
+			TenantTemplates: map[string]conf.EmailContentConfiguration{
+				"brand-a": {
+					Confirmation: "Brand A",
+				},
+			},
+		},
+		Localization: conf.LocalizationConfiguration{
+			DefaultLocale: "en",
+			Locales: map[string]conf.LocaleTemplates{
+				"de": {
+					Templates: conf.EmailContentConfiguration{
+						Confirmation: `Bestätigen: {{ .ConfirmationURL }}`,
+					},
+					Subjects: conf.EmailContentConfiguration{
+						Confirmation: "Bestätigen",
+					},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		Locale          string
+		Tenant          string
+		ResolvedLocale  string
+		Subject         string
+		DefaultTemplate string
+	}{
+		{"de", "", "de", "Bestätigen", `Bestätigen: {{ .ConfirmationURL }}`},
+		{"de-AT", "", "de", "Bestätigen", `Bestätigen: {{ .ConfirmationURL }}`},
+		{"fr", "", "en", "Confirm", defaultConfirmationMail},
+		{"", "", "en", "Confirm", defaultConfirmationMail},
+		{"de", "brand-a", "de", "Bestätigen", "Brand A"},
+	}
+
+	for _, c := range cases {
+		user, err := models.NewUser("", "test@example.com", "", "authenticated", nil)
+		require.NoError(t, err)
+		user.Locale = c.Locale
+
+		client := &recordingMailClient{}
+		m := &TemplateMailer{Config: config, Mailer: client, Tenant: c.Tenant}
+
+		require.NoError(t, m.ConfirmationMail(user, "123456", "", externalURL))
+		assert.Equal(t, c.ResolvedLocale, client.data["Locale"], c.Locale)
+		assert.Equal(t, c.Subject, client.subject, c.Locale)
+		assert.Equal(t, c.DefaultTemplate, client.defaultTemplate, c.Locale)
+	}
+}
@@ -19,6 +19,10 @@ type TemplateMailer struct {
 	SiteURL string
 	Config  *conf.GlobalConfiguration
 	Mailer  MailClient
+
+	// Tenant selects the template overrides in
+	// conf.MailerConfiguration.TenantTemplates.
+	Tenant string
 }
 
 func encodeRedirectURL(referrerURL string) string {
@@ -64,10 +68,97 @@ const defaultEmailChangeMail = `<h2>Confirm email address change</h2>
 <p><a href="{{ .ConfirmationURL }}">Change email address</a></p>
 <p>Alternatively, enter the code: {{ .Token }}</p>`
 
+// The default templates when only links are sent, see conf.EmailOTPModeLink.
+const defaultInviteLinkMail = `<h2>You have been invited</h2>
+
+<p>You have been invited to create a user on {{ .SiteURL }}. Follow this link to accept the invite:</p>
+<p><a href="{{ .ConfirmationURL }}">Accept the invite</a></p>`
+
+const defaultConfirmationLinkMail = `<h2>Confirm your email</h2>
+
+<p>Follow this link to confirm your email:</p>
+<p><a href="{{ .ConfirmationURL }}">Confirm your email address</a></p>
+`
+
+const defaultRecoveryLinkMail = `<h2>Reset password</h2>
+
+<p>Follow this link to reset the password for your user:</p>
+<p><a href="{{ .ConfirmationURL }}">Reset password</a></p>`
+
+const defaultMagicLinkLinkMail = `<h2>Magic Link</h2>
+
+<p>Follow this link to login:</p>
+<p><a href="{{ .ConfirmationURL }}">Log In</a></p>`
+
+const defaultEmailChangeLinkMail = `<h2>Confirm email address change</h2>
+
+<p>Follow this link to confirm the update of your email address from {{ .Email }} to {{ .NewEmail }}:</p>
+<p><a href="{{ .ConfirmationURL }}">Change email address</a></p>`
+
+// The default templates when only codes are sent, see conf.EmailOTPModeCode.
+const defaultInviteCodeMail = `<h2>You have been invited</h2>
+
+<p>You have been invited to create a user on {{ .SiteURL }}. Enter this code to accept the invite:</p>
+<p>{{ .Token }}</p>`
+
+const defaultConfirmationCodeMail = `<h2>Confirm your email</h2>
+
+<p>Enter this code to confirm your email:</p>
+<p>{{ .Token }}</p>
+`
+
+const defaultRecoveryCodeMail = `<h2>Reset password</h2>
+
+<p>Enter this code to reset the password for your user:</p>
+<p>{{ .Token }}</p>`
+
+const defaultMagicLinkCodeMail = `<h2>Login code</h2>
+
+<p>Enter this code to login:</p>
+<p>{{ .Token }}</p>`
+
+const defaultEmailChangeCodeMail = `<h2>Confirm email address change</h2>
+
+<p>Enter this code to confirm the update of your email address from {{ .Email }} to {{ .NewEmail }}:</p>
+<p>{{ .Token }}</p>`
+
 const defaultReauthenticateMail = `<h2>Confirm reauthentication</h2>
 
 <p>Enter the code: {{ .Token }}</p>`
 
+// defaultTemplate picks the default template for the configured email OTP
+// mode.
+func (m *TemplateMailer) defaultTemplate(linkAndCode, link, code string) string {
+	switch m.Config.Mailer.OTPMode {
+	case conf.EmailOTPModeLink:
+		return link
+
+	case conf.EmailOTPModeCode:
+		return code
+
+	default:
+		return linkAndCode
+	}
+}
+
+// tenantTemplates returns the template overrides of the mailer's tenant,
+// which are empty if the tenant has none.
+func (m *TemplateMailer) tenantTemplates() conf.EmailContentConfiguration {
+	return m.Config.Mailer.TenantTemplates[m.Tenant]
+}
+
+// selectTemplate returns the template URL and default template of an email.
+// An override, i.e. the tenant's or localized template, replaces both,
+// otherwise the configured template URL is used with the default as a
+// fallback.
+func selectTemplate(override, templateURL, defaultTemplate string) (string, string) {
+	if override != "" {
+		return "", override
+	}
+
+	return templateURL, defaultTemplate
+}
+
 // ValidateEmail returns nil if the email is valid,
 // otherwise an error indicating the reason it is invalid
 func (m TemplateMailer) ValidateEmail(email string) error {
@@ -86,6 +177,8 @@ func (m *TemplateMailer) InviteMail(user *models.User, otp, referrerURL string,
 		return err
 	}
 
+	locale, localized := m.Config.Localization.Resolve(user.Locale)
+
 	data := map[string]interface{}{
 		"SiteURL":         m.Config.SiteURL,
 		"ConfirmationURL": externalURL.ResolveReference(path).String(),
@@ -93,14 +186,21 @@ func (m *TemplateMailer) InviteMail(user *models.User, otp, referrerURL string,
 		"Token":           otp,
 		"TokenHash":       user.ConfirmationToken,
 		"Data":            user.UserMetaData,
+		"Locale":          locale,
 		"RedirectTo":      referrerURL,
 	}
 
+	templateURL, defaultTemplate := selectTemplate(
+		withDefault(m.tenantTemplates().Invite, localized.Templates.Invite),
+		m.Config.Mailer.Templates.Invite,
+		m.defaultTemplate(defaultInviteMail, defaultInviteLinkMail, defaultInviteCodeMail),
+	)
+
 	return m.Mailer.Mail(
 		user.GetEmail(),
-		withDefault(m.Config.Mailer.Subjects.Invite, "You have been invited"),
-		m.Config.Mailer.Templates.Invite,
-		defaultInviteMail,
+		withDefault(localized.Subjects.Invite, m.Config.Mailer.Subjects.Invite, "You have been invited"),
+		templateURL,
+		defaultTemplate,
 		data,
 	)
 }
@@ -116,6 +216,8 @@ func (m *TemplateMailer) ConfirmationMail(user *models.User, otp, referrerURL st
 		return err
 	}
 
+	locale, localized := m.Config.Localization.Resolve(user.Locale)
+
 	data := map[string]interface{}{
 		"SiteURL":         m.Config.SiteURL,
 		"ConfirmationURL": externalURL.ResolveReference(path).String(),
@@ -123,32 +225,48 @@ func (m *TemplateMailer) ConfirmationMail(user *models.User, otp, referrerURL st
 		"Token":           otp,
 		"TokenHash":       user.ConfirmationToken,
 		"Data":            user.UserMetaData,
+		"Locale":          locale,
 		"RedirectTo":      referrerURL,
 	}
 
+	templateURL, defaultTemplate := selectTemplate(
+		withDefault(m.tenantTemplates().Confirmation, localized.Templates.Confirmation),
+		m.Config.Mailer.Templates.Confirmation,
+		m.defaultTemplate(defaultConfirmationMail, defaultConfirmationLinkMail, defaultConfirmationCodeMail),
+	)
+
 	return m.Mailer.Mail(
 		user.GetEmail(),
-		withDefault(m.Config.Mailer.Subjects.Confirmation, "Confirm Your Email"),
-		m.Config.Mailer.Templates.Confirmation,
-		defaultConfirmationMail,
+		withDefault(localized.Subjects.Confirmation, m.Config.Mailer.Subjects.Confirmation, "Confirm Your Email"),
+		templateURL,
+		defaultTemplate,
 		data,
 	)
 }
 
 // ReauthenticateMail sends a reauthentication mail to an authenticated user
 func (m *TemplateMailer) ReauthenticateMail(user *models.User, otp string) error {
+	locale, localized := m.Config.Localization.Resolve(user.Locale)
+
 	data := map[string]interface{}{
 		"SiteURL": m.Config.SiteURL,
 		"Email":   user.Email,
 		"Token":   otp,
 		"Data":    user.UserMetaData,
+		"Locale":  locale,
 	}
 
-	return m.Mailer.Mail(
-		user.GetEmail(),
-		withDefault(m.Config.Mailer.Subjects.Reauthentication, "Confirm reauthentication"),
+	templateURL, defaultTemplate := selectTemplate(
+		withDefault(m.tenantTemplates().Reauthentication, localized.Templates.Reauthentication),
 		m.Config.Mailer.Templates.Reauthentication,
 		defaultReauthenticateMail,
+	)
+
+	return m.Mailer.Mail(
+		user.GetEmail(),
+		withDefault(localized.Subjects.Reauthentication, m.Config.Mailer.Subjects.Reauthentication, "Confirm reauthentication"),
+		templateURL,
+		defaultTemplate,
 		data,
 	)
 }
@@ -162,13 +280,21 @@ func (m *TemplateMailer) EmailChangeMail(user *models.User, otpNew, otpCurrent,
 		Subject   string
 		Template  string
 	}
+	locale, localized := m.Config.Localization.Resolve(user.Locale)
+
+	templateURL, defaultTemplate := selectTemplate(
+		withDefault(m.tenantTemplates().EmailChange, localized.Templates.EmailChange),
+		m.Config.Mailer.Templates.EmailChange,
+		m.defaultTemplate(defaultEmailChangeMail, defaultEmailChangeLinkMail, defaultEmailChangeCodeMail),
+	)
+
 	emails := []Email{
 		{
 			Address:   user.EmailChange,
 			Otp:       otpNew,
 			TokenHash: user.EmailChangeTokenNew,
-			Subject:   withDefault(m.Config.Mailer.Subjects.EmailChange, "Confirm Email Change"),
-			Template:  m.Config.Mailer.Templates.EmailChange,
+			Subject:   withDefault(localized.Subjects.EmailChange, m.Config.Mailer.Subjects.EmailChange, "Confirm Email Change"),
+			Template:  templateURL,
 		},
 	}
 
@@ -178,8 +304,8 @@ func (m *TemplateMailer) EmailChangeMail(user *models.User, otpNew, otpCurrent,
 			Address:   currentEmail,
 			Otp:       otpCurrent,
 			TokenHash: user.EmailChangeTokenCurrent,
-			Subject:   withDefault(m.Config.Mailer.Subjects.Confirmation, "Confirm Email Address"),
-			Template:  m.Config.Mailer.Templates.EmailChange,
+			Subject:   withDefault(localized.Subjects.Confirmation, m.Config.Mailer.Subjects.Confirmation, "Confirm Email Address"),
+			Template:  templateURL,
 		})
 	}
 
@@ -206,13 +332,14 @@ func (m *TemplateMailer) EmailChangeMail(user *models.User, otpNew, otpCurrent,
 				"TokenHash":       tokenHash,
 				"SendingTo":       address,
 				"Data":            user.UserMetaData,
+				"Locale":          locale,
 				"RedirectTo":      referrerURL,
 			}
 			errors <- m.Mailer.Mail(
 				address,
-				withDefault(m.Config.Mailer.Subjects.EmailChange, "Confirm Email Change"),
+				withDefault(localized.Subjects.EmailChange, m.Config.Mailer.Subjects.EmailChange, "Confirm Email Change"),
 				template,
-				defaultEmailChangeMail,
+				defaultTemplate,
 				data,
 			)
 		}(email.Address, email.Otp, email.TokenHash, email.Template)
@@ -238,6 +365,8 @@ func (m *TemplateMailer) RecoveryMail(user *models.User, otp, referrerURL string
 	if err != nil {
 		return err
 	}
+	locale, localized := m.Config.Localization.Resolve(user.Locale)
+
 	data := map[string]interface{}{
 		"SiteURL":         m.Config.SiteURL,
 		"ConfirmationURL": externalURL.ResolveReference(path).String(),
@@ -245,14 +374,21 @@ func (m *TemplateMailer) RecoveryMail(user *models.User, otp, referrerURL string
 		"Token":           otp,
 		"TokenHash":       user.RecoveryToken,
 		"Data":            user.UserMetaData,
+		"Locale":          locale,
 		"RedirectTo":      referrerURL,
 	}
 
+	templateURL, defaultTemplate := selectTemplate(
+		withDefault(m.tenantTemplates().Recovery, localized.Templates.Recovery),
+		m.Config.Mailer.Templates.Recovery,
+		m.defaultTemplate(defaultRecoveryMail, defaultRecoveryLinkMail, defaultRecoveryCodeMail),
+	)
+
 	return m.Mailer.Mail(
 		user.GetEmail(),
-		withDefault(m.Config.Mailer.Subjects.Recovery, "Reset Your Password"),
-		m.Config.Mailer.Templates.Recovery,
-		defaultRecoveryMail,
+		withDefault(localized.Subjects.Recovery, m.Config.Mailer.Subjects.Recovery, "Reset Your Password"),
+		templateURL,
+		defaultTemplate,
 		data,
 	)
 }
@@ -268,6 +404,8 @@ func (m *TemplateMailer) MagicLinkMail(user *models.User, otp, referrerURL strin
 		return err
 	}
 
+	locale, localized := m.Config.Localization.Resolve(user.Locale)
+
 	data := map[string]interface{}{
 		"SiteURL":         m.Config.SiteURL,
 		"ConfirmationURL": externalURL.ResolveReference(path).String(),
@@ -275,14 +413,21 @@ func (m *TemplateMailer) MagicLinkMail(user *models.User, otp, referrerURL strin
 		"Token":           otp,
 		"TokenHash":       user.RecoveryToken,
 		"Data":            user.UserMetaData,
+		"Locale":          locale,
 		"RedirectTo":      referrerURL,
 	}
 
+	templateURL, defaultTemplate := selectTemplate(
+		withDefault(m.tenantTemplates().MagicLink, localized.Templates.MagicLink),
+		m.Config.Mailer.Templates.MagicLink,
+		m.defaultTemplate(defaultMagicLinkMail, defaultMagicLinkLinkMail, defaultMagicLinkCodeMail),
+	)
+
 	return m.Mailer.Mail(
 		user.GetEmail(),
-		withDefault(m.Config.Mailer.Subjects.MagicLink, "Your Magic Link"),
-		m.Config.Mailer.Templates.MagicLink,
-		defaultMagicLinkMail,
+		withDefault(localized.Subjects.MagicLink, m.Config.Mailer.Subjects.MagicLink, "Your Magic Link"),
+		templateURL,
+		defaultTemplate,
 		data,
 	)
 }
@@ -23,12 +23,16 @@ const (
 	UserSignedUpAction              AuditAction = "user_signedup"
 	UserInvitedAction               AuditAction = "user_invited"
 	UserDeletedAction               AuditAction = "user_deleted"
+	UserRestoredAction              AuditAction = "user_restored"
 	UserModifiedAction              AuditAction = "user_modified"
 	UserRecoveryRequestedAction     AuditAction = "user_recovery_requested"
 	UserReauthenticateAction        AuditAction = "user_reauthenticate_requested"
 	UserConfirmationRequestedAction AuditAction = "user_confirmation_requested"
 	UserRepeatedSignUpAction        AuditAction = "user_repeated_signup"
 	UserUpdatePasswordAction        AuditAction = "user_updated_password"
+	UserConvertedAction             AuditAction = "user_converted"
+	UserLockedAction                AuditAction = "user_locked"
+	UserUnlockedAction              AuditAction = "user_unlocked"
 	TokenRevokedAction              AuditAction = "token_revoked"
 	TokenRefreshedAction            AuditAction = "token_refreshed"
 	GenerateRecoveryCodesAction     AuditAction = "generate_recovery_codes"
@@ -40,6 +44,12 @@ const (
 	DeleteRecoveryCodesAction       AuditAction = "recovery_codes_deleted"
 	UpdateFactorAction              AuditAction = "factor_updated"
 	MFACodeLoginAction              AuditAction = "mfa_code_login"
+	IdTokenGrantAction              AuditAction = "id_token_grant"
+	ProviderAccessTokenGrantAction  AuditAction = "provider_access_token_grant"
+	IdentityLinkedAction            AuditAction = "identity_linked"
+	IdentityUnlinkedAction          AuditAction = "identity_unlinked"
+	UserImpersonatedAction          AuditAction = "user_impersonated"
+	UsersBatchDeletedAction         AuditAction = "users_batch_deleted"
 
 	account       auditLogType = "account"
 	team          auditLogType = "team"
@@ -53,9 +63,13 @@ var ActionLogTypeMap = map[AuditAction]auditLogType{
 	LoginAction:                     account,
 	LogoutAction:                    account,
 	InviteAcceptedAction:            account,
+	IdTokenGrantAction:              account,
+	ProviderAccessTokenGrantAction:  account,
 	UserSignedUpAction:              team,
 	UserInvitedAction:               team,
 	UserDeletedAction:               team,
+	UserRestoredAction:              team,
+	UsersBatchDeletedAction:         team,
 	TokenRevokedAction:              token,
 	TokenRefreshedAction:            token,
 	UserModifiedAction:              user,
@@ -63,6 +77,12 @@ var ActionLogTypeMap = map[AuditAction]auditLogType{
 	UserConfirmationRequestedAction: user,
 	UserRepeatedSignUpAction:        user,
 	UserUpdatePasswordAction:        user,
+	UserConvertedAction:             user,
+	UserLockedAction:                user,
+	UserUnlockedAction:              user,
+	UserImpersonatedAction:          user,
+	IdentityLinkedAction:            user,
+	IdentityUnlinkedAction:          user,
 	GenerateRecoveryCodesAction:     user,
 	EnrollFactorAction:              factor,
 	UnenrollFactorAction:            factor,
@@ -123,8 +143,18 @@ func NewAuditLogEntry(r *http.Request, tx *storage.Connection, actor *User, acti
 		l.Payload["traits"] = traits
 	}
 
-	if err := tx.Create(&l); err != nil {
-		return errors.Wrap(err, "Database error creating audit log entry")
+	if auditLogToDatabase {
+		if err := tx.Create(&l); err != nil {
+			return errors.Wrap(err, "Database error creating audit log entry")
+		}
+	} else {
+		l.CreatedAt = time.Now()
+	}
+
+	for _, sink := range auditLogSinks {
+		if err := sink.WriteAuditLogEntry(&l); err != nil {
+			return err
+		}
 	}
 
 	return nil
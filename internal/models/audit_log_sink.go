@@ -0,0 +1,210 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/utilities"
+)
+
+// AuditLogSink receives the audit log entries written by NewAuditLogEntry,
+// in addition to or instead of the audit_log_entries table.
+type AuditLogSink interface {
+	WriteAuditLogEntry(entry *AuditLogEntry) error
+	Close() error
+}
+
+var (
+	// auditLogToDatabase is whether audit log entries are created in the
+	// audit_log_entries table.
+	auditLogToDatabase = true
+
+	auditLogSinks []AuditLogSink
+)
+
+// ConfigureAuditLog sets the sinks audit log entries are written to, closing
+// the previously configured ones. Entries are only written to the database
+// if no sinks are configured.
+func ConfigureAuditLog(config *conf.AuditLogConfiguration) error {
+	var sinks []AuditLogSink
+	toDatabase := len(config.Sinks) == 0
+
+	for _, sink := range config.Sinks {
+		switch sink {
+		case conf.AuditLogSinkDatabase:
+			toDatabase = true
+
+		case conf.AuditLogSinkFile:
+			fileSink, err := newFileAuditLogSink(&config.File)
+			if err != nil {
+				for _, s := range sinks {
+					utilities.SafeClose(s)
+				}
+				return err
+			}
+			sinks = append(sinks, fileSink)
+
+		case conf.AuditLogSinkHTTP:
+			sinks = append(sinks, newHTTPAuditLogSink(&config.HTTP))
+
+		default:
+			return fmt.Errorf("unsupported audit log sink %q", sink)
+		}
+	}
+
+	for _, s := range auditLogSinks {
+		utilities.SafeClose(s)
+	}
+
+	auditLogToDatabase = toDatabase
+	auditLogSinks = sinks
+
+	return nil
+}
+
+// fileAuditLogSink appends audit log entries to a file as JSON lines.
+type fileAuditLogSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileAuditLogSink(config *conf.AuditLogFileConfiguration) (*fileAuditLogSink, error) {
+	file, err := os.OpenFile(config.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error opening audit log file")
+	}
+
+	return &fileAuditLogSink{file: file}, nil
+}
+
+func (s *fileAuditLogSink) WriteAuditLogEntry(entry *AuditLogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "Error encoding audit log entry")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return errors.Wrap(err, "Error writing audit log entry to file")
+	}
+
+	return nil
+}
+
+func (s *fileAuditLogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// httpAuditLogSink posts audit log entries to a URL in the background, so
+// that a slow or unavailable endpoint doesn't block requests. Entries are
+// dropped while the buffer is full, and entries that fail to be posted are
+// not retried.
+type httpAuditLogSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	mu      sync.RWMutex
+	closed  bool
+	entries chan []byte
+	done    chan struct{}
+}
+
+func newHTTPAuditLogSink(config *conf.AuditLogHTTPConfiguration) *httpAuditLogSink {
+	s := &httpAuditLogSink{
+		url:     config.URL,
+		headers: config.Headers,
+		client:  &http.Client{Timeout: config.Timeout},
+		entries: make(chan []byte, config.BufferSize),
+		done:    make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+func (s *httpAuditLogSink) WriteAuditLogEntry(entry *AuditLogEntry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "Error encoding audit log entry")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil
+	}
+
+	select {
+	case s.entries <- body:
+	default:
+		logrus.WithField("component", "audit_log").WithField("audit_log_entry_id", entry.ID).Warn("HTTP audit log buffer is full, dropping entry")
+	}
+
+	return nil
+}
+
+func (s *httpAuditLogSink) run() {
+	defer close(s.done)
+
+	for body := range s.entries {
+		if err := s.post(body); err != nil {
+			logrus.WithField("component", "audit_log").WithError(err).Warn("Error posting audit log entry")
+		}
+	}
+}
+
+func (s *httpAuditLogSink) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer utilities.SafeClose(res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("audit log endpoint responded with status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Close stops accepting entries and waits until the buffered entries have
+// been posted.
+func (s *httpAuditLogSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.entries)
+	s.mu.Unlock()
+
+	<-s.done
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/storage/test"
+)
+
+func newTestAuditLogEntry(action AuditAction) *AuditLogEntry {
+	return &AuditLogEntry{
+		ID: uuid.Must(uuid.NewV4()),
+		Payload: JSONMap{
+			"action":   action,
+			"log_type": ActionLogTypeMap[action],
+		},
+		CreatedAt: time.Now(),
+		IPAddress: "127.0.0.1",
+	}
+}
+
+func readAuditLogFile(t *testing.T, path string) []AuditLogEntry {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var entries []AuditLogEntry
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditLogEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	require.NoError(t, scanner.Err())
+
+	return entries
+}
+
+func TestFileAuditLogSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := newFileAuditLogSink(&conf.AuditLogFileConfiguration{Path: path})
+	require.NoError(t, err)
+
+	first := newTestAuditLogEntry(LoginAction)
+	second := newTestAuditLogEntry(LogoutAction)
+
+	require.NoError(t, sink.WriteAuditLogEntry(first))
+	require.NoError(t, sink.WriteAuditLogEntry(second))
+	require.NoError(t, sink.Close())
+
+	entries := readAuditLogFile(t, path)
+	require.Len(t, entries, 2)
+	require.Equal(t, first.ID, entries[0].ID)
+	require.Equal(t, string(LoginAction), entries[0].Payload["action"])
+	require.Equal(t, "127.0.0.1", entries[0].IPAddress)
+	require.Equal(t, second.ID, entries[1].ID)
+}
+
+func TestHTTPAuditLogSink(t *testing.T) {
+	var received []AuditLogEntry
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.Equal(t, "Bearer siem-token", r.Header.Get("Authorization"))
+
+		var entry AuditLogEntry
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&entry))
+		received = append(received, entry)
+	}))
+	defer server.Close()
+
+	sink := newHTTPAuditLogSink(&conf.AuditLogHTTPConfiguration{
+		URL:        server.URL,
+		Headers:    map[string]string{"Authorization": "Bearer siem-token"},
+		BufferSize: 10,
+		Timeout:    time.Second,
+	})
+
+	first := newTestAuditLogEntry(LoginAction)
+	second := newTestAuditLogEntry(LogoutAction)
+
+	require.NoError(t, sink.WriteAuditLogEntry(first))
+	require.NoError(t, sink.WriteAuditLogEntry(second))
+
+	// closing waits for the buffered entries to be posted
+	require.NoError(t, sink.Close())
+
+	require.Len(t, received, 2)
+	require.Equal(t, first.ID, received[0].ID)
+	require.Equal(t, second.ID, received[1].ID)
+
+	// entries written after closing are ignored
+	require.NoError(t, sink.WriteAuditLogEntry(newTestAuditLogEntry(LoginAction)))
+}
+
+func TestHTTPAuditLogSinkDoesNotBlock(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+
+	sink := newHTTPAuditLogSink(&conf.AuditLogHTTPConfiguration{
+		URL:        server.URL,
+		BufferSize: 1,
+		Timeout:    time.Minute,
+	})
+
+	// the first entry is being posted, the second is buffered and the
+	// rest are dropped
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sink.WriteAuditLogEntry(newTestAuditLogEntry(LoginAction)))
+	}
+	require.Less(t, time.Since(start), time.Second)
+
+	close(unblock)
+	require.NoError(t, sink.Close())
+}
+
+func TestConfigureAuditLog(t *testing.T) {
+	defer func() {
+		require.NoError(t, ConfigureAuditLog(&conf.AuditLogConfiguration{}))
+	}()
+
+	require.Error(t, ConfigureAuditLog(&conf.AuditLogConfiguration{Sinks: []string{"syslog"}}))
+	require.True(t, auditLogToDatabase)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	require.NoError(t, ConfigureAuditLog(&conf.AuditLogConfiguration{
+		Sinks: []string{conf.AuditLogSinkFile, conf.AuditLogSinkHTTP},
+		File:  conf.AuditLogFileConfiguration{Path: path},
+		HTTP:  conf.AuditLogHTTPConfiguration{URL: "http://localhost", BufferSize: 1},
+	}))
+	require.False(t, auditLogToDatabase)
+	require.Len(t, auditLogSinks, 2)
+
+	require.NoError(t, ConfigureAuditLog(&conf.AuditLogConfiguration{}))
+	require.True(t, auditLogToDatabase)
+	require.Empty(t, auditLogSinks)
+}
+
+func TestNewAuditLogEntrySinks(t *testing.T) {
+	globalConfig, err := conf.LoadGlobal(modelsTestConfig)
+	require.NoError(t, err)
+	conn, err := test.SetupDBConnection(globalConfig)
+	require.NoError(t, err)
+	require.NoError(t, TruncateAll(conn))
+
+	defer func() {
+		require.NoError(t, ConfigureAuditLog(&globalConfig.AuditLog))
+	}()
+
+	user, err := NewUser("", "audit@example.com", "secret", "authenticated", nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.Create(user))
+
+	var received []AuditLogEntry
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entry AuditLogEntry
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&entry))
+		received = append(received, entry)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	require.NoError(t, ConfigureAuditLog(&conf.AuditLogConfiguration{
+		Sinks: []string{conf.AuditLogSinkFile, conf.AuditLogSinkHTTP},
+		File:  conf.AuditLogFileConfiguration{Path: path},
+		HTTP:  conf.AuditLogHTTPConfiguration{URL: server.URL, BufferSize: 10, Timeout: time.Second},
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/token", nil)
+	require.NoError(t, NewAuditLogEntry(req, conn, user, LoginAction, "127.0.0.1", map[string]interface{}{"provider": "email"}))
+
+	// flush the HTTP sink
+	require.NoError(t, ConfigureAuditLog(&globalConfig.AuditLog))
+
+	fileEntries := readAuditLogFile(t, path)
+	require.Len(t, fileEntries, 1)
+	require.Equal(t, string(LoginAction), fileEntries[0].Payload["action"])
+	require.Equal(t, user.ID.String(), fileEntries[0].Payload["actor_id"])
+	require.False(t, fileEntries[0].CreatedAt.IsZero())
+
+	require.Len(t, received, 1)
+	require.Equal(t, fileEntries[0].ID, received[0].ID)
+
+	// the database sink isn't selected
+	dbEntries, err := FindAuditLogEntries(conn, nil, "", nil)
+	require.NoError(t, err)
+	require.Empty(t, dbEntries)
+
+	require.NoError(t, NewAuditLogEntry(req, conn, user, LogoutAction, "127.0.0.1", nil))
+
+	dbEntries, err = FindAuditLogEntries(conn, nil, "", nil)
+	require.NoError(t, err)
+	require.Len(t, dbEntries, 1)
+	require.Len(t, readAuditLogFile(t, path), 1)
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// Avatar is a stored copy of the profile picture of an external identity,
+// served in place of the picture at SourceURL.
+type Avatar struct {
+	ID          uuid.UUID `json:"id" db:"id"`
+	SourceURL   string    `json:"source_url" db:"source_url"`
+	ContentType string    `json:"content_type" db:"content_type"`
+	Data        []byte    `json:"-" db:"data"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+}
+
+func (Avatar) TableName() string {
+	tableName := "avatars"
+	return tableName
+}
+
+// NewAvatar creates a copy of the picture at the source URL.
+func NewAvatar(sourceURL, contentType string, data []byte) *Avatar {
+	return &Avatar{
+		ID:          uuid.Must(uuid.NewV4()),
+		SourceURL:   sourceURL,
+		ContentType: contentType,
+		Data:        data,
+	}
+}
+
+// FindAvatarByID finds the avatar with the given ID.
+func FindAvatarByID(tx *storage.Connection, id uuid.UUID) (*Avatar, error) {
+	avatar := &Avatar{}
+	if err := tx.Find(avatar, id); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, AvatarNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "Database error finding avatar")
+	}
+
+	return avatar, nil
+}
+
+// FindAvatarBySourceURL finds the stored copy of the picture at the source
+// URL.
+func FindAvatarBySourceURL(tx *storage.Connection, sourceURL string) (*Avatar, error) {
+	avatar := &Avatar{}
+	if err := tx.Q().Where("source_url = ?", sourceURL).First(avatar); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, AvatarNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "Database error finding avatar")
+	}
+
+	return avatar, nil
+}
@@ -42,12 +42,17 @@ func TruncateAll(conn *storage.Connection) error {
 			(&pop.Model{Value: Session{}}).TableName(),
 			(&pop.Model{Value: Factor{}}).TableName(),
 			(&pop.Model{Value: Challenge{}}).TableName(),
+			(&pop.Model{Value: RecoveryCode{}}).TableName(),
 			(&pop.Model{Value: AMRClaim{}}).TableName(),
 			(&pop.Model{Value: SSOProvider{}}).TableName(),
 			(&pop.Model{Value: SSODomain{}}).TableName(),
 			(&pop.Model{Value: SAMLProvider{}}).TableName(),
 			(&pop.Model{Value: SAMLRelayState{}}).TableName(),
 			(&pop.Model{Value: FlowState{}}).TableName(),
+			(&pop.Model{Value: WebhookDeadLetter{}}).TableName(),
+			(&pop.Model{Value: ExternalSubjectBan{}}).TableName(),
+			(&pop.Model{Value: Avatar{}}).TableName(),
+			(&pop.Model{Value: PasswordHistoryEntry{}}).TableName(),
 		}
 
 		for _, tableName := range tables {
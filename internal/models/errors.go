@@ -23,6 +23,12 @@ func IsNotFoundError(err error) bool {
 		return true
 	case FlowStateNotFoundError, *FlowStateNotFoundError:
 		return true
+	case RecoveryCodeNotFoundError, *RecoveryCodeNotFoundError:
+		return true
+	case ExternalSubjectBanNotFoundError, *ExternalSubjectBanNotFoundError:
+		return true
+	case AvatarNotFoundError, *AvatarNotFoundError:
+		return true
 	}
 	return false
 }
@@ -105,3 +111,26 @@ type FlowStateNotFoundError struct{}
 func (e FlowStateNotFoundError) Error() string {
 	return "Flow State not found"
 }
+
+// RecoveryCodeNotFoundError represents an error when an unused recovery code
+// can't be found.
+type RecoveryCodeNotFoundError struct{}
+
+func (e RecoveryCodeNotFoundError) Error() string {
+	return "Recovery code not found"
+}
+
+// ExternalSubjectBanNotFoundError represents an error when a subject of an
+// external provider isn't banned.
+type ExternalSubjectBanNotFoundError struct{}
+
+func (e ExternalSubjectBanNotFoundError) Error() string {
+	return "External subject ban not found"
+}
+
+// AvatarNotFoundError represents an error when an avatar can't be found.
+type AvatarNotFoundError struct{}
+
+func (e AvatarNotFoundError) Error() string {
+	return "Avatar not found"
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// ExternalSubjectBan prevents the subject of an external provider from
+// signing in. The ban is permanent unless BannedUntil is set.
+type ExternalSubjectBan struct {
+	ID          uuid.UUID  `json:"id" db:"id"`
+	Provider    string     `json:"provider" db:"provider"`
+	Subject     string     `json:"subject" db:"subject"`
+	BannedUntil *time.Time `json:"banned_until,omitempty" db:"banned_until"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+func (ExternalSubjectBan) TableName() string {
+	tableName := "external_subject_bans"
+	return tableName
+}
+
+// IsActive reports whether the ban still applies at the given time.
+func (b *ExternalSubjectBan) IsActive(now time.Time) bool {
+	return b.BannedUntil == nil || now.Before(*b.BannedUntil)
+}
+
+// BanExternalSubject bans the subject of the provider, for the given
+// duration or permanently if it's zero, replacing any existing ban.
+func BanExternalSubject(tx *storage.Connection, provider, subject string, duration time.Duration) (*ExternalSubjectBan, error) {
+	ban, err := FindExternalSubjectBan(tx, provider, subject)
+	if err != nil && !IsNotFoundError(err) {
+		return nil, err
+	}
+
+	var bannedUntil *time.Time
+	if duration != 0 {
+		t := time.Now().Add(duration)
+		bannedUntil = &t
+	}
+
+	if ban != nil {
+		ban.BannedUntil = bannedUntil
+		if err := tx.UpdateOnly(ban, "banned_until", "updated_at"); err != nil {
+			return nil, errors.Wrap(err, "Database error updating external subject ban")
+		}
+
+		return ban, nil
+	}
+
+	ban = &ExternalSubjectBan{
+		ID:          uuid.Must(uuid.NewV4()),
+		Provider:    provider,
+		Subject:     subject,
+		BannedUntil: bannedUntil,
+	}
+
+	if err := tx.Create(ban); err != nil {
+		return nil, errors.Wrap(err, "Database error creating external subject ban")
+	}
+
+	return ban, nil
+}
+
+// FindExternalSubjectBan finds the ban of the subject of the provider,
+// whether or not it's still active.
+func FindExternalSubjectBan(tx *storage.Connection, provider, subject string) (*ExternalSubjectBan, error) {
+	ban := &ExternalSubjectBan{}
+	if err := tx.Q().Where("provider = ? and subject = ?", provider, subject).First(ban); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, ExternalSubjectBanNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "Database error finding external subject ban")
+	}
+
+	return ban, nil
+}
+
+// FindExternalSubjectBans returns all bans of external subjects, including
+// expired ones, newest first.
+func FindExternalSubjectBans(tx *storage.Connection) ([]*ExternalSubjectBan, error) {
+	bans := []*ExternalSubjectBan{}
+	if err := tx.Q().Order("created_at desc").All(&bans); err != nil {
+		return nil, errors.Wrap(err, "Database error finding external subject bans")
+	}
+
+	return bans, nil
+}
+
+// IsExternalSubjectBanned reports whether the subject of the provider has
+// an active ban.
+func IsExternalSubjectBanned(tx *storage.Connection, provider, subject string) (bool, error) {
+	ban, err := FindExternalSubjectBan(tx, provider, subject)
+	if err != nil {
+		if IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return ban.IsActive(time.Now()), nil
+}
+
+// DeleteExternalSubjectBan lifts the ban of the subject of the provider.
+func DeleteExternalSubjectBan(tx *storage.Connection, provider, subject string) error {
+	ban, err := FindExternalSubjectBan(tx, provider, subject)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Destroy(ban); err != nil {
+		return errors.Wrap(err, "Database error deleting external subject ban")
+	}
+
+	return nil
+}
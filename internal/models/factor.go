@@ -2,6 +2,8 @@ package models
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -10,6 +12,7 @@ import (
 	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 	"github.com/supabase/gotrue/internal/storage"
+	"github.com/supabase/gotrue/internal/webauthn"
 )
 
 type FactorState int
@@ -30,6 +33,7 @@ func (factorState FactorState) String() string {
 }
 
 const TOTP = "totp"
+const WebAuthn = "webauthn"
 
 type AuthenticationMethod int
 
@@ -44,6 +48,8 @@ const (
 	MagicLink
 	EmailSignup
 	EmailChange
+	WebAuthnSignIn
+	Anonymous
 )
 
 func (authMethod AuthenticationMethod) String() string {
@@ -68,6 +74,10 @@ func (authMethod AuthenticationMethod) String() string {
 		return "email/signup"
 	case EmailChange:
 		return "email_change"
+	case WebAuthnSignIn:
+		return "webauthn"
+	case Anonymous:
+		return "anonymous"
 	}
 	return ""
 }
@@ -97,21 +107,56 @@ func ParseAuthenticationMethod(authMethod string) (AuthenticationMethod, error)
 		return EmailSignup, nil
 	case "email_change":
 		return EmailChange, nil
+	case "webauthn":
+		return WebAuthnSignIn, nil
+	case "anonymous":
+		return Anonymous, nil
 	}
 	return 0, fmt.Errorf("unsupported authentication method %q", authMethod)
 }
 
 type Factor struct {
-	ID           uuid.UUID   `json:"id" db:"id"`
-	User         User        `json:"-" belongs_to:"user"`
-	UserID       uuid.UUID   `json:"-" db:"user_id"`
-	CreatedAt    time.Time   `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time   `json:"updated_at" db:"updated_at"`
-	Status       string      `json:"status" db:"status"`
-	FriendlyName string      `json:"friendly_name,omitempty" db:"friendly_name"`
-	Secret       string      `json:"-" db:"secret"`
-	FactorType   string      `json:"factor_type" db:"factor_type"`
-	Challenge    []Challenge `json:"-" has_many:"challenges"`
+	ID                 uuid.UUID           `json:"id" db:"id"`
+	User               User                `json:"-" belongs_to:"user"`
+	UserID             uuid.UUID           `json:"-" db:"user_id"`
+	CreatedAt          time.Time           `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time           `json:"updated_at" db:"updated_at"`
+	Status             string              `json:"status" db:"status"`
+	FriendlyName       string              `json:"friendly_name,omitempty" db:"friendly_name"`
+	Secret             string              `json:"-" db:"secret"`
+	FactorType         string              `json:"factor_type" db:"factor_type"`
+	WebAuthnCredential *WebAuthnCredential `json:"-" db:"web_authn_credential"`
+	Challenge          []Challenge         `json:"-" has_many:"challenges"`
+}
+
+// WebAuthnCredential is the public key credential registered for a webauthn
+// factor, it is only set once the factor has been verified.
+type WebAuthnCredential struct {
+	webauthn.Credential
+}
+
+func (c *WebAuthnCredential) Value() (driver.Value, error) {
+	if c == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return driver.Value(string(data)), nil
+}
+
+func (c *WebAuthnCredential) Scan(src interface{}) error {
+	var source []byte
+	switch v := src.(type) {
+	case string:
+		source = []byte(v)
+	case []byte:
+		source = v
+	default:
+		return errors.New("invalid data type for WebAuthnCredential")
+	}
+	return json.Unmarshal(source, c)
 }
 
 func (Factor) TableName() string {
@@ -185,6 +230,13 @@ func (f *Factor) UpdateStatus(tx *storage.Connection, state FactorState) error {
 	return tx.UpdateOnly(f, "status", "updated_at")
 }
 
+// UpdateWebAuthnCredential stores the credential registered for a webauthn
+// factor, including its latest signature counter
+func (f *Factor) UpdateWebAuthnCredential(tx *storage.Connection, credential *webauthn.Credential) error {
+	f.WebAuthnCredential = &WebAuthnCredential{Credential: *credential}
+	return tx.UpdateOnly(f, "web_authn_credential", "updated_at")
+}
+
 // UpdateFactorType modifies the factor type
 func (f *Factor) UpdateFactorType(tx *storage.Connection, factorType string) error {
 	f.FactorType = factorType
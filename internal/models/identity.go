@@ -12,13 +12,21 @@ import (
 )
 
 type Identity struct {
-	ID           string     `json:"id" db:"id"`
-	UserID       uuid.UUID  `json:"user_id" db:"user_id"`
-	IdentityData JSONMap    `json:"identity_data,omitempty" db:"identity_data"`
-	Provider     string     `json:"provider" db:"provider"`
-	LastSignInAt *time.Time `json:"last_sign_in_at,omitempty" db:"last_sign_in_at"`
-	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
+	ID           string       `json:"id" db:"id"`
+	UserID       uuid.UUID    `json:"user_id" db:"user_id"`
+	IdentityData IdentityData `json:"identity_data,omitempty" db:"identity_data"`
+	Provider     string       `json:"provider" db:"provider"`
+	LastSignInAt *time.Time   `json:"last_sign_in_at,omitempty" db:"last_sign_in_at"`
+	CreatedAt    time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at" db:"updated_at"`
+
+	// ProviderRefreshToken is the encrypted refresh token issued by the
+	// provider, if any.
+	ProviderRefreshToken *string `json:"-" db:"provider_refresh_token"`
+
+	// ProviderClaims are the allowed ID token claims of the identity, only
+	// set when returned by the user endpoint.
+	ProviderClaims map[string]interface{} `json:"provider_claims,omitempty" db:"-"`
 }
 
 func (Identity) TableName() string {
@@ -26,6 +34,24 @@ func (Identity) TableName() string {
 	return tableName
 }
 
+// StoredClaims returns the verified ID token claims stored in the identity
+// data, limited to the allowed ones. It returns nil if no claims are stored.
+func (i *Identity) StoredClaims(allowed []string) map[string]interface{} {
+	claims, ok := i.IdentityData["claims"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	result := make(map[string]interface{}, len(allowed))
+	for _, key := range allowed {
+		if value, ok := claims[key]; ok {
+			result[key] = value
+		}
+	}
+
+	return result
+}
+
 // NewIdentity returns an identity associated to the user's id.
 func NewIdentity(user *User, provider string, identityData map[string]interface{}) (*Identity, error) {
 	providerId, ok := identityData["sub"]
@@ -84,6 +110,15 @@ func FindIdentitiesByUserID(tx *storage.Connection, userID uuid.UUID) ([]*Identi
 	return identities, nil
 }
 
+// CountIdentitiesByUserID returns the number of identities of a user.
+func CountIdentitiesByUserID(tx *storage.Connection, userID uuid.UUID) (int, error) {
+	count, err := tx.Q().Where("user_id = ?", userID).Count(&Identity{})
+	if err != nil {
+		return 0, errors.Wrap(err, "error counting identities")
+	}
+	return count, nil
+}
+
 // FindProvidersByUser returns all providers associated to a user
 func FindProvidersByUser(tx *storage.Connection, user *User) ([]string, error) {
 	identities := []Identity{}
@@ -100,6 +135,12 @@ func FindProvidersByUser(tx *storage.Connection, user *User) ([]string, error) {
 	return providers, nil
 }
 
+// Delete removes the identity. Identities are keyed by both their id and
+// provider, so the same id may belong to identities of other providers.
+func (i *Identity) Delete(tx *storage.Connection) error {
+	return tx.RawQuery("delete from "+(&pop.Model{Value: Identity{}}).TableName()+" where id = ? and provider = ? and user_id = ?", i.ID, i.Provider, i.UserID).Exec()
+}
+
 // UpdateIdentityData sets all identity_data from a map of updates,
 // ensuring that it doesn't override attributes that are not
 // in the provided map.
@@ -123,3 +164,16 @@ func (i *Identity) UpdateIdentityData(tx *storage.Connection, updates map[string
 		i.ID,
 	).Exec()
 }
+
+// SetProviderRefreshToken stores the encrypted provider refresh token, or
+// clears it if nil.
+func (i *Identity) SetProviderRefreshToken(tx *storage.Connection, encrypted *string) error {
+	i.ProviderRefreshToken = encrypted
+	// pop doesn't support updates on tables with composite primary keys so we use a raw query here.
+	return tx.RawQuery(
+		"update "+(&pop.Model{Value: Identity{}}).TableName()+" set provider_refresh_token = ? where provider = ? and id = ?",
+		i.ProviderRefreshToken,
+		i.Provider,
+		i.ID,
+	).Exec()
+}
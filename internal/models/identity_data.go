@@ -0,0 +1,103 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+
+	"github.com/supabase/gotrue/internal/crypto"
+)
+
+// EncryptedIdentityDataFields are the identity_data fields that are
+// encrypted at rest when encryption is configured.
+var EncryptedIdentityDataFields []string
+
+// IdentityData is the identity_data of an identity. The values of the
+// EncryptedIdentityDataFields are stored encrypted, and transparently
+// decrypted when read.
+type IdentityData map[string]interface{}
+
+func (d IdentityData) Value() (driver.Value, error) {
+	stored := make(map[string]interface{}, len(d))
+	for key, value := range d {
+		stored[key] = value
+	}
+
+	if crypto.EncryptionEnabled() {
+		for _, field := range EncryptedIdentityDataFields {
+			value, ok := stored[field]
+			if !ok || value == nil {
+				continue
+			}
+
+			if encrypted, ok := value.(string); ok && crypto.IsEncrypted(encrypted) {
+				continue
+			}
+
+			plaintext, err := json.Marshal(value)
+			if err != nil {
+				return driver.Value(""), err
+			}
+
+			encrypted, err := crypto.Encrypt(string(plaintext))
+			if err != nil {
+				return driver.Value(""), err
+			}
+
+			stored[field] = encrypted
+		}
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return driver.Value(""), err
+	}
+	return driver.Value(string(data)), nil
+}
+
+func (d *IdentityData) Scan(src interface{}) error {
+	var source []byte
+	switch v := src.(type) {
+	case string:
+		source = []byte(v)
+	case []byte:
+		source = v
+	case nil:
+		source = []byte("")
+	default:
+		return errors.New("invalid data type for IdentityData")
+	}
+
+	if len(source) == 0 {
+		source = []byte("{}")
+	}
+
+	data := map[string]interface{}{}
+	if err := json.Unmarshal(source, &data); err != nil {
+		return err
+	}
+
+	// values are decrypted regardless of whether their field is still
+	// designated, so that fields can stop being encrypted
+	for key, value := range data {
+		encrypted, ok := value.(string)
+		if !ok || !crypto.IsEncrypted(encrypted) {
+			continue
+		}
+
+		plaintext, err := crypto.Decrypt(encrypted)
+		if err != nil {
+			return err
+		}
+
+		var decrypted interface{}
+		if err := json.Unmarshal([]byte(plaintext), &decrypted); err != nil {
+			return err
+		}
+
+		data[key] = decrypted
+	}
+
+	*d = data
+	return nil
+}
@@ -1,12 +1,14 @@
 package models
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/gofrs/uuid"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/crypto"
 	"github.com/supabase/gotrue/internal/storage"
 	"github.com/supabase/gotrue/internal/storage/test"
 )
@@ -83,6 +85,107 @@ func (ts *IdentityTestSuite) TestUpdateIdentityData() {
 	}
 }
 
+func (ts *IdentityTestSuite) configureEncryption(config *conf.SecurityConfiguration) {
+	require.NoError(ts.T(), crypto.ConfigureEncryption(config))
+	EncryptedIdentityDataFields = config.EncryptedIdentityDataFields
+
+	ts.T().Cleanup(func() {
+		require.NoError(ts.T(), crypto.ConfigureEncryption(&conf.SecurityConfiguration{}))
+		EncryptedIdentityDataFields = nil
+	})
+}
+
+// storedIdentityData returns the identity_data of the identity as stored in
+// the database, without decrypting it.
+func (ts *IdentityTestSuite) storedIdentityData(identity *Identity) map[string]interface{} {
+	stored := struct {
+		IdentityData string `db:"identity_data"`
+	}{}
+	require.NoError(ts.T(), ts.db.RawQuery("select identity_data::text as identity_data from "+identity.TableName()+" where id = ? and provider = ?", identity.ID, identity.Provider).First(&stored))
+
+	data := map[string]interface{}{}
+	require.NoError(ts.T(), json.Unmarshal([]byte(stored.IdentityData), &data))
+
+	return data
+}
+
+func (ts *IdentityTestSuite) TestIdentityDataEncryption() {
+	ts.configureEncryption(&conf.SecurityConfiguration{
+		EncryptionKey:               "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		EncryptionKeyID:             "key-1",
+		EncryptedIdentityDataFields: []string{"claims"},
+	})
+
+	user := ts.createUserWithEmail("test@supabase.io")
+
+	claims := map[string]interface{}{"iss": "https://accounts.google.com", "hd": "supabase.io"}
+	identity, err := NewIdentity(user, "google", map[string]interface{}{
+		"sub":    "google-subject",
+		"email":  "test@supabase.io",
+		"claims": claims,
+	})
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.db.Create(identity))
+
+	stored := ts.storedIdentityData(identity)
+	require.Equal(ts.T(), "test@supabase.io", stored["email"])
+	require.IsType(ts.T(), "", stored["claims"])
+	require.True(ts.T(), crypto.IsEncrypted(stored["claims"].(string)))
+	require.NotContains(ts.T(), stored["claims"], "accounts.google.com")
+
+	found, err := FindIdentityByIdAndProvider(ts.db, "google-subject", "google")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), claims, found.IdentityData["claims"])
+	require.Equal(ts.T(), "test@supabase.io", found.IdentityData["email"])
+
+	// updates keep the fields encrypted
+	require.NoError(ts.T(), found.UpdateIdentityData(ts.db, map[string]interface{}{"name": "Test"}))
+	require.True(ts.T(), crypto.IsEncrypted(ts.storedIdentityData(found)["claims"].(string)))
+
+	found, err = FindIdentityByIdAndProvider(ts.db, "google-subject", "google")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), claims, found.IdentityData["claims"])
+	require.Equal(ts.T(), "Test", found.IdentityData["name"])
+}
+
+func (ts *IdentityTestSuite) TestIdentityDataEncryptionKeyRotation() {
+	ts.configureEncryption(&conf.SecurityConfiguration{
+		EncryptionKey:               "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		EncryptionKeyID:             "key-1",
+		EncryptedIdentityDataFields: []string{"claims"},
+	})
+
+	user := ts.createUserWithEmail("test@supabase.io")
+
+	claims := map[string]interface{}{"iss": "https://accounts.google.com"}
+	identity, err := NewIdentity(user, "google", map[string]interface{}{
+		"sub":    "google-subject",
+		"claims": claims,
+	})
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.db.Create(identity))
+
+	ts.configureEncryption(&conf.SecurityConfiguration{
+		EncryptionKey:               "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=",
+		EncryptionKeyID:             "key-2",
+		DecryptionKeys:              map[string]string{"key-1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="},
+		EncryptedIdentityDataFields: []string{"claims"},
+	})
+
+	// records encrypted with the previous key are still decrypted
+	found, err := FindIdentityByIdAndProvider(ts.db, "google-subject", "google")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), claims, found.IdentityData["claims"])
+
+	// and are encrypted with the new key when they're updated
+	require.NoError(ts.T(), found.UpdateIdentityData(ts.db, map[string]interface{}{"name": "Test"}))
+	require.Contains(ts.T(), ts.storedIdentityData(found)["claims"], "enc:key-2:")
+
+	found, err = FindIdentityByIdAndProvider(ts.db, "google-subject", "google")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), claims, found.IdentityData["claims"])
+}
+
 func (ts *IdentityTestSuite) createUserWithEmail(email string) *User {
 	user, err := NewUser("", email, "secret", "test", nil)
 	require.NoError(ts.T(), err)
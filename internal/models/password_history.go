@@ -0,0 +1,87 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/supabase/gotrue/internal/crypto"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// PasswordHistoryEntry is the hash of a password the user has set, kept so
+// that it can't be set again.
+type PasswordHistoryEntry struct {
+	ID                uuid.UUID `json:"id" db:"id"`
+	UserID            uuid.UUID `json:"user_id" db:"user_id"`
+	EncryptedPassword string    `json:"-" db:"encrypted_password"`
+	CreatedAt         time.Time `json:"created_at" db:"created_at"`
+}
+
+func (PasswordHistoryEntry) TableName() string {
+	tableName := "password_history"
+	return tableName
+}
+
+// AddToPasswordHistory records the user's current password in their
+// password history before it's replaced, keeping only the length most
+// recent entries.
+func AddToPasswordHistory(tx *storage.Connection, user *User, length int) error {
+	if user.EncryptedPassword == "" {
+		return nil
+	}
+
+	entry := &PasswordHistoryEntry{
+		ID:                uuid.Must(uuid.NewV4()),
+		UserID:            user.ID,
+		EncryptedPassword: user.EncryptedPassword,
+	}
+	if err := tx.Create(entry); err != nil {
+		return errors.Wrap(err, "Database error creating password history entry")
+	}
+
+	tableName := (&pop.Model{Value: PasswordHistoryEntry{}}).TableName()
+	if err := tx.RawQuery("DELETE FROM "+tableName+" WHERE user_id = ? AND id NOT IN (SELECT id FROM "+tableName+" WHERE user_id = ? ORDER BY created_at DESC LIMIT ?)", user.ID, user.ID, length).Exec(); err != nil {
+		return errors.Wrap(err, "Database error trimming password history")
+	}
+
+	return nil
+}
+
+// FindPasswordHistory returns the password history of the user, most recent
+// first.
+func FindPasswordHistory(tx *storage.Connection, user *User) ([]PasswordHistoryEntry, error) {
+	entries := []PasswordHistoryEntry{}
+	if err := tx.Q().Where("user_id = ?", user.ID).Order("created_at desc").All(&entries); err != nil {
+		return nil, errors.Wrap(err, "Database error finding password history")
+	}
+
+	return entries, nil
+}
+
+// IsPasswordReused checks whether the password is the user's current
+// password or one of the length most recent passwords in their history.
+func IsPasswordReused(tx *storage.Connection, user *User, password string, length int) (bool, error) {
+	if user.EncryptedPassword != "" && user.Authenticate(password) {
+		return true, nil
+	}
+
+	entries, err := FindPasswordHistory(tx, user)
+	if err != nil {
+		return false, err
+	}
+
+	for i, entry := range entries {
+		if i >= length {
+			break
+		}
+
+		if crypto.CompareHashAndPassword(context.Background(), entry.EncryptedPassword, password) == nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/supabase/gotrue/internal/crypto"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// RecoveryCode is a single use code that can be used in place of a TOTP code
+// when the user has lost access to their authenticator. Only a hash of the
+// code is stored.
+type RecoveryCode struct {
+	ID        uuid.UUID  `json:"id" db:"id"`
+	FactorID  uuid.UUID  `json:"factor_id" db:"factor_id"`
+	CodeHash  string     `json:"-" db:"code_hash"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty" db:"used_at"`
+}
+
+func (RecoveryCode) TableName() string {
+	tableName := "mfa_recovery_codes"
+	return tableName
+}
+
+// hashRecoveryCode hashes a recovery code for storage, ignoring case and
+// any separators the user may have typed.
+func hashRecoveryCode(factor *Factor, code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return crypto.GenerateTokenHash(factor.ID.String(), code)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the factor with n
+// new ones and returns them. Previously generated codes can no longer be
+// used.
+func RegenerateRecoveryCodes(tx *storage.Connection, factor *Factor, n int) ([]string, error) {
+	if err := DeleteRecoveryCodes(tx, factor); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, n)
+	for i := 0; i < n; i += 1 {
+		code := crypto.GenerateRecoveryCode()
+		recoveryCode := &RecoveryCode{
+			ID:       uuid.Must(uuid.NewV4()),
+			FactorID: factor.ID,
+			CodeHash: hashRecoveryCode(factor, code),
+		}
+		if err := tx.Create(recoveryCode); err != nil {
+			return nil, errors.Wrap(err, "Database error creating recovery code")
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+// ConsumeRecoveryCode marks the unused recovery code of the factor as used.
+// RecoveryCodeNotFoundError is returned if there is no such code.
+func ConsumeRecoveryCode(tx *storage.Connection, factor *Factor, code string) error {
+	recoveryCode := &RecoveryCode{}
+	if err := tx.Q().Where("factor_id = ? and code_hash = ? and used_at is null", factor.ID, hashRecoveryCode(factor, code)).First(recoveryCode); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return RecoveryCodeNotFoundError{}
+		}
+		return errors.Wrap(err, "Database error finding recovery code")
+	}
+
+	// guards against the code being used concurrently
+	count, err := tx.RawQuery("UPDATE "+(&pop.Model{Value: RecoveryCode{}}).TableName()+" SET used_at = ? WHERE id = ? and used_at is null", time.Now(), recoveryCode.ID).ExecWithCount()
+	if err != nil {
+		return errors.Wrap(err, "Database error consuming recovery code")
+	}
+	if count == 0 {
+		return RecoveryCodeNotFoundError{}
+	}
+
+	return nil
+}
+
+// DeleteRecoveryCodes deletes all recovery codes of the factor.
+func DeleteRecoveryCodes(tx *storage.Connection, factor *Factor) error {
+	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: RecoveryCode{}}).TableName()+" WHERE factor_id = ?", factor.ID).Exec()
+}
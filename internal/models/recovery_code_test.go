@@ -0,0 +1,94 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/supabase/gotrue/internal/conf"
+	"github.com/supabase/gotrue/internal/storage"
+	"github.com/supabase/gotrue/internal/storage/test"
+)
+
+type RecoveryCodeTestSuite struct {
+	suite.Suite
+	db *storage.Connection
+}
+
+func TestRecoveryCode(t *testing.T) {
+	globalConfig, err := conf.LoadGlobal(modelsTestConfig)
+	require.NoError(t, err)
+	conn, err := test.SetupDBConnection(globalConfig)
+	require.NoError(t, err)
+	ts := &RecoveryCodeTestSuite{
+		db: conn,
+	}
+	defer ts.db.Close()
+	suite.Run(t, ts)
+}
+
+func (ts *RecoveryCodeTestSuite) SetupTest() {
+	TruncateAll(ts.db)
+}
+
+func (ts *RecoveryCodeTestSuite) createFactor() *Factor {
+	user, err := NewUser("", "recovery@example.com", "secret", "test", nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.db.Create(user))
+
+	factor, err := NewFactor(user, "", TOTP, FactorStateVerified, "topsecret")
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.db.Create(factor))
+
+	return factor
+}
+
+func (ts *RecoveryCodeTestSuite) TestRecoveryCodesAreStoredHashed() {
+	factor := ts.createFactor()
+
+	codes, err := RegenerateRecoveryCodes(ts.db, factor, 10)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), codes, 10)
+
+	recoveryCodes := []RecoveryCode{}
+	require.NoError(ts.T(), ts.db.Q().Where("factor_id = ?", factor.ID).All(&recoveryCodes))
+	require.Len(ts.T(), recoveryCodes, 10)
+
+	for _, recoveryCode := range recoveryCodes {
+		require.NotEmpty(ts.T(), recoveryCode.CodeHash)
+		for _, code := range codes {
+			require.NotContains(ts.T(), recoveryCode.CodeHash, strings.ReplaceAll(code, "-", ""))
+		}
+	}
+}
+
+func (ts *RecoveryCodeTestSuite) TestConsumeRecoveryCodeOnlyOnce() {
+	factor := ts.createFactor()
+
+	codes, err := RegenerateRecoveryCodes(ts.db, factor, 10)
+	require.NoError(ts.T(), err)
+
+	// codes are accepted regardless of case and separators
+	require.NoError(ts.T(), ConsumeRecoveryCode(ts.db, factor, strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))))
+	require.ErrorIs(ts.T(), ConsumeRecoveryCode(ts.db, factor, codes[0]), RecoveryCodeNotFoundError{})
+
+	require.NoError(ts.T(), ConsumeRecoveryCode(ts.db, factor, codes[1]))
+	require.ErrorIs(ts.T(), ConsumeRecoveryCode(ts.db, factor, "aaaaa-aaaaa"), RecoveryCodeNotFoundError{})
+}
+
+func (ts *RecoveryCodeTestSuite) TestRegenerateRecoveryCodesInvalidatesPreviousCodes() {
+	factor := ts.createFactor()
+
+	previousCodes, err := RegenerateRecoveryCodes(ts.db, factor, 10)
+	require.NoError(ts.T(), err)
+
+	codes, err := RegenerateRecoveryCodes(ts.db, factor, 10)
+	require.NoError(ts.T(), err)
+
+	for _, code := range previousCodes {
+		require.ErrorIs(ts.T(), ConsumeRecoveryCode(ts.db, factor, code), RecoveryCodeNotFoundError{})
+	}
+	require.NoError(ts.T(), ConsumeRecoveryCode(ts.db, factor, codes[0]))
+}
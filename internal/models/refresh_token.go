@@ -10,6 +10,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/supabase/gotrue/internal/crypto"
 	"github.com/supabase/gotrue/internal/storage"
+	"github.com/supabase/gotrue/internal/utilities"
 )
 
 // RefreshToken is the database model for refresh tokens.
@@ -23,6 +24,10 @@ type RefreshToken struct {
 	Parent    storage.NullString `db:"parent"`
 	SessionId *uuid.UUID         `db:"session_id"`
 
+	// Fingerprint is the utilities.ClientFingerprint of the client the
+	// token was issued to.
+	Fingerprint storage.NullString `db:"fingerprint"`
+
 	Revoked   bool      `db:"revoked"`
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
@@ -41,6 +46,26 @@ type GrantParams struct {
 	FactorID *uuid.UUID
 
 	SessionNotAfter *time.Time
+
+	// UserAgent and IP identify the client of a new session.
+	UserAgent string
+	IP        string
+
+	// Fingerprint binds the refresh tokens of a new session to the client.
+	Fingerprint string
+
+	// ClientID is the provider client ID the ID token of an id_token
+	// grant was issued to, recorded on the new session.
+	ClientID string
+}
+
+// FillGrantParams sets the client information of a new session from the
+// request. The X-Forwarded-For header is only honored for requests coming
+// through one of the trusted proxies.
+func (g *GrantParams) FillGrantParams(r *http.Request, trustedProxies []string) {
+	g.UserAgent = utilities.NormalizeUserAgent(r.Header.Get("User-Agent"))
+	g.IP = utilities.GetClientIPAddress(r, trustedProxies)
+	g.Fingerprint = utilities.ClientFingerprint(r)
 }
 
 // GrantAuthenticatedUser creates a refresh token for the provided user.
@@ -110,7 +135,9 @@ func createRefreshToken(tx *storage.Connection, user *User, oldToken *RefreshTok
 	if oldToken != nil {
 		token.Parent = storage.NullString(oldToken.Token)
 		token.SessionId = oldToken.SessionId
-
+		token.Fingerprint = oldToken.Fingerprint
+	} else {
+		token.Fingerprint = storage.NullString(params.Fingerprint)
 	}
 
 	if token.SessionId == nil {
@@ -129,6 +156,18 @@ func createRefreshToken(tx *storage.Connection, user *User, oldToken *RefreshTok
 			session.NotAfter = params.SessionNotAfter
 		}
 
+		if params.UserAgent != "" {
+			session.UserAgent = &params.UserAgent
+		}
+
+		if params.IP != "" {
+			session.IP = &params.IP
+		}
+
+		if params.ClientID != "" {
+			session.ClientID = &params.ClientID
+		}
+
 		if err := tx.Create(session); err != nil {
 			return nil, errors.Wrap(err, "error creating new session")
 		}
@@ -58,16 +58,30 @@ func (s sortAMREntries) Swap(i, j int) {
 }
 
 type Session struct {
-	ID        uuid.UUID  `json:"-" db:"id"`
-	UserID    uuid.UUID  `json:"user_id" db:"user_id"`
-	NotAfter  *time.Time `json:"not_after,omitempty" db:"not_after"`
-	CreatedAt time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt time.Time  `json:"updated_at" db:"updated_at"`
-	FactorID  *uuid.UUID `json:"factor_id" db:"factor_id"`
-	AMRClaims []AMRClaim `json:"amr,omitempty" has_many:"amr_claims"`
-	AAL       *string    `json:"aal" db:"aal"`
+	ID           uuid.UUID  `json:"-" db:"id"`
+	UserID       uuid.UUID  `json:"user_id" db:"user_id"`
+	NotAfter     *time.Time `json:"not_after,omitempty" db:"not_after"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
+	LastActiveAt *time.Time `json:"last_active_at,omitempty" db:"last_active_at"`
+	FactorID     *uuid.UUID `json:"factor_id" db:"factor_id"`
+	AMRClaims    []AMRClaim `json:"amr,omitempty" has_many:"amr_claims"`
+	AAL          *string    `json:"aal" db:"aal"`
+	UserAgent    *string    `json:"user_agent,omitempty" db:"user_agent"`
+	IP           *string    `json:"ip,omitempty" db:"ip"`
+	ClientID     *string    `json:"client_id,omitempty" db:"client_id"`
 }
 
+// SessionValidityReason describes why a session is no longer valid.
+type SessionValidityReason int
+
+const (
+	SessionValid SessionValidityReason = iota
+	SessionPastNotAfter
+	SessionPastTimebox
+	SessionTimedOut
+)
+
 func (Session) TableName() string {
 	tableName := "sessions"
 	return tableName
@@ -129,6 +143,15 @@ func FindSessionByUserID(tx *storage.Connection, userId uuid.UUID) (*Session, er
 	return session, nil
 }
 
+// FindSessionsByUserID returns all sessions of the user, newest first.
+func FindSessionsByUserID(tx *storage.Connection, userID uuid.UUID) ([]*Session, error) {
+	sessions := []*Session{}
+	if err := tx.Q().Where("user_id = ?", userID).Order("created_at desc").All(&sessions); err != nil {
+		return nil, errors.Wrap(err, "error finding sessions")
+	}
+	return sessions, nil
+}
+
 func FindSessionsByFactorID(tx *storage.Connection, factorID uuid.UUID) ([]*Session, error) {
 	sessions := []*Session{}
 	if err := tx.Q().Where("factor_id = ?", factorID).All(&sessions); err != nil {
@@ -160,6 +183,39 @@ func LogoutAllExceptMe(tx *storage.Connection, sessionId uuid.UUID, userID uuid.
 	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: Session{}}).TableName()+" WHERE id != ? AND user_id = ?", sessionId, userID).Exec()
 }
 
+// CheckValidity reports whether the session is still valid at now. The
+// session expires once it is older than timebox, or once it hasn't been
+// active for longer than inactivityTimeout. A zero duration disables the
+// respective check.
+func (s *Session) CheckValidity(now time.Time, timebox, inactivityTimeout time.Duration) SessionValidityReason {
+	if s.NotAfter != nil && now.After(*s.NotAfter) {
+		return SessionPastNotAfter
+	}
+
+	if timebox > 0 && now.After(s.CreatedAt.Add(timebox)) {
+		return SessionPastTimebox
+	}
+
+	if inactivityTimeout > 0 {
+		lastActiveAt := s.CreatedAt
+		if s.LastActiveAt != nil {
+			lastActiveAt = *s.LastActiveAt
+		}
+
+		if now.After(lastActiveAt.Add(inactivityTimeout)) {
+			return SessionTimedOut
+		}
+	}
+
+	return SessionValid
+}
+
+// UpdateLastActiveAt records that the session was used at now.
+func (s *Session) UpdateLastActiveAt(tx *storage.Connection, now time.Time) error {
+	s.LastActiveAt = &now
+	return tx.UpdateOnly(s, "last_active_at")
+}
+
 func (s *Session) UpdateAssociatedFactor(tx *storage.Connection, factorID *uuid.UUID) error {
 	s.FactorID = factorID
 	return tx.Update(s)
@@ -173,7 +229,7 @@ func (s *Session) UpdateAssociatedAAL(tx *storage.Connection, aal string) error
 func (s *Session) CalculateAALAndAMR(tx *storage.Connection) (aal string, amr []AMREntry, err error) {
 	amr, aal = []AMREntry{}, AAL1.String()
 	for _, claim := range s.AMRClaims {
-		if *claim.AuthenticationMethod == TOTPSignIn.String() {
+		if *claim.AuthenticationMethod == TOTPSignIn.String() || *claim.AuthenticationMethod == WebAuthnSignIn.String() {
 			aal = AAL2.String()
 		}
 		amr = append(amr, AMREntry{Method: claim.GetAuthenticationMethod(), Timestamp: claim.UpdatedAt.Unix()})
@@ -217,6 +273,24 @@ func (s *Session) CalculateAALAndAMR(tx *storage.Connection) (aal string, amr []
 	return aal, amr, nil
 }
 
+// GrantMethod returns the authentication method that created the session,
+// which is the method of its earliest AMR claim.
+func (s *Session) GrantMethod() string {
+	var first *AMRClaim
+	for i := range s.AMRClaims {
+		claim := &s.AMRClaims[i]
+		if first == nil || claim.CreatedAt.Before(first.CreatedAt) {
+			first = claim
+		}
+	}
+
+	if first == nil {
+		return ""
+	}
+
+	return first.GetAuthenticationMethod()
+}
+
 func (s *Session) GetAAL() string {
 	if s.AAL == nil {
 		return ""
@@ -228,6 +302,25 @@ func (s *Session) IsAAL2() bool {
 	return s.GetAAL() == AAL2.String()
 }
 
+// LastMFAAt returns when an MFA challenge was last completed in the session,
+// or nil if there was none. The AMR claims must be loaded.
+func (s *Session) LastMFAAt() *time.Time {
+	var lastMFAAt *time.Time
+	for i := range s.AMRClaims {
+		claim := &s.AMRClaims[i]
+		method := claim.GetAuthenticationMethod()
+		if method != TOTPSignIn.String() && method != WebAuthnSignIn.String() {
+			continue
+		}
+
+		if lastMFAAt == nil || claim.UpdatedAt.After(*lastMFAAt) {
+			lastMFAAt = &claim.UpdatedAt
+		}
+	}
+
+	return lastMFAAt
+}
+
 // FindCurrentlyActiveRefreshToken returns the currently active refresh
 // token in the session. This is the last created (ordered by the serial
 // primary key) non-revoked refresh token for the session.
@@ -97,3 +97,79 @@ func (ts *SessionsTestSuite) TestCalculateAALAndAMR() {
 	}
 	require.True(ts.T(), found)
 }
+
+func TestSessionCheckValidity(t *testing.T) {
+	createdAt := time.Now()
+	lastActiveAt := createdAt.Add(3 * time.Hour)
+	notAfter := createdAt.Add(2 * time.Hour)
+
+	cases := []struct {
+		desc              string
+		session           Session
+		now               time.Time
+		timebox           time.Duration
+		inactivityTimeout time.Duration
+		expected          SessionValidityReason
+	}{
+		{
+			desc:     "no limits",
+			session:  Session{CreatedAt: createdAt},
+			now:      createdAt.Add(1000 * time.Hour),
+			expected: SessionValid,
+		},
+		{
+			desc:     "past not after",
+			session:  Session{CreatedAt: createdAt, NotAfter: &notAfter},
+			now:      notAfter.Add(time.Second),
+			expected: SessionPastNotAfter,
+		},
+		{
+			desc:     "within timebox",
+			session:  Session{CreatedAt: createdAt},
+			now:      createdAt.Add(8 * time.Hour),
+			timebox:  8 * time.Hour,
+			expected: SessionValid,
+		},
+		{
+			desc:     "past timebox despite activity",
+			session:  Session{CreatedAt: createdAt, LastActiveAt: &lastActiveAt},
+			now:      createdAt.Add(8*time.Hour + time.Second),
+			timebox:  8 * time.Hour,
+			expected: SessionPastTimebox,
+		},
+		{
+			desc:              "never active within inactivity timeout",
+			session:           Session{CreatedAt: createdAt},
+			now:               createdAt.Add(time.Hour),
+			inactivityTimeout: time.Hour,
+			expected:          SessionValid,
+		},
+		{
+			desc:              "never active past inactivity timeout",
+			session:           Session{CreatedAt: createdAt},
+			now:               createdAt.Add(time.Hour + time.Second),
+			inactivityTimeout: time.Hour,
+			expected:          SessionTimedOut,
+		},
+		{
+			desc:              "recently active within inactivity timeout",
+			session:           Session{CreatedAt: createdAt, LastActiveAt: &lastActiveAt},
+			now:               lastActiveAt.Add(time.Hour),
+			inactivityTimeout: time.Hour,
+			expected:          SessionValid,
+		},
+		{
+			desc:              "active past inactivity timeout",
+			session:           Session{CreatedAt: createdAt, LastActiveAt: &lastActiveAt},
+			now:               lastActiveAt.Add(time.Hour + time.Second),
+			inactivityTimeout: time.Hour,
+			expected:          SessionTimedOut,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			require.Equal(t, c.expected, c.session.CheckValidity(c.now, c.timebox, c.inactivityTimeout))
+		})
+	}
+}
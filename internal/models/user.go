@@ -25,6 +25,10 @@ type User struct {
 	Email     storage.NullString `json:"email" db:"email"`
 	IsSSOUser bool               `json:"-" db:"is_sso_user"`
 
+	// IsAnonymous is true for users created with an anonymous sign-in
+	// that have not been converted to a permanent user yet.
+	IsAnonymous bool `json:"is_anonymous" db:"is_anonymous"`
+
 	EncryptedPassword string     `json:"-" db:"encrypted_password"`
 	EmailConfirmedAt  *time.Time `json:"email_confirmed_at,omitempty" db:"email_confirmed_at"`
 	InvitedAt         *time.Time `json:"invited_at,omitempty" db:"invited_at"`
@@ -47,6 +51,15 @@ type User struct {
 	EmailChangeSentAt        *time.Time `json:"email_change_sent_at,omitempty" db:"email_change_sent_at"`
 	EmailChangeConfirmStatus int        `json:"-" db:"email_change_confirm_status"`
 
+	// EmailOtpAttempts counts the failed attempts at verifying the email
+	// OTPs last sent to the user.
+	EmailOtpAttempts int `json:"-" db:"email_otp_attempts"`
+
+	// FailedLoginAttempts counts the consecutive failed password logins
+	// since the last successful login or lockout.
+	FailedLoginAttempts int        `json:"-" db:"failed_login_attempts"`
+	LockedUntil         *time.Time `json:"locked_until,omitempty" db:"locked_until"`
+
 	PhoneChangeToken  string     `json:"-" db:"phone_change_token"`
 	PhoneChange       string     `json:"new_phone,omitempty" db:"phone_change"`
 	PhoneChangeSentAt *time.Time `json:"phone_change_sent_at,omitempty" db:"phone_change_sent_at"`
@@ -56,6 +69,10 @@ type User struct {
 
 	LastSignInAt *time.Time `json:"last_sign_in_at,omitempty" db:"last_sign_in_at"`
 
+	// Locale is the user's preferred locale for emails and SMS messages,
+	// e.g. "pt-BR".
+	Locale string `json:"locale,omitempty" db:"locale"`
+
 	AppMetaData  JSONMap `json:"app_metadata" db:"raw_app_meta_data"`
 	UserMetaData JSONMap `json:"user_metadata" db:"raw_user_meta_data"`
 
@@ -72,11 +89,22 @@ type User struct {
 
 // NewUser initializes a new user from an email, password and user data.
 func NewUser(phone, email, password, aud string, userData map[string]interface{}) (*User, error) {
-	id := uuid.Must(uuid.NewV4())
 	pw, err := crypto.GenerateFromPassword(context.Background(), password)
 	if err != nil {
 		return nil, err
 	}
+	return NewUserWithPasswordHash(phone, email, pw, aud, userData)
+}
+
+// NewUserWithPasswordHash initializes a new user from an existing bcrypt or
+// Argon2 password hash, e.g. when importing users from another system.
+func NewUserWithPasswordHash(phone, email, passwordHash, aud string, userData map[string]interface{}) (*User, error) {
+	if passwordHash != "" {
+		if err := crypto.ValidatePasswordHash(passwordHash); err != nil {
+			return nil, err
+		}
+	}
+	id := uuid.Must(uuid.NewV4())
 	if userData == nil {
 		userData = make(map[string]interface{})
 	}
@@ -86,7 +114,7 @@ func NewUser(phone, email, password, aud string, userData map[string]interface{}
 		Email:             storage.NullString(strings.ToLower(email)),
 		Phone:             storage.NullString(phone),
 		UserMetaData:      userData,
-		EncryptedPassword: pw,
+		EncryptedPassword: passwordHash,
 	}
 	return user, nil
 }
@@ -221,6 +249,13 @@ func (u *User) SetEmail(tx *storage.Connection, email string) error {
 	return tx.UpdateOnly(u, "email")
 }
 
+// ConvertToPermanent clears the anonymous flag of a user that was linked to
+// an email address or external identity.
+func (u *User) ConvertToPermanent(tx *storage.Connection) error {
+	u.IsAnonymous = false
+	return tx.UpdateOnly(u, "is_anonymous")
+}
+
 // SetPhone sets the user's phone
 func (u *User) SetPhone(tx *storage.Connection, phone string) error {
 	u.Phone = storage.NullString(phone)
@@ -259,6 +294,21 @@ func (u *User) Authenticate(password string) bool {
 	return err == nil
 }
 
+// UpgradePasswordHash rehashes the already authenticated password if the
+// stored hash does not use the current password hashing algorithm or
+// parameters. Sessions are not affected.
+func (u *User) UpgradePasswordHash(tx *storage.Connection, password string) error {
+	if !crypto.NeedsRehash(u.EncryptedPassword) {
+		return nil
+	}
+	pw, err := crypto.GenerateFromPassword(context.Background(), password)
+	if err != nil {
+		return err
+	}
+	u.EncryptedPassword = pw
+	return tx.UpdateOnly(u, "encrypted_password")
+}
+
 // ConfirmReauthentication resets the reauthentication token
 func (u *User) ConfirmReauthentication(tx *storage.Connection) error {
 	u.ReauthenticationToken = ""
@@ -273,6 +323,99 @@ func (u *User) Confirm(tx *storage.Connection) error {
 	return tx.UpdateOnly(u, "confirmation_token", "email_confirmed_at")
 }
 
+// IncrementEmailOtpAttempts records a failed attempt at verifying an email
+// OTP. Once maxAttempts is reached, all outstanding email OTPs are
+// invalidated, so that a new one has to be requested, and true is returned.
+func (u *User) IncrementEmailOtpAttempts(tx *storage.Connection, maxAttempts int) (bool, error) {
+	// incrementing in the database locks the row, so that concurrent
+	// attempts are all counted
+	if err := tx.RawQuery("UPDATE "+(&pop.Model{Value: User{}}).TableName()+" SET email_otp_attempts = email_otp_attempts + 1 WHERE id = ?", u.ID).Exec(); err != nil {
+		return false, errors.Wrap(err, "error incrementing email otp attempts")
+	}
+
+	updated, err := FindUserByID(tx, u.ID)
+	if err != nil {
+		return false, err
+	}
+
+	u.EmailOtpAttempts = updated.EmailOtpAttempts
+	if u.EmailOtpAttempts < maxAttempts {
+		return false, nil
+	}
+
+	u.ConfirmationToken = ""
+	u.RecoveryToken = ""
+	u.EmailChangeTokenCurrent = ""
+	u.EmailChangeTokenNew = ""
+	u.EmailOtpAttempts = 0
+
+	return true, tx.UpdateOnly(u, "confirmation_token", "recovery_token", "email_change_token_current", "email_change_token_new", "email_otp_attempts")
+}
+
+// IsLocked returns true if password logins are locked after too many failed
+// attempts.
+func (u *User) IsLocked() bool {
+	return u.LockedUntil != nil && time.Now().Before(*u.LockedUntil)
+}
+
+// IncrementFailedLoginAttempts records a failed password login. Once
+// maxAttempts is reached, password logins are locked for lockoutDuration
+// and true is returned.
+func (u *User) IncrementFailedLoginAttempts(tx *storage.Connection, maxAttempts int, lockoutDuration time.Duration) (bool, error) {
+	// incrementing in the database locks the row, so that concurrent
+	// attempts are all counted
+	if err := tx.RawQuery("UPDATE "+(&pop.Model{Value: User{}}).TableName()+" SET failed_login_attempts = failed_login_attempts + 1 WHERE id = ?", u.ID).Exec(); err != nil {
+		return false, errors.Wrap(err, "error incrementing failed login attempts")
+	}
+
+	updated, err := FindUserByID(tx, u.ID)
+	if err != nil {
+		return false, err
+	}
+
+	u.FailedLoginAttempts = updated.FailedLoginAttempts
+	if u.FailedLoginAttempts < maxAttempts {
+		return false, nil
+	}
+
+	lockedUntil := time.Now().Add(lockoutDuration)
+	u.LockedUntil = &lockedUntil
+	u.FailedLoginAttempts = 0
+
+	return true, tx.UpdateOnly(u, "failed_login_attempts", "locked_until")
+}
+
+// ResetFailedLoginAttempts clears the failed password logins and unlocks
+// password logins.
+func (u *User) ResetFailedLoginAttempts(tx *storage.Connection) error {
+	if u.FailedLoginAttempts == 0 && u.LockedUntil == nil {
+		return nil
+	}
+
+	u.FailedLoginAttempts = 0
+	u.LockedUntil = nil
+
+	return tx.UpdateOnly(u, "failed_login_attempts", "locked_until")
+}
+
+// SetLocale updates the user's preferred locale.
+func (u *User) SetLocale(tx *storage.Connection, locale string) error {
+	u.Locale = locale
+	return tx.UpdateOnly(u, "locale")
+}
+
+// UnconfirmEmail marks the user's email address as not confirmed.
+func (u *User) UnconfirmEmail(tx *storage.Connection) error {
+	u.EmailConfirmedAt = nil
+	return tx.UpdateOnly(u, "email_confirmed_at")
+}
+
+// UnconfirmPhone marks the user's phone number as not confirmed.
+func (u *User) UnconfirmPhone(tx *storage.Connection) error {
+	u.PhoneConfirmedAt = nil
+	return tx.UpdateOnly(u, "phone_confirmed_at")
+}
+
 // ConfirmPhone resets the confimation token and sets the confirm timestamp
 func (u *User) ConfirmPhone(tx *storage.Connection) error {
 	u.ConfirmationToken = ""
@@ -500,10 +643,14 @@ func FindUserWithRefreshToken(tx *storage.Connection, token string, forUpdate bo
 }
 
 // FindUsersInAudience finds users with the matching audience.
-func FindUsersInAudience(tx *storage.Connection, aud string, pageParams *Pagination, sortParams *SortParams, filter string) ([]*User, error) {
+func FindUsersInAudience(tx *storage.Connection, aud string, pageParams *Pagination, sortParams *SortParams, filter string, includeDeleted bool) ([]*User, error) {
 	users := []*User{}
 	q := tx.Q().Where("instance_id = ? and aud = ?", uuid.Nil, aud)
 
+	if !includeDeleted {
+		q = q.Where("deleted_at is null")
+	}
+
 	if filter != "" {
 		lf := "%" + filter + "%"
 		// we must specify the collation in order to get case insensitive search for the JSON column
@@ -527,6 +674,69 @@ func FindUsersInAudience(tx *storage.Connection, aud string, pageParams *Paginat
 	return users, err
 }
 
+// likeEscaper escapes the wildcards of LIKE patterns using the \ escape
+// character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// UserFilter selects the users of an audience for batch operations. Soft
+// deleted users are never selected.
+type UserFilter struct {
+	// EmailDomain selects users whose email address is in the domain.
+	EmailDomain string `json:"email_domain,omitempty"`
+	// CreatedBefore selects users created before the time.
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	// NeverConfirmed selects users who never confirmed their email address
+	// or phone number.
+	NeverConfirmed bool `json:"never_confirmed,omitempty"`
+}
+
+// IsEmpty reports whether the filter selects all users.
+func (f *UserFilter) IsEmpty() bool {
+	return f.EmailDomain == "" && f.CreatedBefore == nil && !f.NeverConfirmed
+}
+
+func (f *UserFilter) query(tx *storage.Connection, aud string) *pop.Query {
+	q := tx.Q().Where("instance_id = ? and aud = ? and deleted_at is null", uuid.Nil, aud)
+
+	if f.EmailDomain != "" {
+		// the domain is matched literally, so that wildcards in it never
+		// select other users
+		q = q.Where(`lower(email) like ? escape '\'`, "%@"+likeEscaper.Replace(strings.ToLower(f.EmailDomain)))
+	}
+
+	if f.CreatedBefore != nil {
+		q = q.Where("created_at < ?", *f.CreatedBefore)
+	}
+
+	if f.NeverConfirmed {
+		q = q.Where("email_confirmed_at is null and phone_confirmed_at is null")
+	}
+
+	return q
+}
+
+// CountFilteredUsers returns the number of users of the audience selected
+// by the filter.
+func CountFilteredUsers(tx *storage.Connection, aud string, filter *UserFilter) (int, error) {
+	count, err := filter.query(tx, aud).Count(&User{})
+	if err != nil {
+		return 0, errors.Wrap(err, "error counting users")
+	}
+
+	return count, nil
+}
+
+// FindFilteredUsers returns up to limit users of the audience selected by
+// the filter, oldest first.
+func FindFilteredUsers(tx *storage.Connection, aud string, filter *UserFilter, limit int) ([]*User, error) {
+	users := []*User{}
+	if err := filter.query(tx, aud).Order("created_at asc").Limit(limit).All(&users); err != nil {
+		return nil, errors.Wrap(err, "error finding users")
+	}
+
+	return users, nil
+}
+
 // FindUserByEmailChangeCurrentAndAudience finds a user with the matching email change and audience.
 func FindUserByEmailChangeCurrentAndAudience(tx *storage.Connection, email, token, aud string) (*User, error) {
 	return findUser(
@@ -627,6 +837,12 @@ func (u *User) Ban(tx *storage.Connection, duration time.Duration) error {
 	return tx.UpdateOnly(u, "banned_until")
 }
 
+// HasPendingInvite returns whether the user was invited and hasn't accepted
+// the invite yet.
+func (u *User) HasPendingInvite() bool {
+	return u.InvitedAt != nil && !u.IsConfirmed()
+}
+
 // IsBanned checks if a user is banned or not
 func (u *User) IsBanned() bool {
 	if u.BannedUntil == nil {
@@ -639,6 +855,26 @@ func (u *User) UpdateBannedUntil(tx *storage.Connection) error {
 	return tx.UpdateOnly(u, "banned_until")
 }
 
+// MarkDeleted soft deletes the user, keeping all of its data so that it can
+// be restored. Unlike SoftDeleteUser, the user's email and phone stay in use.
+func (u *User) MarkDeleted(tx *storage.Connection) error {
+	now := time.Now()
+	u.DeletedAt = &now
+	return tx.UpdateOnly(u, "deleted_at")
+}
+
+// Restore restores a soft deleted user.
+func (u *User) Restore(tx *storage.Connection) error {
+	u.DeletedAt = nil
+	return tx.UpdateOnly(u, "deleted_at")
+}
+
+// IsDeleted reports whether the user is soft deleted. Soft deleted users
+// can't sign in.
+func (u *User) IsDeleted() bool {
+	return u.DeletedAt != nil
+}
+
 // RemoveUnconfirmedIdentities removes potentially malicious unconfirmed identities from a user (if any)
 func (u *User) RemoveUnconfirmedIdentities(tx *storage.Connection) error {
 	if u.IsConfirmed() {
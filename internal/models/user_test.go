@@ -102,7 +102,7 @@ func (ts *UserTestSuite) TestFindUserByEmailAndAudience() {
 func (ts *UserTestSuite) TestFindUsersInAudience() {
 	u := ts.createUser()
 
-	n, err := FindUsersInAudience(ts.db, u.Aud, nil, nil, "")
+	n, err := FindUsersInAudience(ts.db, u.Aud, nil, nil, "", false)
 	require.NoError(ts.T(), err)
 	require.Len(ts.T(), n, 1)
 
@@ -110,7 +110,7 @@ func (ts *UserTestSuite) TestFindUsersInAudience() {
 		Page:    1,
 		PerPage: 50,
 	}
-	n, err = FindUsersInAudience(ts.db, u.Aud, &p, nil, "")
+	n, err = FindUsersInAudience(ts.db, u.Aud, &p, nil, "", false)
 	require.NoError(ts.T(), err)
 	require.Len(ts.T(), n, 1)
 	assert.Equal(ts.T(), uint64(1), p.Count)
@@ -120,11 +120,34 @@ func (ts *UserTestSuite) TestFindUsersInAudience() {
 			{Name: "created_at", Dir: Descending},
 		},
 	}
-	n, err = FindUsersInAudience(ts.db, u.Aud, nil, sp, "")
+	n, err = FindUsersInAudience(ts.db, u.Aud, nil, sp, "", false)
 	require.NoError(ts.T(), err)
 	require.Len(ts.T(), n, 1)
 }
 
+func (ts *UserTestSuite) TestFilteredUsersEmailDomain() {
+	ts.createUserWithEmail("first@example.com")
+	ts.createUserWithEmail("second@EXAMPLE.com")
+	ts.createUserWithEmail("third@notexample.com")
+
+	for domain, expected := range map[string]int{
+		"example.com":  2,
+		"Example.COM":  2,
+		"%":            0,
+		"_%":           0,
+		"%example.com": 0,
+		"exampl_.com":  0,
+	} {
+		count, err := CountFilteredUsers(ts.db, "test", &UserFilter{EmailDomain: domain})
+		require.NoError(ts.T(), err)
+		require.Equal(ts.T(), expected, count, domain)
+
+		users, err := FindFilteredUsers(ts.db, "test", &UserFilter{EmailDomain: domain}, 10)
+		require.NoError(ts.T(), err)
+		require.Len(ts.T(), users, expected, domain)
+	}
+}
+
 func (ts *UserTestSuite) TestFindUserByID() {
 	u := ts.createUser()
 
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/supabase/gotrue/internal/storage"
+)
+
+// WebhookDeadLetter is an event webhook that could not be delivered after
+// all retries. The payload is kept as sent, so that it can be replayed.
+type WebhookDeadLetter struct {
+	ID        uuid.UUID `json:"id" db:"id"`
+	URL       string    `json:"url" db:"url"`
+	Event     string    `json:"event" db:"event"`
+	Payload   string    `json:"payload" db:"payload"`
+	Attempts  int       `json:"attempts" db:"attempts"`
+	LastError string    `json:"last_error" db:"last_error"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+func (WebhookDeadLetter) TableName() string {
+	tableName := "webhook_dead_letters"
+	return tableName
+}
+
+// CreateWebhookDeadLetter stores an undeliverable event webhook.
+func CreateWebhookDeadLetter(tx *storage.Connection, url, event string, payload []byte, attempts int, lastError error) (*WebhookDeadLetter, error) {
+	deadLetter := &WebhookDeadLetter{
+		ID:        uuid.Must(uuid.NewV4()),
+		URL:       url,
+		Event:     event,
+		Payload:   string(payload),
+		Attempts:  attempts,
+		LastError: lastError.Error(),
+	}
+
+	if err := tx.Create(deadLetter); err != nil {
+		return nil, errors.Wrap(err, "Database error creating webhook dead letter")
+	}
+
+	return deadLetter, nil
+}
+
+// FindWebhookDeadLetters returns the undeliverable event webhooks, oldest
+// first.
+func FindWebhookDeadLetters(tx *storage.Connection) ([]*WebhookDeadLetter, error) {
+	deadLetters := []*WebhookDeadLetter{}
+	if err := tx.Q().Order("created_at asc").All(&deadLetters); err != nil {
+		return nil, errors.Wrap(err, "Database error finding webhook dead letters")
+	}
+
+	return deadLetters, nil
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/supabase/gotrue/internal/conf"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
@@ -39,6 +40,19 @@ func ObtainMetricCounter(name, desc string) metricCounter {
 	return counter
 }
 
+type metricHistogram interface {
+	Record(ctx context.Context, value float64, attrs ...attribute.KeyValue)
+}
+
+func ObtainMetricHistogram(name, desc string) metricHistogram {
+	histogram, err := Meter("gotrue").SyncFloat64().Histogram(name, metricinstrument.WithDescription(desc))
+	if err != nil {
+		panic(err)
+	}
+
+	return histogram
+}
+
 func enablePrometheusMetrics(ctx context.Context, mc *conf.MetricsConfig) error {
 	controller := basicmetriccontroller.New(
 		basicmetricprocessor.NewFactory(
@@ -17,6 +17,7 @@ import (
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
@@ -30,6 +31,26 @@ func Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
 	return otel.Tracer(name, opts...)
 }
 
+// StartChildSpan starts a span as a child of the span in the context, with
+// the tracer provider of that span. No span is recorded unless the caller
+// traces the operation, so it is disabled along with the caller's tracing.
+func StartChildSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer("gotrue").Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan records the outcome of the span's operation and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("gotrue.outcome", "failure"))
+	} else {
+		span.SetAttributes(attribute.String("gotrue.outcome", "success"))
+	}
+
+	span.End()
+}
+
 func openTelemetryResource() *sdkresource.Resource {
 	environmentResource := sdkresource.Environment()
 	gotrueResource := sdkresource.NewSchemaless(attribute.String("gotrue.version", utilities.Version))
@@ -45,7 +45,9 @@ func init() {
 	Client = &http.Client{Timeout: defaultTimeout}
 }
 
-func VerifyRequest(r *http.Request, secretKey, captchaProvider string) (VerificationResponse, error) {
+// VerifyRequest verifies the captcha_token of the request with the captcha
+// provider. The verify URL defaults to the provider's siteverify endpoint.
+func VerifyRequest(r *http.Request, secretKey, captchaProvider, verifyURL string) (VerificationResponse, error) {
 	bodyBytes, err := utilities.GetBodyBytes(r)
 	if err != nil {
 		return VerificationResponse{}, err
@@ -64,9 +66,12 @@ func VerifyRequest(r *http.Request, secretKey, captchaProvider string) (Verifica
 	}
 
 	clientIP := utilities.GetIPAddress(r)
-	captchaURL, err := GetCaptchaURL(captchaProvider)
-	if err != nil {
-		return VerificationResponse{}, err
+	captchaURL := verifyURL
+	if captchaURL == "" {
+		captchaURL, err = GetCaptchaURL(captchaProvider)
+		if err != nil {
+			return VerificationResponse{}, err
+		}
 	}
 
 	return verifyCaptchaCode(captchaResponse, secretKey, clientIP, captchaURL)
@@ -91,6 +96,10 @@ func verifyCaptchaCode(token, secretKey, clientIP, captchaURL string) (Verificat
 	}
 	defer utilities.SafeClose(res.Body)
 
+	if res.StatusCode != http.StatusOK {
+		return VerificationResponse{}, fmt.Errorf("failed to verify captcha response: provider returned status %d", res.StatusCode)
+	}
+
 	var verificationResponse VerificationResponse
 
 	if err := json.NewDecoder(res.Body).Decode(&verificationResponse); err != nil {
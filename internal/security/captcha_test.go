@@ -0,0 +1,75 @@
+package security
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newCaptchaRequest(t *testing.T, token string) *http.Request {
+	body, err := json.Marshal(map[string]interface{}{
+		"email": "test@example.com",
+		"gotrue_meta_security": map[string]interface{}{
+			"captcha_token": token,
+		},
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/signup", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func TestVerifyRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "secret", r.PostForm.Get("secret"))
+
+		switch r.PostForm.Get("response") {
+		case "valid":
+			w.Write([]byte(`{"success": true, "hostname": "localhost"}`))
+		case "invalid":
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+		case "not-json":
+			w.Write([]byte(`<html></html>`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	result, err := VerifyRequest(newCaptchaRequest(t, "valid"), "secret", "turnstile", server.URL)
+	require.NoError(t, err)
+	require.True(t, result.Success)
+
+	result, err = VerifyRequest(newCaptchaRequest(t, "invalid"), "secret", "hcaptcha", server.URL)
+	require.NoError(t, err)
+	require.False(t, result.Success)
+	require.Equal(t, []string{"invalid-input-response"}, result.ErrorCodes)
+
+	_, err = VerifyRequest(newCaptchaRequest(t, "provider-error"), "secret", "hcaptcha", server.URL)
+	require.EqualError(t, err, "failed to verify captcha response: provider returned status 500")
+
+	_, err = VerifyRequest(newCaptchaRequest(t, "not-json"), "secret", "hcaptcha", server.URL)
+	require.Error(t, err)
+
+	_, err = VerifyRequest(newCaptchaRequest(t, " "), "secret", "hcaptcha", server.URL)
+	require.EqualError(t, err, "no captcha response (captcha_token) found in request")
+}
+
+func TestGetCaptchaURL(t *testing.T) {
+	captchaURL, err := GetCaptchaURL("hcaptcha")
+	require.NoError(t, err)
+	require.Equal(t, "https://hcaptcha.com/siteverify", captchaURL)
+
+	captchaURL, err = GetCaptchaURL("turnstile")
+	require.NoError(t, err)
+	require.Equal(t, "https://challenges.cloudflare.com/turnstile/v0/siteverify", captchaURL)
+
+	_, err = GetCaptchaURL("recaptcha")
+	require.Error(t, err)
+}
@@ -0,0 +1,182 @@
+package security
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Character classes that can be required in passwords.
+const (
+	LowercaseCharacters = "lowercase"
+	UppercaseCharacters = "uppercase"
+	DigitCharacters     = "digits"
+	SymbolCharacters    = "symbols"
+)
+
+// CharacterClasses lists all supported character classes.
+var CharacterClasses = []string{
+	LowercaseCharacters,
+	UppercaseCharacters,
+	DigitCharacters,
+	SymbolCharacters,
+}
+
+// MaxPasswordStrengthScore is the score of the strongest passwords.
+const MaxPasswordStrengthScore = 4
+
+// commonPasswords are among the most used passwords, which are always
+// guessed first.
+var commonPasswords = map[string]bool{
+	"123456":     true,
+	"123456789":  true,
+	"12345678":   true,
+	"1234567890": true,
+	"password":   true,
+	"password1":  true,
+	"qwerty":     true,
+	"qwerty123":  true,
+	"qwertyuiop": true,
+	"abc123":     true,
+	"111111":     true,
+	"123123":     true,
+	"iloveyou":   true,
+	"admin":      true,
+	"welcome":    true,
+	"letmein":    true,
+	"monkey":     true,
+	"dragon":     true,
+	"football":   true,
+	"baseball":   true,
+	"sunshine":   true,
+	"princess":   true,
+	"master":     true,
+	"shadow":     true,
+	"superman":   true,
+	"trustno1":   true,
+	"passw0rd":   true,
+	"changeme":   true,
+	"secret":     true,
+}
+
+// keyboardRows are used to detect keyboard walks such as "qwerty" or "asdf".
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+func characterClass(r rune) string {
+	switch {
+	case unicode.IsLower(r):
+		return LowercaseCharacters
+
+	case unicode.IsUpper(r):
+		return UppercaseCharacters
+
+	case unicode.IsDigit(r):
+		return DigitCharacters
+
+	default:
+		return SymbolCharacters
+	}
+}
+
+// PasswordCharacterClasses returns the set of character classes used in the
+// password.
+func PasswordCharacterClasses(password string) map[string]bool {
+	classes := make(map[string]bool)
+
+	for _, r := range password {
+		classes[characterClass(r)] = true
+	}
+
+	return classes
+}
+
+func isKeyboardNeighbour(a, b rune) bool {
+	a, b = unicode.ToLower(a), unicode.ToLower(b)
+
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		if i >= 0 && i+1 < len(row) && rune(row[i+1]) == b {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PasswordStrengthScore estimates how hard the password is to guess, in the
+// spirit of zxcvbn: 0 is too guessable, 1 very guessable, 2 somewhat
+// guessable, 3 safely unguessable and 4 very unguessable. Common passwords,
+// repeated characters, sequences such as "abcd" or "1234" and keyboard walks
+// such as "qwerty" contribute little to the score. Parts of the password
+// that match one of the userInputs, e.g. the email address, are ignored.
+func PasswordStrengthScore(password string, userInputs ...string) int {
+	lowered := strings.ToLower(password)
+
+	if commonPasswords[lowered] {
+		return 0
+	}
+
+	for _, input := range userInputs {
+		input = strings.ToLower(input)
+		if len(input) >= 3 {
+			lowered = strings.ReplaceAll(lowered, input, "")
+		}
+	}
+
+	runes := []rune(lowered)
+	if len(runes) == 0 {
+		return 0
+	}
+
+	// characters that are predictable from the previous character only
+	// count as a fraction of an unpredictable one
+	effectiveLength := 1.0
+	for i := 1; i < len(runes); i++ {
+		previous, current := runes[i-1], runes[i]
+
+		if current == previous || current == previous+1 || current == previous-1 || isKeyboardNeighbour(previous, current) {
+			effectiveLength += 0.25
+		} else {
+			effectiveLength += 1
+		}
+	}
+
+	charsetSize := 0
+	for class := range PasswordCharacterClasses(password) {
+		switch class {
+		case LowercaseCharacters, UppercaseCharacters:
+			charsetSize += 26
+
+		case DigitCharacters:
+			charsetSize += 10
+
+		case SymbolCharacters:
+			charsetSize += 33
+		}
+	}
+
+	// log10 of the estimated number of guesses, with thresholds as in zxcvbn
+	guesses := effectiveLength * math.Log10(float64(charsetSize))
+
+	switch {
+	case guesses < 3:
+		return 0
+
+	case guesses < 6:
+		return 1
+
+	case guesses < 8:
+		return 2
+
+	case guesses < 10:
+		return 3
+
+	default:
+		return MaxPasswordStrengthScore
+	}
+}
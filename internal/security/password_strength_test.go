@@ -0,0 +1,42 @@
+package security
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordStrengthScore(t *testing.T) {
+	cases := []struct {
+		password   string
+		userInputs []string
+		score      int
+	}{
+		{password: "password", score: 0},
+		{password: "12345678", score: 0},
+		{password: "qwertyuiop", score: 0},
+		{password: "aaaaaaaaaa", score: 1},
+		{password: "abcdefgh", score: 1},
+		{password: "test123", score: 2},
+		{password: "Tr0ub4dor&3", score: 4},
+		{password: "correct horse battery staple", score: 4},
+		{password: "alice1990!", userInputs: []string{"alice"}, score: 2},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.score, PasswordStrengthScore(c.password, c.userInputs...), "password %q", c.password)
+	}
+}
+
+func TestPasswordCharacterClasses(t *testing.T) {
+	require.Equal(t, map[string]bool{
+		LowercaseCharacters: true,
+		UppercaseCharacters: true,
+		DigitCharacters:     true,
+		SymbolCharacters:    true,
+	}, PasswordCharacterClasses("aB3$"))
+
+	require.Equal(t, map[string]bool{
+		LowercaseCharacters: true,
+	}, PasswordCharacterClasses("abc"))
+}
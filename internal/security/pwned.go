@@ -0,0 +1,65 @@
+package security
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1" //#nosec G505 -- SHA-1 is mandated by the Pwned Passwords range API
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/supabase/gotrue/internal/utilities"
+)
+
+// IsPwnedPassword checks the password against the Pwned Passwords corpus of
+// breached passwords using the k-anonymity range API: only the first 5
+// characters of the password's SHA-1 hash are sent, and the returned hash
+// suffixes are compared locally.
+func IsPwnedPassword(ctx context.Context, client *http.Client, baseURL, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password)) //#nosec G401 -- SHA-1 is mandated by the Pwned Passwords range API
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/range/"+prefix, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't initialize request object for pwned passwords check")
+	}
+
+	// padding hides the size of the response, the padded entries have a
+	// count of 0
+	req.Header.Set("Add-Padding", "true")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to query pwned passwords")
+	}
+	defer utilities.SafeClose(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("pwned passwords responded with HTTP status %d", res.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		entrySuffix, entryCount, found := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !found || !strings.EqualFold(entrySuffix, suffix) {
+			continue
+		}
+
+		count, err := strconv.Atoi(entryCount)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to parse pwned passwords response")
+		}
+
+		return count > 0, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, errors.Wrap(err, "failed to read pwned passwords response")
+	}
+
+	return false, nil
+}
@@ -0,0 +1,183 @@
+package security
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// SlidingWindowLimiter limits the number of events per key within a sliding
+// time window. Unlike a token bucket it does not allow bursts above the
+// limit at window boundaries.
+type SlidingWindowLimiter struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	events    map[string][]time.Time
+	lastSweep time.Time
+}
+
+// NewSlidingWindowLimiter creates a limiter for events in the given window.
+func NewSlidingWindowLimiter(window time.Duration) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Allow records an event for key at now and returns true, unless limit
+// events have already been recorded for key within the window.
+func (l *SlidingWindowLimiter) Allow(key string, limit int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	start := now.Add(-l.window)
+
+	// forget keys without recent events, so that the limiter doesn't grow
+	// with every key it has ever seen
+	if now.Sub(l.lastSweep) > l.window {
+		for k, events := range l.events {
+			if len(events) == 0 || !events[len(events)-1].After(start) {
+				delete(l.events, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	events := l.events[key]
+
+	i := 0
+	for i < len(events) && !events[i].After(start) {
+		i++
+	}
+	events = events[i:]
+
+	if len(events) >= limit {
+		l.events[key] = events
+		return false
+	}
+
+	l.events[key] = append(events, now)
+	return true
+}
+
+// TokenBucketLimiter limits the rate of events per key with token buckets
+// that hold up to burst tokens and refill at rate tokens per second. It
+// behaves like the expirable limiters of tollbooth, which it replaces, but
+// also reports the state of the bucket, so that clients can be told how many
+// requests they have left.
+type TokenBucketLimiter struct {
+	rate  float64
+	burst int
+	ttl   time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	expires time.Time
+}
+
+// RateLimitStatus is the state of a bucket after an event was taken from it.
+type RateLimitStatus struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+
+	// RetryAfter is the time until the next event is allowed, if this one
+	// wasn't.
+	RetryAfter time.Duration
+}
+
+// NewTokenBucketLimiter creates a limiter that allows rate events per second
+// and bursts of up to burst events. Buckets are forgotten ttl after they were
+// created, so they start out full again.
+func NewTokenBucketLimiter(rate float64, burst int, ttl time.Duration) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		rate:    rate,
+		burst:   burst,
+		ttl:     ttl,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Take takes a token from the bucket of key at now, if there is one, and
+// returns the resulting state of the bucket.
+func (l *TokenBucketLimiter) Take(key string, now time.Time) RateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ttl > 0 && now.Sub(l.lastSweep) > l.ttl {
+		for k, bucket := range l.buckets {
+			if now.After(bucket.expires) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok || (l.ttl > 0 && now.After(bucket.expires)) {
+		bucket = &tokenBucket{
+			tokens:  float64(l.burst),
+			last:    now,
+			expires: now.Add(l.ttl),
+		}
+		l.buckets[key] = bucket
+	}
+
+	tokens := bucket.tokens
+	if elapsed := now.Sub(bucket.last); elapsed > 0 && l.rate > 0 {
+		tokens = math.Min(float64(l.burst), tokens+elapsed.Seconds()*l.rate)
+	}
+
+	status := RateLimitStatus{
+		Limit: l.burst,
+	}
+
+	// like golang.org/x/time/rate, the bucket is only updated when a token
+	// is taken, so that denied events don't change when tokens are refilled
+	if tokens >= 1 {
+		tokens -= 1
+		bucket.tokens = tokens
+		bucket.last = now
+		status.Allowed = true
+	} else {
+		status.RetryAfter = l.refillTime(bucket, now, 1-tokens)
+	}
+
+	status.Remaining = int(math.Floor(tokens))
+	status.Reset = l.refillTime(bucket, now, float64(l.burst)-tokens)
+
+	return status
+}
+
+// refillTime returns the time it takes to refill the tokens of the bucket,
+// or the time until the bucket is forgotten, whichever is shorter.
+func (l *TokenBucketLimiter) refillTime(bucket *tokenBucket, now time.Time, tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+
+	expiry := time.Duration(math.MaxInt64)
+	if l.ttl > 0 {
+		expiry = bucket.expires.Sub(now)
+	}
+
+	if l.rate <= 0 {
+		return expiry
+	}
+
+	if refill := time.Duration(tokens / l.rate * float64(time.Second)); refill < expiry {
+		return refill
+	}
+
+	return expiry
+}
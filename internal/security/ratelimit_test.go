@@ -0,0 +1,126 @@
+package security
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	limiter := NewSlidingWindowLimiter(time.Hour)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		require.True(t, limiter.Allow("a@example.com", 3, now.Add(time.Duration(i)*time.Minute)))
+	}
+	require.False(t, limiter.Allow("a@example.com", 3, now.Add(10*time.Minute)))
+
+	// other keys have their own budget
+	require.True(t, limiter.Allow("b@example.com", 3, now.Add(10*time.Minute)))
+
+	// the oldest event leaves the window
+	require.True(t, limiter.Allow("a@example.com", 3, now.Add(time.Hour+time.Second)))
+	require.False(t, limiter.Allow("a@example.com", 3, now.Add(time.Hour+2*time.Second)))
+
+	// denied events are not recorded
+	require.True(t, limiter.Allow("a@example.com", 3, now.Add(time.Hour+2*time.Minute)))
+}
+
+func TestSlidingWindowLimiterSweep(t *testing.T) {
+	limiter := NewSlidingWindowLimiter(time.Minute)
+	now := time.Now()
+
+	require.True(t, limiter.Allow("a@example.com", 1, now))
+	require.True(t, limiter.Allow("b@example.com", 1, now.Add(2*time.Minute)))
+	require.Len(t, limiter.events, 1)
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	// bursts of 3, refilled at one token every 4 seconds
+	limiter := NewTokenBucketLimiter(0.25, 3, time.Hour)
+	now := time.Now()
+
+	for i := 2; i >= 0; i-- {
+		status := limiter.Take("a", now)
+		require.True(t, status.Allowed)
+		require.Equal(t, 3, status.Limit)
+		require.Equal(t, i, status.Remaining)
+		require.Equal(t, time.Duration(3-i)*4*time.Second, status.Reset)
+	}
+
+	status := limiter.Take("a", now.Add(2*time.Second))
+	require.False(t, status.Allowed)
+	require.Equal(t, 0, status.Remaining)
+	require.Equal(t, 2*time.Second, status.RetryAfter)
+	require.Equal(t, 10*time.Second, status.Reset)
+
+	// other keys have their own bucket
+	require.True(t, limiter.Take("b", now).Allowed)
+
+	status = limiter.Take("a", now.Add(4*time.Second))
+	require.True(t, status.Allowed)
+	require.Equal(t, 0, status.Remaining)
+
+	// buckets are refilled up to the burst
+	status = limiter.Take("a", now.Add(time.Minute))
+	require.True(t, status.Allowed)
+	require.Equal(t, 2, status.Remaining)
+	require.Equal(t, 4*time.Second, status.Reset)
+}
+
+func TestTokenBucketLimiterTTL(t *testing.T) {
+	limiter := NewTokenBucketLimiter(0, 1, time.Minute)
+	now := time.Now()
+
+	require.True(t, limiter.Take("a", now).Allowed)
+
+	status := limiter.Take("a", now.Add(30*time.Second))
+	require.False(t, status.Allowed)
+	require.Equal(t, 30*time.Second, status.RetryAfter)
+	require.Equal(t, 30*time.Second, status.Reset)
+
+	// like with tollbooth, buckets are forgotten ttl after they were
+	// created, even if they are still in use
+	require.False(t, limiter.Take("a", now.Add(time.Minute)).Allowed)
+	require.True(t, limiter.Take("a", now.Add(time.Minute+time.Nanosecond)).Allowed)
+
+	// unused buckets are swept
+	require.True(t, limiter.Take("b", now.Add(3*time.Minute)).Allowed)
+	require.Len(t, limiter.buckets, 1)
+}
+
+// TestTokenBucketLimiterParity checks that the limiter allows the same
+// events as the limiters of golang.org/x/time/rate that tollbooth used.
+func TestTokenBucketLimiterParity(t *testing.T) {
+	for _, example := range []struct {
+		rate  float64
+		burst int
+	}{
+		{30.0 / (60 * 5), 30},
+		{150.0 / (60 * 5), 30},
+		{30.0 / (60 * 60), 30},
+		{1.0 / 60, 3},
+		{0.25, 3},
+		{0, 2},
+	} {
+		limiter := NewTokenBucketLimiter(example.rate, example.burst, 0)
+		reference := rate.NewLimiter(rate.Limit(example.rate), example.burst)
+
+		// events arrive about as fast as they are allowed on average
+		interval := time.Second
+		if example.rate > 0 {
+			interval = time.Duration(2 / example.rate * float64(time.Second))
+		}
+
+		random := rand.New(rand.NewSource(1))
+		now := time.Now()
+
+		for i := 0; i < 10000; i++ {
+			now = now.Add(time.Duration(random.Int63n(int64(interval))))
+			require.Equal(t, reference.AllowN(now, 1), limiter.Take("key", now).Allowed, "rate %v burst %d event %d", example.rate, example.burst, i)
+		}
+	}
+}
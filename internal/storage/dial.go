@@ -19,6 +19,11 @@ import (
 // Connection is the interface a storage provider must implement.
 type Connection struct {
 	*pop.Connection
+
+	// afterCommit holds the functions to run once the transaction of
+	// the connection commits, shared by all connections of the
+	// transaction.
+	afterCommit *[]func() error
 }
 
 // Dial will connect to that storage engine
@@ -85,7 +90,7 @@ func Dial(config *conf.GlobalConfiguration) (*Connection, error) {
 		registerOpenTelemetryDatabaseStats(db)
 	}
 
-	return &Connection{db}, nil
+	return &Connection{Connection: db}, nil
 }
 
 func registerOpenTelemetryDatabaseStats(db *pop.Connection) {
@@ -114,17 +119,76 @@ func registerOpenTelemetryDatabaseStats(db *pop.Connection) {
 
 func (c *Connection) Transaction(fn func(*Connection) error) error {
 	if c.TX == nil {
-		return c.Connection.Transaction(func(tx *pop.Connection) error {
-			return fn(&Connection{tx})
-		})
+		var afterCommit []func() error
+
+		if err := c.Connection.Transaction(func(tx *pop.Connection) error {
+			return fn(&Connection{Connection: tx, afterCommit: &afterCommit})
+		}); err != nil {
+			return err
+		}
+
+		for _, fn := range afterCommit {
+			if err := fn(); err != nil {
+				return err
+			}
+		}
+
+		return nil
 	}
 	return fn(c)
 }
 
+// AfterCommit runs fn once the transaction of the connection commits, or
+// right away outside of a transaction. It's meant for work that must not
+// hold the transaction open or be undone by a rollback, such as calling
+// external services. An error returned by fn is returned by Transaction,
+// even though the transaction has already been committed.
+func (c *Connection) AfterCommit(fn func() error) error {
+	if c.afterCommit == nil {
+		return fn()
+	}
+
+	*c.afterCommit = append(*c.afterCommit, fn)
+	return nil
+}
+
+// Savepoint runs fn in a savepoint of the transaction, rolling back only the
+// changes made by fn if it fails, so that the transaction can still be used
+// afterwards. Outside of a transaction, fn runs in a new transaction.
+func (c *Connection) Savepoint(name string, fn func(*Connection) error) error {
+	if c.TX == nil {
+		return c.Transaction(fn)
+	}
+
+	if err := c.RawQuery("SAVEPOINT " + name).Exec(); err != nil {
+		return err
+	}
+
+	var afterCommit int
+	if c.afterCommit != nil {
+		afterCommit = len(*c.afterCommit)
+	}
+
+	if err := fn(c); err != nil {
+		// whatever fn registered to run after the commit is rolled back too
+		if c.afterCommit != nil {
+			*c.afterCommit = (*c.afterCommit)[:afterCommit]
+		}
+
+		if rerr := c.RawQuery("ROLLBACK TO SAVEPOINT " + name).Exec(); rerr != nil {
+			return errors.Wrap(err, rerr.Error())
+		}
+
+		return err
+	}
+
+	return c.RawQuery("RELEASE SAVEPOINT " + name).Exec()
+}
+
 // WithContext returns a new connection with an updated context. This is
 // typically used for tracing as the context contains trace span information.
 func (c *Connection) WithContext(ctx context.Context) *Connection {
-	return &Connection{c.Connection.WithContext(ctx)}
+	return &Connection{Connection: c.Connection.WithContext(ctx), afterCommit: c.afterCommit}
 }
 
 func getExcludedColumns(model interface{}, includeColumns ...string) ([]string, error) {
@@ -1,6 +1,7 @@
 package utilities
 
 import (
+	"database/sql/driver"
 	"errors"
 	"strconv"
 	"strings"
@@ -70,3 +71,29 @@ func getHttpStatusCodeFromPostgresErrorCode(code string) int {
 
 	return 0
 }
+
+// IsTransientPostgresError checks if the error is caused by a temporary
+// condition of the database, such as it being read-only during a failover,
+// lost connections or lock timeouts, rather than by the statement itself.
+func IsTransientPostgresError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	switch pgErr.Code {
+	case pgerrcode.ReadOnlySQLTransaction,
+		pgerrcode.LockNotAvailable,
+		pgerrcode.SerializationFailure,
+		pgerrcode.DeadlockDetected:
+		return true
+	}
+
+	return pgerrcode.IsConnectionException(pgErr.Code) ||
+		pgerrcode.IsInsufficientResources(pgErr.Code) ||
+		pgerrcode.IsOperatorIntervention(pgErr.Code)
+}
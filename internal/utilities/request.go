@@ -2,11 +2,15 @@ package utilities
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/supabase/gotrue/internal/conf"
 )
@@ -39,6 +43,111 @@ func GetIPAddress(r *http.Request) string {
 	return ip
 }
 
+// GetClientIPAddress returns the IP address of the client that sent the
+// request. Unlike GetIPAddress the X-Forwarded-For header is only honored
+// when the request came through one of the trusted proxies, which are given
+// as IP addresses or CIDR ranges. The header is walked from right to left and
+// the first address not belonging to a trusted proxy is returned.
+func GetClientIPAddress(r *http.Request, trustedProxies []string) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	if r.Header == nil || !isTrustedProxy(ip, trustedProxies) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// the header was tampered with before it reached a trusted
+			// proxy, so the last trusted hop is the best we know
+			break
+		}
+
+		ip = hop
+		if !isTrustedProxy(hop, trustedProxies) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func isTrustedProxy(ip string, trustedProxies []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, proxy := range trustedProxies {
+		if strings.Contains(proxy, "/") {
+			if _, network, err := net.ParseCIDR(proxy); err == nil && network.Contains(parsed) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxUserAgentLength is the number of bytes of a user agent that are kept.
+const maxUserAgentLength = 512
+
+// NormalizeUserAgent collapses whitespace and strips control characters from
+// a User-Agent header and truncates it to a storable length.
+func NormalizeUserAgent(userAgent string) string {
+	userAgent = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError {
+			return -1
+		}
+
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+
+		if unicode.IsControl(r) {
+			return -1
+		}
+
+		return r
+	}, userAgent)
+
+	userAgent = strings.Join(strings.Fields(userAgent), " ")
+
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+		for !utf8.ValidString(userAgent) {
+			userAgent = userAgent[:len(userAgent)-1]
+		}
+	}
+
+	return userAgent
+}
+
+// ClientKeyHeader is the request header in which clients send a key that is
+// included in their ClientFingerprint, e.g. one generated on installation.
+const ClientKeyHeader = "X-Client-Key"
+
+// ClientFingerprint returns a hash of the client's user agent and
+// ClientKeyHeader, which identifies the client of a session.
+func ClientFingerprint(r *http.Request) string {
+	hash := sha256.New()
+	hash.Write([]byte(NormalizeUserAgent(r.Header.Get("User-Agent"))))
+	hash.Write([]byte{0})
+	hash.Write([]byte(r.Header.Get(ClientKeyHeader)))
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
 // GetBodyBytes reads the whole request body properly into a byte array.
 func GetBodyBytes(req *http.Request) ([]byte, error) {
 	if req.Body == nil || req.Body == http.NoBody {
@@ -60,7 +169,7 @@ func GetBodyBytes(req *http.Request) ([]byte, error) {
 
 func GetReferrer(r *http.Request, config *conf.GlobalConfiguration) string {
 	// try get redirect url from query or post data first
-	reqref := getRedirectTo(r)
+	reqref := GetRedirectTo(r)
 	if IsRedirectURLValid(config, reqref) {
 		return reqref
 	}
@@ -97,8 +206,8 @@ func IsRedirectURLValid(config *conf.GlobalConfiguration, redirectURL string) bo
 	return false
 }
 
-// getRedirectTo tries extract redirect url from header or from query params
-func getRedirectTo(r *http.Request) (reqref string) {
+// GetRedirectTo tries extract redirect url from header or from query params
+func GetRedirectTo(r *http.Request) (reqref string) {
 	reqref = r.Header.Get("redirect_to")
 	if reqref != "" {
 		return
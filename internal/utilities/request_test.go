@@ -3,6 +3,7 @@ package utilities
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	tst "testing"
 
 	"github.com/stretchr/testify/require"
@@ -88,6 +89,93 @@ func TestGetIPAddress(t *tst.T) {
 	}
 }
 
+func TestGetClientIPAddress(t *tst.T) {
+	trustedProxies := []string{"10.0.0.0/8", "192.0.2.1"}
+
+	cases := []struct {
+		desc          string
+		remoteAddr    string
+		xForwardedFor []string
+		expected      string
+	}{
+		{
+			desc:       "no forwarded header",
+			remoteAddr: "203.0.113.7:8080",
+			expected:   "203.0.113.7",
+		},
+		{
+			desc:          "untrusted proxy",
+			remoteAddr:    "203.0.113.7:8080",
+			xForwardedFor: []string{"198.51.100.1"},
+			expected:      "203.0.113.7",
+		},
+		{
+			desc:          "trusted proxy address",
+			remoteAddr:    "192.0.2.1:8080",
+			xForwardedFor: []string{"198.51.100.1"},
+			expected:      "198.51.100.1",
+		},
+		{
+			desc:          "chain of trusted proxies",
+			remoteAddr:    "10.0.0.1:8080",
+			xForwardedFor: []string{"198.51.100.1, 10.1.2.3", "10.0.0.2"},
+			expected:      "198.51.100.1",
+		},
+		{
+			desc:          "spoofed entries before the client are ignored",
+			remoteAddr:    "10.0.0.1:8080",
+			xForwardedFor: []string{"127.0.0.1, 198.51.100.1"},
+			expected:      "198.51.100.1",
+		},
+		{
+			desc:          "invalid entry stops at the last trusted hop",
+			remoteAddr:    "10.0.0.1:8080",
+			xForwardedFor: []string{"not-an-ip, 10.0.0.2"},
+			expected:      "10.0.0.2",
+		},
+		{
+			desc:          "only trusted proxies",
+			remoteAddr:    "10.0.0.1:8080",
+			xForwardedFor: []string{"10.0.0.3, 10.0.0.2"},
+			expected:      "10.0.0.3",
+		},
+		{
+			desc:          "IPv6 client",
+			remoteAddr:    "10.0.0.1:8080",
+			xForwardedFor: []string{"2001:db8::1"},
+			expected:      "2001:db8::1",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *tst.T) {
+			r := httptest.NewRequest("GET", "http://localhost", nil)
+			r.RemoteAddr = c.remoteAddr
+			for _, value := range c.xForwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			require.Equal(t, c.expected, GetClientIPAddress(r, trustedProxies))
+		})
+	}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.RemoteAddr = "192.0.2.1:8080"
+	r.Header.Add("X-Forwarded-For", "198.51.100.1")
+	require.Equal(t, "192.0.2.1", GetClientIPAddress(r, nil))
+}
+
+func TestNormalizeUserAgent(t *tst.T) {
+	require.Equal(t, "", NormalizeUserAgent(""))
+	require.Equal(t, "Mozilla/5.0 (X11; Linux x86_64)", NormalizeUserAgent("  Mozilla/5.0\t (X11;\r\nLinux x86_64)  "))
+	require.Equal(t, "curlbad", NormalizeUserAgent("curl\x00bad\xff"))
+
+	long := NormalizeUserAgent(strings.Repeat("a", 511) + "é")
+	require.Equal(t, strings.Repeat("a", 511), long)
+
+	require.Len(t, NormalizeUserAgent(strings.Repeat("a", 1000)), 512)
+}
+
 func TestGetReferrer(t *tst.T) {
 	config := conf.GlobalConfiguration{
 		SiteURL:      "https://example.com",
@@ -129,3 +217,78 @@ func TestGetReferrer(t *tst.T) {
 		})
 	}
 }
+
+func TestIsRedirectURLValid(t *tst.T) {
+	config := conf.GlobalConfiguration{
+		SiteURL: "https://example.com",
+		URIAllowList: []string{
+			"http://localhost:3000/welcome",
+			"https://*.example.org/**",
+			"myapp://callback",
+		},
+	}
+	config.ApplyDefaults()
+
+	cases := []struct {
+		desc        string
+		redirectURL string
+		expected    bool
+	}{
+		{
+			desc:        "empty",
+			redirectURL: "",
+			expected:    false,
+		},
+		{
+			desc:        "site url host",
+			redirectURL: "https://example.com/some/path",
+			expected:    true,
+		},
+		{
+			desc:        "exact match",
+			redirectURL: "http://localhost:3000/welcome",
+			expected:    true,
+		},
+		{
+			desc:        "exact match with different path",
+			redirectURL: "http://localhost:3000/other",
+			expected:    false,
+		},
+		{
+			desc:        "custom scheme",
+			redirectURL: "myapp://callback",
+			expected:    true,
+		},
+		{
+			desc:        "wildcard subdomain",
+			redirectURL: "https://app.example.org/",
+			expected:    true,
+		},
+		{
+			desc:        "wildcard subdomain with nested path",
+			redirectURL: "https://app.example.org/auth/callback",
+			expected:    true,
+		},
+		{
+			desc:        "wildcard subdomain does not match nested subdomains",
+			redirectURL: "https://evil.app.example.org/",
+			expected:    false,
+		},
+		{
+			desc:        "wildcard subdomain does not match other domains",
+			redirectURL: "https://app.example.org.evil.com/",
+			expected:    false,
+		},
+		{
+			desc:        "wildcard subdomain does not match other schemes",
+			redirectURL: "http://app.example.org/",
+			expected:    false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *tst.T) {
+			require.Equal(t, c.expected, IsRedirectURLValid(&config, c.redirectURL))
+		})
+	}
+}
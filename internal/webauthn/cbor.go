@@ -0,0 +1,206 @@
+package webauthn
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// maxCBORDepth limits the nesting of arrays and maps, authenticator
+	// data never comes close to it.
+	maxCBORDepth = 16
+
+	// maxCBORLength limits the size of the data that is decoded, and thus
+	// of byte and text strings. Attestation objects are a few KiB at
+	// most, even with certificate chains.
+	maxCBORLength = 64 * 1024
+
+	// maxCBORItems limits how many data items, including the items of
+	// arrays and the keys and values of maps, are decoded in total.
+	maxCBORItems = 1024
+)
+
+var errCBORTruncated = errors.New("webauthn: truncated CBOR data")
+
+// decodeCBOR decodes the first CBOR data item in data and returns it along
+// with the number of bytes it occupied. Only the subset of CBOR emitted by
+// authenticators is supported: definite length integers, byte and text
+// strings, arrays, maps and the simple values false, true and null.
+//
+// Integers are returned as int64, byte strings as []byte, text strings as
+// string, arrays as []interface{} and maps as map[interface{}]interface{}
+// with int64 or string keys.
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	if len(data) > maxCBORLength {
+		return nil, 0, errors.New("webauthn: CBOR data is too long")
+	}
+
+	d := &cborDecoder{data: data}
+
+	value, err := d.decode(0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return value, d.offset, nil
+}
+
+type cborDecoder struct {
+	data   []byte
+	offset int
+	items  int
+}
+
+func (d *cborDecoder) remaining() int {
+	return len(d.data) - d.offset
+}
+
+func (d *cborDecoder) readArgument(info byte) (uint64, error) {
+	var size int
+
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, fmt.Errorf("webauthn: unsupported CBOR additional information %d", info)
+	}
+
+	if d.remaining() < size {
+		return 0, errCBORTruncated
+	}
+
+	var argument uint64
+	for _, b := range d.data[d.offset : d.offset+size] {
+		argument = argument<<8 | uint64(b)
+	}
+	d.offset += size
+
+	return argument, nil
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxCBORDepth {
+		return nil, errors.New("webauthn: CBOR data is nested too deeply")
+	}
+
+	d.items += 1
+	if d.items > maxCBORItems {
+		return nil, errors.New("webauthn: CBOR data has too many items")
+	}
+
+	if d.remaining() < 1 {
+		return nil, errCBORTruncated
+	}
+
+	initial := d.data[d.offset]
+	d.offset += 1
+
+	major, info := initial>>5, initial&0x1f
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("webauthn: unsupported CBOR simple value %d", info)
+	}
+
+	argument, err := d.readArgument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		if argument > math.MaxInt64 {
+			return nil, errors.New("webauthn: CBOR integer overflows int64")
+		}
+		return int64(argument), nil
+
+	case 1:
+		if argument > math.MaxInt64 {
+			return nil, errors.New("webauthn: CBOR integer overflows int64")
+		}
+		return -1 - int64(argument), nil
+
+	case 2, 3:
+		if argument > uint64(d.remaining()) {
+			return nil, errCBORTruncated
+		}
+
+		value := d.data[d.offset : d.offset+int(argument)]
+		d.offset += int(argument)
+
+		if major == 3 {
+			return string(value), nil
+		}
+
+		return append([]byte(nil), value...), nil
+
+	case 4:
+		// every item occupies at least one byte
+		if argument > uint64(d.remaining()) {
+			return nil, errCBORTruncated
+		}
+
+		items := make([]interface{}, 0, int(argument))
+		for i := uint64(0); i < argument; i += 1 {
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+
+		return items, nil
+
+	case 5:
+		// every key and value occupies at least one byte
+		if argument > uint64(d.remaining()/2) {
+			return nil, errCBORTruncated
+		}
+
+		entries := make(map[interface{}]interface{}, int(argument))
+		for i := uint64(0); i < argument; i += 1 {
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, errors.New("webauthn: unsupported CBOR map key type")
+			}
+
+			if _, ok := entries[key]; ok {
+				return nil, errors.New("webauthn: duplicate CBOR map key")
+			}
+
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+
+			entries[key] = value
+		}
+
+		return entries, nil
+	}
+
+	return nil, fmt.Errorf("webauthn: unsupported CBOR major type %d", major)
+}
@@ -0,0 +1,454 @@
+// Package webauthn implements the relying party side of the Web
+// Authentication registration and assertion ceremonies.
+//
+// See: https://www.w3.org/TR/webauthn-2/#sctn-rp-operations
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// CeremonyCreate is the client data type of registration ceremonies.
+	CeremonyCreate = "webauthn.create"
+
+	// CeremonyGet is the client data type of assertion ceremonies.
+	CeremonyGet = "webauthn.get"
+
+	// PublicKeyCredentialType is the only credential type defined by WebAuthn.
+	PublicKeyCredentialType = "public-key"
+)
+
+// COSE algorithm identifiers supported for credential public keys.
+const (
+	AlgorithmES256 = -7
+	AlgorithmRS256 = -257
+)
+
+const (
+	flagUserPresent            = 0x01
+	flagAttestedCredentialData = 0x40
+)
+
+// ErrSignCountNotIncreased is returned when an assertion's signature counter
+// is not greater than the stored one, which signals that the authenticator
+// may have been cloned.
+var ErrSignCountNotIncreased = errors.New("webauthn: signature counter did not increase")
+
+// URLEncodedBytes is a byte slice encoded as unpadded base64url in JSON, the
+// encoding WebAuthn uses for binary values.
+type URLEncodedBytes []byte
+
+func (b URLEncodedBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *URLEncodedBytes) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return err
+	}
+
+	*b = decoded
+
+	return nil
+}
+
+// Credential is a public key credential registered with the relying party.
+type Credential struct {
+	ID        []byte `json:"id"`
+	PublicKey []byte `json:"public_key"`
+	Algorithm int    `json:"algorithm"`
+	SignCount uint32 `json:"sign_count"`
+}
+
+// PublicKeyCredential is the JSON form of the credential returned by
+// navigator.credentials.create() or navigator.credentials.get().
+type PublicKeyCredential struct {
+	ID       string                `json:"id"`
+	RawID    URLEncodedBytes       `json:"rawId"`
+	Type     string                `json:"type"`
+	Response AuthenticatorResponse `json:"response"`
+}
+
+// AuthenticatorResponse holds the fields of an AuthenticatorAttestationResponse
+// or an AuthenticatorAssertionResponse.
+type AuthenticatorResponse struct {
+	ClientDataJSON    URLEncodedBytes `json:"clientDataJSON"`
+	AttestationObject URLEncodedBytes `json:"attestationObject,omitempty"`
+	AuthenticatorData URLEncodedBytes `json:"authenticatorData,omitempty"`
+	Signature         URLEncodedBytes `json:"signature,omitempty"`
+	UserHandle        URLEncodedBytes `json:"userHandle,omitempty"`
+}
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          URLEncodedBytes `json:"id"`
+	Name        string          `json:"name"`
+	DisplayName string          `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type      string `json:"type"`
+	Algorithm int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string          `json:"type"`
+	ID   URLEncodedBytes `json:"id"`
+}
+
+type AuthenticatorSelection struct {
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the options passed to navigator.credentials.create()
+// as the publicKey member.
+type CreationOptions struct {
+	Challenge              URLEncodedBytes        `json:"challenge"`
+	RelyingParty           RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	CredentialParameters   []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	Attestation            string                 `json:"attestation"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+}
+
+// RequestOptions are the options passed to navigator.credentials.get() as
+// the publicKey member.
+type RequestOptions struct {
+	Challenge        URLEncodedBytes        `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RelyingPartyID   string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// RelyingParty verifies ceremonies for a single relying party ID.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+// CreationOptions returns the options for registering a new credential for
+// user. Attestation statements are not verified, so none is requested.
+func (rp *RelyingParty) CreationOptions(challenge []byte, user UserEntity, timeout time.Duration) *CreationOptions {
+	return &CreationOptions{
+		Challenge: challenge,
+		RelyingParty: RelyingPartyEntity{
+			ID:   rp.ID,
+			Name: rp.Name,
+		},
+		User: user,
+		CredentialParameters: []CredentialParameter{
+			{Type: PublicKeyCredentialType, Algorithm: AlgorithmES256},
+			{Type: PublicKeyCredentialType, Algorithm: AlgorithmRS256},
+		},
+		Timeout:     timeout.Milliseconds(),
+		Attestation: "none",
+		AuthenticatorSelection: AuthenticatorSelection{
+			UserVerification: "preferred",
+		},
+	}
+}
+
+// RequestOptions returns the options for asserting the credential.
+func (rp *RelyingParty) RequestOptions(challenge []byte, credential *Credential, timeout time.Duration) *RequestOptions {
+	return &RequestOptions{
+		Challenge:      challenge,
+		Timeout:        timeout.Milliseconds(),
+		RelyingPartyID: rp.ID,
+		AllowCredentials: []CredentialDescriptor{
+			{Type: PublicKeyCredentialType, ID: credential.ID},
+		},
+		UserVerification: "preferred",
+	}
+}
+
+// VerifyRegistration verifies the response to a registration ceremony
+// started with challenge and returns the newly registered credential.
+// Attestation statements are not verified, which is equivalent to the
+// relying party requesting "none" attestation.
+func (rp *RelyingParty) VerifyRegistration(challenge []byte, pkc *PublicKeyCredential) (*Credential, error) {
+	if pkc.Type != PublicKeyCredentialType {
+		return nil, fmt.Errorf("webauthn: unsupported credential type %q", pkc.Type)
+	}
+
+	if err := rp.verifyClientData(pkc.Response.ClientDataJSON, CeremonyCreate, challenge); err != nil {
+		return nil, err
+	}
+
+	attestationObject, _, err := decodeCBOR(pkc.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+
+	attestation, ok := attestationObject.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("webauthn: attestation object is not a map")
+	}
+
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("webauthn: attestation object has no authenticator data")
+	}
+
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	if authData.credentialID == nil {
+		return nil, errors.New("webauthn: authenticator data has no attested credential data")
+	}
+
+	if len(pkc.RawID) > 0 && !bytes.Equal(pkc.RawID, authData.credentialID) {
+		return nil, errors.New("webauthn: credential ID does not match attested credential data")
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(authData.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        authData.credentialID,
+		PublicKey: publicKey,
+		Algorithm: authData.algorithm,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// VerifyAssertion verifies the response to an assertion ceremony started
+// with challenge against credential and returns the new signature counter.
+// ErrSignCountNotIncreased is returned if the counter did not increase.
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, credential *Credential, pkc *PublicKeyCredential) (uint32, error) {
+	if pkc.Type != PublicKeyCredentialType {
+		return 0, fmt.Errorf("webauthn: unsupported credential type %q", pkc.Type)
+	}
+
+	if !bytes.Equal(pkc.RawID, credential.ID) {
+		return 0, errors.New("webauthn: credential ID does not match")
+	}
+
+	if err := rp.verifyClientData(pkc.Response.ClientDataJSON, CeremonyGet, challenge); err != nil {
+		return 0, err
+	}
+
+	authData, err := rp.parseAuthenticatorData(pkc.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(pkc.Response.ClientDataJSON)
+	signed := sha256.Sum256(append(append([]byte(nil), pkc.Response.AuthenticatorData...), clientDataHash[:]...))
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if credential.Algorithm != AlgorithmES256 || !ecdsa.VerifyASN1(key, signed[:], pkc.Response.Signature) {
+			return 0, errors.New("webauthn: invalid assertion signature")
+		}
+
+	case *rsa.PublicKey:
+		if credential.Algorithm != AlgorithmRS256 {
+			return 0, errors.New("webauthn: invalid assertion signature")
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, signed[:], pkc.Response.Signature); err != nil {
+			return 0, errors.New("webauthn: invalid assertion signature")
+		}
+
+	default:
+		return 0, errors.New("webauthn: unsupported credential public key")
+	}
+
+	// authenticators that don't implement a signature counter always
+	// report zero
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return 0, ErrSignCountNotIncreased
+	}
+
+	return authData.signCount, nil
+}
+
+func (rp *RelyingParty) verifyClientData(rawClientData []byte, ceremony string, challenge []byte) error {
+	var clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+
+	if err := json.Unmarshal(rawClientData, &clientData); err != nil {
+		return fmt.Errorf("webauthn: unable to parse client data: %w", err)
+	}
+
+	if clientData.Type != ceremony {
+		return fmt.Errorf("webauthn: unexpected client data type %q", clientData.Type)
+	}
+
+	if clientData.Challenge != base64.RawURLEncoding.EncodeToString(challenge) {
+		return errors.New("webauthn: challenge does not match")
+	}
+
+	for _, origin := range rp.Origins {
+		if clientData.Origin == origin {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("webauthn: origin %q is not allowed", clientData.Origin)
+}
+
+type authenticatorData struct {
+	flags     byte
+	signCount uint32
+
+	// only present if the attested credential data flag is set
+	credentialID []byte
+	publicKey    crypto.PublicKey
+	algorithm    int
+}
+
+func (rp *RelyingParty) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	// rpIdHash (32) || flags (1) || signCount (4)
+	if len(data) < 37 {
+		return nil, errors.New("webauthn: authenticator data is too short")
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return nil, errors.New("webauthn: relying party ID hash does not match")
+	}
+
+	authData := &authenticatorData{
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if authData.flags&flagUserPresent == 0 {
+		return nil, errors.New("webauthn: user was not present")
+	}
+
+	if authData.flags&flagAttestedCredentialData == 0 {
+		return authData, nil
+	}
+
+	// aaguid (16) || credentialIdLength (2) || credentialId || credentialPublicKey
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("webauthn: attested credential data is too short")
+	}
+
+	credentialIDLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < credentialIDLength {
+		return nil, errors.New("webauthn: attested credential data is too short")
+	}
+
+	authData.credentialID = append([]byte(nil), rest[:credentialIDLength]...)
+
+	coseKey, _, err := decodeCBOR(rest[credentialIDLength:])
+	if err != nil {
+		return nil, err
+	}
+
+	authData.publicKey, authData.algorithm, err = parseCOSEKey(coseKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return authData, nil
+}
+
+// The sizes of the RSA credential public keys that are accepted.
+const (
+	rsaMinModulusBits = 2048
+	rsaMaxModulusBits = 4096
+)
+
+// parseCOSEKey converts an EC2 P-256 or RSA COSE key into a public key.
+//
+// See: https://www.rfc-editor.org/rfc/rfc8152#section-13
+func parseCOSEKey(value interface{}) (crypto.PublicKey, int, error) {
+	key, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("webauthn: credential public key is not a map")
+	}
+
+	keyType, _ := key[int64(1)].(int64)
+	algorithm, _ := key[int64(3)].(int64)
+
+	switch {
+	case keyType == 2 && algorithm == AlgorithmES256:
+		curve, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+
+		if curve != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("webauthn: invalid EC2 credential public key")
+		}
+
+		// parsing the uncompressed point checks that it's on the
+		// curve and not the point at infinity
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, 0, errors.New("webauthn: EC2 credential public key is not on the curve")
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, AlgorithmES256, nil
+
+	case keyType == 3 && algorithm == AlgorithmRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+
+		modulus := new(big.Int).SetBytes(n)
+		if modulus.BitLen() < rsaMinModulusBits || modulus.BitLen() > rsaMaxModulusBits || len(e) == 0 || len(e) > 3 {
+			return nil, 0, errors.New("webauthn: invalid RSA credential public key")
+		}
+
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+
+		if exponent < 3 || exponent%2 == 0 {
+			return nil, 0, errors.New("webauthn: invalid RSA credential public key exponent")
+		}
+
+		return &rsa.PublicKey{N: modulus, E: exponent}, AlgorithmRS256, nil
+	}
+
+	return nil, 0, fmt.Errorf("webauthn: unsupported credential public key type %d with algorithm %d", keyType, algorithm)
+}
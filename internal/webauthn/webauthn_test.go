@@ -0,0 +1,394 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+var testRelyingParty = &RelyingParty{
+	ID:      testRPID,
+	Name:    "Example",
+	Origins: []string{testOrigin},
+}
+
+// testAuthenticator emulates an authenticator holding a single P-256
+// credential.
+type testAuthenticator struct {
+	t            testing.TB
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newTestAuthenticator(t testing.TB) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return &testAuthenticator{
+		t:            t,
+		key:          key,
+		credentialID: []byte("test-credential-id"),
+	}
+}
+
+func (a *testAuthenticator) clientData(ceremony string, challenge []byte, origin string) []byte {
+	clientData, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	require.NoError(a.t, err)
+
+	return clientData
+}
+
+func (a *testAuthenticator) authenticatorData(rpID string, flags byte, attestedCredentialData []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	return append(data, attestedCredentialData...)
+}
+
+func (a *testAuthenticator) create(challenge []byte, origin string) *PublicKeyCredential {
+	coseKey := encodeTestCBOR(map[interface{}]interface{}{
+		int64(1):  int64(2),
+		int64(3):  int64(AlgorithmES256),
+		int64(-1): int64(1),
+		int64(-2): a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		int64(-3): a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+
+	attestedCredentialData := make([]byte, 16)
+	attestedCredentialData = binary.BigEndian.AppendUint16(attestedCredentialData, uint16(len(a.credentialID)))
+	attestedCredentialData = append(attestedCredentialData, a.credentialID...)
+	attestedCredentialData = append(attestedCredentialData, coseKey...)
+
+	return &PublicKeyCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  PublicKeyCredentialType,
+		Response: AuthenticatorResponse{
+			ClientDataJSON: a.clientData(CeremonyCreate, challenge, origin),
+			AttestationObject: encodeTestCBOR(map[interface{}]interface{}{
+				"fmt":      "none",
+				"attStmt":  map[interface{}]interface{}{},
+				"authData": a.authenticatorData(testRPID, flagUserPresent|flagAttestedCredentialData, attestedCredentialData),
+			}),
+		},
+	}
+}
+
+func (a *testAuthenticator) get(challenge []byte, origin string) *PublicKeyCredential {
+	clientData := a.clientData(CeremonyGet, challenge, origin)
+	authData := a.authenticatorData(testRPID, flagUserPresent, nil)
+
+	clientDataHash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, signed[:])
+	require.NoError(a.t, err)
+
+	return &PublicKeyCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  PublicKeyCredentialType,
+		Response: AuthenticatorResponse{
+			ClientDataJSON:    clientData,
+			AuthenticatorData: authData,
+			Signature:         signature,
+		},
+	}
+}
+
+// encodeTestCBOR encodes the subset of CBOR decoded by decodeCBOR.
+func encodeTestCBOR(value interface{}) []byte {
+	head := func(major byte, argument uint64) []byte {
+		switch {
+		case argument < 24:
+			return []byte{major<<5 | byte(argument)}
+		case argument <= 0xff:
+			return []byte{major<<5 | 24, byte(argument)}
+		default:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(argument))
+		}
+	}
+
+	switch v := value.(type) {
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []interface{}:
+		data := head(4, uint64(len(v)))
+		for _, item := range v {
+			data = append(data, encodeTestCBOR(item)...)
+		}
+		return data
+	case map[interface{}]interface{}:
+		data := head(5, uint64(len(v)))
+		for key, item := range v {
+			data = append(data, encodeTestCBOR(key)...)
+			data = append(data, encodeTestCBOR(item)...)
+		}
+		return data
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	}
+
+	panic("unsupported CBOR test value")
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	value := map[interface{}]interface{}{
+		"text":    "value",
+		"bytes":   []byte{1, 2, 3},
+		int64(1):  int64(1000),
+		int64(-7): int64(-257),
+		"array":   []interface{}{true, false, nil},
+	}
+
+	encoded := encodeTestCBOR(value)
+
+	decoded, n, err := decodeCBOR(append(encoded, 0xff))
+	require.NoError(t, err)
+	require.Equal(t, value, decoded)
+	require.Equal(t, len(encoded), n)
+
+	for i := 0; i < len(encoded); i += 1 {
+		_, _, err := decodeCBOR(encoded[:i])
+		require.Error(t, err)
+	}
+
+	// indefinite length maps are not supported
+	_, _, err = decodeCBOR([]byte{0xbf, 0xff})
+	require.Error(t, err)
+}
+
+func TestDecodeCBORLimits(t *testing.T) {
+	nested := []interface{}{}
+	for i := 0; i < maxCBORDepth+1; i += 1 {
+		nested = []interface{}{nested}
+	}
+	_, _, err := decodeCBOR(encodeTestCBOR(nested))
+	require.ErrorContains(t, err, "nested too deeply")
+
+	items := make([]interface{}, maxCBORItems)
+	for i := range items {
+		items[i] = int64(0)
+	}
+	_, _, err = decodeCBOR(encodeTestCBOR(items))
+	require.ErrorContains(t, err, "too many items")
+
+	_, _, err = decodeCBOR(encodeTestCBOR(make([]byte, maxCBORLength)))
+	require.ErrorContains(t, err, "too long")
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	f.Add(encodeTestCBOR(map[interface{}]interface{}{
+		"text":    "value",
+		"bytes":   []byte{1, 2, 3},
+		int64(-7): []interface{}{true, false, nil},
+	}))
+	f.Add([]byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0xbf, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, n, err := decodeCBOR(data)
+		if err == nil && (n < 1 || n > len(data)) {
+			t.Fatalf("decoded %d bytes of %d", n, len(data))
+		}
+	})
+}
+
+func TestParseCOSEKey(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+	x := authenticator.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := authenticator.key.PublicKey.Y.FillBytes(make([]byte, 32))
+
+	ec2Key := func(x, y []byte) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			int64(1):  int64(2),
+			int64(3):  int64(AlgorithmES256),
+			int64(-1): int64(1),
+			int64(-2): x,
+			int64(-3): y,
+		}
+	}
+
+	key, algorithm, err := parseCOSEKey(ec2Key(x, y))
+	require.NoError(t, err)
+	require.Equal(t, AlgorithmES256, algorithm)
+	require.True(t, authenticator.key.PublicKey.Equal(key))
+
+	offCurve := append([]byte(nil), y...)
+	offCurve[31] ^= 1
+
+	rsaKey := func(n, e []byte) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			int64(1):  int64(3),
+			int64(3):  int64(AlgorithmRS256),
+			int64(-1): n,
+			int64(-2): e,
+		}
+	}
+
+	modulus := make([]byte, 256)
+	modulus[0] = 0x80
+
+	for i, invalid := range []map[interface{}]interface{}{
+		ec2Key(x, offCurve),
+		ec2Key(make([]byte, 32), make([]byte, 32)),
+		ec2Key(x[:31], y),
+		rsaKey(append([]byte{0}, modulus[1:]...), []byte{1, 0, 1}),
+		rsaKey(modulus, []byte{1}),
+		rsaKey(modulus, []byte{1, 0, 0}),
+		rsaKey(modulus, []byte{1, 0, 0, 1}),
+	} {
+		_, _, err := parseCOSEKey(invalid)
+		require.Error(t, err, "Invalid key %d was regarded as valid", i)
+	}
+
+	_, algorithm, err = parseCOSEKey(rsaKey(modulus, []byte{1, 0, 1}))
+	require.NoError(t, err)
+	require.Equal(t, AlgorithmRS256, algorithm)
+}
+
+func FuzzParseAuthenticatorData(f *testing.F) {
+	authenticator := newTestAuthenticator(f)
+	credential := authenticator.create([]byte("0123456789abcdef"), testOrigin)
+
+	attestation, _, err := decodeCBOR(credential.Response.AttestationObject)
+	require.NoError(f, err)
+
+	f.Add(attestation.(map[interface{}]interface{})["authData"].([]byte))
+	f.Add(authenticator.authenticatorData(testRPID, flagUserPresent, nil))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		authData, err := testRelyingParty.parseAuthenticatorData(data)
+		if err == nil && authData.flags&flagAttestedCredentialData != 0 && authData.publicKey == nil {
+			t.Fatal("attested credential data without a public key")
+		}
+	})
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+	challenge := []byte("0123456789abcdef")
+
+	credential, err := testRelyingParty.VerifyRegistration(challenge, authenticator.create(challenge, testOrigin))
+	require.NoError(t, err)
+	require.Equal(t, authenticator.credentialID, credential.ID)
+	require.Equal(t, AlgorithmES256, credential.Algorithm)
+	require.Equal(t, uint32(0), credential.SignCount)
+
+	_, err = testRelyingParty.VerifyRegistration([]byte("fedcba9876543210"), authenticator.create(challenge, testOrigin))
+	require.Error(t, err)
+
+	_, err = testRelyingParty.VerifyRegistration(challenge, authenticator.create(challenge, "https://evil.example.com"))
+	require.Error(t, err)
+
+	_, err = (&RelyingParty{ID: "other.example.com", Origins: []string{testOrigin}}).VerifyRegistration(challenge, authenticator.create(challenge, testOrigin))
+	require.Error(t, err)
+
+	// an assertion is not a registration
+	_, err = testRelyingParty.VerifyRegistration(challenge, authenticator.get(challenge, testOrigin))
+	require.Error(t, err)
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+	challenge := []byte("0123456789abcdef")
+
+	authenticator.signCount = 5
+	credential, err := testRelyingParty.VerifyRegistration(challenge, authenticator.create(challenge, testOrigin))
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), credential.SignCount)
+
+	authenticator.signCount = 6
+	signCount, err := testRelyingParty.VerifyAssertion(challenge, credential, authenticator.get(challenge, testOrigin))
+	require.NoError(t, err)
+	require.Equal(t, uint32(6), signCount)
+	credential.SignCount = signCount
+
+	_, err = testRelyingParty.VerifyAssertion([]byte("fedcba9876543210"), credential, authenticator.get(challenge, testOrigin))
+	require.Error(t, err)
+
+	_, err = testRelyingParty.VerifyAssertion(challenge, credential, authenticator.get(challenge, "https://evil.example.com"))
+	require.Error(t, err)
+
+	tampered := authenticator.get(challenge, testOrigin)
+	tampered.Response.Signature[len(tampered.Response.Signature)-1] ^= 0xff
+	_, err = testRelyingParty.VerifyAssertion(challenge, credential, tampered)
+	require.Error(t, err)
+
+	other := newTestAuthenticator(t)
+	other.signCount = 7
+	_, err = testRelyingParty.VerifyAssertion(challenge, credential, other.get(challenge, testOrigin))
+	require.Error(t, err)
+}
+
+func TestVerifyAssertionSignCount(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+	challenge := []byte("0123456789abcdef")
+
+	credential, err := testRelyingParty.VerifyRegistration(challenge, authenticator.create(challenge, testOrigin))
+	require.NoError(t, err)
+
+	// authenticators without a counter always report zero
+	_, err = testRelyingParty.VerifyAssertion(challenge, credential, authenticator.get(challenge, testOrigin))
+	require.NoError(t, err)
+
+	credential.SignCount = 10
+
+	for _, signCount := range []uint32{0, 9, 10} {
+		authenticator.signCount = signCount
+		_, err = testRelyingParty.VerifyAssertion(challenge, credential, authenticator.get(challenge, testOrigin))
+		require.ErrorIs(t, err, ErrSignCountNotIncreased)
+	}
+
+	authenticator.signCount = 11
+	signCount, err := testRelyingParty.VerifyAssertion(challenge, credential, authenticator.get(challenge, testOrigin))
+	require.NoError(t, err)
+	require.Equal(t, uint32(11), signCount)
+}
+
+func TestURLEncodedBytes(t *testing.T) {
+	var decoded struct {
+		Unpadded URLEncodedBytes `json:"unpadded"`
+		Padded   URLEncodedBytes `json:"padded"`
+	}
+
+	require.NoError(t, json.Unmarshal([]byte(`{"unpadded":"_-8","padded":"_-8="}`), &decoded))
+	require.Equal(t, URLEncodedBytes{0xff, 0xef}, decoded.Unpadded)
+	require.Equal(t, URLEncodedBytes{0xff, 0xef}, decoded.Padded)
+
+	encoded, err := json.Marshal(URLEncodedBytes{0xff, 0xef})
+	require.NoError(t, err)
+	require.Equal(t, `"_-8"`, string(encoded))
+}
@@ -0,0 +1,2 @@
+-- adds the public key credential of webauthn factors
+alter table {{ index .Options "Namespace" }}.mfa_factors add column if not exists web_authn_credential jsonb null;
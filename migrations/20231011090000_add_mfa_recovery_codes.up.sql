@@ -0,0 +1,13 @@
+-- auth.mfa_recovery_codes definition
+create table if not exists {{ index .Options "Namespace" }}.mfa_recovery_codes(
+       id uuid not null,
+       factor_id uuid not null,
+       code_hash text not null,
+       created_at timestamptz not null,
+       used_at timestamptz null,
+       constraint mfa_recovery_codes_pkey primary key (id),
+       constraint mfa_recovery_codes_factor_id_fkey foreign key (factor_id) references {{ index .Options "Namespace" }}.mfa_factors(id) on delete cascade
+);
+comment on table {{ index .Options "Namespace" }}.mfa_recovery_codes is 'auth: stores hashed single use recovery codes of factors';
+
+create unique index if not exists mfa_recovery_codes_factor_id_code_hash_idx on {{ index .Options "Namespace" }}.mfa_recovery_codes (factor_id, code_hash);
@@ -0,0 +1 @@
+alter table {{ index .Options "Namespace" }}.sessions add column if not exists last_active_at timestamptz null;
@@ -0,0 +1 @@
+alter table {{ index .Options "Namespace" }}.users add column if not exists is_anonymous boolean not null default false;
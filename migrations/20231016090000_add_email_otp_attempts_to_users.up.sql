@@ -0,0 +1 @@
+alter table {{ index .Options "Namespace" }}.users add column if not exists email_otp_attempts integer not null default 0;
@@ -0,0 +1,14 @@
+-- auth.webhook_dead_letters definition
+create table if not exists {{ index .Options "Namespace" }}.webhook_dead_letters(
+       id uuid not null,
+       url text not null,
+       event text not null,
+       payload jsonb not null,
+       attempts integer not null,
+       last_error text not null,
+       created_at timestamptz not null,
+       constraint webhook_dead_letters_pkey primary key (id)
+);
+comment on table {{ index .Options "Namespace" }}.webhook_dead_letters is 'auth: stores event webhooks that could not be delivered, for later replay';
+
+create index if not exists webhook_dead_letters_created_at_idx on {{ index .Options "Namespace" }}.webhook_dead_letters (created_at);
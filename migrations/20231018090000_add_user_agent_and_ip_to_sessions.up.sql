@@ -0,0 +1,2 @@
+alter table {{ index .Options "Namespace" }}.sessions add column if not exists user_agent text null;
+alter table {{ index .Options "Namespace" }}.sessions add column if not exists ip text null;
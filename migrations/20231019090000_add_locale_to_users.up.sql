@@ -0,0 +1 @@
+alter table {{ index .Options "Namespace" }}.users add column if not exists locale varchar(35) not null default '';
@@ -0,0 +1,2 @@
+alter table {{ index .Options "Namespace" }}.users add column if not exists failed_login_attempts integer not null default 0;
+alter table {{ index .Options "Namespace" }}.users add column if not exists locked_until timestamptz null;
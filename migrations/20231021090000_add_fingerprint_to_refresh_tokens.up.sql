@@ -0,0 +1 @@
+alter table {{ index .Options "Namespace" }}.refresh_tokens add column if not exists fingerprint varchar(64) null;
@@ -0,0 +1 @@
+alter table {{ index .Options "Namespace" }}.sessions add column if not exists client_id text null;
@@ -0,0 +1 @@
+alter table {{ index .Options "Namespace" }}.identities add column if not exists provider_refresh_token text null;
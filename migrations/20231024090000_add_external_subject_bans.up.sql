@@ -0,0 +1,12 @@
+-- auth.external_subject_bans definition
+create table if not exists {{ index .Options "Namespace" }}.external_subject_bans(
+       id uuid not null,
+       provider text not null,
+       subject text not null,
+       banned_until timestamptz null,
+       created_at timestamptz not null,
+       updated_at timestamptz not null,
+       constraint external_subject_bans_pkey primary key (id),
+       constraint external_subject_bans_provider_subject_key unique (provider, subject)
+);
+comment on table {{ index .Options "Namespace" }}.external_subject_bans is 'auth: stores subjects of external providers that may not sign in, optionally until a given time';
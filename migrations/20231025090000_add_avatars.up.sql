@@ -0,0 +1,12 @@
+-- auth.avatars definition
+create table if not exists {{ index .Options "Namespace" }}.avatars(
+       id uuid not null,
+       source_url text not null,
+       content_type text not null,
+       data bytea not null,
+       created_at timestamptz not null,
+       updated_at timestamptz not null,
+       constraint avatars_pkey primary key (id),
+       constraint avatars_source_url_key unique (source_url)
+);
+comment on table {{ index .Options "Namespace" }}.avatars is 'auth: stores copies of the profile pictures of external identities';